@@ -0,0 +1,1382 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: adminpb/admin.proto
+
+package adminpb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// Without an id and version, every failed extraction is retried
+type ReextractRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Version              string   `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReextractRequest) Reset()         { *m = ReextractRequest{} }
+func (m *ReextractRequest) String() string { return proto.CompactTextString(m) }
+func (*ReextractRequest) ProtoMessage()    {}
+func (*ReextractRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{0}
+}
+
+func (m *ReextractRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReextractRequest.Unmarshal(m, b)
+}
+func (m *ReextractRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReextractRequest.Marshal(b, m, deterministic)
+}
+func (m *ReextractRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReextractRequest.Merge(m, src)
+}
+func (m *ReextractRequest) XXX_Size() int {
+	return xxx_messageInfo_ReextractRequest.Size(m)
+}
+func (m *ReextractRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReextractRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReextractRequest proto.InternalMessageInfo
+
+func (m *ReextractRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *ReextractRequest) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+type ReextractResponse struct {
+	Statuses             []*ExtractionStatus `protobuf:"bytes,1,rep,name=statuses,proto3" json:"statuses,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}            `json:"-"`
+	XXX_unrecognized     []byte              `json:"-"`
+	XXX_sizecache        int32               `json:"-"`
+}
+
+func (m *ReextractResponse) Reset()         { *m = ReextractResponse{} }
+func (m *ReextractResponse) String() string { return proto.CompactTextString(m) }
+func (*ReextractResponse) ProtoMessage()    {}
+func (*ReextractResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{1}
+}
+
+func (m *ReextractResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReextractResponse.Unmarshal(m, b)
+}
+func (m *ReextractResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReextractResponse.Marshal(b, m, deterministic)
+}
+func (m *ReextractResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReextractResponse.Merge(m, src)
+}
+func (m *ReextractResponse) XXX_Size() int {
+	return xxx_messageInfo_ReextractResponse.Size(m)
+}
+func (m *ReextractResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReextractResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReextractResponse proto.InternalMessageInfo
+
+func (m *ReextractResponse) GetStatuses() []*ExtractionStatus {
+	if m != nil {
+		return m.Statuses
+	}
+	return nil
+}
+
+type ExtractionStatus struct {
+	Id      string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Version string `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	Status  string `protobuf:"bytes,3,opt,name=status,proto3" json:"status,omitempty"`
+	Error   string `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	// RFC 3339
+	Time                 string   `protobuf:"bytes,5,opt,name=time,proto3" json:"time,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ExtractionStatus) Reset()         { *m = ExtractionStatus{} }
+func (m *ExtractionStatus) String() string { return proto.CompactTextString(m) }
+func (*ExtractionStatus) ProtoMessage()    {}
+func (*ExtractionStatus) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{2}
+}
+
+func (m *ExtractionStatus) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ExtractionStatus.Unmarshal(m, b)
+}
+func (m *ExtractionStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ExtractionStatus.Marshal(b, m, deterministic)
+}
+func (m *ExtractionStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ExtractionStatus.Merge(m, src)
+}
+func (m *ExtractionStatus) XXX_Size() int {
+	return xxx_messageInfo_ExtractionStatus.Size(m)
+}
+func (m *ExtractionStatus) XXX_DiscardUnknown() {
+	xxx_messageInfo_ExtractionStatus.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ExtractionStatus proto.InternalMessageInfo
+
+func (m *ExtractionStatus) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *ExtractionStatus) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *ExtractionStatus) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *ExtractionStatus) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *ExtractionStatus) GetTime() string {
+	if m != nil {
+		return m.Time
+	}
+	return ""
+}
+
+type GetCacheStatsRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetCacheStatsRequest) Reset()         { *m = GetCacheStatsRequest{} }
+func (m *GetCacheStatsRequest) String() string { return proto.CompactTextString(m) }
+func (*GetCacheStatsRequest) ProtoMessage()    {}
+func (*GetCacheStatsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{3}
+}
+
+func (m *GetCacheStatsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetCacheStatsRequest.Unmarshal(m, b)
+}
+func (m *GetCacheStatsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetCacheStatsRequest.Marshal(b, m, deterministic)
+}
+func (m *GetCacheStatsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetCacheStatsRequest.Merge(m, src)
+}
+func (m *GetCacheStatsRequest) XXX_Size() int {
+	return xxx_messageInfo_GetCacheStatsRequest.Size(m)
+}
+func (m *GetCacheStatsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetCacheStatsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetCacheStatsRequest proto.InternalMessageInfo
+
+type CacheStats struct {
+	Hits                 uint64   `protobuf:"varint,1,opt,name=hits,proto3" json:"hits,omitempty"`
+	Misses               uint64   `protobuf:"varint,2,opt,name=misses,proto3" json:"misses,omitempty"`
+	Evictions            uint64   `protobuf:"varint,3,opt,name=evictions,proto3" json:"evictions,omitempty"`
+	Invalidations        uint64   `protobuf:"varint,4,opt,name=invalidations,proto3" json:"invalidations,omitempty"`
+	Entries              int64    `protobuf:"varint,5,opt,name=entries,proto3" json:"entries,omitempty"`
+	Bytes                int64    `protobuf:"varint,6,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	MaxBytes             int64    `protobuf:"varint,7,opt,name=max_bytes,json=maxBytes,proto3" json:"max_bytes,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CacheStats) Reset()         { *m = CacheStats{} }
+func (m *CacheStats) String() string { return proto.CompactTextString(m) }
+func (*CacheStats) ProtoMessage()    {}
+func (*CacheStats) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{4}
+}
+
+func (m *CacheStats) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CacheStats.Unmarshal(m, b)
+}
+func (m *CacheStats) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CacheStats.Marshal(b, m, deterministic)
+}
+func (m *CacheStats) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CacheStats.Merge(m, src)
+}
+func (m *CacheStats) XXX_Size() int {
+	return xxx_messageInfo_CacheStats.Size(m)
+}
+func (m *CacheStats) XXX_DiscardUnknown() {
+	xxx_messageInfo_CacheStats.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CacheStats proto.InternalMessageInfo
+
+func (m *CacheStats) GetHits() uint64 {
+	if m != nil {
+		return m.Hits
+	}
+	return 0
+}
+
+func (m *CacheStats) GetMisses() uint64 {
+	if m != nil {
+		return m.Misses
+	}
+	return 0
+}
+
+func (m *CacheStats) GetEvictions() uint64 {
+	if m != nil {
+		return m.Evictions
+	}
+	return 0
+}
+
+func (m *CacheStats) GetInvalidations() uint64 {
+	if m != nil {
+		return m.Invalidations
+	}
+	return 0
+}
+
+func (m *CacheStats) GetEntries() int64 {
+	if m != nil {
+		return m.Entries
+	}
+	return 0
+}
+
+func (m *CacheStats) GetBytes() int64 {
+	if m != nil {
+		return m.Bytes
+	}
+	return 0
+}
+
+func (m *CacheStats) GetMaxBytes() int64 {
+	if m != nil {
+		return m.MaxBytes
+	}
+	return 0
+}
+
+// Without an id, every package's versions are listed
+type ListPackagesRequest struct {
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// At most 100 if not set
+	PageSize             int32    `protobuf:"varint,2,opt,name=page_size,json=pageSize,proto3" json:"page_size,omitempty"`
+	PageToken            string   `protobuf:"bytes,3,opt,name=page_token,json=pageToken,proto3" json:"page_token,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListPackagesRequest) Reset()         { *m = ListPackagesRequest{} }
+func (m *ListPackagesRequest) String() string { return proto.CompactTextString(m) }
+func (*ListPackagesRequest) ProtoMessage()    {}
+func (*ListPackagesRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{5}
+}
+
+func (m *ListPackagesRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListPackagesRequest.Unmarshal(m, b)
+}
+func (m *ListPackagesRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListPackagesRequest.Marshal(b, m, deterministic)
+}
+func (m *ListPackagesRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListPackagesRequest.Merge(m, src)
+}
+func (m *ListPackagesRequest) XXX_Size() int {
+	return xxx_messageInfo_ListPackagesRequest.Size(m)
+}
+func (m *ListPackagesRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListPackagesRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListPackagesRequest proto.InternalMessageInfo
+
+func (m *ListPackagesRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *ListPackagesRequest) GetPageSize() int32 {
+	if m != nil {
+		return m.PageSize
+	}
+	return 0
+}
+
+func (m *ListPackagesRequest) GetPageToken() string {
+	if m != nil {
+		return m.PageToken
+	}
+	return ""
+}
+
+type ListPackagesResponse struct {
+	Packages []*PackageVersion `protobuf:"bytes,1,rep,name=packages,proto3" json:"packages,omitempty"`
+	// Empty on the last page
+	NextPageToken        string   `protobuf:"bytes,2,opt,name=next_page_token,json=nextPageToken,proto3" json:"next_page_token,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListPackagesResponse) Reset()         { *m = ListPackagesResponse{} }
+func (m *ListPackagesResponse) String() string { return proto.CompactTextString(m) }
+func (*ListPackagesResponse) ProtoMessage()    {}
+func (*ListPackagesResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{6}
+}
+
+func (m *ListPackagesResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListPackagesResponse.Unmarshal(m, b)
+}
+func (m *ListPackagesResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListPackagesResponse.Marshal(b, m, deterministic)
+}
+func (m *ListPackagesResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListPackagesResponse.Merge(m, src)
+}
+func (m *ListPackagesResponse) XXX_Size() int {
+	return xxx_messageInfo_ListPackagesResponse.Size(m)
+}
+func (m *ListPackagesResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListPackagesResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListPackagesResponse proto.InternalMessageInfo
+
+func (m *ListPackagesResponse) GetPackages() []*PackageVersion {
+	if m != nil {
+		return m.Packages
+	}
+	return nil
+}
+
+func (m *ListPackagesResponse) GetNextPageToken() string {
+	if m != nil {
+		return m.NextPageToken
+	}
+	return ""
+}
+
+type PackageVersion struct {
+	Id            string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Version       string `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	Listed        bool   `protobuf:"varint,3,opt,name=listed,proto3" json:"listed,omitempty"`
+	Size          int64  `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`
+	Hash          string `protobuf:"bytes,5,opt,name=hash,proto3" json:"hash,omitempty"`
+	HashAlgorithm string `protobuf:"bytes,6,opt,name=hash_algorithm,json=hashAlgorithm,proto3" json:"hash_algorithm,omitempty"`
+	// RFC 3339
+	Published            string   `protobuf:"bytes,7,opt,name=published,proto3" json:"published,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PackageVersion) Reset()         { *m = PackageVersion{} }
+func (m *PackageVersion) String() string { return proto.CompactTextString(m) }
+func (*PackageVersion) ProtoMessage()    {}
+func (*PackageVersion) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{7}
+}
+
+func (m *PackageVersion) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PackageVersion.Unmarshal(m, b)
+}
+func (m *PackageVersion) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PackageVersion.Marshal(b, m, deterministic)
+}
+func (m *PackageVersion) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PackageVersion.Merge(m, src)
+}
+func (m *PackageVersion) XXX_Size() int {
+	return xxx_messageInfo_PackageVersion.Size(m)
+}
+func (m *PackageVersion) XXX_DiscardUnknown() {
+	xxx_messageInfo_PackageVersion.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PackageVersion proto.InternalMessageInfo
+
+func (m *PackageVersion) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *PackageVersion) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *PackageVersion) GetListed() bool {
+	if m != nil {
+		return m.Listed
+	}
+	return false
+}
+
+func (m *PackageVersion) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *PackageVersion) GetHash() string {
+	if m != nil {
+		return m.Hash
+	}
+	return ""
+}
+
+func (m *PackageVersion) GetHashAlgorithm() string {
+	if m != nil {
+		return m.HashAlgorithm
+	}
+	return ""
+}
+
+func (m *PackageVersion) GetPublished() string {
+	if m != nil {
+		return m.Published
+	}
+	return ""
+}
+
+type SetListedRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Version              string   `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	Listed               bool     `protobuf:"varint,3,opt,name=listed,proto3" json:"listed,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SetListedRequest) Reset()         { *m = SetListedRequest{} }
+func (m *SetListedRequest) String() string { return proto.CompactTextString(m) }
+func (*SetListedRequest) ProtoMessage()    {}
+func (*SetListedRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{8}
+}
+
+func (m *SetListedRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SetListedRequest.Unmarshal(m, b)
+}
+func (m *SetListedRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SetListedRequest.Marshal(b, m, deterministic)
+}
+func (m *SetListedRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SetListedRequest.Merge(m, src)
+}
+func (m *SetListedRequest) XXX_Size() int {
+	return xxx_messageInfo_SetListedRequest.Size(m)
+}
+func (m *SetListedRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SetListedRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SetListedRequest proto.InternalMessageInfo
+
+func (m *SetListedRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *SetListedRequest) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *SetListedRequest) GetListed() bool {
+	if m != nil {
+		return m.Listed
+	}
+	return false
+}
+
+type SetListedResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SetListedResponse) Reset()         { *m = SetListedResponse{} }
+func (m *SetListedResponse) String() string { return proto.CompactTextString(m) }
+func (*SetListedResponse) ProtoMessage()    {}
+func (*SetListedResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{9}
+}
+
+func (m *SetListedResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SetListedResponse.Unmarshal(m, b)
+}
+func (m *SetListedResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SetListedResponse.Marshal(b, m, deterministic)
+}
+func (m *SetListedResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SetListedResponse.Merge(m, src)
+}
+func (m *SetListedResponse) XXX_Size() int {
+	return xxx_messageInfo_SetListedResponse.Size(m)
+}
+func (m *SetListedResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SetListedResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SetListedResponse proto.InternalMessageInfo
+
+type GetHealthRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetHealthRequest) Reset()         { *m = GetHealthRequest{} }
+func (m *GetHealthRequest) String() string { return proto.CompactTextString(m) }
+func (*GetHealthRequest) ProtoMessage()    {}
+func (*GetHealthRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{10}
+}
+
+func (m *GetHealthRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetHealthRequest.Unmarshal(m, b)
+}
+func (m *GetHealthRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetHealthRequest.Marshal(b, m, deterministic)
+}
+func (m *GetHealthRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetHealthRequest.Merge(m, src)
+}
+func (m *GetHealthRequest) XXX_Size() int {
+	return xxx_messageInfo_GetHealthRequest.Size(m)
+}
+func (m *GetHealthRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetHealthRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetHealthRequest proto.InternalMessageInfo
+
+// "ok", or "degraded" with the problems found
+type Health struct {
+	Status               string           `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Problems             []*HealthProblem `protobuf:"bytes,2,rep,name=problems,proto3" json:"problems,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *Health) Reset()         { *m = Health{} }
+func (m *Health) String() string { return proto.CompactTextString(m) }
+func (*Health) ProtoMessage()    {}
+func (*Health) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{11}
+}
+
+func (m *Health) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Health.Unmarshal(m, b)
+}
+func (m *Health) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Health.Marshal(b, m, deterministic)
+}
+func (m *Health) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Health.Merge(m, src)
+}
+func (m *Health) XXX_Size() int {
+	return xxx_messageInfo_Health.Size(m)
+}
+func (m *Health) XXX_DiscardUnknown() {
+	xxx_messageInfo_Health.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Health proto.InternalMessageInfo
+
+func (m *Health) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *Health) GetProblems() []*HealthProblem {
+	if m != nil {
+		return m.Problems
+	}
+	return nil
+}
+
+type HealthProblem struct {
+	Component string `protobuf:"bytes,1,opt,name=component,proto3" json:"component,omitempty"`
+	Message   string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	// RFC 3339
+	Since                string   `protobuf:"bytes,3,opt,name=since,proto3" json:"since,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *HealthProblem) Reset()         { *m = HealthProblem{} }
+func (m *HealthProblem) String() string { return proto.CompactTextString(m) }
+func (*HealthProblem) ProtoMessage()    {}
+func (*HealthProblem) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{12}
+}
+
+func (m *HealthProblem) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_HealthProblem.Unmarshal(m, b)
+}
+func (m *HealthProblem) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_HealthProblem.Marshal(b, m, deterministic)
+}
+func (m *HealthProblem) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_HealthProblem.Merge(m, src)
+}
+func (m *HealthProblem) XXX_Size() int {
+	return xxx_messageInfo_HealthProblem.Size(m)
+}
+func (m *HealthProblem) XXX_DiscardUnknown() {
+	xxx_messageInfo_HealthProblem.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_HealthProblem proto.InternalMessageInfo
+
+func (m *HealthProblem) GetComponent() string {
+	if m != nil {
+		return m.Component
+	}
+	return ""
+}
+
+func (m *HealthProblem) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
+func (m *HealthProblem) GetSince() string {
+	if m != nil {
+		return m.Since
+	}
+	return ""
+}
+
+type DeleteVersionRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Version              string   `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeleteVersionRequest) Reset()         { *m = DeleteVersionRequest{} }
+func (m *DeleteVersionRequest) String() string { return proto.CompactTextString(m) }
+func (*DeleteVersionRequest) ProtoMessage()    {}
+func (*DeleteVersionRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{13}
+}
+
+func (m *DeleteVersionRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteVersionRequest.Unmarshal(m, b)
+}
+func (m *DeleteVersionRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteVersionRequest.Marshal(b, m, deterministic)
+}
+func (m *DeleteVersionRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteVersionRequest.Merge(m, src)
+}
+func (m *DeleteVersionRequest) XXX_Size() int {
+	return xxx_messageInfo_DeleteVersionRequest.Size(m)
+}
+func (m *DeleteVersionRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteVersionRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteVersionRequest proto.InternalMessageInfo
+
+func (m *DeleteVersionRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *DeleteVersionRequest) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+type DeleteVersionResponse struct {
+	// Set when delete-mode is unlist, so the version was only unlisted
+	Unlisted             bool     `protobuf:"varint,1,opt,name=unlisted,proto3" json:"unlisted,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeleteVersionResponse) Reset()         { *m = DeleteVersionResponse{} }
+func (m *DeleteVersionResponse) String() string { return proto.CompactTextString(m) }
+func (*DeleteVersionResponse) ProtoMessage()    {}
+func (*DeleteVersionResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{14}
+}
+
+func (m *DeleteVersionResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteVersionResponse.Unmarshal(m, b)
+}
+func (m *DeleteVersionResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteVersionResponse.Marshal(b, m, deterministic)
+}
+func (m *DeleteVersionResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteVersionResponse.Merge(m, src)
+}
+func (m *DeleteVersionResponse) XXX_Size() int {
+	return xxx_messageInfo_DeleteVersionResponse.Size(m)
+}
+func (m *DeleteVersionResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteVersionResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteVersionResponse proto.InternalMessageInfo
+
+func (m *DeleteVersionResponse) GetUnlisted() bool {
+	if m != nil {
+		return m.Unlisted
+	}
+	return false
+}
+
+type ReindexRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReindexRequest) Reset()         { *m = ReindexRequest{} }
+func (m *ReindexRequest) String() string { return proto.CompactTextString(m) }
+func (*ReindexRequest) ProtoMessage()    {}
+func (*ReindexRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{15}
+}
+
+func (m *ReindexRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReindexRequest.Unmarshal(m, b)
+}
+func (m *ReindexRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReindexRequest.Marshal(b, m, deterministic)
+}
+func (m *ReindexRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReindexRequest.Merge(m, src)
+}
+func (m *ReindexRequest) XXX_Size() int {
+	return xxx_messageInfo_ReindexRequest.Size(m)
+}
+func (m *ReindexRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReindexRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReindexRequest proto.InternalMessageInfo
+
+type ReindexResponse struct {
+	// Versions found
+	Packages             int64    `protobuf:"varint,1,opt,name=packages,proto3" json:"packages,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReindexResponse) Reset()         { *m = ReindexResponse{} }
+func (m *ReindexResponse) String() string { return proto.CompactTextString(m) }
+func (*ReindexResponse) ProtoMessage()    {}
+func (*ReindexResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{16}
+}
+
+func (m *ReindexResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReindexResponse.Unmarshal(m, b)
+}
+func (m *ReindexResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReindexResponse.Marshal(b, m, deterministic)
+}
+func (m *ReindexResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReindexResponse.Merge(m, src)
+}
+func (m *ReindexResponse) XXX_Size() int {
+	return xxx_messageInfo_ReindexResponse.Size(m)
+}
+func (m *ReindexResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReindexResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReindexResponse proto.InternalMessageInfo
+
+func (m *ReindexResponse) GetPackages() int64 {
+	if m != nil {
+		return m.Packages
+	}
+	return 0
+}
+
+type SetReadOnlyRequest struct {
+	ReadOnly             bool     `protobuf:"varint,1,opt,name=read_only,json=readOnly,proto3" json:"read_only,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SetReadOnlyRequest) Reset()         { *m = SetReadOnlyRequest{} }
+func (m *SetReadOnlyRequest) String() string { return proto.CompactTextString(m) }
+func (*SetReadOnlyRequest) ProtoMessage()    {}
+func (*SetReadOnlyRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{17}
+}
+
+func (m *SetReadOnlyRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SetReadOnlyRequest.Unmarshal(m, b)
+}
+func (m *SetReadOnlyRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SetReadOnlyRequest.Marshal(b, m, deterministic)
+}
+func (m *SetReadOnlyRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SetReadOnlyRequest.Merge(m, src)
+}
+func (m *SetReadOnlyRequest) XXX_Size() int {
+	return xxx_messageInfo_SetReadOnlyRequest.Size(m)
+}
+func (m *SetReadOnlyRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SetReadOnlyRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SetReadOnlyRequest proto.InternalMessageInfo
+
+func (m *SetReadOnlyRequest) GetReadOnly() bool {
+	if m != nil {
+		return m.ReadOnly
+	}
+	return false
+}
+
+type ReadOnlyState struct {
+	ReadOnly             bool     `protobuf:"varint,1,opt,name=read_only,json=readOnly,proto3" json:"read_only,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReadOnlyState) Reset()         { *m = ReadOnlyState{} }
+func (m *ReadOnlyState) String() string { return proto.CompactTextString(m) }
+func (*ReadOnlyState) ProtoMessage()    {}
+func (*ReadOnlyState) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f34d8f9686a270bf, []int{18}
+}
+
+func (m *ReadOnlyState) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReadOnlyState.Unmarshal(m, b)
+}
+func (m *ReadOnlyState) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReadOnlyState.Marshal(b, m, deterministic)
+}
+func (m *ReadOnlyState) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReadOnlyState.Merge(m, src)
+}
+func (m *ReadOnlyState) XXX_Size() int {
+	return xxx_messageInfo_ReadOnlyState.Size(m)
+}
+func (m *ReadOnlyState) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReadOnlyState.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReadOnlyState proto.InternalMessageInfo
+
+func (m *ReadOnlyState) GetReadOnly() bool {
+	if m != nil {
+		return m.ReadOnly
+	}
+	return false
+}
+
+func init() {
+	proto.RegisterType((*ReextractRequest)(nil), "nugetserver.admin.ReextractRequest")
+	proto.RegisterType((*ReextractResponse)(nil), "nugetserver.admin.ReextractResponse")
+	proto.RegisterType((*ExtractionStatus)(nil), "nugetserver.admin.ExtractionStatus")
+	proto.RegisterType((*GetCacheStatsRequest)(nil), "nugetserver.admin.GetCacheStatsRequest")
+	proto.RegisterType((*CacheStats)(nil), "nugetserver.admin.CacheStats")
+	proto.RegisterType((*ListPackagesRequest)(nil), "nugetserver.admin.ListPackagesRequest")
+	proto.RegisterType((*ListPackagesResponse)(nil), "nugetserver.admin.ListPackagesResponse")
+	proto.RegisterType((*PackageVersion)(nil), "nugetserver.admin.PackageVersion")
+	proto.RegisterType((*SetListedRequest)(nil), "nugetserver.admin.SetListedRequest")
+	proto.RegisterType((*SetListedResponse)(nil), "nugetserver.admin.SetListedResponse")
+	proto.RegisterType((*GetHealthRequest)(nil), "nugetserver.admin.GetHealthRequest")
+	proto.RegisterType((*Health)(nil), "nugetserver.admin.Health")
+	proto.RegisterType((*HealthProblem)(nil), "nugetserver.admin.HealthProblem")
+	proto.RegisterType((*DeleteVersionRequest)(nil), "nugetserver.admin.DeleteVersionRequest")
+	proto.RegisterType((*DeleteVersionResponse)(nil), "nugetserver.admin.DeleteVersionResponse")
+	proto.RegisterType((*ReindexRequest)(nil), "nugetserver.admin.ReindexRequest")
+	proto.RegisterType((*ReindexResponse)(nil), "nugetserver.admin.ReindexResponse")
+	proto.RegisterType((*SetReadOnlyRequest)(nil), "nugetserver.admin.SetReadOnlyRequest")
+	proto.RegisterType((*ReadOnlyState)(nil), "nugetserver.admin.ReadOnlyState")
+}
+
+func init() { proto.RegisterFile("adminpb/admin.proto", fileDescriptor_f34d8f9686a270bf) }
+
+var fileDescriptor_f34d8f9686a270bf = []byte{
+	// 862 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x56, 0x5f, 0x8f, 0xdb, 0x44,
+	0x10, 0x57, 0xee, 0x92, 0xbb, 0x78, 0x4a, 0xae, 0xb9, 0xbd, 0xa3, 0x32, 0x3e, 0x2a, 0xa5, 0xcb,
+	0xb5, 0xbd, 0x07, 0x2e, 0x11, 0xad, 0x10, 0x0f, 0x14, 0x41, 0x0b, 0xa8, 0x48, 0x54, 0x22, 0x72,
+	0x4e, 0x87, 0x84, 0x04, 0xd1, 0x26, 0x1e, 0xd9, 0xab, 0xda, 0x6b, 0xe3, 0xdd, 0x44, 0xb9, 0x4a,
+	0xf0, 0xd5, 0x78, 0x46, 0xe2, 0x43, 0xa1, 0x5d, 0xaf, 0x1d, 0x27, 0xf8, 0x52, 0xee, 0xc9, 0x3b,
+	0xbf, 0x9d, 0x3f, 0x3b, 0x33, 0xbf, 0x99, 0x04, 0x4e, 0x58, 0x90, 0x70, 0x91, 0xcd, 0x46, 0xe6,
+	0x3b, 0xcc, 0xf2, 0x54, 0xa5, 0xe4, 0x58, 0x2c, 0x42, 0x54, 0x12, 0xf3, 0x25, 0xe6, 0x43, 0x73,
+	0x41, 0x5f, 0x40, 0xdf, 0x47, 0x5c, 0xa9, 0x9c, 0xcd, 0x95, 0x8f, 0xbf, 0x2f, 0x50, 0x2a, 0x72,
+	0x04, 0x7b, 0x3c, 0x70, 0x5b, 0x83, 0xd6, 0x85, 0xe3, 0xef, 0xf1, 0x80, 0xb8, 0x70, 0xb8, 0xc4,
+	0x5c, 0xf2, 0x54, 0xb8, 0x7b, 0x06, 0x2c, 0x45, 0x7a, 0x05, 0xc7, 0x35, 0x6b, 0x99, 0xa5, 0x42,
+	0x22, 0xf9, 0x1a, 0xba, 0x52, 0x31, 0xb5, 0x90, 0x28, 0xdd, 0xd6, 0x60, 0xff, 0xe2, 0xde, 0xb3,
+	0x4f, 0x86, 0xff, 0x09, 0x3c, 0xfc, 0xbe, 0xb0, 0xe2, 0xa9, 0x98, 0x18, 0x65, 0xbf, 0x32, 0xa2,
+	0x7f, 0x42, 0x7f, 0xfb, 0xf6, 0xff, 0xbf, 0x89, 0x3c, 0x80, 0x83, 0xc2, 0x93, 0xbb, 0x6f, 0x2e,
+	0xac, 0x44, 0x4e, 0xa1, 0x83, 0x79, 0x9e, 0xe6, 0x6e, 0xdb, 0xc0, 0x85, 0x40, 0x08, 0xb4, 0x15,
+	0x4f, 0xd0, 0xed, 0x18, 0xd0, 0x9c, 0xe9, 0x03, 0x38, 0x7d, 0x8d, 0xea, 0x5b, 0x36, 0x8f, 0x50,
+	0x47, 0x97, 0xb6, 0x2e, 0xf4, 0xef, 0x16, 0xc0, 0x1a, 0xd5, 0xa6, 0x11, 0x57, 0xd2, 0x3c, 0xaa,
+	0xed, 0x9b, 0xb3, 0x0e, 0x9e, 0x70, 0xa9, 0x33, 0xdf, 0x33, 0xa8, 0x95, 0xc8, 0xc7, 0xe0, 0xe0,
+	0x92, 0x9b, 0x84, 0x8a, 0x77, 0xb5, 0xfd, 0x35, 0x40, 0xce, 0xa1, 0xc7, 0xc5, 0x92, 0xc5, 0x3c,
+	0x60, 0x85, 0x46, 0xdb, 0x68, 0x6c, 0x82, 0x3a, 0x65, 0x14, 0x2a, 0xe7, 0x28, 0xcd, 0x6b, 0xf7,
+	0xfd, 0x52, 0xd4, 0xa9, 0xcd, 0x6e, 0x14, 0x4a, 0xf7, 0xc0, 0xe0, 0x85, 0x40, 0xce, 0xc0, 0x49,
+	0xd8, 0x6a, 0x5a, 0xdc, 0x1c, 0x9a, 0x9b, 0x6e, 0xc2, 0x56, 0xaf, 0xb4, 0x4c, 0x19, 0x9c, 0xbc,
+	0xe1, 0x52, 0x8d, 0xd9, 0xfc, 0x2d, 0x0b, 0x51, 0xde, 0xd6, 0xfa, 0x33, 0x70, 0x32, 0x16, 0xe2,
+	0x54, 0xf2, 0x77, 0x68, 0x52, 0xea, 0xf8, 0x5d, 0x0d, 0x4c, 0xf8, 0x3b, 0x24, 0x0f, 0x01, 0xcc,
+	0xa5, 0x4a, 0xdf, 0xa2, 0xb0, 0xd5, 0x36, 0xea, 0x57, 0x1a, 0xa0, 0x7f, 0xc0, 0xe9, 0x66, 0x08,
+	0xcb, 0x8f, 0xaf, 0xa0, 0x9b, 0x59, 0xcc, 0xf2, 0xe3, 0x51, 0x03, 0x3f, 0xac, 0xd9, 0x75, 0xd1,
+	0x55, 0xbf, 0x32, 0x21, 0x4f, 0xe0, 0xbe, 0xc0, 0x95, 0x9a, 0xd6, 0x42, 0x17, 0x0c, 0xe8, 0x69,
+	0x78, 0x5c, 0x85, 0xff, 0xab, 0x05, 0x47, 0x9b, 0x4e, 0xee, 0x46, 0xa2, 0x98, 0x4b, 0x85, 0x81,
+	0x49, 0xab, 0xeb, 0x5b, 0x49, 0xf7, 0xdc, 0x94, 0xa2, 0x6d, 0xca, 0x69, 0xce, 0x86, 0x07, 0x4c,
+	0x46, 0x25, 0x85, 0xf4, 0x99, 0x3c, 0x86, 0x23, 0xfd, 0x9d, 0xb2, 0x38, 0x4c, 0x73, 0xae, 0xa2,
+	0xc4, 0xb4, 0xc6, 0xf1, 0x7b, 0x1a, 0x7d, 0x59, 0x82, 0x9a, 0x16, 0xd9, 0x62, 0x16, 0x73, 0x19,
+	0x61, 0xe0, 0x1e, 0xda, 0x02, 0x96, 0x00, 0xbd, 0x82, 0xfe, 0x04, 0xd5, 0x1b, 0x13, 0xf9, 0xce,
+	0xb3, 0x79, 0x5b, 0x0a, 0xf4, 0x04, 0x8e, 0x6b, 0x5e, 0x8b, 0x9e, 0x50, 0x02, 0xfd, 0xd7, 0xa8,
+	0x7e, 0x40, 0x16, 0xab, 0xa8, 0xa4, 0xfb, 0x6f, 0x70, 0x50, 0x00, 0xb5, 0x91, 0x6a, 0x6d, 0x8c,
+	0xd4, 0x0b, 0xe8, 0x66, 0x79, 0x3a, 0x8b, 0x31, 0xd1, 0x7c, 0xd7, 0x9d, 0x1c, 0x34, 0x74, 0xb2,
+	0x70, 0x32, 0x2e, 0x14, 0xfd, 0xca, 0x82, 0xfe, 0x0a, 0xbd, 0x8d, 0x2b, 0x5d, 0x8d, 0x79, 0x9a,
+	0x64, 0xa9, 0x40, 0xa1, 0x6c, 0xa4, 0x35, 0xa0, 0x33, 0x4d, 0x50, 0x4a, 0x16, 0x62, 0x99, 0xa9,
+	0x15, 0x35, 0xfd, 0x25, 0x17, 0x73, 0xb4, 0x14, 0x2c, 0x04, 0xfa, 0x0d, 0x9c, 0x7e, 0x87, 0x31,
+	0xaa, 0x8a, 0x42, 0x77, 0xde, 0x6e, 0xcf, 0xe1, 0xc3, 0x2d, 0x0f, 0x96, 0xc1, 0x1e, 0x74, 0x17,
+	0xc2, 0x16, 0xb7, 0x65, 0x8a, 0x5b, 0xc9, 0xb4, 0x0f, 0x47, 0x3e, 0x72, 0x11, 0xe0, 0xaa, 0xac,
+	0xe3, 0x25, 0xdc, 0xaf, 0x90, 0xb5, 0x83, 0xda, 0x08, 0x98, 0xc9, 0x2c, 0x65, 0xfa, 0x19, 0x90,
+	0x09, 0x2a, 0x1f, 0x59, 0xf0, 0x93, 0x88, 0x6f, 0xca, 0x57, 0x9f, 0x81, 0x93, 0x23, 0x0b, 0xa6,
+	0xa9, 0x88, 0x6f, 0xca, 0x98, 0xb9, 0xd5, 0xa1, 0x9f, 0x42, 0xaf, 0xd4, 0xd7, 0xab, 0x09, 0x77,
+	0x6a, 0x3f, 0xfb, 0xa7, 0x03, 0x9d, 0x97, 0xba, 0x33, 0xe4, 0x1a, 0x9c, 0x6a, 0x7d, 0x93, 0xa6,
+	0x25, 0xbd, 0xfd, 0xd3, 0xe0, 0x9d, 0xef, 0x56, 0xb2, 0xe9, 0xfd, 0x0c, 0xbd, 0x8d, 0x05, 0x4a,
+	0x9e, 0x36, 0x98, 0x35, 0xad, 0x58, 0xef, 0x61, 0x83, 0x62, 0xcd, 0xcf, 0x14, 0x3e, 0xa8, 0xaf,
+	0x14, 0xf2, 0xa4, 0x41, 0xbd, 0x61, 0xad, 0x79, 0x4f, 0xdf, 0xab, 0x67, 0x5f, 0x7e, 0x0d, 0x4e,
+	0x35, 0x1c, 0x8d, 0x15, 0xd9, 0x1e, 0x48, 0xef, 0x7c, 0xb7, 0x92, 0xf5, 0xfb, 0x23, 0x38, 0xd5,
+	0x7c, 0x35, 0xfa, 0xdd, 0x9e, 0x3e, 0xef, 0xa3, 0x5b, 0x27, 0x89, 0xcc, 0xa0, 0xb7, 0xc1, 0xcb,
+	0xc6, 0xf2, 0x36, 0x71, 0xdf, 0xbb, 0x78, 0xbf, 0xa2, 0x7d, 0xf0, 0x18, 0x0e, 0x2d, 0x69, 0xc9,
+	0xa3, 0xc6, 0x9e, 0xd7, 0x29, 0xee, 0xd1, 0x5d, 0x2a, 0x55, 0x69, 0xef, 0xd5, 0x78, 0x4d, 0x1e,
+	0x37, 0xd7, 0x6d, 0x8b, 0xf7, 0xde, 0xa0, 0xd1, 0x73, 0x8d, 0xeb, 0xaf, 0xbe, 0xf8, 0xe5, 0xf3,
+	0x90, 0xab, 0x68, 0x31, 0x1b, 0xce, 0xd3, 0x64, 0xa4, 0x22, 0xa6, 0x42, 0xae, 0x24, 0x4b, 0x46,
+	0x61, 0x7a, 0x69, 0x6c, 0x2f, 0x0b, 0xe3, 0x91, 0xfd, 0x47, 0xf4, 0xa5, 0xfd, 0xce, 0x0e, 0xcc,
+	0x9f, 0xa2, 0xe7, 0xff, 0x0e, 0x00, 0x9a, 0xde, 0x6c, 0x28, 0x2b, 0x09, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type AdminClient interface {
+	// POST admin/reextract[/{id}/{version}]
+	Reextract(ctx context.Context, in *ReextractRequest, opts ...grpc.CallOption) (*ReextractResponse, error)
+	// GET admin/cache
+	GetCacheStats(ctx context.Context, in *GetCacheStatsRequest, opts ...grpc.CallOption) (*CacheStats, error)
+	// GET Packages, FindPackagesById
+	ListPackages(ctx context.Context, in *ListPackagesRequest, opts ...grpc.CallOption) (*ListPackagesResponse, error)
+	// POST admin/unlist/{id}/{version}, admin/relist/{id}/{version}
+	SetListed(ctx context.Context, in *SetListedRequest, opts ...grpc.CallOption) (*SetListedResponse, error)
+	// GET statusz
+	GetHealth(ctx context.Context, in *GetHealthRequest, opts ...grpc.CallOption) (*Health, error)
+	// DELETE api/v2/package/{id}/{version}
+	DeleteVersion(ctx context.Context, in *DeleteVersionRequest, opts ...grpc.CallOption) (*DeleteVersionResponse, error)
+	// POST admin/reindex
+	Reindex(ctx context.Context, in *ReindexRequest, opts ...grpc.CallOption) (*ReindexResponse, error)
+	// PUT admin/read-only
+	SetReadOnly(ctx context.Context, in *SetReadOnlyRequest, opts ...grpc.CallOption) (*ReadOnlyState, error)
+}
+
+type adminClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAdminClient(cc *grpc.ClientConn) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) Reextract(ctx context.Context, in *ReextractRequest, opts ...grpc.CallOption) (*ReextractResponse, error) {
+	out := new(ReextractResponse)
+	err := c.cc.Invoke(ctx, "/nugetserver.admin.Admin/Reextract", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetCacheStats(ctx context.Context, in *GetCacheStatsRequest, opts ...grpc.CallOption) (*CacheStats, error) {
+	out := new(CacheStats)
+	err := c.cc.Invoke(ctx, "/nugetserver.admin.Admin/GetCacheStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListPackages(ctx context.Context, in *ListPackagesRequest, opts ...grpc.CallOption) (*ListPackagesResponse, error) {
+	out := new(ListPackagesResponse)
+	err := c.cc.Invoke(ctx, "/nugetserver.admin.Admin/ListPackages", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) SetListed(ctx context.Context, in *SetListedRequest, opts ...grpc.CallOption) (*SetListedResponse, error) {
+	out := new(SetListedResponse)
+	err := c.cc.Invoke(ctx, "/nugetserver.admin.Admin/SetListed", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetHealth(ctx context.Context, in *GetHealthRequest, opts ...grpc.CallOption) (*Health, error) {
+	out := new(Health)
+	err := c.cc.Invoke(ctx, "/nugetserver.admin.Admin/GetHealth", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DeleteVersion(ctx context.Context, in *DeleteVersionRequest, opts ...grpc.CallOption) (*DeleteVersionResponse, error) {
+	out := new(DeleteVersionResponse)
+	err := c.cc.Invoke(ctx, "/nugetserver.admin.Admin/DeleteVersion", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Reindex(ctx context.Context, in *ReindexRequest, opts ...grpc.CallOption) (*ReindexResponse, error) {
+	out := new(ReindexResponse)
+	err := c.cc.Invoke(ctx, "/nugetserver.admin.Admin/Reindex", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) SetReadOnly(ctx context.Context, in *SetReadOnlyRequest, opts ...grpc.CallOption) (*ReadOnlyState, error) {
+	out := new(ReadOnlyState)
+	err := c.cc.Invoke(ctx, "/nugetserver.admin.Admin/SetReadOnly", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+type AdminServer interface {
+	// POST admin/reextract[/{id}/{version}]
+	Reextract(context.Context, *ReextractRequest) (*ReextractResponse, error)
+	// GET admin/cache
+	GetCacheStats(context.Context, *GetCacheStatsRequest) (*CacheStats, error)
+	// GET Packages, FindPackagesById
+	ListPackages(context.Context, *ListPackagesRequest) (*ListPackagesResponse, error)
+	// POST admin/unlist/{id}/{version}, admin/relist/{id}/{version}
+	SetListed(context.Context, *SetListedRequest) (*SetListedResponse, error)
+	// GET statusz
+	GetHealth(context.Context, *GetHealthRequest) (*Health, error)
+	// DELETE api/v2/package/{id}/{version}
+	DeleteVersion(context.Context, *DeleteVersionRequest) (*DeleteVersionResponse, error)
+	// POST admin/reindex
+	Reindex(context.Context, *ReindexRequest) (*ReindexResponse, error)
+	// PUT admin/read-only
+	SetReadOnly(context.Context, *SetReadOnlyRequest) (*ReadOnlyState, error)
+}
+
+// UnimplementedAdminServer can be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (*UnimplementedAdminServer) Reextract(ctx context.Context, req *ReextractRequest) (*ReextractResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reextract not implemented")
+}
+func (*UnimplementedAdminServer) GetCacheStats(ctx context.Context, req *GetCacheStatsRequest) (*CacheStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCacheStats not implemented")
+}
+func (*UnimplementedAdminServer) ListPackages(ctx context.Context, req *ListPackagesRequest) (*ListPackagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPackages not implemented")
+}
+func (*UnimplementedAdminServer) SetListed(ctx context.Context, req *SetListedRequest) (*SetListedResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetListed not implemented")
+}
+func (*UnimplementedAdminServer) GetHealth(ctx context.Context, req *GetHealthRequest) (*Health, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHealth not implemented")
+}
+func (*UnimplementedAdminServer) DeleteVersion(ctx context.Context, req *DeleteVersionRequest) (*DeleteVersionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteVersion not implemented")
+}
+func (*UnimplementedAdminServer) Reindex(ctx context.Context, req *ReindexRequest) (*ReindexResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reindex not implemented")
+}
+func (*UnimplementedAdminServer) SetReadOnly(ctx context.Context, req *SetReadOnlyRequest) (*ReadOnlyState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetReadOnly not implemented")
+}
+
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&_Admin_serviceDesc, srv)
+}
+
+func _Admin_Reextract_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReextractRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Reextract(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nugetserver.admin.Admin/Reextract",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Reextract(ctx, req.(*ReextractRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetCacheStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCacheStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetCacheStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nugetserver.admin.Admin/GetCacheStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetCacheStats(ctx, req.(*GetCacheStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ListPackages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPackagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListPackages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nugetserver.admin.Admin/ListPackages",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListPackages(ctx, req.(*ListPackagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_SetListed_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetListedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetListed(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nugetserver.admin.Admin/SetListed",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetListed(ctx, req.(*SetListedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetHealth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetHealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetHealth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nugetserver.admin.Admin/GetHealth",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetHealth(ctx, req.(*GetHealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_DeleteVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteVersionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DeleteVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nugetserver.admin.Admin/DeleteVersion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DeleteVersion(ctx, req.(*DeleteVersionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Reindex_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReindexRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Reindex(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nugetserver.admin.Admin/Reindex",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Reindex(ctx, req.(*ReindexRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_SetReadOnly_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetReadOnlyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetReadOnly(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nugetserver.admin.Admin/SetReadOnly",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetReadOnly(ctx, req.(*SetReadOnlyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Admin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "nugetserver.admin.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Reextract",
+			Handler:    _Admin_Reextract_Handler,
+		},
+		{
+			MethodName: "GetCacheStats",
+			Handler:    _Admin_GetCacheStats_Handler,
+		},
+		{
+			MethodName: "ListPackages",
+			Handler:    _Admin_ListPackages_Handler,
+		},
+		{
+			MethodName: "SetListed",
+			Handler:    _Admin_SetListed_Handler,
+		},
+		{
+			MethodName: "GetHealth",
+			Handler:    _Admin_GetHealth_Handler,
+		},
+		{
+			MethodName: "DeleteVersion",
+			Handler:    _Admin_DeleteVersion_Handler,
+		},
+		{
+			MethodName: "Reindex",
+			Handler:    _Admin_Reindex_Handler,
+		},
+		{
+			MethodName: "SetReadOnly",
+			Handler:    _Admin_SetReadOnly_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "adminpb/admin.proto",
+}
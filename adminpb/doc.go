@@ -0,0 +1,5 @@
+// Package adminpb is the gRPC admin API described by admin.proto. admin.pb.go is
+// generated with protoc-gen-go v1.3.2, from the repository root:
+//
+//	protoc --go_out=plugins=grpc,paths=source_relative:. adminpb/admin.proto
+package adminpb
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Name the allowed ID list is kept under in the filestore
+const allowedIDsSetting = "allowed-ids"
+
+// allowedIDList is the catalog of package IDs that may be pushed when allowed-ids is
+// enabled, as exact IDs or globs such as "Partner.*"
+type allowedIDList struct {
+	Patterns []string `json:"patterns"`
+}
+
+// notAllowedError rejects a push of an ID that isn't on the allowed list
+type notAllowedError struct {
+	ID           string
+	Registration string
+}
+
+func (e *notAllowedError) Error() string {
+	how := e.Registration
+	if how == "" {
+		how = "ask a feed administrator to register it"
+	}
+	return "package id " + e.ID + " is not registered for this feed, " + how
+}
+
+// allows reports whether an ID is on the list, case insensitively
+func (l *allowedIDList) allows(id string) bool {
+	for _, p := range l.Patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(id)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAllowedIDs reads the allowed ID list from the store. It is read for every
+// push, so edits by any instance apply straight away.
+func loadAllowedIDs(ctx context.Context) (*allowedIDList, error) {
+	l := &allowedIDList{Patterns: []string{}}
+	b, err := server.fs.GetSetting(ctx, allowedIDsSetting)
+	if err == ErrFileNotFound {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil, err
+	}
+	if l.Patterns == nil {
+		l.Patterns = []string{}
+	}
+	return l, nil
+}
+
+// saveAllowedIDs writes the allowed ID list to the store, sorted and without duplicates
+func saveAllowedIDs(ctx context.Context, l *allowedIDList) error {
+	seen := make(map[string]bool)
+	var patterns []string
+	for _, p := range l.Patterns {
+		p = strings.TrimSpace(p)
+		if p == "" || seen[strings.ToLower(p)] {
+			continue
+		}
+		seen[strings.ToLower(p)] = true
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	if patterns == nil {
+		patterns = []string{}
+	}
+	l.Patterns = patterns
+
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return server.fs.PutSetting(ctx, allowedIDsSetting, b)
+}
+
+// validateAllowedIDs checks the globs in a new list
+func validateAllowedIDs(l *allowedIDList) error {
+	for _, p := range l.Patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.New("allowed-ids contains an invalid glob: " + p)
+		}
+	}
+	return nil
+}
+
+// checkAllowedID returns a notAllowedError if allowed-ids is enabled and the ID
+// isn't on the list. It is checked alongside the id-policies, both must pass.
+func checkAllowedID(ctx context.Context, id string) error {
+	c := server.Config()
+	if !c.AllowedIDs.Enabled {
+		return nil
+	}
+	l, err := loadAllowedIDs(ctx)
+	if err != nil {
+		return err
+	}
+	if !l.allows(id) {
+		return &notAllowedError{ID: id, Registration: c.AllowedIDs.Registration}
+	}
+	return nil
+}
+
+// allowedIDsInfo is the list as served by admin/allowed-ids. Stored packages whose
+// IDs aren't on it are still served, and are listed so they can be registered.
+type allowedIDsInfo struct {
+	Enabled    bool     `json:"enabled"`
+	Patterns   []string `json:"patterns"`
+	NotAllowed []string `json:"notAllowed"`
+}
+
+func serveAllowedIDs(w http.ResponseWriter, r *http.Request) {
+	var l *allowedIDList
+	var err error
+
+	switch r.Method {
+	case http.MethodPut:
+		// The body replaces the list
+		l = &allowedIDList{}
+		b, err := ioutil.ReadAll(r.Body)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(b, l); err != nil {
+			writeAllowedIDsError(w, "body must be {\"patterns\": [...]}")
+			return
+		}
+		if err := validateAllowedIDs(l); err != nil {
+			writeAllowedIDsError(w, err.Error())
+			return
+		}
+		if err := saveAllowedIDs(r.Context(), l); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		// ?pattern= removes one entry, otherwise the list is cleared
+		l, err = loadAllowedIDs(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if p := r.URL.Query().Get("pattern"); p != "" {
+			var kept []string
+			for _, x := range l.Patterns {
+				if !strings.EqualFold(x, p) {
+					kept = append(kept, x)
+				}
+			}
+			if len(kept) == len(l.Patterns) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			l.Patterns = kept
+		} else {
+			l.Patterns = nil
+		}
+		if err := saveAllowedIDs(r.Context(), l); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	default:
+		l, err = loadAllowedIDs(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	info := &allowedIDsInfo{Enabled: server.Config().AllowedIDs.Enabled, Patterns: l.Patterns, NotAllowed: []string{}}
+	entries, err := allPackageEntries(r.Context(), server.fs, "")
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		id := e.Properties.ID
+		if !seen[strings.ToLower(id)] && !l.allows(id) {
+			info.NotAllowed = append(info.NotAllowed, id)
+		}
+		seen[strings.ToLower(id)] = true
+	}
+	sort.Strings(info.NotAllowed)
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// writeAllowedIDsError explains why a change to the list was refused
+func writeAllowedIDsError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(msg))
+}
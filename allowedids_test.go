@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAllowedIDListAllows(t *testing.T) {
+	l := &allowedIDList{Patterns: []string{"Partner.Core", "Partner.*.Tools", "Vendor.*"}}
+	for id, want := range map[string]bool{
+		"Partner.Core":       true,
+		"partner.core":       true,
+		"Partner.Core.Extra": false,
+		"Partner.Web.Tools":  true,
+		"Partner.Web.Core":   false,
+		"Vendor.Anything":    true,
+		"Other.Pkg":          false,
+	} {
+		if got := l.allows(id); got != want {
+			t.Errorf("%s: got %v, want %v", id, got, want)
+		}
+	}
+	if err := validateAllowedIDs(&allowedIDList{Patterns: []string{"Partner.[Core"}}); err == nil {
+		t.Error("invalid glob accepted")
+	}
+}
+
+func TestAllowedIDs(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.AllowedIDs.Enabled = true
+		c.AllowedIDs.Registration = "see the partner portal"
+		c.FileStore.APIKeys.ReadWrite = append(c.FileStore.APIKeys.ReadWrite, testPlatformKey)
+		c.IDPolicies = testIDPolicies
+	})
+	admin := func(method string, p string, key string, body string) (int, *allowedIDsInfo) {
+		t.Helper()
+		status, b := readResponse(t, ts.do(t, method, "admin/allowed-ids"+p, key, strings.NewReader(body), nil))
+		if status != http.StatusOK {
+			return status, nil
+		}
+		var info allowedIDsInfo
+		if err := json.Unmarshal([]byte(b), &info); err != nil {
+			t.Fatal(err)
+		}
+		return status, &info
+	}
+	push := func(id string, key string) (int, string) {
+		t.Helper()
+		return readResponse(t, ts.pushTo(t, "", key, testPackage(t, id, "1.0.0", "", nil)))
+	}
+
+	// Nothing can be pushed until it's on the list
+	status, body := push("Partner.Core", testWriteKey)
+	wantStatus(t, "empty list", status, body, http.StatusForbidden)
+	if !strings.Contains(body, "Partner.Core is not registered") || !strings.Contains(body, "see the partner portal") {
+		t.Errorf("empty list: %s", body)
+	}
+
+	// Managed with a read-write key only
+	if status, _ := admin(http.MethodGet, "", testReadKey, ""); status != http.StatusForbidden {
+		t.Errorf("GET with a read key: %d", status)
+	}
+	if status, _ := admin(http.MethodPut, "", testReadKey, `{"patterns": ["Other.*"]}`); status != http.StatusForbidden {
+		t.Errorf("PUT with a read key: %d", status)
+	}
+	if status, _ := admin(http.MethodPut, "", testWriteKey, `{"patterns": ["Partner.[Core"]}`); status != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid glob: %d", status)
+	}
+	status, info := admin(http.MethodPut, "", testWriteKey, `{"patterns": ["Partner.Core", "Partner.*.Tools", "partner.core", "QSC.*"]}`)
+	if status != http.StatusOK || !info.Enabled || !reflect.DeepEqual(info.Patterns, []string{"Partner.*.Tools", "Partner.Core", "QSC.*"}) {
+		t.Fatalf("PUT: %d %+v", status, info)
+	}
+
+	// Exact, glob and denied, applied without a restart
+	for _, tc := range []struct {
+		id   string
+		key  string
+		want int
+	}{
+		{"Partner.Core", testWriteKey, http.StatusCreated},
+		{"partner.web.tools", testWriteKey, http.StatusCreated},
+		{"Partner.Web", testWriteKey, http.StatusForbidden},
+		{"Other.Pkg", testWriteKey, http.StatusForbidden},
+		// The id-policies must pass as well
+		{"QSC.Plugin", testWriteKey, http.StatusForbidden},
+		{"QSC.Plugin", testPlatformKey, http.StatusCreated},
+		{"Company.Web.Core", testPlatformKey, http.StatusForbidden},
+	} {
+		status, body := push(tc.id, tc.key)
+		wantStatus(t, tc.id, status, body, tc.want)
+	}
+
+	// Removing an entry stops pushes of it, what's stored is still served
+	status, info = admin(http.MethodDelete, "?pattern=partner.core", testWriteKey, "")
+	if status != http.StatusOK || !reflect.DeepEqual(info.Patterns, []string{"Partner.*.Tools", "QSC.*"}) {
+		t.Fatalf("DELETE: %d %+v", status, info)
+	}
+	if !reflect.DeepEqual(info.NotAllowed, []string{"Partner.Core"}) {
+		t.Errorf("notAllowed %v", info.NotAllowed)
+	}
+	if status, _ := admin(http.MethodDelete, "?pattern=Missing.*", testWriteKey, ""); status != http.StatusNotFound {
+		t.Errorf("DELETE of a missing pattern: %d", status)
+	}
+	status, body = readResponse(t, ts.pushTo(t, "", testWriteKey, testPackage(t, "Partner.Core", "2.0.0", "", nil)))
+	wantStatus(t, "removed entry", status, body, http.StatusForbidden)
+	status, body = ts.get(t, "Packages(Id='Partner.Core',Version='1.0.0')")
+	wantStatus(t, "stored package", status, body, http.StatusOK)
+
+	// The list is kept in the store
+	ts.restart(t)
+	status, info = admin(http.MethodGet, "", testWriteKey, "")
+	if status != http.StatusOK || !reflect.DeepEqual(info.Patterns, []string{"Partner.*.Tools", "QSC.*"}) {
+		t.Errorf("after a restart: %d %+v", status, info)
+	}
+
+	// Clearing it denies everything
+	status, info = admin(http.MethodDelete, "", testWriteKey, "")
+	if status != http.StatusOK || len(info.Patterns) != 0 {
+		t.Fatalf("DELETE all: %d %+v", status, info)
+	}
+	if !reflect.DeepEqual(info.NotAllowed, []string{"Partner.Core", "QSC.Plugin", "partner.web.tools"}) {
+		t.Errorf("notAllowed %v", info.NotAllowed)
+	}
+	status, body = push("Partner.Web.Tools", testWriteKey)
+	wantStatus(t, "cleared", status, body, http.StatusForbidden)
+}
+
+func TestAllowedIDsDisabled(t *testing.T) {
+	ts := newTestServer(t, nil)
+	status, body := readResponse(t, ts.do(t, http.MethodPut, "admin/allowed-ids", testWriteKey, strings.NewReader(`{"patterns": ["Partner.*"]}`), nil))
+	wantStatus(t, "PUT", status, body, http.StatusOK)
+	if !strings.Contains(body, `"enabled":false`) {
+		t.Errorf("PUT: %s", body)
+	}
+	// Only enforced once enabled
+	status, body = ts.push(t, testPackage(t, "Other.Pkg", "1.0.0", "", nil))
+	wantStatus(t, "push", status, body, http.StatusCreated)
+
+	rewriteConfig(t, ts, func(c *Config) { c.AllowedIDs.Enabled = true })
+	status, body = readResponse(t, ts.do(t, http.MethodPost, "admin/reload-config", testWriteKey, nil, nil))
+	wantStatus(t, "reload", status, body, http.StatusNoContent)
+	status, body = ts.push(t, testPackage(t, "Other.Pkg", "2.0.0", "", nil))
+	wantStatus(t, "push after reload", status, body, http.StatusForbidden)
+	status, body = ts.push(t, testPackage(t, "Partner.Pkg", "1.0.0", "", nil))
+	wantStatus(t, "allowed after reload", status, body, http.StatusCreated)
+}
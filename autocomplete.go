@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// IDs returned by autocomplete unless take asks for fewer or more, and at most
+const (
+	defaultAutocompleteTake = 20
+	maxAutocompleteTake     = 1000
+)
+
+// autocompleteResult is what the SearchAutocompleteService answers, package IDs or
+// the versions of one
+type autocompleteResult struct {
+	TotalHits int      `json:"totalHits"`
+	Data      []string `json:"data"`
+}
+
+// serveAutocomplete serves the V3 SearchAutocompleteService clients use to
+// complete package IDs as they're typed, and then the versions of the one chosen
+func serveAutocomplete(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting autocomplete?q=foo&skip=0&take=20&prerelease=true or
+	// autocomplete?id=foo&prerelease=true
+	v := r.URL.Query()
+	prerelease := false
+	if s := v.Get("prerelease"); s != "" {
+		var err error
+		if prerelease, err = strconv.ParseBool(s); err != nil {
+			writeAutocompleteError(w, "prerelease must be true or false")
+			return
+		}
+	}
+	skip, take := 0, defaultAutocompleteTake
+	if s := v.Get("skip"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeAutocompleteError(w, "skip must be a number of at least 0")
+			return
+		}
+		skip = n
+	}
+	if s := v.Get("take"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeAutocompleteError(w, "take must be a number of at least 0")
+			return
+		}
+		take = n
+		if take > maxAutocompleteTake {
+			take = maxAutocompleteTake
+		}
+	}
+
+	// Only listed versions are offered, from the ID given if any
+	id := v.Get("id")
+	entries, err := allPackageEntries(r.Context(), server.fs, id)
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The index picks out the IDs starting with q. It covers everything the key can
+	// see, so is used before any filtering.
+	q := strings.ToLower(v.Get("q"))
+	var candidates map[string]bool
+	if id == "" && q != "" {
+		candidates = autocompleteCandidates(r.Context(), entries, q)
+	}
+	if snap := requestSnapshot(r); snap != nil {
+		entries = snap.Filter(entries)
+	}
+	entries = filterSemVer2(r, entries)
+	var offered []*NugetPackageEntry
+	for _, e := range entries {
+		if !e.Properties.Listed.Value || (!prerelease && versions.IsPrerelease(e.Properties.Version)) {
+			continue
+		}
+		if id != "" && !strings.EqualFold(e.Properties.ID, id) {
+			continue
+		}
+		if candidates != nil && !candidates[strings.ToLower(e.Properties.ID)] {
+			continue
+		}
+		offered = append(offered, e)
+	}
+
+	res := autocompleteResult{Data: []string{}}
+	if id != "" {
+		// Every version of the ID, oldest first
+		sort.Slice(offered, func(i, j int) bool {
+			return versions.Compare(offered[i].Properties.Version, offered[j].Properties.Version) < 0
+		})
+		for _, e := range offered {
+			res.Data = append(res.Data, versions.Normalize(e.Properties.Version))
+		}
+		res.TotalHits = len(res.Data)
+	} else {
+		// IDs starting with q, each spelled as its newest version spells it
+		newest := make(map[string]*NugetPackageEntry)
+		for _, e := range offered {
+			k := strings.ToLower(e.Properties.ID)
+			if n, ok := newest[k]; !ok || versions.Compare(e.Properties.Version, n.Properties.Version) > 0 {
+				newest[k] = e
+			}
+		}
+		var ids []string
+		for _, e := range newest {
+			ids = append(ids, e.Properties.ID)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return strings.ToLower(ids[i]) < strings.ToLower(ids[j])
+		})
+		res.TotalHits = len(ids)
+		if skip > len(ids) {
+			skip = len(ids)
+		}
+		ids = ids[skip:]
+		if take < len(ids) {
+			ids = ids[:take]
+		}
+		res.Data = append(res.Data, ids...)
+	}
+
+	b, err := marshalJSON(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+func writeAutocompleteError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(msg))
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Catalog event types, as nuget.org names them
+const (
+	catalogDetails = "nuget:PackageDetails"
+	catalogDelete  = "nuget:PackageDelete"
+)
+
+// Events in each catalog page
+const catalogPageSize = 550
+
+// catalogEvent is one append only catalog entry. Details are captured from the
+// store when the event is recorded.
+type catalogEvent struct {
+	Seq        int64            `json:"seq"`
+	Type       string           `json:"type"`
+	ID         string           `json:"id"`
+	Version    string           `json:"version"`
+	CommitID   string           `json:"commitId"`
+	CommitTime time.Time        `json:"commitTime"`
+	Details    *catalogMetadata `json:"details,omitempty"`
+	// Change log sequence the event was made from, where the next sync resumes
+	ChangeSeq int64 `json:"changeSeq"`
+}
+
+// catalogMetadata is the package metadata in a PackageDetails leaf
+type catalogMetadata struct {
+	Authors                  string                   `json:"authors,omitempty"`
+	Description              string                   `json:"description,omitempty"`
+	Title                    string                   `json:"title,omitempty"`
+	Tags                     []string                 `json:"tags,omitempty"`
+	Listed                   bool                     `json:"listed"`
+	IsPrerelease             bool                     `json:"isPrerelease"`
+	Published                time.Time                `json:"published"`
+	PackageHash              string                   `json:"packageHash,omitempty"`
+	PackageHashAlgorithm     string                   `json:"packageHashAlgorithm,omitempty"`
+	PackageSize              int                      `json:"packageSize"`
+	ProjectURL               string                   `json:"projectUrl,omitempty"`
+	LicenseURL               string                   `json:"licenseUrl,omitempty"`
+	RequireLicenseAcceptance bool                     `json:"requireLicenseAcceptance"`
+	DependencyGroups         []catalogDependencyGroup `json:"dependencyGroups,omitempty"`
+}
+
+type catalogDependencyGroup struct {
+	TargetFramework string              `json:"targetFramework,omitempty"`
+	Dependencies    []catalogDependency `json:"dependencies,omitempty"`
+}
+
+type catalogDependency struct {
+	ID    string `json:"id"`
+	Range string `json:"range,omitempty"`
+}
+
+// packageCatalog is an append only log of package events kept beside a local repo,
+// fed from the store's change log. It is only compacted when an admin asks.
+type packageCatalog struct {
+	lock   sync.Mutex
+	path   string
+	events []catalogEvent
+	seq    int64
+	// Change log sequence consumed so far
+	changeSeq int64
+	// Current versions and whether they're listed, by snapshotKey
+	state map[string]bool
+}
+
+// openCatalog loads the catalog from disk, starting an empty one if not present
+func openCatalog(path string) (*packageCatalog, error) {
+	c := &packageCatalog{path: path, state: make(map[string]bool)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for s.Scan() {
+		var e catalogEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// A torn final line from a crash mid-append is ignored
+			continue
+		}
+		c.events = append(c.events, e)
+		c.apply(e)
+	}
+	return c, s.Err()
+}
+
+// apply updates the current state and cursors for an event, lock must be held
+func (c *packageCatalog) apply(e catalogEvent) {
+	c.seq = e.Seq
+	if e.ChangeSeq > c.changeSeq {
+		c.changeSeq = e.ChangeSeq
+	}
+	key := snapshotKey(e.ID, e.Version)
+	if e.Type == catalogDelete {
+		delete(c.state, key)
+	} else {
+		c.state[key] = e.Details == nil || e.Details.Listed
+	}
+}
+
+// Sync appends events for the changes made since the catalog was last synced. If
+// the change log has been compacted past that point, the catalog is brought in
+// line with the state it was compacted to.
+func (c *packageCatalog) Sync(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	changes, max, reset, err := server.fs.GetChanges(ctx, c.changeSeq)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 && max == c.changeSeq {
+		return nil
+	}
+
+	type change struct {
+		kind    string
+		id, ver string
+	}
+	var todo []change
+	if reset {
+		current := make(map[string]bool)
+		for _, ch := range changes {
+			if ch.Type == changeCheckpoint || ch.Type == changeRemoved {
+				continue
+			}
+			key := snapshotKey(ch.ID, ch.Version)
+			current[key] = true
+			if listed, ok := c.state[key]; !ok || listed != (ch.Type != changeUnlisted) {
+				todo = append(todo, change{catalogDetails, ch.ID, ch.Version})
+			}
+		}
+		for _, e := range c.events {
+			key := snapshotKey(e.ID, e.Version)
+			if _, ok := c.state[key]; ok && !current[key] {
+				todo = append(todo, change{catalogDelete, e.ID, e.Version})
+				current[key] = true
+			}
+		}
+	} else {
+		for _, ch := range changes {
+			switch ch.Type {
+			case changeAdded, changeUnlisted, changeRelisted:
+				todo = append(todo, change{catalogDetails, ch.ID, ch.Version})
+			case changeRemoved:
+				todo = append(todo, change{catalogDelete, ch.ID, ch.Version})
+			}
+		}
+	}
+
+	// Every event of a sync is one commit
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	commit, now := hex.EncodeToString(b), time.Now().UTC()
+	var events []catalogEvent
+	recorded := make(map[string]bool)
+	for _, t := range todo {
+		key := snapshotKey(t.id, t.ver)
+		e := catalogEvent{Seq: c.seq + int64(len(events)) + 1, Type: t.kind, ID: t.id, Version: t.ver, CommitID: commit, CommitTime: now}
+		if t.kind == catalogDetails {
+			npe, err := server.fs.GetPackageEntry(ctx, t.id, t.ver)
+			if err == ErrFileNotFound {
+				// Removed since, which a later change records
+				continue
+			} else if err != nil {
+				return err
+			}
+			e.ID, e.Version = npe.Properties.ID, npe.Properties.Version
+			e.Details = newCatalogMetadata(npe)
+			recorded[key] = true
+		} else if _, ok := c.state[key]; !ok && !recorded[key] {
+			// Pushed and removed between syncs, readers never saw it
+			continue
+		} else {
+			delete(recorded, key)
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 {
+		c.changeSeq = max
+		return nil
+	}
+	events[len(events)-1].ChangeSeq = max
+
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := writeCatalogEvents(f, events); err != nil {
+		return err
+	}
+	for _, e := range events {
+		c.events = append(c.events, e)
+		c.apply(e)
+	}
+	return nil
+}
+
+// Compact replaces the history with one PackageDetails event for each current
+// version, keeping the events that recorded them. Readers must start again.
+func (c *packageCatalog) Compact() (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	last := make(map[string]int)
+	for i, e := range c.events {
+		last[snapshotKey(e.ID, e.Version)] = i
+	}
+	var kept []catalogEvent
+	for i, e := range c.events {
+		if e.Type == catalogDetails && last[snapshotKey(e.ID, e.Version)] == i {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) > 0 {
+		kept[len(kept)-1].ChangeSeq = c.changeSeq
+	}
+
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeCatalogEvents(f, kept); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return 0, err
+	}
+	removed := len(c.events) - len(kept)
+	c.events = kept
+	return removed, nil
+}
+
+// Events returns a copy of the events
+func (c *packageCatalog) Events() []catalogEvent {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]catalogEvent{}, c.events...)
+}
+
+// writeCatalogEvents writes events as JSON lines and syncs them to disk
+func writeCatalogEvents(f *os.File, events []catalogEvent) error {
+	w := bufio.NewWriter(f)
+	for _, e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// newCatalogMetadata captures the catalog fields of a feed entry
+func newCatalogMetadata(npe *NugetPackageEntry) *catalogMetadata {
+	p := npe.Properties
+	m := &catalogMetadata{
+		Authors:                  npe.Author.Name,
+		Description:              p.Description,
+		Title:                    p.Title,
+		Tags:                     splitTags(p.Tags),
+		Listed:                   p.Listed.Value,
+		IsPrerelease:             versions.IsPrerelease(p.Version),
+		Published:                p.Published.Value,
+		PackageHash:              p.PackageHash,
+		PackageHashAlgorithm:     p.PackageHashAlgorithm,
+		PackageSize:              p.PackageSize.Value,
+		ProjectURL:               p.ProjectURL,
+		LicenseURL:               p.LicenseURL.Value,
+		RequireLicenseAcceptance: p.RequireLicenseAcceptance.Value,
+	}
+	groups := make(map[string]int)
+	for _, d := range parseDependencies(p.Dependencies) {
+		i, ok := groups[strings.ToLower(d.Framework)]
+		if !ok {
+			i = len(m.DependencyGroups)
+			groups[strings.ToLower(d.Framework)] = i
+			m.DependencyGroups = append(m.DependencyGroups, catalogDependencyGroup{TargetFramework: d.Framework})
+		}
+		m.DependencyGroups[i].Dependencies = append(m.DependencyGroups[i].Dependencies, catalogDependency{ID: d.ID, Range: d.Range})
+	}
+	return m
+}
+
+// catalogURL returns the URL of a catalog document
+func catalogURL(doc string) string {
+	return server.URL.String() + `v3/catalog/` + doc
+}
+
+// visibleCatalogEvents syncs the catalog and returns the events a request may see
+func visibleCatalogEvents(r *http.Request) ([]catalogEvent, error) {
+	if server.catalog == nil {
+		return nil, ErrNotSupported
+	}
+	// Synced as the server, so hidden packages are in the history too
+	if err := server.catalog.Sync(context.Background()); err != nil {
+		return nil, err
+	}
+	events := server.catalog.Events()
+	v := contextViewer(r.Context())
+	if v == nil || v.all {
+		return events, nil
+	}
+	var list []catalogEvent
+	for _, e := range events {
+		if h, err := server.visibility.hidden(r.Context(), e.ID); err != nil {
+			return nil, err
+		} else if !h {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+// catalogItem is an event as listed in a page
+func catalogItem(e catalogEvent) map[string]interface{} {
+	return map[string]interface{}{
+		"@id":             catalogURL(`data/` + strconv.FormatInt(e.Seq, 10) + `.json`),
+		"@type":           e.Type,
+		"commitId":        e.CommitID,
+		"commitTimeStamp": formatISO8601Time(e.CommitTime),
+		"nuget:id":        e.ID,
+		"nuget:version":   e.Version,
+	}
+}
+
+// catalogLeaf is the document of one event
+func catalogLeaf(e catalogEvent) map[string]interface{} {
+	t := strings.TrimPrefix(e.Type, "nuget:")
+	leaf := map[string]interface{}{
+		"@id":                     catalogURL(`data/` + strconv.FormatInt(e.Seq, 10) + `.json`),
+		"@type":                   []string{t, "catalog:Permalink"},
+		"catalog:commitId":        e.CommitID,
+		"catalog:commitTimeStamp": formatISO8601Time(e.CommitTime),
+		"id":                      e.ID,
+		"version":                 e.Version,
+	}
+	if e.Type == catalogDelete {
+		leaf["originalId"] = e.ID
+		leaf["published"] = formatISO8601Time(e.CommitTime)
+		return leaf
+	}
+	if d := e.Details; d != nil {
+		b, _ := json.Marshal(d)
+		var fields map[string]interface{}
+		json.Unmarshal(b, &fields)
+		for k, v := range fields {
+			leaf[k] = v
+		}
+		leaf["published"] = formatISO8601Time(d.Published)
+	}
+	return leaf
+}
+
+func serveCatalog(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting v3/catalog/index.json, v3/catalog/page{N}.json or v3/catalog/data/{seq}.json
+	doc := r.URL.Path[len(server.URL.Path+`v3/catalog/`):]
+	events, err := visibleCatalogEvents(r)
+	if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var res interface{}
+	switch {
+	case doc == `index.json`:
+		res = catalogIndex(events)
+	case strings.HasPrefix(doc, `page`) && strings.HasSuffix(doc, `.json`):
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(doc, `page`), `.json`))
+		if err != nil || n < 0 || n*catalogPageSize >= len(events) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		res = catalogPage(events, n)
+	case strings.HasPrefix(doc, `data/`) && strings.HasSuffix(doc, `.json`):
+		seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(doc, `data/`), `.json`), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for _, e := range events {
+			if e.Seq == seq {
+				res = catalogLeaf(e)
+			}
+		}
+		if res == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := marshalJSON(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// catalogIndex is the catalog root, listing every page
+func catalogIndex(events []catalogEvent) map[string]interface{} {
+	index := map[string]interface{}{
+		"@id":   catalogURL(`index.json`),
+		"@type": []string{"CatalogRoot", "AppendOnlyCatalog", "Permalink"},
+		"items": []interface{}{},
+		"count": 0,
+	}
+	var items []interface{}
+	var lastCreated, lastDeleted time.Time
+	for i := 0; i*catalogPageSize < len(events); i++ {
+		page := catalogPageEvents(events, i)
+		last := page[len(page)-1]
+		items = append(items, map[string]interface{}{
+			"@id":             catalogURL(`page` + strconv.Itoa(i) + `.json`),
+			"@type":           "CatalogPage",
+			"commitId":        last.CommitID,
+			"commitTimeStamp": formatISO8601Time(last.CommitTime),
+			"count":           len(page),
+		})
+	}
+	for _, e := range events {
+		if e.Type == catalogDelete {
+			lastDeleted = e.CommitTime
+		} else {
+			lastCreated = e.CommitTime
+		}
+	}
+	if len(events) > 0 {
+		last := events[len(events)-1]
+		index["commitId"] = last.CommitID
+		index["commitTimeStamp"] = formatISO8601Time(last.CommitTime)
+		index["items"] = items
+		index["count"] = len(items)
+	}
+	if !lastCreated.IsZero() {
+		index["nuget:lastCreated"] = formatISO8601Time(lastCreated)
+		index["nuget:lastEdited"] = formatISO8601Time(lastCreated)
+	}
+	if !lastDeleted.IsZero() {
+		index["nuget:lastDeleted"] = formatISO8601Time(lastDeleted)
+	}
+	return index
+}
+
+// catalogPage is one page of events
+func catalogPage(events []catalogEvent, n int) map[string]interface{} {
+	page := catalogPageEvents(events, n)
+	last := page[len(page)-1]
+	var items []interface{}
+	for _, e := range page {
+		items = append(items, catalogItem(e))
+	}
+	return map[string]interface{}{
+		"@id":             catalogURL(`page` + strconv.Itoa(n) + `.json`),
+		"@type":           "CatalogPage",
+		"commitId":        last.CommitID,
+		"commitTimeStamp": formatISO8601Time(last.CommitTime),
+		"count":           len(page),
+		"parent":          catalogURL(`index.json`),
+		"items":           items,
+	}
+}
+
+func catalogPageEvents(events []catalogEvent, n int) []catalogEvent {
+	end := (n + 1) * catalogPageSize
+	if end > len(events) {
+		end = len(events)
+	}
+	return events[n*catalogPageSize : end]
+}
+
+// serveServiceIndex handles GET v3/index.json, listing the V3 resources served
+// beside the V2 feed
+func serveServiceIndex(w http.ResponseWriter, r *http.Request) {
+	res := map[string]interface{}{
+		"version": "3.0.0",
+		"resources": []interface{}{
+			map[string]interface{}{
+				"@id":     catalogURL(`index.json`),
+				"@type":   "Catalog/3.0.0",
+				"comment": "Append only log of package details and delete events",
+			},
+			map[string]interface{}{
+				"@id":     flatContainerURL(``),
+				"@type":   "PackageBaseAddress/3.0.0",
+				"comment": "Version lists, packages and nuspecs by ID and version",
+			},
+			map[string]interface{}{
+				"@id":     registrationURL(``),
+				"@type":   "RegistrationsBaseUrl",
+				"comment": "Metadata of every version of a package ID",
+			},
+			map[string]interface{}{
+				"@id":     registrationURL(``),
+				"@type":   "RegistrationsBaseUrl/3.0.0-rc",
+				"comment": "Metadata of every version of a package ID",
+			},
+			map[string]interface{}{
+				"@id":     registrationURL(``),
+				"@type":   "RegistrationsBaseUrl/3.6.0",
+				"comment": "Metadata of every version of a package ID",
+			},
+			map[string]interface{}{
+				"@id":     server.URL.String() + `autocomplete`,
+				"@type":   "SearchAutocompleteService",
+				"comment": "Package IDs by prefix, and the versions of an ID",
+			},
+			map[string]interface{}{
+				"@id":     server.URL.String() + `autocomplete`,
+				"@type":   "SearchAutocompleteService/3.0.0-rc",
+				"comment": "Package IDs by prefix, and the versions of an ID",
+			},
+			map[string]interface{}{
+				"@id":     server.URL.String() + `readme/{lower_id}/{lower_version}`,
+				"@type":   "ReadmeUriTemplate/6.13.0",
+				"comment": "The readme embedded in a package",
+			},
+			map[string]interface{}{
+				"@id":     server.URL.String() + `api/v2/symbolpackage`,
+				"@type":   "SymbolPackagePublish/4.9.0",
+				"comment": "Push symbol packages",
+			},
+		},
+	}
+	b, err := marshalJSON(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+func serveCatalogCompact(w http.ResponseWriter, r *http.Request) {
+	if server.catalog == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if err := server.catalog.Sync(context.Background()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	removed, err := server.catalog.Compact()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(struct {
+		Removed int `json:"removed"`
+	}{removed})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
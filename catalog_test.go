@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// catalogReader follows the catalog as nuget.org's catalog readers do, keeping
+// the versions it has seen and whether they're listed
+type catalogReader struct {
+	cursor   time.Time
+	versions map[string]bool
+	leaves   int
+}
+
+// getCatalogDoc fetches a catalog document by the URL another document gave
+func getCatalogDoc(t *testing.T, ts *testServer, url string, doc interface{}) {
+	t.Helper()
+	if !strings.HasPrefix(url, server.URL.String()) {
+		t.Fatalf("catalog URL %s isn't under %s", url, server.URL)
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodGet, strings.TrimPrefix(url, server.URL.String()), testReadKey, nil, nil))
+	wantStatus(t, url, status, body, http.StatusOK)
+	if err := json.Unmarshal([]byte(body), doc); err != nil {
+		t.Fatalf("%s: %v", url, err)
+	}
+}
+
+// read applies every commit since the cursor, in commit order, and moves the cursor
+func (cr *catalogReader) read(t *testing.T, ts *testServer) {
+	t.Helper()
+	type item struct {
+		ID         string    `json:"@id"`
+		Type       string    `json:"@type"`
+		CommitTime time.Time `json:"commitTimeStamp"`
+		PackageID  string    `json:"nuget:id"`
+		Version    string    `json:"nuget:version"`
+	}
+	var index struct {
+		Items []item `json:"items"`
+	}
+	getCatalogDoc(t, ts, server.URL.String()+"v3/catalog/index.json", &index)
+
+	var items []item
+	for _, p := range index.Items {
+		if !p.CommitTime.After(cr.cursor) {
+			continue
+		}
+		var page struct {
+			Items []item `json:"items"`
+		}
+		getCatalogDoc(t, ts, p.ID, &page)
+		for _, i := range page.Items {
+			if i.CommitTime.After(cr.cursor) {
+				items = append(items, i)
+			}
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].CommitTime.Before(items[j].CommitTime) })
+
+	for _, i := range items {
+		var leaf struct {
+			Type    []string `json:"@type"`
+			ID      string   `json:"id"`
+			Version string   `json:"version"`
+			Listed  bool     `json:"listed"`
+		}
+		getCatalogDoc(t, ts, i.ID, &leaf)
+		cr.leaves++
+		if leaf.ID != i.PackageID || leaf.Version != i.Version || len(leaf.Type) == 0 || "nuget:"+leaf.Type[0] != i.Type {
+			t.Errorf("leaf %s doesn't match its page item: %+v", i.ID, leaf)
+		}
+		key := versionKey(leaf.ID, leaf.Version)
+		switch i.Type {
+		case catalogDetails:
+			cr.versions[key] = leaf.Listed
+		case catalogDelete:
+			delete(cr.versions, key)
+		default:
+			t.Errorf("%s: unknown event type %s", i.ID, i.Type)
+		}
+		cr.cursor = i.CommitTime
+	}
+}
+
+// storedListing returns every version in the store and whether it's listed
+func storedListing(t *testing.T) map[string]bool {
+	t.Helper()
+	entries, err := allPackageEntries(context.Background(), server.fs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]bool)
+	for _, e := range entries {
+		listed[versionKey(e.Properties.ID, e.Properties.Version)] = e.Properties.Listed.Value
+	}
+	return listed
+}
+
+// A reader walking the catalog from its cursor ends up with the versions stored,
+// across pages, unlists, relists and deletes, and again from scratch after the
+// catalog is compacted
+func TestCatalogReader(t *testing.T) {
+	ts := newTestServer(t, nil)
+	admin := func(method string, p string, want int) {
+		t.Helper()
+		status, body := readResponse(t, ts.do(t, method, p, testWriteKey, nil, nil))
+		wantStatus(t, method+" "+p, status, body, want)
+	}
+	for i := 0; i < 130; i++ {
+		for _, ver := range []string{"1.0.0", "1.1.0-beta", "2.0.0"} {
+			ts.mustPush(t, testPackage(t, fmt.Sprintf("Catalog.Pkg%d", i), ver, "", nil))
+		}
+	}
+
+	reader := &catalogReader{versions: make(map[string]bool)}
+	reader.read(t, ts)
+	if want := storedListing(t); !reflect.DeepEqual(reader.versions, want) || len(want) != 390 {
+		t.Fatalf("after the first pushes the reader has %d versions, the store %d", len(reader.versions), len(want))
+	}
+
+	// Enough changes to fill the first page and start another
+	for i := 0; i < 130; i++ {
+		id := fmt.Sprintf("Catalog.Pkg%d", i)
+		switch i % 4 {
+		case 0:
+			admin(http.MethodPost, "admin/unlist/"+id+"/1.0.0", http.StatusNoContent)
+		case 1:
+			admin(http.MethodPost, "admin/unlist/"+id+"/2.0.0", http.StatusNoContent)
+			admin(http.MethodPost, "admin/relist/"+id+"/2.0.0", http.StatusNoContent)
+		case 2:
+			admin(http.MethodDelete, "api/v2/package/"+id+"/1.1.0-beta", http.StatusNoContent)
+		case 3:
+			ts.mustPush(t, testPackage(t, id, "3.0.0", "", nil))
+			admin(http.MethodDelete, "api/v2/package/"+id+"/1.0.0", http.StatusNoContent)
+		}
+	}
+	ts.mustPush(t, testPackage(t, "Catalog.Late", "1.0.0", "", nil))
+	// Pushed and deleted between reads, readers never need to see it
+	ts.mustPush(t, testPackage(t, "Catalog.Gone", "1.0.0", "", nil))
+	admin(http.MethodDelete, "api/v2/package/Catalog.Gone/1.0.0", http.StatusNoContent)
+
+	seen := reader.leaves
+	reader.read(t, ts)
+	if want := storedListing(t); !reflect.DeepEqual(reader.versions, want) {
+		t.Errorf("after the changes the reader has %d versions, the store %d", len(reader.versions), len(want))
+	}
+	if n := len(server.catalog.Events()); n <= catalogPageSize || reader.leaves != n {
+		t.Errorf("%d events, the reader read %d leaves (%d new), want more than a page", n, reader.leaves, reader.leaves-seen)
+	}
+	// Nothing new, nothing read
+	seen = reader.leaves
+	reader.read(t, ts)
+	if reader.leaves != seen {
+		t.Errorf("a read with nothing new read %d leaves", reader.leaves-seen)
+	}
+
+	// Compacted, a new reader gets the same versions from one event each
+	admin(http.MethodPost, "admin/catalog/compact", http.StatusOK)
+	fresh := &catalogReader{versions: make(map[string]bool)}
+	fresh.read(t, ts)
+	if want := storedListing(t); !reflect.DeepEqual(fresh.versions, want) || fresh.leaves != len(want) {
+		t.Errorf("after compacting a new reader has %d versions from %d leaves, the store %d", len(fresh.versions), fresh.leaves, len(want))
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Default number of records kept before the change log is compacted
+const defaultChangeLogMaxRecords = 10000
+
+// Kinds of change record
+const (
+	changeCheckpoint = "checkpoint"
+	changeAdded      = "added"
+	changeRemoved    = "removed"
+	changeRelisted   = "relisted"
+	changeUnlisted   = "unlisted"
+)
+
+// changeRecord is a single sequence numbered change to the package set
+type changeRecord struct {
+	Seq     int64     `json:"seq"`
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	Size    int       `json:"size,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// changeLog is an append only, disk persisted log of changes to the package set,
+// used by replicas to sync differentially. When it grows past max records it is
+// compacted into a checkpoint followed by the full current state.
+type changeLog struct {
+	lock    sync.Mutex
+	path    string
+	max     int
+	records []changeRecord
+	seq     int64
+}
+
+// openChangeLog loads a change log from disk, creating an empty one if not present
+func openChangeLog(path string, max int) (*changeLog, error) {
+	if max <= 0 {
+		max = defaultChangeLogMaxRecords
+	}
+	cl := &changeLog{path: path, max: max}
+	if err := cl.load(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// Reload re-reads the log from disk, picking up records appended by other instances
+func (cl *changeLog) Reload() error {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.load()
+}
+
+// load reads the records from disk, lock must be held
+func (cl *changeLog) load() error {
+	cl.records = nil
+
+	f, err := os.Open(cl.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var c changeRecord
+		if err := json.Unmarshal(s.Bytes(), &c); err != nil {
+			// A torn final line from a crash mid-append is ignored
+			continue
+		}
+		cl.records = append(cl.records, c)
+		cl.seq = c.Seq
+	}
+	return s.Err()
+}
+
+// Empty reports whether the log has no records yet
+func (cl *changeLog) Empty() bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return len(cl.records) == 0
+}
+
+// Last returns the most recent record for a version, if the log still has one
+func (cl *changeLog) Last(id string, ver string) (changeRecord, bool) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	for i := len(cl.records) - 1; i >= 0; i-- {
+		c := cl.records[i]
+		if strings.EqualFold(c.ID, id) && versions.Equal(c.Version, ver) {
+			return c, true
+		}
+	}
+	return changeRecord{}, false
+}
+
+// Append records a change, compacting the log if it has grown too large
+func (cl *changeLog) Append(kind string, id string, ver string, hash string, size int) error {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.seq++
+	c := changeRecord{Seq: cl.seq, Type: kind, ID: id, Version: ver, Hash: hash, Size: size, Time: time.Now().UTC()}
+
+	f, err := os.OpenFile(cl.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := writeChangeRecords(f, []changeRecord{c}); err != nil {
+		return err
+	}
+	cl.records = append(cl.records, c)
+
+	if len(cl.records) > cl.max {
+		return cl.compact()
+	}
+	return nil
+}
+
+// Checkpoint replaces the log with a checkpoint of the given package set
+func (cl *changeLog) Checkpoint(entries []*NugetPackageEntry) error {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	var state []changeRecord
+	for _, e := range entries {
+		c := changeRecord{Type: changeAdded, ID: e.Properties.ID, Version: e.Properties.Version, Hash: e.Properties.PackageHash, Size: e.Properties.PackageSize.Value}
+		if !e.Properties.Listed.Value {
+			c.Type = changeUnlisted
+		}
+		state = append(state, c)
+	}
+	return cl.rewrite(state)
+}
+
+// compact replays the log into the current state and rewrites it as a checkpoint, lock must be held
+func (cl *changeLog) compact() error {
+	var order []string
+	seen := make(map[string]bool)
+	state := make(map[string]changeRecord)
+	for _, c := range cl.records {
+		key := versionKey(c.ID, c.Version)
+		switch c.Type {
+		case changeAdded, changeRelisted:
+			if !seen[key] {
+				seen[key] = true
+				order = append(order, key)
+			}
+			c.Type = changeAdded
+			state[key] = c
+		case changeUnlisted:
+			// Still present, just hidden
+			if s, ok := state[key]; ok {
+				s.Type = changeUnlisted
+				state[key] = s
+			}
+		case changeRemoved:
+			delete(state, key)
+		}
+	}
+
+	var records []changeRecord
+	for _, key := range order {
+		if c, ok := state[key]; ok {
+			records = append(records, c)
+		}
+	}
+	return cl.rewrite(records)
+}
+
+// rewrite atomically replaces the log with a checkpoint and the given state, lock must be held
+func (cl *changeLog) rewrite(state []changeRecord) error {
+	now := time.Now().UTC()
+	cl.seq++
+	records := []changeRecord{{Seq: cl.seq, Type: changeCheckpoint, Time: now}}
+	for _, c := range state {
+		cl.seq++
+		c.Seq = cl.seq
+		c.Time = now
+		records = append(records, c)
+	}
+
+	tmp := cl.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := writeChangeRecords(f, records); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, cl.path); err != nil {
+		return err
+	}
+	cl.records = records
+	return nil
+}
+
+// writeChangeRecords writes records as JSON lines and syncs them to disk
+func writeChangeRecords(f *os.File, records []changeRecord) error {
+	w := bufio.NewWriter(f)
+	for _, c := range records {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Since returns the records after seq and the current max sequence. If records after
+// seq have been compacted away, the log from the checkpoint is returned and reset is
+// set, meaning the replica must replace its state rather than apply the changes.
+func (cl *changeLog) Since(seq int64) ([]changeRecord, int64, bool) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	changes := []changeRecord{}
+	if len(cl.records) == 0 {
+		return changes, cl.seq, false
+	}
+	if seq < cl.records[0].Seq-1 || seq > cl.seq {
+		return append(changes, cl.records...), cl.seq, true
+	}
+	for _, c := range cl.records {
+		if c.Seq > seq {
+			changes = append(changes, c)
+		}
+	}
+	return changes, cl.seq, false
+}
+
+func serveChanges(w http.ResponseWriter, r *http.Request) {
+
+	// Changes after ?since=, from the start if not given
+	var since int64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, max, reset, err := server.fs.GetChanges(r.Context(), since)
+	if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	changes = mirroredChanges(r.Context(), changes)
+
+	// A long log, or a checkpoint of a large feed, is streamed a change at a time
+	if len(changes) > streamJSONEntries() {
+		streamJSONArray(w, "application/json", `{"max":`+strconv.FormatInt(max, 10)+`,"reset":`+strconv.FormatBool(reset)+`,"changes":[`, len(changes), func(i int) interface{} {
+			return changes[i]
+		}, `]}`)
+		return
+	}
+
+	b, err := marshalJSON(struct {
+		Max     int64          `json:"max"`
+		Reset   bool           `json:"reset"`
+		Changes []changeRecord `json:"changes"`
+	}{max, reset, changes})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
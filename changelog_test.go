@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// replica mirrors a feed from api/changes as an edge site would, downloading what
+// was added
+type replica struct {
+	seq      int64
+	packages map[string]bool // "id version"
+	resets   int
+}
+
+func (rep *replica) sync(t *testing.T, ts *testServer) {
+	t.Helper()
+	status, body := ts.get(t, fmt.Sprintf("api/changes?since=%d", rep.seq))
+	wantStatus(t, "changes", status, body, http.StatusOK)
+	var res struct {
+		Max     int64          `json:"max"`
+		Reset   bool           `json:"reset"`
+		Changes []changeRecord `json:"changes"`
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Reset {
+		rep.packages = make(map[string]bool)
+		rep.resets++
+	}
+	for _, c := range res.Changes {
+		if c.Seq > res.Max {
+			t.Fatalf("change %d is after max %d", c.Seq, res.Max)
+		}
+		key := c.ID + " " + c.Version
+		switch c.Type {
+		case changeAdded, changeRelisted:
+			status, pkg := readResponse(t, ts.do(t, http.MethodGet, "nupkg/"+c.ID+"/"+c.Version, testReadKey, nil, nil))
+			wantStatus(t, "download "+key, status, pkg, http.StatusOK)
+			if sum := sha512.Sum512([]byte(pkg)); hex.EncodeToString(sum[:]) != c.Hash || len(pkg) != c.Size {
+				t.Errorf("%s: downloaded package doesn't match the change's hash and size", key)
+			}
+			rep.packages[key] = true
+		case changeRemoved:
+			delete(rep.packages, key)
+		}
+	}
+	rep.seq = res.Max
+}
+
+func (rep *replica) list() []string {
+	list := []string{}
+	for k := range rep.packages {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// feedPackages lists every version in the feed as "id version"
+func feedPackages(t *testing.T, ts *testServer) []string {
+	t.Helper()
+	status, body := ts.get(t, "Packages()")
+	wantStatus(t, "feed", status, body, http.StatusOK)
+	list := append([]string{}, feedIDs(t, body)...)
+	sort.Strings(list)
+	return list
+}
+
+// Replicas replaying the change stream end up with the feed's packages, whether
+// they keep up or fall behind a compaction
+func TestChangesReplicaConverges(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.FileStore.ChangeLogMaxRecords = 6 })
+	current := &replica{packages: make(map[string]bool)}
+	stale := &replica{packages: make(map[string]bool)}
+
+	for cycle := 0; cycle < 5; cycle++ {
+		// Add a few versions and delete one added earlier
+		for i := 0; i < 3; i++ {
+			ts.mustPush(t, testPackage(t, fmt.Sprintf("Sync.Pkg%d", i), fmt.Sprintf("1.%d.0", cycle), "", nil))
+		}
+		if cycle > 0 {
+			status, body := readResponse(t, ts.do(t, http.MethodDelete, fmt.Sprintf("api/v2/package/Sync.Pkg%d/1.%d.0", cycle%3, cycle-1), testWriteKey, nil, nil))
+			wantStatus(t, "delete", status, body, http.StatusNoContent)
+		}
+		current.sync(t, ts)
+		if cycle == 1 {
+			stale.sync(t, ts)
+		}
+		if got, want := current.list(), feedPackages(t, ts); !reflect.DeepEqual(got, want) {
+			t.Fatalf("cycle %d: replica has %q, feed has %q", cycle, got, want)
+		}
+	}
+
+	// The stale replica's sequence was compacted away, so it starts again from the checkpoint
+	stale.sync(t, ts)
+	if stale.resets == 0 {
+		t.Error("replica behind a compaction wasn't reset")
+	}
+	if got, want := stale.list(), feedPackages(t, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("stale replica has %q, feed has %q", got, want)
+	}
+
+	// With nothing new, a synced replica gets no changes
+	seq := current.seq
+	current.sync(t, ts)
+	if current.seq != seq {
+		t.Errorf("max moved from %d to %d without changes", seq, current.seq)
+	}
+}
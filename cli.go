@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Default config file, relative to the working directory
+const defaultConfigFile = "nuget-server-config-local.json"
+
+// Exit codes for the CLI commands
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// runCommand runs a CLI command and returns the process exit code
+func runCommand(cmd string, args []string) int {
+	switch cmd {
+	case "serve":
+		return cmdServe(args)
+	case "import":
+		return cmdImport(args)
+	case "verify":
+		return cmdVerify(args)
+	case "list":
+		return cmdList(args)
+	case "help", "-h", "--help":
+		printUsage()
+		return exitOK
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+	printUsage()
+	return exitUsage
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `Usage: go-nuget-server <command> [flags]
+
+Commands:
+  serve            serve the feed over HTTP (default)
+  import <dir>     store every .nupkg found under dir
+  verify           check stored packages for corruption
+  list [id]        print stored packages and versions
+
+Run a command with -h to see its flags.`)
+}
+
+// newFlagSet returns flags common to all commands
+func newFlagSet(name string, usage string) (*flag.FlagSet, *string) {
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	f.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: go-nuget-server "+name+" [flags] "+usage)
+		f.PrintDefaults()
+	}
+	cf := f.String("config", defaultConfigFile, "config file")
+	return f, cf
+}
+
+func cmdServe(args []string) int {
+	f, cf := newFlagSet("serve", "")
+	check := f.Bool("check-config", false, "check the config and exit without serving")
+	if err := f.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *check {
+		return checkConfigFile(*cf)
+	}
+
+	// Load config and init server
+	prepareService()
+	server = InitServer(*cf)
+	if err := server.migration.resumeMigration(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error resuming store migration:", err)
+		return exitFailure
+	}
+	serve()
+	return exitOK
+}
+
+// checkConfigFile runs the startup config checks, printing any problems
+func checkConfigFile(cf string) int {
+	c, _, err := readConfig(cf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	warnings, err := checkConfig(c)
+	for _, w := range warnings {
+		fmt.Println("WARNING:", w)
+	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return exitFailure
+	}
+	fmt.Println("config OK")
+	return exitOK
+}
+
+func cmdImport(args []string) int {
+	f, cf := newFlagSet("import", "<dir>")
+	if err := f.Parse(args); err != nil {
+		return exitUsage
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		return exitUsage
+	}
+
+	// Find all packages under the directory
+	var files []string
+	err := filepath.Walk(f.Arg(0), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && strings.EqualFold(filepath.Ext(p), ".nupkg") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	server = loadServer(*cf)
+
+	// Packages already in the store are skipped, anything else that can't be stored fails the run
+	failed := 0
+	for i, p := range files {
+		status := "stored"
+		pkg, err := ioutil.ReadFile(p)
+		if err == nil {
+			_, err = server.fs.StorePackage(context.Background(), pkg)
+		}
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			status = "exists"
+		} else if err != nil {
+			status = "failed: " + err.Error()
+			failed++
+		}
+		fmt.Printf("[%d/%d] %s %s\n", i+1, len(files), p, status)
+	}
+
+	fmt.Printf("%d packages, %d failed\n", len(files), failed)
+	if failed > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// listedPackage is a stored package as printed by the list command
+type listedPackage struct {
+	ID        string    `json:"id"`
+	Version   string    `json:"version"`
+	Size      int       `json:"size"`
+	Published time.Time `json:"published"`
+	Downloads int       `json:"downloads"`
+}
+
+func cmdList(args []string) int {
+	f, cf := newFlagSet("list", "[id]")
+	asJSON := f.Bool("json", false, "print JSON instead of a table")
+	if err := f.Parse(args); err != nil {
+		return exitUsage
+	}
+	if f.NArg() > 1 {
+		f.Usage()
+		return exitUsage
+	}
+
+	server = loadServer(*cf)
+	entries, err := allPackageEntries(context.Background(), server.fs, f.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	list := []listedPackage{}
+	for _, e := range entries {
+		list = append(list, listedPackage{
+			ID:        e.Properties.ID,
+			Version:   e.Properties.Version,
+			Size:      e.Properties.PackageSize.Value,
+			Published: e.Properties.Published.Value,
+			Downloads: e.Properties.VersionDownloadCount.Value,
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if !strings.EqualFold(list[i].ID, list[j].ID) {
+			return strings.ToLower(list[i].ID) < strings.ToLower(list[j].ID)
+		}
+		return versions.Compare(list[i].Version, list[j].Version) < 0
+	})
+
+	if *asJSON {
+		b, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		fmt.Println(string(b))
+		return exitOK
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tVERSION\tSIZE\tPUBLISHED\tDOWNLOADS")
+	for _, p := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\n", p.ID, p.Version, p.Size, formatAtomTime(p.Published), p.Downloads)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+// verifyProblem is an integrity failure found by the verify command
+type verifyProblem struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	File    string `json:"file,omitempty"` // For a file that isn't in the feed
+	Problem string `json:"problem"`
+}
+
+func cmdVerify(args []string) int {
+	f, cf := newFlagSet("verify", "")
+	asJSON := f.Bool("json", false, "print JSON instead of text")
+	if err := f.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	server = loadServer(*cf)
+	checked, problems, err := verifyPackages(context.Background(), server.fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(struct {
+			Checked  int             `json:"checked"`
+			Problems []verifyProblem `json:"problems"`
+		}{checked, problems}, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		fmt.Println(string(b))
+	} else {
+		for _, p := range problems {
+			if p.File != "" {
+				fmt.Printf("%s: %s\n", p.File, p.Problem)
+			} else {
+				fmt.Printf("%s %s: %s\n", p.ID, p.Version, p.Problem)
+			}
+		}
+		fmt.Printf("%d packages checked, %d problems\n", checked, len(problems))
+	}
+
+	if len(problems) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// verifyPackages checks every stored package can be read, is a valid package for its
+// id and version, and matches the hash recorded when it was stored. With a local
+// store the package files on disk are checked too, as any that failed to load
+// aren't in the feed.
+func verifyPackages(ctx context.Context, fs fileStore) (int, []verifyProblem, error) {
+	entries, err := allPackageEntries(ctx, fs, "")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Hashes recorded in the change log, where the store keeps one
+	recorded := make(map[string]string)
+	if changes, _, _, err := fs.GetChanges(ctx, 0); err == nil {
+		for _, c := range changes {
+			key := versionKey(c.ID, c.Version)
+			switch c.Type {
+			case changeAdded, changeRelisted:
+				recorded[key] = c.Hash
+			case changeUnlisted:
+				if c.Hash != "" {
+					recorded[key] = c.Hash
+				}
+			case changeRemoved:
+				delete(recorded, key)
+			}
+		}
+	} else if err != ErrNotSupported {
+		return 0, nil, err
+	}
+
+	problems := []verifyProblem{}
+	for _, e := range entries {
+		id, ver := e.Properties.ID, e.Properties.Version
+		fail := func(format string, a ...interface{}) {
+			problems = append(problems, verifyProblem{ID: id, Version: ver, Problem: fmt.Sprintf(format, a...)})
+		}
+
+		pkg, err := fs.ReadPackageFile(ctx, id, ver)
+		if err != nil {
+			fail("cannot read package: %v", err)
+			continue
+		}
+
+		h := sha512.Sum512(pkg)
+		hash := hex.EncodeToString(h[:])
+		if e.Properties.PackageHash != "" && !strings.EqualFold(hash, e.Properties.PackageHash) {
+			fail("hash does not match feed entry")
+		}
+		if r, ok := recorded[versionKey(id, ver)]; ok && r != "" && !strings.EqualFold(hash, r) {
+			fail("hash does not match change log")
+		}
+
+		nsf, err := readNuspec(pkg)
+		if err != nil {
+			fail("not a valid package: %v", err)
+			continue
+		}
+		if !strings.EqualFold(nsf.Meta.ID, id) || !versions.Equal(nsf.Meta.Version, ver) {
+			fail("nuspec is for %s %s", nsf.Meta.ID, nsf.Meta.Version)
+		}
+	}
+
+	checked := len(entries)
+	if local, ok := fs.(*fileStoreLocal); ok {
+		files, err := verifyDiskPackages(local, entries)
+		if err != nil {
+			return 0, nil, err
+		}
+		checked += len(files)
+		problems = append(problems, files...)
+	}
+
+	return checked, problems, nil
+}
+
+// verifyDiskPackages reports the package files of a local store that aren't in the
+// feed, with why they couldn't be loaded
+func verifyDiskPackages(fs *fileStoreLocal, entries []*NugetPackageEntry) ([]verifyProblem, error) {
+	loaded := make(map[string]*NugetPackageEntry)
+	for _, e := range entries {
+		loaded[filepath.Clean(fs.nupkgPath(e.Properties.ID, e.Properties.Version))] = e
+	}
+	pkgs, err := fs.diskPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []verifyProblem{}
+	for _, p := range pkgs {
+		fail := func(format string, a ...interface{}) {
+			problems = append(problems, verifyProblem{ID: p.id, Version: p.ver, File: p.path, Problem: fmt.Sprintf(format, a...)})
+		}
+
+		// Loaded, though maybe from another package's directory
+		if e, ok := loaded[filepath.Clean(p.path)]; ok {
+			if p.id != "" && (!strings.EqualFold(e.Properties.ID, p.id) || !versions.Equal(e.Properties.Version, p.ver)) {
+				fail("nuspec is for %s %s", e.Properties.ID, e.Properties.Version)
+			}
+			continue
+		}
+
+		if p.missing {
+			fail("version directory has no package file")
+			continue
+		}
+		pkg, err := ioutil.ReadFile(p.path)
+		if err != nil {
+			fail("cannot read package: %v", err)
+			continue
+		}
+		nsf, err := readNuspec(pkg)
+		if err != nil {
+			fail("not a valid package: %v", err)
+			continue
+		}
+		if p.id != "" && (!strings.EqualFold(nsf.Meta.ID, p.id) || !versions.Equal(nsf.Meta.Version, p.ver)) {
+			fail("nuspec is for %s %s", nsf.Meta.ID, nsf.Meta.Version)
+			continue
+		}
+		fail("%s %s is not in the feed", nsf.Meta.ID, nsf.Meta.Version)
+	}
+	return problems, nil
+}
+
+// allPackageEntries pages through every feed entry, optionally for a single id
+func allPackageEntries(ctx context.Context, fs fileStore, id string) ([]*NugetPackageEntry, error) {
+	var all []*NugetPackageEntry
+	startAfter := ""
+	for {
+		// The store may not check between pages, so stop here for a cancelled request
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		page, more, err := fs.GetPackageFeedEntries(ctx, id, startAfter, 100)
+		if err == ErrStartAfterGone {
+			// The last version read was removed meanwhile, so read them all again
+			all, startAfter = nil, ""
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if !more || len(page) == 0 {
+			return all, nil
+		}
+		last := page[len(page)-1]
+		startAfter = last.Properties.ID + "." + last.Properties.Version
+	}
+}
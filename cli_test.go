@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeStoreFile writes a file under a local store's directory
+func writeStoreFile(t *testing.T, ts *testServer, p string, b []byte) {
+	t.Helper()
+	fp := filepath.Join(ts.Root, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verifyStore runs verify on a test server's local store, returning the number of
+// packages checked and each problem as "id version: problem" or "file: problem"
+func verifyStore(t *testing.T, ts *testServer) (int, []string) {
+	t.Helper()
+	local, _, _ := server.migration.stores()
+	checked, problems, err := verifyPackages(context.Background(), local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range problems {
+		if p.File != "" {
+			rel, err := filepath.Rel(ts.Root, p.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, filepath.ToSlash(rel)+": "+p.Problem)
+		} else {
+			got = append(got, p.ID+" "+p.Version+": "+p.Problem)
+		}
+	}
+	sort.Strings(got)
+	return checked, got
+}
+
+func TestVerifyPackages(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.FileStore.Layout = layoutHierarchical })
+	ts.mustPush(t, testPackage(t, "Good.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Good.Pkg", "2.0.0", "", nil))
+
+	// Files that can't be loaded, beside a good version of the same ID
+	writeStoreFile(t, ts, "mixed.pkg/1.0.0/mixed.pkg.1.0.0.nupkg", []byte("not a zip"))
+	writeStoreFile(t, ts, "mixed.pkg/2.0.0/mixed.pkg.2.0.0.nupkg", testPackage(t, "Mixed.Pkg", "2.0.0", "", nil))
+	writeStoreFile(t, ts, "wrong.pkg/1.0.0/wrong.pkg.1.0.0.nupkg", testPackage(t, "Other.Pkg", "1.0.0", "", nil))
+	if err := os.MkdirAll(filepath.Join(ts.Root, "empty.pkg", "1.0.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/reindex", testWriteKey, nil, nil))
+	wantStatus(t, "reindex", status, body, http.StatusOK)
+	status, body = ts.get(t, "Packages(Id='Mixed.Pkg',Version='2.0.0')")
+	wantStatus(t, "version after one that can't be loaded", status, body, http.StatusOK)
+
+	// And a stored package replaced since it was pushed
+	writeStoreFile(t, ts, "good.pkg/2.0.0/good.pkg.2.0.0.nupkg", testPackage(t, "Good.Pkg", "2.0.0", "<tags>changed</tags>", nil))
+
+	checked, got := verifyStore(t, ts)
+	want := []string{
+		"Good.Pkg 2.0.0: hash does not match change log",
+		"Good.Pkg 2.0.0: hash does not match feed entry",
+		"empty.pkg/1.0.0/empty.pkg.1.0.0.nupkg: version directory has no package file",
+		"mixed.pkg/1.0.0/mixed.pkg.1.0.0.nupkg: not a valid package: zip: not a valid zip file",
+		"wrong.pkg/1.0.0/wrong.pkg.1.0.0.nupkg: nuspec is for Other.Pkg 1.0.0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems:\n%q\nwant\n%q", got, want)
+	}
+	// The four in the feed, Other.Pkg among them, and the three files that aren't
+	if checked != 7 {
+		t.Errorf("checked %d packages, want 7", checked)
+	}
+}
+
+func TestVerifyPackagesFlat(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.FileStore.Layout = layoutFlat })
+	ts.mustPush(t, testPackage(t, "Flat.Pkg", "1.0.0", "", nil))
+	writeStoreFile(t, ts, "broken.nupkg", []byte("not a zip"))
+	writeStoreFile(t, ts, "z-copy.nupkg", testPackage(t, "Flat.Pkg", "1.0.0", "", nil))
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/reindex", testWriteKey, nil, nil))
+	wantStatus(t, "reindex", status, body, http.StatusOK)
+
+	checked, got := verifyStore(t, ts)
+	want := []string{
+		"broken.nupkg: not a valid package: zip: not a valid zip file",
+		"z-copy.nupkg: Flat.Pkg 1.0.0 is not in the feed",
+	}
+	if !reflect.DeepEqual(got, want) || checked != 3 {
+		t.Errorf("checked %d, problems:\n%q\nwant 3 and\n%q", checked, got, want)
+	}
+}
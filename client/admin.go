@@ -0,0 +1,309 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// QuarantinedPackage is a push held for approval
+type QuarantinedPackage struct {
+	ID          string `json:"id"`
+	Version     string `json:"version"`
+	Title       string `json:"title"`
+	Authors     string `json:"authors"`
+	Description string `json:"description"`
+	Size        int    `json:"size"`
+	Hash        string `json:"hash"`
+	Submitted   string `json:"submitted"`
+}
+
+// Quarantine lists the packages awaiting approval
+func (c *Client) Quarantine(ctx context.Context) ([]*QuarantinedPackage, error) {
+	var list []*QuarantinedPackage
+	err := c.do(ctx, http.MethodGet, c.endpoint("admin/quarantine", nil), nil, &list)
+	return list, err
+}
+
+// Approve moves a quarantined package into the feed
+func (c *Client) Approve(ctx context.Context, id string, version string) error {
+	return c.do(ctx, http.MethodPost, c.endpoint("admin/quarantine/"+escapePath(id, version, "approve"), nil), nil, nil, http.StatusNoContent)
+}
+
+// Reject drops a quarantined package, recording the reason given
+func (c *Client) Reject(ctx context.Context, id string, version string, reason string) error {
+	in := struct {
+		Reason string `json:"reason"`
+	}{reason}
+	return c.do(ctx, http.MethodPost, c.endpoint("admin/quarantine/"+escapePath(id, version, "reject"), nil), in, nil, http.StatusNoContent)
+}
+
+// ExtractionStatus is whether a package's content was extracted
+type ExtractionStatus struct {
+	ID      string    `json:"id"`
+	Version string    `json:"version"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// ExtractionFailures lists the packages whose content failed to extract
+func (c *Client) ExtractionFailures(ctx context.Context) ([]*ExtractionStatus, error) {
+	var list []*ExtractionStatus
+	err := c.do(ctx, http.MethodGet, c.endpoint("admin/extraction", nil), nil, &list)
+	return list, err
+}
+
+// Reextract retries extracting a version's content, or every failed version if id
+// is empty, and returns the new statuses
+func (c *Client) Reextract(ctx context.Context, id string, version string) ([]*ExtractionStatus, error) {
+	p := "admin/reextract"
+	if id != "" {
+		p += "/" + escapePath(id, version)
+	}
+	var list []*ExtractionStatus
+	err := c.do(ctx, http.MethodPost, c.endpoint(p, nil), nil, &list)
+	return list, err
+}
+
+// ReloadConfig has the server re-read its configuration file
+func (c *Client) ReloadConfig(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, c.endpoint("admin/reload-config", nil), nil, nil, http.StatusNoContent)
+}
+
+// PackageHash compares a version's hashes
+type PackageHash struct {
+	Algorithm string `json:"algorithm"`
+	Feed      string `json:"feed"`
+	Recorded  string `json:"recorded,omitempty"`
+	Computed  string `json:"computed,omitempty"`
+	Matches   *bool  `json:"matches,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PackageStorage is where a version is kept
+type PackageStorage struct {
+	Package      string `json:"package"`
+	PackageSize  int64  `json:"packageSize"`
+	ContentDir   string `json:"contentDir,omitempty"`
+	ContentFiles int    `json:"contentFiles"`
+	ContentSize  int64  `json:"contentSize"`
+}
+
+// PackageReport is everything the server knows about a version
+type PackageReport struct {
+	ID        string          `json:"id"`
+	Version   string          `json:"version"`
+	Listed    bool            `json:"listed"`
+	Owners    string          `json:"owners,omitempty"`
+	Entry     *Package        `json:"entry"`
+	Storage   *PackageStorage `json:"storage,omitempty"`
+	Hash      *PackageHash    `json:"hash"`
+	Downloads struct {
+		Version int `json:"version"`
+		Total   int `json:"total"`
+	} `json:"downloads"`
+	Extraction *ExtractionStatus `json:"extraction,omitempty"`
+	Changes    []*Change         `json:"changes,omitempty"`
+}
+
+// Report returns a version's report. With verify the server hashes the stored
+// file, which reads it in full.
+func (c *Client) Report(ctx context.Context, id string, version string, verify bool) (*PackageReport, error) {
+	var q url.Values
+	if verify {
+		q = url.Values{"verify": {"true"}}
+	}
+	var rep PackageReport
+	if err := c.do(ctx, http.MethodGet, c.endpoint("admin/packages/"+escapePath(id, version), q), nil, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// CacheStats are the counters of the server's package cache
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+	MaxBytes      int64  `json:"maxBytes"`
+}
+
+// CacheStats returns the package cache's counters. Servers without a cache answer
+// with an error IsNotFound reports.
+func (c *Client) CacheStats(ctx context.Context) (*CacheStats, error) {
+	var cs CacheStats
+	if err := c.do(ctx, http.MethodGet, c.endpoint("admin/cache", nil), nil, &cs); err != nil {
+		return nil, err
+	}
+	return &cs, nil
+}
+
+// Operation is a long running operation in progress on the server
+type Operation struct {
+	ID                 int64     `json:"id"`
+	Name               string    `json:"name"`
+	Started            time.Time `json:"started"`
+	Total              int64     `json:"total"`
+	Done               int64     `json:"done"`
+	EstimatedRemaining string    `json:"estimatedRemaining,omitempty"`
+}
+
+// Operations lists the operations in progress
+func (c *Client) Operations(ctx context.Context) ([]*Operation, error) {
+	var list []*Operation
+	err := c.do(ctx, http.MethodGet, c.endpoint("admin/operations", nil), nil, &list)
+	return list, err
+}
+
+// AllowedIDs is the list of IDs that may be pushed when allowed-ids is enabled
+type AllowedIDs struct {
+	Enabled  bool     `json:"enabled"`
+	Patterns []string `json:"patterns"`
+	// NotAllowed are stored IDs the list doesn't cover
+	NotAllowed []string `json:"notAllowed"`
+}
+
+// AllowedIDs returns the allowed ID list
+func (c *Client) AllowedIDs(ctx context.Context) (*AllowedIDs, error) {
+	var a AllowedIDs
+	if err := c.do(ctx, http.MethodGet, c.endpoint("admin/allowed-ids", nil), nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// SetAllowedIDs replaces the allowed ID list with exact IDs or globs
+func (c *Client) SetAllowedIDs(ctx context.Context, patterns []string) (*AllowedIDs, error) {
+	in := struct {
+		Patterns []string `json:"patterns"`
+	}{patterns}
+	var a AllowedIDs
+	if err := c.do(ctx, http.MethodPut, c.endpoint("admin/allowed-ids", nil), in, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// RemoveAllowedID removes one entry from the allowed ID list, or clears it if
+// pattern is empty
+func (c *Client) RemoveAllowedID(ctx context.Context, pattern string) (*AllowedIDs, error) {
+	var q url.Values
+	if pattern != "" {
+		q = url.Values{"pattern": {pattern}}
+	}
+	var a AllowedIDs
+	if err := c.do(ctx, http.MethodDelete, c.endpoint("admin/allowed-ids", q), nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Snapshot is a frozen view of the feed's package set
+type Snapshot struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Created  string `json:"created"`
+	Expires  string `json:"expires"`
+	Packages int    `json:"packages"`
+}
+
+// CreateSnapshot freezes the current package set. Its URL serves the feed as it
+// is now until the snapshot expires.
+func (c *Client) CreateSnapshot(ctx context.Context) (*Snapshot, error) {
+	var s Snapshot
+	if err := c.do(ctx, http.MethodPost, c.endpoint("api/snapshots", nil), nil, &s, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// DeleteSnapshot drops a snapshot before it expires
+func (c *Client) DeleteSnapshot(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, c.endpoint("api/snapshots/"+escapePath(id), nil), nil, nil, http.StatusNoContent)
+}
+
+// Change is an entry of the feed's change log
+type Change struct {
+	Seq     int64     `json:"seq"`
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	Size    int       `json:"size,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Changes is a page of the change log
+type Changes struct {
+	Max int64 `json:"max"`
+	// Reset is set if the log no longer goes back to the sequence asked for, so a
+	// mirror must resync from the packages listed
+	Reset   bool      `json:"reset"`
+	Changes []*Change `json:"changes"`
+}
+
+// Changes returns the changes after sequence number since
+func (c *Client) Changes(ctx context.Context, since int64) (*Changes, error) {
+	q := url.Values{"since": {strconv.FormatInt(since, 10)}}
+	var ch Changes
+	if err := c.do(ctx, http.MethodGet, c.endpoint("api/changes", q), nil, &ch); err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// FacetCount is a tag or author and how many packages have it
+type FacetCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// Facets are the distinct tags and authors across the latest version of each package
+type Facets struct {
+	Tags    []*FacetCount `json:"tags"`
+	Authors []*FacetCount `json:"authors"`
+}
+
+// Facets returns the feed's tags and authors
+func (c *Client) Facets(ctx context.Context) (*Facets, error) {
+	var f Facets
+	if err := c.do(ctx, http.MethodGet, c.endpoint("api/facets", nil), nil, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// ResolveCandidate is a version considered by Resolve
+type ResolveCandidate struct {
+	Version    string `json:"version"`
+	Listed     bool   `json:"listed"`
+	Prerelease bool   `json:"prerelease"`
+	Included   bool   `json:"included"`
+	Reason     string `json:"reason"`
+}
+
+// Resolution is the version a range resolves to and why
+type Resolution struct {
+	ID         string              `json:"id"`
+	Range      string              `json:"range"`
+	Prerelease bool                `json:"prerelease"`
+	Selected   *string             `json:"selected"`
+	Candidates []*ResolveCandidate `json:"candidates"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// Resolve returns the version NuGet would pick for a package and version range
+func (c *Client) Resolve(ctx context.Context, id string, versionRange string, prerelease bool) (*Resolution, error) {
+	q := url.Values{"id": {id}, "range": {versionRange}, "prerelease": {strconv.FormatBool(prerelease)}}
+	var res Resolution
+	if err := c.do(ctx, http.MethodGet, c.endpoint("api/resolve", q), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
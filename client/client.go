@@ -0,0 +1,181 @@
+// Package client is a Go client for go-nuget-server's package and admin APIs.
+//
+// Every method takes a context and sends the client's API key. Requests the server
+// refuses return an *Error carrying the status code and the server's explanation.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client talks to one feed
+type Client struct {
+	// BaseURL is the feed's root, such as https://nuget.example.com/feed/
+	BaseURL string
+	// APIKey is sent as X-NuGet-ApiKey. Admin calls need a read-write key.
+	APIKey string
+	// HTTPClient is used for requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// New returns a client for the feed at baseURL
+func New(baseURL string, apiKey string) *Client {
+	return &Client{BaseURL: baseURL, APIKey: apiKey}
+}
+
+// Error is a request the server answered with a status other than the one expected
+type Error struct {
+	StatusCode int
+	// Message is the server's explanation, if it gave one
+	Message string
+	// Result is the upload result of a refused push, if the server returned one
+	Result *PushResult
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("nuget server: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// IsNotFound reports whether err is the server answering 404
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsConflict reports whether err is the server answering 409, such as for a push of
+// a version that already exists
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+// IsForbidden reports whether err is the server answering 403
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
+
+// IsNotSupported reports whether err is the server answering 501, as it does for
+// features its store doesn't support
+func IsNotSupported(err error) bool {
+	return hasStatus(err, http.StatusNotImplemented)
+}
+
+func hasStatus(err error, code int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == code
+}
+
+// endpoint resolves a path and query against the base URL
+func (c *Client) endpoint(p string, q url.Values) string {
+	u := strings.TrimRight(c.BaseURL, "/") + "/" + p
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+// escapePath escapes each part of a path, so IDs and versions can't change the route
+func escapePath(parts ...string) string {
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// newRequest builds a request with the API key set
+func (c *Client) newRequest(ctx context.Context, method string, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.APIKey != "" {
+		req.Header.Set("X-NuGet-ApiKey", c.APIKey)
+	}
+	return req, nil
+}
+
+// send runs a request, returning an *Error unless the status is one of want
+func (c *Client) send(req *http.Request, want ...int) (*http.Response, []byte, error) {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range want {
+		if resp.StatusCode == s {
+			return resp, b, nil
+		}
+	}
+	return nil, nil, newError(resp, b)
+}
+
+// newError reads the server's explanation from a refused request's body, which is
+// plain text or, for pushes, an upload result
+func newError(resp *http.Response, b []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var r PushResult
+		if json.Unmarshal(b, &r) == nil && (r.ID != "" || r.Error != "") {
+			e.Result = &r
+			e.Message = r.Error
+		}
+		return e
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	return e
+}
+
+// do sends a request with an optional JSON body and decodes a JSON response into out
+func (c *Client) do(ctx context.Context, method string, u string, in interface{}, out interface{}, want ...int) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := c.newRequest(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if out != nil {
+		req.Header.Set("Accept", "application/json")
+	}
+	if len(want) == 0 {
+		want = []int{http.StatusOK}
+	}
+	_, b, err := c.send(req, want...)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
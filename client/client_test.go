@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newFake serves a handler as a feed at /feed/
+func newFake(t *testing.T, h http.HandlerFunc) *Client {
+	t.Helper()
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	return New(s.URL+"/feed/", "key")
+}
+
+func TestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		message     string
+		result      bool
+		is          func(error) bool
+	}{
+		{"not found", http.StatusNotFound, "", "", "", false, IsNotFound},
+		{"conflict", http.StatusConflict, "text/plain; charset=utf-8", "already exists\n", "already exists", false, IsConflict},
+		{"forbidden push", http.StatusForbidden, "application/json", `{"id":"A","version":"1.0.0","error":"not registered"}`, "not registered", true, IsForbidden},
+		{"not supported", http.StatusNotImplemented, "text/html", "<p>no</p>", "", false, IsNotSupported},
+	} {
+		c := newFake(t, func(w http.ResponseWriter, r *http.Request) {
+			if tc.contentType != "" {
+				w.Header().Set("Content-Type", tc.contentType)
+			}
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		})
+		err := c.Unlist(context.Background(), "A", "1.0.0")
+		e, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("%s: got %v", tc.name, err)
+		}
+		if e.StatusCode != tc.status || e.Message != tc.message || (e.Result != nil) != tc.result {
+			t.Errorf("%s: got %+v", tc.name, e)
+		}
+		if !tc.is(err) {
+			t.Errorf("%s: not recognized as a %d", tc.name, tc.status)
+		}
+		if IsNotFound(err) != (tc.status == http.StatusNotFound) {
+			t.Errorf("%s: IsNotFound %v", tc.name, IsNotFound(err))
+		}
+		if tc.message != "" && !strings.HasSuffix(err.Error(), ": "+tc.message) {
+			t.Errorf("%s: Error() %q", tc.name, err.Error())
+		}
+	}
+}
+
+func TestRequests(t *testing.T) {
+	var method, path, key, body string
+	c := newFake(t, func(w http.ResponseWriter, r *http.Request) {
+		method, path, key = r.Method, r.URL.EscapedPath(), r.Header.Get("X-NuGet-ApiKey")
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ctx := context.Background()
+	for _, tc := range []struct {
+		call               func() error
+		method, path, body string
+	}{
+		{func() error { return c.Unlist(ctx, "A/../B", "1.0.0") }, http.MethodPost, "/feed/admin/unlist/A%2F..%2FB/1.0.0", ""},
+		{func() error { return c.Relist(ctx, "A", "1.0.0") }, http.MethodPost, "/feed/admin/relist/A/1.0.0", ""},
+		{func() error { return c.Delete(ctx, "A", "1.0.0") }, http.MethodDelete, "/feed/api/v2/package/A/1.0.0", ""},
+		{func() error { return c.Pin(ctx, "A", "1.0.0") }, http.MethodPut, "/feed/admin/packages/A/pin", `{"version":"1.0.0"}`},
+		{func() error { return c.Unpin(ctx, "A") }, http.MethodDelete, "/feed/admin/packages/A/pin", ""},
+		{func() error { return c.Reject(ctx, "A", "1.0.0", "no") }, http.MethodPost, "/feed/admin/quarantine/A/1.0.0/reject", `{"reason":"no"}`},
+		{func() error { return c.DeleteSnapshot(ctx, "s1") }, http.MethodDelete, "/feed/api/snapshots/s1", ""},
+		{func() error { return c.ReloadConfig(ctx) }, http.MethodPost, "/feed/admin/reload-config", ""},
+	} {
+		if err := tc.call(); err != nil {
+			t.Errorf("%s %s: %v", tc.method, tc.path, err)
+			continue
+		}
+		if method != tc.method || path != tc.path || body != tc.body || key != "key" {
+			t.Errorf("got %s %s %q key %q, want %s %s %q", method, path, body, key, tc.method, tc.path, tc.body)
+		}
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	c := newFake(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request sent with a cancelled context")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.List(ctx); err != context.Canceled && !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Package is a package version as the feed's OData v4 JSON describes it
+type Package struct {
+	ID                       string  `json:"Id"`
+	Version                  string  `json:"Version"`
+	NormalizedVersion        string  `json:"NormalizedVersion"`
+	Title                    string  `json:"Title"`
+	Authors                  string  `json:"Authors"`
+	Description              string  `json:"Description"`
+	Summary                  string  `json:"Summary"`
+	Tags                     string  `json:"Tags"`
+	Dependencies             string  `json:"Dependencies"`
+	Created                  string  `json:"Created"`
+	Published                string  `json:"Published"`
+	LastEdited               string  `json:"LastEdited"`
+	DownloadCount            int     `json:"DownloadCount"`
+	VersionDownloadCount     int     `json:"VersionDownloadCount"`
+	IsLatestVersion          bool    `json:"IsLatestVersion"`
+	IsAbsoluteLatestVersion  bool    `json:"IsAbsoluteLatestVersion"`
+	IsPrerelease             bool    `json:"IsPrerelease"`
+	Listed                   bool    `json:"Listed"`
+	PackageHash              string  `json:"PackageHash"`
+	PackageHashAlgorithm     string  `json:"PackageHashAlgorithm"`
+	PackageSize              int     `json:"PackageSize"`
+	ProjectURL               string  `json:"ProjectUrl"`
+	IconURL                  *string `json:"IconUrl"`
+	LicenseURL               *string `json:"LicenseUrl"`
+	RequireLicenseAcceptance bool    `json:"RequireLicenseAcceptance"`
+	ReleaseNotes             *string `json:"ReleaseNotes"`
+	SupportedFrameworks      string  `json:"SupportedFrameworks"`
+}
+
+// PackagePage is a page of packages. NextLink is empty on the last page.
+type PackagePage struct {
+	Packages []*Package
+	NextLink string
+}
+
+// PushWarning is a validation rule a pushed package didn't meet
+type PushWarning struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PushResult is the server's report on a push, when validation is enabled
+type PushResult struct {
+	ID                string        `json:"id"`
+	Version           string        `json:"version"`
+	NormalizedVersion string        `json:"normalizedVersion"`
+	Size              int           `json:"size"`
+	Hash              string        `json:"hash"`
+	Warnings          []PushWarning `json:"warnings"`
+	Error             string        `json:"error,omitempty"`
+}
+
+// PushStatus is what became of a pushed package
+type PushStatus struct {
+	// Quarantined is set if the package is held for approval
+	Quarantined bool
+	// Result is the server's report, nil unless validation is enabled
+	Result *PushResult
+}
+
+// Push uploads a nupkg. Pushing a version that is already stored succeeds if the
+// bytes are identical, otherwise it returns an error IsConflict reports.
+func (c *Client) Push(ctx context.Context, pkg io.Reader) (*PushStatus, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("package", "package.nupkg")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(fw, pkg); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPut, c.endpoint("api/v2/package/", nil), &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, b, err := c.send(req, http.StatusOK, http.StatusCreated, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &PushStatus{Quarantined: resp.StatusCode == http.StatusAccepted}
+	if len(b) > 0 {
+		ps.Result = &PushResult{}
+		if err := json.Unmarshal(b, ps.Result); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// packagePage fetches a page of a feed as OData v4 JSON
+func (c *Client) packagePage(ctx context.Context, u string) (*PackagePage, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json;odata.metadata=minimal")
+	_, b, err := c.send(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var v struct {
+		Value    []*Package `json:"value"`
+		NextLink string     `json:"@odata.nextLink"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return &PackagePage{Packages: v.Value, NextLink: v.NextLink}, nil
+}
+
+// List returns the first page of the feed's packages
+func (c *Client) List(ctx context.Context) (*PackagePage, error) {
+	return c.packagePage(ctx, c.endpoint("Packages()", nil))
+}
+
+// NextPage returns the page after p, or nil if p was the last
+func (c *Client) NextPage(ctx context.Context, p *PackagePage) (*PackagePage, error) {
+	if p == nil || p.NextLink == "" {
+		return nil, nil
+	}
+	return c.packagePage(ctx, p.NextLink)
+}
+
+// SearchOptions narrow a search
+type SearchOptions struct {
+	// TargetFramework limits results to packages usable by the framework, several
+	// may be given separated by |
+	TargetFramework   string
+	IncludePrerelease bool
+	Skip              int
+	// Top is the page size, the server's default if 0
+	Top int
+}
+
+// Search returns the packages matching a search term
+func (c *Client) Search(ctx context.Context, term string, opts *SearchOptions) (*PackagePage, error) {
+	q := url.Values{}
+	q.Set("searchTerm", "'"+term+"'")
+	if opts != nil {
+		if opts.TargetFramework != "" {
+			q.Set("targetFramework", "'"+opts.TargetFramework+"'")
+		}
+		q.Set("includePrerelease", strconv.FormatBool(opts.IncludePrerelease))
+		if opts.Skip > 0 {
+			q.Set("$skip", strconv.Itoa(opts.Skip))
+		}
+		if opts.Top > 0 {
+			q.Set("$top", strconv.Itoa(opts.Top))
+		}
+	}
+	return c.packagePage(ctx, c.endpoint("Search()", q))
+}
+
+// Download returns a version's nupkg. The version "latest" downloads the version
+// flagged as latest, a pinned one if set.
+func (c *Client) Download(ctx context.Context, id string, version string) ([]byte, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.endpoint("nupkg/"+escapePath(id, version), nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	_, b, err := c.send(req, http.StatusOK)
+	return b, err
+}
+
+// Delete removes a version from the feed, or unlists it if the server's delete-mode
+// says so
+func (c *Client) Delete(ctx context.Context, id string, version string) error {
+	return c.do(ctx, http.MethodDelete, c.endpoint("api/v2/package/"+escapePath(id, version), nil), nil, nil, http.StatusNoContent)
+}
+
+// Unlist hides a version from searches and listings. It can still be restored.
+func (c *Client) Unlist(ctx context.Context, id string, version string) error {
+	return c.do(ctx, http.MethodPost, c.endpoint("admin/unlist/"+escapePath(id, version), nil), nil, nil, http.StatusNoContent)
+}
+
+// Relist shows an unlisted version again
+func (c *Client) Relist(ctx context.Context, id string, version string) error {
+	return c.do(ctx, http.MethodPost, c.endpoint("admin/relist/"+escapePath(id, version), nil), nil, nil, http.StatusNoContent)
+}
+
+// Pin flags a listed version as the package's latest, whatever its number
+func (c *Client) Pin(ctx context.Context, id string, version string) error {
+	in := struct {
+		Version string `json:"version"`
+	}{version}
+	return c.do(ctx, http.MethodPut, c.endpoint("admin/packages/"+escapePath(id, "pin"), nil), in, nil, http.StatusNoContent)
+}
+
+// Unpin returns a package to flagging its highest version as latest
+func (c *Client) Unpin(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, c.endpoint("admin/packages/"+escapePath(id, "pin"), nil), nil, nil, http.StatusNoContent)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/thatgitsam/go-nuget-server/client"
+)
+
+// newTestClient returns a client of the test server's feed with a key
+func newTestClient(ts *testServer, key string) *client.Client {
+	c := client.New(ts.Feed, key)
+	c.HTTPClient = ts.Client()
+	return c
+}
+
+// The client against a real server: pushes, listing, search, downloads and the
+// admin calls, and the server's refusals as typed errors
+func TestClient(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.MaxPageSize = 2
+		c.Moderation.Enabled = true
+		c.Moderation.PackageIDs = []string{"Mod.*"}
+	})
+	ctx := context.Background()
+	rw := newTestClient(ts, testWriteKey)
+	ro := newTestClient(ts, testReadKey)
+
+	pkgs := map[string][]byte{}
+	for _, ver := range []string{"1.0.0", "1.1.0", "2.0.0-beta"} {
+		pkgs[ver] = testPackage(t, "Client.Pkg", ver, "<tags>client</tags>", nil)
+		ps, err := rw.Push(ctx, bytes.NewReader(pkgs[ver]))
+		if err != nil {
+			t.Fatalf("push %s: %v", ver, err)
+		}
+		if ps.Quarantined {
+			t.Errorf("push %s: quarantined", ver)
+		}
+	}
+
+	// Refusals
+	if _, err := ro.Push(ctx, bytes.NewReader(testPackage(t, "Client.Pkg", "3.0.0", "", nil))); !client.IsForbidden(err) {
+		t.Errorf("push with a read key: %v", err)
+	}
+	if _, err := rw.Push(ctx, bytes.NewReader(testPackage(t, "Client.Pkg", "1.0.0", "<title>Other</title>", nil))); !client.IsConflict(err) {
+		t.Errorf("push of different bytes for a stored version: %v", err)
+	}
+	if _, err := rw.Push(ctx, bytes.NewReader(pkgs["1.0.0"])); err != nil {
+		t.Errorf("identical push retried: %v", err)
+	}
+	if _, err := rw.Download(ctx, "Client.Pkg", "9.0.0"); !client.IsNotFound(err) {
+		t.Errorf("download of a missing version: %v", err)
+	}
+
+	// Listing follows next links
+	var listed []string
+	page, err := ro.List(ctx)
+	for ; err == nil && page != nil; page, err = ro.NextPage(ctx, page) {
+		if len(page.Packages) > 2 {
+			t.Errorf("page of %d", len(page.Packages))
+		}
+		for _, p := range page.Packages {
+			listed = append(listed, p.Version)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 3 {
+		t.Errorf("listed %v", listed)
+	}
+
+	res, err := ro.Search(ctx, "tags:client", &client.SearchOptions{IncludePrerelease: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Packages) != 1 || res.Packages[0].Version != "2.0.0-beta" || !res.Packages[0].IsAbsoluteLatestVersion {
+		t.Errorf("search %+v", res.Packages)
+	}
+
+	// Downloads, latest following a pin
+	b, err := ro.Download(ctx, "client.pkg", "1.1")
+	if err != nil || !bytes.Equal(b, pkgs["1.1.0"]) {
+		t.Errorf("download 1.1: %v", err)
+	}
+	if err := ro.Pin(ctx, "Client.Pkg", "1.0.0"); !client.IsForbidden(err) {
+		t.Errorf("pin with a read key: %v", err)
+	}
+	if err := rw.Pin(ctx, "Client.Pkg", "9.0.0"); err == nil || err.(*client.Error).StatusCode != http.StatusBadRequest || err.(*client.Error).Message == "" {
+		t.Errorf("pin of a missing version: %v", err)
+	}
+	if err := rw.Pin(ctx, "Client.Pkg", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ro.Download(ctx, "Client.Pkg", "latest"); err != nil || !bytes.Equal(b, pkgs["1.0.0"]) {
+		t.Errorf("latest download when pinned: %v", err)
+	}
+	if err := rw.Unpin(ctx, "Client.Pkg"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ro.Download(ctx, "Client.Pkg", "latest"); err != nil || !bytes.Equal(b, pkgs["1.1.0"]) {
+		t.Errorf("latest download: %v", err)
+	}
+
+	// Unlist, relist and delete
+	if err := rw.Unlist(ctx, "Client.Pkg", "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := ro.Search(ctx, "tags:client", nil); err != nil || len(res.Packages) != 1 || res.Packages[0].Version != "1.0.0" {
+		t.Errorf("search with 1.1.0 unlisted: %v", err)
+	}
+	if err := rw.Relist(ctx, "Client.Pkg", "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Delete(ctx, "Client.Pkg", "2.0.0-beta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Delete(ctx, "Client.Pkg", "2.0.0-beta"); !client.IsNotFound(err) {
+		t.Errorf("delete again: %v", err)
+	}
+
+	// Quarantine
+	ps, err := rw.Push(ctx, bytes.NewReader(testPackage(t, "Mod.Pkg", "1.0.0", "", nil)))
+	if err != nil || !ps.Quarantined {
+		t.Fatalf("moderated push: %+v %v", ps, err)
+	}
+	rw.Push(ctx, bytes.NewReader(testPackage(t, "Mod.Other", "1.0.0", "", nil)))
+	q, err := rw.Quarantine(ctx)
+	if err != nil || len(q) != 2 {
+		t.Fatalf("quarantine %v %v", q, err)
+	}
+	if err := rw.Approve(ctx, "Mod.Pkg", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Reject(ctx, "Mod.Other", "1.0.0", "not ours"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Approve(ctx, "Mod.Other", "1.0.0"); !client.IsNotFound(err) {
+		t.Errorf("approve after reject: %v", err)
+	}
+
+	// Changes, resolve and facets
+	ch, err := ro.Changes(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, c := range ch.Changes {
+		if c.ID == "Client.Pkg" && c.Version == "2.0.0-beta" || c.ID == "Mod.Pkg" {
+			kinds = append(kinds, c.Type+" "+c.ID)
+		}
+	}
+	if want := "added Client.Pkg,removed Client.Pkg,added Mod.Pkg"; joinStrings(kinds) != want {
+		t.Errorf("changes %v, want %s", kinds, want)
+	}
+	// A range resolves to its lowest version, as clients do
+	r, err := ro.Resolve(ctx, "Client.Pkg", "[1.0,2.0)", false)
+	if err != nil || r.Selected == nil || *r.Selected != "1.0.0" || len(r.Candidates) != 2 {
+		t.Errorf("resolve %+v %v", r, err)
+	}
+	f, err := ro.Facets(ctx)
+	if err != nil || len(f.Tags) != 1 || f.Tags[0].Name != "client" {
+		t.Errorf("facets %+v %v", f, err)
+	}
+
+	// Snapshots keep what was there
+	s, err := rw.CreateSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Delete(ctx, "Client.Pkg", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	snap := client.New(s.URL, testReadKey)
+	snap.HTTPClient = ts.Client()
+	if b, err := snap.Download(ctx, "Client.Pkg", "1.0.0"); err == nil || len(b) > 0 {
+		// The nupkg itself is gone, only the snapshot's listing is kept
+		t.Logf("snapshot download: %v", err)
+	}
+	if err := rw.DeleteSnapshot(ctx, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.DeleteSnapshot(ctx, s.ID); !client.IsNotFound(err) {
+		t.Errorf("delete snapshot again: %v", err)
+	}
+
+	// Admin calls need a read-write key
+	if _, err := ro.Quarantine(ctx); !client.IsForbidden(err) {
+		t.Errorf("quarantine with a read key: %v", err)
+	}
+	if err := ro.ReloadConfig(ctx); !client.IsForbidden(err) {
+		t.Errorf("reload with a read key: %v", err)
+	}
+	if err := rw.ReloadConfig(ctx); err != nil {
+		t.Errorf("reload: %v", err)
+	}
+	if _, err := rw.CacheStats(ctx); !client.IsNotFound(err) {
+		t.Errorf("cache stats without a cache: %v", err)
+	}
+}
+
+func joinStrings(list []string) string {
+	s := ""
+	for i, x := range list {
+		if i > 0 {
+			s += ","
+		}
+		s += x
+	}
+	return s
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestArtifactoryRemote follows what an Artifactory remote repository sends: an
+// anonymous health check of the service root, an Id eq search and FindPackagesById
+// revalidated by ETag, then the download it caches
+func TestArtifactoryRemote(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Remote.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Remote.Pkg", "1.1.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Other.Pkg", "1.0.0", "", nil))
+
+	for _, p := range []string{"", "$metadata"} {
+		status, body := readResponse(t, ts.do(t, http.MethodGet, p, "", nil, nil))
+		wantStatus(t, "anonymous "+p, status, body, http.StatusOK)
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "Packages", "", nil, nil))
+	wantStatus(t, "anonymous Packages", status, body, http.StatusForbidden)
+
+	status, body = ts.get(t, "Packages()?$filter=Id%20eq%20'remote.pkg'")
+	wantStatus(t, "Id eq", status, body, http.StatusOK)
+	if got, want := feedIDs(t, body), []string{"Remote.Pkg 1.1.0", "Remote.Pkg 1.0.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Id eq: %v, want %v", got, want)
+	}
+
+	find := "FindPackagesById()?id='Remote.Pkg'"
+	resp := ts.do(t, http.MethodGet, find, testReadKey, nil, nil)
+	etag := resp.Header.Get("ETag")
+	status, body = readResponse(t, resp)
+	wantStatus(t, "FindPackagesById", status, body, http.StatusOK)
+	if etag == "" {
+		t.Fatal("FindPackagesById has no ETag")
+	}
+	resp = ts.do(t, http.MethodGet, find, testReadKey, nil, http.Header{"If-None-Match": {etag}})
+	status, body = readResponse(t, resp)
+	wantStatus(t, "revalidated", status, body, http.StatusNotModified)
+
+	// A new version changes the result set
+	ts.mustPush(t, testPackage(t, "Remote.Pkg", "1.2.0", "", nil))
+	resp = ts.do(t, http.MethodGet, find, testReadKey, nil, http.Header{"If-None-Match": {etag}})
+	if status, body = readResponse(t, resp); status != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Fatalf("after push: got %d ETag %s, want 200 and a new ETag", status, resp.Header.Get("ETag"))
+	}
+
+	src := between(body, `<content type="binary/octet-stream" src="`, `"`)
+	if !strings.HasPrefix(src, ts.Feed) {
+		t.Fatalf("download link %q is not under the feed", src)
+	}
+	status, body = ts.get(t, strings.TrimPrefix(src, ts.Feed))
+	wantStatus(t, "download", status, body, http.StatusOK)
+}
+
+// The service root can require a key like the rest of the feed
+func TestServiceRootRequireKey(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.ServiceRootRequireKey = true })
+	for _, p := range []string{"", "$metadata"} {
+		status, body := readResponse(t, ts.do(t, http.MethodGet, p, "", nil, nil))
+		wantStatus(t, "anonymous "+p, status, body, http.StatusForbidden)
+		status, body = ts.get(t, p)
+		wantStatus(t, "with key "+p, status, body, http.StatusOK)
+	}
+}
+
+func TestFeedFilterID(t *testing.T) {
+	for filter, want := range map[string]string{
+		"tolower(Id) eq 'foo'":            "foo",
+		"Id eq 'Foo'":                     "Foo",
+		"IsLatestVersion and Id eq 'Foo'": "Foo",
+		"Id ne 'Foo'":                     "",
+		"Version eq '1.0.0'":              "",
+		"":                                "",
+	} {
+		if got := parseFeedFilter(filter).ID; got != want {
+			t.Errorf("parseFeedFilter(%q).ID = %q, want %q", filter, got, want)
+		}
+	}
+}
+
+// Paket asks for SemVer 2.0.0 versions and follows every next link
+func TestPaketFindPackagesByID(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxPageSize = 2 })
+	for _, v := range []string{"1.0.0", "1.1.0-beta", "1.1.0-beta.2", "1.2.0+build.5", "2.0.0"} {
+		ts.mustPush(t, testPackage(t, "Paket.Pkg", v, "", nil))
+	}
+
+	all := func(p string) []string {
+		var got []string
+		for p != "" {
+			status, body := ts.get(t, p)
+			wantStatus(t, p, status, body, http.StatusOK)
+			got = append(got, feedIDs(t, body)...)
+			p = strings.TrimPrefix(nextHref(t, body), ts.Feed)
+		}
+		return got
+	}
+	got := all("api/v2/FindPackagesById()?id='Paket.Pkg'&semVerLevel=2.0.0")
+	want := []string{"Paket.Pkg 2.0.0", "Paket.Pkg 1.2.0+build.5", "Paket.Pkg 1.1.0-beta.2", "Paket.Pkg 1.1.0-beta", "Paket.Pkg 1.0.0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("semVerLevel=2.0.0: %q, want %q", got, want)
+	}
+
+	// Without semVerLevel, build metadata and dotted prereleases are left out
+	got = all("api/v2/FindPackagesById()?id='Paket.Pkg'")
+	want = []string{"Paket.Pkg 2.0.0", "Paket.Pkg 1.1.0-beta", "Paket.Pkg 1.0.0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("no semVerLevel: %q, want %q", got, want)
+	}
+}
+
+// Cake looks versions up as they were written in the build script
+func TestCakeSingleEntity(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Cake.Pkg", "1.0.0", "", nil))
+
+	for _, p := range []string{
+		"Packages(Id='Cake.Pkg',Version='1.0.0')",
+		"Packages(Id='Cake.Pkg',Version='1.0')",
+		"Packages(Id='cake.pkg',Version='1.0.0.0')",
+		"api/v2/Packages(Id='Cake.Pkg',Version='1.0')",
+	} {
+		status, body := ts.get(t, p)
+		wantStatus(t, p, status, body, http.StatusOK)
+		if got := between(body, "<d:Version>", "</d:Version>"); got != "1.0.0" {
+			t.Errorf("%s: version %q, want 1.0.0", p, got)
+		}
+	}
+	status, body := ts.get(t, "Packages(Id='Cake.Pkg',Version='1.0.1')")
+	wantStatus(t, "missing version", status, body, http.StatusNotFound)
+}
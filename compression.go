@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Smallest content file precompressed, unless configured
+const defaultPrecompressMinBytes = 1024
+
+// isCompressible reports whether a content type is worth gzipping. Archives, images
+// and other binary formats are already compressed or don't shrink.
+func isCompressible(contentType string) bool {
+	t := strings.ToLower(contentType)
+	if i := strings.Index(t, ";"); i >= 0 {
+		t = strings.TrimSpace(t[:i])
+	}
+	switch {
+	case strings.HasPrefix(t, "text/"),
+		strings.HasSuffix(t, "+xml"),
+		strings.HasSuffix(t, "+json"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript":
+		return true
+	}
+	return false
+}
+
+// gzipBytes compresses data at the best compression level, as it's only done once
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// acceptsGzip reports whether the client's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, h := range r.Header["Accept-Encoding"] {
+		for _, e := range strings.Split(h, ",") {
+			x := strings.Split(e, ";")
+			name := strings.ToLower(strings.TrimSpace(x[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			// An explicit q=0 refuses the encoding
+			q := 1.0
+			for _, p := range x[1:] {
+				p = strings.TrimSpace(p)
+				if strings.HasPrefix(p, "q=") {
+					q, _ = strconv.ParseFloat(p[2:], 64)
+				}
+			}
+			return q > 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func gunzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestPrecompressedContent(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.FileStore.PrecompressContent = true
+		c.FileStore.PrecompressMinBytes = 16
+	})
+	data := `{"design": "` + strings.Repeat("lua ", 256) + `"}`
+	ownGz, err := gzipBytes([]byte("the package's own archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.mustPush(t, testPackage(t, "Gz.Pkg", "1.0.0", "", map[string]string{
+		"content/data.json":    data,
+		"content/data.json.gz": string(ownGz),
+		"content/small.txt":    "tiny",
+	}))
+
+	// fetch returns a file's body, decoded, and its ETag
+	fetch := func(p string, gzip bool) (string, string) {
+		t.Helper()
+		enc := "identity"
+		if gzip {
+			enc = "gzip"
+		}
+		res := ts.do(t, http.MethodGet, p, testReadKey, nil, http.Header{"Accept-Encoding": {enc}})
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %d %s", p, res.StatusCode, b)
+		}
+		if res.Header.Get("Content-Encoding") == "gzip" {
+			if !gzip {
+				t.Errorf("%s: gzipped for a client that doesn't accept it", p)
+			}
+			b = gunzip(t, b)
+		}
+		return string(b), res.Header.Get("ETag")
+	}
+
+	for _, tc := range []struct {
+		file       string
+		want       string
+		compressed bool
+	}{
+		{"data.json", data, true},
+		{"data.json.gz", string(ownGz), false},
+		{"small.txt", "tiny", false},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			p := "files/gz.pkg/1.0.0/content/" + tc.file
+			plain, plainTag := fetch(p, false)
+			gz, gzTag := fetch(p, true)
+			if plain != tc.want || gz != tc.want {
+				t.Errorf("got %q and gzipped %q, want %q", plain, gz, tc.want)
+			}
+			if plainTag == "" || plainTag != gzTag {
+				t.Errorf("ETags %s and %s differ between encodings", plainTag, gzTag)
+			}
+
+			res := ts.do(t, http.MethodGet, p, testReadKey, nil, http.Header{"Accept-Encoding": {"gzip"}})
+			res.Body.Close()
+			if got := res.Header.Get("Content-Encoding") == "gzip"; got != tc.compressed {
+				t.Errorf("compressed copy served = %v, want %v", got, tc.compressed)
+			}
+			if ct := res.Header.Get("Content-Type"); tc.compressed && !strings.Contains(ct, "json") {
+				t.Errorf("Content-Type = %q, want the file's own type", ct)
+			}
+		})
+	}
+
+	// The copies are kept apart from the content and aren't served themselves
+	if _, err := os.Stat(precompressedPath(ts.versionDir(t, "gz.pkg", "1.0.0"), "content/data.json")); err != nil {
+		t.Errorf("no compressed copy: %v", err)
+	}
+	status, _ := ts.get(t, "files/gz.pkg/1.0.0/.gz/content/data.json.gz")
+	wantStatus(t, "compressed copy", status, "", http.StatusNotFound)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the environment variables overriding config fields
+const configEnvPrefix = "NUGETSERVER_"
+
+// Environment variable giving the default host-url, as container platforms often set
+const hostURLEnv = "NUGET_SERVER_URL"
+
+// Defaults used for anything neither the config file nor the environment sets
+const (
+	defaultHostURL = "http://localhost:5000/"
+	defaultRepoDIR = "./packages"
+)
+
+// Shown in place of secrets in the effective config
+const redacted = "REDACTED"
+
+// defaultConfig returns the config used with no config file: a local store in
+// ./packages open to anyone, served at NUGET_SERVER_URL or http://localhost:5000/
+func defaultConfig() *Config {
+	c := &Config{HostURL: defaultHostURL}
+	if u := os.Getenv(hostURLEnv); u != "" {
+		c.HostURL = u
+	}
+	c.FileStore.Type = "local"
+	c.FileStore.RepoDIR = defaultRepoDIR
+	return c
+}
+
+// readConfig returns the effective config: the defaults, overlaid by the config
+// file, overlaid by NUGETSERVER_ environment variables. A missing config file is
+// only an error if it isn't the default one. found reports whether it was read.
+func readConfig(cf string) (c *Config, found bool, err error) {
+	c = defaultConfig()
+	data, err := ioutil.ReadFile(cf)
+	if err == nil {
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, false, errors.New("error with json: " + err.Error())
+		}
+		found = true
+	} else if !os.IsNotExist(err) || cf != defaultConfigFile {
+		return nil, false, err
+	}
+	if err := applyConfigEnv(c, os.Environ()); err != nil {
+		return nil, false, err
+	}
+	return c, found, nil
+}
+
+// applyConfigEnv sets config fields from NUGETSERVER_ environment variables. The
+// name of a field is the prefix then the Go field names on the way to it,
+// uppercased and joined by '_', e.g. NUGETSERVER_FILESTORE_REPODIR. Strings,
+// numbers and booleans are given as is, string lists comma separated or as JSON,
+// and anything else (maps, lists of objects, whole sections) as JSON.
+func applyConfigEnv(c *Config, environ []string) error {
+	vars := map[string]string{}
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv, configEnvPrefix) {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+
+	used := map[string]bool{}
+	if err := applyEnvFields(reflect.ValueOf(c).Elem(), configEnvPrefix, vars, used); err != nil {
+		return err
+	}
+
+	// A name matching no field is most likely a typo, which shouldn't go unnoticed
+	var unknown []string
+	for k := range vars {
+		if !used[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.New("unknown config environment variables: " + strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// applyEnvFields sets the fields of a config struct named by vars under prefix
+func applyEnvFields(v reflect.Value, prefix string, vars map[string]string, used map[string]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := prefix + strings.ToUpper(f.Name)
+		fv := v.Field(i)
+
+		// A section can be set whole as JSON, then its fields individually
+		if s, ok := vars[name]; ok {
+			used[name] = true
+			if err := setEnvValue(fv, s); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		if f.Type.Kind() == reflect.Struct {
+			if err := applyEnvFields(fv, name+"_", vars, used); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setEnvValue parses an environment variable into a config field
+func setEnvValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(s), "[") {
+			l := []string{}
+			for _, x := range strings.Split(s, ",") {
+				if x = strings.TrimSpace(x); x != "" {
+					l = append(l, x)
+				}
+			}
+			v.Set(reflect.ValueOf(l))
+			return nil
+		}
+		fallthrough
+	default:
+		if err := json.Unmarshal([]byte(s), v.Addr().Interface()); err != nil {
+			return errors.New("must be JSON: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// redactConfig returns a copy of a config with keys replaced, so it can be shown
+func redactConfig(c *Config) *Config {
+	r := &Config{}
+	b, _ := json.Marshal(c)
+	json.Unmarshal(b, r)
+
+	if r.SkipTokenKey != "" {
+		r.SkipTokenKey = redacted
+	}
+	if r.ShareKey != "" {
+		r.ShareKey = redacted
+	}
+	redactKeys(r.FileStore.APIKeys.ReadOnly)
+	redactKeys(r.FileStore.APIKeys.ReadWrite)
+	for i := range r.IDPolicies {
+		redactKeys(r.IDPolicies[i].AllowedKeys)
+	}
+	for _, keys := range r.Visibility.Groups {
+		redactKeys(keys)
+	}
+	redactKeys(r.Visibility.AdminKeys)
+	return r
+}
+
+// redactKeys replaces each key in a list, keeping how many there are
+func redactKeys(keys []string) {
+	for i := range keys {
+		keys[i] = redacted
+	}
+}
+
+// serveConfig handles GET admin/config, the running config with keys redacted
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(redactConfig(server.Config()), "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The environment wins over the config file, which wins over the defaults, field
+// by field
+func TestConfigPrecedence(t *testing.T) {
+	const file = `{
+		"host-url": "https://file.example.com/feed/",
+		"log-level": 1,
+		"filestore": {"type": "local", "local-directory": "/file/packages", "api-keys": {"read-write": ["file-key"]}},
+		"moderation": {"enabled": true, "package-ids": ["File.*"]}
+	}`
+
+	type want struct {
+		hostURL    string
+		logLevel   int
+		repoDIR    string
+		readWrite  []string
+		moderation bool
+		moderated  []string
+	}
+	defaults := want{hostURL: defaultHostURL, repoDIR: defaultRepoDIR}
+	fromFile := want{"https://file.example.com/feed/", 1, "/file/packages", []string{"file-key"}, true, []string{"File.*"}}
+
+	for _, tc := range []struct {
+		name string
+		file string // Config file contents, none if empty
+		env  map[string]string
+		want want
+		err  string // Part of the error expected, if any
+	}{
+		{name: "defaults", want: defaults},
+		{name: "default url from the platform", env: map[string]string{hostURLEnv: "https://platform.example.com/"},
+			want: want{hostURL: "https://platform.example.com/", repoDIR: defaultRepoDIR}},
+		{name: "file", file: file, want: fromFile},
+		{name: "file over the platform url", file: file, env: map[string]string{hostURLEnv: "https://platform.example.com/"}, want: fromFile},
+		{name: "environment", env: map[string]string{
+			"NUGETSERVER_HOSTURL":                     "https://env.example.com/",
+			"NUGETSERVER_FILESTORE_REPODIR":           "/env/packages",
+			"NUGETSERVER_FILESTORE_APIKEYS_READWRITE": "env-1, env-2",
+		}, want: want{hostURL: "https://env.example.com/", repoDIR: "/env/packages", readWrite: []string{"env-1", "env-2"}}},
+		{name: "environment over file", file: file, env: map[string]string{
+			hostURLEnv:             "https://platform.example.com/",
+			"NUGETSERVER_HOSTURL":  "https://env.example.com/",
+			"NUGETSERVER_LOGLEVEL": "0",
+			"NUGETSERVER_FILESTORE_APIKEYS_READWRITE": `["env-key"]`,
+			"NUGETSERVER_MODERATION_ENABLED":          "false",
+		}, want: want{"https://env.example.com/", 0, "/file/packages", []string{"env-key"}, false, []string{"File.*"}}},
+		{name: "section then field", file: file, env: map[string]string{
+			"NUGETSERVER_MODERATION":         `{"enabled": false, "package-ids": ["Env.*"]}`,
+			"NUGETSERVER_MODERATION_ENABLED": "true",
+		}, want: want{"https://file.example.com/feed/", 1, "/file/packages", []string{"file-key"}, true, []string{"Env.*"}}},
+		{name: "empty list", file: file, env: map[string]string{"NUGETSERVER_FILESTORE_APIKEYS_READWRITE": ""},
+			want: want{"https://file.example.com/feed/", 1, "/file/packages", []string{}, true, []string{"File.*"}}},
+
+		{name: "unknown variable", file: file, env: map[string]string{"NUGETSERVER_HOSTURLL": "x"}, err: "unknown config environment variables: NUGETSERVER_HOSTURLL"},
+		{name: "bad bool", env: map[string]string{"NUGETSERVER_MODERATION_ENABLED": "yes please"}, err: "NUGETSERVER_MODERATION_ENABLED: must be true or false"},
+		{name: "bad number", env: map[string]string{"NUGETSERVER_LOGLEVEL": "high"}, err: "NUGETSERVER_LOGLEVEL: must be a whole number"},
+		{name: "bad json", env: map[string]string{"NUGETSERVER_CONTENTTYPES": ".qsys=binary"}, err: "NUGETSERVER_CONTENTTYPES: must be JSON"},
+		{name: "bad file", file: `{"host-url": `, err: "error with json"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// No config file is only allowed for the default one, so run where it isn't
+			dir := t.TempDir()
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+			if tc.file != "" {
+				if err := ioutil.WriteFile(filepath.Join(dir, defaultConfigFile), []byte(tc.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv(hostURLEnv, "")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			c, found, err := readConfig(defaultConfigFile)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != (tc.file != "") {
+				t.Errorf("found %v", found)
+			}
+			got := want{c.HostURL, c.Loglevel, c.FileStore.RepoDIR, c.FileStore.APIKeys.ReadWrite, c.Moderation.Enabled, c.Moderation.PackageIDs}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+			if c.FileStore.Type != "local" {
+				t.Errorf("filestore type %q", c.FileStore.Type)
+			}
+		})
+	}
+
+	// Only the default config file may be missing
+	if _, _, err := readConfig(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing named config: got %v", err)
+	}
+}
+
+// Settings can hold signing keys, so only the server's user may read them
+func TestSettingsPrivate(t *testing.T) {
+	ts := newTestServer(t, nil)
+	fs := ts.local(t)
+	if err := fs.PutSetting(context.Background(), "private", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fs.settingPath("private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("setting written with mode %o, want 600", perm)
+	}
+}
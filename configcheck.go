@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkConfig runs the startup checks on a config: the rules validateConfig applies
+// on reload, plus the host URL and filestore location. Problems that stop the server
+// working are returned as an error, ones that probably aren't intended as warnings.
+func checkConfig(c *Config) ([]string, error) {
+	var warnings []string
+
+	if err := validateConfig(c); err != nil {
+		return nil, err
+	}
+
+	// The host URL is the base of every link in the feed, so must be exact
+	if c.HostURL == "" {
+		return nil, errors.New("host-url must be set")
+	}
+	u, err := url.Parse(c.HostURL)
+	if err != nil {
+		return nil, errors.New("host-url is not a valid URL: " + err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("host-url scheme must be http or https: " + c.HostURL)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("host-url has no host: " + c.HostURL)
+	}
+	if p := u.Port(); p != "" {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return nil, errors.New("host-url port is not a valid port number: " + p)
+		}
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		return nil, errors.New(`host-url path must end with "/": ` + c.HostURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New("host-url must not have a query or fragment: " + c.HostURL)
+	}
+	if u.Scheme == "http" && !isLoopbackHost(u.Hostname()) {
+		warnings = append(warnings, "host-url uses http for a non-local host, API keys will be sent in the clear")
+	}
+
+	// The filestore must be usable
+	switch c.FileStore.Type {
+	case "local":
+		if c.FileStore.RepoDIR == "" {
+			return nil, errors.New("filestore local-directory must be set")
+		}
+		if err := checkWritableDir(c.FileStore.RepoDIR); err != nil {
+			return nil, errors.New("filestore local-directory is not writable: " + err.Error())
+		}
+		if err := validateLayout(c); err != nil {
+			return nil, err
+		}
+	case "gcp":
+		if c.FileStore.BucketName == "" || c.FileStore.ProjectID == "" {
+			return nil, errors.New("filestore storage-bucket and project-id must be set")
+		}
+	default:
+		return nil, errors.New(`filestore type must be "local" or "gcp": ` + c.FileStore.Type)
+	}
+	if c.FileStore.CacheDirectory != "" {
+		if c.FileStore.Type == "local" {
+			warnings = append(warnings, "filestore cache-directory is ignored for a local filestore")
+		} else if err := checkWritableDir(c.FileStore.CacheDirectory); err != nil {
+			return nil, errors.New("filestore cache-directory is not writable: " + err.Error())
+		}
+	}
+	if c.FileStore.CacheMaxBytes < 0 {
+		return nil, errors.New("filestore cache-max-bytes must not be negative")
+	}
+
+	// Repeated keys are harmless but a key in both lists is probably a mistake
+	keys := c.FileStore.APIKeys
+	seen := make(map[string]bool)
+	for _, k := range keys.ReadOnly {
+		if seen[k] {
+			warnings = append(warnings, "read-only api-keys lists a key more than once")
+		}
+		seen[k] = true
+	}
+	rw := make(map[string]bool)
+	for _, k := range keys.ReadWrite {
+		if rw[k] {
+			warnings = append(warnings, "read-write api-keys lists a key more than once")
+		}
+		rw[k] = true
+		if seen[k] {
+			warnings = append(warnings, "a key is in both read-only and read-write api-keys, it has read-write access")
+		}
+	}
+
+	// URLs the server sends to or writes into packages, which are only used once
+	// the feature is on or a package is pushed, so would otherwise fail late
+	if c.Telemetry.CollectorURL != "" {
+		u, err := url.Parse(c.Telemetry.CollectorURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("telemetry collector-url must be an http or https URL: " + c.Telemetry.CollectorURL)
+		}
+	}
+	for _, ic := range c.PushInterceptors {
+		if ic.Name != injectRepositoryInterceptor {
+			continue
+		}
+		var h injectRepositoryHook
+		if err := json.Unmarshal(ic.Config, &h); err != nil {
+			return nil, errors.New(injectRepositoryInterceptor + " config: " + err.Error())
+		}
+		if err := checkAbsoluteURL(h.URL); err != nil {
+			return nil, errors.New(injectRepositoryInterceptor + " url " + err.Error())
+		}
+	}
+	if c.ReportAbuseURL != "" {
+		if _, err := url.Parse(examplePackageURL(c.ReportAbuseURL)); err != nil {
+			return nil, errors.New("report-abuse-url is not a valid URL: " + c.ReportAbuseURL)
+		}
+	}
+
+	return warnings, nil
+}
+
+// examplePackageURL fills in a URL template's {id} and {version} for checking
+func examplePackageURL(t string) string {
+	return strings.NewReplacer("{id}", "Package.Id", "{version}", "1.0.0").Replace(t)
+}
+
+// checkAbsoluteURL checks a URL template expands to an absolute URL with a host
+func checkAbsoluteURL(t string) error {
+	u, err := url.Parse(examplePackageURL(t))
+	if err != nil {
+		return errors.New("is not a valid URL: " + t)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return errors.New("must be an absolute URL: " + t)
+	}
+	return nil
+}
+
+// isLoopbackHost reports whether a host name only reaches the local machine
+func isLoopbackHost(h string) bool {
+	if h == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(h)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkWritableDir creates a directory if needed and checks files can be written to it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
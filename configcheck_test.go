@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes a config from testdata/config to a temp directory, with
+// {tmp} replaced by the directory, which also holds a regular file named file
+func writeTestConfig(t *testing.T, name string) string {
+	t.Helper()
+	tmp := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(tmp, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "config", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := filepath.Join(tmp, "config.json")
+	b = []byte(strings.Replace(string(b), "{tmp}", filepath.ToSlash(tmp), -1))
+	if err := ioutil.WriteFile(cf, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cf
+}
+
+func TestCheckConfig(t *testing.T) {
+	for _, tc := range []struct {
+		config  string
+		err     string // Part of the error expected, if any
+		warning string // Part of the warning expected, if any
+	}{
+		{config: "valid"},
+		{config: "host-url-missing", err: "host-url must be set"},
+		{config: "host-url-invalid", err: "host-url is not a valid URL"},
+		{config: "host-url-scheme", err: "scheme must be http or https"},
+		{config: "host-url-no-host", err: "host-url has no host"},
+		{config: "host-url-port", err: "not a valid port number"},
+		{config: "host-url-no-slash", err: `must end with "/"`},
+		{config: "host-url-query", err: "must not have a query"},
+		{config: "host-url-http", warning: "sent in the clear"},
+		{config: "local-directory-missing", err: "local-directory must be set"},
+		{config: "local-directory-unwritable", err: "local-directory is not writable"},
+		{config: "filestore-type", err: `type must be "local" or "gcp"`},
+		{config: "gcp-project-missing", err: "storage-bucket and project-id must be set"},
+		{config: "cache-directory-local", warning: "cache-directory is ignored"},
+		{config: "cache-max-bytes-negative", err: "cache-max-bytes must not be negative"},
+		{config: "api-key-empty", err: "must not contain empty or blank keys"},
+		{config: "api-key-blank", err: "must not contain empty or blank keys"},
+		{config: "api-key-repeated", warning: "lists a key more than once"},
+		{config: "api-key-both-lists", warning: "in both read-only and read-write"},
+		{config: "telemetry-url-invalid", err: "collector-url must be an http or https URL"},
+		{config: "telemetry-url-invalid-disabled", err: "collector-url must be an http or https URL"},
+		{config: "inject-repository-url-relative", err: "url must be an absolute URL"},
+		{config: "inject-repository-url-invalid", err: "url is not a valid URL"},
+		{config: "report-abuse-url-invalid", err: "report-abuse-url is not a valid URL"},
+	} {
+		t.Run(tc.config, func(t *testing.T) {
+			c, _, err := readConfig(writeTestConfig(t, tc.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			warnings, err := checkConfig(c)
+			if tc.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("got error %v, want one containing %q", err, tc.err)
+			}
+			if tc.err != "" {
+				return
+			}
+			if tc.warning == "" && len(warnings) > 0 {
+				t.Errorf("unexpected warnings: %q", warnings)
+			}
+			if tc.warning != "" && !strings.Contains(strings.Join(warnings, "\n"), tc.warning) {
+				t.Errorf("got warnings %q, want one containing %q", warnings, tc.warning)
+			}
+		})
+	}
+}
+
+// -check-config exits 1 on errors
+func TestCheckConfigFile(t *testing.T) {
+	for name, want := range map[string]int{"valid": exitOK, "host-url-http": exitOK, "api-key-blank": exitFailure} {
+		if got := checkConfigFile(writeTestConfig(t, name)); got != want {
+			t.Errorf("%s: exit %d, want %d", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Recordings of client traffic, made with tools/record. See testdata/conformance/README.md.
+const conformanceDir = "testdata/conformance"
+
+// conformanceFeeds lists the packages each recording was made against, as in
+// testdata/conformance/packages. Recordings not listed start from an empty feed.
+var conformanceFeeds = map[string][]string{
+	"dotnet-restore": {"Conformance.Lib.1.0.0.nupkg", "Conformance.Lib.1.1.0.nupkg"},
+	"nuget-install":  {"Conformance.Lib.1.0.0.nupkg", "Conformance.Lib.1.1.0.nupkg"},
+	"vs-browse":      {"Conformance.Lib.1.0.0.nupkg", "Conformance.Lib.1.1.0.nupkg"},
+	"paket-update":   {"Conformance.Lib.1.0.0.nupkg", "Conformance.Lib.1.1.0.nupkg"},
+}
+
+// recordedExchange is a line of a recording, as written by tools/record
+type recordedExchange struct {
+	Request  recordedMessage `json:"request"`
+	Response recordedMessage `json:"response"`
+}
+
+type recordedMessage struct {
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Status     int                 `json:"status"`
+	Header     map[string][]string `json:"header"`
+	Body       string              `json:"body"`
+	BodyBase64 string              `json:"bodyBase64"`
+}
+
+// body returns a recorded body with {base} replaced by a feed's URL
+func (m recordedMessage) body(t *testing.T, base string) []byte {
+	t.Helper()
+	if m.BodyBase64 != "" {
+		b, err := base64.StdEncoding.DecodeString(m.BodyBase64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	return []byte(strings.Replace(m.Body, "{base}", base, -1))
+}
+
+// TestConformance replays what real clients send and checks the feed still gives
+// them the statuses, headers and fields they read from the responses
+func TestConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(conformanceDir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no recordings in " + conformanceDir)
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".jsonl")
+		t.Run(name, func(t *testing.T) {
+			replay(t, name, readRecording(t, f))
+		})
+	}
+}
+
+func readRecording(t *testing.T, f string) []recordedExchange {
+	t.Helper()
+	file, err := os.Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var rec []recordedExchange
+	s := bufio.NewScanner(file)
+	s.Buffer(nil, 16<<20)
+	for s.Scan() {
+		var e recordedExchange
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		rec = append(rec, e)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// replay sends each recorded request in turn to a new feed, comparing the responses
+func replay(t *testing.T, name string, rec []recordedExchange) {
+	// Clients were recorded without a read key, as most feeds are set up
+	ts := newTestServer(t, func(c *Config) {
+		c.FileStore.APIKeys.ReadOnly = nil
+	})
+	for _, p := range conformanceFeeds[name] {
+		b, err := ioutil.ReadFile(filepath.Join(conformanceDir, "packages", p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.mustPush(t, b)
+	}
+	base := strings.TrimSuffix(ts.Feed, "/")
+	client := ts.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	for i, e := range rec {
+		what := e.Request.Method + " " + e.Request.Path
+		r, err := http.NewRequest(e.Request.Method, strings.Replace(e.Request.Path, "{base}", base, 1), bytes.NewReader(e.Request.body(t, base)))
+		if err != nil {
+			t.Fatalf("%d %s: %v", i, what, err)
+		}
+		for k, v := range e.Request.Header {
+			switch {
+			case k == "Accept-Encoding" || k == "Content-Length":
+				// Sent by the transport, which decompresses responses as the recorder had them
+			case v[0] == "REDACTED":
+				r.Header.Set(k, testWriteKey)
+			default:
+				r.Header[k] = v
+			}
+		}
+		res, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("%d %s: %v", i, what, err)
+		}
+		status, body := readResponse(t, res)
+		if status != e.Response.Status {
+			wantStatus(t, what, status, body, e.Response.Status)
+		}
+		checkResponse(t, what, e.Response, res.Header, []byte(body), base)
+	}
+}
+
+// checkResponse compares a response with a recorded one by what clients read:
+// the media type, the shape of JSON and XML bodies and the packages listed in
+// them, and the bytes of anything else
+func checkResponse(t *testing.T, what string, want recordedMessage, header http.Header, got []byte, base string) {
+	t.Helper()
+	wantType := mediaType(http.Header(want.Header).Get("Content-Type"))
+	if gotType := mediaType(header.Get("Content-Type")); gotType != wantType {
+		t.Errorf("%s: Content-Type %q, want %q", what, gotType, wantType)
+	}
+	if loc := http.Header(want.Header).Get("Location"); loc != "" {
+		if got := header.Get("Location"); got != strings.Replace(loc, "{base}", base, 1) {
+			t.Errorf("%s: Location %q, want %q", what, got, loc)
+		}
+	}
+
+	wantBody := want.body(t, base)
+	switch {
+	case len(wantBody) == 0:
+	case strings.Contains(wantType, "json"):
+		missing(t, what, jsonShape(t, wantBody), jsonShape(t, got))
+		if w, g := jsonVersions(t, wantBody), jsonVersions(t, got); !reflect.DeepEqual(w, g) {
+			t.Errorf("%s: versions %v, want %v", what, g, w)
+		}
+	case strings.Contains(wantType, "xml"):
+		missing(t, what, xmlShape(t, wantBody), xmlShape(t, got))
+		if w, g := feedIDs(t, string(wantBody)), feedIDs(t, string(got)); !reflect.DeepEqual(w, g) {
+			t.Errorf("%s: entries %v, want %v", what, g, w)
+		}
+	case !bytes.Equal(wantBody, got):
+		t.Errorf("%s: body differs from the recording, got %d bytes, want %d", what, len(got), len(wantBody))
+	}
+}
+
+func mediaType(ct string) string {
+	mt, _, _ := mime.ParseMediaType(ct)
+	return mt
+}
+
+// missing reports the fields of a recorded response the replayed one lacks
+func missing(t *testing.T, what string, want map[string]bool, got map[string]bool) {
+	t.Helper()
+	var m []string
+	for k := range want {
+		if !got[k] {
+			m = append(m, k)
+		}
+	}
+	sort.Strings(m)
+	if len(m) > 0 {
+		t.Errorf("%s: missing %s", what, strings.Join(m, ", "))
+	}
+}
+
+// jsonShape returns the paths of a JSON document's fields, such as
+// resources[].@id, along with the values of @type, which clients look services up by
+func jsonShape(t *testing.T, b []byte) map[string]bool {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("%v: %.200s", err, b)
+	}
+	shape := make(map[string]bool)
+	var walk func(p string, v interface{})
+	walk = func(p string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, c := range v {
+				shape[p+k] = true
+				if s, ok := c.(string); ok && k == "@type" {
+					shape[p+k+"="+s] = true
+				}
+				walk(p+k+".", c)
+			}
+		case []interface{}:
+			for _, c := range v {
+				walk(strings.TrimSuffix(p, ".")+"[].", c)
+			}
+		}
+	}
+	walk("", v)
+	return shape
+}
+
+// jsonVersions returns the version list of a flat container index, if it is one
+func jsonVersions(t *testing.T, b []byte) []string {
+	t.Helper()
+	var v struct {
+		Versions []string `json:"versions"`
+	}
+	json.Unmarshal(b, &v)
+	return v.Versions
+}
+
+// xmlShape returns the paths of an XML document's elements and attributes, such
+// as feed/entry/properties/Id and feed/entry/content@src
+func xmlShape(t *testing.T, b []byte) map[string]bool {
+	t.Helper()
+	shape := make(map[string]bool)
+	d := xml.NewDecoder(bytes.NewReader(b))
+	var stack []string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%v: %.200s", err, b)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, tok.Name.Local)
+			p := strings.Join(stack, "/")
+			shape[p] = true
+			for _, a := range tok.Attr {
+				if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" {
+					shape[p+"@"+a.Name.Local] = true
+				}
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return shape
+}
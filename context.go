@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Status logged for requests the client gave up on, as nginx does. The client never sees it.
+const statusClientClosedRequest = 499
+
+// Size of each write when streaming a body, between checks for a cancelled request
+const streamChunkSize = 32 * 1024
+
+// isCancelled reports whether err is from a request's context ending. Stores
+// backed by a remote service may wrap it.
+func isCancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// writeCancelled records that a request was abandoned by its client. The router
+// logs it at debug level.
+func writeCancelled(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(statusClientClosedRequest)
+}
+
+// writeBody writes b in chunks, stopping early if the request is cancelled
+func writeBody(ctx context.Context, w http.ResponseWriter, b []byte) error {
+	for len(b) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := len(b)
+		if n > streamChunkSize {
+			n = streamChunkSize
+		}
+		if _, err := w.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// logDebug logs only when the log level asks for detail
+func logDebug(v ...interface{}) {
+	if server.Config().Loglevel > 0 {
+		log.Println(v...)
+	}
+}
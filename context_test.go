@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// cancellingWriter cancels its request's context after the first write
+type cancellingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+	writes int
+}
+
+func (w *cancellingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestWriteBodyStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &cancellingWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+	err := writeBody(ctx, w, make([]byte, 4*streamChunkSize))
+	if err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if w.writes != 1 || w.Body.Len() != streamChunkSize {
+		t.Errorf("%d writes of %d bytes, want one chunk", w.writes, w.Body.Len())
+	}
+
+	w = &cancellingWriter{ResponseRecorder: httptest.NewRecorder(), cancel: func() {}}
+	if err := writeBody(context.Background(), w, make([]byte, 2*streamChunkSize+1)); err != nil || w.writes != 3 {
+		t.Errorf("uncancelled: %v after %d writes, want 3", err, w.writes)
+	}
+}
+
+// Paging through the store stops between pages once the request is cancelled
+func TestPagingStopsWhenCancelled(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Cancel.Pkg", "1.0.0", "", nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	keep := func(e []*NugetPackageEntry) []*NugetPackageEntry { return e }
+
+	if _, err := countFeedEntries(ctx, "", keep); !isCancelled(err) {
+		t.Errorf("count: got %v, want a cancellation", err)
+	}
+	if _, _, err := skipFeedEntries(ctx, "", 1, 10, keep); !isCancelled(err) {
+		t.Errorf("skip: got %v, want a cancellation", err)
+	}
+	if n, err := countFeedEntries(context.Background(), "", keep); err != nil || n != 1 {
+		t.Errorf("count uncancelled: %d, %v", n, err)
+	}
+}
+
+// A request the client gave up on is recorded as 499 and only logged when debugging
+func TestCancelledRequest(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Cancel.Pkg", "1.0.0", "", nil))
+
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	for _, p := range []string{"Packages()?$skip=1", "Packages/$count"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := httptest.NewRequest(http.MethodGet, "/feed/"+p, nil).WithContext(ctx)
+		r.Header.Set("X-NuGet-ApiKey", testReadKey)
+		w := httptest.NewRecorder()
+		handleRequest(w, r)
+		if w.Code != statusClientClosedRequest {
+			t.Errorf("%s: got %d, want %d", p, w.Code, statusClientClosedRequest)
+		}
+	}
+	if strings.Contains(logged.String(), "Request::") || strings.Contains(logged.String(), "Request cancelled::") {
+		t.Errorf("cancelled requests logged outside debug:\n%s", logged.String())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isCountPath reports whether a feed request is for its $count, e.g. Packages()/$count
+func isCountPath(path string) bool {
+	return strings.HasSuffix(path, `/$count`)
+}
+
+// requestInlineCount reports whether a feed should include its count, from
+// $inlinecount=allpages
+func requestInlineCount(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get("$inlinecount"); v {
+	case "", "none":
+		return false, nil
+	case "allpages":
+		return true, nil
+	default:
+		return false, &odataError{Status: http.StatusBadRequest, Message: "$inlinecount of '" + v + "' is not supported, expected allpages or none"}
+	}
+}
+
+// countFeedEntries counts the entries for id that keep lets through, paging
+// through the store as the feed does
+func countFeedEntries(ctx context.Context, id string, keep func([]*NugetPackageEntry) []*NugetPackageEntry) (int, error) {
+	n := 0
+	startAfter := ""
+	for {
+		// The store may not check between pages, so stop here for a cancelled request
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		page, more, err := server.fs.GetPackageFeedEntries(ctx, id, startAfter, 100)
+		if err == ErrStartAfterGone {
+			// The last version counted was removed meanwhile, so count again
+			n, startAfter = 0, ""
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		n += len(keep(page))
+		if !more || len(page) == 0 {
+			return n, nil
+		}
+		last := page[len(page)-1]
+		startAfter = last.Properties.ID + "." + last.Properties.Version
+	}
+}
+
+// serveFeedCount answers a $count request, or writes the error counting gave
+func serveFeedCount(w http.ResponseWriter, r *http.Request, n int, err error) {
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b := []byte(strconv.Itoa(n))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// $count and $inlinecount=allpages count what the feed would list, whatever the
+// page asked for
+func TestFeedCount(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, v := range []string{"Count.A 1.0.0", "Count.A 2.0.0", "Count.A 3.0.0-beta", "Count.B 1.0.0", "Count.B 1.1.0"} {
+		x := strings.Fields(v)
+		ts.mustPush(t, testPackage(t, x[0], x[1], "", nil))
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Count.B/1.1.0", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	for _, tc := range []struct {
+		p    string
+		want string
+	}{
+		{"Packages/$count", "4"},
+		{"Packages()/$count", "4"},
+		{"api/v2/Packages()/$count", "4"},
+		{"Packages()/$count?$top=1&$skip=1", "4"},
+		{"Packages()/$count?$filter=IsLatestVersion", "2"},
+		{"Packages()/$count?$filter=IsAbsoluteLatestVersion and tolower(Id) eq 'count.a'", "1"},
+		{"FindPackagesById()/$count?id='Count.A'", "3"},
+		{"FindPackagesById()/$count?id='Count.A'&includePrerelease=false", "2"},
+		{"FindPackagesById()/$count?id='Count.B'", "2"},
+		{"FindPackagesById()/$count?id='No.Such.Pkg'", "0"},
+		// Search counts packages rather than versions
+		{"Search()/$count?searchTerm='count'", "2"},
+		{"Search()/$count?searchTerm='count'&includePrerelease=true&$top=1", "2"},
+		{"api/v2/Search()/$count?searchTerm='nothing-matches'", "0"},
+	} {
+		res := ts.do(t, http.MethodGet, strings.ReplaceAll(tc.p, " ", "%20"), testReadKey, nil, nil)
+		contentType := res.Header.Get("Content-Type")
+		status, body := readResponse(t, res)
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		if body != tc.want || contentType != "text/plain; charset=utf-8" {
+			t.Errorf("%s: got %q as %s, want %q", tc.p, body, contentType, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		p       string
+		count   string // Empty for none
+		entries int
+	}{
+		{"Packages()?$inlinecount=allpages&$top=1", "4", 1},
+		{"Packages()?$inlinecount=allpages&$filter=IsLatestVersion", "2", 2},
+		{"Packages()?$inlinecount=allpages&$top=0", "4", 0},
+		{"Packages()?$inlinecount=none", "", 4},
+		{"Packages()", "", 4},
+		{"FindPackagesById()?id='Count.A'&$inlinecount=allpages&$top=1", "3", 1},
+		{"Search()?searchTerm='count'&$inlinecount=allpages&$top=1", "2", 1},
+	} {
+		status, body := ts.get(t, strings.ReplaceAll(tc.p, " ", "%20"))
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		count := between(body, "<m:count>", "</m:count>")
+		if count != tc.count || strings.Contains(body, "<m:count>") != (tc.count != "") {
+			t.Errorf("%s: count %q, want %q", tc.p, count, tc.count)
+		}
+		if n := len(feedIDs(t, body)); n != tc.entries {
+			t.Errorf("%s: %d entries, want %d", tc.p, n, tc.entries)
+		}
+	}
+	for _, p := range []string{"Packages()?$inlinecount=some", "Search()?searchTerm=''&$inlinecount=all"} {
+		status, body := ts.get(t, p)
+		wantStatus(t, p, status, body, http.StatusBadRequest)
+	}
+
+	// A script polling the count sees a push
+	ts.mustPush(t, testPackage(t, "Count.C", "1.0.0", "", nil))
+	if status, body := ts.get(t, "Packages/$count"); status != http.StatusOK || body != "5" {
+		t.Errorf("after a push: got %d %q, want 5", status, body)
+	}
+}
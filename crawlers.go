@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Crawler actions on download routes
+const (
+	crawlerDeny     = "deny"
+	crawlerThrottle = "throttle"
+)
+
+// Time a throttled crawler waits between downloads when crawlers set none
+const defaultCrawlerInterval = 10 * time.Second
+
+// Paths robots.txt disallows when crawlers set none, relative to host-url
+var defaultRobotsDisallow = []string{"nupkg", "admin"}
+
+// crawlerConfig keeps web crawlers away from the feed
+type crawlerConfig struct {
+	// Paths robots.txt disallows, relative to host-url (default nupkg and admin, [] for none)
+	Disallow []string `json:"disallow"`
+	// Send X-Robots-Tag: noindex on feed, download and admin responses
+	NoIndex bool `json:"noindex"`
+	// User-Agent substrings of crawlers, matched ignoring case
+	UserAgents []string `json:"user-agents"`
+	// What crawlers get on download routes, 'deny' (403) or 'throttle' (off if empty)
+	Action string `json:"action"`
+	// Time a throttled crawler waits between downloads, e.g. "10s" (default 10s)
+	ThrottleInterval string `json:"throttle-interval"`
+}
+
+// validateCrawlers checks the crawlers config
+func validateCrawlers(c *Config) error {
+	switch c.Crawlers.Action {
+	case "", crawlerDeny, crawlerThrottle:
+	default:
+		return errors.New("crawlers action must be deny or throttle: " + c.Crawlers.Action)
+	}
+	if c.Crawlers.ThrottleInterval != "" {
+		if d, err := time.ParseDuration(c.Crawlers.ThrottleInterval); err != nil || d <= 0 {
+			return errors.New("crawlers throttle-interval is not a valid duration: " + c.Crawlers.ThrottleInterval)
+		}
+	}
+	for _, ua := range c.Crawlers.UserAgents {
+		if strings.TrimSpace(ua) == "" {
+			return errors.New("crawlers user-agents must not contain empty entries")
+		}
+	}
+	return nil
+}
+
+// robotsTxt returns the robots.txt for a config, with paths under the base path
+func robotsTxt(c *Config, base string) []byte {
+	disallow := c.Crawlers.Disallow
+	if disallow == nil {
+		disallow = defaultRobotsDisallow
+	}
+	var b bytes.Buffer
+	b.WriteString("User-agent: *\n")
+	if len(disallow) == 0 {
+		// An empty Disallow allows everything
+		b.WriteString("Disallow:\n")
+	}
+	for _, p := range disallow {
+		b.WriteString("Disallow: " + base + strings.TrimPrefix(p, "/") + "\n")
+	}
+	return b.Bytes()
+}
+
+// serveRobots handles GET /robots.txt at the site root
+func serveRobots(w http.ResponseWriter, r *http.Request) {
+	b := robotsTxt(server.Config(), server.URL.Path)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// Route classes sent X-Robots-Tag
+const (
+	routeOther = iota
+	routeFeed
+	routeDownload
+	routeAdmin
+)
+
+// robotsRouteClass returns which class of route a path under the base path is
+func robotsRouteClass(p string) int {
+	if !strings.HasPrefix(p, server.URL.Path) {
+		return routeOther
+	}
+	p = p[len(server.URL.Path):]
+	switch {
+	case strings.HasPrefix(p, `nupkg`), strings.HasPrefix(p, `dl/`):
+		return routeDownload
+	case strings.HasPrefix(p, `admin/`), strings.HasPrefix(p, `api/admin/`), p == `statusz`:
+		return routeAdmin
+	case p == ``, p == `$metadata`,
+		strings.HasPrefix(p, `Packages`), strings.HasPrefix(p, `api/v2/Packages`),
+		strings.HasPrefix(p, `FindPackagesById`), strings.HasPrefix(p, `api/v2/FindPackagesById`),
+		strings.HasPrefix(p, `Search`), strings.HasPrefix(p, `api/v2/Search`),
+		strings.HasPrefix(p, `feed/`):
+		return routeFeed
+	}
+	return routeOther
+}
+
+// setRobotsTag marks feed, download and admin responses noindex, if configured
+func setRobotsTag(w http.ResponseWriter, r *http.Request) {
+	if server.Config().Crawlers.NoIndex && robotsRouteClass(r.URL.Path) != routeOther {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+}
+
+// isCrawler reports whether a request comes from a configured crawler. NuGet
+// clients never count as one, whatever the list says.
+func isCrawler(c *Config, r *http.Request) bool {
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" || strings.Contains(ua, "nuget") {
+		return false
+	}
+	for _, s := range c.Crawlers.UserAgents {
+		if strings.Contains(ua, strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// crawlerLimits is when each crawler may next download, by user agent and address
+var crawlerLimits struct {
+	lock sync.Mutex
+	next map[string]time.Time
+}
+
+// allowCrawler applies the crawlers action to a download, answering 403 or 429
+// and returning false if the crawler is refused
+func allowCrawler(w http.ResponseWriter, r *http.Request) bool {
+	c := server.Config()
+	if c.Crawlers.Action == "" || !isCrawler(c, r) {
+		return true
+	}
+	if c.Crawlers.Action == crawlerDeny {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	interval := defaultCrawlerInterval
+	if c.Crawlers.ThrottleInterval != "" {
+		interval, _ = time.ParseDuration(c.Crawlers.ThrottleInterval)
+	}
+	host := r.RemoteAddr
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	key := host + " " + r.UserAgent()
+	now := time.Now()
+
+	crawlerLimits.lock.Lock()
+	defer crawlerLimits.lock.Unlock()
+	if crawlerLimits.next == nil {
+		crawlerLimits.next = make(map[string]time.Time)
+	}
+	if next, ok := crawlerLimits.next[key]; ok && now.Before(next) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(next.Sub(now).Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return false
+	}
+	// Forget crawlers that have waited long enough
+	for k, next := range crawlerLimits.next {
+		if now.After(next) {
+			delete(crawlerLimits.next, k)
+		}
+	}
+	crawlerLimits.next[key] = now.Add(interval)
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRobotsTxt(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		disallow []string
+		want     string
+	}{
+		{"default", nil, "User-agent: *\nDisallow: /feed/nupkg\nDisallow: /feed/admin\n"},
+		{"configured", []string{"/nupkg", "v3-flatcontainer/", "ui"}, "User-agent: *\nDisallow: /feed/nupkg\nDisallow: /feed/v3-flatcontainer/\nDisallow: /feed/ui\n"},
+		{"allow all", []string{}, "User-agent: *\nDisallow:\n"},
+	} {
+		ts := newTestServer(t, func(c *Config) { c.Crawlers.Disallow = tc.disallow })
+		// At the site root, not under the feed, and without a key
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			r, err := http.NewRequest(method, ts.URL+"/robots.txt", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := ts.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, body := readResponse(t, res)
+			wantStatus(t, tc.name+" "+method, status, body, http.StatusOK)
+			if ct := res.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+				t.Errorf("%s %s: Content-Type %q", tc.name, method, ct)
+			}
+			if method == http.MethodGet && body != tc.want {
+				t.Errorf("%s: got\n%s\nwant\n%s", tc.name, body, tc.want)
+			}
+		}
+	}
+}
+
+// With noindex, feed, download and admin responses carry X-Robots-Tag, whatever
+// their status, and nothing else does
+func TestRobotsTag(t *testing.T) {
+	for _, noindex := range []bool{false, true} {
+		ts := newTestServer(t, func(c *Config) { c.Crawlers.NoIndex = noindex })
+		ts.mustPush(t, testPackage(t, "Robots.Pkg", "1.0.0", "", nil))
+
+		for _, tc := range []struct {
+			p      string
+			key    string
+			status int
+			class  int
+		}{
+			{"", testReadKey, http.StatusOK, routeFeed},
+			{"$metadata", testReadKey, http.StatusOK, routeFeed},
+			{"Packages()", testReadKey, http.StatusOK, routeFeed},
+			{"api/v2/Packages()", "", http.StatusForbidden, routeFeed},
+			{"FindPackagesById()?id='Robots.Pkg'", testReadKey, http.StatusOK, routeFeed},
+			{"Search()?searchTerm='robots'", testReadKey, http.StatusOK, routeFeed},
+			{"feed/Robots.Pkg.atom", testReadKey, http.StatusOK, routeFeed},
+			{"nupkg/Robots.Pkg/1.0.0", testReadKey, http.StatusOK, routeDownload},
+			{"nupkg/Robots.Pkg/9.0.0", testReadKey, http.StatusNotFound, routeDownload},
+			{"dl/not-a-token", "", http.StatusNotFound, routeDownload},
+			{"admin/operations", testWriteKey, http.StatusOK, routeAdmin},
+			{"admin/operations", testReadKey, http.StatusForbidden, routeAdmin},
+			{"statusz", testWriteKey, http.StatusOK, routeAdmin},
+			{"v3/index.json", testReadKey, http.StatusOK, routeOther},
+			{"v3-flatcontainer/robots.pkg/index.json", testReadKey, http.StatusOK, routeOther},
+			{"api/openapi.json", testReadKey, http.StatusOK, routeOther},
+		} {
+			if class := robotsRouteClass(server.URL.Path + strings.SplitN(tc.p, "?", 2)[0]); class != tc.class {
+				t.Errorf("%s: class %d, want %d", tc.p, class, tc.class)
+			}
+			res := ts.do(t, http.MethodGet, tc.p, tc.key, nil, nil)
+			tag := res.Header.Get("X-Robots-Tag")
+			status, body := readResponse(t, res)
+			wantStatus(t, tc.p, status, body, tc.status)
+			want := ""
+			if noindex && tc.class != routeOther {
+				want = "noindex, nofollow"
+			}
+			if tag != want {
+				t.Errorf("%s with noindex %v: X-Robots-Tag %q, want %q", tc.p, noindex, tag, want)
+			}
+		}
+	}
+}
+
+// Configured crawlers are denied or throttled on download routes only, and a
+// NuGet client never counts as one
+func TestCrawlerAction(t *testing.T) {
+	const bot = "Mozilla/5.0 (compatible; ExampleBot/2.1)"
+	for _, tc := range []struct {
+		action string
+		want   []int // Statuses of the bot's downloads in a row
+	}{
+		{"", []int{http.StatusOK, http.StatusOK}},
+		{crawlerDeny, []int{http.StatusForbidden, http.StatusForbidden}},
+		{crawlerThrottle, []int{http.StatusOK, http.StatusTooManyRequests}},
+	} {
+		ts := newTestServer(t, func(c *Config) {
+			c.Crawlers.UserAgents = []string{"examplebot"}
+			c.Crawlers.Action = tc.action
+			c.Crawlers.ThrottleInterval = "1h"
+		})
+		ts.mustPush(t, testPackage(t, "Crawl.Pkg", "1.0.0", "", nil))
+		// Crawlers are remembered by the process, not the server
+		crawlerLimits.lock.Lock()
+		crawlerLimits.next = nil
+		crawlerLimits.lock.Unlock()
+		get := func(p string, ua string) *http.Response {
+			return ts.do(t, http.MethodGet, p, testReadKey, nil, http.Header{"User-Agent": {ua}})
+		}
+
+		for i, want := range tc.want {
+			res := get("nupkg/Crawl.Pkg/1.0.0", bot)
+			retry := res.Header.Get("Retry-After")
+			status, body := readResponse(t, res)
+			wantStatus(t, tc.action+" download", status, body, want)
+			if (want == http.StatusTooManyRequests) != (retry != "") || (retry != "" && retry != "3600") {
+				t.Errorf("%s download %d: Retry-After %q", tc.action, i, retry)
+			}
+		}
+		for _, p := range []string{"Packages()", "v3-flatcontainer/crawl.pkg/index.json"} {
+			status, body := readResponse(t, get(p, bot))
+			wantStatus(t, tc.action+" "+p, status, body, http.StatusOK)
+		}
+		for _, ua := range []string{"NuGet Command Line/6.0 (ExampleBot)", "Go-http-client/1.1", ""} {
+			status, body := readResponse(t, get("nupkg/Crawl.Pkg/1.0.0", ua))
+			wantStatus(t, tc.action+" as "+ua, status, body, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Highest OData protocol version the feed is written to
+const dataServiceVersion = 2.0
+
+// setDataServiceVersion sets the OData version headers older clients need before
+// they'll parse a feed. NuGet 2.8 sends MaxDataServiceVersion and refuses responses
+// above it, so the version is 1.0 if that's below what the feed supports. Clients
+// that name their limit with OData-MaxVersion get it in OData-Version too.
+func setDataServiceVersion(w http.ResponseWriter, r *http.Request) {
+	v := dataServiceVersion
+	if max, ok := parseDataServiceVersion(r.Header.Get("MaxDataServiceVersion")); ok && max < v {
+		v = 1.0
+	}
+	if max, ok := parseDataServiceVersion(r.Header.Get("OData-MaxVersion")); ok && max < v {
+		v = 1.0
+	}
+	// Set directly to keep the casing WCF Data Services used
+	s := strconv.FormatFloat(v, 'f', 1, 64)
+	w.Header()["DataServiceVersion"] = []string{s + ";"}
+	if r.Header.Get("OData-MaxVersion") != "" {
+		w.Header()["OData-Version"] = []string{s}
+	}
+}
+
+// parseDataServiceVersion reads a version header such as "2.0;NetFx" or "3.0"
+func parseDataServiceVersion(h string) (float64, bool) {
+	if i := strings.Index(h, ";"); i >= 0 {
+		h = h[:i]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(h), 64)
+	return v, err == nil
+}
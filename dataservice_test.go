@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// The headers each client era sends with its OData requests, and the versions the
+// feed should answer them with
+func TestDataServiceVersion(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "OData.Pkg", "1.0.0", "", nil))
+
+	for _, tc := range []struct {
+		client       string
+		header       http.Header
+		dsv          string
+		odataVersion string
+	}{
+		{client: "NuGet 2.8", header: http.Header{"DataServiceVersion": {"1.0;NetFx"}, "MaxDataServiceVersion": {"2.0;NetFx"}}, dsv: "2.0;"},
+		{client: "NuGet 3.5", header: http.Header{"DataServiceVersion": {"1.0;NetFx"}, "MaxDataServiceVersion": {"2.0;NetFx"}, "Accept": {"application/atom+xml"}}, dsv: "2.0;"},
+		{client: "NuGet 5.x", header: http.Header{"Accept": {"application/atom+xml, application/xml"}}, dsv: "2.0;"},
+		{client: "OData 1.0 only", header: http.Header{"MaxDataServiceVersion": {"1.0;NetFx"}}, dsv: "1.0;"},
+		{client: "OData v4", header: http.Header{"OData-MaxVersion": {"4.0"}}, dsv: "2.0;", odataVersion: "2.0"},
+		{client: "OData v4 limited to 1.0", header: http.Header{"OData-MaxVersion": {"1.0"}}, dsv: "1.0;", odataVersion: "1.0"},
+	} {
+		for _, p := range []string{
+			"",
+			"$metadata",
+			"Packages()",
+			"Packages()?$format=json",
+			"Packages(Id='OData.Pkg',Version='1.0.0')",
+			"FindPackagesById()?id='OData.Pkg'",
+		} {
+			res := ts.do(t, http.MethodGet, p, testReadKey, nil, tc.header)
+			status, body := readResponse(t, res)
+			wantStatus(t, tc.client+" "+p, status, body, http.StatusOK)
+			if got := res.Header.Get("DataServiceVersion"); got != tc.dsv {
+				t.Errorf("%s %s: DataServiceVersion %q, want %q", tc.client, p, got, tc.dsv)
+			}
+			if got := res.Header.Get("OData-Version"); got != tc.odataVersion {
+				t.Errorf("%s %s: OData-Version %q, want %q", tc.client, p, got, tc.odataVersion)
+			}
+		}
+	}
+}
+
+func TestParseDataServiceVersion(t *testing.T) {
+	for h, want := range map[string]float64{"2.0;NetFx": 2, "1.0;": 1, " 3.0 ": 3, "4.0": 4} {
+		if got, ok := parseDataServiceVersion(h); !ok || got != want {
+			t.Errorf("%q: got %v, %v, want %v", h, got, ok, want)
+		}
+	}
+	for _, h := range []string{"", "NetFx", "two"} {
+		if _, ok := parseDataServiceVersion(h); ok {
+			t.Errorf("%q parsed", h)
+		}
+	}
+}
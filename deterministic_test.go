@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Run with -update to rewrite the golden files after a deliberate change to how
+// feeds are serialized
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// Packages of the golden feed. Each is only a nuspec, so the nupkg and its hash
+// are the same every time.
+var goldenPackages = []struct {
+	id, ver  string
+	metadata string
+	time     time.Time
+}{
+	{"Golden.Core", "1.0.0", `<tags>golden core</tags>`, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+	{"Golden.Core", "2.0.0-beta.1", `<title>Golden Core</title>
+    <releaseNotes>First beta</releaseNotes>`, time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)},
+	{"Golden.Tools", "0.3.0", `<dependencies>
+      <group targetFramework="netstandard2.0">
+        <dependency id="Golden.Core" version="[1.0.0,2.0.0)" />
+      </group>
+    </dependencies>`, time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)},
+}
+
+// newGoldenServer serves the golden packages as copied into a store by hand, at a
+// fixed URL and with fixed publish times
+func newGoldenServer(t *testing.T) *testServer {
+	t.Helper()
+	ts := newTestServer(t, func(c *Config) {
+		c.HostURL = "http://nuget.example/feed/"
+		c.SkipTokenKey = "golden"
+		for _, p := range goldenPackages {
+			copyPackage(t, c, p.id, p.ver, testPackage(t, p.id, p.ver, p.metadata, nil))
+			if err := os.Chtimes(copiedPackagePath(c, p.id, p.ver), p.time, p.time); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	return ts
+}
+
+// checkGolden compares a response byte for byte with its golden file
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	fp := filepath.Join("testdata", "golden", name)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fp, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from its golden file, run the tests with -update if the change is intended\ngot:\n%s", name, got)
+	}
+}
+
+func TestGoldenFeed(t *testing.T) {
+	ts := newGoldenServer(t)
+
+	// Counted downloads are zeroed for comparison
+	status, body := ts.get(t, "nupkg/Golden.Core/1.0.0")
+	wantStatus(t, "download", status, body, http.StatusOK)
+	server.downloads.Close()
+	status, body = ts.get(t, "Packages(Id='Golden.Core',Version='1.0.0')")
+	wantStatus(t, "counted", status, body, http.StatusOK)
+	if got := between(body, `<d:VersionDownloadCount m:type="Edm.Int32">`, "<"); got != "1" {
+		t.Fatalf("VersionDownloadCount %q, want the download counted", got)
+	}
+
+	for name, p := range map[string]string{
+		"packages.xml":         "Packages()?deterministic=1",
+		"packages.json":        "Packages()?$format=json&deterministic=1",
+		"findpackagesbyid.xml": "FindPackagesById()?id='Golden.Core'&deterministic=1",
+		"entry.xml":            "Packages(Id='Golden.Tools',Version='0.3.0')?deterministic=1",
+		"search.xml":           "Search()?searchTerm=''&includePrerelease=true&deterministic=1",
+	} {
+		status, body := ts.get(t, p)
+		wantStatus(t, name, status, body, http.StatusOK)
+		checkGolden(t, name, []byte(body))
+	}
+}
+
+// The same packages on another server, or the same one later, give the same bytes
+func TestFeedRepeatable(t *testing.T) {
+	var first []string
+	paths := []string{
+		"Packages()",
+		"Packages()?$format=json",
+		"Packages()?$orderby=Id&$top=1",
+		"FindPackagesById()?id='Golden.Core'",
+		"Search()?searchTerm='golden'",
+	}
+	for i := 0; i < 2; i++ {
+		ts := newGoldenServer(t)
+		for j, p := range paths {
+			status, body := ts.get(t, p)
+			wantStatus(t, p, status, body, http.StatusOK)
+			if i == 0 {
+				first = append(first, body)
+			} else if body != first[j] {
+				t.Errorf("%s differs between servers:\n%s\n%s", p, first[j], body)
+			}
+			// And within one
+			if _, again := ts.get(t, p); again != body {
+				t.Errorf("%s differs between requests", p)
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Download events queued before new ones are dropped, unless configured
+const defaultDownloadQueueSize = 1024
+
+// How long counts are gathered before being written to the store
+const downloadFlushDelay = 2 * time.Second
+
+// How long after a client is served a version further responses for it are taken
+// as the same download resumed or retried, unless configured
+const defaultDownloadResumeWindow = 30 * time.Second
+
+// downloadEvent is a package download waiting to be counted
+type downloadEvent struct {
+	ID        string
+	Version   string
+	Client    string // API key and address, for de-duplication
+	UserAgent string
+	Method    string // HEAD requests never count
+	Status    int    // Only 200 and 206 responses count
+	Bytes     int64  // Nothing counts until its first byte is served
+	Continued bool   // A range starting after the first byte, which never counts
+	Time      time.Time
+}
+
+// downloadCounter is the store aggregated download counts are added to, keyed {id}/{version}
+type downloadCounter interface {
+	AddDownloads(ctx context.Context, counts map[string]int) error
+}
+
+// downloadPipeline counts downloads off the request path. Handlers send events into
+// a buffered channel and a single goroutine de-duplicates them, applies them to the
+// statistics and writes the counts to the store a little later in one go. Downloads
+// never wait on counting: when the queue is full the event is dropped and counted.
+//
+// A download counts when the first byte of a 200 or 206 response is served. Ranges
+// that start after the first byte continue a download and never count. Retries by
+// the same client within the resume window don't count again either, each one
+// extending the window. The dedup window is separate:
+// it is longer and counts repeat downloads by a client once.
+type downloadPipeline struct {
+	dropped      uint64 // accessed atomically, kept first for alignment
+	events       chan downloadEvent
+	done         chan struct{}
+	closeLock    sync.RWMutex // held for writing while closing, so no send races it
+	closed       bool
+	store        downloadCounter
+	stats        *downloadStats
+	dedupWindow  time.Duration
+	resumeWindow time.Duration
+	flushDelay   time.Duration
+	lastSeen     map[string]time.Time
+	lastServed   map[string]time.Time
+	pending      map[string]int
+}
+
+// newDownloadPipeline starts the aggregator. A dedup or resume window of 0 counts every download.
+func newDownloadPipeline(store downloadCounter, stats *downloadStats, queueSize int, dedupWindow time.Duration, resumeWindow time.Duration, flushDelay time.Duration) *downloadPipeline {
+	if queueSize <= 0 {
+		queueSize = defaultDownloadQueueSize
+	}
+	p := &downloadPipeline{
+		events:       make(chan downloadEvent, queueSize),
+		done:         make(chan struct{}),
+		store:        store,
+		stats:        stats,
+		dedupWindow:  dedupWindow,
+		resumeWindow: resumeWindow,
+		flushDelay:   flushDelay,
+		lastSeen:     make(map[string]time.Time),
+		lastServed:   make(map[string]time.Time),
+		pending:      make(map[string]int),
+	}
+	go p.run()
+	return p
+}
+
+// Send queues a download to be counted without blocking. Downloads still being
+// served when the pipeline is closed aren't counted.
+func (p *downloadPipeline) Send(e downloadEvent) {
+	if p == nil {
+		return
+	}
+	p.closeLock.RLock()
+	defer p.closeLock.RUnlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.events <- e:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+// Dropped returns how many downloads weren't counted because the queue was full
+func (p *downloadPipeline) Dropped() uint64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// Close counts everything queued and writes it out. Events sent after are dropped.
+func (p *downloadPipeline) Close() {
+	if p == nil {
+		return
+	}
+	p.closeLock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.events)
+	}
+	p.closeLock.Unlock()
+	<-p.done
+}
+
+func (p *downloadPipeline) run() {
+	defer close(p.done)
+
+	var flush <-chan time.Time
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+	var reported uint64
+
+	for {
+		select {
+		case e, ok := <-p.events:
+			if !ok {
+				p.flush()
+				return
+			}
+			if p.apply(e) && flush == nil {
+				flush = time.After(p.flushDelay)
+			}
+		case <-flush:
+			flush = nil
+			p.flush()
+			if d := p.Dropped(); d != reported {
+				log.Printf("Warning: %d downloads not counted, the download queue was full", d-reported)
+				reported = d
+			}
+		case now := <-prune.C:
+			for k, t := range p.lastSeen {
+				if now.Sub(t) >= p.dedupWindow {
+					delete(p.lastSeen, k)
+				}
+			}
+			for k, t := range p.lastServed {
+				if now.Sub(t) >= p.resumeWindow {
+					delete(p.lastServed, k)
+				}
+			}
+		}
+	}
+}
+
+// apply counts an event unless it served nothing, is a range past the first byte,
+// continues a download the client was served within the resume window, or repeats
+// one within the dedup window, returning whether it was counted
+func (p *downloadPipeline) apply(e downloadEvent) bool {
+	if e.Method == http.MethodHead || e.Bytes == 0 ||
+		(e.Status != http.StatusOK && e.Status != http.StatusPartialContent) {
+		return false
+	}
+
+	key := versionKey(e.ID, e.Version)
+	seen := key + "/" + e.Client
+	if p.resumeWindow > 0 {
+		t, ok := p.lastServed[seen]
+		p.lastServed[seen] = e.Time
+		if ok && e.Time.Sub(t) < p.resumeWindow {
+			return false
+		}
+	}
+	if e.Continued {
+		return false
+	}
+	if p.dedupWindow > 0 {
+		if t, ok := p.lastSeen[seen]; ok && e.Time.Sub(t) < p.dedupWindow {
+			return false
+		}
+		p.lastSeen[seen] = e.Time
+	}
+
+	p.pending[e.ID+"/"+e.Version]++
+	p.stats.Record(e.ID, e.Version, e.UserAgent, e.Time)
+	return true
+}
+
+// flush writes the pending counts and statistics
+func (p *downloadPipeline) flush() {
+	if len(p.pending) > 0 {
+		if err := p.store.AddDownloads(context.Background(), p.pending); err != nil {
+			log.Println("Error: Cannot save download counts", err)
+		}
+		p.pending = make(map[string]int)
+	}
+	if err := p.stats.Save(); err != nil {
+		log.Println("Error: Cannot save download stats", err)
+	}
+}
+
+// rangeContinues reports whether a request's Range starts after the first byte,
+// picking up a download already under way
+func rangeContinues(r *http.Request) bool {
+	h := r.Header.Get("Range")
+	if !strings.HasPrefix(h, "bytes=") {
+		return false
+	}
+	first := strings.TrimSpace(strings.SplitN(h[len("bytes="):], ",", 2)[0])
+	return !strings.HasPrefix(first, "0-")
+}
+
+// servedWriter notes the status of a download and when its first byte was served
+type servedWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	first  time.Time
+}
+
+func (w *servedWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *servedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if n > 0 && w.bytes == 0 {
+		w.first = time.Now()
+	}
+	w.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore gathers the counts a pipeline writes. If entered is set, each
+// write signals it and waits for release.
+type countingStore struct {
+	lock    sync.Mutex
+	counts  map[string]int
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *countingStore) AddDownloads(ctx context.Context, counts map[string]int) error {
+	if s.entered != nil {
+		s.entered <- struct{}{}
+		<-s.release
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.counts == nil {
+		s.counts = make(map[string]int)
+	}
+	for k, n := range counts {
+		s.counts[k] += n
+	}
+	return nil
+}
+
+func newTestPipeline(t *testing.T, store downloadCounter, queueSize int, dedup time.Duration, resume time.Duration) *downloadPipeline {
+	t.Helper()
+	stats, err := loadDownloadStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newDownloadPipeline(store, stats, queueSize, dedup, resume, time.Hour)
+}
+
+func TestDownloadPipelineCounts(t *testing.T) {
+	now := time.Now()
+	// served is a whole download of a version of A by a client, at a time after now
+	served := func(ver string, client string, at time.Duration) downloadEvent {
+		return downloadEvent{ID: "A", Version: ver, Client: client, Method: http.MethodGet, Status: http.StatusOK, Bytes: 10, Time: now.Add(at)}
+	}
+	with := func(e downloadEvent, change func(e *downloadEvent)) downloadEvent {
+		change(&e)
+		return e
+	}
+	head := func(e *downloadEvent) { e.Method = http.MethodHead }
+	notFound := func(e *downloadEvent) { e.Status = http.StatusNotFound }
+	empty := func(e *downloadEvent) { e.Bytes = 0 }
+	firstRange := func(e *downloadEvent) { e.Status = http.StatusPartialContent }
+	laterRange := func(e *downloadEvent) { e.Status, e.Continued = http.StatusPartialContent, true }
+
+	for _, tc := range []struct {
+		name   string
+		dedup  time.Duration
+		resume time.Duration
+		events []downloadEvent
+		want   map[string]int
+	}{
+		{name: "one download", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{served("1.0.0", "k1", 0)},
+			want:   map[string]int{"A/1.0.0": 1}},
+		{name: "retried within the resume window", resume: time.Minute,
+			events: []downloadEvent{served("1.0.0", "k1", 0), served("1.0.0", "k1", time.Second)},
+			want:   map[string]int{"A/1.0.0": 1}},
+		{name: "each retry extends the resume window", resume: 30 * time.Second,
+			events: []downloadEvent{served("1.0.0", "k1", 0), served("1.0.0", "k1", 20*time.Second), served("1.0.0", "k1", 40*time.Second), served("1.0.0", "k1", 60*time.Second)},
+			want:   map[string]int{"A/1.0.0": 1}},
+		{name: "again after the resume window", resume: 30 * time.Second,
+			events: []downloadEvent{served("1.0.0", "k1", 0), served("1.0.0", "k1", 31*time.Second)},
+			want:   map[string]int{"A/1.0.0": 2}},
+		{name: "again within the dedup window", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{served("1.0.0", "k1", 0), served("1.0.0", "k1", 10*time.Minute)},
+			want:   map[string]int{"A/1.0.0": 1}},
+		{name: "again after the dedup window", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{served("1.0.0", "k1", 0), served("1.0.0", "k1", 2*time.Hour)},
+			want:   map[string]int{"A/1.0.0": 2}},
+		{name: "no windows", events: []downloadEvent{served("1.0.0", "k1", 0), served("1.0.0", "k1", 0), served("1.0.0", "k1", time.Second)},
+			want: map[string]int{"A/1.0.0": 3}},
+		{name: "other clients", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{served("1.0.0", "k1", 0), served("1.0.0", "k2", 0), served("1.0.0", "", 0)},
+			want:   map[string]int{"A/1.0.0": 3}},
+		{name: "other versions", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{served("1.0.0", "k1", 0), served("2.0.0", "k1", 0)},
+			want:   map[string]int{"A/1.0.0": 1, "A/2.0.0": 1}},
+		{name: "head", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{with(served("1.0.0", "k1", 0), head)}},
+		{name: "not found", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{with(served("1.0.0", "k1", 0), notFound)}},
+		{name: "nothing served", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{with(served("1.0.0", "k1", 0), empty)}},
+		{name: "head then get", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{with(served("1.0.0", "k1", 0), head), served("1.0.0", "k1", time.Second)},
+			want:   map[string]int{"A/1.0.0": 1}},
+		{name: "failed then retried", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{with(served("1.0.0", "k1", 0), notFound), with(served("1.0.0", "k1", time.Second), empty), served("1.0.0", "k1", 2*time.Second)},
+			want:   map[string]int{"A/1.0.0": 1}},
+		{name: "range from the first byte", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{with(served("1.0.0", "k1", 0), firstRange)},
+			want:   map[string]int{"A/1.0.0": 1}},
+		{name: "ranges of one download", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{with(served("1.0.0", "k1", 0), firstRange), with(served("1.0.0", "k1", time.Second), laterRange), with(served("1.0.0", "k1", 2*time.Second), laterRange)},
+			want:   map[string]int{"A/1.0.0": 1}},
+		{name: "range past the first byte", dedup: time.Hour, resume: time.Minute,
+			events: []downloadEvent{with(served("1.0.0", "k1", 0), laterRange)}},
+		{name: "range past the first byte after the resume window", resume: time.Minute,
+			events: []downloadEvent{served("1.0.0", "k1", 0), with(served("1.0.0", "k1", 2*time.Minute), laterRange)},
+			want:   map[string]int{"A/1.0.0": 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &countingStore{}
+			p := newTestPipeline(t, store, 0, tc.dedup, tc.resume)
+			for _, e := range tc.events {
+				p.Send(e)
+			}
+
+			// Closing counts everything queued
+			p.Close()
+			if len(store.counts)+len(tc.want) > 0 && !reflect.DeepEqual(store.counts, tc.want) {
+				t.Errorf("counts = %v, want %v", store.counts, tc.want)
+			}
+		})
+	}
+}
+
+func TestDownloadPipelineDropsWhenFull(t *testing.T) {
+	store := &countingStore{entered: make(chan struct{}), release: make(chan struct{})}
+	stats, err := loadDownloadStats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newDownloadPipeline(store, stats, 1, 0, 0, time.Millisecond)
+	e := downloadEvent{ID: "A", Version: "1.0.0", Method: http.MethodGet, Status: http.StatusOK, Bytes: 10, Time: time.Now()}
+
+	// The aggregator waits on the store while the queue fills
+	p.Send(e)
+	<-store.entered
+	for i := 0; i < 5; i++ {
+		p.Send(e)
+	}
+	if got := p.Dropped(); got != 4 {
+		t.Errorf("dropped %d, want 4", got)
+	}
+
+	go func() {
+		for range store.entered {
+		}
+	}()
+	close(store.release)
+	p.Close()
+	close(store.entered)
+	if want := map[string]int{"A/1.0.0": 2}; !reflect.DeepEqual(store.counts, want) {
+		t.Errorf("counts = %v, want %v", store.counts, want)
+	}
+}
+
+func TestDownloadPipelineSendAfterClose(t *testing.T) {
+	p := newTestPipeline(t, &countingStore{}, 4, 0, 0)
+	e := downloadEvent{ID: "A", Version: "1.0.0", Method: http.MethodGet, Status: http.StatusOK, Bytes: 10, Time: time.Now()}
+
+	// Downloads finishing while the server shuts down
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.Send(e)
+			}
+		}()
+	}
+	p.Close()
+	wg.Wait()
+
+	p.Send(e)
+	p.Close()
+}
+
+// Downloads answer Range and If-Modified-Since requests, and a full GET counts once
+// however the client resumes or retries it
+func TestServeVersionFile(t *testing.T) {
+	ts := newTestServer(t, nil)
+	pkg := testPackage(t, "Serve.Pkg", "1.0.0", "", nil)
+	ts.mustPush(t, pkg)
+	const download = "nupkg/Serve.Pkg/1.0.0"
+
+	res := ts.do(t, http.MethodGet, download, testReadKey, nil, nil)
+	lastModified := res.Header.Get("Last-Modified")
+	status, body := readResponse(t, res)
+	wantStatus(t, "download", status, body, http.StatusOK)
+	if body != string(pkg) {
+		t.Fatal("download isn't the package pushed")
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		t.Fatalf("Last-Modified %q: %v", lastModified, err)
+	}
+
+	size := len(pkg)
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		status int
+		want   string // Body of a 200 or 206
+	}{
+		{"first bytes", http.Header{"Range": {"bytes=0-9"}}, http.StatusPartialContent, string(pkg[:10])},
+		{"resumed", http.Header{"Range": {"bytes=10-"}}, http.StatusPartialContent, string(pkg[10:])},
+		{"suffix", http.Header{"Range": {"bytes=-4"}}, http.StatusPartialContent, string(pkg[size-4:])},
+		{"past the end", http.Header{"Range": {fmt.Sprintf("bytes=%d-", size)}}, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"not modified", http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified, ""},
+		{"modified", http.Header{"If-Modified-Since": {modified.Add(-time.Hour).Format(http.TimeFormat)}}, http.StatusOK, string(pkg)},
+		{"head", nil, http.StatusOK, ""},
+	} {
+		method := http.MethodGet
+		if tc.name == "head" {
+			method = http.MethodHead
+		}
+		res := ts.do(t, method, download, testReadKey, nil, tc.header)
+		contentRange := res.Header.Get("Content-Range")
+		status, body := readResponse(t, res)
+		wantStatus(t, tc.name, status, body, tc.status)
+		if (status == http.StatusOK || status == http.StatusPartialContent) && body != tc.want {
+			t.Errorf("%s: got %d bytes, want %d", tc.name, len(body), len(tc.want))
+		}
+		if status == http.StatusRequestedRangeNotSatisfiable && contentRange != fmt.Sprintf("bytes */%d", size) {
+			t.Errorf("%s: Content-Range %q, want the size", tc.name, contentRange)
+		}
+	}
+
+	// Another client's full GET is another download
+	status, body = readResponse(t, ts.do(t, http.MethodGet, download, testWriteKey, nil, nil))
+	wantStatus(t, "another download", status, body, http.StatusOK)
+
+	server.downloads.Close()
+	npe, err := server.fs.GetPackageEntry(context.Background(), "Serve.Pkg", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := npe.Properties.VersionDownloadCount.Value; n != 2 {
+		t.Errorf("download count = %d, want 2", n)
+	}
+}
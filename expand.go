@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Relation of the Screenshots navigation link on a package entry
+const screenshotsRel = "http://schemas.microsoft.com/ado/2007/08/dataservices/related/Screenshots"
+
+// NugetInline is an expanded navigation property inside its link
+type NugetInline struct {
+	Feed *NugetInlineFeed `xml:"feed"`
+}
+
+// NugetInlineFeed is the collection of an expanded navigation property
+type NugetInlineFeed struct {
+	ID    string `xml:"id"`
+	Title struct {
+		Text string `xml:",chardata"`
+		Type string `xml:"type,attr"`
+	} `xml:"title"`
+	Updated EdmDateTime `xml:"updated"`
+}
+
+// packageProperties reads the V2FeedPackage properties and navigation properties
+// declared in $metadata, so what can be expanded always agrees with it
+func packageProperties() (map[string]string, map[string]string) {
+	props := make(map[string]string)
+	navs := make(map[string]string)
+	d := xml.NewDecoder(bytes.NewReader(server.MetaDataResponse))
+	inPackage := false
+	for {
+		t, err := d.Token()
+		if err == io.EOF || err != nil {
+			return props, navs
+		}
+		switch se := t.(type) {
+		case xml.StartElement:
+			name := ""
+			for _, a := range se.Attr {
+				if a.Name.Local == "Name" {
+					name = a.Value
+				}
+			}
+			switch se.Name.Local {
+			case "EntityType":
+				inPackage = name == "V2FeedPackage"
+			case "Property":
+				if inPackage {
+					props[strings.ToLower(name)] = name
+				}
+			case "NavigationProperty":
+				if inPackage {
+					navs[strings.ToLower(name)] = name
+				}
+			}
+		case xml.EndElement:
+			if se.Name.Local == "EntityType" {
+				inPackage = false
+			}
+		}
+	}
+}
+
+// parseExpand reads $expand and returns the navigation properties to expand.
+// Properties $metadata declares as plain values are always inline, so asking to
+// expand them, as some generated clients do with Dependencies, changes nothing.
+// Anything $metadata doesn't declare is an error.
+func parseExpand(r *http.Request) ([]string, error) {
+	v := strings.TrimSpace(r.URL.Query().Get("$expand"))
+	if v == "" {
+		return nil, nil
+	}
+	props, navs := packageProperties()
+	var expand []string
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		x := strings.Split(p, "/")
+		if nav, ok := navs[strings.ToLower(x[0])]; ok && len(x) == 1 {
+			expand = append(expand, nav)
+			continue
+		}
+		if _, ok := props[strings.ToLower(x[0])]; ok && len(x) == 1 {
+			continue
+		}
+		return nil, &odataError{Status: http.StatusBadRequest, Message: "$expand of '" + p + "' is not supported, V2FeedPackage has no such navigation property"}
+	}
+	return expand, nil
+}
+
+// expandEntries inlines the navigation properties asked for. Screenshots are never
+// stored, so they expand to an empty collection. Entries are copied, not changed.
+func expandEntries(entries []*NugetPackageEntry, expand []string) []*NugetPackageEntry {
+	if !containsString(expand, "Screenshots") {
+		return entries
+	}
+	list := make([]*NugetPackageEntry, 0, len(entries))
+	for _, e := range entries {
+		c := *e
+		c.Link = make([]*NugetLink, 0, len(e.Link))
+		for _, l := range e.Link {
+			if l.Rel == screenshotsRel {
+				nl := *l
+				nl.Inline = newScreenshotsFeed(e)
+				l = &nl
+			}
+			c.Link = append(c.Link, l)
+		}
+		list = append(list, &c)
+	}
+	return list
+}
+
+// newScreenshotsFeed returns an entry's empty Screenshots collection
+func newScreenshotsFeed(e *NugetPackageEntry) *NugetInline {
+	f := &NugetInlineFeed{ID: e.ID + "/Screenshots", Updated: e.Updated}
+	f.Title.Text = "Screenshots"
+	f.Title.Type = "text"
+	return &NugetInline{Feed: f}
+}
+
+// screenshotsExpanded reports whether an entry's Screenshots were inlined
+func screenshotsExpanded(e *NugetPackageEntry) bool {
+	for _, l := range e.Link {
+		if l.Rel == screenshotsRel && l.Inline != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// serveScreenshots serves a package's Screenshots navigation property, which is
+// always empty
+func serveScreenshots(w http.ResponseWriter, r *http.Request, id string, ver string) {
+	npe, err := server.fs.GetPackageEntry(r.Context(), id, ver)
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var b []byte
+	switch requestedFeedFormat(r) {
+	case feedFormatJSONv4:
+		b, _ = marshalJSON(struct {
+			Context string        `json:"@odata.context"`
+			Value   []interface{} `json:"value"`
+		}{server.URL.String() + `$metadata#Screenshots`, []interface{}{}})
+		w.Header().Set("Content-Type", "application/json;odata.metadata=minimal")
+	case feedFormatJSONVerbose:
+		b, _ = marshalJSON(map[string]interface{}{"d": map[string]interface{}{"results": []interface{}{}}})
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		nf := NewNugetFeed("Screenshots", server.URL.String())
+		nf.ID = strings.Replace(npe.ID, "http://hosturl/", server.URL.String(), 1) + "/Screenshots"
+		nf.SetUpdated(npe.Updated.Value)
+		b = nf.ToBytes()
+		w.Header().Set("Content-Type", "application/atom+xml;type=feed;charset=utf-8")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// odataError is a query the feed refuses, answered in the OData error format
+type odataError struct {
+	Status  int
+	Message string
+}
+
+func (e *odataError) Error() string {
+	return e.Message
+}
+
+// writeODataError answers with an OData error in the format the client asked for
+func writeODataError(w http.ResponseWriter, r *http.Request, e *odataError) {
+	var b []byte
+	switch requestedFeedFormat(r) {
+	case feedFormatJSONv4:
+		b, _ = marshalJSON(map[string]interface{}{"error": map[string]interface{}{"code": "", "message": e.Message}})
+		w.Header().Set("Content-Type", "application/json;odata.metadata=minimal")
+	case feedFormatJSONVerbose:
+		b, _ = marshalJSON(map[string]interface{}{"error": map[string]interface{}{"code": "", "message": map[string]string{"lang": "en-US", "value": e.Message}}})
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		var buf bytes.Buffer
+		buf.WriteString(xmlProlog)
+		buf.WriteString(`<error xmlns="http://schemas.microsoft.com/ado/2007/08/dataservices/metadata"><code></code><message xml:lang="en-US">`)
+		xml.EscapeText(&buf, []byte(e.Message))
+		buf.WriteString(`</message></error>`)
+		b = buf.Bytes()
+		w.Header().Set("Content-Type", "application/xml;charset=utf-8")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(e.Status)
+	w.Write(b)
+}
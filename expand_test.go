@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	dataServicesNS = "http://schemas.microsoft.com/ado/2007/08/dataservices"
+	metadataNS     = "http://schemas.microsoft.com/ado/2007/08/dataservices/metadata"
+)
+
+func TestParseExpand(t *testing.T) {
+	newTestServer(t, nil)
+	for _, c := range []struct {
+		expand string
+		want   []string
+	}{
+		{"", nil},
+		{"Screenshots", []string{"Screenshots"}},
+		{" screenshots ", []string{"Screenshots"}},
+		{"Dependencies", nil},
+		{"Dependencies,Screenshots", []string{"Screenshots"}},
+		{"Tags, SCREENSHOTS", []string{"Screenshots"}},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/feed/Packages()?$expand="+strings.ReplaceAll(c.expand, " ", "%20"), nil)
+		got, err := parseExpand(r)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("$expand=%s: got %q %v, want %q", c.expand, got, err, c.want)
+		}
+	}
+	for _, expand := range []string{"Bogus", "Screenshots,Bogus", "Screenshots/Title", "Dependencies/Id", ","} {
+		r := httptest.NewRequest(http.MethodGet, "/feed/Packages()?$expand="+expand, nil)
+		if got, err := parseExpand(r); err == nil {
+			t.Errorf("$expand=%s: got %q, want an error", expand, got)
+		} else if oe, ok := err.(*odataError); !ok || oe.Status != http.StatusBadRequest {
+			t.Errorf("$expand=%s: %v", expand, err)
+		}
+	}
+}
+
+// strictModel is what a strict OData client knows of V2FeedPackage from $metadata
+type strictModel struct {
+	props map[string]bool
+	navs  map[string]bool
+}
+
+// readStrictModel reads the feed's $metadata as a generated client would
+func readStrictModel(t *testing.T, ts *testServer) strictModel {
+	t.Helper()
+	status, body := ts.get(t, "$metadata")
+	wantStatus(t, "$metadata", status, body, http.StatusOK)
+	var doc struct {
+		Schemas []struct {
+			EntityTypes []struct {
+				Name  string `xml:"Name,attr"`
+				Props []struct {
+					Name string `xml:"Name,attr"`
+				} `xml:"Property"`
+				Navs []struct {
+					Name string `xml:"Name,attr"`
+				} `xml:"NavigationProperty"`
+			} `xml:"EntityType"`
+		} `xml:"DataServices>Schema"`
+	}
+	if err := xml.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	m := strictModel{props: map[string]bool{}, navs: map[string]bool{}}
+	for _, s := range doc.Schemas {
+		for _, et := range s.EntityTypes {
+			if et.Name != "V2FeedPackage" {
+				continue
+			}
+			for _, p := range et.Props {
+				m.props[p.Name] = true
+			}
+			for _, n := range et.Navs {
+				m.navs[n.Name] = true
+			}
+		}
+	}
+	if len(m.props) == 0 || !m.navs["Screenshots"] {
+		t.Fatalf("$metadata declares %v and %v", m.props, m.navs)
+	}
+	return m
+}
+
+// strictLink is a link on an Atom entry
+type strictLink struct {
+	Rel    string `xml:"rel,attr"`
+	Href   string `xml:"href,attr"`
+	Inline *struct {
+		Feed *struct {
+			ID      string     `xml:"http://www.w3.org/2005/Atom id"`
+			Entries []xml.Name `xml:"http://www.w3.org/2005/Atom entry"`
+		} `xml:"http://www.w3.org/2005/Atom feed"`
+	} `xml:"http://schemas.microsoft.com/ado/2007/08/dataservices/metadata inline"`
+}
+
+// strictEntry is an Atom entry as a strict client binds it
+type strictEntry struct {
+	Links      []strictLink `xml:"http://www.w3.org/2005/Atom link"`
+	Properties struct {
+		Values []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"http://schemas.microsoft.com/ado/2007/08/dataservices/metadata properties"`
+}
+
+// checkAtom binds the entries of an Atom feed or entry, failing on any property or
+// navigation link $metadata doesn't declare, and returns how many entries had
+// their Screenshots inlined
+func (m strictModel) checkAtom(t *testing.T, what string, body string) (entries int, expanded int) {
+	t.Helper()
+	var list []strictEntry
+	if strings.Contains(body, "<feed") && strings.Index(body, "<feed") < strings.Index(body+"<entry", "<entry") {
+		var f struct {
+			Entries []strictEntry `xml:"http://www.w3.org/2005/Atom entry"`
+		}
+		if err := xml.Unmarshal([]byte(body), &f); err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		list = f.Entries
+	} else {
+		var e strictEntry
+		if err := xml.Unmarshal([]byte(body), &e); err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		list = []strictEntry{e}
+	}
+	for _, e := range list {
+		for _, v := range e.Properties.Values {
+			if v.XMLName.Space == dataServicesNS && !m.props[v.XMLName.Local] {
+				t.Errorf("%s: property %s is not in $metadata", what, v.XMLName.Local)
+			}
+		}
+		for _, l := range e.Links {
+			nav := strings.TrimPrefix(l.Rel, dataServicesNS+"/related/")
+			if nav == l.Rel {
+				continue
+			}
+			if !m.navs[nav] {
+				t.Errorf("%s: navigation link %s is not in $metadata", what, nav)
+			}
+			if l.Inline != nil {
+				if l.Inline.Feed == nil || len(l.Inline.Feed.Entries) != 0 || !strings.HasSuffix(l.Inline.Feed.ID, "/"+nav) {
+					t.Errorf("%s: inline %s is not an empty feed", what, nav)
+				}
+				expanded++
+			}
+		}
+	}
+	return len(list), expanded
+}
+
+// checkJSON binds the packages of a verbose or v4 JSON response the same way
+func (m strictModel) checkJSON(t *testing.T, what string, body string) (entries int, expanded int) {
+	t.Helper()
+	var v struct {
+		D *struct {
+			Results []map[string]json.RawMessage `json:"results"`
+		} `json:"d"`
+		Value []map[string]json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	list, empty := v.Value, "[]"
+	if v.D != nil {
+		list, empty = v.D.Results, `{"results":[]}`
+	} else if v.Value == nil {
+		// A v4 single entry is the object itself
+		var e map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(body), &e); err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		list = []map[string]json.RawMessage{e}
+	}
+	for _, e := range list {
+		for k, raw := range e {
+			switch {
+			case strings.HasPrefix(k, "@") || k == "__metadata" || m.props[k]:
+			case m.navs[k]:
+				if string(raw) != empty {
+					t.Errorf("%s: %s is %s, want %s", what, k, raw, empty)
+				}
+				expanded++
+			default:
+				t.Errorf("%s: property %s is not in $metadata", what, k)
+			}
+		}
+	}
+	return len(list), expanded
+}
+
+// Every format agrees with $metadata, expanded or not, for the query shapes
+// clients use
+func TestExpandContract(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Expand.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Expand.Pkg", "2.0.0", "<dependencies><dependency id=\"Expand.Dep\" version=\"1.0.0\" /></dependencies>", nil))
+	m := readStrictModel(t, ts)
+
+	// Verbose JSON is asked for in the query, v4 by Accept
+	formats := map[string]http.Header{
+		"atom":    nil,
+		"verbose": nil,
+		"v4":      {"Accept": {"application/json;odata.metadata=minimal"}},
+	}
+	withQuery := func(p string, format string, q string) string {
+		if format == "verbose" {
+			q = strings.TrimPrefix(q+"&$format=json", "&")
+		}
+		if q == "" {
+			return p
+		}
+		if strings.Contains(p, "?") {
+			return p + "&" + q
+		}
+		return p + "?" + q
+	}
+	for _, q := range []string{
+		"Packages()",
+		"Packages()?$filter=IsLatestVersion",
+		"Packages(Id='Expand.Pkg',Version='2.0.0')",
+		"FindPackagesById()?id='Expand.Pkg'",
+		"Search()?searchTerm=''&includePrerelease=true",
+		"GetUpdates()?packageIds='Expand.Pkg'&versions='1.0.0'&includePrerelease=false&includeAllVersions=false",
+	} {
+		for format, header := range formats {
+			for _, expand := range []string{"", "Screenshots", "Dependencies", "Dependencies,Screenshots"} {
+				p := withQuery(q, format, "")
+				if expand != "" {
+					p = withQuery(q, format, "$expand="+expand)
+				}
+				what := format + " " + p
+				status, body := readResponse(t, ts.do(t, http.MethodGet, p, testReadKey, nil, header))
+				wantStatus(t, what, status, body, http.StatusOK)
+
+				var entries, expanded int
+				if format == "atom" {
+					entries, expanded = m.checkAtom(t, what, body)
+				} else {
+					entries, expanded = m.checkJSON(t, what, body)
+				}
+				if entries == 0 {
+					t.Errorf("%s: no entries", what)
+				}
+				if want := 0; strings.Contains(expand, "Screenshots") && expanded != entries || !strings.Contains(expand, "Screenshots") && expanded != want {
+					t.Errorf("%s: %d of %d entries expanded", what, expanded, entries)
+				}
+			}
+		}
+	}
+
+	// The navigation property itself
+	for format, header := range formats {
+		status, body := readResponse(t, ts.do(t, http.MethodGet, withQuery("Packages(Id='Expand.Pkg',Version='1.0.0')/Screenshots", format, ""), testReadKey, nil, header))
+		wantStatus(t, format+" Screenshots", status, body, http.StatusOK)
+		if format == "atom" {
+			var f struct {
+				XMLName xml.Name
+				Entries []xml.Name `xml:"http://www.w3.org/2005/Atom entry"`
+			}
+			if err := xml.Unmarshal([]byte(body), &f); err != nil || f.XMLName.Local != "feed" || len(f.Entries) != 0 {
+				t.Errorf("%s Screenshots: %v %s", format, err, body)
+			}
+		} else if n, _ := m.checkJSON(t, format+" Screenshots", body); n != 0 {
+			t.Errorf("%s Screenshots: %s", format, body)
+		}
+	}
+	status, body := ts.get(t, "Packages(Id='Expand.Pkg',Version='3.0.0')/Screenshots")
+	wantStatus(t, "Screenshots of a missing version", status, body, http.StatusNotFound)
+
+	// Unknown expansions are refused with an OData error in the format asked for
+	for format, header := range formats {
+		for _, expand := range []string{"Bogus", "Screenshots/Title", "Dependencies/Id"} {
+			what := format + " $expand=" + expand
+			status, body := readResponse(t, ts.do(t, http.MethodGet, withQuery("Packages()", format, "$expand="+expand), testReadKey, nil, header))
+			wantStatus(t, what, status, body, http.StatusBadRequest)
+			var msg string
+			if format == "atom" {
+				var e struct {
+					XMLName xml.Name
+					Message string `xml:"message"`
+				}
+				if err := xml.Unmarshal([]byte(body), &e); err != nil || e.XMLName.Space != metadataNS || e.XMLName.Local != "error" {
+					t.Errorf("%s: %v %s", what, err, body)
+				}
+				msg = e.Message
+			} else {
+				var e struct {
+					Error struct {
+						Message json.RawMessage `json:"message"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal([]byte(body), &e); err != nil {
+					t.Errorf("%s: %v %s", what, err, body)
+				}
+				msg = string(e.Error.Message)
+			}
+			if !strings.Contains(msg, expand) {
+				t.Errorf("%s: message %q", what, msg)
+			}
+		}
+	}
+}
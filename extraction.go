@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outcomes of extracting a package's content files
+const (
+	extractionOK      = "ok"
+	extractionFailed  = "failed"
+	extractionSkipped = "skipped"
+)
+
+// extractionStatus records how extracting a package's content files went. The
+// package is served either way, only its /files are missing on failure.
+type extractionStatus struct {
+	ID      string    `json:"id"`
+	Version string    `json:"version"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Extraction limits used unless configured
+const (
+	defaultExtractMaxFileBytes  = 100 * 1024 * 1024
+	defaultExtractMaxTotalBytes = 250 * 1024 * 1024
+	defaultExtractMaxFiles      = 10000
+)
+
+// extractionLimits bound what extracting a package may decompress, so a zip bomb
+// can't fill the memory or disk
+type extractionLimits struct {
+	MaxFileBytes  int64 `json:"max-file-bytes"`
+	MaxTotalBytes int64 `json:"max-total-bytes"`
+	MaxFiles      int   `json:"max-files"`
+}
+
+// extractionLimitsFor returns the limits in a config with defaults filled in
+func extractionLimitsFor(c *Config) extractionLimits {
+	l := c.ExtractionLimits
+	if l.MaxFileBytes <= 0 {
+		l.MaxFileBytes = defaultExtractMaxFileBytes
+	}
+	if l.MaxTotalBytes <= 0 {
+		l.MaxTotalBytes = defaultExtractMaxTotalBytes
+	}
+	if l.MaxFiles <= 0 {
+		l.MaxFiles = defaultExtractMaxFiles
+	}
+	return l
+}
+
+// extractionLimitError is returned when a package's contents exceed an extraction limit
+type extractionLimitError struct {
+	Limit  string
+	Detail string
+}
+
+func (e *extractionLimitError) Error() string {
+	return "package exceeds extraction limit " + e.Limit + ": " + e.Detail
+}
+
+func serveExtractionList(w http.ResponseWriter, r *http.Request) {
+
+	list, err := server.fs.GetExtractionStatuses(r.Context())
+	if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Optionally only one outcome, e.g. ?status=failed
+	if s := r.URL.Query().Get("status"); s != "" {
+		filtered := []*extractionStatus{}
+		for _, st := range list {
+			if st.Status == s {
+				filtered = append(filtered, st)
+			}
+		}
+		list = filtered
+	}
+
+	writeExtractionJSON(w, list)
+}
+
+func serveReextract(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting admin/reextract/{id}/{version}, or admin/reextract to retry all failures
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`admin/reextract`):], `/`), `/`)
+	if len(x) == 2 {
+		st, err := server.fs.ReextractPackage(r.Context(), x[0], x[1])
+		if err == ErrFileNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err == ErrNotSupported {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeExtractionJSON(w, []*extractionStatus{st})
+		return
+	} else if x[0] != "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	retried, err := retryFailedExtractions(r.Context())
+	if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if isCancelled(err) {
+		// Packages already retried stay retried if the client goes away
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeExtractionJSON(w, retried)
+}
+
+// retryFailedExtractions extracts again every package whose extraction failed,
+// returning their new statuses
+func retryFailedExtractions(ctx context.Context) ([]*extractionStatus, error) {
+	list, err := server.fs.GetExtractionStatuses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var failed []*extractionStatus
+	for _, st := range list {
+		if st.Status == extractionFailed {
+			failed = append(failed, st)
+		}
+	}
+	op := server.operations.Start("reextract", len(failed))
+	defer op.Finish()
+
+	retried := []*extractionStatus{}
+	for _, st := range failed {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		nst, err := server.fs.ReextractPackage(ctx, st.ID, st.Version)
+		if err != nil {
+			return nil, err
+		}
+		op.Step()
+		retried = append(retried, nst)
+	}
+	return retried, nil
+}
+
+// extractionFailure returns the recorded failure for a /files path of the form
+// {id}/{version}/..., or nil if the package's content was extracted
+func extractionFailure(ctx context.Context, fn string) *extractionStatus {
+	x := strings.Split(strings.Trim(fn, `/`), `/`)
+	if len(x) < 2 {
+		return nil
+	}
+	st, err := server.fs.GetExtractionStatus(ctx, x[0], x[1])
+	if err != nil || st.Status != extractionFailed {
+		return nil
+	}
+	return st
+}
+
+func writeExtractionJSON(w http.ResponseWriter, list []*extractionStatus) {
+	b, err := json.Marshal(list)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
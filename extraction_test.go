@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// zeros reads as endless zero bytes, which compress to almost nothing
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// bombPackage builds a nupkg of files of zero bytes, far smaller compressed than
+// their sizes. pad adds that many bytes of comment to the nuspec.
+func bombPackage(t *testing.T, id string, ver string, pad int, files map[string]int64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(id + ".nuspec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://schemas.microsoft.com/packaging/2010/07/nuspec.xsd">
+  <metadata>
+    <id>`+id+`</id>
+    <version>`+ver+`</version>
+    <authors>Tester</authors>
+    <description>Description of `+id+`</description>
+  </metadata>
+</package>
+<!--`+strings.Repeat(" ", pad)+`-->`)
+	for p, n := range files {
+		w, err := zw.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(w, zeros{}, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractionLimits(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.ExtractionLimits = extractionLimits{MaxFileBytes: 1 << 20, MaxTotalBytes: 2 << 20, MaxFiles: 4}
+	})
+
+	for _, tc := range []struct {
+		name  string
+		pkg   []byte
+		limit string
+	}{
+		{"file", bombPackage(t, "Bomb.File", "1.0.0", 0, map[string]int64{"content/zeros.bin": 64 << 20}), "max-file-bytes"},
+		{"nuspec", bombPackage(t, "Bomb.Nuspec", "1.0.0", 64<<20, nil), "max-file-bytes"},
+		{"total", bombPackage(t, "Bomb.Total", "1.0.0", 0, map[string]int64{"content/a.bin": 900 << 10, "content/b.bin": 900 << 10, "content/c.bin": 900 << 10}), "max-total-bytes"},
+		{"files", bombPackage(t, "Bomb.Files", "1.0.0", 0, map[string]int64{"content/a": 1, "content/b": 1, "content/c": 1, "content/d": 1}), "max-files"},
+		// Entries that would be written outside the package
+		{"traversal", bombPackage(t, "Slip.Up", "1.0.0", 0, map[string]int64{"content/../../../zipslip.txt": 1}), "entry-names"},
+		{"backslashes", bombPackage(t, "Slip.Back", "1.0.0", 0, map[string]int64{`content\..\..\zipslip.txt`: 1}), "entry-names"},
+		{"absolute", bombPackage(t, "Slip.Root", "1.0.0", 0, map[string]int64{"/tmp/zipslip.txt": 1}), "entry-names"},
+		{"drive", bombPackage(t, "Slip.Drive", "1.0.0", 0, map[string]int64{`C:\zipslip.txt`: 1}), "entry-names"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.pkg) > 1<<20 {
+				t.Fatalf("fixture is %d bytes compressed", len(tc.pkg))
+			}
+			status, body := ts.push(t, tc.pkg)
+			wantStatus(t, "push", status, body, http.StatusBadRequest)
+			if !strings.Contains(body, tc.limit) {
+				t.Errorf("push: got %q, want the %s limit named", body, tc.limit)
+			}
+		})
+	}
+
+	status, body := ts.get(t, "Packages()")
+	wantStatus(t, "feed", status, body, http.StatusOK)
+	if ids := feedIDs(t, body); len(ids) != 0 {
+		t.Errorf("feed has %v, want nothing stored", ids)
+	}
+	filepath.Walk(ts.Dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Name() == "zipslip.txt" {
+			t.Errorf("%s was written", p)
+		}
+		return err
+	})
+	ts.mustPush(t, bombPackage(t, "Not.Bomb", "1.0.0", 0, map[string]int64{"content/a.bin": 1 << 20, "content/a..b/c.txt": 1}))
+}
+
+func TestExtractionLimitsOnLoad(t *testing.T) {
+	// As when the process starts, with no server yet while the store is loaded
+	server = nil
+	ts := newTestServer(t, func(c *Config) {
+		c.ExtractionLimits = extractionLimits{MaxFileBytes: 1 << 20}
+
+		// Stored before the limits were lowered
+		copyPackage(t, c, "Bomb.Loaded", "1.0.0", bombPackage(t, "Bomb.Loaded", "1.0.0", 0, map[string]int64{"content/zeros.bin": 64 << 20}))
+	})
+
+	// The package is still served, only its content isn't
+	status, body := ts.get(t, "Packages(Id='Bomb.Loaded',Version='1.0.0')")
+	wantStatus(t, "entry", status, body, http.StatusOK)
+	if _, err := os.Stat(filepath.Join(ts.versionDir(t, "bomb.loaded", "1.0.0"), "content", "zeros.bin")); !os.IsNotExist(err) {
+		t.Errorf("content was extracted: %v", err)
+	}
+
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "admin/extraction?status=failed", testWriteKey, nil, nil))
+	wantStatus(t, "extraction", status, body, http.StatusOK)
+	var list []*extractionStatus
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "Bomb.Loaded" || !strings.Contains(list[0].Error, "max-file-bytes") {
+		t.Errorf("got %s, want Bomb.Loaded failed on max-file-bytes", body)
+	}
+}
+
+// A package whose content can't be written keeps its failure across a restart
+func TestExtractionFailurePersists(t *testing.T) {
+	ts := newTestServer(t, nil)
+
+	// content/a.txt can't be both a file and a directory
+	ts.mustPush(t, testPackage(t, "Bad.Content", "1.0.0", "", map[string]string{"content/a.txt": "file", "content/a.txt/b.txt": "file"}))
+	status, failed := ts.get(t, "files/bad.content/1.0.0/content/c.txt")
+	wantStatus(t, "files", status, failed, http.StatusServiceUnavailable)
+	if !strings.Contains(failed, "content extraction failed") {
+		t.Errorf("files: got %q, want the recorded reason", failed)
+	}
+
+	// The same failure, from the same time, rather than another attempt
+	ts.restart(t)
+	status, body := ts.get(t, "Packages(Id='Bad.Content',Version='1.0.0')")
+	wantStatus(t, "entry after restart", status, body, http.StatusOK)
+	status, body = ts.get(t, "files/bad.content/1.0.0/content/c.txt")
+	wantStatus(t, "files after restart", status, body, http.StatusServiceUnavailable)
+	if body != failed {
+		t.Errorf("files after restart: got %q, want %q", body, failed)
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "admin/extraction?status=failed", testWriteKey, nil, nil))
+	wantStatus(t, "extraction", status, body, http.StatusOK)
+	var list []*extractionStatus
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "Bad.Content" || list[0].Error == "" {
+		t.Fatalf("got %s, want Bad.Content failed", body)
+	}
+
+	// Retrying all failures extracts it again
+	marker := filepath.Join(ts.versionDir(t, "bad.content", "1.0.0"), extractedMarkerName)
+	var m extractedMarker
+	if b, err := ioutil.ReadFile(marker); err != nil || json.Unmarshal(b, &m) != nil || m.Status != extractionFailed {
+		t.Fatalf("marker: %s %v, want the failure recorded", b, err)
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodPost, "admin/reextract", testWriteKey, nil, nil))
+	wantStatus(t, "reextract", status, body, http.StatusOK)
+	list = nil
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Status != extractionFailed || list[0].Time.Before(m.Time) {
+		t.Errorf("reextract: got %s, want Bad.Content retried", body)
+	}
+}
+
+// contentPackage builds a nupkg with content files worth precompressing, nested
+// and under a repeated content/ prefix, beside files that aren't content
+func contentPackage(t *testing.T, id string, ver string) []byte {
+	t.Helper()
+	return testPackage(t, id, ver, "", map[string]string{
+		"content/readme.txt":         strings.Repeat("Read me. ", 1000),
+		"content/scripts/app.js":     strings.Repeat("console.log('app');\n", 500),
+		"content/content/nested.txt": "nested",
+		"content/empty/":             "",
+		"lib/net48/Content.Pkg.dll":  "not content",
+	})
+}
+
+// versionLayout returns every file under a version's directory and what it holds.
+// The marker's time is cleared, as it's when the content was extracted.
+func versionLayout(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if fi.Name() == extractedMarkerName {
+			var m extractedMarker
+			if err := json.Unmarshal(b, &m); err != nil {
+				return err
+			}
+			m.Time = time.Time{}
+			b, _ = json.Marshal(m)
+		}
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// A push extracts its content once, a restart keeps it, and a package copied into
+// the store is extracted at startup to the same files
+func TestExtractionOncePerPush(t *testing.T) {
+	pkg := contentPackage(t, "Content.Pkg", "1.0.0")
+	precompress := func(c *Config) {
+		c.FileStore.PrecompressContent = true
+		c.FileStore.PrecompressMinBytes = 1024
+	}
+
+	var pushed map[string]string
+	t.Run("push", func(t *testing.T) {
+		ts := newTestServer(t, precompress)
+		ts.mustPush(t, pkg)
+		if n := atomic.LoadUint64(&ts.local(t).extractions); n != 1 {
+			t.Errorf("a push extracted %d times, want once", n)
+		}
+		dir := ts.versionDir(t, "Content.Pkg", "1.0.0")
+		pushed = versionLayout(t, dir)
+		for _, f := range []string{"content/readme.txt", "content/scripts/app.js", "content/nested.txt", extractedMarkerName} {
+			if _, ok := pushed[f]; !ok {
+				t.Errorf("no %s in %v", f, pushed)
+			}
+		}
+		marker, err := ioutil.ReadFile(filepath.Join(dir, extractedMarkerName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Up to date, nothing is extracted again, and the marker keeps its time
+		ts.restart(t)
+		if n := atomic.LoadUint64(&ts.local(t).extractions); n != 0 {
+			t.Errorf("a restart extracted %d times, want none", n)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, extractedMarkerName)); err != nil || string(b) != string(marker) {
+			t.Errorf("marker after restart: %s %v, want %s", b, err, marker)
+		}
+	})
+
+	t.Run("startup", func(t *testing.T) {
+		server = nil
+		ts := newTestServer(t, func(c *Config) {
+			precompress(c)
+			copyPackage(t, c, "Content.Pkg", "1.0.0", pkg)
+		})
+		if n := atomic.LoadUint64(&ts.local(t).extractions); n != 1 {
+			t.Errorf("startup extracted %d times, want once", n)
+		}
+		loaded := versionLayout(t, ts.versionDir(t, "Content.Pkg", "1.0.0"))
+		if !reflect.DeepEqual(loaded, pushed) {
+			for f := range pushed {
+				if loaded[f] != pushed[f] {
+					t.Errorf("%s differs from the pushed copy:\n%.200s\npushed\n%.200s", f, loaded[f], pushed[f])
+				}
+			}
+			for f := range loaded {
+				if _, ok := pushed[f]; !ok {
+					t.Errorf("%s is only there loaded at startup", f)
+				}
+			}
+		}
+	})
+}
+
+// A content file whose path leads out of the content directory fails the
+// extraction before anything is written
+func TestExtractContentTraversal(t *testing.T) {
+	c := defaultConfig()
+	root := t.TempDir()
+	fs := &fileStoreLocal{rootDir: root, server: &Server{config: c}}
+	for _, name := range []string{
+		"content/../../../zipslip.txt",
+		"content/scripts/../../../../zipslip.txt",
+		"content/content/../..",
+	} {
+		_, err := fs.extractContent("Slip.Pkg", "1.0.0", map[string][]byte{
+			"content/readme.txt": []byte("fine"),
+			name:                 []byte("escaped"),
+		})
+		if err == nil || !strings.Contains(err.Error(), "outside the content directory") {
+			t.Errorf("%s: got %v, want the extraction refused", name, err)
+		}
+		filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				t.Errorf("%s: %s was written", name, p)
+			}
+			return err
+		})
+	}
+}
+
+// Extracting a package of 200 content files: from the files a push has already
+// unzipped, from the nupkg as at startup, and skipped as up to date
+func BenchmarkExtraction(b *testing.B) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < 200; i++ {
+		w, err := zw.Create(fmt.Sprintf("content/dir%d/file%d.txt", i%10, i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.WriteString(w, strings.Repeat(fmt.Sprintf("line %d of the file\n", i), 200))
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	pkg := buf.Bytes()
+	c := defaultConfig()
+	_, unzipped, err := extractPackage(pkg, extractionLimitsFor(c))
+	if err != nil {
+		b.Fatal(err)
+	}
+	fs := &fileStoreLocal{rootDir: b.TempDir(), server: &Server{config: c}}
+
+	b.Run("push", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fs.extractVersion("Bench.Content", "1.0.0", pkg, "hash", unzipped)
+		}
+	})
+	b.Run("startup", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			os.Remove(filepath.Join(fs.versionDir("Bench.Content", "1.0.0"), extractedMarkerName))
+			fs.extractVersion("Bench.Content", "1.0.0", pkg, "hash", nil)
+		}
+	})
+	b.Run("up to date", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fs.extractVersion("Bench.Content", "1.0.0", pkg, "hash", nil)
+		}
+	})
+}
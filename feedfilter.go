@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// feedFilter is the part of a Packages() $filter the feed understands: an ID and
+// the latest version flags, joined by "and", e.g.
+// "IsLatestVersion and tolower(Id) eq 'foo'". Other clauses are ignored.
+type feedFilter struct {
+	ID                      string
+	IsLatestVersion         bool
+	IsAbsoluteLatestVersion bool
+}
+
+// parseFeedFilter reads the clauses of a $filter it understands
+func parseFeedFilter(filter string) feedFilter {
+	var f feedFilter
+	for _, c := range splitFilterAnd(filter) {
+		x := strings.Fields(strings.Trim(strings.TrimSpace(c), `()`))
+		if len(x) == 0 {
+			continue
+		}
+
+		// A flag alone or compared with true
+		flag := len(x) == 1 || (len(x) == 3 && x[1] == "eq" && strings.EqualFold(x[2], "true"))
+		switch {
+		case x[0] == "IsLatestVersion" && flag:
+			f.IsLatestVersion = true
+		case x[0] == "IsAbsoluteLatestVersion" && flag:
+			f.IsAbsoluteLatestVersion = true
+		case (x[0] == "tolower(Id)" || x[0] == "Id") && len(x) == 3 && x[1] == "eq":
+			f.ID = strings.Trim(x[2], `'`)
+		}
+	}
+	return f
+}
+
+// splitFilterAnd splits a $filter on its "and" operators, in any case
+func splitFilterAnd(filter string) []string {
+	var clauses []string
+	x := strings.Fields(filter)
+	start := 0
+	for i, w := range x {
+		if strings.EqualFold(w, "and") {
+			clauses = append(clauses, strings.Join(x[start:i], " "))
+			start = i + 1
+		}
+	}
+	return append(clauses, strings.Join(x[start:], " "))
+}
+
+// Apply drops the entries not flagged as the filter asks
+func (f feedFilter) Apply(entries []*NugetPackageEntry) []*NugetPackageEntry {
+	if !f.IsLatestVersion && !f.IsAbsoluteLatestVersion {
+		return entries
+	}
+	var filtered []*NugetPackageEntry
+	for _, e := range entries {
+		if f.IsLatestVersion && !e.Properties.IsLatestVersion.Value {
+			continue
+		}
+		if f.IsAbsoluteLatestVersion && !e.Properties.IsAbsoluteLatestVersion.Value {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+	return filtered
+}
+
+// requestPrerelease reports whether prerelease versions may be included, false
+// only if the client sent includePrerelease=false
+func requestPrerelease(r *http.Request) bool {
+	b, err := strconv.ParseBool(strings.Trim(r.URL.Query().Get("includePrerelease"), `'`))
+	return err != nil || b
+}
+
+// filterPrerelease drops prerelease versions from a feed
+func filterPrerelease(entries []*NugetPackageEntry) []*NugetPackageEntry {
+	var filtered []*NugetPackageEntry
+	for _, e := range entries {
+		if !versions.IsPrerelease(e.Properties.Version) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
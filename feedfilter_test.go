@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseFeedFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		want   feedFilter
+	}{
+		{"", feedFilter{}},
+		{"IsLatestVersion", feedFilter{IsLatestVersion: true}},
+		{"IsAbsoluteLatestVersion eq true", feedFilter{IsAbsoluteLatestVersion: true}},
+		{"(IsLatestVersion)", feedFilter{IsLatestVersion: true}},
+		{"IsLatestVersion eq false", feedFilter{}},
+		{"IsLatestVersion and IsAbsoluteLatestVersion", feedFilter{IsLatestVersion: true, IsAbsoluteLatestVersion: true}},
+		{"IsLatestVersion AND tolower(Id) eq 'foo'", feedFilter{ID: "foo", IsLatestVersion: true}},
+		{"Id eq 'Foo' and IsAbsoluteLatestVersion eq TRUE", feedFilter{ID: "Foo", IsAbsoluteLatestVersion: true}},
+		{"IsLatestVersion or IsPrerelease", feedFilter{}},
+		{"substringof('x', Title) and IsLatestVersion", feedFilter{IsLatestVersion: true}},
+		{"Island and IsLatestVersion", feedFilter{IsLatestVersion: true}},
+	} {
+		if got := parseFeedFilter(tc.filter); got != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.filter, got, tc.want)
+		}
+	}
+}
+
+// The latest flag filters and includePrerelease pick versions from the feed as
+// nuget.exe expects
+func TestFeedFilterRoutes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, v := range []string{"Filter.A 1.0.0", "Filter.A 2.0.0", "Filter.A 3.0.0-beta", "Filter.B 1.0.0-alpha", "Filter.C 1.0.0", "Filter.C 1.1.0"} {
+		id, ver := v[:8], v[9:]
+		ts.mustPush(t, testPackage(t, id, ver, "", nil))
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Filter.C/1.1.0", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	for _, tc := range []struct {
+		p    string
+		want []string
+	}{
+		{"Packages()", []string{"Filter.A 1.0.0", "Filter.A 2.0.0", "Filter.A 3.0.0-beta", "Filter.B 1.0.0-alpha", "Filter.C 1.0.0"}},
+		// Only listed stable versions can be latest, so Filter.B has none
+		{"Packages()?$filter=IsLatestVersion", []string{"Filter.A 2.0.0", "Filter.C 1.0.0"}},
+		{"Packages()?$filter=IsAbsoluteLatestVersion", []string{"Filter.A 3.0.0-beta", "Filter.B 1.0.0-alpha", "Filter.C 1.0.0"}},
+		{"Packages()?$filter=IsLatestVersion and IsAbsoluteLatestVersion", []string{"Filter.C 1.0.0"}},
+		{"Packages()?$filter=IsLatestVersion eq true and tolower(Id) eq 'filter.a'", []string{"Filter.A 2.0.0"}},
+		{"Packages()?$filter=IsAbsoluteLatestVersion and Id eq 'Filter.B'", []string{"Filter.B 1.0.0-alpha"}},
+		{"Packages()?$filter=IsLatestVersion and tolower(Id) eq 'filter.b'", nil},
+		{"api/v2/Packages()?$filter=IsLatestVersion", []string{"Filter.A 2.0.0", "Filter.C 1.0.0"}},
+		// Clauses the feed doesn't understand are ignored
+		{"Packages()?$filter=IsPrerelease eq false", []string{"Filter.A 1.0.0", "Filter.A 2.0.0", "Filter.A 3.0.0-beta", "Filter.B 1.0.0-alpha", "Filter.C 1.0.0"}},
+		{"FindPackagesById()?id='Filter.A'", []string{"Filter.A 1.0.0", "Filter.A 2.0.0", "Filter.A 3.0.0-beta"}},
+		{"FindPackagesById()?id='Filter.A'&includePrerelease=true", []string{"Filter.A 1.0.0", "Filter.A 2.0.0", "Filter.A 3.0.0-beta"}},
+		{"FindPackagesById()?id='Filter.A'&includePrerelease=false", []string{"Filter.A 1.0.0", "Filter.A 2.0.0"}},
+		{"FindPackagesById()?id='Filter.A'&includePrerelease='false'", []string{"Filter.A 1.0.0", "Filter.A 2.0.0"}},
+		{"FindPackagesById()?id='Filter.B'&includePrerelease=false", nil},
+		// Unlisted versions are still found by ID
+		{"FindPackagesById()?id='Filter.C'&includePrerelease=false", []string{"Filter.C 1.0.0", "Filter.C 1.1.0"}},
+	} {
+		status, body := ts.get(t, strings.ReplaceAll(tc.p, " ", "%20"))
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		got := feedIDs(t, body)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.p, got, tc.want)
+		}
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"crypto/sha512"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"log"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,6 +20,8 @@ import (
 	"google.golang.org/api/iterator"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
 )
 
 type fileStoreGCP struct {
@@ -58,30 +62,104 @@ func (fs *fileStoreGCP) Init(s *Server) error {
 func (fs *fileStoreGCP) UpdateCountsInMemory() {
 }
 
-func (fs *fileStoreGCP) StorePackage(pkg []byte) (bool, error) {
+func (fs *fileStoreGCP) QuarantinePackage(ctx context.Context, pkg []byte) (*NugetPackageEntry, error) {
+	return nil, ErrNotSupported
+}
+
+func (fs *fileStoreGCP) GetQuarantinedEntries(ctx context.Context) ([]*NugetPackageEntry, error) {
+	return nil, ErrNotSupported
+}
+
+func (fs *fileStoreGCP) ApprovePackage(ctx context.Context, id string, ver string) error {
+	return ErrNotSupported
+}
+
+func (fs *fileStoreGCP) RejectPackage(ctx context.Context, id string, ver string, reason string) error {
+	return ErrNotSupported
+}
+
+func (fs *fileStoreGCP) GetChanges(ctx context.Context, since int64) ([]changeRecord, int64, bool, error) {
+	return nil, 0, false, ErrNotSupported
+}
+
+func (fs *fileStoreGCP) SetListed(ctx context.Context, id string, ver string, listed bool) error {
+	return ErrNotSupported
+}
+
+func (fs *fileStoreGCP) DeletePackage(ctx context.Context, id string, ver string) error {
+	return ErrNotSupported
+}
+
+func (fs *fileStoreGCP) GetExtractionStatus(ctx context.Context, id string, ver string) (*extractionStatus, error) {
+	return nil, ErrNotSupported
+}
+
+func (fs *fileStoreGCP) GetExtractionStatuses(ctx context.Context) ([]*extractionStatus, error) {
+	return nil, ErrNotSupported
+}
+
+func (fs *fileStoreGCP) ReextractPackage(ctx context.Context, id string, ver string) (*extractionStatus, error) {
+	return nil, ErrNotSupported
+}
+
+// Reindex isn't needed, every request reads Firestore
+func (fs *fileStoreGCP) Reindex(ctx context.Context) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (fs *fileStoreGCP) GetCompressedFile(ctx context.Context, f string) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+// LastChanged returns the publish time of the most recently stored package
+func (fs *fileStoreGCP) LastChanged(ctx context.Context) time.Time {
+	// Firestore orders strings after timestamps, so look past documents still
+	// holding the time as a string unless there are only those
+	q := fs.firestore.Collection("Nuget-Packages").OrderBy("Properties.Published.Value", firestore.Desc).Limit(1)
+	d, err := q.Where("Properties.Published.Value", ">", time.Time{}).Documents(ctx).Next()
+	if err == iterator.Done {
+		d, err = q.Documents(ctx).Next()
+	}
+	if err != nil {
+		if err != iterator.Done {
+			log.Println("Error: Cannot read last change", err)
+		}
+		return time.Time{}
+	}
+	npe, err := packageEntry(d)
+	if err != nil {
+		log.Println("Error: Cannot read last change", err)
+		return time.Time{}
+	}
+	return npe.Properties.Published.Value
+}
+
+func (fs *fileStoreGCP) StorePackage(ctx context.Context, pkg []byte) (bool, error) {
 
 	// Extract files
-	nsf, files, err := extractPackage(pkg)
+	nsf, files, err := extractPackage(pkg, extractionLimitsFor(server.Config()))
 	if err != nil {
 		return false, err
 	}
 
-	// Generate local variables for ease
-	pkgRef := nsf.Meta.ID + "." + nsf.Meta.Version
-	pkgFileName := pkgRef + ".nupkg"                   // Package File Name
-	pkgDir := path.Join(nsf.Meta.ID, nsf.Meta.Version) // Package Directory Name
+	// Generate local variables for ease, stored under the normalized version so
+	// 1.0 and 1.0.0 are the same package
+	ver := versions.Normalize(nsf.Meta.Version)
+	pkgRef := nsf.Meta.ID + "." + ver
+	pkgFileName := pkgRef + ".nupkg"      // Package File Name
+	pkgDir := path.Join(nsf.Meta.ID, ver) // Package Directory Name
 
-	// Check to see if package already exists
-	d, err := fs.firestore.Collection("Nuget-Packages").Doc(pkgRef).Get(fs.ctx)
-	if err != nil && grpc.Code(err) != codes.NotFound {
+	// Check to see if package already exists, however it was written
+	d, err := fs.packageDoc(ctx, nsf.Meta.ID, nsf.Meta.Version)
+	if err != nil && err != ErrFileNotFound {
 		return false, err
 	}
-	if d.Exists() {
+	if err == nil {
 		return true, nil
 	}
 
 	// Save Package
-	wc := fs.bucket.Object(path.Join(pkgDir, pkgFileName)).NewWriter(fs.ctx)
+	wc := fs.bucket.Object(path.Join(pkgDir, pkgFileName)).NewWriter(ctx)
 	wc.ContentType = "application/octet-stream"
 	if _, err := wc.Write(pkg); err != nil {
 		return false, err
@@ -92,7 +170,7 @@ func (fs *fileStoreGCP) StorePackage(pkg []byte) (bool, error) {
 
 	// Save Files
 	for name, content := range files {
-		wc := fs.bucket.Object(path.Join(pkgDir, name)).NewWriter(fs.ctx)
+		wc := fs.bucket.Object(path.Join(pkgDir, name)).NewWriter(ctx)
 		wc.ContentType = "application/octet-stream"
 		if _, err := wc.Write(content); err != nil {
 			return false, err
@@ -105,30 +183,34 @@ func (fs *fileStoreGCP) StorePackage(pkg []byte) (bool, error) {
 
 	// Make a new Package Entry
 	npe := NewNugetPackageEntry(nsf)
+	npe.setNuspecDetails(pkg)
 
 	// Populate additional time values
-	npe.Properties.Created.Value = time.Now().Format(zuluTimeLayout)
-	npe.Properties.LastEdited.Value = time.Now().Format(zuluTimeLayout)
-	npe.Properties.Published.Value = time.Now().Format(zuluTimeLayout)
-	npe.Updated = time.Now().Format(zuluTimeLayout)
+	now := time.Now().UTC()
+	npe.Properties.Created.Value = now
+	npe.Properties.LastEdited.Value = now
+	npe.Properties.Published.Value = now
+	npe.Updated.Value = now
 
 	// Populate additional package values
 	h := sha512.Sum512(pkg)
 	npe.Properties.PackageHash = hex.EncodeToString(h[:])
 	npe.Properties.PackageHashAlgorithm = `SHA512`
 	npe.Properties.PackageSize.Value = len(pkg)
+	npe.Properties.SupportedFrameworks = strings.Join(packageFrameworks(pkg), "|")
 	npe.Properties.PackageSize.Type = "Edm.Int64"
 
 	// Save to Firestore
-	if _, err := fs.firestore.Collection("Nuget-Packages").Doc(pkgRef).Set(fs.ctx, npe); err != nil {
+	if _, err := fs.firestore.Collection("Nuget-Packages").Doc(pkgRef).Set(ctx, npe); err != nil {
 		return false, err
 	}
 
 	// Local Extras object
 	pe := &packagesExtra{}
 
-	// Cycle through all packages with this ID to get the latest version
-	iter := fs.firestore.Collection("Nuget-Packages").Where("Properties.ID", "==", npe.Properties.ID).Documents(fs.ctx)
+	// Cycle through all packages with this ID to get the latest versions
+	var list []string
+	iter := fs.firestore.Collection("Nuget-Packages").Where("Properties.ID", "==", npe.Properties.ID).Documents(ctx)
 	// Cycle Iterator
 	for {
 		d, err = iter.Next()
@@ -139,20 +221,18 @@ func (fs *fileStoreGCP) StorePackage(pkg []byte) (bool, error) {
 			return false, err
 		}
 		// Marshall into structure
-		var npe *NugetPackageEntry
-		if err := d.DataTo(&npe); err != nil {
+		npe, err := packageEntry(d)
+		if err != nil {
 			return false, err
 		}
-		// Check against latest and overrite if higher
-		if npe.Properties.Version > pe.Latest {
-			pe.Latest = npe.Properties.Version
-		}
+		list = append(list, npe.Properties.Version)
 	}
+	pe.Latest, pe.Stable = latestVersions(list)
 
 	// Ensure Extras is created for this id
-	if _, err := fs.firestore.Collection("Nuget-Packages-Extra").Doc(npe.Properties.ID).Set(fs.ctx,
+	if _, err := fs.firestore.Collection("Nuget-Packages-Extra").Doc(npe.Properties.ID).Set(ctx,
 		pe,
-		firestore.Merge([]string{"Latest"}),
+		firestore.Merge([]string{"Latest"}, []string{"Stable"}),
 	); err != nil {
 		return false, err
 	}
@@ -162,14 +242,82 @@ func (fs *fileStoreGCP) StorePackage(pkg []byte) (bool, error) {
 
 type packagesExtra struct {
 	Downloads int
-	Latest    string
+	// The highest version, flagged IsAbsoluteLatestVersion
+	Latest string
+	// The highest stable version, empty if there is none
+	Stable string
+	// Set to override Stable, see SetPinnedVersion
+	Pinned string
+}
+
+// latest returns the version flagged IsLatestVersion, the pinned one if set
+func (pe *packagesExtra) latest() string {
+	if pe.Pinned != "" {
+		return pe.Pinned
+	}
+	// Documents written before Stable was kept only have Latest
+	if pe.Stable == "" && !versions.IsPrerelease(pe.Latest) {
+		return pe.Latest
+	}
+	return pe.Stable
+}
+
+// latestVersions returns the highest of a package's versions and the highest of
+// its stable versions, by SemVer 2.0.0 precedence
+func latestVersions(list []string) (string, string) {
+	latest, stable := "", ""
+	for _, v := range list {
+		if latest == "" || versions.Compare(v, latest) > 0 {
+			latest = v
+		}
+		if !versions.IsPrerelease(v) && (stable == "" || versions.Compare(v, stable) > 0) {
+			stable = v
+		}
+	}
+	return latest, stable
+}
+
+// packageEntry reads a package document
+func packageEntry(d *firestore.DocumentSnapshot) (*NugetPackageEntry, error) {
+	var npe *NugetPackageEntry
+	if err := d.DataTo(&npe); err == nil {
+		return npe, nil
+	}
+	return legacyPackageEntry(d.Data())
+}
+
+// legacyPackageEntry reads a package document stored with its timestamps as
+// strings, which DataTo can't set a time.Time from. The times are parsed, and the
+// rest is decoded through JSON, which goes by the same field names as Firestore.
+func legacyPackageEntry(data map[string]interface{}) (*NugetPackageEntry, error) {
+	if s, ok := data["Updated"].(string); ok {
+		data["Updated"] = map[string]interface{}{"Value": parseTimestamp(s)}
+	}
+	if props, ok := data["Properties"].(map[string]interface{}); ok {
+		for _, k := range []string{"Created", "LastEdited", "Published"} {
+			if dt, ok := props[k].(map[string]interface{}); ok {
+				if s, ok := dt["Value"].(string); ok {
+					dt["Value"] = parseTimestamp(s)
+				}
+			}
+		}
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var npe *NugetPackageEntry
+	if err := json.Unmarshal(b, &npe); err != nil {
+		return nil, err
+	}
+	return npe, nil
 }
 
-func (fs *fileStoreGCP) getPackageExtras(id string) (*packagesExtra, error) {
+func (fs *fileStoreGCP) getPackageExtras(ctx context.Context, id string) (*packagesExtra, error) {
 
 	// Get additional data - Download counts and check if latest version
 	// Fetch the additional data document for this ID
-	d, err := fs.firestore.Collection("Nuget-Packages-Extra").Doc(id).Get(fs.ctx)
+	d, err := fs.firestore.Collection("Nuget-Packages-Extra").Doc(id).Get(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -184,57 +332,124 @@ func (fs *fileStoreGCP) getPackageExtras(id string) (*packagesExtra, error) {
 	return nil, errors.New("Can't Find Nuget-Package-Extra")
 }
 
-func (fs *fileStoreGCP) GetPackageEntry(id string, ver string) (*NugetPackageEntry, error) {
+// versionForms returns the ways a version may be stored: normalized, as it is now
+// stored, and then as written, as it was stored before
+func versionForms(ver string) []string {
+	if n := versions.Normalize(ver); n != ver {
+		return []string{n, ver}
+	}
+	return []string{ver}
+}
+
+// packageDoc fetches a version's document, however the version is written
+func (fs *fileStoreGCP) packageDoc(ctx context.Context, id string, ver string) (*firestore.DocumentSnapshot, error) {
+	for _, v := range versionForms(ver) {
+		d, err := fs.firestore.Collection("Nuget-Packages").Doc(id + "." + v).Get(ctx)
+		if grpc.Code(err) == codes.NotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, ErrFileNotFound
+}
+
+// readPackage reads a version's nupkg from the bucket, however the version is written
+func (fs *fileStoreGCP) readPackage(ctx context.Context, id string, ver string) ([]byte, error) {
+	for _, v := range versionForms(ver) {
+		b, _, err := fs.GetFile(ctx, path.Join(id, v, id+"."+v+".nupkg"))
+		if err == ErrFileNotFound {
+			continue
+		}
+		return b, err
+	}
+	return nil, ErrFileNotFound
+}
+
+func (fs *fileStoreGCP) GetPackageEntry(ctx context.Context, id string, ver string) (*NugetPackageEntry, error) {
 
 	// Fetch this document
-	d, err := fs.firestore.Collection("Nuget-Packages").Doc(id + "." + ver).Get(fs.ctx)
+	d, err := fs.packageDoc(ctx, id, ver)
 	if err != nil {
 		return nil, err
 	}
 
 	// Marshall into structure
-	var npe *NugetPackageEntry
-	if err := d.DataTo(&npe); err != nil {
+	npe, err := packageEntry(d)
+	if err != nil {
 		return nil, err
 	}
 
-	pe, err := fs.getPackageExtras(id)
+	pe, err := fs.getPackageExtras(ctx, id)
 	if err != nil {
 		return nil, err
 	}
+	// Listing isn't supported, so every version is listed
+	npe.Properties.Listed = BoolProp{Value: true, Type: "Edm.Boolean"}
+	// Documents stored before DevelopmentDependency was read don't have its type
+	npe.Properties.DevelopmentDependency.Type = "Edm.Boolean"
 	// Get download count for this id all versions
 	npe.Properties.DownloadCount.Value = pe.Downloads
 	// Get latest version and compare to this
-	npe.Properties.IsLatestVersion.Value = pe.Latest == ver
-	npe.Properties.IsAbsoluteLatestVersion.Value = pe.Latest == ver
+	npe.Properties.IsLatestVersion.Value = pe.latest() != "" && versions.Equal(pe.latest(), ver)
+	npe.Properties.IsAbsoluteLatestVersion.Value = versions.Equal(pe.Latest, ver)
 
-	// TODO: Returns 500 error when no matching package - should return 404
 	return npe, nil
 }
 
-func (fs *fileStoreGCP) GetPackageFeedEntries(id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+// GetPackageFeedEntries reads entries in document order. Firestore would need an
+// index for each $orderby, so with one every matching entry is read and sorted
+// here, and a page starts after the entry startAfter names in that order.
+func (fs *fileStoreGCP) GetPackageFeedEntries(ctx context.Context, id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+
+	// Create query, by ID if specified
+	q := fs.firestore.Collection("Nuget-Packages").Query
+	if id != "" {
+		q = q.Where("Properties.IDLowerCase", "==", strings.ToLower(id))
+	}
+
+	if o := contextFeedOrder(ctx); len(o) > 0 {
+		f, err := fs.feedEntries(ctx, q.Documents(ctx))
+		if err != nil {
+			return nil, false, err
+		}
+		sortFeedEntries(f, o)
+		return pageFeedEntries(f, startAfter, max)
+	}
 
 	// Increment max to get one more than we need, to use to detect if another page exists
 	max = max + 1
-	// Create new empty feed
-	var f []*NugetPackageEntry
-	// Create new itterator
-	var iter *firestore.DocumentIterator
-	// Create map of extra details so only looked up once per id
-	extras := make(map[string]*packagesExtra)
 	// Populate Itterator
 	if startAfter != "" {
 		// Get specific APIKey entry
-		d, err := fs.firestore.Collection("Nuget-Packages").Doc(startAfter).Get(fs.ctx)
+		d, err := fs.firestore.Collection("Nuget-Packages").Doc(startAfter).Get(ctx)
 		if err != nil {
 			return nil, false, err
 		}
-		iter = fs.firestore.Collection("Nuget-Packages").StartAfter(d).Limit(max).Documents(fs.ctx)
-	} else if id != "" {
-		iter = fs.firestore.Collection("Nuget-Packages").Limit(max).Where("Properties.IDLowerCase", "==", strings.ToLower(id)).Documents(fs.ctx)
-	} else {
-		iter = fs.firestore.Collection("Nuget-Packages").Limit(max).Documents(fs.ctx)
+		q = fs.firestore.Collection("Nuget-Packages").StartAfter(d)
+	}
+	f, err := fs.feedEntries(ctx, q.Limit(max).Documents(ctx))
+	if err != nil {
+		return nil, false, err
 	}
+
+	// Check array has no more
+	if len(f) < max {
+		return f, false, nil
+	}
+	// Remove end
+	f = f[:len(f)-1]
+	return f, true, nil
+}
+
+// feedEntries reads the entries an iterator returns, with their download counts
+// and latest version flags
+func (fs *fileStoreGCP) feedEntries(ctx context.Context, iter *firestore.DocumentIterator) ([]*NugetPackageEntry, error) {
+	// Create new empty feed
+	var f []*NugetPackageEntry
+	// Create map of extra details so only looked up once per id
+	extras := make(map[string]*packagesExtra)
 	// Cycle Iterator
 	for {
 		// Get next
@@ -244,70 +459,129 @@ func (fs *fileStoreGCP) GetPackageFeedEntries(id string, startAfter string, max
 			break
 		}
 		if err != nil {
-			return nil, false, err
+			return nil, err
 		}
 		// Cast document into structure
-		var e *NugetPackageEntry
-		if err := doc.DataTo(&e); err != nil {
-			return nil, false, err
+		e, err := packageEntry(doc)
+		if err != nil {
+			return nil, err
 		}
 		// Get extras if not in map already
 		if _, ok := extras[e.Properties.ID]; !ok {
-			extra, err := fs.getPackageExtras(e.Properties.ID)
+			extra, err := fs.getPackageExtras(ctx, e.Properties.ID)
 			if err != nil {
-				return nil, false, err
+				return nil, err
 			}
 			extras[e.Properties.ID] = extra
 		}
 		// Add extra details to entry
+		e.Properties.Listed = BoolProp{Value: true, Type: "Edm.Boolean"}
+		e.Properties.DevelopmentDependency.Type = "Edm.Boolean"
 		e.Properties.DownloadCount.Value = extras[e.Properties.ID].Downloads
-		e.Properties.IsLatestVersion.Value = extras[e.Properties.ID].Latest == e.Properties.Version
-		e.Properties.IsAbsoluteLatestVersion.Value = extras[e.Properties.ID].Latest == e.Properties.Version
+		l := extras[e.Properties.ID].latest()
+		e.Properties.IsLatestVersion.Value = l != "" && versions.Equal(l, e.Properties.Version)
+		e.Properties.IsAbsoluteLatestVersion.Value = versions.Equal(extras[e.Properties.ID].Latest, e.Properties.Version)
 		// Add in to list
 		f = append(f, e)
 	}
-
-	// Check array has no more
-	if len(f) < max {
-		return f, false, nil
-	}
-	// Remove end
-	f = f[:len(f)-1]
-	return f, true, nil
+	return f, nil
 }
 
-func (fs *fileStoreGCP) GetPackageFile(id string, ver string) ([]byte, string, error) {
-
-	// Set the filename
-	key := id + "." + ver
+// GetPackageFile reads a version's nupkg from the bucket whole, as serving ranges
+// needs to seek. Put the package cache in front to stream downloads from disk.
+func (fs *fileStoreGCP) GetPackageFile(ctx context.Context, id string, ver string) (*packageFile, error) {
 
 	// Get the file
-	b, _, err := fs.GetFile(path.Join(id, ver, key+".nupkg"))
+	b, err := fs.readPackage(ctx, id, ver)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	// Increment this verson's download count
-	_, err = fs.firestore.Collection("Nuget-Packages").Doc(key).Update(fs.ctx, []firestore.Update{
-		{Path: "Properties.VersionDownloadCount.Value", Value: firestore.Increment(1)},
-	})
-	if err != nil {
-		return nil, "", err
+	// Return it
+	return bytesPackageFile(b, time.Time{}, "binary/octet-stream"), nil
+}
+
+// GetPackageStorage describes where a version's nupkg and extracted content are in the bucket
+func (fs *fileStoreGCP) GetPackageStorage(ctx context.Context, id string, ver string) (*packageStorage, error) {
+	for _, v := range versionForms(ver) {
+		ps, err := fs.packageStorageAt(ctx, id, v)
+		if err == ErrFileNotFound {
+			continue
+		}
+		return ps, err
 	}
+	return nil, ErrFileNotFound
+}
 
-	// Increment this ID's download count
-	_, err = fs.firestore.Collection("Nuget-Packages-Extra").Doc(id).Update(fs.ctx, []firestore.Update{
-		{Path: "Downloads", Value: firestore.Increment(1)},
-	})
-	if err != nil {
-		return nil, "", err
+// packageStorageAt describes a version's objects in the bucket with the version
+// written as given
+func (fs *fileStoreGCP) packageStorageAt(ctx context.Context, id string, ver string) (*packageStorage, error) {
+	prefix := path.Join(id, ver) + "/"
+	nupkg := prefix + id + "." + ver + ".nupkg"
+
+	ps := &packageStorage{}
+	it := fs.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		a, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if a.Name == nupkg {
+			ps.Package = "gs://" + a.Bucket + "/" + a.Name
+			ps.PackageSize = a.Size
+			ps.ContentDir = "gs://" + a.Bucket + "/" + prefix
+			continue
+		}
+		ps.ContentFiles++
+		ps.ContentSize += a.Size
+	}
+	if ps.Package == "" {
+		return nil, ErrFileNotFound
 	}
+	return ps, nil
+}
 
-	// Return it
-	return b, "binary/octet-stream", nil
+// AddDownloads adds aggregated download counts, keyed {id}/{version}
+func (fs *fileStoreGCP) AddDownloads(ctx context.Context, counts map[string]int) error {
+	for k, n := range counts {
+		x := strings.SplitN(k, "/", 2)
+		if len(x) != 2 {
+			continue
+		}
+
+		// Increment this verson's download count
+		d, err := fs.packageDoc(ctx, x[0], x[1])
+		if err == ErrFileNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		_, err = d.Ref.Update(ctx, []firestore.Update{
+			{Path: "Properties.VersionDownloadCount.Value", Value: firestore.Increment(n)},
+		})
+		if err != nil {
+			return err
+		}
+
+		// Increment this ID's download count
+		_, err = fs.firestore.Collection("Nuget-Packages-Extra").Doc(x[0]).Update(ctx, []firestore.Update{
+			{Path: "Downloads", Value: firestore.Increment(n)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPackageFile returns a nupkg without counting it as a download
+func (fs *fileStoreGCP) ReadPackageFile(ctx context.Context, id string, ver string) ([]byte, error) {
+	return fs.readPackage(ctx, id, ver)
 }
 
-func (fs *fileStoreGCP) GetFile(f string) ([]byte, string, error) {
+func (fs *fileStoreGCP) GetFile(ctx context.Context, f string) ([]byte, string, error) {
 
 	if strings.HasPrefix(f, `/`) {
 		f = f[1:]
@@ -315,14 +589,14 @@ func (fs *fileStoreGCP) GetFile(f string) ([]byte, string, error) {
 
 	// Check for exact match
 	obj := fs.bucket.Object(f)
-	a, err := obj.Attrs(fs.ctx)
+	a, err := obj.Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
 		// Check for lowercase filename match (Due to zip file not keeping cases)
 		d := path.Dir(f)
 		fn := path.Base(f)
 		fp := path.Join(d, strings.ToLower(fn))
 		obj = fs.bucket.Object(fp)
-		_, err = obj.Attrs(fs.ctx)
+		_, err = obj.Attrs(ctx)
 		if err == storage.ErrObjectNotExist {
 			// ToDo: Full loop of directory contents on ToLower comparison of full
 			// path looking for match
@@ -334,7 +608,7 @@ func (fs *fileStoreGCP) GetFile(f string) ([]byte, string, error) {
 		return nil, "", err
 	}
 
-	r, err := obj.NewReader(fs.ctx)
+	r, err := obj.NewReader(ctx)
 	if err != nil {
 		return nil, "", err
 	}
@@ -353,7 +627,7 @@ type FirestoreAPIKey struct {
 	Access    string
 }
 
-func (fs *fileStoreGCP) GetAccessLevel(key string) (access, error) {
+func (fs *fileStoreGCP) GetAccessLevel(ctx context.Context, key string) (access, error) {
 
 	// Set default variables
 	var err error
@@ -361,7 +635,7 @@ func (fs *fileStoreGCP) GetAccessLevel(key string) (access, error) {
 	var iter *firestore.DocumentIterator
 
 	// Check for case where no ReadOnly keys are in place
-	iter = fs.firestore.Collection("Nuget-APIKeys").Where("Access", "==", "ReadOnly").Documents(fs.ctx)
+	iter = fs.firestore.Collection("Nuget-APIKeys").Where("Access", "==", "ReadOnly").Documents(ctx)
 	_, err = iter.Next()
 	// Attempt to advance to first in the list
 	if err == iterator.Done {
@@ -373,7 +647,7 @@ func (fs *fileStoreGCP) GetAccessLevel(key string) (access, error) {
 	}
 
 	// Check for case where no keys are declared yet - dev mode
-	iter = fs.firestore.Collection("Nuget-APIKeys").Documents(fs.ctx)
+	iter = fs.firestore.Collection("Nuget-APIKeys").Documents(ctx)
 	_, err = iter.Next()
 	// Attempt to advance to first in the list
 	if err == iterator.Done {
@@ -386,7 +660,7 @@ func (fs *fileStoreGCP) GetAccessLevel(key string) (access, error) {
 
 	// Get specific APIKey entry
 	k := FirestoreAPIKey{}
-	d, err := fs.firestore.Collection("Nuget-APIKeys").Doc(key).Get(fs.ctx)
+	d, err := fs.firestore.Collection("Nuget-APIKeys").Doc(key).Get(ctx)
 	if err != nil {
 		return a, nil
 	}
@@ -404,3 +678,123 @@ func (fs *fileStoreGCP) GetAccessLevel(key string) (access, error) {
 	// Deny access if not
 	return a, nil
 }
+
+// firestoreSetting is a named server setting, kept as its JSON
+type firestoreSetting struct {
+	Value string
+}
+
+func (fs *fileStoreGCP) GetSetting(ctx context.Context, name string) ([]byte, error) {
+	d, err := fs.firestore.Collection("Nuget-Settings").Doc(name).Get(ctx)
+	if grpc.Code(err) == codes.NotFound {
+		return nil, ErrFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	s := firestoreSetting{}
+	if err := d.DataTo(&s); err != nil {
+		return nil, err
+	}
+	return []byte(s.Value), nil
+}
+
+func (fs *fileStoreGCP) PutSetting(ctx context.Context, name string, b []byte) error {
+	_, err := fs.firestore.Collection("Nuget-Settings").Doc(name).Set(ctx, firestoreSetting{Value: string(b)})
+	return err
+}
+
+// SetPinnedVersion pins the version flagged IsLatestVersion for an id, or clears
+// the pin if ver is empty
+func (fs *fileStoreGCP) SetPinnedVersion(ctx context.Context, id string, ver string) error {
+	_, err := fs.firestore.Collection("Nuget-Packages-Extra").Doc(id).Set(ctx,
+		map[string]interface{}{"Pinned": ver},
+		firestore.Merge([]string{"Pinned"}),
+	)
+	return err
+}
+
+// GetPackageVersions returns every version stored for an id, oldest first, or
+// ErrFileNotFound if there are none
+func (fs *fileStoreGCP) GetPackageVersions(ctx context.Context, id string) ([]string, error) {
+	var list []string
+	iter := fs.firestore.Collection("Nuget-Packages").Where("Properties.IDLowerCase", "==", strings.ToLower(id)).Documents(ctx)
+	for {
+		d, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		e, err := packageEntry(d)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e.Properties.Version)
+	}
+	if len(list) == 0 {
+		return nil, ErrFileNotFound
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return versions.Compare(list[i], list[j]) < 0
+	})
+	return list, nil
+}
+
+func (fs *fileStoreGCP) GetPinnedVersions(ctx context.Context) (map[string]string, error) {
+	pins := make(map[string]string)
+	iter := fs.firestore.Collection("Nuget-Packages-Extra").Where("Pinned", ">", "").Documents(ctx)
+	for {
+		d, err := iter.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var pe *packagesExtra
+		if err := d.DataTo(&pe); err != nil {
+			return nil, err
+		}
+		pins[strings.ToLower(d.Ref.ID)] = pe.Pinned
+	}
+	return pins, nil
+}
+
+// GetNuspec returns a version's root .nuspec, read from the nupkg stored under the
+// ID and version as pushed
+func (fs *fileStoreGCP) GetNuspec(ctx context.Context, id string, ver string) ([]byte, error) {
+	iter := fs.firestore.Collection("Nuget-Packages").Where("Properties.IDLowerCase", "==", strings.ToLower(id)).Documents(ctx)
+	for {
+		d, err := iter.Next()
+		if err == iterator.Done {
+			return nil, ErrFileNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		e, err := packageEntry(d)
+		if err != nil {
+			return nil, err
+		}
+		if versions.Equal(e.Properties.Version, ver) {
+			pkg, err := fs.ReadPackageFile(ctx, e.Properties.ID, e.Properties.Version)
+			if err != nil {
+				return nil, err
+			}
+			return readNuspecFile(pkg)
+		}
+	}
+}
+
+// StoreSymbolPackage isn't supported on GCP, symbols are only kept by the local store
+func (fs *fileStoreGCP) StoreSymbolPackage(ctx context.Context, id string, ver string, pkg []byte) error {
+	return ErrNotSupported
+}
+
+// GetSymbolPackage isn't supported on GCP
+func (fs *fileStoreGCP) GetSymbolPackage(ctx context.Context, id string, ver string) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+// GetSymbolFile isn't supported on GCP
+func (fs *fileStoreGCP) GetSymbolFile(ctx context.Context, pdbName string, signature string) ([]byte, string, error) {
+	return nil, "", ErrNotSupported
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatestVersions(t *testing.T) {
+	for _, tc := range []struct {
+		list           []string
+		latest, stable string
+	}{
+		{[]string{"1.0.0", "1.0.0-rc.1", "1.0.0-rc.10", "1.1.0-beta"}, "1.1.0-beta", "1.0.0"},
+		{[]string{"1.9.0", "1.10.0", "1.2.0"}, "1.10.0", "1.10.0"},
+		{[]string{"1.0.0-beta.2", "1.0.0-beta.10"}, "1.0.0-beta.10", ""},
+		{[]string{"2.0", "1.0.0"}, "2.0", "2.0"},
+		{nil, "", ""},
+	} {
+		latest, stable := latestVersions(tc.list)
+		if latest != tc.latest || stable != tc.stable {
+			t.Errorf("latestVersions(%q) = %q, %q, want %q, %q", tc.list, latest, stable, tc.latest, tc.stable)
+		}
+	}
+}
+
+func TestPackagesExtraLatest(t *testing.T) {
+	for _, tc := range []struct {
+		pe   packagesExtra
+		want string
+	}{
+		{packagesExtra{Latest: "1.1.0-beta", Stable: "1.0.0"}, "1.0.0"},
+		{packagesExtra{Latest: "1.1.0-beta", Stable: "1.0.0", Pinned: "0.9.0"}, "0.9.0"},
+		{packagesExtra{Latest: "1.1.0-beta"}, ""},
+		// Written before Stable was kept
+		{packagesExtra{Latest: "1.1.0"}, "1.1.0"},
+	} {
+		if got := tc.pe.latest(); got != tc.want {
+			t.Errorf("%+v: latest() = %q, want %q", tc.pe, got, tc.want)
+		}
+	}
+}
+
+func TestLegacyPackageEntry(t *testing.T) {
+	published := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+	for name, stamp := range map[string]interface{}{
+		"string": "2019-05-06T07:08:09Z",
+		"time":   published,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// As DocumentSnapshot.Data returns it
+			data := map[string]interface{}{
+				"Updated": stamp,
+				"Properties": map[string]interface{}{
+					"ID":              "Old.Pkg",
+					"Version":         "1.0.0",
+					"Created":         map[string]interface{}{"Value": stamp, "Type": "Edm.DateTime"},
+					"LastEdited":      map[string]interface{}{"Value": "", "Type": "Edm.DateTime"},
+					"Published":       map[string]interface{}{"Value": stamp, "Type": "Edm.DateTime"},
+					"DownloadCount":   map[string]interface{}{"Value": int64(12), "Type": "Edm.Int32"},
+					"IsLatestVersion": map[string]interface{}{"Value": true, "Type": "Edm.Boolean"},
+				},
+			}
+			if name == "time" {
+				data["Updated"] = map[string]interface{}{"Value": stamp, "Type": ""}
+			}
+			npe, err := legacyPackageEntry(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := npe.Properties
+			if p.ID != "Old.Pkg" || p.DownloadCount.Value != 12 || !p.IsLatestVersion.Value || p.Published.Type != "Edm.DateTime" {
+				t.Errorf("got %+v", p)
+			}
+			for what, got := range map[string]time.Time{
+				"Updated":   npe.Updated.Value,
+				"Created":   p.Created.Value,
+				"Published": p.Published.Value,
+			} {
+				if !got.Equal(published) {
+					t.Errorf("%s = %v, want %v", what, got, published)
+				}
+			}
+			if !p.LastEdited.Value.IsZero() {
+				t.Errorf("LastEdited = %v, want unset", p.LastEdited.Value)
+			}
+		})
+	}
+}
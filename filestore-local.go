@@ -3,39 +3,61 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/sha512"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
-	"fmt"
-	"mime"
-	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	nuspec "github.com/soloworks/go-nuspec"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
 )
 
 type fileStoreLocal struct {
-	rootDir  string
-	packages []*NugetPackageEntry
+	extractions    uint64 // content extractions done, accessed atomically, kept first for alignment
+	rootDir        string
+	packages       []*NugetPackageEntry
 	downloadCounts map[string]int
-	countsPath string
-	server   *Server
-	lock	sync.RWMutex
+	countsPath     string
+	countsFrozen   bool
+	server         *Server
+	lock           sync.RWMutex
+	changes        *changeLog
+	intents        *intentLog
+	pins           map[string]string
+	lastChanged    time.Time
+	changedLock    sync.Mutex
+	shared         bool
+	extraction     map[string]*extractionStatus
+	extractionLock sync.Mutex
+	flat           bool
+	paths          map[string]string
+	pathsLock      sync.RWMutex
+	symbols        map[string]symbolEntry
+	symbolsLock    sync.Mutex
 }
 
-
 func (fs *fileStoreLocal) Init(s *Server) error {
 
 	// Set the Repo Path
 	fs.rootDir = s.config.FileStore.RepoDIR
 	fs.server = s
+	fs.shared = s.config.FileStore.SharedStorage
+	fs.flat = s.config.FileStore.Layout == layoutFlat
+	fs.paths = make(map[string]string)
 
 	// Create the package folder if required
 	if _, err := os.Stat(fs.rootDir); os.IsNotExist(err) {
@@ -48,15 +70,34 @@ func (fs *fileStoreLocal) Init(s *Server) error {
 
 	// Load persisted download counts
 	if err := fs.LoadDownloadCounts(); err != nil {
-		log.Printf("Warning: could not load download counts: %v", err)
+		log.Printf("Error: could not load download counts: %v", err)
+	}
+
+	// Open the replica change log, it is started from the current state if new
+	var err error
+	fs.changes, err = openChangeLog(filepath.Join(fs.rootDir, "changes.jsonl"), s.config.FileStore.ChangeLogMaxRecords)
+	if err != nil {
+		return err
+	}
+	fresh := fs.changes.Empty()
+
+	// Finish or undo anything a crash interrupted before the packages are read
+	if err := fs.openIntents(!fresh); err != nil {
+		return err
 	}
 
 	// Refresh Packages
-	err := fs.RefeshPackages()
+	err = fs.RefeshPackages()
 	if err != nil {
 		return err
 	}
 
+	if fresh {
+		if err := fs.changes.Checkpoint(fs.packages); err != nil {
+			return err
+		}
+	}
+
 	// Sync download counts into in-memory packages
 	for _, p := range fs.packages {
 		key := fmt.Sprintf("%s/%s", p.Properties.ID, p.Properties.Version)
@@ -67,9 +108,21 @@ func (fs *fileStoreLocal) Init(s *Server) error {
 		}
 	}
 
+	// Pick up pushes and deletes made by other instances on shared storage
+	if fs.shared {
+		fs.markChanged(fs.sharedMarkerTime())
+		go fs.watchShared(s.config.FileStore.SharedSyncInterval)
+	}
+
 	return nil
 }
 
+// Component download count problems are reported under in statusz
+const downloadCountsComponent = "download-counts"
+
+// LoadDownloadCounts reads downloads.json. A corrupt file is moved aside, never to
+// be overwritten, and the counts recovered from the backup kept by saves, or the
+// last write if that was interrupted. The error returned says what was lost.
 func (fs *fileStoreLocal) LoadDownloadCounts() error {
 	fs.countsPath = filepath.Join(fs.rootDir, "downloads.json")
 	fs.downloadCounts = make(map[string]int)
@@ -81,84 +134,203 @@ func (fs *fileStoreLocal) LoadDownloadCounts() error {
 		}
 		return err
 	}
+	counts, err := parseDownloadCounts(data)
+	if err == nil {
+		fs.downloadCounts = counts
+		return nil
+	}
+
+	// Keep the corrupt file for inspection, under a name nothing writes to
+	aside, merr := moveAside(fs.countsPath)
+	if merr != nil {
+		// Saving would overwrite it, so counts are kept in memory only
+		fs.countsFrozen = true
+		msg := fmt.Sprintf("downloads.json is corrupt (%v) and could not be moved aside, counts won't be saved: %v", err, merr)
+		fs.server.health.Degrade(downloadCountsComponent, msg)
+		return errors.New(msg)
+	}
+
+	// The newest readable of the backup and an interrupted save
+	var from string
+	var fromTime time.Time
+	for _, p := range []string{fs.countsPath + ".bak", fs.countsPath + ".tmp"} {
+		counts, rerr := readDownloadCounts(p)
+		f, serr := os.Stat(p)
+		if rerr == nil && serr == nil && (from == "" || f.ModTime().After(fromTime)) {
+			fs.downloadCounts, from, fromTime = counts, p, f.ModTime()
+		}
+	}
+	if from != "" {
+		msg := fmt.Sprintf("downloads.json was corrupt (%v), moved to %s and counts recovered from %s", err, filepath.Base(aside), filepath.Base(from))
+		fs.server.health.Degrade(downloadCountsComponent, msg)
+		return errors.New(msg)
+	}
+	msg := fmt.Sprintf("downloads.json was corrupt (%v) and moved to %s, no backup could be read so counts start from zero", err, filepath.Base(aside))
+	fs.server.health.Degrade(downloadCountsComponent, msg)
+	return errors.New(msg)
+}
+
+// readDownloadCounts reads a download counts file
+func readDownloadCounts(p string) (map[string]int, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return parseDownloadCounts(data)
+}
+
+// parseDownloadCounts parses download counts, a truncated or empty file being an error
+func parseDownloadCounts(data []byte) (map[string]int, error) {
+	counts := make(map[string]int)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.New("file is empty")
+	}
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
 
-	return json.Unmarshal(data, &fs.downloadCounts)
+// moveAside renames a file to a timestamped name no other file has, returning it
+func moveAside(p string) (string, error) {
+	base := p + ".corrupt-" + time.Now().UTC().Format("20060102T150405Z")
+	aside := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(aside); os.IsNotExist(err) {
+			break
+		}
+		aside = base + "-" + strconv.Itoa(i)
+	}
+	return aside, os.Rename(p, aside)
 }
 
+// SaveDownloadCounts writes downloads.json, keeping the file it replaces as
+// downloads.json.bak so there's always a known good copy to recover from
 func (fs *fileStoreLocal) SaveDownloadCounts() error {
+	if fs.countsFrozen {
+		return errors.New("downloads.json is corrupt and was not moved aside, see statusz")
+	}
 	data, err := json.MarshalIndent(fs.downloadCounts, "", "  ")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(fs.countsPath, data, 0644)
+	// Write then rename so readers never see a partial file
+	tmp := fs.countsPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if _, err := readDownloadCounts(fs.countsPath); err == nil {
+		bak := fs.countsPath + ".bak"
+		os.Remove(bak)
+		if err := os.Link(fs.countsPath, bak); err != nil {
+			log.Println("Warning: could not back up download counts:", err)
+		}
+	}
+	return os.Rename(tmp, fs.countsPath)
 }
 
 func (fs *fileStoreLocal) UpdateCountsInMemory() {
-    for _, p := range fs.packages {
-        key := fmt.Sprintf("%s/%s", p.Properties.ID, p.Properties.Version)
-        if val, ok := fs.downloadCounts[key]; ok {
-            p.Properties.VersionDownloadCount.Value = val
-        } else {
-            p.Properties.VersionDownloadCount.Value = 0
-        }
-    }
+	// Left to the next read if the store is busy, which will then answer 503 itself
+	if err := fs.readLock(context.Background(), true); err != nil {
+		return
+	}
+	defer fs.lock.Unlock()
+	for _, p := range fs.packages {
+		key := fmt.Sprintf("%s/%s", p.Properties.ID, p.Properties.Version)
+		if val, ok := fs.downloadCounts[key]; ok {
+			p.Properties.VersionDownloadCount.Value = val
+		} else {
+			p.Properties.VersionDownloadCount.Value = 0
+		}
+	}
 }
 
+// RecalculateLatestVersions flags the latest versions of each package. Only listed
+// versions qualify: IsLatestVersion goes to the highest listed stable version (if
+// there is one) and IsAbsoluteLatestVersion to the highest listed version overall.
+// A listed version pinned with SetPinnedVersion takes IsLatestVersion instead.
 func (fs *fileStoreLocal) RecalculateLatestVersions() {
-    // Map package ID to the highest version found
-    latestVersions := make(map[string]string)
-    
-    // First pass: find highest version per package ID
-    for _, p := range fs.packages {
-        currentLatest, exists := latestVersions[p.Properties.ID]
-        if !exists || compareVersions(p.Properties.Version, currentLatest) > 0 {
-            latestVersions[p.Properties.ID] = p.Properties.Version
-        }
-    }
-    
-    // Second pass: mark packages accordingly
-    for _, p := range fs.packages {
-        latestVersion := latestVersions[p.Properties.ID]
-        isLatest := compareVersions(p.Properties.Version, latestVersion) == 0
-        p.Properties.IsLatestVersion = BoolProp{Value: isLatest, Type: "Edm.Boolean"}
-        p.Properties.IsAbsoluteLatestVersion = BoolProp{Value: isLatest, Type: "Edm.Boolean"}
-    }
+	latest := make(map[string]*NugetPackageEntry)
+	absolute := make(map[string]*NugetPackageEntry)
+	pinned := make(map[string]*NugetPackageEntry)
+
+	// First pass: find the highest listed versions per package ID
+	for _, p := range fs.packages {
+		if !p.Properties.Listed.Value {
+			continue
+		}
+		id := strings.ToLower(p.Properties.ID)
+		if a, ok := absolute[id]; !ok || versions.Compare(p.Properties.Version, a.Properties.Version) > 0 {
+			absolute[id] = p
+		}
+		if v, ok := fs.pins[id]; ok && versions.Equal(v, p.Properties.Version) {
+			pinned[id] = p
+		}
+		if p.Properties.IsPrerelease.Value {
+			continue
+		}
+		if l, ok := latest[id]; !ok || versions.Compare(p.Properties.Version, l.Properties.Version) > 0 {
+			latest[id] = p
+		}
+	}
+
+	for id, p := range pinned {
+		latest[id] = p
+	}
+
+	// Second pass: mark packages accordingly
+	for _, p := range fs.packages {
+		id := strings.ToLower(p.Properties.ID)
+		p.Properties.IsLatestVersion = BoolProp{Value: latest[id] == p, Type: "Edm.Boolean"}
+		p.Properties.IsAbsoluteLatestVersion = BoolProp{Value: absolute[id] == p, Type: "Edm.Boolean"}
+	}
 }
 
+// Reindex reads every package from disk again, along with the download counts,
+// picking up any changed outside the server, and returns how many were found
+func (fs *fileStoreLocal) Reindex(ctx context.Context) (int, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
 
-func (fs *fileStoreLocal) RefeshPackages() error {
+	fs.packages = nil
+	fs.resetPaths()
+	if err := fs.LoadDownloadCounts(); err != nil {
+		log.Printf("Error: could not load download counts: %v", err)
+	}
+	if err := fs.RefeshPackages(); err != nil {
+		return 0, err
+	}
+	fs.markChanged(time.Now().UTC())
+	return len(fs.packages), nil
+}
 
-	// Read in all files in directory root
-	IDs, err := ioutil.ReadDir(fs.rootDir)
+func (fs *fileStoreLocal) RefeshPackages() error {
+	pkgs, err := fs.diskPackages()
 	if err != nil {
 		return err
 	}
-
-	// Loop through all directories (first level is lowercase IDs)
-	for _, ID := range IDs {
-		if ID.IsDir() {
-			Vers, err := ioutil.ReadDir(filepath.Join(fs.rootDir, ID.Name()))
-			if err != nil {
-				return err
-			}
-			for _, Ver := range Vers {
-				if Ver.IsDir() {
-					fp := filepath.Join(fs.rootDir, ID.Name(), Ver.Name(), ID.Name()+"."+Ver.Name()+".nupkg")
-					if _, err := os.Stat(fp); os.IsNotExist(err) {
-						log.Println("Not a nupkg directory")
-						break
-					}
-					err = fs.LoadPackage(fp)
-					if err != nil {
-						log.Println("Error: Cannot load package")
-						log.Println(err)
-						break
-					}
-				}
-			}
+	op := fs.server.operations.Start("reindex", len(pkgs))
+	defer op.Finish()
+
+	// A package that can't be loaded is left out, and verify reports it
+	for _, p := range pkgs {
+		op.Step()
+		if p.missing {
+			log.Println("Not a nupkg directory", filepath.Dir(p.path))
+			continue
+		}
+		if err := fs.LoadPackage(p.path); err != nil {
+			log.Println("Error: Cannot load package", p.path)
+			log.Println(err)
 		}
 	}
 
+	fs.packagesLoaded()
+	return nil
+}
+
+// packagesLoaded brings download counts and latest flags up to date after a refresh
+func (fs *fileStoreLocal) packagesLoaded() {
 	// Sync download counts into in-memory packages after loading all packages
 	for _, p := range fs.packages {
 		key := fmt.Sprintf("%s/%s", p.Properties.ID, p.Properties.Version)
@@ -170,46 +342,12 @@ func (fs *fileStoreLocal) RefeshPackages() error {
 	}
 
 	// Recalculate latest version flags once after all packages are loaded
-    fs.RecalculateLatestVersions()
+	fs.loadPins()
+	fs.loadSymbols()
+	fs.RecalculateLatestVersions()
+	invalidateSearchIndexes()
 
 	log.Printf("fs Loaded with %d Packages Found", len(fs.packages))
-
-	return nil
-}
-
-func compareVersions(v1, v2 string) int {
-    parse := func(v string) []int {
-        parts := strings.Split(v, ".")
-        nums := make([]int, len(parts))
-        for i, p := range parts {
-            n := 0
-            fmt.Sscanf(p, "%d", &n)
-            nums[i] = n
-        }
-        return nums
-    }
-    a := parse(v1)
-    b := parse(v2)
-    maxLen := len(a)
-    if len(b) > maxLen {
-        maxLen = len(b)
-    }
-    for i := 0; i < maxLen; i++ {
-        var x, y int
-        if i < len(a) {
-            x = a[i]
-        }
-        if i < len(b) {
-            y = b[i]
-        }
-        if x < y {
-            return -1
-        }
-        if x > y {
-            return 1
-        }
-    }
-    return 0
 }
 
 func (fs *fileStoreLocal) LoadPackage(fp string) error {
@@ -224,32 +362,45 @@ func (fs *fileStoreLocal) LoadPackage(fp string) error {
 		return err
 	}
 
-	// Extract .nuspec and file list using shared function
-	nsf, files, err := extractPackage(content)
+	// Only the nuspec is read here, content is extracted if it isn't already
+	nsf, err := readNuspec(content)
 	if err != nil {
-		return fmt.Errorf("failed to extract nupkg: %w", err)
+		return fmt.Errorf("failed to read nupkg: %w", err)
 	}
+	return fs.addPackage(fp, content, nsf, f.ModTime().UTC(), nil)
+}
 
-	if nsf == nil {
-		return fmt.Errorf("nuspec not found in nupkg")
+// addPackage indexes a stored nupkg and brings its content files up to date. files
+// are the package's unzipped files if the caller already has them. The lock must
+// be held.
+func (fs *fileStoreLocal) addPackage(fp string, content []byte, nsf *nuspec.NuSpec, modTime time.Time, files map[string][]byte) error {
+	// A flat directory can hold the same version under two file names, keep the first
+	if other, ok := fs.indexPath(nsf.Meta.ID, nsf.Meta.Version, fp); !ok {
+		log.Printf("Warning: Ignoring %s, %s %s is already loaded from %s", fp, nsf.Meta.ID, nsf.Meta.Version, other)
+		return nil
 	}
 
 	// Create NugetPackageEntry
 	p := NewNugetPackageEntry(nsf)
+	p.setNuspecDetails(content)
 	p.Content.Src = fs.server.URL.String() + "nupkg/" + nsf.Meta.ID + "/" + nsf.Meta.Version
 
 	// Set metadata timestamps
-	modTime := f.ModTime().Format(zuluTimeLayout)
 	p.Properties.Created.Value = modTime
 	p.Properties.LastEdited.Value = modTime
 	p.Properties.Published.Value = modTime
-	p.Updated = modTime
+	p.Updated.Value = modTime
+	if _, err := os.Stat(filepath.Join(fs.versionDir(nsf.Meta.ID, nsf.Meta.Version), unlistedMarkerName)); err == nil {
+		p.Properties.Listed.Value = false
+	}
+	fs.markChanged(modTime)
 
 	// Set hash and size
 	hash := sha512.Sum512(content)
 	p.Properties.PackageHash = hex.EncodeToString(hash[:])
 	p.Properties.PackageHashAlgorithm = `SHA512`
 	p.Properties.PackageSize.Value = len(content)
+	p.Properties.SupportedFrameworks = strings.Join(packageFrameworks(content), "|")
 	p.Properties.PackageSize.Type = "Edm.Int64"
 
 	// Insert into sorted list
@@ -259,50 +410,358 @@ func (fs *fileStoreLocal) LoadPackage(fp string) error {
 	copy(fs.packages[index+1:], fs.packages[index:])
 	fs.packages[index] = p
 
-	// Extract files that are inside "content/" in the nupkg to: <root>/<id>/<version>/content/
-	contentDir := filepath.Join(fs.rootDir, strings.ToLower(nsf.Meta.ID), nsf.Meta.Version, "content")
+	// Extract content files, a failure is recorded but the package is still served
+	fs.extractVersion(nsf.Meta.ID, nsf.Meta.Version, content, p.Properties.PackageHash, files)
 
-	for filePath, data := range files {
+	// Flag the latest versions
+	fs.RecalculateLatestVersions()
+
+	return nil
+}
+
+// Marker file in a version directory for versions hidden from listings
+const unlistedMarkerName = ".unlisted"
+
+// SetListed unlists or relists a stored version. Unlisted versions can still be
+// downloaded, they just can't be the latest version.
+func (fs *fileStoreLocal) SetListed(ctx context.Context, id string, ver string, listed bool) error {
+	// Serialise with other instances sharing the directory, and append after
+	// their changes
+	if fs.shared {
+		unlock, err := fs.lockShared()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if err := fs.changes.Reload(); err != nil {
+			return err
+		}
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	var p *NugetPackageEntry
+	for _, e := range fs.packages {
+		if strings.EqualFold(e.Properties.ID, id) && versions.Equal(e.Properties.Version, ver) {
+			p = e
+			break
+		}
+	}
+	if p == nil {
+		return ErrFileNotFound
+	}
+	if p.Properties.Listed.Value == listed {
+		return nil
+	}
+
+	kind, op := changeRelisted, intentRelist
+	if !listed {
+		kind, op = changeUnlisted, intentUnlist
+	}
+	token, err := fs.intents.Begin(intentRecord{Op: op, ID: p.Properties.ID, Version: p.Properties.Version, Path: fs.nupkgPath(p.Properties.ID, p.Properties.Version), Hash: p.Properties.PackageHash, Size: p.Properties.PackageSize.Value})
+	if err != nil {
+		return err
+	}
+	defer fs.intents.Done(token)
+
+	if err := fs.setListedMarker(p.Properties.ID, p.Properties.Version, listed); err != nil {
+		return err
+	}
+
+	p.Properties.Listed.Value = listed
+	fs.RecalculateLatestVersions()
+	fs.markChanged(time.Now().UTC())
+
+	if err := fs.changes.Append(kind, p.Properties.ID, p.Properties.Version, p.Properties.PackageHash, p.Properties.PackageSize.Value); err != nil {
+		log.Println("Error: Cannot record change", err)
+	}
+	if fs.shared {
+		fs.touchSharedMarker()
+	}
+	return nil
+}
+
+// Marker file in a version directory recording the package its content was
+// extracted from and how that went
+const extractedMarkerName = ".extracted"
+
+// extractedMarker is what a version's content was extracted from, so a start can
+// skip extracting it again, and the outcome, so a failure is still reported after
+// a restart. Markers written before the outcome was kept have no Status.
+type extractedMarker struct {
+	Hash        string    `json:"hash"`
+	Files       int       `json:"files"`
+	Precompress bool      `json:"precompress"`
+	Status      string    `json:"status,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// extractVersion brings a version's content files up to date with its package and
+// records the outcome. Content already extracted from the same package, with the
+// same precompression, is kept, and a failure recorded for the same package is
+// reported again rather than retried until it is re-extracted. files are the
+// package's unzipped files if the caller already has them.
+func (fs *fileStoreLocal) extractVersion(id string, ver string, pkg []byte, hash string, files map[string][]byte) *extractionStatus {
+	dir := fs.versionDir(id, ver)
+	precompress := fs.server.Config().FileStore.PrecompressContent
+	if files == nil {
+		var m extractedMarker
+		if b, err := ioutil.ReadFile(filepath.Join(dir, extractedMarkerName)); err == nil && json.Unmarshal(b, &m) == nil &&
+			m.Hash == hash && m.Precompress == precompress {
+			if m.Status == extractionFailed {
+				return fs.setExtractionStatus(&extractionStatus{ID: id, Version: ver, Status: m.Status, Error: m.Error, Time: m.Time})
+			}
+			if _, err := os.Stat(filepath.Join(dir, "content")); m.Files == 0 || err == nil {
+				st := newExtractionStatus(id, ver, m.Files, nil)
+				if !m.Time.IsZero() {
+					st.Time = m.Time
+				}
+				return fs.setExtractionStatus(st)
+			}
+		}
+		var err error
+		if _, files, err = extractPackage(pkg, extractionLimitsFor(fs.server.Config())); err != nil {
+			return fs.recordExtraction(hash, newExtractionStatus(id, ver, 0, err), 0)
+		}
+	}
+
+	n, err := fs.extractContent(id, ver, files)
+	return fs.recordExtraction(hash, newExtractionStatus(id, ver, n, err), n)
+}
+
+// recordExtraction keeps the outcome of extracting n files from the package with
+// the given hash, in its marker as well as in memory
+func (fs *fileStoreLocal) recordExtraction(hash string, st *extractionStatus, n int) *extractionStatus {
+	dir := fs.versionDir(st.ID, st.Version)
+	b, _ := json.Marshal(extractedMarker{
+		Hash:        hash,
+		Files:       n,
+		Precompress: fs.server.Config().FileStore.PrecompressContent,
+		Status:      st.Status,
+		Error:       st.Error,
+		Time:        st.Time,
+	})
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, extractedMarkerName), b, 0644)
+	}
+	if err != nil {
+		log.Println("Warning: Cannot record extraction of", st.ID, st.Version, err)
+	}
+	return fs.setExtractionStatus(st)
+}
+
+// extractContent writes the files inside "content/" in the nupkg to
+// <root>/<id>/<version>/content/ (.content/<id>/<version>/content/ in the flat
+// layout) and returns how many were written
+func (fs *fileStoreLocal) extractContent(id string, ver string, files map[string][]byte) (int, error) {
+	dir := fs.versionDir(id, ver)
+	contentDir := filepath.Join(dir, "content")
+
+	// Compressed copies are made again with the content
+	if err := os.RemoveAll(filepath.Join(dir, precompressedDirName)); err != nil {
+		return 0, fmt.Errorf("failed to remove compressed content: %w", err)
+	}
+
+	// Every file is checked before any is written, so a package with one that
+	// escapes the content directory extracts nothing
+	targets := make(map[string]string)
+	for filePath := range files {
 		if strings.HasPrefix(filePath, "content/") && !zipFileIsDirectory(filePath) {
 			// Remove all leading "content/" prefixes to avoid duplication
 			relPath := filePath
 			for strings.HasPrefix(relPath, "content/") {
 				relPath = strings.TrimPrefix(relPath, "content/")
 			}
-
 			targetPath := filepath.Join(contentDir, filepath.FromSlash(relPath))
+			if rel, err := filepath.Rel(contentDir, targetPath); err != nil || rel == "." || rel == ".." ||
+				strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+				return 0, fmt.Errorf("content file %s is outside the content directory", filePath)
+			}
+			targets[filePath] = relPath
+		}
+	}
 
+	atomic.AddUint64(&fs.extractions, 1)
+	n := 0
+	for filePath, data := range files {
+		if relPath, ok := targets[filePath]; ok {
+			targetPath := filepath.Join(contentDir, filepath.FromSlash(relPath))
 			if err := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); err != nil {
-				return fmt.Errorf("failed to create content directory: %w", err)
+				return n, fmt.Errorf("failed to create content directory: %w", err)
 			}
 			if err := ioutil.WriteFile(targetPath, data, 0644); err != nil {
-				return fmt.Errorf("failed to write content file: %w", err)
+				return n, fmt.Errorf("failed to write content file: %w", err)
 			}
+			fs.precompress(dir, path.Join("content", relPath), data)
+			n++
 		}
 	}
+	return n, nil
+}
 
-	// After extracting content files successfully
-	fs.RecalculateLatestVersions()
+// precompress writes a gzipped copy of an extracted file, named by its path under
+// the version's directory, if configured and worthwhile. Failing only costs
+// compressing on the fly, so it's logged rather than returned.
+func (fs *fileStoreLocal) precompress(dir string, name string, data []byte) {
+	config := fs.server.Config()
+	c := config.FileStore
+	if !c.PrecompressContent {
+		return
+	}
+	min := c.PrecompressMinBytes
+	if min <= 0 {
+		min = defaultPrecompressMinBytes
+	}
+	if len(data) < min || strings.EqualFold(path.Ext(name), ".gz") || !isCompressible(contentTypeIn(config, name, data)) {
+		return
+	}
+	gzPath := precompressedPath(dir, name)
+	gz, err := gzipBytes(data)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(gzPath), os.ModePerm)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(gzPath, gz, 0644)
+	}
+	if err != nil {
+		log.Println("Warning: Cannot precompress", name, "of", dir, err)
+	}
+}
 
-	return nil
+// newExtractionStatus returns the outcome of extracting n of a package's content
+// files
+func newExtractionStatus(id string, ver string, n int, err error) *extractionStatus {
+	st := &extractionStatus{ID: id, Version: ver, Status: extractionOK, Time: time.Now().UTC()}
+	if err != nil {
+		st.Status = extractionFailed
+		st.Error = err.Error()
+		log.Printf("Error: Cannot extract %s %s: %v", id, ver, err)
+	} else if n == 0 {
+		st.Status = extractionSkipped
+	}
+	return st
+}
+
+// setExtractionStatus keeps a package's extraction status for the admin API
+func (fs *fileStoreLocal) setExtractionStatus(st *extractionStatus) *extractionStatus {
+	fs.extractionLock.Lock()
+	defer fs.extractionLock.Unlock()
+	if fs.extraction == nil {
+		fs.extraction = make(map[string]*extractionStatus)
+	}
+	fs.extraction[versionKey(st.ID, st.Version)] = st
+	return st
+}
+
+func (fs *fileStoreLocal) GetExtractionStatus(ctx context.Context, id string, ver string) (*extractionStatus, error) {
+	fs.extractionLock.Lock()
+	defer fs.extractionLock.Unlock()
+	st, ok := fs.extraction[versionKey(id, ver)]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	return st, nil
+}
+
+func (fs *fileStoreLocal) GetExtractionStatuses(ctx context.Context) ([]*extractionStatus, error) {
+	fs.extractionLock.Lock()
+	defer fs.extractionLock.Unlock()
+	list := []*extractionStatus{}
+	for _, st := range fs.extraction {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].ID+"/"+list[i].Version) < strings.ToLower(list[j].ID+"/"+list[j].Version)
+	})
+	return list, nil
+}
+
+// ReextractPackage extracts a stored package's content files again
+func (fs *fileStoreLocal) ReextractPackage(ctx context.Context, id string, ver string) (*extractionStatus, error) {
+	pkg, err := fs.ReadPackageFile(ctx, id, ver)
+	if err != nil {
+		return nil, err
+	}
+	nsf, err := readNuspec(pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forget the earlier extraction so it's done again
+	os.Remove(filepath.Join(fs.versionDir(nsf.Meta.ID, nsf.Meta.Version), extractedMarkerName))
+	hash := sha512.Sum512(pkg)
+	return fs.extractVersion(nsf.Meta.ID, nsf.Meta.Version, pkg, hex.EncodeToString(hash[:]), nil), nil
+}
+
+// DeletePackage removes a stored version
+func (fs *fileStoreLocal) DeletePackage(ctx context.Context, id string, ver string) error {
+	npe, err := fs.GetPackageEntry(ctx, id, ver)
+	if err != nil {
+		return err
+	}
+	return fs.RemovePackage(npe.Filename())
 }
 
-func (fs *fileStoreLocal) RemovePackage(fn string) {
-    fs.lock.Lock()
-    defer fs.lock.Unlock()
+// RemovePackage deletes a stored version along with its content, markers and
+// download count. It is recorded in the intent log first so a crash part way
+// through is finished at the next start.
+func (fs *fileStoreLocal) RemovePackage(fn string) error {
+	// Serialise with other instances sharing the directory, and append after
+	// their changes
+	if fs.shared {
+		unlock, err := fs.lockShared()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if err := fs.changes.Reload(); err != nil {
+			return err
+		}
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
 
-    for i, p := range fs.packages {
-        if p.Filename() == fn {
-            fs.packages = append(fs.packages[:i], fs.packages[i+1:]...)
-            break
-        }
-    }
-    os.RemoveAll(filepath.Join(fs.rootDir, `content`, fn))
+	found := false
+	for i, p := range fs.packages {
+		if p.Filename() == fn {
+			ir := intentRecord{Op: intentRemove, ID: p.Properties.ID, Version: p.Properties.Version, Path: fs.nupkgPath(p.Properties.ID, p.Properties.Version), Hash: p.Properties.PackageHash, Size: p.Properties.PackageSize.Value}
+			token, err := fs.intents.Begin(ir)
+			if err != nil {
+				log.Println("Error: Cannot record intent", err)
+				return err
+			}
+			if err := fs.removeVersion(ir); err != nil {
+				// Left for recovery to finish
+				log.Println("Error: Cannot remove package", err)
+				return err
+			}
+			fs.packages = append(fs.packages[:i], fs.packages[i+1:]...)
+			fs.unindexPath(p.Properties.ID, p.Properties.Version)
+			if err := fs.changes.Append(changeRemoved, p.Properties.ID, p.Properties.Version, p.Properties.PackageHash, p.Properties.PackageSize.Value); err != nil {
+				log.Println("Error: Cannot record change", err)
+			}
+			fs.intents.Done(token)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrFileNotFound
+	}
+	fs.markChanged(time.Now().UTC())
+	if fs.shared {
+		fs.touchSharedMarker()
+	}
 
-    fs.RecalculateLatestVersions()
+	fs.RecalculateLatestVersions()
+	return nil
 }
 
-func (fs *fileStoreLocal) StorePackage(pkg []byte) (bool, error) {
+func (fs *fileStoreLocal) StorePackage(ctx context.Context, pkg []byte) (bool, error) {
 	// Open nupkg as zip reader
 	zipReader, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
 	if err != nil {
@@ -313,18 +772,12 @@ func (fs *fileStoreLocal) StorePackage(pkg []byte) (bool, error) {
 	// Find the .nuspec file
 	for _, zipFile := range zipReader.File {
 		if filepath.Ext(zipFile.Name) == ".nuspec" && filepath.Dir(zipFile.Name) == "." {
-			rc, err := zipFile.Open()
-			if err != nil {
-				return false, fmt.Errorf("error opening nuspec: %w", err)
-			}
-			defer rc.Close()
-
-			nuspecData, err := ioutil.ReadAll(rc)
+			nuspecData, err := readZipFile(zipFile, extractionLimitsFor(fs.server.Config()).MaxFileBytes)
 			if err != nil {
 				return false, fmt.Errorf("error reading nuspec: %w", err)
 			}
 
-			nsf, err = nuspec.FromBytes(nuspecData)
+			nsf, err = parseNuspec(nuspecData)
 			if err != nil {
 				return false, fmt.Errorf("error parsing nuspec: %w", err)
 			}
@@ -336,56 +789,90 @@ func (fs *fileStoreLocal) StorePackage(pkg []byte) (bool, error) {
 		return false, fmt.Errorf("nuspec file not found in package")
 	}
 
-	// Build the package path
+	if err := checkPackageIdentity(nsf.Meta.ID, nsf.Meta.Version); err != nil {
+		return false, err
+	}
+
+	// Refuse packages over the extraction limits before anything is written. The
+	// files are kept to extract once stored.
+	_, files, err := extractPackage(pkg, extractionLimitsFor(fs.server.Config()))
+	if err != nil {
+		return false, err
+	}
+
+	// Build the package path, under the normalized version so 1.0 and 1.0.0 are
+	// the same package
 	id := strings.ToLower(nsf.Meta.ID)
-	version := nsf.Meta.Version
-	packageDir := filepath.Join(fs.rootDir, id, version)
-	nupkgFilename := fmt.Sprintf("%s.%s.nupkg", id, version)
-	nupkgPath := filepath.Join(packageDir, nupkgFilename)
+	version := versions.Normalize(nsf.Meta.Version)
+	nupkgPath := fs.nupkgPath(id, version)
+	packageDir := filepath.Dir(nupkgPath)
+
+	// Serialise pushes with other instances sharing the directory
+	if fs.shared {
+		unlock, err := fs.lockShared()
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+		defer fs.touchSharedMarker()
+		if err := fs.changes.Reload(); err != nil {
+			return false, err
+		}
+	}
 
 	// Check if already exists
 	if _, err := os.Stat(nupkgPath); err == nil {
 		return false, fmt.Errorf("package already exists: %s", nupkgPath)
 	}
 
+	// Record the push so a crash before it reaches the change log is undone
+	hash := sha512.Sum512(pkg)
+	token, err := fs.intents.Begin(intentRecord{Op: intentStore, ID: nsf.Meta.ID, Version: version, Path: nupkgPath, Hash: hex.EncodeToString(hash[:]), Size: len(pkg)})
+	if err != nil {
+		return false, err
+	}
+	defer fs.intents.Done(token)
+
 	// Create directory
 	if err := os.MkdirAll(packageDir, os.ModePerm); err != nil {
 		return false, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	// Write the .nupkg file
-	if err := ioutil.WriteFile(nupkgPath, pkg, 0644); err != nil {
+	// Write the .nupkg file to a temp file and link it into place, which fails
+	// if a concurrent push of the same version got there first
+	tmp, err := ioutil.TempFile(packageDir, ".upload-")
+	if err != nil {
+		return false, fmt.Errorf("failed to write nupkg: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(pkg); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("failed to write nupkg: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("failed to write nupkg: %w", err)
+	}
+	if err := os.Link(tmp.Name(), nupkgPath); os.IsExist(err) {
+		return false, fmt.Errorf("package already exists: %s", nupkgPath)
+	} else if err != nil {
 		return false, fmt.Errorf("failed to write nupkg: %w", err)
 	}
 
-	// Load it into memory
-	if err := fs.LoadPackage(nupkgPath); err != nil {
+	// Load it into memory, only the push that created the file gets here
+	f, err := os.Stat(nupkgPath)
+	if err != nil {
 		return false, fmt.Errorf("failed to load package: %w", err)
 	}
-
-	// Extract content folder into the version directory
-	_, files, err := extractPackage(pkg)
+	fs.lock.Lock()
+	err = fs.addPackage(nupkgPath, pkg, nsf, f.ModTime().UTC(), files)
+	fs.lock.Unlock()
 	if err != nil {
-		return false, fmt.Errorf("failed to extract package: %w", err)
+		return false, fmt.Errorf("failed to load package: %w", err)
 	}
 
-	for filePath, data := range files {
-		if strings.HasPrefix(filePath, "content/") && !zipFileIsDirectory(filePath) {
-			relPath := filePath
-			// Strip all leading "content/" prefixes to avoid nesting
-			for strings.HasPrefix(relPath, "content/") {
-				relPath = strings.TrimPrefix(relPath, "content/")
-			}
-
-			destPath := filepath.Join(packageDir, "content", filepath.FromSlash(relPath))
-			destDir := filepath.Dir(destPath)
-			if err := os.MkdirAll(destDir, os.ModePerm); err != nil {
-				return false, fmt.Errorf("failed to create directory %s: %w", destDir, err)
-			}
-			if err := ioutil.WriteFile(destPath, data, 0644); err != nil {
-				return false, fmt.Errorf("failed to write file %s: %w", destPath, err)
-			}
-		}
+	// Record the change for replicas
+	if err := fs.changes.Append(changeAdded, nsf.Meta.ID, version, hex.EncodeToString(hash[:]), len(pkg)); err != nil {
+		log.Println("Error: Cannot record change", err)
 	}
 
 	log.Printf("Package stored: %s %s", id, version)
@@ -396,7 +883,12 @@ func zipFileIsDirectory(name string) bool {
 	return strings.HasSuffix(name, "/") || path.Ext(name) == ""
 }
 
-func (fs *fileStoreLocal) GetPackageEntry(id string, ver string) (*NugetPackageEntry, error) {
+func (fs *fileStoreLocal) GetPackageEntry(ctx context.Context, id string, ver string) (*NugetPackageEntry, error) {
+	if err := fs.readLock(ctx, false); err != nil {
+		return nil, err
+	}
+	defer fs.lock.RUnlock()
+
 	var match *NugetPackageEntry
 	totalDownloads := 0
 
@@ -406,7 +898,7 @@ func (fs *fileStoreLocal) GetPackageEntry(id string, ver string) (*NugetPackageE
 			totalDownloads += p.Properties.VersionDownloadCount.Value
 
 			// Match target version
-			if p.Properties.Version == ver {
+			if versions.Equal(p.Properties.Version, ver) {
 				match = p
 			}
 		}
@@ -414,18 +906,21 @@ func (fs *fileStoreLocal) GetPackageEntry(id string, ver string) (*NugetPackageE
 
 	// If not found, return error to trigger 404 upstream
 	if match == nil {
-		return nil, fmt.Errorf("package not found")
+		return nil, ErrFileNotFound
 	}
 
-	// Update values like GCP does
-	match.Properties.DownloadCount.Value = totalDownloads
+	// Update values like GCP does, on a copy as other requests share the entry
+	c := *match
+	c.Properties.DownloadCount.Value = totalDownloads
 
-	return match, nil
+	return &c, nil
 }
 
-func (fs *fileStoreLocal) GetPackageFeedEntries(id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+func (fs *fileStoreLocal) GetPackageFeedEntries(ctx context.Context, id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+	if err := fs.readLock(ctx, false); err != nil {
+		return nil, false, err
+	}
+	defer fs.lock.RUnlock()
 
 	// Aggregate total downloads per package ID
 	downloadTotals := make(map[string]int)
@@ -437,109 +932,144 @@ func (fs *fileStoreLocal) GetPackageFeedEntries(id string, startAfter string, ma
 	}
 
 	var packages []*NugetPackageEntry
-	for _, p := range fs.packages {
-		// Update per-version download count
-		key := fmt.Sprintf("%s/%s", p.Properties.ID, p.Properties.Version)
-		if count, ok := fs.downloadCounts[key]; ok {
-			p.Properties.VersionDownloadCount.Value = count
-		} else {
-			p.Properties.VersionDownloadCount.Value = 0
-		}
-
-		// Set total download count per package ID
-		if total, ok := downloadTotals[p.Properties.ID]; ok {
-			p.Properties.DownloadCount.Value = total
-		} else {
-			p.Properties.DownloadCount.Value = 0
-		}
-
+	for _, e := range fs.packages {
 		// Filter by ID if specified
-		if id != "" && p.Properties.ID != id {
+		if id != "" && !strings.EqualFold(e.Properties.ID, id) {
 			continue
 		}
 
-		packages = append(packages, p)
-	}
-
-	// Sort packages by published date descending (newest first)
-	sort.Slice(packages, func(i, j int) bool {
-		ti, err1 := time.Parse(time.RFC3339, packages[i].Properties.Published.Value)
-		tj, err2 := time.Parse(time.RFC3339, packages[j].Properties.Published.Value)
-		if err1 != nil || err2 != nil {
-			// If parsing fails, keep original order
-			return false
-		}
-		return tj.Before(ti)
-	})
+		// The counts are set on a copy as other requests share the entry
+		p := *e
+		key := fmt.Sprintf("%s/%s", p.Properties.ID, p.Properties.Version)
+		p.Properties.VersionDownloadCount.Value = fs.downloadCounts[key]
+		p.Properties.DownloadCount.Value = downloadTotals[p.Properties.ID]
 
-	// Pagination logic
-	start := 0
-	if startAfter != "" {
-		for i, p := range packages {
-			if p.Properties.ID+"/"+p.Properties.Version == startAfter {
-				start = i + 1
-				break
-			}
-		}
+		packages = append(packages, &p)
 	}
 
-	end := start + max
-	if end > len(packages) {
-		end = len(packages)
-	}
+	// Sort packages as the request asks, by default newest published first
+	sortFeedEntries(packages, contextFeedOrder(ctx))
 
-	hasMore := end < len(packages)
+	return pageFeedEntries(packages, startAfter, max)
+}
 
-	return packages[start:end], hasMore, nil
+// GetPackageFile opens a version's nupkg where it is stored, so a download is
+// streamed from disk
+func (fs *fileStoreLocal) GetPackageFile(ctx context.Context, id string, ver string) (*packageFile, error) {
+	return openPackageFile(fs.nupkgPath(id, ver), "application/octet-stream")
 }
 
-func (fs *fileStoreLocal) GetPackageFile(id string, ver string) ([]byte, string, error) {
-	// Construct full path to nupkg file
-	filename := filepath.Join(fs.rootDir, id, ver, fmt.Sprintf("%s.%s.nupkg", id, ver))
+// GetPackageStorage describes where a version's nupkg and extracted content are on
+// disk. Markers such as .unlisted aren't counted as content.
+func (fs *fileStoreLocal) GetPackageStorage(ctx context.Context, id string, ver string) (*packageStorage, error) {
+	np := fs.nupkgPath(id, ver)
+	fi, err := os.Stat(np)
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
 
-	content, err := ioutil.ReadFile(filename)
-	if err != nil {
+	ps := &packageStorage{PackageSize: fi.Size()}
+	if ps.Package, err = filepath.Abs(np); err != nil {
+		return nil, err
+	}
+	dir := fs.versionDir(id, ver)
+	if ps.ContentDir, err = filepath.Abs(dir); err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
 		if os.IsNotExist(err) {
-			return nil, "", ErrFileNotFound
+			return nil
+		} else if err != nil {
+			return err
 		}
-		return nil, "", err
+		if fi.IsDir() || p == np || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		ps.ContentFiles++
+		ps.ContentSize += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return ps, nil
+}
 
-	key := fmt.Sprintf("%s/%s", id, ver)
-	fs.downloadCounts[key]++
-	_ = fs.SaveDownloadCounts() // Optional: handle error or debounce
+// AddDownloads adds aggregated download counts, keyed {id}/{version} in any case
+func (fs *fileStoreLocal) AddDownloads(ctx context.Context, counts map[string]int) error {
+	// Other instances count downloads too, so add to the latest counts on disk
+	if fs.shared {
+		unlock, err := fs.lockShared()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
 
-	for _, p := range fs.packages {
-		if strings.EqualFold(p.Properties.ID, id) && p.Properties.Version == ver {
-			p.Properties.VersionDownloadCount.Value = fs.downloadCounts[key]
-			break
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.shared {
+		if err := fs.LoadDownloadCounts(); err != nil {
+			return err
 		}
 	}
 
-	return content, "application/octet-stream", nil
+	for k, n := range counts {
+		x := strings.SplitN(k, "/", 2)
+		if len(x) != 2 {
+			continue
+		}
+		for _, p := range fs.packages {
+			if strings.EqualFold(p.Properties.ID, x[0]) && versions.Equal(p.Properties.Version, x[1]) {
+				key := fmt.Sprintf("%s/%s", p.Properties.ID, p.Properties.Version)
+				fs.downloadCounts[key] += n
+				p.Properties.VersionDownloadCount.Value = fs.downloadCounts[key]
+				break
+			}
+		}
+	}
+	return fs.SaveDownloadCounts()
 }
 
+// ReadPackageFile returns a nupkg without counting it as a download
+func (fs *fileStoreLocal) ReadPackageFile(ctx context.Context, id string, ver string) ([]byte, error) {
+	content, err := ioutil.ReadFile(fs.nupkgPath(id, ver))
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+	return content, err
+}
 
-
-func (fs *fileStoreLocal) GetFile(f string) ([]byte, string, error) {
-	fullPath := filepath.Join(fs.rootDir, f)
+func (fs *fileStoreLocal) GetFile(ctx context.Context, f string) ([]byte, string, error) {
+	fullPath, ok := fs.servedFilePath(f)
+	if !ok {
+		return nil, "", ErrFileNotFound
+	}
 
 	data, err := ioutil.ReadFile(fullPath)
 	if err != nil {
 		return nil, "", ErrFileNotFound
 	}
 
-	// Detect content type from extension
-	contentType := mime.TypeByExtension(filepath.Ext(fullPath))
-	if contentType == "" {
-		contentType = "application/octet-stream"
-	}
+	return data, contentTypeFor(fullPath, data), nil
+}
 
-	return data, contentType, nil
+func (fs *fileStoreLocal) GetCompressedFile(ctx context.Context, f string) ([]byte, error) {
+	gzPath, ok := fs.compressedFilePath(f)
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	data, err := ioutil.ReadFile(gzPath)
+	if err != nil {
+		return nil, ErrFileNotFound
+	}
+	return data, nil
 }
 
-func (fs *fileStoreLocal) GetAccessLevel(key string) (access, error) {
-	cfg := fs.server.config.FileStore.APIKeys
+func (fs *fileStoreLocal) GetAccessLevel(ctx context.Context, key string) (access, error) {
+	cfg := fs.server.Config().FileStore.APIKeys
 
 	// No keys defined — open server
 	if len(cfg.ReadOnly) == 0 && len(cfg.ReadWrite) == 0 {
@@ -558,7 +1088,7 @@ func (fs *fileStoreLocal) GetAccessLevel(key string) (access, error) {
 				return accessReadOnly, nil
 			}
 		}
-		return accessDenied, fmt.Errorf("unauthorized")
+		return accessDenied, nil
 	}
 
 	// No ReadOnly keys, only ReadWrite keys: read is open, write requires a key
@@ -570,3 +1100,502 @@ func (fs *fileStoreLocal) GetAccessLevel(key string) (access, error) {
 	return accessReadOnly, nil
 }
 
+// quarantineDir returns the directory holding packages awaiting approval
+func (fs *fileStoreLocal) quarantineDir() string {
+	return filepath.Join(fs.rootDir, ".quarantine")
+}
+
+// quarantinePath returns the path of a quarantined nupkg
+func (fs *fileStoreLocal) quarantinePath(id string, ver string) string {
+	id = strings.ToLower(id)
+	return filepath.Join(fs.quarantineDir(), id, ver, fmt.Sprintf("%s.%s.nupkg", id, ver))
+}
+
+func (fs *fileStoreLocal) QuarantinePackage(ctx context.Context, pkg []byte) (*NugetPackageEntry, error) {
+	nsf, err := readNuspec(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing nuspec: %w", err)
+	}
+	if err := checkPackageIdentity(nsf.Meta.ID, nsf.Meta.Version); err != nil {
+		return nil, err
+	}
+	if _, _, err := extractPackage(pkg, extractionLimitsFor(fs.server.Config())); err != nil {
+		return nil, err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	// Refuse versions already stored or already awaiting approval
+	storedPath := fs.nupkgPath(nsf.Meta.ID, nsf.Meta.Version)
+	if _, err := os.Stat(storedPath); err == nil {
+		return nil, fmt.Errorf("package already exists: %s", storedPath)
+	}
+	qp := fs.quarantinePath(nsf.Meta.ID, nsf.Meta.Version)
+	if _, err := os.Stat(qp); err == nil {
+		return nil, fmt.Errorf("package already exists in quarantine: %s", qp)
+	}
+
+	// Write the nupkg into the quarantine area
+	if err := os.MkdirAll(filepath.Dir(qp), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := ioutil.WriteFile(qp, pkg, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write nupkg: %w", err)
+	}
+
+	log.Printf("Package quarantined: %s %s", nsf.Meta.ID, nsf.Meta.Version)
+	return fs.quarantineEntry(qp, pkg, nsf)
+}
+
+// quarantineEntry builds a feed entry for a quarantined package so it can be reviewed
+func (fs *fileStoreLocal) quarantineEntry(fp string, pkg []byte, nsf *nuspec.NuSpec) (*NugetPackageEntry, error) {
+	f, err := os.Stat(fp)
+	if err != nil {
+		return nil, err
+	}
+	p := NewNugetPackageEntry(nsf)
+	p.setNuspecDetails(pkg)
+	p.Properties.Created.Value = f.ModTime().UTC()
+	p.Properties.LastEdited.Value = p.Properties.Created.Value
+	p.Properties.Published.Value = p.Properties.Created.Value
+	p.Updated.Value = p.Properties.Created.Value
+	hash := sha512.Sum512(pkg)
+	p.Properties.PackageHash = hex.EncodeToString(hash[:])
+	p.Properties.PackageHashAlgorithm = `SHA512`
+	p.Properties.PackageSize.Value = len(pkg)
+	p.Properties.SupportedFrameworks = strings.Join(packageFrameworks(pkg), "|")
+	p.Properties.PackageSize.Type = "Edm.Int64"
+	return p, nil
+}
+
+func (fs *fileStoreLocal) GetQuarantinedEntries(ctx context.Context) ([]*NugetPackageEntry, error) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	var entries []*NugetPackageEntry
+	pkgs, err := filepath.Glob(filepath.Join(fs.quarantineDir(), "*", "*", "*.nupkg"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range pkgs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pkg, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return nil, err
+		}
+		nsf, err := readNuspec(pkg)
+		if err != nil {
+			log.Println("Error: Cannot read quarantined package", fp, err)
+			continue
+		}
+		p, err := fs.quarantineEntry(fp, pkg, nsf)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, p)
+	}
+
+	return entries, nil
+}
+
+func (fs *fileStoreLocal) ApprovePackage(ctx context.Context, id string, ver string) error {
+	qp := fs.quarantinePath(id, ver)
+	pkg, err := ioutil.ReadFile(qp)
+	if os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// The file must be the package it is filed under, in case the quarantine was edited by hand
+	nsf, err := readNuspec(pkg)
+	if err != nil {
+		return err
+	}
+	if err := checkPushTarget(id, ver, nsf); err != nil {
+		return err
+	}
+
+	// Promote into the normal store, then drop it from quarantine
+	hash := sha512.Sum512(pkg)
+	token, err := fs.intents.Begin(intentRecord{Op: intentApprove, ID: id, Version: ver, Path: qp, Hash: hex.EncodeToString(hash[:])})
+	if err != nil {
+		return err
+	}
+	defer fs.intents.Done(token)
+	if _, err := fs.StorePackage(ctx, pkg); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Dir(qp)); err != nil {
+		return err
+	}
+
+	log.Printf("Package approved: %s %s", id, ver)
+	return nil
+}
+
+// quarantineRejection records why a quarantined package was rejected
+type quarantineRejection struct {
+	ID       string    `json:"id"`
+	Version  string    `json:"version"`
+	Reason   string    `json:"reason"`
+	Rejected time.Time `json:"rejected"`
+}
+
+func (fs *fileStoreLocal) RejectPackage(ctx context.Context, id string, ver string, reason string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	qp := fs.quarantinePath(id, ver)
+	if _, err := os.Stat(qp); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	token, err := fs.intents.Begin(intentRecord{Op: intentReject, ID: id, Version: ver, Path: qp})
+	if err != nil {
+		return err
+	}
+	defer fs.intents.Done(token)
+
+	// Append to the rejection record
+	rp := filepath.Join(fs.quarantineDir(), "rejected.json")
+	var rejections []quarantineRejection
+	if data, err := ioutil.ReadFile(rp); err == nil {
+		if err := json.Unmarshal(data, &rejections); err != nil {
+			return err
+		}
+	}
+	rejections = append(rejections, quarantineRejection{ID: id, Version: ver, Reason: reason, Rejected: time.Now().UTC()})
+	data, err := json.MarshalIndent(rejections, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(rp, data, 0644); err != nil {
+		return err
+	}
+
+	// Delete the package
+	if err := os.RemoveAll(filepath.Dir(qp)); err != nil {
+		return err
+	}
+
+	log.Printf("Package rejected: %s %s (%s)", id, ver, reason)
+	return nil
+}
+
+// LastChanged returns when a package was last published to or removed from the store.
+// It has its own lock so feeds can check it while a long write holds the store.
+func (fs *fileStoreLocal) LastChanged(ctx context.Context) time.Time {
+	fs.changedLock.Lock()
+	defer fs.changedLock.Unlock()
+	return fs.lastChanged
+}
+
+// markChanged moves LastChanged forward to t
+func (fs *fileStoreLocal) markChanged(t time.Time) {
+	fs.changedLock.Lock()
+	defer fs.changedLock.Unlock()
+	if t.After(fs.lastChanged) {
+		fs.lastChanged = t
+	}
+}
+
+// readLock takes the store lock for a feed read, shared unless exclusive, returning
+// ErrBusy rather than waiting past read-lock-timeout behind a long write, or the
+// context's error if the request is cancelled while waiting
+func (fs *fileStoreLocal) readLock(ctx context.Context, exclusive bool) error {
+	lock, unlock := fs.lock.RLock, fs.lock.RUnlock
+	if exclusive {
+		lock, unlock = fs.lock.Lock, fs.lock.Unlock
+	}
+	return acquireWithin(ctx, lock, unlock, readLockTimeout(fs.server.Config()))
+}
+
+func (fs *fileStoreLocal) GetChanges(ctx context.Context, since int64) ([]changeRecord, int64, bool, error) {
+	changes, max, reset := fs.changes.Since(since)
+	return changes, max, reset, nil
+}
+
+// settingPath returns where a named server setting is kept, out of the way of packages
+func (fs *fileStoreLocal) settingPath(name string) string {
+	return filepath.Join(fs.rootDir, ".settings", name+".json")
+}
+
+func (fs *fileStoreLocal) GetSetting(ctx context.Context, name string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fs.settingPath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+	return b, err
+}
+
+func (fs *fileStoreLocal) PutSetting(ctx context.Context, name string, b []byte) error {
+	p := fs.settingPath(name)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	// Write then rename so readers never see a partial file. Settings include
+	// signing keys, so only the server's user may read them.
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// loadPins reads the pinned versions, keeping the current ones if they can't be read
+func (fs *fileStoreLocal) loadPins() {
+	pins := make(map[string]string)
+	b, err := fs.GetSetting(context.Background(), pinsSetting)
+	if err == nil {
+		err = json.Unmarshal(b, &pins)
+	}
+	if err != nil && err != ErrFileNotFound {
+		log.Println("Warning: could not load pinned versions", err)
+		return
+	}
+	fs.pins = pins
+}
+
+// SetPinnedVersion pins the version flagged IsLatestVersion for an id, or clears
+// the pin if ver is empty. A pin whose version is later removed or unlisted is
+// ignored until it is cleared.
+func (fs *fileStoreLocal) SetPinnedVersion(ctx context.Context, id string, ver string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	pins := make(map[string]string)
+	for k, v := range fs.pins {
+		pins[k] = v
+	}
+	if ver == "" {
+		delete(pins, strings.ToLower(id))
+	} else {
+		pins[strings.ToLower(id)] = ver
+	}
+	b, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fs.PutSetting(ctx, pinsSetting, b); err != nil {
+		return err
+	}
+	fs.pins = pins
+
+	fs.RecalculateLatestVersions()
+	fs.markChanged(time.Now().UTC())
+	if fs.shared {
+		fs.touchSharedMarker()
+	}
+	return nil
+}
+
+// GetPackageVersions returns every version stored for an id, listed or not, oldest
+// first, or ErrFileNotFound if there are none
+func (fs *fileStoreLocal) GetPackageVersions(ctx context.Context, id string) ([]string, error) {
+	if err := fs.readLock(ctx, false); err != nil {
+		return nil, err
+	}
+	defer fs.lock.RUnlock()
+	var list []string
+	for _, p := range fs.packages {
+		if strings.EqualFold(p.Properties.ID, id) {
+			list = append(list, p.Properties.Version)
+		}
+	}
+	if len(list) == 0 {
+		return nil, ErrFileNotFound
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return versions.Compare(list[i], list[j]) < 0
+	})
+	return list, nil
+}
+
+// GetNuspec returns a version's root .nuspec, read from the nupkg as only content/
+// is extracted
+func (fs *fileStoreLocal) GetNuspec(ctx context.Context, id string, ver string) ([]byte, error) {
+	pkg, err := fs.ReadPackageFile(ctx, id, ver)
+	if err != nil {
+		return nil, err
+	}
+	return readNuspecFile(pkg)
+}
+
+// StoreSymbolPackage stores a version's .snupkg, replacing any pushed before. The
+// version must already be stored, and its symbols are deleted with it.
+func (fs *fileStoreLocal) StoreSymbolPackage(ctx context.Context, id string, ver string, pkg []byte) error {
+	if err := fs.readLock(ctx, false); err != nil {
+		return err
+	}
+	defer fs.lock.RUnlock()
+
+	if _, err := os.Stat(fs.nupkgPath(id, ver)); os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if err != nil {
+		return err
+	}
+	dir := fs.versionDir(id, ver)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Write to a temp file and rename it into place, so a download never sees half
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return fmt.Errorf("failed to write snupkg: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(pkg); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snupkg: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snupkg: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), fs.snupkgPath(id, ver)); err != nil {
+		return fmt.Errorf("failed to write snupkg: %w", err)
+	}
+	return fs.indexSymbols(ctx, id, ver, pkg)
+}
+
+// loadSymbols reads the PDB index, keeping the current one if it can't be read
+func (fs *fileStoreLocal) loadSymbols() {
+	symbols := make(map[string]symbolEntry)
+	b, err := fs.GetSetting(context.Background(), symbolsSetting)
+	if err == nil {
+		err = json.Unmarshal(b, &symbols)
+	}
+	if err != nil && err != ErrFileNotFound {
+		log.Println("Warning: could not load the symbol index", err)
+		return
+	}
+	fs.symbolsLock.Lock()
+	fs.symbols = symbols
+	fs.symbolsLock.Unlock()
+}
+
+// indexSymbols records the PDBs in a version's .snupkg by their signatures,
+// replacing those of any .snupkg it was pushed before
+func (fs *fileStoreLocal) indexSymbols(ctx context.Context, id string, ver string, pkg []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		return err
+	}
+
+	fs.symbolsLock.Lock()
+	defer fs.symbolsLock.Unlock()
+	symbols := make(map[string]symbolEntry)
+	for k, e := range fs.symbols {
+		if !strings.EqualFold(e.ID, id) || !versions.Equal(e.Version, ver) {
+			symbols[k] = e
+		}
+	}
+	for _, f := range zr.File {
+		if !strings.EqualFold(path.Ext(f.Name), ".pdb") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		sig, err := pdbSignature(b)
+		if err != nil {
+			log.Println("Warning: not indexing", f.Name, "of", id, ver+":", err)
+			continue
+		}
+		symbols[symbolKey(path.Base(f.Name), sig)] = symbolEntry{ID: id, Version: ver, Path: f.Name}
+	}
+
+	b, err := json.MarshalIndent(symbols, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fs.PutSetting(ctx, symbolsSetting, b); err != nil {
+		return err
+	}
+	fs.symbols = symbols
+	return nil
+}
+
+// GetSymbolFile returns a PDB by its file name and signature, read from the
+// .snupkg it was indexed from, and the ID of the package it is for
+func (fs *fileStoreLocal) GetSymbolFile(ctx context.Context, pdbName string, signature string) ([]byte, string, error) {
+	if err := fs.readLock(ctx, false); err != nil {
+		return nil, "", err
+	}
+	defer fs.lock.RUnlock()
+
+	// Replicas sharing the store index symbols pushed to the others
+	fs.symbolsLock.Lock()
+	e, ok := fs.symbols[symbolKey(pdbName, signature)]
+	fs.symbolsLock.Unlock()
+	if !ok && fs.shared {
+		fs.loadSymbols()
+		fs.symbolsLock.Lock()
+		e, ok = fs.symbols[symbolKey(pdbName, signature)]
+		fs.symbolsLock.Unlock()
+	}
+	if !ok {
+		return nil, "", ErrFileNotFound
+	}
+
+	// The .snupkg goes when its version is deleted, leaving its entries behind
+	pkg, err := ioutil.ReadFile(fs.snupkgPath(e.ID, e.Version))
+	if os.IsNotExist(err) {
+		return nil, "", ErrFileNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, f := range zr.File {
+		if f.Name != e.Path {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, "", err
+		}
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		return b, e.ID, err
+	}
+	return nil, "", ErrFileNotFound
+}
+
+// GetSymbolPackage returns a version's .snupkg
+func (fs *fileStoreLocal) GetSymbolPackage(ctx context.Context, id string, ver string) ([]byte, error) {
+	if err := fs.readLock(ctx, false); err != nil {
+		return nil, err
+	}
+	defer fs.lock.RUnlock()
+
+	b, err := ioutil.ReadFile(fs.snupkgPath(id, ver))
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+	return b, err
+}
+
+func (fs *fileStoreLocal) GetPinnedVersions(ctx context.Context) (map[string]string, error) {
+	if err := fs.readLock(ctx, false); err != nil {
+		return nil, err
+	}
+	defer fs.lock.RUnlock()
+	pins := make(map[string]string)
+	for k, v := range fs.pins {
+		pins[k] = v
+	}
+	return pins, nil
+}
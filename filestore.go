@@ -3,8 +3,16 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
 	"path"
+	"strings"
+	"time"
 
 	nuspec "github.com/soloworks/go-nuspec"
 )
@@ -12,18 +20,156 @@ import (
 // Global Constant for formatting time strings
 const zuluTimeLayout = "2006-01-02T15:04:05Z"
 
+// fileStore is implemented by each storage backend. Methods that do I/O take the
+// request's context first so work stops when the client goes away.
 type fileStore interface {
 	Init(c *Server) error
-	GetPackageEntry(id string, ver string) (*NugetPackageEntry, error)
-	GetPackageFeedEntries(id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error)
-	StorePackage(pkg []byte) (bool, error)
-	GetFile(f string) ([]byte, string, error)
-	GetPackageFile(id string, ver string) ([]byte, string, error)
-	GetAccessLevel(key string) (access, error)
+	GetPackageEntry(ctx context.Context, id string, ver string) (*NugetPackageEntry, error)
+	GetPackageFeedEntries(ctx context.Context, id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error)
+	StorePackage(ctx context.Context, pkg []byte) (bool, error)
+	GetFile(ctx context.Context, f string) ([]byte, string, error)
+	GetCompressedFile(ctx context.Context, f string) ([]byte, error)
+	GetPackageFile(ctx context.Context, id string, ver string) (*packageFile, error)
+	ReadPackageFile(ctx context.Context, id string, ver string) ([]byte, error)
+	GetAccessLevel(ctx context.Context, key string) (access, error)
 	UpdateCountsInMemory()
+	AddDownloads(ctx context.Context, counts map[string]int) error
+	QuarantinePackage(ctx context.Context, pkg []byte) (*NugetPackageEntry, error)
+	GetQuarantinedEntries(ctx context.Context) ([]*NugetPackageEntry, error)
+	ApprovePackage(ctx context.Context, id string, ver string) error
+	RejectPackage(ctx context.Context, id string, ver string, reason string) error
+	GetChanges(ctx context.Context, since int64) ([]changeRecord, int64, bool, error)
+	LastChanged(ctx context.Context) time.Time
+	GetExtractionStatus(ctx context.Context, id string, ver string) (*extractionStatus, error)
+	GetExtractionStatuses(ctx context.Context) ([]*extractionStatus, error)
+	ReextractPackage(ctx context.Context, id string, ver string) (*extractionStatus, error)
+	Reindex(ctx context.Context) (int, error)
+	SetListed(ctx context.Context, id string, ver string, listed bool) error
+	DeletePackage(ctx context.Context, id string, ver string) error
+	GetPackageStorage(ctx context.Context, id string, ver string) (*packageStorage, error)
+	GetSetting(ctx context.Context, name string) ([]byte, error)
+	PutSetting(ctx context.Context, name string, b []byte) error
+	SetPinnedVersion(ctx context.Context, id string, ver string) error
+	GetPinnedVersions(ctx context.Context) (map[string]string, error)
+	GetPackageVersions(ctx context.Context, id string) ([]string, error)
+	GetNuspec(ctx context.Context, id string, ver string) ([]byte, error)
+	StoreSymbolPackage(ctx context.Context, id string, ver string, pkg []byte) error
+	GetSymbolPackage(ctx context.Context, id string, ver string) ([]byte, error)
+	GetSymbolFile(ctx context.Context, pdbName string, signature string) ([]byte, string, error)
 }
 
-func extractPackage(pkg []byte) (*nuspec.NuSpec, map[string][]byte, error) {
+// packageFile is a stored nupkg opened for downloading, read as it is served
+// rather than held in memory. It must be closed.
+type packageFile struct {
+	io.ReadSeeker
+	Size        int64
+	ModTime     time.Time // Zero if the store doesn't know
+	ContentType string
+	closer      io.Closer
+}
+
+func (f *packageFile) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+// openPackageFile opens a nupkg on disk for downloading
+func openPackageFile(p string, contentType string) (*packageFile, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &packageFile{ReadSeeker: f, Size: fi.Size(), ModTime: fi.ModTime(), ContentType: contentType, closer: f}, nil
+}
+
+// bytesPackageFile serves a nupkg a store could only read whole
+func bytesPackageFile(b []byte, modTime time.Time, contentType string) *packageFile {
+	return &packageFile{ReadSeeker: bytes.NewReader(b), Size: int64(len(b)), ModTime: modTime, ContentType: contentType}
+}
+
+// readNuspec returns the parsed root .nuspec of a package without extracting any other files
+func readNuspec(pkg []byte) (*nuspec.NuSpec, error) {
+	b, err := readNuspecFile(pkg)
+	if err != nil {
+		return nil, err
+	}
+	return parseNuspec(b)
+}
+
+// readNuspecFile returns the root .nuspec of a package as it is in the package
+func readNuspecFile(pkg []byte) ([]byte, error) {
+
+	// Open package data as zipfile
+	zipReader, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the root .nuspec file
+	for _, zippedFile := range zipReader.File {
+		if path.Dir(zippedFile.Name) == "." && path.Ext(zippedFile.Name) == ".nuspec" {
+			return readZipFile(zippedFile, nuspecMaxBytes())
+		}
+	}
+
+	return nil, ErrNuspecNotFound
+}
+
+// nuspecMaxBytes is the most of a nuspec that is read. Packages already in a store
+// are loaded while the server starts, before there is a config to ask.
+func nuspecMaxBytes() int64 {
+	if server == nil {
+		return defaultExtractMaxFileBytes
+	}
+	return extractionLimitsFor(server.Config()).MaxFileBytes
+}
+
+// readZipFile reads a file in a package, failing with an extractionLimitError once
+// it is over max bytes. Sizes in the zip headers can't be trusted, so the limit is
+// applied while reading.
+func readZipFile(f *zip.File, max int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// Read all bytes, stopping just past the limit
+	b, err := ioutil.ReadAll(io.LimitReader(rc, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, &extractionLimitError{"max-file-bytes", fmt.Sprintf("%s is over %d bytes", f.Name, max)}
+	}
+	return b, nil
+}
+
+// unsafeEntryName reports whether a zip entry's name is absolute or climbs out of
+// the package with "..", with either kind of slash
+func unsafeEntryName(name string) bool {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return true
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func extractPackage(pkg []byte, limits extractionLimits) (*nuspec.NuSpec, map[string][]byte, error) {
 
 	// Open package data as zipfile
 	zipReader, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
@@ -39,28 +185,39 @@ func extractPackage(pkg []byte) (*nuspec.NuSpec, map[string][]byte, error) {
 	for _, zippedFile := range zipReader.File {
 		// If this is the root .nuspec file read it into a NewspecFile structure
 		if path.Dir(zippedFile.Name) == "." && path.Ext(zippedFile.Name) == ".nuspec" {
-			// Get a reader for this file
-			rc, err := zippedFile.Open()
+			// Read into nuspec.File structure
+			b, err := readZipFile(zippedFile, limits.MaxFileBytes)
 			if err != nil {
 				return nil, nil, err
 			}
-			// Read into nuspec.File structure
-			nsf, err = nuspec.FromReader(rc)
+			if nsf, err = parseNuspec(b); err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 
+	// Sizes in the zip headers can't be trusted, so limits are applied while reading
+	if len(zipReader.File) > limits.MaxFiles {
+		return nsf, nil, &extractionLimitError{"max-files", fmt.Sprintf("%d files, limit %d", len(zipReader.File), limits.MaxFiles)}
+	}
+	var total int64
+
 	// Extract contents to files
 	for _, zipFile := range zipReader.File {
 
-		// Open file to be extracted
-		r, err := zipFile.Open()
-		if err != nil {
-			return nil, nil, err
+		// Nothing may be written outside the package, whatever it's extracted into
+		if unsafeEntryName(zipFile.Name) {
+			return nsf, nil, &extractionLimitError{"entry-names", fmt.Sprintf("%q is not a relative path inside the package", zipFile.Name)}
 		}
-		// Read all bytes
-		b, err := ioutil.ReadAll(r)
+
+		// Read the file to be extracted
+		b, err := readZipFile(zipFile, limits.MaxFileBytes)
 		if err != nil {
-			return nil, nil, err
+			return nsf, nil, err
+		}
+		total += int64(len(b))
+		if total > limits.MaxTotalBytes {
+			return nsf, nil, &extractionLimitError{"max-total-bytes", fmt.Sprintf("contents are over %d bytes", limits.MaxTotalBytes)}
 		}
 		// Store in map with filename
 		files[zipFile.Name] = b
@@ -70,6 +227,41 @@ func extractPackage(pkg []byte) (*nuspec.NuSpec, map[string][]byte, error) {
 	return nsf, files, nil
 }
 
+// Content types for Q-Sys and firmware files the stdlib doesn't know
+var defaultContentTypes = map[string]string{
+	".qplug": "text/x-lua; charset=utf-8",
+	".lua":   "text/x-lua; charset=utf-8",
+	".luac":  "application/x-lua-bytecode",
+	".qsys":  "application/x-qsys-design",
+	".lcp":   "application/x-qsys-lcp",
+	".bin":   "application/octet-stream",
+}
+
+// contentTypeFor returns the content type of a file: from the config overrides, then
+// the Q-Sys defaults, then the stdlib extension table, and finally by sniffing the data
+func contentTypeFor(name string, data []byte) string {
+	return contentTypeIn(server.Config(), name, data)
+}
+
+// contentTypeIn is contentTypeFor with the overrides of the given config, for a
+// store loading before the server is set
+func contentTypeIn(c *Config, name string, data []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext != "" {
+		if t, ok := c.ContentTypes[ext]; ok {
+			return t
+		}
+		if t, ok := defaultContentTypes[ext]; ok {
+			return t
+		}
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t
+		}
+	}
+	// DetectContentType only looks at the first 512 bytes and falls back to application/octet-stream
+	return http.DetectContentType(data)
+}
+
 // FileStoreError represents a FileStore Error
 type FileStoreError struct {
 	ErrorString string
@@ -82,6 +274,15 @@ func (fse *FileStoreError) Error() string {
 var (
 	// ErrFileNotFound is returned when request file is not found in the store
 	ErrFileNotFound = &FileStoreError{"File Not Found"}
+	// ErrNuspecNotFound is returned when a package has no root .nuspec file
+	ErrNuspecNotFound = &FileStoreError{"Nuspec Not Found"}
+	// ErrNotSupported is returned when a FileStore does not implement a feature
+	ErrNotSupported = &FileStoreError{"Not Supported by FileStore"}
+	// ErrBusy is returned when a read can't get at the store within read-lock-timeout
+	ErrBusy = &FileStoreError{"FileStore Busy"}
+	// ErrStartAfterGone is returned when a page is to start after a version no
+	// longer in the store, so where it would have been in the order isn't known
+	ErrStartAfterGone = &FileStoreError{"Page Start Not Found"}
 )
 
 // Access Types for ease of reference
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentTypeFor(t *testing.T) {
+	newTestServer(t, func(c *Config) {
+		c.ContentTypes = map[string]string{".qsys": "application/octet-stream", ".fw": "application/x-firmware"}
+	})
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		// Config overrides win over the defaults, whatever the case of the name
+		{"design.qsys", nil, "application/octet-stream"},
+		{"DESIGN.QSYS", nil, "application/octet-stream"},
+		{"update.fw", png, "application/x-firmware"},
+		// Q-Sys defaults, even for content that sniffs as something else
+		{"plugin.qplug", []byte("<html>"), "text/x-lua; charset=utf-8"},
+		{"control.lcp", nil, "application/x-qsys-lcp"},
+		{"image.bin", png, "application/octet-stream"},
+		// The standard table
+		{"info.json", nil, "application/json"},
+		{"readme.txt", png, "text/plain; charset=utf-8"},
+		// Sniffed when the extension is unknown or missing
+		{"LICENSE", []byte("MIT License\n\nCopyright"), "text/plain; charset=utf-8"},
+		{"page.unknownext", []byte("<!DOCTYPE html><html></html>"), "text/html; charset=utf-8"},
+		{"logo", png, "image/png"},
+		// And octet-stream when sniffing finds nothing
+		{"blob", []byte{0x00, 0x01, 0x02, 0xfe}, "application/octet-stream"},
+		{"empty", nil, "text/plain; charset=utf-8"},
+	} {
+		if got := contentTypeFor(tc.name, tc.data); got != tc.want {
+			t.Errorf("contentTypeFor(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Extracted content is served with the type worked out for it
+func TestContentTypeServed(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.ContentTypes = map[string]string{".fw": "application/x-firmware"}
+	})
+	ts.mustPush(t, testPackage(t, "Types.Pkg", "1.0.0", "", map[string]string{
+		"content/plugin.qplug":    "PluginInfo = {}",
+		"content/update.fw":       "\x00\x01",
+		"content/data.json":       "{}",
+		"content/notes.zzunknown": "plain text",
+	}))
+	for file, want := range map[string]string{
+		"plugin.qplug":    "text/x-lua; charset=utf-8",
+		"update.fw":       "application/x-firmware",
+		"data.json":       "application/json",
+		"notes.zzunknown": "text/plain; charset=utf-8",
+	} {
+		res := ts.do(t, http.MethodGet, "files/types.pkg/1.0.0/content/"+file, testReadKey, nil, nil)
+		status, body := readResponse(t, res)
+		wantStatus(t, file, status, body, http.StatusOK)
+		if got := res.Header.Get("Content-Type"); got != want {
+			t.Errorf("%s: Content-Type %q, want %q", file, got, want)
+		}
+	}
+}
+
+// A corrupt downloads.json is moved aside, kept, and the counts recovered from the
+// newest readable of the backup and an interrupted save
+func TestDownloadCountsRecovery(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		corrupt func(good []byte) []byte
+		bak     string // Backup left by the last save, removed if empty
+		tmp     string // Interrupted save, newer than the backup, if any
+		count   string // Downloads of the package after the restart
+		err     string // Part of the problem reported in statusz
+	}{
+		{name: "truncated", corrupt: func(b []byte) []byte { return b[:len(b)/2] }, count: "5", err: "recovered from downloads.json.bak"},
+		{name: "garbage", corrupt: func([]byte) []byte { return []byte("\x00\x01\xfe not json") }, count: "5", err: "recovered from downloads.json.bak"},
+		{name: "empty", corrupt: func([]byte) []byte { return nil }, count: "5", err: "file is empty"},
+		{name: "interrupted save", corrupt: func(b []byte) []byte { return b[:1] }, tmp: `{"Count.Pkg/1.0.0": 6}`, count: "6", err: "recovered from downloads.json.tmp"},
+		{name: "bad interrupted save", corrupt: func(b []byte) []byte { return b[:1] }, tmp: `{"Count.Pkg/1.0.0": `, count: "5", err: "recovered from downloads.json.bak"},
+		{name: "no backup", corrupt: func(b []byte) []byte { return b[:1] }, bak: "-", count: "0", err: "counts start from zero"},
+		{name: "bad backup", corrupt: func(b []byte) []byte { return b[:1] }, bak: "[", count: "0", err: "counts start from zero"},
+	} {
+		ts := newTestServer(t, nil)
+		ts.mustPush(t, testPackage(t, "Count.Pkg", "1.0.0", "", nil))
+		fs := ts.local(t)
+		ctx := context.Background()
+
+		// Two saves, so the backup has the first
+		for _, n := range []int{5, 2} {
+			if err := fs.AddDownloads(ctx, map[string]int{"Count.Pkg/1.0.0": n}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p := filepath.Join(ts.Root, "downloads.json")
+		if counts, err := readDownloadCounts(p + ".bak"); err != nil || counts["Count.Pkg/1.0.0"] != 5 {
+			t.Fatalf("%s: backup %v, %v", tc.name, counts, err)
+		}
+		good, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt := tc.corrupt(good)
+		if err := ioutil.WriteFile(p, corrupt, 0644); err != nil {
+			t.Fatal(err)
+		}
+		switch tc.bak {
+		case "":
+		case "-":
+			os.Remove(p + ".bak")
+		default:
+			ioutil.WriteFile(p+".bak", []byte(tc.bak), 0644)
+		}
+		if tc.tmp != "" {
+			ioutil.WriteFile(p+".tmp", []byte(tc.tmp), 0644)
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(p+".tmp", later, later)
+		}
+
+		ts.restart(t)
+		_, body := ts.get(t, "Packages(Id='Count.Pkg',Version='1.0.0')")
+		if got := between(body, `<d:VersionDownloadCount m:type="Edm.Int32">`, "<"); got != tc.count {
+			t.Errorf("%s: %s downloads after the restart, want %s", tc.name, got, tc.count)
+		}
+		statusz := func() (int, string) {
+			return readResponse(t, ts.do(t, http.MethodGet, "statusz", testWriteKey, nil, nil))
+		}
+		status, body := statusz()
+		if status != http.StatusOK || !strings.Contains(body, `"degraded"`) || !strings.Contains(body, downloadCountsComponent) || !strings.Contains(body, tc.err) {
+			t.Errorf("%s: statusz %d %s, want %q", tc.name, status, body, tc.err)
+		}
+
+		// The corrupt file is kept as it was, and saves never touch it
+		aside, _ := filepath.Glob(p + ".corrupt-*")
+		if len(aside) != 1 {
+			t.Fatalf("%s: moved aside to %q", tc.name, aside)
+		}
+		if err := ts.local(t).AddDownloads(ctx, map[string]int{"Count.Pkg/1.0.0": 1}); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadFile(aside[0]); err != nil || !bytes.Equal(b, corrupt) {
+			t.Errorf("%s: %s changed to %q, %v", tc.name, aside[0], b, err)
+		}
+		want, _ := strconv.Atoi(tc.count)
+		if counts, err := readDownloadCounts(p); err != nil || counts["Count.Pkg/1.0.0"] != want+1 {
+			t.Errorf("%s: saved %v, %v, want %d", tc.name, counts, err, want+1)
+		}
+
+		// Another restart finds nothing wrong, and a second corrupt file is
+		// moved to a name of its own
+		ts.restart(t)
+		if _, body := statusz(); !strings.Contains(body, `"ok"`) {
+			t.Errorf("%s: statusz after a good save %s", tc.name, body)
+		}
+		ioutil.WriteFile(p, []byte("{"), 0644)
+		ts.restart(t)
+		if aside, _ := filepath.Glob(p + ".corrupt-*"); len(aside) != 2 {
+			t.Errorf("%s: second corrupt file moved aside to %q", tc.name, aside)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// flatContainerURL returns the address of a document in the V3 flat container
+func flatContainerURL(doc string) string {
+	return server.URL.String() + `v3-flatcontainer/` + doc
+}
+
+// flatContainerVersions is v3-flatcontainer/{id}/index.json
+type flatContainerVersions struct {
+	Versions []string `json:"versions"`
+}
+
+// serveFlatContainer serves the V3 PackageBaseAddress resource restore uses to
+// list and download versions. IDs and versions in the path match whatever their
+// case, and versions whichever way they are written (1.0 is 1.0.0).
+func serveFlatContainer(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting v3-flatcontainer/{id}/index.json or
+	// v3-flatcontainer/{id}/{version}/{id}.{version}.nupkg|nuspec
+	x := strings.Split(r.URL.Path[len(server.URL.Path+`v3-flatcontainer/`):], `/`)
+	switch {
+	case len(x) == 2 && x[0] != "" && x[1] == "index.json":
+		serveFlatContainerIndex(w, r, x[0])
+		return
+	case len(x) != 3 || x[0] == "" || x[1] == "":
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, ver, name := x[0], x[1], x[2]
+
+	// The file name repeats the id and version, in the normalized form clients send
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	base, ext := name[:i], strings.ToLower(name[i+1:])
+	if (ext != "nupkg" && ext != "nuspec") ||
+		(!strings.EqualFold(base, id+"."+ver) && !strings.EqualFold(base, id+"."+versions.Normalize(ver))) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Serve the version as it was stored, so it is counted and found as any other
+	// download. One no longer stored is left for serveVersionFile to answer.
+	list, err := server.fs.GetPackageVersions(r.Context(), id)
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil && err != ErrFileNotFound {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, v := range list {
+		if versions.Equal(v, ver) {
+			ver = v
+			break
+		}
+	}
+
+	if ext == "nupkg" {
+		serveVersionFile(w, r, id, ver)
+		return
+	}
+	serveNuspec(w, r, id, ver)
+}
+
+// serveFlatContainerIndex lists every version of an id, listed or not as NuGet's
+// own flat container does, normalized and in lower case
+func serveFlatContainerIndex(w http.ResponseWriter, r *http.Request, id string) {
+	lastChanged := server.fs.LastChanged(r.Context())
+	if notModified(w, r, lastChanged) {
+		return
+	}
+
+	list, err := server.fs.GetPackageVersions(r.Context(), id)
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := flatContainerVersions{Versions: []string{}}
+	snap := requestSnapshot(r)
+	for _, v := range list {
+		if snap != nil && !snap.Contains(id, v) {
+			continue
+		}
+		res.Versions = append(res.Versions, versions.Key(v))
+	}
+	if len(res.Versions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	serveV3Document(w, r, v3CacheKey(r, id), versionsGeneration(res.Versions), "flatcontainer/index.json", func() ([]byte, error) {
+		return marshalJSON(res)
+	})
+}
+
+// serveNuspec serves a version's .nuspec as it is in the package
+func serveNuspec(w http.ResponseWriter, r *http.Request, id string, ver string) {
+
+	// Versions outside of a snapshot don't exist within it
+	snap := requestSnapshot(r)
+	if snap != nil && !snap.Contains(id, ver) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := server.fs.GetNuspec(r.Context(), id, ver)
+	if err == ErrFileNotFound && snap != nil {
+		serveSnapshotGone(w, snap, id, ver)
+		return
+	} else if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// floatingResult is the version a floating dev reference currently resolves to
+type floatingResult struct {
+	ID            string `json:"id"`
+	Version       string `json:"version"`
+	PrereleaseTag string `json:"prereleaseTag,omitempty"`
+	DownloadURL   string `json:"downloadUrl"`
+	Hash          string `json:"hash"`
+	HashAlgorithm string `json:"hashAlgorithm"`
+}
+
+// floatingNotFound is the answer when nothing matches, with the tags that would
+type floatingNotFound struct {
+	Error     string   `json:"error"`
+	KnownTags []string `json:"knownTags"`
+}
+
+func serveFloatingVersion(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting api/packages/{id}/latest?prereleaseTag=branch&redirect=true
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`api/packages`):], `/`), `/`)
+	if len(x) != 2 || x[0] == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, tag := x[0], r.URL.Query().Get("prereleaseTag")
+	redirect := false
+	if s := r.URL.Query().Get("redirect"); s != "" {
+		var err error
+		if redirect, err = strconv.ParseBool(s); err != nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("redirect must be true or false"))
+			return
+		}
+	}
+
+	entries, err := allPackageEntries(r.Context(), server.fs, id)
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The newest listed version with the tag, or without one the latest version
+	// nupkg/{id}/latest serves
+	var match *NugetPackageEntry
+	tags := make(map[string]bool)
+	snap := requestSnapshot(r)
+	for _, e := range entries {
+		v := versions.Lenient(e.Properties.Version)
+		if !strings.EqualFold(e.Properties.ID, id) || !e.Properties.Listed.Value {
+			continue
+		}
+		if snap != nil && !snap.Contains(e.Properties.ID, e.Properties.Version) {
+			continue
+		}
+		if v.IsPrerelease() {
+			tags[v.PrereleaseName()] = true
+		}
+		if tag == "" {
+			if e.Properties.IsLatestVersion.Value || (match == nil && e.Properties.IsAbsoluteLatestVersion.Value) {
+				match = e
+			}
+			continue
+		}
+		if v.HasPrereleaseTag(tag) && (match == nil || v.Compare(versions.Lenient(match.Properties.Version)) > 0) {
+			match = e
+		}
+	}
+
+	if match == nil {
+		res := floatingNotFound{Error: "no version of " + id + " matches", KnownTags: []string{}}
+		if tag != "" {
+			res.Error = "no version of " + id + " has the prerelease tag " + tag
+		}
+		for t := range tags {
+			res.KnownTags = append(res.KnownTags, t)
+		}
+		sort.Strings(res.KnownTags)
+		b, err := json.Marshal(res)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(b)
+		return
+	}
+
+	p := match.Properties
+	res := floatingResult{
+		ID:            p.ID,
+		Version:       p.Version,
+		PrereleaseTag: tag,
+		DownloadURL:   server.URL.String() + "nupkg/" + p.ID + "/" + p.Version,
+		Hash:          p.PackageHash,
+		HashAlgorithm: p.PackageHashAlgorithm,
+	}
+
+	// The answer moves with every build, so never cache it
+	w.Header().Set("Cache-Control", "no-store")
+	if redirect {
+		http.Redirect(w, r, res.DownloadURL, http.StatusFound)
+		return
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
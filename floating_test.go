@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// A prerelease tag picks the newest listed build of its branch, matching each of
+// its identifiers in full whatever the case and ordering numeric suffixes as numbers
+func TestFloatingVersion(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, ver := range []string{
+		"1.0.0",
+		"1.2.3-dev", "1.2.3-dev.2", "1.2.3-dev.9", "1.2.3-DEV.10",
+		"1.2.3-develop.50",
+		"1.2.2-dev.feature.7",
+		"1.2.4-dev.11",
+		"1.3.0-feature", "1.3.0-feature-login.3", "1.3.0-feature-login.12",
+		"1.3.0-release-2.0.1",
+	} {
+		ts.mustPush(t, testPackage(t, "Float.Pkg", ver, "", nil))
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Float.Pkg/1.2.4-dev.11", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	known := []string{"dev", "develop", "feature", "feature-login", "release-2"}
+	for _, tc := range []struct {
+		tag   string
+		want  string   // Version found
+		known []string // Tags listed when none is
+	}{
+		{tag: "", want: "1.0.0"},
+		// dev.10 is newer than dev.9, and the unlisted dev.11 isn't offered
+		{tag: "dev", want: "1.2.3-DEV.10"},
+		{tag: "Dev", want: "1.2.3-DEV.10"},
+		// dev is not a prefix of develop, nor develop of dev
+		{tag: "develop", want: "1.2.3-develop.50"},
+		{tag: "devel", known: known},
+		{tag: "dev.feature", want: "1.2.2-dev.feature.7"},
+		{tag: "dev.9", want: "1.2.3-dev.9"},
+		{tag: "dev.1", known: known},
+		// A branch name is one identifier, dashes and all
+		{tag: "feature", want: "1.3.0-feature"},
+		{tag: "feature-login", want: "1.3.0-feature-login.12"},
+		{tag: "feature-login.3", want: "1.3.0-feature-login.3"},
+		{tag: "feature-log", known: known},
+		{tag: "release-2", want: "1.3.0-release-2.0.1"},
+		{tag: "release-2.0", want: "1.3.0-release-2.0.1"},
+		{tag: "release-2.0.2", known: known},
+	} {
+		status, body := ts.get(t, "api/packages/Float.Pkg/latest?prereleaseTag="+url.QueryEscape(tc.tag))
+		if tc.want == "" {
+			wantStatus(t, tc.tag, status, body, http.StatusNotFound)
+			var res floatingNotFound
+			if err := json.Unmarshal([]byte(body), &res); err != nil || !reflect.DeepEqual(res.KnownTags, tc.known) ||
+				res.Error != "no version of Float.Pkg has the prerelease tag "+tc.tag {
+				t.Errorf("%s: got %s, want the known tags %q", tc.tag, body, tc.known)
+			}
+			continue
+		}
+		wantStatus(t, tc.tag, status, body, http.StatusOK)
+		var res floatingResult
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatal(err)
+		}
+		want := floatingResult{ID: "Float.Pkg", Version: tc.want, PrereleaseTag: tc.tag, DownloadURL: server.URL.String() + "nupkg/Float.Pkg/" + tc.want,
+			Hash: res.Hash, HashAlgorithm: "SHA512"}
+		if res != want || res.Hash == "" {
+			t.Errorf("%s: got %+v, want %+v", tc.tag, res, want)
+		}
+	}
+
+	// redirect=true sends the client straight to the package
+	res := ts.do(t, http.MethodGet, "api/packages/Float.Pkg/latest?prereleaseTag=dev&redirect=true", testReadKey, nil, nil)
+	if res.StatusCode != http.StatusOK || res.Request.URL.String() != server.URL.String()+"nupkg/Float.Pkg/1.2.3-DEV.10" {
+		t.Errorf("redirect: got %d from %s", res.StatusCode, res.Request.URL)
+	}
+	res.Body.Close()
+	status, body = ts.get(t, "api/packages/Float.Pkg/latest?redirect=maybe")
+	wantStatus(t, "bad redirect", status, body, http.StatusBadRequest)
+
+	status, body = ts.get(t, "api/packages/No.Such.Pkg/latest?prereleaseTag=dev")
+	wantStatus(t, "missing package", status, body, http.StatusNotFound)
+	if body != `{"error":"no version of No.Such.Pkg has the prerelease tag dev","knownTags":[]}` {
+		t.Errorf("missing package: got %s", body)
+	}
+}
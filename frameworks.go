@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Package folders whose subfolders are named for the framework they target
+var frameworkFolders = map[string]bool{"lib": true, "ref": true, "build": true}
+
+// targetFramework is a parsed target framework moniker. .NET 5 and later are the
+// netcoreapp family, as they are to NuGet.
+type targetFramework struct {
+	Family  string
+	Version []int
+}
+
+// Long framework identifiers and the short family names they map to
+var frameworkFamilies = map[string]string{
+	".netframework": "net",
+	".netstandard":  "netstandard",
+	".netcoreapp":   "netcoreapp",
+	".netcore":      "netcore",
+	".netportable":  "portable",
+	"silverlight":   "sl",
+	"windowsphone":  "wp",
+	"uap":           "uap",
+	"tizen":         "tizen",
+	"monoandroid":   "monoandroid",
+	"xamarin.ios":   "xamarinios",
+}
+
+// parseFramework reads a framework as a folder name (net472, net6.0-windows,
+// netstandard2.0) or a long identifier (.NETFramework,Version=v4.7.2, .NETStandard2.0)
+func parseFramework(s string) (targetFramework, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	// Platforms such as -windows don't change the family
+	if i := strings.Index(s, "-"); i > 0 {
+		s = s[:i]
+	}
+
+	// Long identifiers
+	if i := strings.Index(s, ",version=v"); i > 0 {
+		s = s[:i] + s[i+len(",version=v"):]
+	}
+	for long, short := range frameworkFamilies {
+		if strings.HasPrefix(s, long) && len(s) > len(long) && s[len(long)] >= '0' && s[len(long)] <= '9' {
+			s = short + s[len(long):]
+			break
+		}
+	}
+
+	i := strings.IndexAny(s, "0123456789")
+	if i <= 0 {
+		return targetFramework{}, false
+	}
+	tf := targetFramework{Family: s[:i]}
+	v := s[i:]
+	if strings.Contains(v, ".") {
+		for _, p := range strings.Split(v, ".") {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return targetFramework{}, false
+			}
+			tf.Version = append(tf.Version, n)
+		}
+	} else {
+		// Folder names such as net472 give a digit per part
+		for _, c := range v {
+			if c < '0' || c > '9' {
+				return targetFramework{}, false
+			}
+			tf.Version = append(tf.Version, int(c-'0'))
+		}
+	}
+	for len(tf.Version) > 1 && tf.Version[len(tf.Version)-1] == 0 {
+		tf.Version = tf.Version[:len(tf.Version)-1]
+	}
+
+	// net5.0 and later carry on from netcoreapp3.1
+	if tf.Family == "net" && tf.Version[0] >= 5 {
+		tf.Family = "netcoreapp"
+	}
+	return tf, true
+}
+
+// String returns the framework's folder name, e.g. net472, net6.0 or netstandard2.0
+func (tf targetFramework) String() string {
+	v := append([]int(nil), tf.Version...)
+	if len(v) < 2 {
+		v = append(v, 0)
+	}
+	if tf.Family == "net" {
+		var b strings.Builder
+		for _, n := range v {
+			b.WriteString(strconv.Itoa(n))
+		}
+		return "net" + b.String()
+	}
+	var parts []string
+	for _, n := range v {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	family := tf.Family
+	if family == "netcoreapp" && v[0] >= 5 {
+		family = "net"
+	}
+	return family + strings.Join(parts, ".")
+}
+
+// compareFrameworkVersions compares two framework versions part by part
+func compareFrameworkVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		x, y := 0, 0
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// CompatibleWith reports whether a package built for tf can be used by a project
+// targeting project: the same family, at the same or an earlier version
+func (tf targetFramework) CompatibleWith(project targetFramework) bool {
+	return tf.Family == project.Family && compareFrameworkVersions(tf.Version, project.Version) <= 0
+}
+
+// packageFrameworks returns the frameworks a package supports, from the framework
+// folders under lib/, ref/ and build/ and the nuspec's dependency groups
+func packageFrameworks(pkg []byte) []string {
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var list []string
+	add := func(s string) {
+		if tf, ok := parseFramework(s); ok && !seen[tf.String()] {
+			seen[tf.String()] = true
+			list = append(list, tf.String())
+		}
+	}
+	for _, f := range zr.File {
+		// Only files in a framework's folder, not ones directly in lib/
+		x := strings.Split(strings.Replace(f.Name, `\`, "/", -1), "/")
+		if len(x) >= 3 && frameworkFolders[strings.ToLower(x[0])] {
+			add(x[1])
+		}
+		if path.Dir(f.Name) == "." && strings.HasSuffix(strings.ToLower(f.Name), ".nuspec") {
+			rc, err := f.Open()
+			if err != nil {
+				continue
+			}
+			for _, g := range nuspecDependencyFrameworks(rc) {
+				add(g)
+			}
+			rc.Close()
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// nuspecDependencyFrameworks returns the targetFramework of each dependency group
+func nuspecDependencyFrameworks(r io.Reader) []string {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var list []string
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return list
+		}
+		if se, ok := t.(xml.StartElement); ok && se.Name.Local == "group" {
+			for _, a := range se.Attr {
+				if a.Name.Local == "targetFramework" && a.Value != "" {
+					list = append(list, a.Value)
+				}
+			}
+		}
+	}
+}
+
+// splitFrameworks splits an entry's SupportedFrameworks
+func splitFrameworks(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "|")
+}
+
+// frameworkFilter matches packages usable by any of the requested frameworks
+type frameworkFilter []targetFramework
+
+// parseFrameworkFilter reads a targetFramework search parameter, which may list
+// several frameworks separated by |
+func parseFrameworkFilter(s string) frameworkFilter {
+	var f frameworkFilter
+	for _, x := range strings.Split(s, "|") {
+		if tf, ok := parseFramework(x); ok {
+			f = append(f, tf)
+		}
+	}
+	return f
+}
+
+// Matches reports whether a package supports one of the filter's frameworks.
+// Packages without framework folders, such as tools or content only packages,
+// work anywhere and always match.
+func (f frameworkFilter) Matches(e *NugetPackageEntry) bool {
+	fws := splitFrameworks(e.Properties.SupportedFrameworks)
+	if len(f) == 0 || len(fws) == 0 {
+		return true
+	}
+	for _, s := range fws {
+		tf, ok := parseFramework(s)
+		if !ok {
+			continue
+		}
+		for _, project := range f {
+			if tf.CompatibleWith(project) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseFramework(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"net472", "net472", true},
+		{"net45", "net45", true},
+		{"NET40", "net40", true},
+		{"netstandard2.0", "netstandard2.0", true},
+		{"netstandard20", "netstandard2.0", true},
+		{"netcoreapp3.1", "netcoreapp3.1", true},
+		{"net6.0", "net6.0", true},
+		{"net6.0-windows", "net6.0", true},
+		{".NETFramework,Version=v4.7.2", "net472", true},
+		{".NETFramework4.5", "net45", true},
+		{".NETStandard2.0", "netstandard2.0", true},
+		{".NETStandard,Version=v1.3", "netstandard1.3", true},
+		{".NETCoreApp,Version=v5.0", "net5.0", true},
+		{"", "", false},
+		{"any", "", false},
+		{"native", "", false},
+		{"net4x", "", false},
+	} {
+		tf, ok := parseFramework(tc.in)
+		if ok != tc.ok || (ok && tf.String() != tc.want) {
+			t.Errorf("parseFramework(%q) = %v %v, want %q %v", tc.in, tf, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestFrameworkCompatible(t *testing.T) {
+	for _, tc := range []struct {
+		pkg, project string
+		want         bool
+	}{
+		{"net45", "net472", true},
+		{"net472", "net472", true},
+		{"net472", "net45", false},
+		{"netstandard2.0", "netstandard2.1", true},
+		{"netstandard2.1", "netstandard2.0", false},
+		{"netcoreapp3.1", "net6.0", true},
+		{"net6.0", "netcoreapp3.1", false},
+		{"net5.0", "net6.0-windows", true},
+		// Only the same family counts
+		{"netstandard2.0", "net472", false},
+		{"net472", "net6.0", false},
+	} {
+		a, _ := parseFramework(tc.pkg)
+		b, _ := parseFramework(tc.project)
+		if got := a.CompatibleWith(b); got != tc.want {
+			t.Errorf("%s for %s: got %v, want %v", tc.pkg, tc.project, got, tc.want)
+		}
+	}
+}
+
+// Packages built for .NET Framework, .NET Standard and no framework at all
+func frameworkPackages(t *testing.T) map[string][]byte {
+	return map[string][]byte{
+		"Fw.Net472": testPackage(t, "Fw.Net472", "1.0.0", "", map[string]string{
+			"lib/net472/Fw.Net472.dll": "dll",
+		}),
+		"Fw.Standard": testPackage(t, "Fw.Standard", "1.0.0", `<dependencies>
+      <group targetFramework=".NETStandard2.0" />
+      <group targetFramework="net6.0" />
+    </dependencies>`, map[string]string{
+			"lib/netstandard2.0/Fw.Standard.dll": "dll",
+			"ref/netstandard2.0/Fw.Standard.dll": "dll",
+			"build/net6.0/Fw.Standard.targets":   "<Project />",
+		}),
+		"Fw.Tools": testPackage(t, "Fw.Tools", "1.0.0", "", map[string]string{
+			"tools/install.ps1": "",
+			"lib/readme.txt":    "not in a framework's folder",
+		}),
+	}
+}
+
+func TestPackageFrameworks(t *testing.T) {
+	want := map[string][]string{
+		"Fw.Net472":   {"net472"},
+		"Fw.Standard": {"net6.0", "netstandard2.0"},
+		"Fw.Tools":    nil,
+	}
+	for id, pkg := range frameworkPackages(t) {
+		if got := packageFrameworks(pkg); !reflect.DeepEqual(got, want[id]) {
+			t.Errorf("%s: got %v, want %v", id, got, want[id])
+		}
+	}
+	if got := packageFrameworks([]byte("not a zip")); got != nil {
+		t.Errorf("not a zip: got %v", got)
+	}
+}
+
+func TestSearchTargetFramework(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, pkg := range frameworkPackages(t) {
+		ts.mustPush(t, pkg)
+	}
+
+	// Recorded on the entry and served as a property
+	status, body := ts.get(t, "Packages(Id='Fw.Standard',Version='1.0.0')")
+	wantStatus(t, "entry", status, body, http.StatusOK)
+	if got := between(body, "<d:SupportedFrameworks>", "</d:SupportedFrameworks>"); got != "net6.0|netstandard2.0" {
+		t.Errorf("SupportedFrameworks %q", got)
+	}
+	status, body = ts.get(t, "Packages()?$filter=Id%20eq%20'Fw.Net472'&$format=json")
+	wantStatus(t, "json entry", status, body, http.StatusOK)
+	if !strings.Contains(body, `"SupportedFrameworks":"net472"`) {
+		t.Errorf("json entry %s", body)
+	}
+	status, body = ts.get(t, "$metadata")
+	wantStatus(t, "$metadata", status, body, http.StatusOK)
+	if !strings.Contains(body, `<Property Name="SupportedFrameworks"`) {
+		t.Error("$metadata does not declare SupportedFrameworks")
+	}
+
+	// Packages without framework folders match any framework
+	for _, tc := range []struct {
+		tf   string
+		want []string
+	}{
+		{"", []string{"Fw.Net472", "Fw.Standard", "Fw.Tools"}},
+		{"'net48'", []string{"Fw.Net472", "Fw.Tools"}},
+		{"'net45'", []string{"Fw.Tools"}},
+		{"'netstandard2.1'", []string{"Fw.Standard", "Fw.Tools"}},
+		{"'net7.0'", []string{"Fw.Standard", "Fw.Tools"}},
+		{"'net45|netstandard2.0'", []string{"Fw.Standard", "Fw.Tools"}},
+		{"'.NETFramework,Version=v4.8'", []string{"Fw.Net472", "Fw.Tools"}},
+	} {
+		status, body := ts.get(t, "Search()?searchTerm=''&targetFramework="+tc.tf)
+		wantStatus(t, tc.tf, status, body, http.StatusOK)
+		got := feedIDs(t, body)
+		sort.Strings(got)
+		for i := range got {
+			got[i] = strings.TrimSuffix(got[i], " 1.0.0")
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("targetFramework=%s: got %v, want %v", tc.tf, got, tc.want)
+		}
+	}
+
+	// And shown as badges
+	status, body = ts.get(t, "ui/Fw.Standard/1.0.0")
+	wantStatus(t, "ui", status, body, http.StatusOK)
+	for _, fw := range []string{"net6.0", "netstandard2.0"} {
+		if !strings.Contains(body, `<span class="badge">`+fw+`</span>`) {
+			t.Errorf("ui has no %s badge", fw)
+		}
+	}
+	status, body = ts.get(t, "ui/Fw.Tools/1.0.0")
+	wantStatus(t, "ui tools", status, body, http.StatusOK)
+	if strings.Contains(body, `class="badge"`) {
+		t.Error("ui has badges for a package without frameworks")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// withGalleryURLs returns copies of entries with their gallery details and report
+// abuse links pointing at the UI page and the configured report abuse URL. The
+// entries may be shared with other requests, so they aren't changed.
+func withGalleryURLs(entries []*NugetPackageEntry) []*NugetPackageEntry {
+	base := server.URL.String()
+	abuse := server.Config().ReportAbuseURL
+	list := make([]*NugetPackageEntry, 0, len(entries))
+	for _, e := range entries {
+		c := *e
+		id := url.PathEscape(c.Properties.ID)
+		ver := url.PathEscape(c.Properties.Version)
+		c.Properties.GalleryDetailsURL = base + "ui/" + id + "/" + ver
+		if abuse != "" {
+			c.Properties.ReportAbuseURL = expandPackageURL(abuse, id, ver)
+		}
+		list = append(list, &c)
+	}
+	return list
+}
+
+// deterministicEntries returns copies of entries with the fields that change between
+// requests, the download counts, zeroed when ?deterministic=1 is asked for, so
+// feeds from two servers with the same packages can be compared byte for byte.
+// Otherwise the entries are returned as they are.
+func deterministicEntries(r *http.Request, entries []*NugetPackageEntry) []*NugetPackageEntry {
+	if r.URL.Query().Get("deterministic") != "1" {
+		return entries
+	}
+	list := make([]*NugetPackageEntry, 0, len(entries))
+	for _, e := range entries {
+		c := *e
+		c.Properties.DownloadCount.Value = 0
+		c.Properties.VersionDownloadCount.Value = 0
+		list = append(list, &c)
+	}
+	return list
+}
+
+// expandPackageURL fills in {id} and {version} in a URL template, resolving it
+// against the server URL if relative
+func expandPackageURL(t string, id string, ver string) string {
+	s := strings.NewReplacer("{id}", id, "{version}", ver).Replace(t)
+	u, err := url.Parse(s)
+	if err != nil || u.IsAbs() {
+		return s
+	}
+	return server.URL.ResolveReference(u).String()
+}
+
+// servePackageAtom serves feed/{id}.atom, an Atom feed of a package's listed
+// versions, newest first, for owners to subscribe to
+func servePackageAtom(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len(server.URL.Path+`feed/`):]
+	if !strings.HasSuffix(name, ".atom") || strings.Contains(name, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := strings.TrimSuffix(name, ".atom")
+
+	entries, err := allPackageEntries(r.Context(), server.fs, id)
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if snap := requestSnapshot(r); snap != nil {
+		entries = snap.Filter(entries)
+	}
+
+	nf := NewNugetFeed(id, server.URL.String())
+	nf.Link[0].Href = `feed/` + url.PathEscape(id) + `.atom`
+	nf.ID = server.URL.String() + nf.Link[0].Href
+	for _, e := range entries {
+		if e.Properties.Listed.Value {
+			nf.Packages = append(nf.Packages, e)
+		}
+	}
+	if len(nf.Packages) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	nf.Packages = withGalleryURLs(nf.Packages)
+	nf.Packages = deterministicEntries(r, nf.Packages)
+
+	// Updated when the newest version was published
+	updated := nf.Packages[0].Properties.Published.Value
+	for _, e := range nf.Packages {
+		if e.Properties.Published.Value.After(updated) {
+			updated = e.Properties.Published.Value
+		}
+	}
+	nf.SetUpdated(updated)
+
+	b := nf.ToBytes()
+	w.Header().Set("Content-Type", "application/atom+xml;type=feed;charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
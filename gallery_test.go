@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGalleryURLs(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.ReportAbuseURL = "report?id={id}&v={version}" })
+	ts.mustPush(t, testPackage(t, "Gallery.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Gallery.Pkg", "2.0.0-beta", "", nil))
+
+	status, body := ts.get(t, "Packages(Id='Gallery.Pkg',Version='1.0.0')")
+	wantStatus(t, "entry", status, body, http.StatusOK)
+	if got, want := between(body, "<d:GalleryDetailsUrl>", "</d:GalleryDetailsUrl>"), ts.Feed+"ui/Gallery.Pkg/1.0.0"; got != want {
+		t.Errorf("GalleryDetailsUrl = %q, want %q", got, want)
+	}
+	if got, want := between(body, "<d:ReportAbuseUrl>", "</d:ReportAbuseUrl>"), ts.Feed+"report?id=Gallery.Pkg&amp;v=1.0.0"; got != want {
+		t.Errorf("ReportAbuseUrl = %q, want %q", got, want)
+	}
+
+	t.Run("atom", func(t *testing.T) {
+		status, body := ts.get(t, "feed/Gallery.Pkg.atom")
+		wantStatus(t, "atom", status, body, http.StatusOK)
+		if ids := feedIDs(t, body); len(ids) != 2 {
+			t.Errorf("atom feed has %v, want both versions", ids)
+		}
+		if !strings.Contains(body, `<id>`+ts.Feed+`feed/Gallery.Pkg.atom</id>`) {
+			t.Errorf("atom feed id isn't under the sub-path: %s", body)
+		}
+		status, _ = ts.get(t, "feed/No.Such.Pkg.atom")
+		wantStatus(t, "unknown ID", status, "", http.StatusNotFound)
+	})
+
+	// The links are set per request, so feeds read at once don't share them
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, body := ts.get(t, "FindPackagesById()?id='Gallery.Pkg'")
+				if status != http.StatusOK || !strings.Contains(body, ts.Feed+"ui/Gallery.Pkg/2.0.0-beta") {
+					t.Errorf("got %d %s", status, body)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/thatgitsam/go-nuget-server/adminpb"
+)
+
+// Versions listed per ListPackages page if the request doesn't say, and at most
+const (
+	defaultAdminListPageSize = 100
+	maxAdminListPageSize     = 1000
+)
+
+// adminGRPCKeyContextKey carries the API key a gRPC call was made with
+type adminGRPCKeyContextKey struct{}
+
+// validateAdminGRPC checks the admin-grpc-address config
+func validateAdminGRPC(c *Config) error {
+	if c.AdminGRPCAddress == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.AdminGRPCAddress); err != nil {
+		return errors.New("admin-grpc-address must be host:port: " + c.AdminGRPCAddress)
+	}
+	return nil
+}
+
+// startAdminGRPC serves the admin API over gRPC on addr in the background. Errors
+// that stop it are sent to errc.
+func startAdminGRPC(addr string, errc chan<- error) (*grpc.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	gs := newAdminGRPCServer()
+	log.Println("Serving the gRPC admin API on", l.Addr())
+	go func() {
+		if err := gs.Serve(l); err != nil {
+			errc <- err
+		}
+	}()
+	return gs, nil
+}
+
+// newAdminGRPCServer returns a gRPC server with the admin API registered
+func newAdminGRPCServer() *grpc.Server {
+	gs := grpc.NewServer(grpc.UnaryInterceptor(authorizeAdminGRPC))
+	adminpb.RegisterAdminServer(gs, adminGRPCServer{})
+	return gs
+}
+
+// stopAdminGRPC lets in-flight calls finish, unless ctx ends first
+func stopAdminGRPC(ctx context.Context, gs *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		gs.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		gs.Stop()
+	}
+}
+
+// Calls that change the feed, refused while it's read-only as their HTTP routes are
+var adminGRPCChanges = map[string]bool{
+	"/nugetserver.admin.Admin/Reextract":     true,
+	"/nugetserver.admin.Admin/SetListed":     true,
+	"/nugetserver.admin.Admin/DeleteVersion": true,
+}
+
+// authorizeAdminGRPC checks the x-nuget-apikey metadata of a call as the HTTP
+// routes check the header: listing packages needs read access, everything else a
+// read-write key. The call then reads the store as the key sees it.
+func authorizeAdminGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	key := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-nuget-apikey"); len(v) > 0 {
+			key = v[0]
+		}
+	}
+	a, err := server.fs.GetAccessLevel(ctx, key)
+	if err != nil {
+		return nil, adminGRPCError(err)
+	}
+	need := accessReadWrite
+	if info.FullMethod == "/nugetserver.admin.Admin/ListPackages" {
+		need = accessReadOnly
+	}
+	if a == accessDenied || (need == accessReadWrite && a != accessReadWrite) {
+		return nil, status.Error(codes.PermissionDenied, "API key does not allow "+info.FullMethod)
+	}
+	if adminGRPCChanges[info.FullMethod] && isReadOnly() {
+		return nil, status.Error(codes.Unavailable, "the feed is read-only")
+	}
+
+	ctx = context.WithValue(ctx, viewerContextKey{}, viewerFor(server.Config(), key))
+	ctx = context.WithValue(ctx, adminGRPCKeyContextKey{}, key)
+	return handler(ctx, req)
+}
+
+// adminGRPCError maps a store error to the gRPC status the HTTP routes' status
+// code corresponds to
+func adminGRPCError(err error) error {
+	switch {
+	case err == ErrFileNotFound:
+		return status.Error(codes.NotFound, "not found")
+	case err == ErrNotSupported:
+		return status.Error(codes.Unimplemented, "not supported by this filestore")
+	case err == ErrBusy:
+		return status.Error(codes.Unavailable, "store busy, try again")
+	case err == ErrStartAfterGone:
+		return status.Error(codes.InvalidArgument, "page token names a version no longer in the store")
+	case isCancelled(err):
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// adminGRPCServer implements the gRPC admin API over the same functions as the
+// HTTP admin routes
+type adminGRPCServer struct{}
+
+func (adminGRPCServer) Reextract(ctx context.Context, req *adminpb.ReextractRequest) (*adminpb.ReextractResponse, error) {
+	var list []*extractionStatus
+	switch {
+	case req.Id != "" && req.Version != "":
+		st, err := server.fs.ReextractPackage(ctx, req.Id, req.Version)
+		if err != nil {
+			return nil, adminGRPCError(err)
+		}
+		list = []*extractionStatus{st}
+	case req.Id == "" && req.Version == "":
+		var err error
+		if list, err = retryFailedExtractions(ctx); err != nil {
+			return nil, adminGRPCError(err)
+		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, "id and version must be given together")
+	}
+
+	res := &adminpb.ReextractResponse{}
+	for _, st := range list {
+		res.Statuses = append(res.Statuses, &adminpb.ExtractionStatus{
+			Id:      st.ID,
+			Version: st.Version,
+			Status:  st.Status,
+			Error:   st.Error,
+			Time:    st.Time.UTC().Format(time.RFC3339),
+		})
+	}
+	return res, nil
+}
+
+func (adminGRPCServer) GetCacheStats(ctx context.Context, req *adminpb.GetCacheStatsRequest) (*adminpb.CacheStats, error) {
+	if server.cache == nil {
+		return nil, status.Error(codes.NotFound, "no package cache is configured")
+	}
+	st := server.cache.Stats()
+	return &adminpb.CacheStats{
+		Hits:          st.Hits,
+		Misses:        st.Misses,
+		Evictions:     st.Evictions,
+		Invalidations: st.Invalidations,
+		Entries:       int64(st.Entries),
+		Bytes:         st.Bytes,
+		MaxBytes:      st.MaxBytes,
+	}, nil
+}
+
+func (adminGRPCServer) ListPackages(ctx context.Context, req *adminpb.ListPackagesRequest) (*adminpb.ListPackagesResponse, error) {
+	size := int(req.PageSize)
+	if size <= 0 {
+		size = defaultAdminListPageSize
+	} else if size > maxAdminListPageSize {
+		size = maxAdminListPageSize
+	}
+
+	// Paged as the feed is, the token is the last version's "{id}.{version}"
+	page, more, err := server.fs.GetPackageFeedEntries(ctx, req.Id, req.PageToken, size)
+	if err != nil {
+		return nil, adminGRPCError(err)
+	}
+	res := &adminpb.ListPackagesResponse{}
+	for _, e := range page {
+		p := e.Properties
+		res.Packages = append(res.Packages, &adminpb.PackageVersion{
+			Id:            p.ID,
+			Version:       p.Version,
+			Listed:        p.Listed.Value,
+			Size:          int64(p.PackageSize.Value),
+			Hash:          p.PackageHash,
+			HashAlgorithm: p.PackageHashAlgorithm,
+			Published:     p.Published.Value.UTC().Format(time.RFC3339),
+		})
+	}
+	if more && len(page) > 0 {
+		last := page[len(page)-1].Properties
+		res.NextPageToken = last.ID + "." + last.Version
+	}
+	return res, nil
+}
+
+func (adminGRPCServer) SetListed(ctx context.Context, req *adminpb.SetListedRequest) (*adminpb.SetListedResponse, error) {
+	if req.Id == "" || req.Version == "" {
+		return nil, status.Error(codes.InvalidArgument, "id and version are required")
+	}
+
+	// Changing a version is governed by the same ID policies as publishing it
+	key, _ := ctx.Value(adminGRPCKeyContextKey{}).(string)
+	if err := idPolicyError(server.Config(), req.Id, key); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if err := server.fs.SetListed(ctx, req.Id, req.Version, req.Listed); err != nil {
+		return nil, adminGRPCError(err)
+	}
+	return &adminpb.SetListedResponse{}, nil
+}
+
+func (adminGRPCServer) GetHealth(ctx context.Context, req *adminpb.GetHealthRequest) (*adminpb.Health, error) {
+	h := currentHealth()
+	res := &adminpb.Health{Status: h.Status}
+	for _, p := range h.Problems {
+		res.Problems = append(res.Problems, &adminpb.HealthProblem{
+			Component: p.Component,
+			Message:   p.Message,
+			Since:     p.Since.UTC().Format(time.RFC3339),
+		})
+	}
+	return res, nil
+}
+
+func (adminGRPCServer) DeleteVersion(ctx context.Context, req *adminpb.DeleteVersionRequest) (*adminpb.DeleteVersionResponse, error) {
+	if req.Id == "" || req.Version == "" {
+		return nil, status.Error(codes.InvalidArgument, "id and version are required")
+	}
+
+	// Deleting a version is governed by the same ID policies as publishing it
+	key, _ := ctx.Value(adminGRPCKeyContextKey{}).(string)
+	if err := idPolicyError(server.Config(), req.Id, key); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	var protected *deleteProtectionError
+	if err := checkDeleteProtection(ctx, req.Id, req.Version); errors.As(err, &protected) {
+		return nil, status.Error(codes.FailedPrecondition, protected.Error())
+	} else if err != nil {
+		return nil, adminGRPCError(err)
+	}
+	unlisted, err := deleteVersion(ctx, req.Id, req.Version)
+	if err != nil {
+		return nil, adminGRPCError(err)
+	}
+	return &adminpb.DeleteVersionResponse{Unlisted: unlisted}, nil
+}
+
+func (adminGRPCServer) Reindex(ctx context.Context, req *adminpb.ReindexRequest) (*adminpb.ReindexResponse, error) {
+	n, err := server.fs.Reindex(ctx)
+	if err != nil {
+		return nil, adminGRPCError(err)
+	}
+	return &adminpb.ReindexResponse{Packages: int64(n)}, nil
+}
+
+func (adminGRPCServer) SetReadOnly(ctx context.Context, req *adminpb.SetReadOnlyRequest) (*adminpb.ReadOnlyState, error) {
+	setReadOnly(req.ReadOnly)
+	return &adminpb.ReadOnlyState{ReadOnly: isReadOnly()}, nil
+}
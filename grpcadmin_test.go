@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/thatgitsam/go-nuget-server/adminpb"
+)
+
+// newAdminGRPCClient serves the admin API over an in-memory connection
+func newAdminGRPCClient(t *testing.T) adminpb.AdminClient {
+	t.Helper()
+	l := bufconn.Listen(1 << 20)
+	gs := newAdminGRPCServer()
+	go gs.Serve(l)
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+		return l.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		gs.Stop()
+	})
+	return adminpb.NewAdminClient(conn)
+}
+
+// withKey sends a call with an API key
+func withKey(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-nuget-apikey", key)
+}
+
+func wantCode(t *testing.T, what string, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Errorf("%s: got %v (%v), want %v", what, got, err, want)
+	}
+}
+
+func TestAdminGRPC(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Grpc.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Grpc.Pkg", "2.0.0", "", nil))
+	c := newAdminGRPCClient(t)
+	rw := withKey(testWriteKey)
+
+	t.Run("auth", func(t *testing.T) {
+		_, err := c.ListPackages(withKey(testReadKey), &adminpb.ListPackagesRequest{})
+		wantCode(t, "list with a read key", err, codes.OK)
+		for name, call := range map[string]func(ctx context.Context) error{
+			"DeleteVersion": func(ctx context.Context) error {
+				_, err := c.DeleteVersion(ctx, &adminpb.DeleteVersionRequest{Id: "Grpc.Pkg", Version: "1.0.0"})
+				return err
+			},
+			"Reindex": func(ctx context.Context) error {
+				_, err := c.Reindex(ctx, &adminpb.ReindexRequest{})
+				return err
+			},
+			"SetReadOnly": func(ctx context.Context) error {
+				_, err := c.SetReadOnly(ctx, &adminpb.SetReadOnlyRequest{ReadOnly: true})
+				return err
+			},
+		} {
+			wantCode(t, name+" with a read key", call(withKey(testReadKey)), codes.PermissionDenied)
+			wantCode(t, name+" without a key", call(context.Background()), codes.PermissionDenied)
+		}
+		if isReadOnly() {
+			t.Error("read-only set by a read key")
+		}
+	})
+
+	t.Run("DeleteVersion", func(t *testing.T) {
+		res, err := c.DeleteVersion(rw, &adminpb.DeleteVersionRequest{Id: "grpc.pkg", Version: "1.0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Unlisted {
+			t.Error("deleted version reported unlisted")
+		}
+		status, body := ts.get(t, "Packages(Id='Grpc.Pkg',Version='1.0.0')")
+		wantStatus(t, "deleted version", status, body, http.StatusNotFound)
+
+		_, err = c.DeleteVersion(rw, &adminpb.DeleteVersionRequest{Id: "Grpc.Pkg", Version: "1.0.0"})
+		wantCode(t, "delete again", err, codes.NotFound)
+		_, err = c.DeleteVersion(rw, &adminpb.DeleteVersionRequest{Id: "Grpc.Pkg"})
+		wantCode(t, "delete without a version", err, codes.InvalidArgument)
+	})
+
+	t.Run("Reindex", func(t *testing.T) {
+		// A version copied into the store by hand is found by a reindex
+		copyPackage(t, server.Config(), "Grpc.Other", "1.0.0", testPackage(t, "Grpc.Other", "1.0.0", "", nil))
+		res, err := c.Reindex(rw, &adminpb.ReindexRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Packages != 2 {
+			t.Errorf("reindex found %d packages, want 2", res.Packages)
+		}
+		status, body := ts.get(t, "Packages(Id='Grpc.Other',Version='1.0.0')")
+		wantStatus(t, "reindexed version", status, body, http.StatusOK)
+	})
+
+	t.Run("SetReadOnly", func(t *testing.T) {
+		res, err := c.SetReadOnly(rw, &adminpb.SetReadOnlyRequest{ReadOnly: true})
+		if err != nil || !res.ReadOnly {
+			t.Fatalf("got %v, %v", res, err)
+		}
+		defer setReadOnly(false)
+
+		status, body := ts.push(t, testPackage(t, "Grpc.Pkg", "3.0.0", "", nil))
+		wantStatus(t, "push while read-only", status, body, http.StatusServiceUnavailable)
+		_, err = c.DeleteVersion(rw, &adminpb.DeleteVersionRequest{Id: "Grpc.Pkg", Version: "2.0.0"})
+		wantCode(t, "delete while read-only", err, codes.Unavailable)
+		_, err = c.SetListed(rw, &adminpb.SetListedRequest{Id: "Grpc.Pkg", Version: "2.0.0"})
+		wantCode(t, "unlist while read-only", err, codes.Unavailable)
+		status, body = ts.get(t, "Packages(Id='Grpc.Pkg',Version='2.0.0')")
+		wantStatus(t, "read while read-only", status, body, http.StatusOK)
+		_, err = c.ListPackages(rw, &adminpb.ListPackagesRequest{})
+		wantCode(t, "list while read-only", err, codes.OK)
+
+		if res, err = c.SetReadOnly(rw, &adminpb.SetReadOnlyRequest{}); err != nil || res.ReadOnly {
+			t.Fatalf("got %v, %v", res, err)
+		}
+		ts.mustPush(t, testPackage(t, "Grpc.Pkg", "3.0.0", "", nil))
+	})
+}
+
+func TestReadOnlyHTTP(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer setReadOnly(false)
+	ts.mustPush(t, testPackage(t, "Ro.Pkg", "1.0.0", "", nil))
+
+	put := func(body string) (int, string) {
+		return readResponse(t, ts.do(t, http.MethodPut, "admin/read-only", testWriteKey, strings.NewReader(body), nil))
+	}
+	status, body := put(`{"readOnly": true}`)
+	wantStatus(t, "set read-only", status, body, http.StatusOK)
+	if body != `{"readOnly":true}` {
+		t.Errorf("got %s", body)
+	}
+
+	status, body = readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Ro.Pkg/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete while read-only", status, body, http.StatusServiceUnavailable)
+	status, body = readResponse(t, ts.do(t, http.MethodPost, "admin/reindex", testWriteKey, nil, nil))
+	wantStatus(t, "reindex while read-only", status, body, http.StatusOK)
+	if body != `{"packages":1}` {
+		t.Errorf("reindex: got %s", body)
+	}
+
+	status, body = put(`nope`)
+	wantStatus(t, "bad body", status, body, http.StatusBadRequest)
+	status, body = put(`{"readOnly": false}`)
+	wantStatus(t, "clear read-only", status, body, http.StatusOK)
+	status, body = readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Ro.Pkg/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete", status, body, http.StatusNoContent)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// API keys every test server accepts
+const (
+	testReadKey  = "test-read"
+	testWriteKey = "test-write"
+)
+
+// Layout of the local store test servers use, unless a test sets its own
+var testLayout = layoutHierarchical
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	// The feed must behave the same whichever layout the store has, so the
+	// suite runs against both
+	code := m.Run()
+	if code == 0 {
+		testLayout = layoutFlat
+		code = m.Run()
+	}
+	os.Exit(code)
+}
+
+// testServer is the feed served over HTTP for a test, from a local store in a
+// temp directory. Only one runs at a time, as the server is global.
+type testServer struct {
+	*httptest.Server
+	Dir  string // Holds the config and the store
+	Root string // The local store's directory
+	Feed string // The feed's URL, ending in /
+
+	srv  *Server // What it serves, the global server while it's running
+	stop sync.Once
+}
+
+// runningTestServer is the test server serving now, shut down before another
+// takes its place
+var runningTestServer *testServer
+
+// newTestServer starts a feed at /feed/ with a read key and a read-write key.
+// configure may change the config before the server starts.
+func newTestServer(t *testing.T, configure func(c *Config)) *testServer {
+	t.Helper()
+	ts := &testServer{Server: httptest.NewUnstartedServer(http.HandlerFunc(handleRequest)), Dir: t.TempDir()}
+	ts.Root = filepath.Join(ts.Dir, "store")
+	ts.Feed = "http://" + ts.Listener.Addr().String() + "/feed/"
+
+	c := defaultConfig()
+	c.HostURL = ts.Feed
+	c.FileStore.Type = "local"
+	c.FileStore.RepoDIR = ts.Root
+	c.FileStore.APIKeys.ReadOnly = []string{testReadKey}
+	c.FileStore.APIKeys.ReadWrite = []string{testWriteKey}
+	c.FileStore.Layout = testLayout
+	if configure != nil {
+		configure(c)
+	}
+	t.Logf("local store in the %s layout", c.FileStore.Layout)
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := filepath.Join(ts.Dir, "config.json")
+	if err := ioutil.WriteFile(cf, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server is global, so one still serving from earlier in the test
+	// mustn't be handling requests when it's replaced
+	if runningTestServer != nil {
+		runningTestServer.shutdown()
+	}
+	server = InitServer(cf)
+	ts.srv = server
+	ts.Start()
+	runningTestServer = ts
+	t.Cleanup(ts.shutdown)
+	return ts
+}
+
+// shutdown stops serving, waiting for requests in progress, and flushes what the
+// server has pending. Only the first call does anything.
+func (ts *testServer) shutdown() {
+	ts.stop.Do(func() {
+		ts.Close()
+		ts.srv.downloads.Close()
+		ts.srv.idempotency.Save()
+		if runningTestServer == ts {
+			runningTestServer = nil
+		}
+	})
+}
+
+// restart replaces the server with one loaded again from the same config and
+// store, as after a restart of the process
+func (ts *testServer) restart(t *testing.T) {
+	t.Helper()
+	ts.srv.downloads.Close()
+	ts.srv.idempotency.Save()
+	server = InitServer(filepath.Join(ts.Dir, "config.json"))
+	ts.srv = server
+}
+
+// nupkgPath returns where the store keeps a version's nupkg
+func (ts *testServer) nupkgPath(t *testing.T, id string, ver string) string {
+	t.Helper()
+	return ts.local(t).nupkgPath(id, ver)
+}
+
+// versionDir returns where the store keeps a version's extracted content and markers
+func (ts *testServer) versionDir(t *testing.T, id string, ver string) string {
+	t.Helper()
+	return ts.local(t).versionDir(id, ver)
+}
+
+// copiedPackagePath returns where a package copied into a store by hand goes in
+// the store's layout
+func copiedPackagePath(c *Config, id string, ver string) string {
+	id = strings.ToLower(id)
+	if c.FileStore.Layout == layoutFlat {
+		return filepath.Join(c.FileStore.RepoDIR, id+"."+ver+".nupkg")
+	}
+	return filepath.Join(c.FileStore.RepoDIR, id, ver, id+"."+ver+".nupkg")
+}
+
+// copyPackage writes a package into a store by hand, where its layout expects it
+func copyPackage(t *testing.T, c *Config, id string, ver string, pkg []byte) {
+	t.Helper()
+	fp := copiedPackagePath(c, id, ver)
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp, pkg, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ts *testServer) local(t *testing.T) *fileStoreLocal {
+	t.Helper()
+	src, _, _ := server.migration.stores()
+	local, ok := src.(*fileStoreLocal)
+	if !ok {
+		t.Fatalf("store is a %T", src)
+	}
+	return local
+}
+
+// testPackage builds a nupkg. metadata is added to the nuspec's <metadata> and
+// files maps paths in the package to their content.
+func testPackage(t *testing.T, id string, ver string, metadata string, files map[string]string) []byte {
+	t.Helper()
+	nuspec := `<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://schemas.microsoft.com/packaging/2010/07/nuspec.xsd">
+  <metadata>
+    <id>` + id + `</id>
+    <version>` + ver + `</version>
+    <authors>Tester</authors>
+    <description>Description of ` + id + `</description>
+    ` + metadata + `
+  </metadata>
+</package>`
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	entries := map[string]string{id + ".nuspec": nuspec}
+	for p, c := range files {
+		entries[p] = c
+	}
+	for p, c := range entries {
+		w, err := zw.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// do sends a request to a path under the feed with an API key, if not empty
+func (ts *testServer) do(t *testing.T, method string, p string, key string, body io.Reader, header http.Header) *http.Response {
+	t.Helper()
+	r, err := http.NewRequest(method, ts.Feed+p, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if key != "" {
+		r.Header.Set("X-NuGet-ApiKey", key)
+	}
+	resp, err := ts.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// get fetches a path under the feed with the read key, returning the status and body
+func (ts *testServer) get(t *testing.T, p string) (int, string) {
+	t.Helper()
+	return readResponse(t, ts.do(t, http.MethodGet, p, testReadKey, nil, nil))
+}
+
+// push sends a package as nuget.exe does, returning the status and body
+func (ts *testServer) push(t *testing.T, pkg []byte) (int, string) {
+	t.Helper()
+	return readResponse(t, ts.pushTo(t, "api/v2/package/", testWriteKey, pkg))
+}
+
+// pushTo sends a package as a multipart PUT to a path under the feed
+func (ts *testServer) pushTo(t *testing.T, p string, key string, pkg []byte) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("package", "package.nupkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(pkg)
+	mw.Close()
+	return ts.do(t, http.MethodPut, p, key, &buf, http.Header{"Content-Type": {mw.FormDataContentType()}})
+}
+
+// mustPush pushes a package, failing the test unless it is stored
+func (ts *testServer) mustPush(t *testing.T, pkg []byte) {
+	t.Helper()
+	if status, body := ts.push(t, pkg); status != http.StatusCreated {
+		t.Fatalf("push: got %d %s, want 201", status, body)
+	}
+}
+
+// readResponse reads and closes a response's body
+func readResponse(t *testing.T, resp *http.Response) (int, string) {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// wantStatus fails the test unless a response has the status expected
+func wantStatus(t *testing.T, what string, got int, body string, want int) {
+	t.Helper()
+	if got != want {
+		if len(body) > 300 {
+			body = body[:300] + "..."
+		}
+		t.Fatalf("%s: got %d %s, want %d", what, got, strings.TrimSpace(body), want)
+	}
+}
+
+// feedIDs returns the package ID and version of each entry of an Atom feed
+func feedIDs(t *testing.T, feed string) []string {
+	t.Helper()
+	var ids []string
+	for _, e := range strings.Split(feed, "<entry>")[1:] {
+		id := between(e, "<d:Id>", "</d:Id>")
+		ver := between(e, "<d:Version>", "</d:Version>")
+		ids = append(ids, fmt.Sprintf("%s %s", id, ver))
+	}
+	return ids
+}
+
+// between returns the text of s between two markers, empty if they aren't there
+func between(s string, start string, end string) string {
+	i := strings.Index(s, start)
+	if i < 0 {
+		return ""
+	}
+	s = s[i+len(start):]
+	if j := strings.Index(s, end); j >= 0 {
+		return s[:j]
+	}
+	return ""
+}
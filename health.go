@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// healthProblem is something the server carried on despite, which an operator
+// should look at
+type healthProblem struct {
+	Component string    `json:"component"`
+	Message   string    `json:"message"`
+	Since     time.Time `json:"since"`
+}
+
+// healthRegistry collects the problems the server is running with, as served by statusz
+type healthRegistry struct {
+	lock     sync.Mutex
+	problems map[string]*healthProblem
+}
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{problems: make(map[string]*healthProblem)}
+}
+
+// Degrade records a problem with a component, replacing any recorded before
+func (h *healthRegistry) Degrade(component string, msg string) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.problems[component] = &healthProblem{Component: component, Message: msg, Since: time.Now().UTC()}
+}
+
+// Recover clears a component's problem
+func (h *healthRegistry) Recover(component string) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.problems, component)
+}
+
+// List returns the problems, ordered by component
+func (h *healthRegistry) List() []healthProblem {
+	list := []healthProblem{}
+	if h == nil {
+		return list
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, p := range h.problems {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Component < list[j].Component })
+	return list
+}
+
+// healthStatus is the server's health as served by statusz
+type healthStatus struct {
+	Status   string          `json:"status"`
+	Problems []healthProblem `json:"problems"`
+}
+
+// currentHealth returns "ok", or "degraded" with the problems found
+func currentHealth() healthStatus {
+	res := healthStatus{Status: "ok", Problems: server.health.List()}
+	if len(res.Problems) > 0 {
+		res.Status = "degraded"
+	}
+	return res
+}
+
+// serveStatusz handles GET statusz
+func serveStatusz(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(currentHealth())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,185 @@
+// Package hooks lets a deployment add its own policy to the push pipeline.
+//
+// A PushInterceptor is registered in code under a name, usually from an init
+// function, and the server runs the ones its config names, in order, for every
+// package pushed: Validate can refuse the push, Mutate can change the package
+// before it is stored, and AfterStore is told once it has been.
+package hooks
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+
+	nuspec "github.com/soloworks/go-nuspec"
+)
+
+// PushInterceptor is site specific policy run on every pushed package
+type PushInterceptor interface {
+	// Validate refuses the push by returning an error. A *Rejection chooses
+	// between 400 and 403, any other error is a 400.
+	Validate(ctx context.Context, p *PackageInfo) error
+	// Mutate changes the package before it is stored, through SetBytes. An error
+	// refuses the push as Validate's do.
+	Mutate(ctx context.Context, p *PackageInfo) error
+	// AfterStore is called once the package is stored or quarantined
+	AfterStore(ctx context.Context, p *PackageInfo)
+}
+
+// Factory makes an interceptor from its config, which is nil if none is given
+type Factory func(config json.RawMessage) (PushInterceptor, error)
+
+// Rejection is a refused push. Forbidden answers it with 403 rather than 400.
+type Rejection struct {
+	Forbidden bool
+	Reason    string
+}
+
+func (r *Rejection) Error() string {
+	return r.Reason
+}
+
+// Reject returns a Rejection answered with 400
+func Reject(reason string) error {
+	return &Rejection{Reason: reason}
+}
+
+// Forbid returns a Rejection answered with 403
+func Forbid(reason string) error {
+	return &Rejection{Forbidden: true, Reason: reason}
+}
+
+// PackageInfo is a pushed package as interceptors see it
+type PackageInfo struct {
+	// Nuspec is the package's parsed nuspec
+	Nuspec *nuspec.NuSpec
+	// Size of the package in bytes
+	Size int
+	// Hash is the hex SHA512 of the package
+	Hash string
+	// APIKey the package was pushed with
+	APIKey string
+	// RemoteAddr the package was pushed from
+	RemoteAddr string
+
+	data  []byte
+	parse func([]byte) (*nuspec.NuSpec, error)
+}
+
+// NewPackageInfo returns the info of a package, parsing its nuspec with parse
+func NewPackageInfo(data []byte, parse func([]byte) (*nuspec.NuSpec, error)) (*PackageInfo, error) {
+	p := &PackageInfo{parse: parse}
+	if err := p.SetBytes(data); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Bytes returns the package file. It must not be modified, use SetBytes.
+func (p *PackageInfo) Bytes() []byte {
+	return p.data
+}
+
+// SetBytes replaces the package file, updating the nuspec, size and hash. The
+// package is left unchanged if its nuspec can't be read.
+func (p *PackageInfo) SetBytes(data []byte) error {
+	nsf, err := p.parse(data)
+	if err != nil {
+		return err
+	}
+	h := sha512.Sum512(data)
+	p.Nuspec = nsf
+	p.Size = len(data)
+	p.Hash = hex.EncodeToString(h[:])
+	p.data = data
+	return nil
+}
+
+// Chain is interceptors run in order
+type Chain []PushInterceptor
+
+// Validate runs each interceptor's Validate, stopping at the first error
+func (c Chain) Validate(ctx context.Context, p *PackageInfo) error {
+	for _, i := range c {
+		if err := i.Validate(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mutate runs each interceptor's Mutate, stopping at the first error. Each sees
+// the package as the ones before it left it.
+func (c Chain) Mutate(ctx context.Context, p *PackageInfo) error {
+	for _, i := range c {
+		if err := i.Mutate(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AfterStore runs each interceptor's AfterStore
+func (c Chain) AfterStore(ctx context.Context, p *PackageInfo) {
+	for _, i := range c {
+		i.AfterStore(ctx, p)
+	}
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]Factory{}
+)
+
+// Register makes an interceptor available under a name. It panics if the name
+// is taken, as two interceptors sharing one is a programming error.
+func Register(name string, f Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if f == nil {
+		panic("hooks: Register factory is nil for " + name)
+	}
+	if _, ok := registry[name]; ok {
+		panic("hooks: Register called twice for " + name)
+	}
+	registry[name] = f
+}
+
+// New makes the interceptor registered under a name
+func New(name string, config json.RawMessage) (PushInterceptor, error) {
+	registryLock.RLock()
+	f, ok := registry[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown push interceptor " + name)
+	}
+	return f(config)
+}
+
+// Names returns the registered interceptor names, sorted
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	var names []string
+	for n := range registry {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Base can be embedded by interceptors that only implement some of the methods
+type Base struct{}
+
+// Validate accepts every package
+func (Base) Validate(ctx context.Context, p *PackageInfo) error { return nil }
+
+// Mutate leaves the package as it is
+func (Base) Mutate(ctx context.Context, p *PackageInfo) error { return nil }
+
+// AfterStore does nothing
+func (Base) AfterStore(ctx context.Context, p *PackageInfo) {}
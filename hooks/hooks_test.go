@@ -0,0 +1,169 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	nuspec "github.com/soloworks/go-nuspec"
+)
+
+// recorder notes each call made to it, failing the ones named in fail
+type recorder struct {
+	name  string
+	calls *[]string
+	fail  map[string]error
+}
+
+func (r recorder) call(method string) error {
+	*r.calls = append(*r.calls, r.name+"."+method)
+	return r.fail[method]
+}
+
+func (r recorder) Validate(ctx context.Context, p *PackageInfo) error {
+	return r.call("validate")
+}
+
+func (r recorder) Mutate(ctx context.Context, p *PackageInfo) error {
+	if err := r.call("mutate"); err != nil {
+		return err
+	}
+	// Each sees what the ones before it left
+	return p.SetBytes(append(p.Bytes(), r.name...))
+}
+
+func (r recorder) AfterStore(ctx context.Context, p *PackageInfo) {
+	r.call("after")
+}
+
+// parseTest reads a package made of its ID, so SetBytes has something to parse
+func parseTest(b []byte) (*nuspec.NuSpec, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty package")
+	}
+	nsf := &nuspec.NuSpec{}
+	nsf.Meta.ID = string(b)
+	return nsf, nil
+}
+
+func TestChain(t *testing.T) {
+	reject := Reject("no")
+	for _, tc := range []struct {
+		name     string
+		fail     map[string]map[string]error // Methods failing, by interceptor
+		validate error
+		mutate   error
+		calls    []string
+		pkg      string // Package after Mutate
+	}{
+		{name: "all pass",
+			calls: []string{"a.validate", "b.validate", "c.validate", "a.mutate", "b.mutate", "c.mutate", "a.after", "b.after", "c.after"},
+			pkg:   "pkgabc"},
+		{name: "validate fails", fail: map[string]map[string]error{"b": {"validate": reject}}, validate: reject,
+			calls: []string{"a.validate", "b.validate", "a.mutate", "b.mutate", "c.mutate", "a.after", "b.after", "c.after"},
+			pkg:   "pkgabc"},
+		{name: "mutate fails", fail: map[string]map[string]error{"a": {"mutate": reject}}, mutate: reject,
+			calls: []string{"a.validate", "b.validate", "c.validate", "a.mutate", "a.after", "b.after", "c.after"},
+			pkg:   "pkg"},
+		{name: "last mutate fails", fail: map[string]map[string]error{"c": {"mutate": reject}}, mutate: reject,
+			calls: []string{"a.validate", "b.validate", "c.validate", "a.mutate", "b.mutate", "c.mutate", "a.after", "b.after", "c.after"},
+			pkg:   "pkgab"},
+	} {
+		var calls []string
+		var chain Chain
+		for _, n := range []string{"a", "b", "c"} {
+			chain = append(chain, recorder{name: n, calls: &calls, fail: tc.fail[n]})
+		}
+		p, err := NewPackageInfo([]byte("pkg"), parseTest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The chain stops at the first error and returns it as is, the caller
+		// deciding whether to go on
+		if err := chain.Validate(context.Background(), p); err != tc.validate {
+			t.Errorf("%s: Validate returned %v, want %v", tc.name, err, tc.validate)
+		}
+		if err := chain.Mutate(context.Background(), p); err != tc.mutate {
+			t.Errorf("%s: Mutate returned %v, want %v", tc.name, err, tc.mutate)
+		}
+		chain.AfterStore(context.Background(), p)
+		if !reflect.DeepEqual(calls, tc.calls) {
+			t.Errorf("%s: got calls %q, want %q", tc.name, calls, tc.calls)
+		}
+		if string(p.Bytes()) != tc.pkg || p.Nuspec.Meta.ID != tc.pkg || p.Size != len(tc.pkg) {
+			t.Errorf("%s: package %q, id %q, size %d, want %q", tc.name, p.Bytes(), p.Nuspec.Meta.ID, p.Size, tc.pkg)
+		}
+	}
+}
+
+// A package that can't be parsed is refused, leaving the one before
+func TestSetBytes(t *testing.T) {
+	p, err := NewPackageInfo([]byte("pkg"), parseTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := p.Hash
+	if err := p.SetBytes(nil); err == nil {
+		t.Error("SetBytes of an empty package succeeded")
+	}
+	if string(p.Bytes()) != "pkg" || p.Hash != hash || p.Size != 3 {
+		t.Errorf("after a failed SetBytes: %q %s %d", p.Bytes(), p.Hash, p.Size)
+	}
+	if _, err := NewPackageInfo(nil, parseTest); err == nil {
+		t.Error("NewPackageInfo of an empty package succeeded")
+	}
+}
+
+func TestRejection(t *testing.T) {
+	var rej *Rejection
+	if err := Forbid("reserved"); !errors.As(err, &rej) || !rej.Forbidden || err.Error() != "reserved" {
+		t.Errorf("Forbid: %#v", err)
+	}
+	if err := Reject("invalid"); !errors.As(err, &rej) || rej.Forbidden || err.Error() != "invalid" {
+		t.Errorf("Reject: %#v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var got json.RawMessage
+	Register("test-registry", func(config json.RawMessage) (PushInterceptor, error) {
+		got = config
+		if string(config) == "bad" {
+			return nil, errors.New("bad config")
+		}
+		return Base{}, nil
+	})
+	if i, err := New("test-registry", json.RawMessage(`{"x":1}`)); err != nil || i == nil || string(got) != `{"x":1}` {
+		t.Errorf("New: %v, %v, config %s", i, err, got)
+	}
+	if _, err := New("test-registry", json.RawMessage("bad")); err == nil || err.Error() != "bad config" {
+		t.Errorf("New with a bad config: %v", err)
+	}
+	if _, err := New("test-missing", nil); err == nil || !strings.Contains(err.Error(), "unknown push interceptor test-missing") {
+		t.Errorf("New of a missing name: %v", err)
+	}
+	found := false
+	for _, n := range Names() {
+		found = found || n == "test-registry"
+	}
+	if !found {
+		t.Errorf("Names: %q", Names())
+	}
+
+	for name, f := range map[string]Factory{
+		"test-registry": func(json.RawMessage) (PushInterceptor, error) { return Base{}, nil },
+		"test-nil":      nil,
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register %s: no panic", name)
+				}
+			}()
+			Register(name, f)
+		}()
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long an Idempotency-Key is remembered if idempotency-window isn't set
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// How often remembered keys are written out, if any changed
+const idempotencySaveInterval = time.Minute
+
+// Longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
+// Largest request body taken with an Idempotency-Key, and response body remembered.
+// Admin requests are far smaller, a larger response is not remembered.
+const maxIdempotentBodyBytes = 1 << 20
+
+// idempotentResponse is a mutating admin request's response, kept so a retry with
+// the same Idempotency-Key gets it again rather than repeating the change
+type idempotentResponse struct {
+	// Hash of the method, URL and body the key was first used with
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"contentType,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	Expires     time.Time `json:"expires"`
+	// Still being handled, not yet answered
+	pending bool
+}
+
+// idempotencyStore remembers responses by Idempotency-Key, in memory and beside a
+// local repo so retries across a restart are still recognised
+type idempotencyStore struct {
+	lock    sync.Mutex
+	path    string
+	dirty   bool
+	Records map[string]*idempotentResponse `json:"records"`
+}
+
+// loadIdempotencyStore reads remembered responses from path, which may be empty to
+// keep them in memory only. A usable store is returned even with an error.
+func loadIdempotencyStore(path string) (*idempotencyStore, error) {
+	s := &idempotencyStore{path: path, Records: make(map[string]*idempotentResponse)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		s.Records = make(map[string]*idempotentResponse)
+		return s, err
+	}
+	return s, nil
+}
+
+// idempotencyWindow returns how long responses are remembered
+func idempotencyWindow(c *Config) time.Duration {
+	if d, err := time.ParseDuration(c.IdempotencyWindow); err == nil && d > 0 {
+		return d
+	}
+	return defaultIdempotencyWindow
+}
+
+// validateIdempotency checks the idempotency-window config
+func validateIdempotency(c *Config) error {
+	if c.IdempotencyWindow == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(c.IdempotencyWindow); err != nil || d <= 0 {
+		return errors.New("idempotency-window must be a positive duration: " + c.IdempotencyWindow)
+	}
+	return nil
+}
+
+// isIdempotentRoute reports whether a request is an admin mutation, or a package
+// delete, that takes an Idempotency-Key
+func isIdempotentRoute(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch:
+		if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, server.URL.Path+`api/v2/package/`) {
+			return true
+		}
+		return strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/`) || strings.HasPrefix(r.URL.Path, server.URL.Path+`api/admin/`)
+	}
+	return false
+}
+
+// idempotencyWriter keeps a copy of the response to a request with an Idempotency-Key
+type idempotencyWriter struct {
+	http.ResponseWriter
+	key      string
+	buf      bytes.Buffer
+	tooLarge bool
+}
+
+func (iw *idempotencyWriter) Write(b []byte) (int, error) {
+	if !iw.tooLarge {
+		if iw.buf.Len()+len(b) > maxIdempotentBodyBytes {
+			iw.tooLarge = true
+			iw.buf = bytes.Buffer{}
+		} else {
+			iw.buf.Write(b)
+		}
+	}
+	return iw.ResponseWriter.Write(b)
+}
+
+// Begin handles the Idempotency-Key of a mutating admin request. A replay of an
+// answered request is sent its response again, and a key reused for a different
+// request, or while the first is still being handled, gets a 409. Either way it
+// returns false and the request is done. Otherwise it returns true and sw keeps a
+// copy of the response for Finish.
+func (s *idempotencyStore) Begin(sw *statusWriter, r *http.Request) bool {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength || strings.IndexFunc(key, func(c rune) bool { return c < 0x21 || c > 0x7e }) >= 0 {
+		writeIdempotencyError(sw, http.StatusBadRequest, "Idempotency-Key must be at most "+strconv.Itoa(maxIdempotencyKeyLength)+" printable ASCII characters")
+		return false
+	}
+
+	// The body is read here to be hashed, and handed on to the handler
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxIdempotentBodyBytes+1))
+	if err != nil {
+		writeIdempotencyError(sw, http.StatusBadRequest, "error reading body: "+err.Error())
+		return false
+	} else if len(body) > maxIdempotentBodyBytes {
+		writeIdempotencyError(sw, http.StatusRequestEntityTooLarge, "body too large for an Idempotency-Key")
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	h := sha256.New()
+	io.WriteString(h, r.Method+"\n"+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	fingerprint := hex.EncodeToString(h.Sum(nil))
+
+	// Keys belong to the API key that sent them
+	k := sha256.Sum256([]byte(requestAPIKey(r)))
+	key = hex.EncodeToString(k[:8]) + "/" + key
+
+	s.lock.Lock()
+	rec, ok := s.Records[key]
+	if ok && !rec.pending && time.Now().After(rec.Expires) {
+		delete(s.Records, key)
+		ok = false
+	}
+	if !ok {
+		s.Records[key] = &idempotentResponse{Fingerprint: fingerprint, pending: true}
+		s.lock.Unlock()
+		sw.ResponseWriter = &idempotencyWriter{ResponseWriter: sw.ResponseWriter, key: key}
+		return true
+	}
+	replay := *rec
+	s.lock.Unlock()
+
+	switch {
+	case replay.Fingerprint != fingerprint:
+		writeIdempotencyError(sw, http.StatusConflict, "Idempotency-Key was already used for a different request")
+	case replay.pending:
+		writeIdempotencyError(sw, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+	default:
+		if replay.ContentType != "" {
+			sw.Header().Set("Content-Type", replay.ContentType)
+		}
+		if replay.Location != "" {
+			sw.Header().Set("Location", replay.Location)
+		}
+		sw.Header().Set("Idempotent-Replayed", "true")
+		sw.Header().Set("Content-Length", strconv.Itoa(len(replay.Body)))
+		sw.WriteHeader(replay.Status)
+		sw.Write(replay.Body)
+	}
+	return false
+}
+
+// Finish remembers the response to a request Begin let through. Failures that a
+// retry may get past (5xx, 429) and cancelled requests are forgotten, so the retry
+// is handled afresh.
+func (s *idempotencyStore) Finish(iw *idempotencyWriter, r *http.Request, status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rec, ok := s.Records[iw.key]
+	if !ok || !rec.pending {
+		return
+	}
+	if status >= 500 || status == http.StatusTooManyRequests || iw.tooLarge || r.Context().Err() != nil {
+		delete(s.Records, iw.key)
+		return
+	}
+	rec.pending = false
+	rec.Status = status
+	rec.ContentType = iw.Header().Get("Content-Type")
+	rec.Location = iw.Header().Get("Location")
+	rec.Body = iw.buf.Bytes()
+	rec.Expires = time.Now().Add(idempotencyWindow(server.Config()))
+	s.dirty = true
+}
+
+// Save drops expired responses and writes out the rest, if anything changed
+func (s *idempotencyStore) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for k, rec := range s.Records {
+		if !rec.pending && now.After(rec.Expires) {
+			delete(s.Records, k)
+			s.dirty = true
+		}
+	}
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+	// Requests still being handled are remembered once answered
+	answered := make(map[string]*idempotentResponse)
+	for k, rec := range s.Records {
+		if !rec.pending {
+			answered[k] = rec
+		}
+	}
+	data, err := json.Marshal(struct {
+		Records map[string]*idempotentResponse `json:"records"`
+	}{answered})
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// runSaver writes out remembered responses periodically
+func (s *idempotencyStore) runSaver() {
+	for range time.NewTicker(idempotencySaveInterval).C {
+		if err := s.Save(); err != nil {
+			log.Println("Error saving idempotency keys:", err)
+		}
+	}
+}
+
+func writeIdempotencyError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(msg))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// doIdempotent sends a request with an Idempotency-Key, returning the status, body
+// and whether it was a replay
+func (ts *testServer) doIdempotent(t *testing.T, method string, p string, key string, idem string, body string) (int, string, bool) {
+	t.Helper()
+	resp := ts.do(t, method, p, key, strings.NewReader(body), http.Header{"Idempotency-Key": {idem}, "Content-Type": {"application/json"}})
+	replayed := resp.Header.Get("Idempotent-Replayed") == "true"
+	status, b := readResponse(t, resp)
+	return status, b, replayed
+}
+
+// rememberedKeys counts the Idempotency-Keys the server holds
+func rememberedKeys() int {
+	server.idempotency.lock.Lock()
+	defer server.idempotency.lock.Unlock()
+	return len(server.idempotency.Records)
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Idem.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Idem.Pkg", "2.0.0", "", nil))
+
+	// A retried delete gets the first answer rather than a 404
+	status, first, replayed := ts.doIdempotent(t, http.MethodDelete, "api/v2/package/Idem.Pkg/1.0.0", testWriteKey, "delete-1", "")
+	wantStatus(t, "delete", status, first, http.StatusNoContent)
+	if replayed {
+		t.Error("delete: marked as replayed")
+	}
+	status, again, replayed := ts.doIdempotent(t, http.MethodDelete, "api/v2/package/Idem.Pkg/1.0.0", testWriteKey, "delete-1", "")
+	wantStatus(t, "delete retried", status, again, http.StatusNoContent)
+	if !replayed || again != first {
+		t.Errorf("delete retried: got %s replayed %v, want %s replayed", again, replayed, first)
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Idem.Pkg/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete without a key", status, body, http.StatusNotFound)
+
+	// As does an admin change
+	for i, want := range []bool{false, true} {
+		status, body, replayed := ts.doIdempotent(t, http.MethodPost, "admin/unlist/Idem.Pkg/2.0.0", testWriteKey, "unlist-2", "")
+		wantStatus(t, "unlist", status, body, http.StatusNoContent)
+		if replayed != want {
+			t.Errorf("unlist %d: replayed %v, want %v", i, replayed, want)
+		}
+	}
+
+	// A key is only remembered once answered without a server error
+	status, body, _ = ts.doIdempotent(t, http.MethodDelete, "api/v2/package/Idem.Pkg/9.0.0", testWriteKey, "delete-9", "")
+	wantStatus(t, "delete missing", status, body, http.StatusNotFound)
+	if n := rememberedKeys(); n != 3 {
+		t.Errorf("got %d keys remembered, want 3", n)
+	}
+}
+
+func TestIdempotencyKeyReuse(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Flag.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Flag.Pkg", "2.0.0", "", nil))
+
+	status, body, _ := ts.doIdempotent(t, http.MethodPut, "admin/packages/Flag.Pkg/pin", testWriteKey, "pin", `{"version": "1.0.0"}`)
+	wantStatus(t, "pin", status, body, http.StatusNoContent)
+
+	// The same key with another body, or on another route, is refused and changes nothing
+	for _, tc := range []struct{ method, p, body string }{
+		{http.MethodPut, "admin/packages/Flag.Pkg/pin", `{"version": "2.0.0"}`},
+		{http.MethodDelete, "admin/packages/Flag.Pkg/pin", ""},
+		{http.MethodDelete, "api/v2/package/Flag.Pkg/1.0.0", ""},
+	} {
+		status, body, replayed := ts.doIdempotent(t, tc.method, tc.p, testWriteKey, "pin", tc.body)
+		wantStatus(t, tc.method+" "+tc.p+" "+tc.body, status, body, http.StatusConflict)
+		if replayed || !strings.Contains(body, "different request") {
+			t.Errorf("%s %s %s: got %s replayed %v", tc.method, tc.p, tc.body, body, replayed)
+		}
+	}
+	wantLatest(t, ts, "after reuse", "1.0.0", "2.0.0")
+
+	// The original request is still replayed
+	status, body, replayed := ts.doIdempotent(t, http.MethodPut, "admin/packages/Flag.Pkg/pin", testWriteKey, "pin", `{"version": "1.0.0"}`)
+	wantStatus(t, "pin retried", status, body, http.StatusNoContent)
+	if !replayed {
+		t.Error("pin retried: not replayed")
+	}
+
+	status, body, _ = ts.doIdempotent(t, http.MethodPut, "admin/packages/Flag.Pkg/pin", testWriteKey, strings.Repeat("k", maxIdempotencyKeyLength+1), `{"version": "1.0.0"}`)
+	wantStatus(t, "long key", status, body, http.StatusBadRequest)
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.IdempotencyWindow = "100ms" })
+	ts.mustPush(t, testPackage(t, "Idem.Pkg", "1.0.0", "", nil))
+
+	status, body, _ := ts.doIdempotent(t, http.MethodDelete, "api/v2/package/Idem.Pkg/1.0.0", testWriteKey, "delete", "")
+	wantStatus(t, "delete", status, body, http.StatusNoContent)
+	status, body, replayed := ts.doIdempotent(t, http.MethodDelete, "api/v2/package/Idem.Pkg/1.0.0", testWriteKey, "delete", "")
+	wantStatus(t, "delete retried", status, body, http.StatusNoContent)
+	if !replayed {
+		t.Error("delete retried: not replayed")
+	}
+
+	// Once the window has passed the key is forgotten and the request handled afresh
+	time.Sleep(200 * time.Millisecond)
+	status, body, replayed = ts.doIdempotent(t, http.MethodDelete, "api/v2/package/Idem.Pkg/1.0.0", testWriteKey, "delete", "")
+	wantStatus(t, "delete after the window", status, body, http.StatusNotFound)
+	if replayed {
+		t.Error("delete after the window: replayed")
+	}
+
+	// Save drops what has expired
+	time.Sleep(200 * time.Millisecond)
+	if err := server.idempotency.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if n := rememberedKeys(); n != 0 {
+		t.Errorf("got %d keys remembered after expiry, want 0", n)
+	}
+}
+
+// Callers who may not make the change never get their key or body remembered
+func TestIdempotencyNeedsWriteKey(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Idem.Pkg", "1.0.0", "", nil))
+
+	for _, key := range []string{"", "wrong", testReadKey} {
+		status, body, _ := ts.doIdempotent(t, http.MethodDelete, "api/v2/package/Idem.Pkg/1.0.0", key, "k-"+key, "")
+		wantStatus(t, "delete with key "+key, status, body, http.StatusForbidden)
+		status, body, _ = ts.doIdempotent(t, http.MethodPost, "admin/reindex", key, "k-"+key, strings.Repeat("x", 1000))
+		wantStatus(t, "reindex with key "+key, status, body, http.StatusForbidden)
+	}
+	if n := rememberedKeys(); n != 0 {
+		t.Errorf("got %d keys remembered, want 0", n)
+	}
+
+	// Nor while the feed is read-only
+	status, body := readResponse(t, ts.do(t, http.MethodPut, "admin/read-only", testWriteKey, strings.NewReader(`{"readOnly": true}`), nil))
+	wantStatus(t, "read-only", status, body, http.StatusOK)
+	status, body, _ = ts.doIdempotent(t, http.MethodDelete, "api/v2/package/Idem.Pkg/1.0.0", testWriteKey, "read-only", "")
+	wantStatus(t, "delete while read-only", status, body, http.StatusServiceUnavailable)
+	if n := rememberedKeys(); n != 0 {
+		t.Errorf("got %d keys remembered while read-only, want 0", n)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// idPolicy reserves package IDs matching a prefix (e.g. "QSC.") or glob
+// (e.g. "Company.*.Core") for the listed API keys
+type idPolicy struct {
+	Name        string   `json:"name"`
+	Pattern     string   `json:"pattern"`
+	AllowedKeys []string `json:"allowed-keys"`
+}
+
+// isGlob reports whether the pattern is a glob rather than a prefix
+func (p *idPolicy) isGlob() bool {
+	return strings.ContainsAny(p.Pattern, "*?[")
+}
+
+// matches reports whether the policy applies to an ID, case insensitively
+func (p *idPolicy) matches(id string) bool {
+	if p.isGlob() {
+		ok, _ := path.Match(strings.ToLower(p.Pattern), strings.ToLower(id))
+		return ok
+	}
+	return strings.HasPrefix(strings.ToLower(id), strings.ToLower(p.Pattern))
+}
+
+// specificity ranks overlapping policies, the longest literal part winning
+func (p *idPolicy) specificity() int {
+	return len(strings.NewReplacer("*", "", "?", "").Replace(p.Pattern))
+}
+
+// allows reports whether an API key may publish under the policy
+func (p *idPolicy) allows(key string) bool {
+	for _, k := range p.AllowedKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// validateIDPolicies checks the id-policies config
+func validateIDPolicies(c *Config) error {
+	for _, p := range c.IDPolicies {
+		if p.Pattern == "" {
+			return errors.New("id-policies entries must have a pattern")
+		}
+		if _, err := path.Match(p.Pattern, ""); err != nil {
+			return errors.New("id-policies contains an invalid glob: " + p.Pattern)
+		}
+	}
+	return nil
+}
+
+// idPolicyFor returns the policy governing an ID, or nil if none applies. Where
+// policies overlap the most specific wins, then the first listed.
+func idPolicyFor(c *Config, id string) *idPolicy {
+	var best *idPolicy
+	for i := range c.IDPolicies {
+		p := &c.IDPolicies[i]
+		if p.matches(id) && (best == nil || p.specificity() > best.specificity()) {
+			best = p
+		}
+	}
+	return best
+}
+
+// checkIDPolicy returns an error naming the policy if the request's key may not
+// publish or change packages with the ID
+func checkIDPolicy(r *http.Request, id string) error {
+	return idPolicyError(server.Config(), id, requestAPIKey(r))
+}
+
+// idPolicyError returns an error naming the policy if the key may not publish or
+// change packages with the ID
+func idPolicyError(c *Config, id string, key string) error {
+	p := idPolicyFor(c, id)
+	if p == nil || p.allows(key) {
+		return nil
+	}
+	name := p.Name
+	if name == "" {
+		name = p.Pattern
+	}
+	return errors.New("package id " + id + " is reserved by policy " + name)
+}
+
+// idPolicyInfo is a policy as shown by the admin endpoint, without its keys
+type idPolicyInfo struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	AllowedKeys int    `json:"allowedKeys"`
+}
+
+func newIDPolicyInfo(p *idPolicy) *idPolicyInfo {
+	return &idPolicyInfo{Name: p.Name, Pattern: p.Pattern, AllowedKeys: len(p.AllowedKeys)}
+}
+
+// idPolicyTest is the policy that would apply to an ID
+type idPolicyTest struct {
+	ID     string        `json:"id"`
+	Policy *idPolicyInfo `json:"policy"`
+}
+
+func serveIDPolicies(w http.ResponseWriter, r *http.Request) {
+	c := server.Config()
+
+	res := struct {
+		Policies []*idPolicyInfo `json:"policies"`
+		Test     *idPolicyTest   `json:"test,omitempty"`
+	}{Policies: []*idPolicyInfo{}}
+	for i := range c.IDPolicies {
+		res.Policies = append(res.Policies, newIDPolicyInfo(&c.IDPolicies[i]))
+	}
+
+	// Optionally which policy governs an ID, e.g. ?test=Company.Core.Foo
+	if id := r.URL.Query().Get("test"); id != "" {
+		res.Test = &idPolicyTest{ID: id}
+		if p := idPolicyFor(c, id); p != nil {
+			res.Test.Policy = newIDPolicyInfo(p)
+		}
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
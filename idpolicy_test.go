@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A second read-write key, allowed the IDs reserved in testIDPolicies
+const testPlatformKey = "test-platform"
+
+var testIDPolicies = []idPolicy{
+	{Name: "qsc", Pattern: "QSC.", AllowedKeys: []string{testPlatformKey}},
+	{Name: "qsc-open", Pattern: "QSC.Open.", AllowedKeys: []string{testWriteKey, testPlatformKey}},
+	{Name: "core", Pattern: "Company.*.Core", AllowedKeys: []string{testPlatformKey}},
+}
+
+func TestIDPolicyFor(t *testing.T) {
+	c := defaultConfig()
+	if p := idPolicyFor(c, "QSC.Anything"); p != nil {
+		t.Errorf("no policies: got %q", p.Name)
+	}
+
+	c.IDPolicies = testIDPolicies
+	for id, want := range map[string]string{
+		"QSC.Plugin":        "qsc",
+		"qsc.plugin":        "qsc",
+		"QSC.Open.Plugin":   "qsc-open",
+		"Company.Web.Core":  "core",
+		"company.web.core":  "core",
+		"Company.Web.Tools": "",
+		"QSCX.Plugin":       "",
+		"Other.Pkg":         "",
+	} {
+		got := ""
+		if p := idPolicyFor(c, id); p != nil {
+			got = p.Name
+		}
+		if got != want {
+			t.Errorf("%s: policy %q, want %q", id, got, want)
+		}
+	}
+
+	if err := idPolicyError(c, "QSC.Plugin", testWriteKey); err == nil || !strings.Contains(err.Error(), "policy qsc") {
+		t.Errorf("write key on QSC.Plugin: got %v", err)
+	}
+	for _, id := range []string{"QSC.Open.Plugin", "Other.Pkg"} {
+		if err := idPolicyError(c, id, testWriteKey); err != nil {
+			t.Errorf("write key on %s: %v", id, err)
+		}
+	}
+}
+
+func TestValidateIDPolicies(t *testing.T) {
+	c := defaultConfig()
+	c.IDPolicies = []idPolicy{{Name: "empty"}}
+	if err := validateIDPolicies(c); err == nil {
+		t.Error("a policy with no pattern was accepted")
+	}
+	c.IDPolicies = []idPolicy{{Pattern: "QSC.[", AllowedKeys: []string{testPlatformKey}}}
+	if err := validateIDPolicies(c); err == nil || !strings.Contains(err.Error(), "invalid glob") {
+		t.Errorf("invalid glob: got %v", err)
+	}
+}
+
+func TestIDPolicyRoutes(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.FileStore.APIKeys.ReadWrite = append(c.FileStore.APIKeys.ReadWrite, testPlatformKey)
+		c.IDPolicies = testIDPolicies
+	})
+
+	// Only the platform key may push a reserved ID, any key the rest
+	pkg := testPackage(t, "QSC.Plugin", "1.0.0", "", nil)
+	status, body := readResponse(t, ts.pushTo(t, "api/v2/package/", testWriteKey, pkg))
+	wantStatus(t, "reserved push", status, body, http.StatusForbidden)
+	if !strings.Contains(body, "policy qsc") {
+		t.Errorf("reserved push: %q does not name the policy", body)
+	}
+	status, body = readResponse(t, ts.pushTo(t, "api/v2/package/", testPlatformKey, pkg))
+	wantStatus(t, "platform push", status, body, http.StatusCreated)
+	ts.mustPush(t, testPackage(t, "QSC.Open.Plugin", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Other.Pkg", "1.0.0", "", nil))
+
+	// Changing a reserved package is gated alike
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodPost, "admin/unlist/QSC.Plugin/1.0.0"},
+		{http.MethodPost, "admin/relist/QSC.Plugin/1.0.0"},
+		{http.MethodDelete, "api/v2/package/QSC.Plugin/1.0.0"},
+	} {
+		status, body := readResponse(t, ts.do(t, tc.method, tc.path, testWriteKey, nil, nil))
+		wantStatus(t, tc.method+" "+tc.path, status, body, http.StatusForbidden)
+	}
+	status, body = readResponse(t, ts.pushTo(t, "api/v2/package/QSC.Plugin/1.0.0", testWriteKey, pkg))
+	wantStatus(t, "overwrite", status, body, http.StatusForbidden)
+	status, body = readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/QSC.Plugin/1.0.0", testPlatformKey, nil, nil))
+	wantStatus(t, "platform delete", status, body, http.StatusNoContent)
+
+	// The admin endpoint lists the policies without keys and tests an ID
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "admin/id-policies?test=QSC.Open.Thing", testWriteKey, nil, nil))
+	wantStatus(t, "admin/id-policies", status, body, http.StatusOK)
+	if strings.Contains(body, testPlatformKey) {
+		t.Errorf("admin/id-policies shows keys: %s", body)
+	}
+	var res struct {
+		Policies []idPolicyInfo `json:"policies"`
+		Test     *idPolicyTest  `json:"test"`
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Policies) != 3 || res.Policies[1].AllowedKeys != 2 {
+		t.Errorf("policies %+v", res.Policies)
+	}
+	if res.Test == nil || res.Test.Policy == nil || res.Test.Policy.Name != "qsc-open" {
+		t.Errorf("test: %s", body)
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "admin/id-policies", testReadKey, nil, nil))
+	wantStatus(t, "admin/id-policies with a read key", status, body, http.StatusForbidden)
+}
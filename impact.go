@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Risk levels of removing a version
+const (
+	impactLow    = "low"
+	impactMedium = "medium"
+	impactHigh   = "high"
+)
+
+// impactReport is what would be affected by deleting or unlisting a version
+type impactReport struct {
+	ID         string            `json:"id"`
+	Version    string            `json:"version"`
+	Risk       string            `json:"risk"`
+	Reasons    []string          `json:"reasons"`
+	Listed     bool              `json:"listed"`
+	Latest     bool              `json:"latest"`
+	Pinned     bool              `json:"pinned"`
+	Downloads  int               `json:"downloadsLast30Days"`
+	Snapshots  []string          `json:"snapshots"`
+	Dependents []impactDependent `json:"dependents"`
+}
+
+// impactDependent is a hosted package version whose dependency range the version satisfies
+type impactDependent struct {
+	ID        string `json:"id"`
+	Version   string `json:"version"`
+	Range     string `json:"range,omitempty"`
+	Framework string `json:"framework,omitempty"`
+	// No other version of the package satisfies the range
+	SoleSatisfier bool `json:"soleSatisfier"`
+}
+
+// impactSummary is the shortened impact report of a delete refused by delete-protection
+type impactSummary struct {
+	ID      string   `json:"id"`
+	Version string   `json:"version"`
+	Risk    string   `json:"risk"`
+	Reasons []string `json:"reasons"`
+}
+
+// summary shortens a report to its risk and reasons
+func (rep *impactReport) summary() impactSummary {
+	return impactSummary{ID: rep.ID, Version: rep.Version, Risk: rep.Risk, Reasons: rep.Reasons}
+}
+
+// deleteProtectionError is a delete refused by delete-protection
+type deleteProtectionError struct {
+	Impact impactSummary
+}
+
+func (e *deleteProtectionError) Error() string {
+	return e.Impact.ID + " " + e.Impact.Version + " is protected from deletion: " + strings.Join(e.Impact.Reasons, ", ")
+}
+
+// checkDeleteProtection returns a *deleteProtectionError if delete-protection
+// covers a version. The impact is only assessed when protection is on, and a
+// version that isn't stored is left to the delete to report.
+func checkDeleteProtection(ctx context.Context, id string, ver string) error {
+	p := server.Config().DeleteProtection
+	if !p.Latest && !p.SoleSatisfier {
+		return nil
+	}
+	rep, err := assessImpact(ctx, id, ver)
+	if err != nil || rep == nil {
+		return err
+	}
+	sole := false
+	for _, d := range rep.Dependents {
+		sole = sole || d.SoleSatisfier
+	}
+	if (p.Latest && rep.Latest) || (p.SoleSatisfier && sole) {
+		return &deleteProtectionError{Impact: rep.summary()}
+	}
+	return nil
+}
+
+// assessImpact reports what removing a version would affect. It returns nil if
+// the version doesn't exist.
+func assessImpact(ctx context.Context, id string, ver string) (*impactReport, error) {
+	all, err := allPackageEntries(ctx, server.fs, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// The package's own versions, to find which ranges others can satisfy
+	var target *NugetPackageEntry
+	var others []*NugetPackageEntry
+	for _, e := range all {
+		if !strings.EqualFold(e.Properties.ID, id) {
+			continue
+		}
+		if versions.Equal(e.Properties.Version, ver) {
+			target = e
+		} else {
+			others = append(others, e)
+		}
+	}
+	if target == nil {
+		return nil, nil
+	}
+	id, ver = target.Properties.ID, target.Properties.Version
+
+	rep := &impactReport{
+		ID:         id,
+		Version:    ver,
+		Reasons:    []string{},
+		Listed:     target.Properties.Listed.Value,
+		Snapshots:  server.snapshots.Containing(id, ver),
+		Dependents: []impactDependent{},
+	}
+	if latest, err := latestVersion(ctx, id); err == nil {
+		rep.Latest = versions.Equal(latest, ver)
+	}
+	rep.Pinned = versions.Equal(pinnedVersion(ctx, id), ver)
+	for _, vs := range server.stats.forPackage(id) {
+		if versions.Equal(vs.Version, ver) {
+			for _, n := range vs.Daily {
+				rep.Downloads += n
+			}
+		}
+	}
+
+	for _, e := range all {
+		if strings.EqualFold(e.Properties.ID, id) {
+			continue
+		}
+		for _, d := range parseDependencies(e.Properties.Dependencies) {
+			if !strings.EqualFold(d.ID, id) {
+				continue
+			}
+			// A dependency without a range takes any version
+			r := d.Range
+			if r == "" {
+				r = "0.0.0"
+			}
+			vr, err := parseVersionRange(r)
+			if err != nil || !rangeAdmits(vr, target) {
+				continue
+			}
+			dep := impactDependent{
+				ID:            e.Properties.ID,
+				Version:       e.Properties.Version,
+				Range:         d.Range,
+				Framework:     d.Framework,
+				SoleSatisfier: true,
+			}
+			for _, o := range others {
+				if rangeAdmits(vr, o) {
+					dep.SoleSatisfier = false
+					break
+				}
+			}
+			rep.Dependents = append(rep.Dependents, dep)
+		}
+	}
+
+	rep.Risk = impactLow
+	sole := 0
+	for _, d := range rep.Dependents {
+		if d.SoleSatisfier {
+			sole++
+		}
+	}
+	if sole > 0 {
+		rep.Reasons = append(rep.Reasons, strconv.Itoa(sole)+" dependent range(s) satisfied only by this version")
+	}
+	if rep.Latest {
+		rep.Reasons = append(rep.Reasons, "latest version")
+	}
+	if rep.Pinned {
+		rep.Reasons = append(rep.Reasons, "pinned as the latest version")
+	}
+	if len(rep.Reasons) > 0 {
+		rep.Risk = impactHigh
+	}
+	if n := len(rep.Dependents) - sole; n > 0 {
+		rep.Reasons = append(rep.Reasons, strconv.Itoa(n)+" dependent range(s) also satisfied by other versions")
+	}
+	if rep.Downloads > 0 {
+		rep.Reasons = append(rep.Reasons, strconv.Itoa(rep.Downloads)+" download(s) in the last "+strconv.Itoa(statsDays)+" days")
+	}
+	if len(rep.Snapshots) > 0 {
+		rep.Reasons = append(rep.Reasons, "in "+strconv.Itoa(len(rep.Snapshots))+" snapshot(s)")
+	}
+	if rep.Risk == impactLow && len(rep.Reasons) > 0 {
+		rep.Risk = impactMedium
+	}
+	return rep, nil
+}
+
+// rangeAdmits reports whether a client restoring a range could get a version,
+// following the rules api/resolve applies
+func rangeAdmits(vr *versionRange, e *NugetPackageEntry) bool {
+	v := e.Properties.Version
+	if !vr.Satisfies(v) {
+		return false
+	}
+	if versions.IsPrerelease(v) && !vr.AllowsPrerelease() {
+		return false
+	}
+	// Unlisted versions are only restored by a range that pins them exactly
+	return e.Properties.Listed.Value || (vr.Min != "" && vr.Min == vr.Max)
+}
+
+func serveImpact(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting admin/packages/{id}/{version}/impact
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`admin/packages`):], `/`), `/`)
+	if len(x) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	server.fs.UpdateCountsInMemory()
+	rep, err := assessImpact(r.Context(), x[0], x[1])
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if rep == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(rep)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// pushImpactChain pushes Top -> App -> Lib, with Tool also depending on Lib by
+// a range more than one version satisfies
+func pushImpactChain(t *testing.T, ts *testServer) {
+	t.Helper()
+	deps := func(id string, r string) string {
+		return `<dependencies><dependency id="` + id + `" version="` + r + `" /></dependencies>`
+	}
+	ts.mustPush(t, testPackage(t, "Lib", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Lib", "2.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Lib", "3.0.0-beta", "", nil))
+	ts.mustPush(t, testPackage(t, "App", "1.0.0", deps("Lib", "[2.0.0]"), nil))
+	ts.mustPush(t, testPackage(t, "Tool", "1.0.0", deps("Lib", "1.0.0"), nil))
+	ts.mustPush(t, testPackage(t, "Top", "1.0.0", deps("App", "[1.0.0,2.0.0)"), nil))
+}
+
+// getImpact fetches the impact report of a version
+func getImpact(t *testing.T, ts *testServer, id string, ver string) *impactReport {
+	t.Helper()
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "admin/packages/"+id+"/"+ver+"/impact", testWriteKey, nil, nil))
+	wantStatus(t, "impact of "+id+" "+ver, status, body, http.StatusOK)
+	var rep impactReport
+	if err := json.Unmarshal([]byte(body), &rep); err != nil {
+		t.Fatal(err)
+	}
+	return &rep
+}
+
+// soleDependents lists, sorted, the dependents only the version satisfies
+func soleDependents(rep *impactReport) []string {
+	var sole []string
+	for _, d := range rep.Dependents {
+		if d.SoleSatisfier {
+			sole = append(sole, d.ID+" "+d.Version)
+		}
+	}
+	sort.Strings(sole)
+	return sole
+}
+
+func TestImpactSoleSatisfier(t *testing.T) {
+	ts := newTestServer(t, nil)
+	pushImpactChain(t, ts)
+
+	for _, tc := range []struct {
+		id, ver    string
+		risk       string
+		dependents int
+		sole       string
+		latest     bool
+	}{
+		// App pins Lib 2.0.0 exactly, Tool takes any Lib from 1.0.0
+		{"Lib", "2.0.0", impactHigh, 2, "App 1.0.0", true},
+		{"Lib", "1.0.0", impactMedium, 1, "", false},
+		// Tool's range doesn't take prereleases
+		{"Lib", "3.0.0-beta", impactLow, 0, "", false},
+		// The chain goes on up to Top
+		{"App", "1.0.0", impactHigh, 1, "Top 1.0.0", true},
+		{"Top", "1.0.0", impactHigh, 0, "", true},
+	} {
+		rep := getImpact(t, ts, tc.id, tc.ver)
+		if rep.Risk != tc.risk || len(rep.Dependents) != tc.dependents || strings.Join(soleDependents(rep), ",") != tc.sole || rep.Latest != tc.latest {
+			t.Errorf("%s %s: got risk %s, %d dependents, sole %q, latest %v, want %s, %d, %q, %v (%q)",
+				tc.id, tc.ver, rep.Risk, len(rep.Dependents), soleDependents(rep), rep.Latest, tc.risk, tc.dependents, tc.sole, tc.latest, rep.Reasons)
+		}
+	}
+
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "admin/packages/Lib/4.0.0/impact", testWriteKey, nil, nil))
+	wantStatus(t, "impact of a missing version", status, body, http.StatusNotFound)
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "admin/packages/Lib/2.0.0/impact", testReadKey, nil, nil))
+	if status == http.StatusOK {
+		t.Errorf("impact with a read key: got %d %s", status, body)
+	}
+
+	// Deleting the sole satisfier leaves Lib 1.0.0 as the only version Tool can get
+	status, body = readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Lib/2.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete", status, body, http.StatusNoContent)
+	if rep := getImpact(t, ts, "Lib", "1.0.0"); rep.Risk != impactHigh || strings.Join(soleDependents(rep), ",") != "Tool 1.0.0" || !rep.Latest {
+		t.Errorf("Lib 1.0.0 after the delete: got %+v", rep)
+	}
+
+	status, body = readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Lib/2.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete again", status, body, http.StatusNotFound)
+}
+
+// With delete-protection, deleting a version it covers is refused with a summary
+// of the impact unless forced, and other deletes go ahead
+func TestDeleteProtection(t *testing.T) {
+	type del struct {
+		p      string
+		status int
+		reason string // In the refusal's reasons
+	}
+	for _, tc := range []struct {
+		name    string
+		latest  bool
+		sole    bool
+		unlist  bool
+		deletes []del
+	}{
+		{name: "sole satisfier", sole: true, deletes: []del{
+			{"Lib/2.0.0", http.StatusConflict, "1 dependent range(s) satisfied only by this version"},
+			{"App/1.0.0", http.StatusConflict, "1 dependent range(s) satisfied only by this version"},
+			// Latest, but nothing depends on it alone
+			{"Top/1.0.0", http.StatusNoContent, ""},
+			{"Lib/1.0.0", http.StatusNoContent, ""},
+			{"Lib/2.0.0", http.StatusConflict, "2 dependent range(s) satisfied only by this version"},
+			{"Lib/2.0.0?force=true", http.StatusNoContent, ""},
+			{"Lib/2.0.0", http.StatusNotFound, ""},
+		}},
+		{name: "latest", latest: true, deletes: []del{
+			{"Top/1.0.0", http.StatusConflict, "latest version"},
+			{"Lib/2.0.0", http.StatusConflict, "latest version"},
+			{"Lib/1.0.0", http.StatusNoContent, ""},
+			{"Lib/3.0.0-beta", http.StatusNoContent, ""},
+			{"Top/1.0.0?force=TRUE", http.StatusNoContent, ""},
+		}},
+		{name: "unlist", sole: true, unlist: true, deletes: []del{
+			{"Lib/2.0.0", http.StatusConflict, "satisfied only by this version"},
+			{"Top/1.0.0", http.StatusNoContent, ""},
+		}},
+		{name: "off", deletes: []del{
+			{"Lib/2.0.0", http.StatusNoContent, ""},
+			{"Top/1.0.0", http.StatusNoContent, ""},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t, func(c *Config) {
+				c.DeleteProtection.Latest = tc.latest
+				c.DeleteProtection.SoleSatisfier = tc.sole
+				if tc.unlist {
+					c.DeleteMode = deleteModeUnlist
+				}
+			})
+			pushImpactChain(t, ts)
+			for _, d := range tc.deletes {
+				status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/"+d.p, testWriteKey, nil, nil))
+				wantStatus(t, d.p, status, body, d.status)
+				if d.status != http.StatusConflict {
+					continue
+				}
+				var refused deleteRefused
+				if err := json.Unmarshal([]byte(body), &refused); err != nil {
+					t.Fatalf("%s: %v", d.p, err)
+				}
+				id, ver := strings.Split(d.p, "/")[0], strings.Split(d.p, "/")[1]
+				if refused.Impact.ID != id || refused.Impact.Version != ver || refused.Impact.Risk != impactHigh ||
+					!strings.Contains(strings.Join(refused.Impact.Reasons, "|"), d.reason) || !strings.Contains(refused.Error, "protected") {
+					t.Errorf("%s: got %s, want the reason %q", d.p, body, d.reason)
+				}
+				// Still there, and still listed
+				if rep := getImpact(t, ts, id, ver); !rep.Listed {
+					t.Errorf("%s: removed though refused", d.p)
+				}
+			}
+		})
+	}
+}
+
+// With delete-mode unlist a deleted version stays, and being unlisted only
+// satisfies ranges pinning it
+func TestImpactDeleteUnlists(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.DeleteMode = deleteModeUnlist })
+	pushImpactChain(t, ts)
+
+	status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Lib/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete", status, body, http.StatusNoContent)
+
+	rep := getImpact(t, ts, "Lib", "1.0.0")
+	if rep.Listed || len(rep.Dependents) != 0 {
+		t.Errorf("unlisted Lib 1.0.0: got %+v", rep)
+	}
+	if rep := getImpact(t, ts, "Lib", "2.0.0"); strings.Join(soleDependents(rep), ",") != "App 1.0.0,Tool 1.0.0" {
+		t.Errorf("Lib 2.0.0 with 1.0.0 unlisted: got sole %q", soleDependents(rep))
+	}
+}
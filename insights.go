@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Days of daily download counts kept per version
+const statsDays = 30
+
+// Distinct clients tracked per version, beyond this they are counted as "other"
+const statsMaxClients = 50
+
+// downloadStats records when and by which clients package versions are downloaded,
+// for package owners to see who is using their packages
+type downloadStats struct {
+	lock     sync.Mutex
+	path     string
+	Versions map[string]*versionStats `json:"versions"`
+}
+
+// versionStats are the download statistics of one package version
+type versionStats struct {
+	ID           string         `json:"id"`
+	Version      string         `json:"version"`
+	LastDownload time.Time      `json:"lastDownload"`
+	Daily        map[string]int `json:"daily"`
+	Clients      map[string]int `json:"clients"`
+}
+
+// loadDownloadStats reads statistics from path, which may be empty to keep them in
+// memory only. Usable stats are returned even with an error.
+func loadDownloadStats(path string) (*downloadStats, error) {
+	ds := &downloadStats{path: path, Versions: make(map[string]*versionStats)}
+	if path == "" {
+		return ds, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ds, nil
+	} else if err != nil {
+		return ds, err
+	}
+	if err := json.Unmarshal(data, ds); err != nil {
+		ds.Versions = make(map[string]*versionStats)
+		return ds, err
+	}
+
+	// Older stats were keyed by the version as written, so "1.0" and "1.0.0" may
+	// have been counted apart
+	loaded := ds.Versions
+	ds.Versions = make(map[string]*versionStats, len(loaded))
+	for _, vs := range loaded {
+		key := versionKey(vs.ID, vs.Version)
+		prev, ok := ds.Versions[key]
+		if !ok {
+			ds.Versions[key] = vs
+			continue
+		}
+		if prev.Daily == nil {
+			prev.Daily = make(map[string]int)
+		}
+		if prev.Clients == nil {
+			prev.Clients = make(map[string]int)
+		}
+		for d, n := range vs.Daily {
+			prev.Daily[d] += n
+		}
+		for c, n := range vs.Clients {
+			prev.Clients[c] += n
+		}
+		if vs.LastDownload.After(prev.LastDownload) {
+			prev.LastDownload = vs.LastDownload
+		}
+	}
+	return ds, nil
+}
+
+// Record counts a download of a version at a time by the client with the given
+// user agent. The statistics are only written out by Save.
+func (ds *downloadStats) Record(id string, ver string, userAgent string, t time.Time) {
+	if ds == nil {
+		return
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	key := versionKey(id, ver)
+	vs, ok := ds.Versions[key]
+	if !ok {
+		vs = &versionStats{ID: id, Version: ver, Daily: make(map[string]int), Clients: make(map[string]int)}
+		ds.Versions[key] = vs
+	}
+
+	t = t.UTC()
+	vs.LastDownload = t
+	vs.Daily[t.Format("2006-01-02")]++
+	cutoff := t.AddDate(0, 0, -statsDays).Format("2006-01-02")
+	for d := range vs.Daily {
+		if d <= cutoff {
+			delete(vs.Daily, d)
+		}
+	}
+
+	c := clientName(userAgent)
+	if _, ok := vs.Clients[c]; !ok && len(vs.Clients) >= statsMaxClients {
+		c = "other"
+	}
+	vs.Clients[c]++
+}
+
+// Save writes the statistics to disk if they have a path
+func (ds *downloadStats) Save() error {
+	if ds == nil || ds.path == "" {
+		return nil
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	data, err := json.Marshal(ds)
+	if err != nil {
+		return err
+	}
+	tmp := ds.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ds.path)
+}
+
+// forPackage returns copies of the statistics of every version of a package
+func (ds *downloadStats) forPackage(id string) []versionStats {
+	if ds == nil {
+		return nil
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	var list []versionStats
+	for _, vs := range ds.Versions {
+		if !strings.EqualFold(vs.ID, id) {
+			continue
+		}
+		c := *vs
+		c.Daily = make(map[string]int)
+		for k, v := range vs.Daily {
+			c.Daily[k] = v
+		}
+		c.Clients = make(map[string]int)
+		for k, v := range vs.Clients {
+			c.Clients[k] = v
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// clientName reduces a user agent to the client and its version,
+// e.g. "NuGet Command Line/5.11.0 (Microsoft Windows NT 10.0)" -> "NuGet Command Line/5.11.0"
+func clientName(ua string) string {
+	if i := strings.Index(ua, " ("); i >= 0 {
+		ua = ua[:i]
+	}
+	ua = strings.TrimSpace(ua)
+	if ua == "" {
+		return "unknown"
+	}
+	if len(ua) > 64 {
+		ua = ua[:64]
+	}
+	return ua
+}
+
+// packageInsights is the usage summary of a package returned to its owners
+type packageInsights struct {
+	ID         string             `json:"id"`
+	Downloads  int                `json:"downloads"`
+	Versions   []versionInsights  `json:"versions"`
+	Daily      []dailyDownloads   `json:"daily"`
+	Clients    map[string]int     `json:"clients"`
+	Dependents []packageDependent `json:"dependents"`
+}
+
+type versionInsights struct {
+	Version      string     `json:"version"`
+	Downloads    int        `json:"downloads"`
+	LastDownload *time.Time `json:"lastDownload"`
+}
+
+type dailyDownloads struct {
+	Date      string `json:"date"`
+	Downloads int    `json:"downloads"`
+}
+
+// packageDependent is a package on the feed that depends on the package
+type packageDependent struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	Range   string `json:"range"`
+}
+
+func servePackageInsights(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting api/packages/{id}/insights
+	id := strings.TrimSuffix(r.URL.Path[len(server.URL.Path+`api/packages/`):], `/insights`)
+	if id == "" || strings.Contains(id, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Entries are fetched page by page, so the store isn't locked while this is assembled
+	entries, err := allPackageEntries(r.Context(), server.fs, "")
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	pi := packageInsights{ID: id, Versions: []versionInsights{}, Clients: make(map[string]int), Dependents: []packageDependent{}}
+	stats := make(map[string]versionStats)
+	for _, vs := range server.stats.forPackage(id) {
+		stats[versions.Key(vs.Version)] = vs
+	}
+
+	// Per version counts, and packages depending on this one
+	for _, e := range entries {
+		if strings.EqualFold(e.Properties.ID, id) {
+			pi.ID = e.Properties.ID
+			vi := versionInsights{Version: e.Properties.Version, Downloads: e.Properties.VersionDownloadCount.Value}
+			if vs, ok := stats[versions.Key(e.Properties.Version)]; ok {
+				t := vs.LastDownload
+				vi.LastDownload = &t
+			}
+			pi.Versions = append(pi.Versions, vi)
+			pi.Downloads += vi.Downloads
+			continue
+		}
+		for _, d := range strings.Split(e.Properties.Dependencies, "|") {
+			x := strings.SplitN(d, ":", 3)
+			if strings.EqualFold(x[0], id) {
+				dep := packageDependent{ID: e.Properties.ID, Version: e.Properties.Version}
+				if len(x) > 1 {
+					dep.Range = x[1]
+				}
+				pi.Dependents = append(pi.Dependents, dep)
+			}
+		}
+	}
+	if len(pi.Versions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sort.Slice(pi.Versions, func(i, j int) bool {
+		return versions.Compare(pi.Versions[i].Version, pi.Versions[j].Version) > 0
+	})
+
+	// Daily series over all versions, oldest first with empty days filled in
+	today := time.Now().UTC()
+	for i := statsDays - 1; i >= 0; i-- {
+		d := today.AddDate(0, 0, -i).Format("2006-01-02")
+		n := 0
+		for _, vs := range stats {
+			n += vs.Daily[d]
+		}
+		pi.Daily = append(pi.Daily, dailyDownloads{Date: d, Downloads: n})
+	}
+	for _, vs := range stats {
+		for c, n := range vs.Clients {
+			pi.Clients[c] += n
+		}
+	}
+
+	b, err := json.Marshal(pi)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Operations recorded in the intent log
+const (
+	intentStore   = "store"
+	intentRemove  = "remove"
+	intentApprove = "approve"
+	intentReject  = "reject"
+	intentUnlist  = "unlist"
+	intentRelist  = "relist"
+)
+
+// intentRecord is a line of the intent log. A record without Done is written before
+// a mutation starts, and one with Done and the same token once it has finished.
+type intentRecord struct {
+	Token   string    `json:"token"`
+	Op      string    `json:"op,omitempty"`
+	ID      string    `json:"id,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Hash    string    `json:"hash,omitempty"`
+	Size    int       `json:"size,omitempty"`
+	Done    bool      `json:"done,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// intentLog is a write-ahead log of the local store's multi-step mutations, so one
+// interrupted by a crash can be finished or undone at the next start rather than
+// leaving the nupkg, markers, download counts and change log disagreeing
+type intentLog struct {
+	lock   sync.Mutex
+	path   string
+	shared bool
+	open   int
+}
+
+// openIntentLog opens the intent log at path and returns the intents that were
+// begun but never marked done
+func openIntentLog(path string) (*intentLog, []intentRecord, error) {
+	il := &intentLog{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return il, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var order []string
+	begun := make(map[string]intentRecord)
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var ir intentRecord
+		if err := json.Unmarshal(s.Bytes(), &ir); err != nil {
+			// A torn final line from a crash mid-append is ignored
+			continue
+		}
+		if ir.Done {
+			delete(begun, ir.Token)
+		} else {
+			begun[ir.Token] = ir
+			order = append(order, ir.Token)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var pending []intentRecord
+	for _, t := range order {
+		if ir, ok := begun[t]; ok {
+			pending = append(pending, ir)
+		}
+	}
+	return il, pending, nil
+}
+
+// Begin records that a mutation is about to start and returns its token
+func (il *intentLog) Begin(ir intentRecord) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ir.Token = hex.EncodeToString(b)
+	ir.Done = false
+	ir.Time = time.Now().UTC()
+	if err := il.append(ir); err != nil {
+		return "", err
+	}
+	il.lock.Lock()
+	il.open++
+	il.lock.Unlock()
+	return ir.Token, nil
+}
+
+// Done records that the mutation with token has finished
+func (il *intentLog) Done(token string) {
+	if err := il.append(intentRecord{Token: token, Done: true, Time: time.Now().UTC()}); err != nil {
+		log.Println("Error: Cannot record intent", err)
+	}
+
+	// With nothing in progress the log can start again, unless another instance
+	// sharing the directory may still be writing to it
+	il.lock.Lock()
+	defer il.lock.Unlock()
+	il.open--
+	if il.open == 0 && !il.shared {
+		if err := os.Remove(il.path); err != nil && !os.IsNotExist(err) {
+			log.Println("Error: Cannot reset intent log", err)
+		}
+	}
+}
+
+// append writes a record and syncs it to disk before returning
+func (il *intentLog) append(ir intentRecord) error {
+	b, err := json.Marshal(ir)
+	if err != nil {
+		return err
+	}
+
+	il.lock.Lock()
+	defer il.lock.Unlock()
+	f, err := os.OpenFile(il.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Reset empties the log once every intent in it has been dealt with
+func (il *intentLog) Reset() error {
+	il.lock.Lock()
+	defer il.lock.Unlock()
+	if err := os.Remove(il.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// openIntents opens the store's intent log and recovers whatever it shows was
+// interrupted, then starts the log again
+func (fs *fileStoreLocal) openIntents(record bool) error {
+	il, pending, err := openIntentLog(filepath.Join(fs.rootDir, "intents.jsonl"))
+	if err != nil {
+		return err
+	}
+	il.shared = fs.shared
+	fs.intents = il
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Pushes on other instances hold the shared lock, so none is undone mid-write
+	if fs.shared {
+		unlock, err := fs.lockShared()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := fs.recoverIntents(pending, record); err != nil {
+		return err
+	}
+	return il.Reset()
+}
+
+// recoverIntents finishes or undoes the mutations a crash interrupted. It runs
+// before the packages are loaded, so they are read in a consistent state. Change
+// records are only written when record is set; a new change log is checkpointed
+// from the recovered packages instead.
+func (fs *fileStoreLocal) recoverIntents(pending []intentRecord, record bool) error {
+	for _, ir := range pending {
+		log.Printf("Recovering interrupted %s of %s %s", ir.Op, ir.ID, ir.Version)
+		var err error
+		switch ir.Op {
+		case intentStore:
+			err = fs.recoverStore(ir)
+		case intentRemove:
+			err = fs.removeVersion(ir)
+			if err == nil && record {
+				if c, ok := fs.changes.Last(ir.ID, ir.Version); !ok || c.Type != changeRemoved {
+					err = fs.changes.Append(changeRemoved, ir.ID, ir.Version, ir.Hash, ir.Size)
+				}
+			}
+		case intentApprove:
+			// The store has its own intent; quarantine is only cleared once the
+			// package is in the store
+			if c, ok := fs.changes.Last(ir.ID, ir.Version); ok && c.Type == changeAdded && strings.EqualFold(c.Hash, ir.Hash) {
+				err = os.RemoveAll(filepath.Dir(ir.Path))
+			}
+		case intentReject:
+			// The package is only dropped if its rejection was recorded
+			if fs.rejectionRecorded(ir.ID, ir.Version) {
+				err = os.RemoveAll(filepath.Dir(ir.Path))
+			}
+		case intentUnlist, intentRelist:
+			// Nothing to do if the version has gone since
+			if _, err := os.Stat(ir.Path); err != nil {
+				continue
+			}
+			err = fs.setListedMarker(ir.ID, ir.Version, ir.Op == intentRelist)
+			kind := changeUnlisted
+			if ir.Op == intentRelist {
+				kind = changeRelisted
+			}
+			if err == nil && record {
+				if c, ok := fs.changes.Last(ir.ID, ir.Version); !ok || c.Type != kind {
+					err = fs.changes.Append(kind, ir.ID, ir.Version, ir.Hash, ir.Size)
+				}
+			}
+		default:
+			log.Println("Warning: unknown intent", ir.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverStore undoes a push that didn't reach the change log. The nupkg is only
+// removed if it is the one the push was writing.
+func (fs *fileStoreLocal) recoverStore(ir intentRecord) error {
+	if c, ok := fs.changes.Last(ir.ID, ir.Version); ok && c.Type == changeAdded && strings.EqualFold(c.Hash, ir.Hash) {
+		return nil
+	}
+	pkg, err := ioutil.ReadFile(ir.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	h := sha512.Sum512(pkg)
+	if !strings.EqualFold(hex.EncodeToString(h[:]), ir.Hash) {
+		return nil
+	}
+	return fs.removeVersion(ir)
+}
+
+// removeVersion deletes a version's nupkg, extracted content, markers and download
+// count. Each step can be repeated, so an interrupted removal is simply run again.
+// With shared storage the caller holds the shared lock, and the count is removed
+// from the counts on disk so those other instances added are kept.
+func (fs *fileStoreLocal) removeVersion(ir intentRecord) error {
+	if err := os.Remove(ir.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	vd := fs.versionDir(ir.ID, ir.Version)
+	if err := os.RemoveAll(vd); err != nil {
+		return err
+	}
+	// Drop the id's directory if this was its last version
+	os.Remove(filepath.Dir(vd))
+
+	if fs.shared {
+		if err := fs.LoadDownloadCounts(); err != nil {
+			return err
+		}
+	}
+	for k := range fs.downloadCounts {
+		x := strings.SplitN(k, "/", 2)
+		if len(x) == 2 && strings.EqualFold(x[0], ir.ID) && versions.Equal(x[1], ir.Version) {
+			delete(fs.downloadCounts, k)
+			if err := fs.SaveDownloadCounts(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setListedMarker creates or removes a version's unlisted marker
+func (fs *fileStoreLocal) setListedMarker(id string, ver string, listed bool) error {
+	marker := filepath.Join(fs.versionDir(id, ver), unlistedMarkerName)
+	if listed {
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(marker), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(marker, nil, 0644)
+}
+
+// rejectionRecorded reports whether the quarantine's rejection record has a version
+func (fs *fileStoreLocal) rejectionRecorded(id string, ver string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(fs.quarantineDir(), "rejected.json"))
+	if err != nil {
+		return false
+	}
+	var rejections []quarantineRejection
+	if err := json.Unmarshal(data, &rejections); err != nil {
+		return false
+	}
+	for _, r := range rejections {
+		if strings.EqualFold(r.ID, id) && versions.Equal(r.Version, ver) {
+			return true
+		}
+	}
+	return false
+}
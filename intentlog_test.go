@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenIntentLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "intents.jsonl")
+	il, pending, err := openIntentLog(path)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("new log: %v %v", pending, err)
+	}
+
+	a, err := il.Begin(intentRecord{Op: intentRemove, ID: "A", Version: "1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := il.Begin(intentRecord{Op: intentStore, ID: "B", Version: "1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := il.Begin(intentRecord{Op: intentUnlist, ID: "C", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	il.Done(b)
+
+	// A crash part way through an append leaves a torn line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"token":"` + a + `","do`)
+	f.Close()
+
+	_, pending, err = openIntentLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ir := range pending {
+		got = append(got, ir.Op+" "+ir.ID)
+	}
+	if want := []string{"remove A", "unlist C"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pending %v, want %v", got, want)
+	}
+}
+
+func TestIntentLogResets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "intents.jsonl")
+	il, _, err := openIntentLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := il.Begin(intentRecord{Op: intentRemove, ID: "A", Version: "1.0.0"})
+	b, _ := il.Begin(intentRecord{Op: intentRemove, ID: "B", Version: "1.0.0"})
+	il.Done(a)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("log removed with an intent still open: %v", err)
+	}
+	il.Done(b)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("log kept with nothing open: %v", err)
+	}
+
+	// Shared storage keeps it for the other instances
+	il.shared = true
+	a, _ = il.Begin(intentRecord{Op: intentRemove, ID: "A", Version: "1.0.0"})
+	il.Done(a)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("shared log removed: %v", err)
+	}
+}
+
+// changeCount counts the change log's records of a kind for a version
+func changeCount(fs *fileStoreLocal, kind string, id string, ver string) int {
+	fs.changes.lock.Lock()
+	defer fs.changes.lock.Unlock()
+	n := 0
+	for _, c := range fs.changes.records {
+		if c.Type == kind && strings.EqualFold(c.ID, id) && c.Version == ver {
+			n++
+		}
+	}
+	return n
+}
+
+// wantNoIntents checks recovery has started the intent log again
+func wantNoIntents(t *testing.T, ts *testServer, what string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(ts.Root, "intents.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("%s: intent log kept after recovery: %v", what, err)
+	}
+}
+
+// A delete interrupted after any of its steps is finished by the next start
+func TestRecoverRemove(t *testing.T) {
+	steps := []string{"begun", "nupkg", "content", "counts", "changes"}
+	for n := range steps {
+		what := "crash after " + steps[n]
+		ts := newTestServer(t, nil)
+		ts.mustPush(t, testPackage(t, "Crash.Pkg", "1.0.0", "", map[string]string{"content/readme.txt": "hello"}))
+		fs := ts.local(t)
+		fs.downloadCounts["Crash.Pkg/1.0.0"] = 5
+		if err := fs.SaveDownloadCounts(); err != nil {
+			t.Fatal(err)
+		}
+		npe, err := fs.GetPackageEntry(context.Background(), "Crash.Pkg", "1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ir := intentRecord{Op: intentRemove, ID: "Crash.Pkg", Version: "1.0.0", Path: ts.nupkgPath(t, "Crash.Pkg", "1.0.0"), Hash: npe.Properties.PackageHash, Size: npe.Properties.PackageSize.Value}
+		vd := ts.versionDir(t, "Crash.Pkg", "1.0.0")
+		if _, err := os.Stat(vd); err != nil {
+			t.Fatalf("%s: no content to remove: %v", what, err)
+		}
+
+		// The steps RemovePackage takes, up to the crash
+		if _, err := fs.intents.Begin(ir); err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range steps[1 : n+1] {
+			switch step {
+			case "nupkg":
+				err = os.Remove(ir.Path)
+			case "content":
+				err = os.RemoveAll(vd)
+			case "counts":
+				delete(fs.downloadCounts, "Crash.Pkg/1.0.0")
+				err = fs.SaveDownloadCounts()
+			case "changes":
+				err = fs.changes.Append(changeRemoved, ir.ID, ir.Version, ir.Hash, ir.Size)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", what, err)
+			}
+		}
+
+		ts.restart(t)
+		fs = ts.local(t)
+		for _, p := range []string{ir.Path, vd} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("%s: %s left behind", what, p)
+			}
+		}
+		if _, ok := fs.downloadCounts["Crash.Pkg/1.0.0"]; ok {
+			t.Errorf("%s: download count left behind", what)
+		}
+		if got := changeCount(fs, changeRemoved, "Crash.Pkg", "1.0.0"); got != 1 {
+			t.Errorf("%s: removal recorded %d times", what, got)
+		}
+		status, body := ts.get(t, "Packages(Id='Crash.Pkg',Version='1.0.0')")
+		wantStatus(t, what, status, body, http.StatusNotFound)
+		wantNoIntents(t, ts, what)
+	}
+}
+
+// A push interrupted before it reaches the change log is undone by the next
+// start, whether the version is new or replaces one that was deleted
+func TestRecoverStore(t *testing.T) {
+	for _, overwrite := range []bool{false, true} {
+		for _, step := range []string{"begun", "nupkg", "changes"} {
+			what := "crash after " + step
+			if overwrite {
+				what = "overwrite " + what
+			}
+			ts := newTestServer(t, nil)
+			fs := ts.local(t)
+			if overwrite {
+				ts.mustPush(t, testPackage(t, "Crash.Pkg", "1.0.0", "<title>Old</title>", nil))
+				if err := fs.DeletePackage(context.Background(), "Crash.Pkg", "1.0.0"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The steps StorePackage takes, up to the crash
+			pkg := testPackage(t, "Crash.Pkg", "1.0.0", "", nil)
+			h := sha512.Sum512(pkg)
+			ir := intentRecord{Op: intentStore, ID: "Crash.Pkg", Version: "1.0.0", Path: ts.nupkgPath(t, "Crash.Pkg", "1.0.0"), Hash: hex.EncodeToString(h[:]), Size: len(pkg)}
+			if _, err := fs.intents.Begin(ir); err != nil {
+				t.Fatal(err)
+			}
+			if step != "begun" {
+				if err := os.MkdirAll(filepath.Dir(ir.Path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(ir.Path, pkg, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if step == "changes" {
+				if err := fs.changes.Append(changeAdded, ir.ID, ir.Version, ir.Hash, ir.Size); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ts.restart(t)
+			fs = ts.local(t)
+			status, body := ts.get(t, "Packages(Id='Crash.Pkg',Version='1.0.0')")
+			if step == "changes" {
+				// Recorded, so kept
+				wantStatus(t, what, status, body, http.StatusOK)
+				if strings.Contains(body, "Old") {
+					t.Errorf("%s: serving the old package", what)
+				}
+			} else {
+				wantStatus(t, what, status, body, http.StatusNotFound)
+				if _, err := os.Stat(ir.Path); !os.IsNotExist(err) {
+					t.Errorf("%s: nupkg left behind", what)
+				}
+				if got := changeCount(fs, changeAdded, "Crash.Pkg", "1.0.0"); overwrite && got != 1 || !overwrite && got != 0 {
+					t.Errorf("%s: added recorded %d times", what, got)
+				}
+			}
+			wantNoIntents(t, ts, what)
+		}
+	}
+}
+
+// Recovery never deletes a nupkg the interrupted push wasn't writing
+func TestRecoverStoreKeepsOtherFile(t *testing.T) {
+	ts := newTestServer(t, nil)
+	fs := ts.local(t)
+	pkg := testPackage(t, "Crash.Pkg", "1.0.0", "", nil)
+	ir := intentRecord{Op: intentStore, ID: "Crash.Pkg", Version: "1.0.0", Path: ts.nupkgPath(t, "Crash.Pkg", "1.0.0"), Hash: strings.Repeat("0", 128), Size: len(pkg)}
+	if _, err := fs.intents.Begin(ir); err != nil {
+		t.Fatal(err)
+	}
+	copyPackage(t, server.config, "Crash.Pkg", "1.0.0", pkg)
+
+	ts.restart(t)
+	status, body := ts.get(t, "Packages(Id='Crash.Pkg',Version='1.0.0')")
+	wantStatus(t, "other file", status, body, http.StatusOK)
+	wantNoIntents(t, ts, "other file")
+}
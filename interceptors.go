@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/thatgitsam/go-nuget-server/hooks"
+)
+
+// Names of the built in push interceptors
+const (
+	idPolicyInterceptor         = "id-policy"
+	injectRepositoryInterceptor = "inject-repository"
+)
+
+// pushInterceptorConfig names a push interceptor to run and its settings
+type pushInterceptorConfig struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+func init() {
+	hooks.Register(idPolicyInterceptor, func(json.RawMessage) (hooks.PushInterceptor, error) {
+		return idPolicyHook{}, nil
+	})
+	hooks.Register(injectRepositoryInterceptor, newInjectRepositoryHook)
+}
+
+// newPushChain returns the interceptors a config runs on pushes. The id-policy
+// check always runs first, so the ones configured can't get around it.
+func newPushChain(c *Config) (hooks.Chain, error) {
+	chain := hooks.Chain{idPolicyHook{}}
+	for _, ic := range c.PushInterceptors {
+		if ic.Name == idPolicyInterceptor {
+			return nil, errors.New("push-interceptors must not list " + idPolicyInterceptor + ", it always runs first")
+		}
+		i, err := hooks.New(ic.Name, ic.Config)
+		if err != nil {
+			return nil, errors.New("push-interceptors: " + err.Error())
+		}
+		chain = append(chain, i)
+	}
+	return chain, nil
+}
+
+// newPushInfo returns a pushed package as interceptors see it
+func newPushInfo(r *http.Request, pkg []byte) (*hooks.PackageInfo, error) {
+	info, err := hooks.NewPackageInfo(pkg, readNuspec)
+	if err != nil {
+		return nil, err
+	}
+	info.APIKey = requestAPIKey(r)
+	info.RemoteAddr = r.RemoteAddr
+	return info, nil
+}
+
+// pushRejectionStatus returns the status a push refused by an interceptor gets
+func pushRejectionStatus(err error) int {
+	var rej *hooks.Rejection
+	if errors.As(err, &rej) && rej.Forbidden {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// idPolicyHook refuses pushes of IDs reserved by an id-policy for other keys
+type idPolicyHook struct {
+	hooks.Base
+}
+
+func (idPolicyHook) Validate(ctx context.Context, p *hooks.PackageInfo) error {
+	if err := idPolicyError(server.Config(), p.Nuspec.Meta.ID, p.APIKey); err != nil {
+		return hooks.Forbid(err.Error())
+	}
+	return nil
+}
+
+// injectRepositoryHook adds a <repository> element to the nuspec of packages
+// pushed without one, so every package links back to its source
+type injectRepositoryHook struct {
+	hooks.Base
+	// Type of the repository, e.g. git
+	Type string `json:"type"`
+	// URL of the repository, {id} and {version} are replaced
+	URL string `json:"url"`
+	// Replace a <repository> the package already has
+	Override bool `json:"override"`
+}
+
+func newInjectRepositoryHook(config json.RawMessage) (hooks.PushInterceptor, error) {
+	h := &injectRepositoryHook{}
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, h); err != nil {
+			return nil, errors.New(injectRepositoryInterceptor + " config: " + err.Error())
+		}
+	}
+	if h.URL == "" {
+		return nil, errors.New(injectRepositoryInterceptor + " config must set url")
+	}
+	return h, nil
+}
+
+// Matches a <repository> element, empty or not
+var repositoryElement = regexp.MustCompile(`(?s)<repository\b[^>]*?(/>|>.*?</repository>)`)
+
+func (h *injectRepositoryHook) Mutate(ctx context.Context, p *hooks.PackageInfo) error {
+	url := strings.NewReplacer("{id}", p.Nuspec.Meta.ID, "{version}", p.Nuspec.Meta.Version).Replace(h.URL)
+	var elem bytes.Buffer
+	elem.WriteString(`<repository`)
+	if h.Type != "" {
+		elem.WriteString(` type="`)
+		xml.EscapeText(&elem, []byte(h.Type))
+		elem.WriteString(`"`)
+	}
+	elem.WriteString(` url="`)
+	xml.EscapeText(&elem, []byte(url))
+	elem.WriteString(`" />`)
+
+	b, changed, err := rewriteNuspec(p.Bytes(), func(ns []byte) ([]byte, bool) {
+		// Only UTF-8 nuspecs can be edited as text
+		if !utf8.Valid(ns) {
+			return ns, false
+		}
+		if repositoryElement.Match(ns) {
+			if !h.Override {
+				return ns, false
+			}
+			return repositoryElement.ReplaceAllLiteral(ns, elem.Bytes()), true
+		}
+		i := bytes.LastIndex(ns, []byte("</metadata>"))
+		if i < 0 {
+			return ns, false
+		}
+		return append(append(append([]byte{}, ns[:i]...), elem.Bytes()...), ns[i:]...), true
+	})
+	if err != nil || !changed {
+		return err
+	}
+	return p.SetBytes(b)
+}
+
+// rewriteNuspec returns a package with its root .nuspec passed through edit. The
+// package is repacked only if edit reports a change.
+func rewriteNuspec(pkg []byte, edit func([]byte) ([]byte, bool)) ([]byte, bool, error) {
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		return nil, false, err
+	}
+	var nuspecFile *zip.File
+	var ns []byte
+	for _, f := range zr.File {
+		if path.Dir(f.Name) == "." && path.Ext(f.Name) == ".nuspec" {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, false, err
+			}
+			ns, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, false, err
+			}
+			nuspecFile = f
+			break
+		}
+	}
+	if nuspecFile == nil {
+		return nil, false, errors.New("package has no nuspec")
+	}
+	ns, changed := edit(ns)
+	if !changed {
+		return pkg, false, nil
+	}
+
+	// Copy every entry across, in order, with the nuspec replaced
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		fh := f.FileHeader
+		w, err := zw.CreateHeader(&fh)
+		if err != nil {
+			return nil, false, err
+		}
+		if f == nuspecFile {
+			if _, err := w.Write(ns); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, false, err
+		}
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/thatgitsam/go-nuget-server/hooks"
+)
+
+// Calls made to the test interceptors, in order
+var interceptorCalls struct {
+	sync.Mutex
+	calls []string
+}
+
+// testInterceptor records its calls, failing the one named in its config
+type testInterceptor struct {
+	Name string `json:"name"`
+	// "validate", "forbid", "mutate" or "rename" (changing the package ID)
+	Fail string `json:"fail"`
+}
+
+func init() {
+	hooks.Register("test-recorder", func(config json.RawMessage) (hooks.PushInterceptor, error) {
+		i := &testInterceptor{}
+		return i, json.Unmarshal(config, i)
+	})
+}
+
+func (i *testInterceptor) record(method string) {
+	interceptorCalls.Lock()
+	defer interceptorCalls.Unlock()
+	interceptorCalls.calls = append(interceptorCalls.calls, i.Name+"."+method)
+}
+
+func (i *testInterceptor) Validate(ctx context.Context, p *hooks.PackageInfo) error {
+	i.record("validate")
+	switch i.Fail {
+	case "validate":
+		return hooks.Reject(i.Name + " refused " + p.Nuspec.Meta.ID)
+	case "forbid":
+		return hooks.Forbid(i.Name + " forbade " + p.Nuspec.Meta.ID)
+	}
+	return nil
+}
+
+func (i *testInterceptor) Mutate(ctx context.Context, p *hooks.PackageInfo) error {
+	i.record("mutate")
+	switch i.Fail {
+	case "mutate":
+		return errors.New(i.Name + " could not change " + p.Nuspec.Meta.ID)
+	case "rename":
+		b, _, err := rewriteNuspec(p.Bytes(), func(ns []byte) ([]byte, bool) {
+			return []byte(strings.Replace(string(ns), "<id>"+p.Nuspec.Meta.ID+"</id>", "<id>Renamed</id>", 1)), true
+		})
+		if err != nil {
+			return err
+		}
+		return p.SetBytes(b)
+	}
+	return nil
+}
+
+func (i *testInterceptor) AfterStore(ctx context.Context, p *hooks.PackageInfo) {
+	i.record("after")
+}
+
+// takeInterceptorCalls returns the calls made since it was last called
+func takeInterceptorCalls() []string {
+	interceptorCalls.Lock()
+	defer interceptorCalls.Unlock()
+	calls := interceptorCalls.calls
+	interceptorCalls.calls = nil
+	return calls
+}
+
+// Interceptors run in the order configured, after the id-policy check, and a
+// failure stops the push with the interceptor's reason
+func TestPushInterceptors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fail   map[string]string // Failures, by interceptor
+		id     string
+		status int
+		reason string
+		calls  []string
+	}{
+		{name: "all pass", id: "Hook.Pkg", status: http.StatusCreated,
+			calls: []string{"a.validate", "b.validate", "a.mutate", "b.mutate", "a.after", "b.after"}},
+		{name: "id-policy first", id: "QSC.Reserved", status: http.StatusForbidden, reason: "qsc"},
+		{name: "refused", fail: map[string]string{"a": "validate"}, id: "Hook.Pkg", status: http.StatusBadRequest, reason: "a refused Hook.Pkg",
+			calls: []string{"a.validate"}},
+		{name: "forbidden", fail: map[string]string{"b": "forbid"}, id: "Hook.Pkg", status: http.StatusForbidden, reason: "b forbade Hook.Pkg",
+			calls: []string{"a.validate", "b.validate"}},
+		{name: "mutate fails", fail: map[string]string{"a": "mutate"}, id: "Hook.Pkg", status: http.StatusBadRequest, reason: "a could not change Hook.Pkg",
+			calls: []string{"a.validate", "b.validate", "a.mutate"}},
+		{name: "renamed", fail: map[string]string{"b": "rename"}, id: "Hook.Pkg", status: http.StatusInternalServerError,
+			calls: []string{"a.validate", "b.validate", "a.mutate", "b.mutate"}},
+	} {
+		ts := newTestServer(t, func(c *Config) {
+			c.IDPolicies = testIDPolicies
+			for _, n := range []string{"a", "b"} {
+				b, _ := json.Marshal(testInterceptor{Name: n, Fail: tc.fail[n]})
+				c.PushInterceptors = append(c.PushInterceptors, pushInterceptorConfig{Name: "test-recorder", Config: b})
+			}
+		})
+		takeInterceptorCalls()
+
+		status, body := ts.push(t, testPackage(t, tc.id, "1.0.0", "", nil))
+		wantStatus(t, tc.name, status, body, tc.status)
+		if tc.reason != "" {
+			var res uploadResult
+			if err := json.Unmarshal([]byte(body), &res); err != nil || !strings.Contains(res.Error, tc.reason) {
+				t.Errorf("%s: got %s, want the error %q", tc.name, body, tc.reason)
+			}
+		}
+		if calls := takeInterceptorCalls(); !reflect.DeepEqual(calls, tc.calls) {
+			t.Errorf("%s: got calls %q, want %q", tc.name, calls, tc.calls)
+		}
+
+		// Only a push that got through is stored
+		want := "0"
+		if tc.status == http.StatusCreated {
+			want = "1"
+		}
+		if _, n := ts.get(t, "Packages()/$count"); n != want {
+			t.Errorf("%s: %s packages stored, want %s", tc.name, n, want)
+		}
+	}
+}
+
+// The id-policy interceptor can't be configured, as it always runs first
+func TestPushChainConfig(t *testing.T) {
+	c := &Config{}
+	c.PushInterceptors = []pushInterceptorConfig{{Name: injectRepositoryInterceptor, Config: json.RawMessage(`{"url": "https://git.example.com/{id}"}`)}}
+	chain, err := newPushChain(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || reflect.TypeOf(chain[0]) != reflect.TypeOf(idPolicyHook{}) {
+		t.Errorf("chain %#v", chain)
+	}
+
+	for _, tc := range []struct {
+		ic  pushInterceptorConfig
+		err string
+	}{
+		{pushInterceptorConfig{Name: idPolicyInterceptor}, "must not list id-policy"},
+		{pushInterceptorConfig{Name: "no-such-interceptor"}, "push-interceptors: unknown push interceptor no-such-interceptor"},
+		{pushInterceptorConfig{Name: injectRepositoryInterceptor}, "inject-repository config must set url"},
+	} {
+		c.PushInterceptors = []pushInterceptorConfig{tc.ic}
+		if _, err := newPushChain(c); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got %v, want %q", tc.ic.Name, err, tc.err)
+		}
+	}
+}
+
+// inject-repository adds a <repository> to packages without one, replacing one
+// only with override
+func TestInjectRepository(t *testing.T) {
+	for _, override := range []bool{false, true} {
+		ts := newTestServer(t, func(c *Config) {
+			b, _ := json.Marshal(injectRepositoryHook{Type: "git", URL: "https://git.example.com/{id}?v={version}", Override: override})
+			c.PushInterceptors = []pushInterceptorConfig{{Name: injectRepositoryInterceptor, Config: b}}
+		})
+		ts.mustPush(t, testPackage(t, "Repo.None", "1.0.0", "", nil))
+		ts.mustPush(t, testPackage(t, "Repo.Own", "1.0.0", `<repository type="svn" url="https://svn.example.com/own" />`, nil))
+
+		for id, want := range map[string]string{
+			"Repo.None": `<repository type="git" url="https://git.example.com/Repo.None?v=1.0.0" />`,
+			"Repo.Own":  map[bool]string{false: `<repository type="svn" url="https://svn.example.com/own" />`, true: `<repository type="git" url="https://git.example.com/Repo.Own?v=1.0.0" />`}[override],
+		} {
+			status, body := ts.get(t, "nuspec/"+id+"/1.0.0")
+			wantStatus(t, id, status, body, http.StatusOK)
+			if strings.Count(body, "<repository") != 1 || !strings.Contains(body, want) {
+				t.Errorf("%s with override %v: nuspec %s, want %s", id, override, body, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Layouts of the local filestore directory
+const (
+	// layoutHierarchical stores {id}/{version}/{id}.{version}.nupkg with the
+	// extracted content and markers beside it
+	layoutHierarchical = "hierarchical"
+	// layoutFlat keeps every nupkg directly in the root under any name, reading the
+	// id and version from the nuspec. Content and markers go in .content/{id}/{version}.
+	layoutFlat = "flat"
+)
+
+// Directory under the root holding extracted content in the flat layout
+const flatContentDirName = ".content"
+
+// validateLayout checks the filestore layout config
+func validateLayout(c *Config) error {
+	switch c.FileStore.Layout {
+	case "", layoutHierarchical, layoutFlat:
+		return nil
+	}
+	return errors.New(`filestore layout must be "hierarchical" or "flat": ` + c.FileStore.Layout)
+}
+
+// pathKey identifies a version in the nupkg path index, ignoring case and normalization
+func pathKey(id string, ver string) string {
+	return versionKey(id, ver)
+}
+
+// nupkgPath returns where a version's nupkg is stored, or would be if pushed under
+// its normalized version. Found packages keep the path they were loaded from,
+// however the version is written there, and in the flat layout whatever file name
+// they had.
+func (fs *fileStoreLocal) nupkgPath(id string, ver string) string {
+	id = strings.ToLower(id)
+	fs.pathsLock.RLock()
+	p, ok := fs.paths[pathKey(id, ver)]
+	fs.pathsLock.RUnlock()
+	if ok {
+		return p
+	}
+	ver = versions.Normalize(ver)
+	if !fs.flat {
+		return filepath.Join(fs.rootDir, id, ver, id+"."+ver+".nupkg")
+	}
+	return filepath.Join(fs.rootDir, id+"."+ver+".nupkg")
+}
+
+// diskPackage is a package file the layout has on disk, loaded or not
+type diskPackage struct {
+	path string
+	// From the directory names in the hierarchical layout, empty in the flat one
+	id  string
+	ver string
+	// A hierarchical version directory without its nupkg
+	missing bool
+}
+
+// diskPackages lists the package files in the store's directory, as they are
+// loaded at startup
+func (fs *fileStoreLocal) diskPackages() ([]diskPackage, error) {
+	if fs.flat {
+		files, err := filepath.Glob(filepath.Join(fs.rootDir, "*.nupkg"))
+		if err != nil {
+			return nil, err
+		}
+		pkgs := make([]diskPackage, len(files))
+		for i, fp := range files {
+			pkgs[i] = diskPackage{path: fp}
+		}
+		return pkgs, nil
+	}
+
+	// First level is lowercase IDs, then versions
+	ids, err := ioutil.ReadDir(fs.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []diskPackage
+	for _, id := range ids {
+		// Skip internal directories such as the quarantine area
+		if !id.IsDir() || strings.HasPrefix(id.Name(), ".") {
+			continue
+		}
+		vers, err := ioutil.ReadDir(filepath.Join(fs.rootDir, id.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, ver := range vers {
+			if !ver.IsDir() {
+				continue
+			}
+			p := diskPackage{
+				path: filepath.Join(fs.rootDir, id.Name(), ver.Name(), id.Name()+"."+ver.Name()+".nupkg"),
+				id:   id.Name(),
+				ver:  ver.Name(),
+			}
+			if _, err := os.Stat(p.path); os.IsNotExist(err) {
+				p.missing = true
+			}
+			pkgs = append(pkgs, p)
+		}
+	}
+	return pkgs, nil
+}
+
+// versionDir returns the directory holding a version's extracted content and markers
+func (fs *fileStoreLocal) versionDir(id string, ver string) string {
+	if !fs.flat {
+		// Beside the nupkg, wherever it was found
+		return filepath.Dir(fs.nupkgPath(id, ver))
+	}
+	return filepath.Join(fs.contentRoot(), strings.ToLower(id), versions.Normalize(ver))
+}
+
+// snupkgPath returns where a version's symbol package is stored, beside its content
+func (fs *fileStoreLocal) snupkgPath(id string, ver string) string {
+	return filepath.Join(fs.versionDir(id, ver), strings.ToLower(id)+"."+versions.Normalize(ver)+".snupkg")
+}
+
+// servedFilePath returns where a /files path is on disk. The store's own files are
+// never served: those at the top of the store, such as downloads.json and the
+// idempotency keys, and anything under a name starting with '.', such as .settings
+// and the version markers.
+func (fs *fileStoreLocal) servedFilePath(f string) (string, bool) {
+	p := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(f)), "/")
+	x := strings.Split(p, "/")
+	if len(x) < 2 {
+		return "", false
+	}
+	for _, s := range x {
+		if strings.HasPrefix(s, ".") {
+			return "", false
+		}
+	}
+	// The _www pages are at the top of the store whatever the layout
+	if x[0] == "_www" {
+		return filepath.Join(fs.rootDir, filepath.FromSlash(p)), true
+	}
+	return filepath.Join(fs.contentRoot(), filepath.FromSlash(p)), true
+}
+
+// Directory in a version's directory holding gzipped copies of its content, apart
+// from the content so they can't be mistaken for, or replace, files named .gz
+const precompressedDirName = ".gz"
+
+// precompressedPath returns where the gzipped copy of a file named by its path
+// under a version's directory is kept
+func precompressedPath(dir string, name string) string {
+	return filepath.Join(dir, precompressedDirName, filepath.FromSlash(name)+".gz")
+}
+
+// compressedFilePath returns where the gzipped copy of a /files path is kept. The
+// first two parts of the path are the version's directory.
+func (fs *fileStoreLocal) compressedFilePath(f string) (string, bool) {
+	if _, ok := fs.servedFilePath(f); !ok {
+		return "", false
+	}
+	x := strings.SplitN(strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(f)), "/"), "/", 3)
+	if len(x) < 3 {
+		return "", false
+	}
+	return precompressedPath(filepath.Join(fs.contentRoot(), x[0], x[1]), x[2]), true
+}
+
+// contentRoot returns the directory /files paths are served from
+func (fs *fileStoreLocal) contentRoot() string {
+	if fs.flat {
+		return filepath.Join(fs.rootDir, flatContentDirName)
+	}
+	return fs.rootDir
+}
+
+// indexPath records where a loaded version's nupkg is. It returns the path already
+// recorded if another file holds the same version.
+func (fs *fileStoreLocal) indexPath(id string, ver string, fp string) (string, bool) {
+	fs.pathsLock.Lock()
+	defer fs.pathsLock.Unlock()
+	k := pathKey(id, ver)
+	if p, ok := fs.paths[k]; ok && p != fp {
+		return p, false
+	}
+	fs.paths[k] = fp
+	return fp, true
+}
+
+// unindexPath forgets where a removed version's nupkg was
+func (fs *fileStoreLocal) unindexPath(id string, ver string) {
+	fs.pathsLock.Lock()
+	defer fs.pathsLock.Unlock()
+	delete(fs.paths, pathKey(id, ver))
+}
+
+// resetPaths empties the nupkg path index before the packages are reloaded
+func (fs *fileStoreLocal) resetPaths() {
+	fs.pathsLock.Lock()
+	defer fs.pathsLock.Unlock()
+	fs.paths = make(map[string]string)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// LicenseUrl NuGet expects when a package has a license expression or file instead
+// of a URL. Clients seeing it read the license from the package metadata.
+const deprecatedLicenseURL = "https://aka.ms/deprecateLicenseUrl"
+
+// Largest license file served
+const maxLicenseFileBytes = 1024 * 1024
+
+// licenseLink returns where a person can read a package's license: the expression
+// on licenses.nuget.org, the embedded file through the license route, or the
+// legacy URL. It is "" if the package has no license.
+func licenseLink(e *NugetPackageEntry) string {
+	switch {
+	case e.Properties.LicenseExpression != "":
+		return "https://licenses.nuget.org/" + url.PathEscape(e.Properties.LicenseExpression)
+	case e.Properties.LicenseFile != "":
+		return server.URL.String() + "license/" + url.PathEscape(e.Properties.ID) + "/" + url.PathEscape(e.Properties.Version)
+	case !e.Properties.LicenseURL.Null && e.Properties.LicenseURL.Value != deprecatedLicenseURL:
+		return e.Properties.LicenseURL.Value
+	}
+	return ""
+}
+
+// serveLicense serves license/{id}/{version}: the license file embedded in the
+// package, or a redirect to the license's text for expressions and legacy URLs
+func serveLicense(w http.ResponseWriter, r *http.Request) {
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`license`):], `/`), `/`)
+	if len(x) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	npe, err := server.fs.GetPackageEntry(r.Context(), x[0], x[1])
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if snap := requestSnapshot(r); snap != nil && !snap.Contains(npe.Properties.ID, npe.Properties.Version) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if npe.Properties.LicenseFile == "" {
+		link := licenseLink(npe)
+		if link == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+
+	// The nuspec names the file with either slash, and zip entry names vary in case
+	files, err := packageListing(r.Context(), npe.Properties.ID, npe.Properties.Version)
+	if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	name := ""
+	for _, f := range files {
+		if strings.EqualFold(f.Name, npe.Properties.LicenseFile) {
+			name = f.Name
+		}
+	}
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b, err := readPackageEntry(r.Context(), npe.Properties.ID, npe.Properties.Version, name, maxLicenseFileBytes)
+	if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// NuGet only allows text and markdown license files
+	if strings.EqualFold(path.Ext(name), ".md") {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(b)
+}
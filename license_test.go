@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// The license text packed with license-file.nuspec
+const testLicenseFile = "# License\n\nUse it *as is*.\n"
+
+// Each way a nuspec gives its license is served as NuGet clients expect, and the
+// license route finds the license for a person to read
+func TestLicenseFixtures(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, tc := range []struct {
+		file  string
+		id    string
+		url   string // LicenseUrl in the feed
+		names string // LicenseNames in the feed
+		// What license/{id}/{version} gives
+		status   int
+		location string
+		body     string
+	}{
+		{file: "license-expression.nuspec", id: "Vendor.LicenseExpression",
+			url: "https://licenses.nuget.org/MIT%20OR%20Apache-2.0", names: "MIT OR Apache-2.0",
+			status: http.StatusFound, location: "https://licenses.nuget.org/MIT%20OR%20Apache-2.0"},
+		{file: "license-file.nuspec", id: "Vendor.LicenseFile",
+			url:    deprecatedLicenseURL,
+			status: http.StatusOK, body: testLicenseFile},
+		{file: "license-url.nuspec", id: "Vendor.LicenseUrl",
+			url:    "https://vendor.example/eula.html",
+			status: http.StatusFound, location: "https://vendor.example/eula.html"},
+		{file: "license-none.nuspec", id: "Vendor.LicenseNone",
+			status: http.StatusNotFound},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw := zip.NewWriter(&buf)
+			for name, content := range map[string]string{
+				"package.nuspec":  string(readNuspecFixture(t, tc.file)),
+				"docs/LICENSE.md": testLicenseFile,
+			} {
+				w, err := zw.Create(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.Write([]byte(content))
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			ts.mustPush(t, buf.Bytes())
+
+			status, body := ts.get(t, "Packages(Id='"+tc.id+"',Version='1.0.0')")
+			wantStatus(t, "entry", status, body, http.StatusOK)
+			if got := between(body, `<d:LicenseUrl m:null="false">`, "</d:LicenseUrl>"); got != tc.url {
+				t.Errorf("LicenseUrl %q, want %q", got, tc.url)
+			}
+			if got := between(body, `<d:LicenseNames m:null="false">`, "</d:LicenseNames>"); got != tc.names {
+				t.Errorf("LicenseNames %q, want %q", got, tc.names)
+			}
+
+			// Not followed, the redirect is the answer
+			r, err := http.NewRequest(http.MethodGet, ts.Feed+"license/"+tc.id+"/1.0.0", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("X-NuGet-ApiKey", testReadKey)
+			res, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			location, contentType := res.Header.Get("Location"), res.Header.Get("Content-Type")
+			status, body = readResponse(t, res)
+			wantStatus(t, "license", status, body, tc.status)
+			if location != tc.location {
+				t.Errorf("license redirects to %q, want %q", location, tc.location)
+			}
+			if tc.body != "" && (body != tc.body || !strings.HasPrefix(contentType, "text/markdown")) {
+				t.Errorf("license served as %s:\n%s", contentType, body)
+			}
+		})
+	}
+}
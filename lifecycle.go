@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long in-flight requests get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// startServer starts serving in the background, on a listener handed over by the
+// service manager if there is one, otherwise on addr. The returned channel receives
+// the error if serving stops other than by stopServer.
+func startServer(addr string) (*http.Server, <-chan error, error) {
+	l, err := inheritedListener()
+	if err != nil {
+		return nil, nil, err
+	}
+	if l == nil {
+		if addr == "" {
+			addr = ":http"
+		}
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		log.Println("Using listener from the service manager:", l.Addr())
+	}
+
+	srv := &http.Server{Addr: addr}
+	errc := make(chan error, 2)
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			errc <- err
+		}
+	}()
+
+	// The gRPC admin API has a port of its own, if configured
+	if a := server.Config().AdminGRPCAddress; a != "" {
+		if server.adminGRPC, err = startAdminGRPC(a, errc); err != nil {
+			srv.Close()
+			return nil, nil, err
+		}
+	}
+	return srv, errc, nil
+}
+
+// stopServer lets in-flight requests finish and writes out queued state. Every way
+// of running the server stops through here.
+func stopServer(srv *http.Server) {
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Error: Shutdown", err)
+	}
+	if server.adminGRPC != nil {
+		stopAdminGRPC(ctx, server.adminGRPC)
+	}
+	server.downloads.Close()
+	if err := server.idempotency.Save(); err != nil {
+		log.Println("Error saving idempotency keys:", err)
+	}
+	server.tracer.Close()
+}
+
+// runConsole serves until interrupted or terminated, telling systemd when ready and
+// stopping if it's the service manager
+func runConsole(addr string) {
+	srv, errc, err := startServer(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	notifySystemd("READY=1")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-sig:
+	}
+
+	notifySystemd("STOPPING=1")
+	stopServer(srv)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// What DELETE api/v2/package/{id}/{version} does, see delete-mode
+const (
+	deleteModeHard   = "hard"
+	deleteModeUnlist = "unlist"
+)
+
+// validateDeleteMode checks the delete-mode config
+func validateDeleteMode(c *Config) error {
+	switch c.DeleteMode {
+	case "", deleteModeHard, deleteModeUnlist:
+		return nil
+	}
+	return errors.New("delete-mode must be hard or unlist: " + c.DeleteMode)
+}
+
+// filterUnlisted drops unlisted versions from a package list, which like search
+// only offers listed versions. They're still served by id and version, and by
+// FindPackagesById, so restores of them keep working.
+func filterUnlisted(entries []*NugetPackageEntry) []*NugetPackageEntry {
+	var filtered []*NugetPackageEntry
+	for _, e := range entries {
+		if e.Properties.Listed.Value {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+func serveListingAction(w http.ResponseWriter, r *http.Request, action string, listed bool) {
+
+	// Expecting [api/]admin/{unlist|relist}/{id}/{version}
+	p := strings.TrimPrefix(r.URL.Path[len(server.URL.Path):], `api/`)
+	x := strings.Split(strings.Trim(p[len(`admin/`+action):], `/`), `/`)
+	if len(x) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Changing a version is governed by the same ID policies as publishing it
+	if err := checkIDPolicy(r, x[0]); err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err := server.fs.SetListed(r.Context(), x[0], x[1], listed)
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveDeletePackage handles DELETE api/v2/package/{id}/{version}, as sent by
+// nuget delete. It removes the version and everything stored with it, or with
+// delete-mode unlist only unlists it, as nuget.org does. A version covered by
+// delete-protection is refused with a summary of its impact unless forced.
+func serveDeletePackage(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting api/v2/package/{id}/{version}
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`api/v2/package`):], `/`), `/`)
+	if len(x) != 2 || x[0] == "" || x[1] == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Deleting a version is governed by the same ID policies as publishing it
+	if err := checkIDPolicy(r, x[0]); err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if !strings.EqualFold(r.URL.Query().Get("force"), "true") {
+		var protected *deleteProtectionError
+		err := checkDeleteProtection(r.Context(), x[0], x[1])
+		if errors.As(err, &protected) {
+			b, err := json.Marshal(deleteRefused{Error: protected.Error(), Impact: protected.Impact})
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			w.WriteHeader(http.StatusConflict)
+			w.Write(b)
+			return
+		} else if err == ErrBusy {
+			writeBusy(w)
+			return
+		} else if isCancelled(err) {
+			writeCancelled(w, r)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err := deleteVersion(r.Context(), x[0], x[1])
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteRefused is the body of a 409 from a delete refused by delete-protection
+type deleteRefused struct {
+	Error  string        `json:"error"`
+	Impact impactSummary `json:"impact"`
+}
+
+// deleteVersion removes a version, or with delete-mode unlist unlists it,
+// returning whether it was only unlisted
+func deleteVersion(ctx context.Context, id string, ver string) (bool, error) {
+	if server.Config().DeleteMode == deleteModeUnlist {
+		return true, server.fs.SetListed(ctx, id, ver, false)
+	}
+	if err := server.fs.DeletePackage(ctx, id, ver); err != nil {
+		return false, err
+	}
+	// It may take the package back under its soft version limit
+	noteVersionCount(id)
+	return false, nil
+}
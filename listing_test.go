@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// latestFlags returns the versions a feed flags IsLatestVersion and
+// IsAbsoluteLatestVersion, joined by commas if more than one is
+func latestFlags(t *testing.T, feed string) (string, string) {
+	t.Helper()
+	var latest, absolute []string
+	for _, e := range strings.Split(feed, "<entry>")[1:] {
+		ver := between(e, "<d:Version>", "</d:Version>")
+		if strings.Contains(between(e, "<d:IsLatestVersion", "</d:IsLatestVersion>"), ">true") {
+			latest = append(latest, ver)
+		}
+		if strings.Contains(between(e, "<d:IsAbsoluteLatestVersion", "</d:IsAbsoluteLatestVersion>"), ">true") {
+			absolute = append(absolute, ver)
+		}
+	}
+	return strings.Join(latest, ","), strings.Join(absolute, ",")
+}
+
+// wantLatest fails the test unless a package's latest flags are on the versions expected
+func wantLatest(t *testing.T, ts *testServer, what string, latest string, absolute string) {
+	t.Helper()
+	status, body := ts.get(t, "FindPackagesById()?id='Flag.Pkg'&semVerLevel=2.0.0")
+	wantStatus(t, what, status, body, http.StatusOK)
+	if l, a := latestFlags(t, body); l != latest || a != absolute {
+		t.Errorf("%s: IsLatestVersion on %q and IsAbsoluteLatestVersion on %q, want %q and %q", what, l, a, latest, absolute)
+	}
+}
+
+// setListed unlists or relists a version of Flag.Pkg
+func (ts *testServer) setListed(t *testing.T, ver string, listed bool) {
+	t.Helper()
+	action := "unlist"
+	if listed {
+		action = "relist"
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/"+action+"/Flag.Pkg/"+ver, testWriteKey, nil, nil))
+	wantStatus(t, action+" "+ver, status, body, http.StatusNoContent)
+}
+
+func TestLatestVersionFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		listed   []string
+		unlisted []string
+		latest   string
+		absolute string
+	}{
+		{name: "stable", listed: []string{"1.0.0", "2.0.0"}, latest: "2.0.0", absolute: "2.0.0"},
+		{name: "stable unlisted", listed: []string{"1.0.0"}, unlisted: []string{"2.0.0"}, latest: "1.0.0", absolute: "1.0.0"},
+		{name: "prerelease", listed: []string{"1.0.0", "2.0.0-beta"}, latest: "1.0.0", absolute: "2.0.0-beta"},
+		{name: "prerelease unlisted", listed: []string{"1.0.0"}, unlisted: []string{"2.0.0-beta"}, latest: "1.0.0", absolute: "1.0.0"},
+		{name: "stable unlisted under prerelease", listed: []string{"2.0.0-beta"}, unlisted: []string{"1.0.0"}, absolute: "2.0.0-beta"},
+		{name: "only prereleases", listed: []string{"1.0.0-alpha", "1.0.0-beta"}, absolute: "1.0.0-beta"},
+		{name: "all unlisted", unlisted: []string{"1.0.0", "2.0.0-beta"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestServer(t, nil)
+			for _, v := range append(append([]string(nil), tc.listed...), tc.unlisted...) {
+				ts.mustPush(t, testPackage(t, "Flag.Pkg", v, "", nil))
+			}
+			for _, v := range tc.unlisted {
+				ts.setListed(t, v, false)
+			}
+			wantLatest(t, ts, tc.name, tc.latest, tc.absolute)
+		})
+	}
+}
+
+// The flags move with every push, unlist, relist and delete
+func TestLatestVersionFlagsRecalculated(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Flag.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Flag.Pkg", "2.0.0", "", nil))
+	wantLatest(t, ts, "pushed", "2.0.0", "2.0.0")
+
+	status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Flag.Pkg/2.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete", status, body, http.StatusNoContent)
+	wantLatest(t, ts, "deleted", "1.0.0", "1.0.0")
+
+	ts.mustPush(t, testPackage(t, "Flag.Pkg", "3.0.0-beta", "", nil))
+	wantLatest(t, ts, "prerelease pushed", "1.0.0", "3.0.0-beta")
+
+	ts.setListed(t, "1.0.0", false)
+	wantLatest(t, ts, "unlisted", "", "3.0.0-beta")
+	ts.setListed(t, "1.0.0", true)
+	wantLatest(t, ts, "relisted", "1.0.0", "3.0.0-beta")
+}
+
+// Versions are unlisted and relisted under admin/ and api/admin/ alike, and one
+// deleted in delete-mode unlist is brought back by relisting it
+func TestListingRoutes(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.DeleteMode = deleteModeUnlist })
+	ts.mustPush(t, testPackage(t, "Flag.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Flag.Pkg", "2.0.0", "", nil))
+	for _, tc := range []struct {
+		method string
+		p      string
+		key    string
+		status int
+		latest string // IsLatestVersion after
+	}{
+		{http.MethodPost, "api/admin/unlist/Flag.Pkg/2.0.0", testWriteKey, http.StatusNoContent, "1.0.0"},
+		{http.MethodPost, "api/admin/relist/flag.pkg/2.0.0", testWriteKey, http.StatusNoContent, "2.0.0"},
+		{http.MethodPost, "admin/unlist/Flag.Pkg/2.0.0", testWriteKey, http.StatusNoContent, "1.0.0"},
+		{http.MethodPost, "admin/relist/Flag.Pkg/2.0.0", testWriteKey, http.StatusNoContent, "2.0.0"},
+		{http.MethodDelete, "api/v2/package/Flag.Pkg/2.0.0", testWriteKey, http.StatusNoContent, "1.0.0"},
+		{http.MethodPost, "api/admin/relist/Flag.Pkg/2.0.0", testWriteKey, http.StatusNoContent, "2.0.0"},
+		{http.MethodPost, "api/admin/unlist/Flag.Pkg/2.0.0", testReadKey, http.StatusForbidden, "2.0.0"},
+		{http.MethodPost, "api/admin/unlist/Flag.Pkg/3.0.0", testWriteKey, http.StatusNotFound, "2.0.0"},
+		{http.MethodPost, "api/admin/unlist/Flag.Pkg", testWriteKey, http.StatusNotFound, "2.0.0"},
+		{http.MethodPost, "api/admin/relist/Flag.Pkg/2.0.0/extra", testWriteKey, http.StatusNotFound, "2.0.0"},
+		{http.MethodGet, "api/admin/relist/Flag.Pkg/2.0.0", testWriteKey, http.StatusNotFound, "2.0.0"},
+	} {
+		what := tc.method + " " + tc.p
+		status, body := readResponse(t, ts.do(t, tc.method, tc.p, tc.key, nil, nil))
+		wantStatus(t, what, status, body, tc.status)
+		wantLatest(t, ts, what, tc.latest, tc.latest)
+	}
+}
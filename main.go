@@ -1,186 +1,567 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strconv"
 	"strings"
-	"encoding/json"
 	"time"
+
+	"github.com/thatgitsam/go-nuget-server/hooks"
+	"github.com/thatgitsam/go-nuget-server/versions"
 )
 
 // Global Variables
 var server *Server
 
-func init() {
-	// Load config and init server
-	server = InitServer("nuget-server-config-local.json")
+func main() {
+	// Serve unless another command is given
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	os.Exit(runCommand(cmd, args))
 }
 
-func main() {
+// serve handles the feed over HTTP until the listener fails
+func serve() {
+
+	// Reload config on SIGHUP or file change, and send telemetry if it's enabled
+	// now or by a later reload. Only the server being served does either, once.
+	go server.watchConfig(server.configWatch)
+	go runTelemetry()
 
 	// Handling Routing
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/", handleRequest)
 
-		// Local Varibles
-		var err error                                                          // Reusable error
-		apiKey := ""                                                           // APIKey (populated if found in headers)
-		accessLevel := accessDenied                                          // Access Level (defaults to denied)
-		altFilePath := path.Join(`/F`, server.URL.Path, `api`, `v2`, `browse`) // Alternative API called by client
+	// Set port number (Defaults to 80)
+	p := "" //DO not modify this value, if you need to use a different port, make sure it is set in the server.URL
+	// if port is set in URL string
+	if server.URL.Port() != "" {
+		p = ":" + server.URL.Port()
+	}
 
-		// Create new statusWriter
-		sw := statusWriter{ResponseWriter: w}
+	// Log and Start server, as a service if started by a service manager
+	log.Println("Starting Server on ", server.URL.String()+p)
+	runService(p)
+}
 
-		// Check if this is NOT part of the Api Routing
-		if !strings.HasPrefix(r.URL.Path, server.URL.Path) && !strings.HasPrefix(r.URL.Path, altFilePath) {
-			f := path.Base(r.URL.Path)
-			if f == "/" {
-				f = "index.html"
-			}
-			serveStaticFile(&sw, r, path.Join("_www", f))
+// handleRequest routes every request to the feed
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Local Varibles
+	var err error                                                          // Reusable error
+	accessLevel := accessDenied                                            // Access Level (defaults to denied)
+	altFilePath := path.Join(`/F`, server.URL.Path, `api`, `v2`, `browse`) // Alternative API called by client
+
+	// Create new statusWriter
+	sw := statusWriter{ResponseWriter: w}
+
+	// Time the request and the phases within it, if tracing
+	r, span := startRequestSpan(r)
+
+	// Clients often drop the trailing slash from the source URL, send them to the real root
+	if base := strings.TrimSuffix(server.URL.Path, `/`); base != "" && r.URL.Path == base {
+		redirectToRoot(&sw, r)
+		goto End
+	}
+
+	// robots.txt belongs at the site root, whatever the base path
+	if r.URL.Path == `/robots.txt` && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		serveRobots(&sw, r)
+		goto End
+	}
+
+	// Check if this is NOT part of the Api Routing
+	if !strings.HasPrefix(r.URL.Path, server.URL.Path) && !strings.HasPrefix(r.URL.Path, altFilePath) {
+		f, ok := wwwFile(r.URL.Path)
+		if !ok {
+			sw.WriteHeader(http.StatusNotFound)
 			goto End
 		}
-
-		// Open Access Routes (No ApiKey needed)
-		switch r.Method {
-		case http.MethodGet:
-			switch {
-			case r.URL.String() == server.URL.Path:
-				serveRoot(&sw, r)
+		// Locked down deployments require a read key for the web pages too
+		if server.Config().WWWRequireKey {
+			accessLevel, err = requestAccessLevel(r)
+			if err != nil {
+				sw.WriteHeader(http.StatusInternalServerError)
 				goto End
-			case r.URL.String() == server.URL.Path+`$metadata`:
-				serveMetaData(&sw, r)
+			}
+			if accessLevel == accessDenied {
+				sw.WriteHeader(http.StatusForbidden)
 				goto End
 			}
 		}
-		
-		// Process Headers looking for API key (can't access direct as case may not match)
-		for name, headers := range r.Header {
-			// Grab ApiKey as it passes
-			if strings.ToLower(name) == "x-nuget-apikey" {
-				apiKey = headers[0]
-			}
+		if f == homePage {
+			serveHome(&sw, r)
+		} else {
+			serveStaticFile(&sw, r, f)
 		}
-		accessLevel, err = server.fs.GetAccessLevel(apiKey)
-		if err != nil {
-			sw.WriteHeader(http.StatusInternalServerError)
+		goto End
+	}
+
+	// Keep crawlers out of the index and off the download routes, if configured
+	setRobotsTag(&sw, r)
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && robotsRouteClass(r.URL.Path) == routeDownload && !allowCrawler(&sw, r) {
+		goto End
+	}
+
+	// Open Access Routes (No ApiKey needed unless configured)
+	switch {
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.HasPrefix(r.URL.Path, server.URL.Path+`dl/`):
+		// Share links carry their own signed grant
+		serveShareDownload(&sw, r)
+		goto End
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && !server.Config().ServiceRootRequireKey:
+		switch {
+		case r.URL.Path == server.URL.Path:
+			serveRoot(&sw, r)
+			goto End
+		case r.URL.Path == server.URL.Path+`$metadata`:
+			serveMetaData(&sw, r)
+			goto End
+		case r.URL.Path == server.URL.Path+`api/openapi.json`:
+			serveOpenAPI(&sw, r)
 			goto End
 		}
-		// Bounce any unauthorised requests
-		if accessLevel == accessDenied {
-			sw.WriteHeader(http.StatusForbidden)
+	}
+
+	accessLevel, err = requestAccessLevel(r)
+	if err != nil {
+		sw.WriteHeader(http.StatusInternalServerError)
+		goto End
+	}
+	// Bounce any unauthorised requests
+	if accessLevel == accessDenied {
+		sw.WriteHeader(http.StatusForbidden)
+		goto End
+	}
+
+	// Read the store as the key sees it, so restricted packages stay hidden
+	r = withViewer(r)
+
+	// Restrict requests under snapshot/{id}/ to that snapshot's package set
+	if strings.HasPrefix(r.URL.Path, server.URL.Path+`snapshot/`) {
+		x := strings.SplitN(r.URL.Path[len(server.URL.Path+`snapshot/`):], `/`, 2)
+		s := server.snapshots.Get(x[0])
+		if s == nil {
+			sw.WriteHeader(http.StatusNotFound)
 			goto End
 		}
+		rest := ""
+		if len(x) == 2 {
+			rest = x[1]
+		}
+		r = withSnapshot(r, s, server.URL.Path+rest)
+		sw.ResponseWriter = newRebaseWriter(w, server.URL.String(), server.URL.String()+`snapshot/`+s.ID+`/`)
+	}
+
+	// Changes wait while an administrator has the feed read-only
+	if isReadOnly() && !readOnlyAllows(r) {
+		writeReadOnly(&sw)
+		goto End
+	}
+
+	// Retried admin changes with an Idempotency-Key are answered once. They all
+	// need a read-write key, so other callers are refused without the body being
+	// read or the key remembered.
+	if accessLevel == accessReadWrite && isIdempotentRoute(r) && r.Header.Get("Idempotency-Key") != "" && !server.idempotency.Begin(&sw, r) {
+		goto End
+	}
 
-		log.Println("Route check — r.URL.String():", r.URL.String())
-		log.Println("Route check — server.URL.Path:", server.URL.Path)
-
-
-		// Restricted Routes
-		switch r.Method {
-		case http.MethodGet:
-			log.Println("Routing Debug:")
-			log.Println("→ r.URL.Path =", r.URL.Path)
-			log.Println("→ server.URL.Path =", server.URL.Path)
-
-			// Perform Routing
-			switch {
-			case strings.HasPrefix(r.URL.String(), server.URL.Path+`Packages`):
-				servePackageFeed(&sw, r)
-			case strings.HasPrefix(r.URL.String(), server.URL.Path+`api/v2/Packages`):
-				log.Println("API V2 Packages Route")
-				servePackageFeed(&sw, r)
-			case strings.HasPrefix(r.URL.String(), server.URL.Path+`FindPackagesById`):
-				log.Println("FindPackagesById Route")
-				servePackageFeed(&sw, r)
-			case strings.HasPrefix(r.URL.String(), server.URL.Path+`nupkg`):
-				servePackageFile(&sw, r)
-			case strings.HasPrefix(r.URL.String(), server.URL.Path+`files`):
-				serveStaticFile(&sw, r, r.URL.String()[len(server.URL.Path+`files`):])
-			case strings.HasPrefix(r.URL.String(), altFilePath):
-				serveStaticFile(&sw, r, r.URL.String()[len(altFilePath):])
-			}
-		case http.MethodPut:
-			log.Println("PUT found!")
+	log.Println("Route check — r.URL.String():", r.URL.String())
+	log.Println("Route check — server.URL.Path:", server.URL.Path)
+
+	// Restricted Routes
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		log.Println("Routing Debug:")
+		log.Println("→ r.URL.Path =", r.URL.Path)
+		log.Println("→ server.URL.Path =", server.URL.Path)
+
+		// Perform Routing
+		switch {
+		case r.URL.Path == server.URL.Path:
+			serveRoot(&sw, r)
+		case r.URL.Path == server.URL.Path+`$metadata`:
+			serveMetaData(&sw, r)
+		case r.URL.Path == server.URL.Path+`api/openapi.json`:
+			serveOpenAPI(&sw, r)
+		case strings.HasPrefix(r.URL.String(), server.URL.Path+`Packages`):
+			servePackageFeed(&sw, r)
+		case strings.HasPrefix(r.URL.String(), server.URL.Path+`api/v2/Packages`):
+			log.Println("API V2 Packages Route")
+			servePackageFeed(&sw, r)
+		case strings.HasPrefix(r.URL.String(), server.URL.Path+`FindPackagesById`),
+			strings.HasPrefix(r.URL.String(), server.URL.Path+`api/v2/FindPackagesById`):
+			log.Println("FindPackagesById Route")
+			servePackageFeed(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`Search`),
+			strings.HasPrefix(r.URL.Path, server.URL.Path+`api/v2/Search`):
+			serveSearch(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`GetUpdates`),
+			strings.HasPrefix(r.URL.Path, server.URL.Path+`api/v2/GetUpdates`):
+			serveGetUpdates(&sw, r)
+		case strings.HasPrefix(r.URL.String(), server.URL.Path+`nupkg`):
+			servePackageFile(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`nuspec/`):
+			serveNuspecFile(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`snupkg/`):
+			serveSymbolPackage(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`symbols/`):
+			serveSymbolFile(&sw, r)
+		case strings.HasPrefix(r.URL.String(), server.URL.Path+`files`):
+			serveStaticFile(&sw, r, r.URL.String()[len(server.URL.Path+`files`):])
+		case strings.HasPrefix(r.URL.String(), altFilePath):
+			serveStaticFile(&sw, r, r.URL.String()[len(altFilePath):])
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`ui/`):
+			serveUI(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`license/`):
+			serveLicense(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`readme/`):
+			serveReadme(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`feed/`):
+			servePackageAtom(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`api/packages/`) && strings.HasSuffix(r.URL.Path, `/insights`):
+			servePackageInsights(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`api/packages/`) && strings.HasSuffix(r.URL.Path, `/changelog`):
+			serveChangelog(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`api/packages/`) && strings.HasSuffix(r.URL.Path, `/latest`):
+			serveFloatingVersion(&sw, r)
+		case r.URL.Path == server.URL.Path+`api/resolve`:
+			serveResolve(&sw, r)
+		case r.URL.Path == server.URL.Path+`api/changes`:
+			serveChanges(&sw, r)
+		case r.URL.Path == server.URL.Path+`v3/index.json`:
+			serveServiceIndex(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`v3/catalog/`):
+			serveCatalog(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`v3-flatcontainer/`):
+			serveFlatContainer(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`v3/registration/`):
+			serveRegistration(&sw, r)
+		case r.URL.Path == server.URL.Path+`autocomplete`:
+			serveAutocomplete(&sw, r)
+		case r.URL.Path == server.URL.Path+`api/facets`:
+			serveFacets(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/quarantine`):
 			if accessLevel != accessReadWrite {
 				sw.WriteHeader(http.StatusForbidden)
-				return
+				goto End
 			}
-
-			// Route
-			switch {
-			case r.URL.String() == server.URL.Path:
-				// Process Request
-				uploadPackage(&sw, r)
-			case strings.HasPrefix(r.URL.String(), server.URL.Path+`api/v2/package/`):
-				log.Println("API V2 Upload Package")
-				uploadPackage(&sw, r)
-			default:
-				sw.WriteHeader(http.StatusNotFound)
+			serveQuarantineList(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/extraction`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveExtractionList(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/id-policies`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveIDPolicies(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/config`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveConfig(&sw, r)
+		case r.URL.Path == server.URL.Path+`statusz`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveStatusz(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/telemetry/`):
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveTelemetry(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/operations`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveOperations(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/packages/`) && strings.HasSuffix(r.URL.Path, `/retire`):
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveRetirement(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/packages/`) && strings.HasSuffix(r.URL.Path, `/impact`):
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveImpact(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/packages/`):
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			servePackageReport(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/cache`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveCacheStats(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/read-only`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveReadOnly(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/v3-cache`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveV3CacheStats(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/allowed-ids`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveAllowedIDs(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/visibility`):
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
+				goto End
+			}
+			serveVisibility(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/migrate/status`:
+			if accessLevel != accessReadWrite {
+				sw.WriteHeader(http.StatusForbidden)
 				goto End
 			}
+			serveMigration(&sw, r)
+		default:
+			sw.WriteHeader(http.StatusNotFound)
+			goto End
+		}
+	case http.MethodPut:
+		log.Println("PUT found!")
+		// Everything here must be decided before the body is read, so a client that
+		// sent Expect: 100-continue gets the error without uploading the package
+		if accessLevel != accessReadWrite {
+			sw.WriteHeader(http.StatusForbidden)
+			goto End
+		}
+		if !limitUploadSize(&sw, r) {
+			goto End
+		}
+
+		// Route
+		switch {
+		case r.URL.Path == server.URL.Path+`admin/allowed-ids`:
+			serveAllowedIDs(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/packages/`) && strings.HasSuffix(r.URL.Path, `/retire`):
+			serveRetirement(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/packages/`):
+			servePin(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/visibility/`):
+			serveVisibility(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/read-only`:
+			serveReadOnly(&sw, r)
+		case r.URL.String() == server.URL.Path:
+			// Process Request
+			uploadPackage(&sw, r, pushPackage)
+		case strings.HasPrefix(r.URL.String(), server.URL.Path+`api/v2/package/`):
+			log.Println("API V2 Upload Package")
+			uploadPackage(&sw, r, pushPackage)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`api/v2/symbolpackage`):
+			log.Println("API V2 Upload Symbol Package")
+			uploadPackage(&sw, r, pushSymbolPackage)
+		default:
+			sw.WriteHeader(http.StatusNotFound)
+			goto End
+		}
+	case http.MethodPost:
+		// Nothing POSTed here is more than a small JSON document
+		r.Body = http.MaxBytesReader(&sw, r.Body, maxPostBodyBytes)
+
+		// Route
+		switch {
+		case r.URL.Path == server.URL.Path+`api/snapshots`:
+			createSnapshot(&sw, r)
+		case accessLevel != accessReadWrite:
+			sw.WriteHeader(http.StatusForbidden)
+			goto End
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/quarantine/`):
+			serveQuarantineAction(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/reload-config`:
+			serveReloadConfig(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/reextract`):
+			serveReextract(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/reindex`:
+			serveReindex(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/unlist/`),
+			strings.HasPrefix(r.URL.Path, server.URL.Path+`api/admin/unlist/`):
+			serveListingAction(&sw, r, "unlist", false)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/relist/`),
+			strings.HasPrefix(r.URL.Path, server.URL.Path+`api/admin/relist/`):
+			serveListingAction(&sw, r, "relist", true)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/migrate`):
+			serveMigration(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/share`:
+			serveShare(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/catalog/compact`:
+			serveCatalogCompact(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/telemetry/`):
+			serveTelemetry(&sw, r)
+		default:
+			sw.WriteHeader(http.StatusNotFound)
+			goto End
+		}
+	case http.MethodDelete:
+		// Route
+		switch {
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`api/snapshots/`):
+			deleteSnapshot(&sw, r)
+		case accessLevel != accessReadWrite:
+			sw.WriteHeader(http.StatusForbidden)
+			goto End
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`api/v2/package/`):
+			serveDeletePackage(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/allowed-ids`:
+			serveAllowedIDs(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/packages/`) && strings.HasSuffix(r.URL.Path, `/retire`):
+			serveRetirement(&sw, r)
+		case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/packages/`):
+			servePin(&sw, r)
+		case r.URL.Path == server.URL.Path+`admin/migrate`:
+			serveMigration(&sw, r)
 		default:
 			sw.WriteHeader(http.StatusNotFound)
 			goto End
 		}
+	default:
+		sw.WriteHeader(http.StatusNotFound)
+		goto End
+	}
+
+End:
+	// A handler that returned without writing anything is sent as 200 by net/http
+	if !sw.WroteHeader() {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	// Send any body held back for rewriting
+	if rw, ok := sw.ResponseWriter.(*rebaseWriter); ok {
+		rw.Flush()
+	}
+
+	// Remember the answer for retries with the same Idempotency-Key
+	if iw, ok := sw.ResponseWriter.(*idempotencyWriter); ok {
+		server.idempotency.Finish(iw, r, sw.Status())
+	}
 
-	End:
+	endRequestSpan(span, sw.Status())
+	countResponse(sw.Status())
 
+	// Requests the client gave up on are only interesting when debugging
+	if r.Context().Err() != nil {
+		logDebug("Request cancelled::", sw.Status(), r.Method, r.URL.String())
+	} else {
 		log.Println("Request::", sw.Status(), r.Method, r.URL.String())
+	}
 
-		if server.config.Loglevel > 0 {
-			log.Println("Request Headers:")
-			if len(w.Header()) == 0 {
-				log.Println("        None")
-			} else {
-				for name, headers := range r.Header {
-					for _, h := range headers {
-						// Log Key
-						log.Println("        " + name + "::" + h)
-					}
+	if server.Config().Loglevel > 0 {
+		log.Println("Request Headers:")
+		if len(w.Header()) == 0 {
+			log.Println("        None")
+		} else {
+			for name, headers := range r.Header {
+				for _, h := range headers {
+					// Log Key
+					log.Println("        " + name + "::" + h)
 				}
 			}
+		}
 
-			log.Println("Response Headers:")
-			if len(w.Header()) == 0 {
-				log.Println("        None")
-			} else {
-				for name, headers := range w.Header() {
-					for _, h := range headers {
-						// Log Key
-						log.Println("        " + name + "::" + h)
-					}
+		log.Println("Response Headers:")
+		if len(w.Header()) == 0 {
+			log.Println("        None")
+		} else {
+			for name, headers := range w.Header() {
+				for _, h := range headers {
+					// Log Key
+					log.Println("        " + name + "::" + h)
 				}
 			}
 		}
-	})
+	}
+}
 
-	// Set port number (Defaults to 80)
-	p := "" //DO not modify this value, if you need to use a different port, make sure it is set in the server.URL
-	// if port is set in URL string
-	if server.URL.Port() != "" {
-		p = ":" + server.URL.Port()
+// requestAccessLevel returns the access granted by the API key sent with a request
+func requestAccessLevel(r *http.Request) (access, error) {
+	ctx, span := startSpan(r.Context(), "auth")
+	defer span.End()
+	a, err := server.fs.GetAccessLevel(ctx, requestAPIKey(r))
+	span.SetError(err)
+	return a, err
+}
+
+// requestAPIKey returns the API key sent with a request, if any
+func requestAPIKey(r *http.Request) string {
+	apiKey := ""
+	// Process Headers looking for API key (can't access direct as case may not match)
+	for name, headers := range r.Header {
+		// Grab ApiKey as it passes
+		if strings.ToLower(name) == "x-nuget-apikey" {
+			apiKey = headers[0]
+		}
 	}
+	return apiKey
+}
 
-	// Log and Start server
-	log.Println("Starting Server on ", server.URL.String()+p)
-	log.Fatal(http.ListenAndServe(p, nil))
+// wwwFile maps a request outside of the API onto a file in _www. Only the
+// index page and the assets folder are served, anything else is not found.
+func wwwFile(p string) (string, bool) {
+	switch {
+	case p == "" || p == "/" || p == "/index.html":
+		return homePage, true
+	case strings.HasPrefix(p, "/assets/"):
+		p = path.Clean(p)
+		if !strings.HasPrefix(p, "/assets/") {
+			return "", false
+		}
+		return path.Join("_www", p), true
+	}
+	return "", false
 }
 
 func serveRoot(w http.ResponseWriter, r *http.Request) {
 
+	setDataServiceVersion(w, r)
+
 	// Create a new Service Struct
 	ns := NewNugetService(server.URL.String())
 	b := ns.ToBytes()
 
 	// Set Headers
+	if lc := server.fs.LastChanged(r.Context()); !lc.IsZero() {
+		w.Header().Set("Last-Modified", lc.UTC().Format(http.TimeFormat))
+	}
 	w.Header().Set("Content-Type", "application/xml;charset=utf-8")
 	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
 
@@ -188,8 +569,24 @@ func serveRoot(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// redirectToRoot sends a request for the base path without its trailing slash to the
+// service root. Other methods than GET and HEAD get a 308 so uploads keep their body.
+func redirectToRoot(w http.ResponseWriter, r *http.Request) {
+	u := server.URL.Path
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, u, code)
+}
+
 func serveMetaData(w http.ResponseWriter, r *http.Request) {
 
+	setDataServiceVersion(w, r)
+
 	// Set Headers
 	w.Header().Set("Content-Type", "application/xml;charset=utf-8")
 	w.Header().Set("Content-Length", strconv.Itoa(len(server.MetaDataResponse)))
@@ -201,21 +598,56 @@ func serveMetaData(w http.ResponseWriter, r *http.Request) {
 func serveStaticFile(w http.ResponseWriter, r *http.Request, fn string) {
 
 	// Get the file from the FileStore
-	b, c, err := server.fs.GetFile(fn)
+	b, c, err := server.fs.GetFile(r.Context(), fn)
 	if err == ErrFileNotFound {
+		// Say why if the package's content couldn't be extracted
+		if st := extractionFailure(r.Context(), fn); st != nil {
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("content extraction failed " + formatISO8601Time(st.Time) + ": " + st.Error))
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
 	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// Stores may only know a generic type
+	if c == "" || c == "application/octet-stream" {
+		c = contentTypeFor(fn, b)
+	}
+
+	// The ETag is of the uncompressed content so it's the same for every encoding
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept-Encoding")
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Prefer a precompressed copy, unless the file is itself compressed
+	if isCompressible(c) && acceptsGzip(r) {
+		if gz, err := server.fs.GetCompressedFile(r.Context(), fn); err == nil {
+			w.Header().Set("Content-Encoding", "gzip")
+			b = gz
+		}
+	}
+
 	// Set Headers
 	w.Header().Set("Content-Type", c)
 	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
 
-	// Output Xml
-	w.Write(b)
+	// Output the file, giving up if the client goes away
+	if err := writeBody(r.Context(), w, b); isCancelled(err) {
+		logDebug("Stopped sending", fn, "to cancelled request")
+	}
 }
 
 func servePackageFile(w http.ResponseWriter, r *http.Request) {
@@ -224,135 +656,423 @@ func servePackageFile(w http.ResponseWriter, r *http.Request) {
 	// get the last two parts of the URL
 	x := strings.Split(r.URL.String(), `/`)
 
-	// Get the file
-	b, t, err := server.fs.GetPackageFile(x[len(x)-2], x[len(x)-1])
-	if err == ErrFileNotFound {
+	// nupkg/{id}/latest is the version flagged IsLatestVersion, a pinned one if set
+	if strings.EqualFold(x[len(x)-1], "latest") {
+		ver, err := latestVersion(r.Context(), x[len(x)-2])
+		if err == ErrFileNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err == ErrBusy {
+			writeBusy(w)
+			return
+		} else if isCancelled(err) {
+			writeCancelled(w, r)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		x[len(x)-1] = ver
+	}
+
+	serveVersionFile(w, r, x[len(x)-2], x[len(x)-1])
+}
+
+// serveNuspecFile serves nuspec/{id}/{version}, the manifest alone
+func serveNuspecFile(w http.ResponseWriter, r *http.Request) {
+	x := strings.Split(r.URL.Path[len(server.URL.Path+`nuspec/`):], `/`)
+	if len(x) != 2 || x[0] == "" || x[1] == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	serveNuspec(w, r, x[0], x[1])
+}
+
+// serveVersionFile serves a version's nupkg and counts the download
+func serveVersionFile(w http.ResponseWriter, r *http.Request, id string, ver string) {
+
+	// Versions outside of a snapshot don't exist within it
+	snap := requestSnapshot(r)
+	if snap != nil && !snap.Contains(id, ver) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Open the file
+	f, err := server.fs.GetPackageFile(r.Context(), id, ver)
+	if err == ErrFileNotFound && snap != nil {
+		serveSnapshotGone(w, snap, id, ver)
+		return
+	} else if err == ErrFileNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
 	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 
 	}
+	defer f.Close()
 
 	// Set header to fix filename on client side
-	w.Header().Set("Cache-Control", "max-age=3600")
-	w.Header().Set("Content-Disposition", `filename=`+x[len(x)-2]+x[len(x)-1]+".nupkg")
-	w.Header().Set("Content-Type", t)
-	// Serve up the file
-	w.Write(b)
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "max-age=3600")
+	}
+	w.Header().Set("Content-Disposition", `filename=`+id+ver+".nupkg")
+	w.Header().Set("Content-Type", f.ContentType)
+	// Stream the file, ServeContent answering Range and If-Modified-Since requests
+	sw := &servedWriter{ResponseWriter: w}
+	http.ServeContent(sw, r, "", f.ModTime, f)
+	if isCancelled(r.Context().Err()) {
+		logDebug("Stopped sending", id, ver, "to cancelled request")
+	}
+
+	// Counted later, so the download never waits on it. Whether it counts is up to
+	// the pipeline, from what was served.
+	client := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = h
+	}
+	served := sw.first
+	if served.IsZero() {
+		served = time.Now()
+	}
+	server.downloads.Send(downloadEvent{
+		ID:        id,
+		Version:   ver,
+		Client:    requestAPIKey(r) + "@" + client,
+		UserAgent: r.UserAgent(),
+		Method:    r.Method,
+		Status:    sw.status,
+		Bytes:     sw.bytes,
+		Continued: sw.status == http.StatusPartialContent && rangeContinues(r),
+		Time:      served,
+	})
 }
 
 func servePackageFeed(w http.ResponseWriter, r *http.Request) {
-	var err error
 	var b []byte
 	var params = &packageParams{}
 	var isMore bool
 	var nf *NugetFeed
 
+	setDataServiceVersion(w, r)
+
+	expand, err := parseExpand(r)
+	if err != nil {
+		writeODataError(w, r, err.(*odataError))
+		return
+	}
+	inlineCount, err := requestInlineCount(r)
+	if err != nil {
+		writeODataError(w, r, err.(*odataError))
+		return
+	}
+
+	// Pages are read in the $orderby order, so a $skiptoken continues in it too
+	r = r.WithContext(withFeedOrder(r.Context(), parseFeedOrder(r.URL.Query().Get("$orderby"))))
+
+	// Let clients skip feeds that haven't changed since they last looked
+	lastChanged := server.fs.LastChanged(r.Context())
+	if notModified(w, r, lastChanged) {
+		return
+	}
+
 	// Handle /FindPackagesById()?id='foo'
-	if strings.HasPrefix(r.URL.Path, server.URL.Path+`FindPackagesById`) {
+	if strings.HasPrefix(r.URL.Path, server.URL.Path+`FindPackagesById`) ||
+		strings.HasPrefix(r.URL.Path, server.URL.Path+`api/v2/FindPackagesById`) {
 		id := strings.Trim(r.URL.Query().Get("id"), `'`)
 		log.Println("FindPackagesById ID Param:", id)
 		nf = NewNugetFeed("FindPackagesById", server.URL.String())
+		nf.SetUpdated(lastChanged)
 
 		// Update counts before fetching packages
 		server.fs.UpdateCountsInMemory()
 
-		log.Println("Calling GetPackageFeedEntries with ID:", id)
-		nf.Packages, isMore, err = server.fs.GetPackageFeedEntries(id, "", 100)
+		startAfter, err := requestStartAfter(r)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		if r.URL.Query().Get("$format") == "json" {
-			renderJSONFeed(w, nf.Packages)
+		skip, skipping, err := requestSkip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-
-		b = nf.ToBytes()
-	} else if strings.HasPrefix(r.URL.Path, server.URL.Path+`Packages`) ||
-		strings.HasPrefix(r.URL.Path, server.URL.Path+`api/v2/Packages`) {
-
-		if i := strings.Index(r.URL.Path, "("); i >= 0 {
-			if j := strings.Index(r.URL.Path[i:], ")"); j >= 0 {
-				params = newPackageParams(r.URL.Path[i+1 : i+j])
+		top, err := requestTop(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		size := feedPageSize(top)
+		keep := func(entries []*NugetPackageEntry) []*NugetPackageEntry {
+			if snap := requestSnapshot(r); snap != nil {
+				entries = snap.Filter(entries)
 			}
+			entries = filterSemVer2(r, entries)
+			if !requestPrerelease(r) {
+				entries = filterPrerelease(entries)
+			}
+			return entries
 		}
 
-		if params.ID != "" && params.Version != "" {
-			npe, err := server.fs.GetPackageEntry(params.ID, params.Version)
-			if err != nil {
+		// FindPackagesById()/$count is how many versions the feed would list
+		if isCountPath(r.URL.Path) {
+			n, err := countFeedEntries(r.Context(), id, keep)
+			serveFeedCount(w, r, n, err)
+			return
+		}
+
+		log.Println("Calling GetPackageFeedEntries with ID:", id)
+		// Continue after the last entry read, even if it is filtered out
+		var last *NugetPackageEntry
+		if skipping {
+			nf.Packages, isMore, err = skipFeedEntries(r.Context(), id, skip, size, keep)
+		} else if size > 0 {
+			nf.Packages, last, isMore, err = readFeedPage(r.Context(), id, startAfter, size, keep)
+		}
+		if err == ErrBusy {
+			writeBusy(w)
+			return
+		} else if isCancelled(err) {
+			writeCancelled(w, r)
+			return
+		} else if err == ErrStartAfterGone {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// A retired ID's last page can point on to its replacement
+		if !isMore && requestSnapshot(r) == nil {
+			repl, err := replacementEntry(r.Context(), id)
+			if err == ErrBusy {
+				writeBusy(w)
+				return
+			} else if isCancelled(err) {
+				writeCancelled(w, r)
+				return
+			} else if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-
-			if r.URL.Query().Get("$format") == "json" {
-				renderJSONFeed(w, []*NugetPackageEntry{npe})
-				return
+			if repl != nil {
+				nf.Packages = append(nf.Packages, filterSemVer2(r, []*NugetPackageEntry{repl})...)
 			}
+		}
 
-			b = npe.ToBytes()
-		} else {
-			// Package list feed
-			nf = NewNugetFeed("Packages", server.URL.String())
+		nf.Packages = withGalleryURLs(nf.Packages)
+		nf.Packages = deterministicEntries(r, nf.Packages)
+		nf.Packages = expandEntries(nf.Packages, expand)
+
+		// Clients such as Paket follow next links to get every version, paging as
+		// they started to
+		if isMore && skipping && (top < 0 || top > len(nf.Packages)) {
+			nf.Link = append(nf.Link, &NugetLink{
+				Rel:  "next",
+				Href: nextSkipLink(r, skip+len(nf.Packages), remainingTop(top, len(nf.Packages))),
+			})
+		} else if isMore && last != nil && (top < 0 || top > size) {
+			nf.Link = append(nf.Link, &NugetLink{
+				Rel:  "next",
+				Href: nextPageLink(r, last, remainingTop(top, size)),
+			})
+		}
 
-			s := strings.SplitAfterN(r.URL.Query().Get("$filter"), " ", 3)
-			id := ""
-			if len(s) == 3 && strings.TrimSpace(s[0]) == "tolower(Id)" && strings.TrimSpace(s[1]) == "eq" {
-				id = s[2]
-				id = strings.Trim(id, `'`)
+		if inlineCount {
+			n, err := countFeedEntries(r.Context(), id, keep)
+			if err == ErrBusy {
+				writeBusy(w)
+				return
+			} else if isCancelled(err) {
+				writeCancelled(w, r)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
+			nf.Count = &n
+		}
 
-			startAfter := strings.ReplaceAll(strings.ReplaceAll(r.URL.Query().Get("$skiptoken"), `'`, ``), `,`, `.`)
+		// Let caching proxies revalidate the result set
+		f := requestedFeedFormat(r)
+		etag := resultSetETag(nf.Packages, f)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 
-			// Update counts before fetching packages
-			server.fs.UpdateCountsInMemory()
+		if f != feedFormatAtom {
+			renderJSONFeed(w, f, nf.Packages, nextLink(nf), false)
+			return
+		}
+
+		traced(r.Context(), "serialize", func() { b = nf.ToBytes() })
+	} else if strings.HasPrefix(r.URL.Path, server.URL.Path+`Packages`) ||
+		strings.HasPrefix(r.URL.Path, server.URL.Path+`api/v2/Packages`) {
 
-			nf.Packages, isMore, err = server.fs.GetPackageFeedEntries(id, startAfter, 100)
+		if i := strings.Index(r.URL.Path, "("); i >= 0 {
+			var rest string
+			var err error
+			params, rest, err = parsePackageKey(r.URL.Path[i+1:])
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("malformed package key: " + err.Error()))
 				return
 			}
 
-			if r.URL.Query().Get("$top") != "" && isMore {
-				t, err := strconv.Atoi(r.URL.Query().Get("$top"))
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+			// Packages(Id='..',Version='..')/$value is the package itself
+			if rest == `/$value` {
+				if params.ID == "" || params.Version == "" {
+					w.WriteHeader(http.StatusNotFound)
 					return
 				}
+				serveVersionFile(w, r, params.ID, params.Version)
+				return
+			}
+			if rest == `/Screenshots` && params.ID != "" && params.Version != "" {
+				serveScreenshots(w, r, params.ID, params.Version)
+				return
+			}
+		}
+
+		if params.ID != "" && params.Version != "" {
+			// Versions are matched normalized, so 1.0 finds 1.0.0
+			npe, err := server.fs.GetPackageEntry(r.Context(), params.ID, params.Version)
+			if err == ErrFileNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err == ErrBusy {
+				writeBusy(w)
+				return
+			} else if isCancelled(err) {
+				writeCancelled(w, r)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if snap := requestSnapshot(r); snap != nil && !snap.Contains(npe.Properties.ID, npe.Properties.Version) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			npe = withGalleryURLs([]*NugetPackageEntry{npe})[0]
+			npe = deterministicEntries(r, []*NugetPackageEntry{npe})[0]
+			npe = expandEntries([]*NugetPackageEntry{npe}, expand)[0]
 
-				u, err := url.Parse(r.URL.String())
-				u.Host = server.URL.Hostname()
-				u.Scheme = server.URL.Scheme
+			if f := requestedFeedFormat(r); f != feedFormatAtom {
+				renderJSONFeed(w, f, []*NugetPackageEntry{npe}, "", true)
+				return
+			}
+
+			traced(r.Context(), "serialize", func() { b = npe.ToBytes() })
+		} else {
+			// Package list feed
+			nf = NewNugetFeed("Packages", server.URL.String())
+			nf.SetUpdated(lastChanged)
 
-				q := u.Query()
-				q.Del("$skip")
-				q.Set("$top", strconv.Itoa(t-100))
-				q.Set("$skiptoken", fmt.Sprintf(`'%s','%s'`,
-					nf.Packages[len(nf.Packages)-1].Properties.ID,
-					nf.Packages[len(nf.Packages)-1].Properties.Version))
-				u.RawQuery = q.Encode()
+			filter := parseFeedFilter(r.URL.Query().Get("$filter"))
 
-				cleanURL, err := url.PathUnescape(u.String())
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					return
+			startAfter, err := requestStartAfter(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			skip, skipping, err := requestSkip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			top, err := requestTop(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			size := feedPageSize(top)
+			keep := func(entries []*NugetPackageEntry) []*NugetPackageEntry {
+				if snap := requestSnapshot(r); snap != nil {
+					entries = snap.Filter(entries)
 				}
+				entries = filterSemVer2(r, entries)
+				entries = filterUnlisted(entries)
+				return filter.Apply(entries)
+			}
+
+			// Packages/$count is how many versions match, whatever the paging
+			if isCountPath(r.URL.Path) {
+				n, err := countFeedEntries(r.Context(), filter.ID, keep)
+				serveFeedCount(w, r, n, err)
+				return
+			}
+
+			// Update counts before fetching packages
+			server.fs.UpdateCountsInMemory()
+
+			// Continue after the last entry read, even if it is filtered out
+			var last *NugetPackageEntry
+			if skipping {
+				nf.Packages, isMore, err = skipFeedEntries(r.Context(), filter.ID, skip, size, keep)
+			} else if size > 0 {
+				nf.Packages, last, isMore, err = readFeedPage(r.Context(), filter.ID, startAfter, size, keep)
+			}
+			if err == ErrBusy {
+				writeBusy(w)
+				return
+			} else if isCancelled(err) {
+				writeCancelled(w, r)
+				return
+			} else if err == ErrStartAfterGone {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			nf.Packages = withGalleryURLs(nf.Packages)
+			nf.Packages = deterministicEntries(r, nf.Packages)
+			nf.Packages = expandEntries(nf.Packages, expand)
 
+			// The next link pages as the client started to
+			if skipping && isMore && (top < 0 || top > len(nf.Packages)) {
+				nf.Link = append(nf.Link, &NugetLink{
+					Rel:  "next",
+					Href: nextSkipLink(r, skip+len(nf.Packages), remainingTop(top, len(nf.Packages))),
+				})
+			} else if isMore && last != nil && (top < 0 || top > size) {
 				nf.Link = append(nf.Link, &NugetLink{
 					Rel:  "next",
-					Href: cleanURL,
+					Href: nextPageLink(r, last, remainingTop(top, size)),
 				})
 			}
 
-			if r.URL.Query().Get("$format") == "json" {
-				renderJSONFeed(w, nf.Packages)
+			if inlineCount {
+				n, err := countFeedEntries(r.Context(), filter.ID, keep)
+				if err == ErrBusy {
+					writeBusy(w)
+					return
+				} else if isCancelled(err) {
+					writeCancelled(w, r)
+					return
+				} else if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				nf.Count = &n
+			}
+
+			if f := requestedFeedFormat(r); f != feedFormatAtom {
+				renderJSONFeed(w, f, nf.Packages, nextLink(nf), false)
 				return
 			}
 
-			b = nf.ToBytes()
+			traced(r.Context(), "serialize", func() { b = nf.ToBytes() })
 		}
 	}
 
@@ -363,102 +1083,422 @@ func servePackageFeed(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/atom+xml;type=feed;charset=utf-8")
 	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
-	w.Write(b)
+	traced(r.Context(), "write", func() { w.Write(b) })
+}
+
+// notModified sets Last-Modified from the feed's last change and answers 304 if
+// the client's If-Modified-Since is no older. Returns true if the response is done.
+func notModified(w http.ResponseWriter, r *http.Request, lastChanged time.Time) bool {
+	if lastChanged.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", lastChanged.UTC().Format(http.TimeFormat))
+
+	// Entity tags take precedence where the route has them
+	if r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+
+	// HTTP dates only have second precision
+	t, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastChanged.Truncate(time.Second).After(t) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// requestStartAfter returns the entry a page continues after, from the $skiptoken
+func requestStartAfter(r *http.Request) (string, error) {
+	t := r.URL.Query().Get("$skiptoken")
+	if t == "" {
+		return "", nil
+	}
+	id, ver, err := parseSkipToken(server.skipTokenKey, t, server.Config().LegacySkipTokens)
+	if err != nil {
+		return "", err
+	}
+	return id + "." + ver, nil
+}
+
+// nextPageLink returns the request URL continuing after the last entry, with $top
+// set to top unless it is negative
+func nextPageLink(r *http.Request, last *NugetPackageEntry, top int) string {
+	u := *r.URL
+	u.Host = server.URL.Host
+	u.Scheme = server.URL.Scheme
+
+	q := u.Query()
+	q.Del("$skip")
+	if top >= 0 {
+		q.Set("$top", strconv.Itoa(top))
+	}
+	q.Set("$skiptoken", newSkipToken(server.skipTokenKey, last.Properties.ID, last.Properties.Version))
+	u.RawQuery = q.Encode()
+
+	// Clients expect the OData punctuation unescaped
+	if s, err := url.PathUnescape(u.String()); err == nil {
+		return s
+	}
+	return u.String()
+}
+
+// Entries in a feed page unless max-page-size says otherwise
+const defaultMaxPageSize = 100
+
+// maxPageSize returns the most entries a feed page holds, whatever $top asks for
+func maxPageSize() int {
+	if n := server.Config().MaxPageSize; n > 0 {
+		return n
+	}
+	return defaultMaxPageSize
+}
+
+// requestTop returns the $top of a request, or -1 if it has none
+func requestTop(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("$top")
+	if v == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("$top must be a number of at least 0")
+	}
+	return n, nil
 }
 
-func renderJSONFeed(w http.ResponseWriter, packages []*NugetPackageEntry) {
-	type Metadata struct {
-		ID          string `json:"id"`
-		URI         string `json:"uri"`
-		Type        string `json:"type"`
-		EditMedia   string `json:"edit_media"`
-		MediaSrc    string `json:"media_src"`
-		ContentType string `json:"content_type"`
-	}
-
-	type PackageJson struct {
-		Metadata        Metadata `json:"__metadata"`
-		ID              string   `json:"Id"`
-		Version         string   `json:"Version"`
-		Authors         string   `json:"Authors"`
-		Copyright       *string  `json:"Copyright"`
-		Description     string   `json:"Description"`
-		DownloadCount   string   `json:"DownloadCount"`
-		IconURL         *string  `json:"IconUrl"`
-		IsLatestVersion bool     `json:"IsLatestVersion"`
-		Published       string   `json:"Published"`
-		ProjectURL      string   `json:"ProjectUrl"`
-		ReleaseNotes    string   `json:"ReleaseNotes"`
-		Summary         string   `json:"Summary"`
-		Tags            *string  `json:"Tags"`
-		Title           string   `json:"Title"`
+// feedPageSize returns how many entries to read for a page: $top, up to the
+// maximum page size, which is also used without one
+func feedPageSize(top int) int {
+	if max := maxPageSize(); top < 0 || top > max {
+		return max
+	}
+	return top
+}
+
+// remainingTop returns what's left of $top after a page of n entries, -1 if the
+// request had no $top
+func remainingTop(top int, n int) int {
+	if top < 0 {
+		return -1
+	}
+	return top - n
+}
+
+// requestSkip returns the $skip a request pages by, and whether it pages by
+// offset at all rather than by $skiptoken, which takes precedence
+func requestSkip(r *http.Request) (int, bool, error) {
+	q := r.URL.Query()
+	if q.Get("$skiptoken") != "" || q.Get("$skip") == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(q.Get("$skip"))
+	if err != nil || n < 0 {
+		return 0, false, errors.New("$skip must be a number of at least 0")
+	}
+	return n, true, nil
+}
+
+// readFeedPage returns up to max of the entries for id that keep lets through,
+// after startAfter, with the last entry read and whether more follow. Versions
+// filtered out don't cut a page short, the store is read until the page is full.
+func readFeedPage(ctx context.Context, id string, startAfter string, max int, keep func([]*NugetPackageEntry) []*NugetPackageEntry) ([]*NugetPackageEntry, *NugetPackageEntry, bool, error) {
+	var list []*NugetPackageEntry
+	var last *NugetPackageEntry
+	for {
+		page, more, err := server.fs.GetPackageFeedEntries(ctx, id, startAfter, max-len(list))
+		if err != nil {
+			return nil, nil, false, err
+		}
+		list = append(list, keep(page)...)
+		if len(page) > 0 {
+			last = page[len(page)-1]
+			startAfter = last.Properties.ID + "." + last.Properties.Version
+		}
+		if !more || len(page) == 0 || len(list) == max {
+			return list, last, more, nil
+		}
+
+		// The store may not check between pages, so stop here for a cancelled request
+		if err := ctx.Err(); err != nil {
+			return nil, nil, false, err
+		}
+	}
+}
+
+// skipFeedEntries returns up to max of the entries for id that keep lets through,
+// after the first skip of them, and whether more follow. Offsets count what the
+// client is shown, so a client adding up what it was given never sees an entry
+// twice or misses one.
+func skipFeedEntries(ctx context.Context, id string, skip int, max int, keep func([]*NugetPackageEntry) []*NugetPackageEntry) ([]*NugetPackageEntry, bool, error) {
+	var list []*NugetPackageEntry
+	startAfter := ""
+	toSkip := skip
+	for {
+		// The store may not check between pages, so stop here for a cancelled request
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		page, more, err := server.fs.GetPackageFeedEntries(ctx, id, startAfter, 100)
+		if err == ErrStartAfterGone {
+			// The last version read was removed meanwhile, so skip from the top again
+			list, startAfter, skip = nil, "", toSkip
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		for _, e := range keep(page) {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(list) == max {
+				return list, true, nil
+			}
+			list = append(list, e)
+		}
+		if !more || len(page) == 0 {
+			return list, false, nil
+		}
+		last := page[len(page)-1]
+		startAfter = last.Properties.ID + "." + last.Properties.Version
+	}
+}
+
+// nextSkipLink returns the request URL continuing at an offset, with $top set to
+// top unless it is negative
+func nextSkipLink(r *http.Request, skip int, top int) string {
+	u := *r.URL
+	u.Host = server.URL.Host
+	u.Scheme = server.URL.Scheme
+
+	q := u.Query()
+	q.Set("$skip", strconv.Itoa(skip))
+	if top >= 0 {
+		q.Set("$top", strconv.Itoa(top))
+	}
+	u.RawQuery = q.Encode()
+
+	// Clients expect the OData punctuation unescaped
+	if s, err := url.PathUnescape(u.String()); err == nil {
+		return s
+	}
+	return u.String()
+}
+
+// resultSetETag returns an entity tag identifying a set of feed entries in a given format
+func resultSetETag(packages []*NugetPackageEntry, f feedFormat) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", f)
+	for _, p := range packages {
+		fmt.Fprintf(h, "%s\n%s\n%s\n%d\n%d\n%s\n%s\n", p.Properties.ID, p.Properties.Version, p.Properties.PackageHash,
+			p.Properties.DownloadCount.Value, p.Properties.VersionDownloadCount.Value,
+			p.Properties.DeprecationMessage, p.Properties.AlternatePackageID)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches the entity tag
+func etagMatches(header string, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Output formats a feed can be rendered in
+type feedFormat int
+
+const (
+	// feedFormatAtom is the default Atom XML feed
+	feedFormatAtom feedFormat = iota
+	// feedFormatJSONVerbose is OData v2 verbose JSON ({"d":{"results":[]}})
+	feedFormatJSONVerbose
+	// feedFormatJSONv4 is OData v4 minimal metadata JSON ({"@odata.context":..,"value":[]})
+	feedFormatJSONv4
+)
+
+// requestedFeedFormat negotiates the feed format from $format and the Accept header
+func requestedFeedFormat(r *http.Request) feedFormat {
+	f := strings.ToLower(r.URL.Query().Get("$format"))
+	switch {
+	// An unescaped ';' makes the query parser drop $format, so check the raw query too
+	case strings.Contains(f, "odata.metadata="),
+		strings.Contains(strings.ToLower(r.URL.RawQuery), "$format=application/json;odata.metadata="):
+		return feedFormatJSONv4
+	case f == "json" || strings.HasPrefix(f, "application/json"):
+		return feedFormatJSONVerbose
+	case f != "":
+		return feedFormatAtom
+	}
+
+	a := strings.ToLower(r.Header.Get("Accept"))
+	if strings.Contains(a, "application/json") && strings.Contains(a, "odata.metadata=") {
+		return feedFormatJSONv4
+	}
+	return feedFormatAtom
+}
+
+// nextLink returns the continuation link of a feed, if any
+func nextLink(nf *NugetFeed) string {
+	for _, l := range nf.Link {
+		if l.Rel == "next" {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// v2JSONMetadata is the __metadata of a package in OData v2 verbose JSON
+type v2JSONMetadata struct {
+	ID          string `json:"id"`
+	URI         string `json:"uri"`
+	Type        string `json:"type"`
+	EditMedia   string `json:"edit_media"`
+	MediaSrc    string `json:"media_src"`
+	ContentType string `json:"content_type"`
+}
+
+// v2JSONPackage is a package as serialised in OData v2 verbose JSON
+type v2JSONPackage struct {
+	Metadata        v2JSONMetadata  `json:"__metadata"`
+	ID              string          `json:"Id"`
+	Version         string          `json:"Version"`
+	Authors         string          `json:"Authors"`
+	Copyright       *string         `json:"Copyright"`
+	Dependencies    string          `json:"Dependencies"`
+	Description     string          `json:"Description"`
+	DownloadCount   string          `json:"DownloadCount"`
+	IconURL         *string         `json:"IconUrl"`
+	IsLatestVersion bool            `json:"IsLatestVersion"`
+	Published       string          `json:"Published"`
+	ProjectURL      string          `json:"ProjectUrl"`
+	ReleaseNotes    string          `json:"ReleaseNotes"`
+	Summary         string          `json:"Summary"`
+	Tags            *string         `json:"Tags"`
+	Title           string          `json:"Title"`
+	Frameworks      string          `json:"SupportedFrameworks"`
+	LicenseURL      *string         `json:"LicenseUrl"`
+	RequireLicense  bool            `json:"RequireLicenseAcceptance"`
+	MinClient       *string         `json:"MinClientVersion"`
+	DevDependency   bool            `json:"DevelopmentDependency"`
+	Deprecation     string          `json:"DeprecationMessage,omitempty"`
+	Alternate       string          `json:"AlternatePackageId,omitempty"`
+	Screenshots     json.RawMessage `json:"Screenshots,omitempty"`
+}
+
+// newV2JSONPackage maps a feed entry onto the OData v2 JSON shape
+func newV2JSONPackage(p *NugetPackageEntry) v2JSONPackage {
+	// Construct URLs
+	packageID := url.PathEscape(p.Properties.ID)
+	packageVersion := url.PathEscape(p.Properties.Version)
+	baseURL := strings.TrimSuffix(server.URL.String(), "/")
+
+	editUri := fmt.Sprintf("%s/api/v2/Packages(Id='%s',Version='%s')", baseURL, packageID, packageVersion)
+	nupkgUrl := fmt.Sprintf("%s/nupkg/%s/%s", baseURL, packageID, packageVersion)
+	mediaUrl := fmt.Sprintf("%s/api/v2/Packages(Id='%s',Version='%s')/$value", baseURL, packageID, packageVersion)
+
+	// Format published date as /Date(milliseconds)/
+	published := formatODataJSONTime(p.Properties.Published.Value)
+
+	// Optional fields
+	var copyright *string
+	if !p.Properties.Copyright.Null {
+		copyright = &p.Properties.Copyright.Value
+	}
+
+	var iconURL *string
+	if p.Properties.IconURL != "" {
+		iconURL = &p.Properties.IconURL
+	}
+
+	var tags *string
+	if p.Properties.Tags != "" {
+		tags = &p.Properties.Tags
+	}
+
+	var licenseURL *string
+	if !p.Properties.LicenseURL.Null && p.Properties.LicenseURL.Value != "" {
+		licenseURL = &p.Properties.LicenseURL.Value
+	}
+
+	var minClient *string
+	if !p.Properties.MinClientVersion.Null && p.Properties.MinClientVersion.Value != "" {
+		minClient = &p.Properties.MinClientVersion.Value
+	}
+
+	// Expanded Screenshots are always empty
+	var screenshots json.RawMessage
+	if screenshotsExpanded(p) {
+		screenshots = json.RawMessage(`{"results":[]}`)
+	}
+
+	return v2JSONPackage{
+		Metadata: v2JSONMetadata{
+			ID:          editUri,
+			URI:         editUri,
+			Type:        "MyGet.V2FeedPackage",
+			EditMedia:   mediaUrl,
+			MediaSrc:    nupkgUrl,
+			ContentType: "binary/octet-stream",
+		},
+		ID:              p.Properties.ID,
+		Version:         p.Properties.Version,
+		Authors:         p.Author.Name,
+		Copyright:       copyright,
+		Dependencies:    p.Properties.Dependencies,
+		Description:     p.Properties.Description,
+		DownloadCount:   strconv.Itoa(p.Properties.DownloadCount.Value),
+		IconURL:         iconURL,
+		IsLatestVersion: p.Properties.IsLatestVersion.Value,
+		Published:       published,
+		ProjectURL:      p.Properties.ProjectURL,
+		ReleaseNotes:    p.Properties.ReleaseNotes.Value,
+		Summary:         p.Summary.Text,
+		Tags:            tags,
+		Title:           p.Properties.Title,
+		Frameworks:      p.Properties.SupportedFrameworks,
+		LicenseURL:      licenseURL,
+		RequireLicense:  p.Properties.RequireLicenseAcceptance.Value,
+		MinClient:       minClient,
+		DevDependency:   p.Properties.DevelopmentDependency.Value,
+		Deprecation:     p.Properties.DeprecationMessage,
+		Alternate:       p.Properties.AlternatePackageID,
+		Screenshots:     screenshots,
+	}
+}
+
+func renderJSONFeed(w http.ResponseWriter, f feedFormat, packages []*NugetPackageEntry, next string, single bool) {
+	if f == feedFormatJSONv4 {
+		renderJSONv4Feed(w, packages, next, single)
+		return
+	}
+
+	// Large feeds are streamed a package at a time
+	if len(packages) > streamJSONEntries() {
+		streamJSONArray(w, "application/json", `{"d":{"results":[`, len(packages), func(i int) interface{} {
+			return newV2JSONPackage(packages[i])
+		}, `]}}`)
+		return
 	}
 
 	type ODataResponse struct {
 		D struct {
-			Results []PackageJson `json:"results"`
+			Results []v2JSONPackage `json:"results"`
 		} `json:"d"`
 	}
 
+	// An empty page is an empty list, not null
 	resp := ODataResponse{}
-
+	resp.D.Results = []v2JSONPackage{}
 	for _, p := range packages {
-		// Construct URLs
-		packageID := url.PathEscape(p.Properties.ID)
-		packageVersion := url.PathEscape(p.Properties.Version)
-		baseURL := strings.TrimSuffix(server.URL.String(), "/")
-
-		editUri := fmt.Sprintf("%s/api/v2/Packages(Id='%s',Version='%s')", baseURL, packageID, packageVersion)
-		nupkgUrl := fmt.Sprintf("%s/nupkg/%s/%s", baseURL, packageID, packageVersion)
-		mediaUrl := fmt.Sprintf("%s/api/v2/Packages(Id='%s',Version='%s')/$value", baseURL, packageID, packageVersion)
-
-		// Format published date as /Date(milliseconds)/
-		publishedMillis := parseDateToEpochMillis(p.Properties.Published.Value)
-		published := fmt.Sprintf("/Date(%d)/", publishedMillis)
-
-		// Optional fields
-		var copyright *string
-		if !p.Properties.Copyright.Null {
-			copyright = &p.Properties.Copyright.Value
-		}
-
-		var iconURL *string
-		if p.Properties.IconURL != "" {
-			iconURL = &p.Properties.IconURL
-		}
-
-		var tags *string
-		if p.Properties.Tags != "" {
-			tags = &p.Properties.Tags
-		}
-
-		resp.D.Results = append(resp.D.Results, PackageJson{
-			Metadata: Metadata{
-				ID:          editUri,
-				URI:         editUri,
-				Type:        "MyGet.V2FeedPackage",
-				EditMedia:   mediaUrl,
-				MediaSrc:    nupkgUrl,
-				ContentType: "binary/octet-stream",
-			},
-			ID:              p.Properties.ID,
-			Version:         p.Properties.Version,
-			Authors:         p.Author.Name,
-			Copyright:       copyright,
-			Description:     p.Properties.Description,
-			DownloadCount:   strconv.Itoa(p.Properties.DownloadCount.Value),
-			IconURL:         iconURL,
-			IsLatestVersion: p.Properties.IsLatestVersion.Value,
-			Published:       published,
-			ProjectURL:      p.Properties.ProjectURL,
-			ReleaseNotes:    p.Properties.ReleaseNotes.Value,
-			Summary:         p.Summary.Text,
-			Tags:            tags,
-			Title:           p.Properties.Title,
-		})
-	}
-
-	jsonData, err := json.Marshal(resp)
+		resp.D.Results = append(resp.D.Results, newV2JSONPackage(p))
+	}
+
+	jsonData, err := marshalJSON(resp)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -469,57 +1509,497 @@ func renderJSONFeed(w http.ResponseWriter, packages []*NugetPackageEntry) {
 	w.Write(jsonData)
 }
 
-func parseDateToEpochMillis(dateStr string) int64 {
-	t, err := time.Parse(time.RFC3339, dateStr)
+// v4Package is a V2FeedPackage entity as serialised in OData v4 JSON
+type v4Package struct {
+	ID                       string          `json:"Id"`
+	Version                  string          `json:"Version"`
+	NormalizedVersion        string          `json:"NormalizedVersion"`
+	Authors                  string          `json:"Authors"`
+	Copyright                *string         `json:"Copyright"`
+	Created                  string          `json:"Created"`
+	Dependencies             string          `json:"Dependencies"`
+	Description              string          `json:"Description"`
+	DownloadCount            int             `json:"DownloadCount"`
+	GalleryDetailsURL        string          `json:"GalleryDetailsUrl"`
+	IconURL                  *string         `json:"IconUrl"`
+	IsLatestVersion          bool            `json:"IsLatestVersion"`
+	IsAbsoluteLatestVersion  bool            `json:"IsAbsoluteLatestVersion"`
+	LastEdited               string          `json:"LastEdited"`
+	Published                string          `json:"Published"`
+	LicenseURL               *string         `json:"LicenseUrl"`
+	PackageHash              string          `json:"PackageHash"`
+	PackageHashAlgorithm     string          `json:"PackageHashAlgorithm"`
+	PackageSize              int             `json:"PackageSize"`
+	ProjectURL               string          `json:"ProjectUrl"`
+	ReleaseNotes             *string         `json:"ReleaseNotes"`
+	ReportAbuseURL           string          `json:"ReportAbuseUrl"`
+	RequireLicenseAcceptance bool            `json:"RequireLicenseAcceptance"`
+	Summary                  string          `json:"Summary"`
+	Tags                     string          `json:"Tags"`
+	Title                    string          `json:"Title"`
+	VersionDownloadCount     int             `json:"VersionDownloadCount"`
+	IsPrerelease             bool            `json:"IsPrerelease"`
+	Listed                   bool            `json:"Listed"`
+	MinClientVersion         *string         `json:"MinClientVersion"`
+	DevelopmentDependency    bool            `json:"DevelopmentDependency"`
+	Language                 string          `json:"Language"`
+	SupportedFrameworks      string          `json:"SupportedFrameworks"`
+	DeprecationMessage       string          `json:"DeprecationMessage,omitempty"`
+	AlternatePackageID       string          `json:"AlternatePackageId,omitempty"`
+	Screenshots              json.RawMessage `json:"Screenshots,omitempty"`
+}
+
+// newV4Package maps a feed entry onto the OData v4 entity shape
+func newV4Package(p *NugetPackageEntry) *v4Package {
+	// Nullable properties
+	nullable := func(v string, null bool) *string {
+		if null || v == "" {
+			return nil
+		}
+		return &v
+	}
+
+	v := &v4Package{
+		ID:                       p.Properties.ID,
+		Version:                  p.Properties.Version,
+		NormalizedVersion:        p.Properties.VersionNorm,
+		Authors:                  p.Author.Name,
+		Copyright:                nullable(p.Properties.Copyright.Value, p.Properties.Copyright.Null),
+		Created:                  formatISO8601Time(p.Properties.Created.Value),
+		Dependencies:             p.Properties.Dependencies,
+		Description:              p.Properties.Description,
+		DownloadCount:            p.Properties.DownloadCount.Value,
+		GalleryDetailsURL:        p.Properties.GalleryDetailsURL,
+		IconURL:                  nullable(p.Properties.IconURL, false),
+		IsLatestVersion:          p.Properties.IsLatestVersion.Value,
+		IsAbsoluteLatestVersion:  p.Properties.IsAbsoluteLatestVersion.Value,
+		LastEdited:               formatISO8601Time(p.Properties.LastEdited.Value),
+		Published:                formatISO8601Time(p.Properties.Published.Value),
+		LicenseURL:               nullable(p.Properties.LicenseURL.Value, p.Properties.LicenseURL.Null),
+		PackageHash:              p.Properties.PackageHash,
+		PackageHashAlgorithm:     p.Properties.PackageHashAlgorithm,
+		PackageSize:              p.Properties.PackageSize.Value,
+		ProjectURL:               p.Properties.ProjectURL,
+		ReleaseNotes:             nullable(p.Properties.ReleaseNotes.Value, p.Properties.ReleaseNotes.Null),
+		ReportAbuseURL:           p.Properties.ReportAbuseURL,
+		RequireLicenseAcceptance: p.Properties.RequireLicenseAcceptance.Value,
+		Summary:                  p.Summary.Text,
+		Tags:                     p.Properties.Tags,
+		Title:                    p.Properties.Title,
+		VersionDownloadCount:     p.Properties.VersionDownloadCount.Value,
+		IsPrerelease:             p.Properties.IsPrerelease.Value,
+		Listed:                   p.Properties.Listed.Value,
+		MinClientVersion:         nullable(p.Properties.MinClientVersion.Value, p.Properties.MinClientVersion.Null),
+		DevelopmentDependency:    p.Properties.DevelopmentDependency.Value,
+		Language:                 p.Properties.Language,
+		SupportedFrameworks:      p.Properties.SupportedFrameworks,
+		DeprecationMessage:       p.Properties.DeprecationMessage,
+		AlternatePackageID:       p.Properties.AlternatePackageID,
+	}
+	if screenshotsExpanded(p) {
+		v.Screenshots = json.RawMessage(`[]`)
+	}
+	return v
+}
+
+func renderJSONv4Feed(w http.ResponseWriter, packages []*NugetPackageEntry, next string, single bool) {
+	var v interface{}
+	context := server.URL.String() + `$metadata#Packages`
+
+	if single && len(packages) == 1 {
+		// Single entity, context annotation goes alongside the properties
+		v = struct {
+			Context string `json:"@odata.context"`
+			*v4Package
+		}{context + `/$entity`, newV4Package(packages[0])}
+	} else if len(packages) > streamJSONEntries() {
+		// Large feeds are streamed a package at a time
+		suffix := `]`
+		if next != "" {
+			suffix += `,"@odata.nextLink":` + jsonString(next)
+		}
+		streamJSONArray(w, "application/json;odata.metadata=minimal", `{"@odata.context":`+jsonString(context)+`,"value":[`, len(packages), func(i int) interface{} {
+			return newV4Package(packages[i])
+		}, suffix+`}`)
+		return
+	} else {
+		resp := struct {
+			Context  string       `json:"@odata.context"`
+			Value    []*v4Package `json:"value"`
+			NextLink string       `json:"@odata.nextLink,omitempty"`
+		}{Context: context, Value: []*v4Package{}, NextLink: next}
+		for _, p := range packages {
+			resp.Value = append(resp.Value, newV4Package(p))
+		}
+		v = resp
+	}
+
+	b, err := marshalJSON(v)
 	if err != nil {
-		return 0
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	return t.UnixNano() / int64(time.Millisecond)
+
+	w.Header().Set("Content-Type", "application/json;odata.metadata=minimal")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
 }
 
-func uploadPackage(w http.ResponseWriter, r *http.Request) {
+// uploadPackage reads each package in a push and hands it to push, which stores it
+// and writes the response
+func uploadPackage(w http.ResponseWriter, r *http.Request, push func(http.ResponseWriter, *http.Request, []byte) bool) {
 
 	log.Println("Putting Package into FileStore")
 
-	// Parse Mime type
+	// Parse Mime type, a missing or unknown one is taken to be the package itself
 	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+		// A boundary is at most 70 characters, anything longer is refused before parsing
+		boundary := params["boundary"]
+		if boundary == "" || len(boundary) > 70 {
+			writeUploadError(w, http.StatusBadRequest, "invalid multipart boundary")
+			return
+		}
 
-	// Detect and Decode based on mime type
-	if strings.HasPrefix(mediaType, "multipart/form-data") {
 		// Get a multipart.Reader
-		mr := multipart.NewReader(r.Body, params["boundary"])
+		mr := multipart.NewReader(r.Body, boundary)
+		max := maxUploadParts(server.Config())
+		pushed := false
 		// Itterate over parts/files uploaded
-		for {
+		for n := 0; ; n++ {
 			// Get he next part from the multipart.Reader, exit loop if no more
 			p, err := mr.NextPart()
 			if err == io.EOF {
 				break
+			} else if isBodyTooLarge(err) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
 			} else if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				writeUploadError(w, http.StatusBadRequest, "invalid multipart body: "+err.Error())
+				return
+			}
+			if n == max {
+				writeUploadError(w, http.StatusBadRequest, "too many parts, at most "+strconv.Itoa(max)+" are accepted")
 				return
 			}
 			// Store the package file in byte array for use
-			pkgFile, err := ioutil.ReadAll(p)
+			pkgFile, status, err := readUploadBody(p)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				writeUploadError(w, status, err.Error())
+				return
+			}
+			if !push(w, r, pkgFile) {
 				return
 			}
-			// Store the file
-			_, err = server.fs.StorePackage(pkgFile)
+			pushed = true
+		}
+		// A body of nothing but the closing boundary has no package to push
+		if !pushed {
+			writeUploadError(w, http.StatusBadRequest, "no package in multipart body")
+		}
+		return
+	}
+
+	// Otherwise the body is the package
+	pkgFile, status, err := readUploadBody(r.Body)
+	if err != nil {
+		writeUploadError(w, status, err.Error())
+		return
+	}
+	push(w, r, pkgFile)
+}
+
+// pushPackage checks and stores one pushed package, writing the response. It
+// returns false if the push failed and no further parts should be taken.
+func pushPackage(w http.ResponseWriter, r *http.Request, pkgFile []byte) bool {
+	// Check the package against the validation rules
+	var result *uploadResult
+	var info *hooks.PackageInfo
+	stored := false
+	chain := server.PushChain()
+	nsf, nsfErr := readNuspec(pkgFile)
+	if nsfErr == nil {
+		// The id and version name the package's files, so nothing else is done with them first
+		if err := checkPackageIdentity(nsf.Meta.ID, nsf.Meta.Version); err != nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return false
+		}
+		warnings, fatal := validatePackage(pkgFile, nsf, server.Config())
+		result = newUploadResult(pkgFile, nsf, warnings)
+		// The id-policy check, then any site specific rules
+		var err error
+		if info, err = newPushInfo(r, pkgFile); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		if err := chain.Validate(r.Context(), info); err != nil {
+			result.Error = err.Error()
+			writeUploadResult(w, pushRejectionStatus(err), result)
+			return false
+		}
+		if err := checkAllowedID(r.Context(), nsf.Meta.ID); err != nil {
+			if _, ok := err.(*notAllowedError); ok {
+				result.Error = err.Error()
+				writeUploadResult(w, http.StatusForbidden, result)
+			} else if isCancelled(err) {
+				writeCancelled(w, r)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return false
+		}
+		// A retired ID takes no more versions
+		if rt, err := server.retirement.retirementOf(r.Context(), nsf.Meta.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		} else if rt != nil {
+			result.Error = rt.pushError()
+			writeUploadResult(w, http.StatusGone, result)
+			return false
+		}
+		groups, status, err := checkPushVisibility(r, nsf.Meta.ID)
+		if err != nil && status == http.StatusInternalServerError {
+			w.WriteHeader(status)
+			return false
+		} else if err != nil {
+			result.Error = err.Error()
+			writeUploadResult(w, status, result)
+			return false
+		}
+		// Restricted before it's stored, so it's never briefly public, and put back as
+		// it was unless the push is stored
+		if groups != nil {
+			id := nsf.Meta.ID
+			prev, err := server.visibility.groupsFor(r.Context(), id)
+			if err == nil {
+				err = server.visibility.setVisibility(r.Context(), id, groups)
+			}
 			if err != nil {
-				if strings.Contains(err.Error(), "already exists") {
-					w.WriteHeader(http.StatusConflict)
-				} else {
-					w.WriteHeader(http.StatusInternalServerError)
+				w.WriteHeader(http.StatusInternalServerError)
+				return false
+			}
+			defer func() {
+				if stored {
+					return
 				}
-				return
+				if err := server.visibility.setVisibility(context.Background(), id, prev); err != nil {
+					log.Println("Error: Cannot restore the visibility of", id, err)
+				}
+			}()
+		}
+		// A push to a versioned URL must be that version, so a misrouted job can't replace another package
+		if id, ver, ok := pushTarget(r); ok {
+			if err := checkPushTarget(id, ver, nsf); err != nil {
+				result.Error = err.Error()
+				writeUploadResult(w, http.StatusBadRequest, result)
+				return false
 			}
+		}
+		if fatal {
+			result.Error = "package failed validation"
+			writeUploadResult(w, http.StatusBadRequest, result)
+			return false
+		}
+	}
+
+	// Nothing unreadable is stored under a versioned URL
+	if _, _, ok := pushTarget(r); ok && nsfErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	// Nor anywhere else if its id or version can't be found, however lenient the reading
+	if errors.Is(nsfErr, ErrNuspecMissingIdentity) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(nsfErr.Error()))
+		return false
+	}
+
+	hash, err := pushHash(r, pkgFile)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+
+	// Site specific changes are made once the package is known to be acceptable
+	if info != nil {
+		if err := chain.Mutate(r.Context(), info); err != nil {
+			result.Error = err.Error()
+			writeUploadResult(w, pushRejectionStatus(err), result)
+			return false
+		}
+		// The checks already made were for this ID and version
+		if !strings.EqualFold(info.Nuspec.Meta.ID, nsf.Meta.ID) || !versions.Equal(info.Nuspec.Meta.Version, nsf.Meta.Version) {
+			log.Println("Error: a push interceptor changed the ID or version of", nsf.Meta.ID, nsf.Meta.Version)
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		pkgFile, nsf, hash = info.Bytes(), info.Nuspec, info.Hash
+		result.Size, result.Hash = info.Size, info.Hash
+	}
 
-			w.WriteHeader(http.StatusCreated)
+	// Keep the package under its version limit, refusing the push or choosing what
+	// to evict once it's stored. Nothing is evicted for a push that then fails.
+	var evict []*NugetPackageEntry
+	if nsfErr == nil && !server.requiresModeration(nsf.Meta.ID) {
+		unlock := lockVersionLimit(nsf.Meta.ID)
+		defer unlock()
+		var vlErr *versionLimitError
+		var err error
+		if evict, err = planVersionEvictions(nsf.Meta.ID, nsf.Meta.Version); errors.As(err, &vlErr) {
+			result.Error = vlErr.Error()
+			writeUploadResult(w, http.StatusConflict, result)
+			return false
+		} else if err != nil {
+			log.Println("Error: Version limit:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
 		}
 	}
+
+	// Hold the package for approval if moderation applies to it
+	status := http.StatusCreated
+	if nsfErr == nil && server.requiresModeration(nsf.Meta.ID) {
+		_, err = server.fs.QuarantinePackage(r.Context(), pkgFile)
+		status = http.StatusAccepted
+	} else {
+		// Store the file
+		_, err = server.fs.StorePackage(r.Context(), pkgFile)
+	}
+	var limitErr *extractionLimitError
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") && nsfErr == nil && identicalVersion(r.Context(), nsf.Meta.ID, nsf.Meta.Version, hash) {
+			// A retry of a push that was stored succeeds, only different bytes conflict
+			log.Println("Push of", nsf.Meta.ID, nsf.Meta.Version, "is identical to the stored package, treated as success")
+			if result == nil {
+				w.WriteHeader(http.StatusOK)
+				return true
+			}
+			writeUploadResult(w, http.StatusOK, result)
+		} else if strings.Contains(err.Error(), "already exists") {
+			w.WriteHeader(http.StatusConflict)
+		} else if errors.Is(err, ErrInvalidPackageIdentity) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+		} else if errors.As(err, &limitErr) && result != nil {
+			result.Error = limitErr.Error()
+			writeUploadResult(w, http.StatusBadRequest, result)
+		} else if errors.As(err, &limitErr) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(limitErr.Error()))
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	stored = true
+	if info != nil {
+		chain.AfterStore(r.Context(), info)
+	}
+	if nsfErr == nil && status == http.StatusCreated {
+		if err := evictVersions(evict, nsf.Meta.Version); err != nil {
+			log.Println("Error: Version limit:", err)
+		}
+		noteVersionCount(nsf.Meta.ID)
+	}
+	if result == nil {
+		w.WriteHeader(status)
+		return true
+	}
+	writeUploadResult(w, status, result)
+	return true
+}
+
+// Parts of a multipart push taken before the request is refused, unless configured
+const defaultMaxUploadParts = 5
+
+// Largest body taken by a POST, which are all admin actions with small JSON bodies
+const maxPostBodyBytes = 64 << 10
+
+// Every nupkg starts with a zip local file header
+var zipMagic = []byte("PK\x03\x04")
+
+// limitUploadSize rejects a push whose Content-Length is over max-upload-bytes with
+// a 413, and otherwise caps the body so chunked uploads can't exceed it either
+func limitUploadSize(w http.ResponseWriter, r *http.Request) bool {
+	max := server.Config().MaxUploadBytes
+	if max <= 0 {
+		return true
+	}
+	if r.ContentLength > max {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	return true
+}
+
+// isBodyTooLarge reports whether a read failed because the body hit the upload limit
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// readUploadBody reads a pushed package, refusing anything that doesn't start like
+// a zip file before buffering it. It returns the status to answer an error with.
+func readUploadBody(r io.Reader) ([]byte, int, error) {
+	magic := make([]byte, len(zipMagic))
+	_, err := io.ReadFull(r, magic)
+	if isBodyTooLarge(err) {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("package is too large")
+	} else if (err == nil || err == io.EOF || err == io.ErrUnexpectedEOF) && !bytes.Equal(magic, zipMagic) {
+		return nil, http.StatusBadRequest, errors.New("body is not a nupkg (zip) file")
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Each part is held to the upload limit by itself, not only the whole body
+	max := server.Config().MaxUploadBytes
+	if max > 0 {
+		r = io.LimitReader(r, max-int64(len(magic))+1)
+	}
+	b, err := ioutil.ReadAll(io.MultiReader(bytes.NewReader(magic), r))
+	if isBodyTooLarge(err) || (max > 0 && int64(len(b)) > max) {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("package is too large")
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, http.StatusBadRequest, errors.New("body ended part way through the package")
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return b, 0, nil
+}
+
+// maxUploadParts returns how many parts of a multipart push are taken
+func maxUploadParts(c *Config) int {
+	if c.MaxUploadParts > 0 {
+		return c.MaxUploadParts
+	}
+	return defaultMaxUploadParts
+}
+
+// writeUploadError explains why a push was refused
+func writeUploadError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(msg))
+}
+
+func writeUploadResult(w http.ResponseWriter, status int, result *uploadResult) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(status)
+	w.Write(b)
 }
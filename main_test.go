@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONFeedShapes(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxPageSize = 1 })
+	ts.mustPush(t, testPackage(t, "Shape.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Shape.Pkg", "2.0.0", "", nil))
+	v4 := http.Header{"Accept": {"application/json;odata.metadata=minimal"}}
+
+	t.Run("v2 list", func(t *testing.T) {
+		status, body := ts.get(t, "FindPackagesById()?id='Shape.Pkg'&$format=json")
+		wantStatus(t, "list", status, body, http.StatusOK)
+		var feed struct {
+			D struct {
+				Results []map[string]interface{} `json:"results"`
+			} `json:"d"`
+		}
+		if err := json.Unmarshal([]byte(body), &feed); err != nil {
+			t.Fatal(err)
+		}
+		if len(feed.D.Results) != 1 || feed.D.Results[0]["Id"] != "Shape.Pkg" {
+			t.Fatalf("got %s", body)
+		}
+		if _, ok := feed.D.Results[0]["__metadata"]; !ok {
+			t.Errorf("v2 entry has no __metadata: %s", body)
+		}
+	})
+
+	t.Run("v2 single", func(t *testing.T) {
+		status, body := ts.get(t, "Packages(Id='Shape.Pkg',Version='1.0.0')?$format=json")
+		wantStatus(t, "single", status, body, http.StatusOK)
+		var feed struct {
+			D struct {
+				Results []map[string]interface{} `json:"results"`
+			} `json:"d"`
+		}
+		if err := json.Unmarshal([]byte(body), &feed); err != nil || len(feed.D.Results) != 1 || feed.D.Results[0]["Version"] != "1.0.0" {
+			t.Fatalf("got %s (%v)", body, err)
+		}
+	})
+
+	t.Run("v4 list", func(t *testing.T) {
+		status, body := readResponse(t, ts.do(t, http.MethodGet, "FindPackagesById()?id='Shape.Pkg'", testReadKey, nil, v4))
+		wantStatus(t, "list", status, body, http.StatusOK)
+		var feed struct {
+			Context  string                   `json:"@odata.context"`
+			Value    []map[string]interface{} `json:"value"`
+			NextLink string                   `json:"@odata.nextLink"`
+		}
+		if err := json.Unmarshal([]byte(body), &feed); err != nil {
+			t.Fatal(err)
+		}
+		if feed.Context != ts.Feed+"$metadata#Packages" {
+			t.Errorf("@odata.context = %q", feed.Context)
+		}
+		if len(feed.Value) != 1 || feed.Value[0]["Id"] != "Shape.Pkg" || feed.Value[0]["NormalizedVersion"] == nil {
+			t.Errorf("value = %v", feed.Value)
+		}
+		if feed.NextLink == "" {
+			t.Errorf("no @odata.nextLink with more versions than a page: %s", body)
+		}
+	})
+
+	t.Run("v4 single", func(t *testing.T) {
+		status, body := ts.get(t, "Packages(Id='Shape.Pkg',Version='2.0.0')?$format=application/json;odata.metadata=minimal")
+		wantStatus(t, "single", status, body, http.StatusOK)
+		var entity map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity["@odata.context"] != ts.Feed+"$metadata#Packages/$entity" || entity["Version"] != "2.0.0" {
+			t.Errorf("got %s", body)
+		}
+		if _, ok := entity["value"]; ok {
+			t.Errorf("single entity is wrapped in value: %s", body)
+		}
+	})
+}
+
+// The feed's last change is its <updated>, its Last-Modified and on the homepage,
+// and If-Modified-Since gets a 304 until a push
+func TestFeedLastModified(t *testing.T) {
+	ts := newTestServer(t, nil)
+	home := func() string {
+		t.Helper()
+		res, err := ts.Client().Get(ts.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, body := readResponse(t, res)
+		wantStatus(t, "homepage", status, body, http.StatusOK)
+		return body
+	}
+	ts.mustPush(t, testPackage(t, "Fresh.Pkg", "1.0.0", "", nil))
+	res := ts.do(t, http.MethodGet, "Packages()", testReadKey, nil, nil)
+	status, body := readResponse(t, res)
+	wantStatus(t, "feed", status, body, http.StatusOK)
+	updated := between(body, "<updated>", "</updated>")
+	pushed, err := time.Parse(zuluTimeLayout, updated)
+	if err != nil {
+		t.Fatalf("feed updated %q: %v", updated, err)
+	}
+	if time.Since(pushed) > time.Minute {
+		t.Errorf("feed updated %s, want the time of the push", updated)
+	}
+	lastModified := res.Header.Get("Last-Modified")
+	if lastModified != pushed.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified %q, want %q", lastModified, pushed.Format(http.TimeFormat))
+	}
+	if body := home(); !strings.Contains(body, "Feed last updated "+updated) {
+		t.Errorf("homepage: got %q, want updated %s", body, updated)
+	}
+
+	// A store's own homepage gets the time in place of the placeholder
+	writeStoreFile(t, ts, "_www/index.html", []byte("<p>Updated {{feed-updated}}</p>"))
+	if body := home(); body != "<p>Updated "+updated+"</p>" {
+		t.Errorf("homepage: got %q, want updated %s", body, updated)
+	}
+
+	since := http.Header{"If-Modified-Since": {lastModified}}
+	for _, p := range []string{"Packages()", "FindPackagesById()?id='Fresh.Pkg'"} {
+		status, body := readResponse(t, ts.do(t, http.MethodGet, p, testReadKey, nil, since))
+		wantStatus(t, p+" not modified", status, body, http.StatusNotModified)
+	}
+
+	// HTTP dates are to the second, so push in the next one, allowing for file
+	// times lagging the clock
+	time.Sleep(time.Until(pushed.Add(time.Second + 50*time.Millisecond)))
+	ts.mustPush(t, testPackage(t, "Fresh.Pkg", "2.0.0", "", nil))
+	for _, p := range []string{"Packages()", "FindPackagesById()?id='Fresh.Pkg'"} {
+		res := ts.do(t, http.MethodGet, p, testReadKey, nil, since)
+		status, body := readResponse(t, res)
+		wantStatus(t, p+" after a push", status, body, http.StatusOK)
+		if got := between(body, "<updated>", "</updated>"); got <= updated {
+			t.Errorf("%s: updated %s, want after %s", p, got, updated)
+		}
+		if got := res.Header.Get("Last-Modified"); got == lastModified {
+			t.Errorf("%s: Last-Modified still %s", p, got)
+		}
+	}
+}
+
+func TestWWWFile(t *testing.T) {
+	for p, want := range map[string]string{
+		"":                        "_www/index.html",
+		"/":                       "_www/index.html",
+		"/index.html":             "_www/index.html",
+		"/assets/app.css":         "_www/assets/app.css",
+		"/assets/img/logo.png":    "_www/assets/img/logo.png",
+		"/assets/../secret.json":  "",
+		"/secret.json":            "",
+		"/whatever/secret.json":   "",
+		"/whatever/index.html":    "",
+		"/assetsx/app.css":        "",
+		"/assets/../../etc/hosts": "",
+	} {
+		got, ok := wwwFile(p)
+		if ok != (want != "") || got != want {
+			t.Errorf("wwwFile(%q) = %q, %v, want %q", p, got, ok, want)
+		}
+	}
+}
+
+func TestWWWRoutes(t *testing.T) {
+	for _, locked := range []bool{false, true} {
+		ts := newTestServer(t, func(c *Config) { c.WWWRequireKey = locked })
+		writeStoreFile(t, ts, "_www/index.html", []byte("home"))
+		writeStoreFile(t, ts, "_www/secret.json", []byte("secret"))
+		writeStoreFile(t, ts, "_www/assets/app.css", []byte("css"))
+
+		get := func(p string, key string) (int, string) {
+			t.Helper()
+			r, err := http.NewRequest(http.MethodGet, ts.URL+p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != "" {
+				r.Header.Set("X-NuGet-ApiKey", key)
+			}
+			res, err := ts.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return readResponse(t, res)
+		}
+
+		// Only the index and assets are served, nothing is found by its base name
+		for p, want := range map[string]string{"/": "home", "/index.html": "home", "/assets/app.css": "css"} {
+			status, body := get(p, testReadKey)
+			wantStatus(t, p, status, body, http.StatusOK)
+			if body != want {
+				t.Errorf("%s: got %q, want %q", p, body, want)
+			}
+		}
+		for _, p := range []string{"/secret.json", "/whatever/secret.json", "/feedx/secret.json", "/assets/%2e%2e/secret.json"} {
+			status, body := get(p, testReadKey)
+			wantStatus(t, p, status, body, http.StatusNotFound)
+		}
+
+		// Locked down, the pages need a read key as the feed does
+		want := http.StatusOK
+		if locked {
+			want = http.StatusForbidden
+		}
+		for _, p := range []string{"/", "/assets/app.css"} {
+			status, body := get(p, "")
+			wantStatus(t, fmt.Sprintf("%s without a key, locked %v", p, locked), status, body, want)
+			status, body = get(p, "wrong")
+			wantStatus(t, fmt.Sprintf("%s with a wrong key, locked %v", p, locked), status, body, want)
+		}
+	}
+}
+
+func TestRootWithoutSlash(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Root.Pkg", "1.0.0", "", nil))
+	client := *ts.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	send := func(method string, p string) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(method, ts.URL+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-NuGet-ApiKey", testReadKey)
+		res, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// The base path without its slash is redirected to the service root
+	for method, code := range map[string]int{http.MethodGet: http.StatusMovedPermanently, http.MethodHead: http.StatusMovedPermanently, http.MethodPut: http.StatusPermanentRedirect} {
+		res := send(method, "/feed?x=1")
+		status, body := readResponse(t, res)
+		wantStatus(t, method+" /feed", status, body, code)
+		if got := res.Header.Get("Location"); got != "/feed/?x=1" {
+			t.Errorf("%s /feed: Location %q, want /feed/?x=1", method, got)
+		}
+	}
+
+	// Each route answers GET and HEAD under the sub-path
+	for _, p := range []string{"/feed/", "/feed/$metadata", "/feed/Packages", "/feed/Packages()", "/feed/api/v2/Packages()"} {
+		status, body := readResponse(t, send(http.MethodGet, p))
+		wantStatus(t, "GET "+p, status, body, http.StatusOK)
+		status, body = readResponse(t, send(http.MethodHead, p))
+		wantStatus(t, "HEAD "+p, status, body, http.StatusOK)
+	}
+
+	// Followed, the redirect ends at the service document
+	res, err := ts.Client().Get(ts.URL + "/feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := readResponse(t, res)
+	wantStatus(t, "followed", status, body, http.StatusOK)
+	if !strings.Contains(body, "<service") {
+		t.Errorf("followed: %.200s is not the service document", body)
+	}
+}
+
+// Every route logs the status the client got, whether the handler set it, only
+// wrote a body, or was stopped before reaching a handler
+func TestLoggedStatus(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Log.Pkg", "1.0.0", "", nil))
+
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	for _, tc := range []struct {
+		method string
+		p      string
+		key    string
+		want   int
+	}{
+		{http.MethodGet, "/feed", testReadKey, http.StatusMovedPermanently},
+		{http.MethodGet, "/robots.txt", "", http.StatusOK},
+		{http.MethodGet, "/no-such-page", "", http.StatusNotFound},
+		{http.MethodGet, "/feed/", testReadKey, http.StatusOK},
+		{http.MethodGet, "/feed/$metadata", "", http.StatusOK},
+		{http.MethodGet, "/feed/Packages()", "", http.StatusForbidden},
+		{http.MethodGet, "/feed/Packages()", testReadKey, http.StatusOK},
+		{http.MethodHead, "/feed/Packages()", testReadKey, http.StatusOK},
+		{http.MethodGet, "/feed/Packages()/$count", testReadKey, http.StatusOK},
+		{http.MethodGet, "/feed/Packages()?$skiptoken=nonsense", testReadKey, http.StatusBadRequest},
+		{http.MethodGet, "/feed/Packages(Id='Log.Pkg',Version='9.0.0')", testReadKey, http.StatusNotFound},
+		{http.MethodGet, "/feed/nupkg/Log.Pkg/1.0.0", testReadKey, http.StatusOK},
+		{http.MethodGet, "/feed/nupkg/Log.Pkg/9.0.0", testReadKey, http.StatusNotFound},
+		{http.MethodGet, "/feed/v3/index.json", testReadKey, http.StatusOK},
+		{http.MethodGet, "/feed/v3-flatcontainer/log.pkg/index.json", testReadKey, http.StatusOK},
+		{http.MethodGet, "/feed/autocomplete?q=log", testReadKey, http.StatusOK},
+		{http.MethodGet, "/feed/no/such/route", testReadKey, http.StatusNotFound},
+		{http.MethodPost, "/feed/admin/reindex", testReadKey, http.StatusForbidden},
+		{http.MethodPost, "/feed/admin/unlist/Log.Pkg/1.0.0", testWriteKey, http.StatusNoContent},
+		{http.MethodDelete, "/feed/api/v2/package/Log.Pkg/1.0.0", testWriteKey, http.StatusNoContent},
+		{http.MethodDelete, "/feed/api/v2/package/Log.Pkg/1.0.0", testWriteKey, http.StatusNotFound},
+	} {
+		logged.Reset()
+		r := httptest.NewRequest(tc.method, tc.p, nil)
+		if tc.key != "" {
+			r.Header.Set("X-NuGet-ApiKey", tc.key)
+		}
+		w := httptest.NewRecorder()
+		handleRequest(w, r)
+		name := tc.method + " " + tc.p
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d %.100s, want %d", name, w.Code, w.Body.String(), tc.want)
+		}
+		want := fmt.Sprintf("Request:: %d %s ", w.Code, tc.method)
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("%s: answered %d, logged %q", name, w.Code, logged.String())
+		}
+	}
+}
+
+// feedPages follows a feed's next links from a path, returning the entries of
+// every page and the links followed
+func feedPages(t *testing.T, ts *testServer, p string) ([][]string, []string) {
+	t.Helper()
+	var pages [][]string
+	var links []string
+	for p != "" {
+		status, body := ts.get(t, strings.ReplaceAll(p, " ", "%20"))
+		wantStatus(t, p, status, body, http.StatusOK)
+		pages = append(pages, feedIDs(t, body))
+		next := nextHref(t, body)
+		if next != "" {
+			links = append(links, next)
+		}
+		if len(pages) > 10 {
+			t.Fatalf("%s: still paging after %d pages: %q", p, len(pages), links)
+		}
+		p = strings.TrimPrefix(next, ts.Feed)
+	}
+	return pages, links
+}
+
+// A client paging by $skip gets $skip links that pick up where it left off, counted
+// in the entries it was shown
+func TestSkipPaging(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxPageSize = 2 })
+	for _, v := range []string{"1.0.0", "2.0.0", "3.0.0", "4.0.0", "5.0.0"} {
+		ts.mustPush(t, testPackage(t, "Skip.Pkg", v, "", nil))
+	}
+	// Offsets count listed versions only in Packages()
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Skip.Pkg/4.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	for _, tc := range []struct {
+		p     string
+		pages string // Versions of each page, pages split by |
+		links []string
+	}{
+		{"Packages()?$skip=0", "5.0.0 3.0.0|2.0.0 1.0.0", []string{"Packages()?$skip=2"}},
+		{"Packages()?$skip=1", "3.0.0 2.0.0|1.0.0", []string{"Packages()?$skip=3"}},
+		{"Packages()?$skip=3", "1.0.0", nil},
+		{"Packages()?$skip=4", "", nil},
+		{"Packages()?$skip=100", "", nil},
+		// $top is what's left to give, so the link asks only for the rest
+		{"Packages()?$skip=0&$top=3", "5.0.0 3.0.0|2.0.0", []string{"Packages()?$skip=2&$top=1"}},
+		{"Packages()?$skip=1&$top=2", "3.0.0 2.0.0", nil},
+		{"Packages()?$skip=1&$top=1", "3.0.0", nil},
+		{"Packages()?$skip=2&$top=0", "", nil},
+		{"Packages()?$skip=0&$orderby=Version", "1.0.0 2.0.0|3.0.0 5.0.0", []string{"Packages()?$orderby=Version&$skip=2"}},
+		// FindPackagesById lists unlisted versions as well
+		{"FindPackagesById()?id='Skip.Pkg'&$skip=0", "5.0.0 4.0.0|3.0.0 2.0.0|1.0.0", []string{"FindPackagesById()?$skip=2&id='Skip.Pkg'", "FindPackagesById()?$skip=4&id='Skip.Pkg'"}},
+		{"FindPackagesById()?id='Skip.Pkg'&$skip=3&$top=5", "2.0.0 1.0.0", nil},
+		{"FindPackagesById()?id='Other.Pkg'&$skip=0", "", nil},
+	} {
+		pages, links := feedPages(t, ts, tc.p)
+		var got []string
+		for _, page := range pages {
+			got = append(got, strings.Join(page, " "))
+		}
+		if g := strings.ReplaceAll(strings.Join(got, "|"), "Skip.Pkg ", ""); g != tc.pages {
+			t.Errorf("%s: got pages %q, want %q", tc.p, g, tc.pages)
+		}
+		var want []string
+		for _, l := range tc.links {
+			want = append(want, ts.Feed+l)
+		}
+		if fmt.Sprint(links) != fmt.Sprint(want) {
+			t.Errorf("%s: got links %q, want %q", tc.p, links, want)
+		}
+	}
+
+	for _, p := range []string{"Packages()?$skip=-1", "Packages()?$skip=one", "FindPackagesById()?id='Skip.Pkg'&$skip=1.5"} {
+		status, body := ts.get(t, p)
+		wantStatus(t, p, status, body, http.StatusBadRequest)
+	}
+
+	// A $skiptoken takes precedence, and its links page by token
+	_, links := feedPages(t, ts, "Packages()")
+	if len(links) == 0 || !strings.Contains(links[0], "$skiptoken=") {
+		t.Fatalf("Packages(): links %q", links)
+	}
+	token := links[0][strings.Index(links[0], "$skiptoken="):]
+	pages, links := feedPages(t, ts, "Packages()?$skip=3&"+token)
+	if fmt.Sprint(pages) != "[[Skip.Pkg 2.0.0 Skip.Pkg 1.0.0]]" || len(links) != 0 {
+		t.Errorf("$skip with a $skiptoken: got %q, links %q", pages, links)
+	}
+}
+
+// A page holds $top entries up to max-page-size, and the next link asks only for
+// the rest of $top
+func TestTopPaging(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxPageSize = 2 })
+	for _, v := range []string{"1.0.0", "2.0.0", "3.0.0", "4.0.0", "5.0.0", "6.0.0"} {
+		ts.mustPush(t, testPackage(t, "Top.Pkg", v, "", nil))
+	}
+	// Read first and filtered out of Packages(), it mustn't cut the page short
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Top.Pkg/6.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	for _, tc := range []struct {
+		p     string
+		pages string   // Versions of each page, pages split by |
+		tops  []string // $top of each next link
+	}{
+		{"Packages()?$top=1", "5.0.0", nil},
+		{"Packages()?$top=2", "5.0.0 4.0.0", nil},
+		{"Packages()?$top=3", "5.0.0 4.0.0|3.0.0", []string{"1"}},
+		{"Packages()?$top=100", "5.0.0 4.0.0|3.0.0 2.0.0|1.0.0", []string{"98", "96"}},
+		// Without $top max-page-size still cuts the page, and the links have none
+		{"Packages()", "5.0.0 4.0.0|3.0.0 2.0.0|1.0.0", []string{"", ""}},
+		{"Packages()?$top=0", "", nil},
+		{"FindPackagesById()?id='Top.Pkg'&$top=1", "6.0.0", nil},
+		{"FindPackagesById()?id='Top.Pkg'&$top=4", "6.0.0 5.0.0|4.0.0 3.0.0", []string{"2"}},
+		{"FindPackagesById()?id='Top.Pkg'&$top=0", "", nil},
+	} {
+		pages, links := feedPages(t, ts, tc.p)
+		var got []string
+		for _, page := range pages {
+			got = append(got, strings.Join(page, " "))
+		}
+		if g := strings.ReplaceAll(strings.Join(got, "|"), "Top.Pkg ", ""); g != tc.pages {
+			t.Errorf("%s: got pages %q, want %q", tc.p, g, tc.pages)
+		}
+		var tops []string
+		for _, l := range links {
+			u, err := url.Parse(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Query().Get("$skiptoken") == "" {
+				t.Errorf("%s: link %s has no $skiptoken", tc.p, l)
+			}
+			tops = append(tops, u.Query().Get("$top"))
+		}
+		if fmt.Sprint(tops) != fmt.Sprint(tc.tops) {
+			t.Errorf("%s: next links ask for $top %q, want %q", tc.p, tops, tc.tops)
+		}
+	}
+
+	// $top=0 is an empty feed in every format
+	for _, tc := range []struct {
+		header http.Header
+		p      string
+		empty  string
+	}{
+		{nil, "Packages()?$top=0", "</feed>"},
+		{nil, "Packages()?$top=0&$format=json", `"results":[]`},
+		{http.Header{"Accept": {"application/json;odata.metadata=minimal"}}, "Packages()?$top=0", `"value":[]`},
+	} {
+		status, body := readResponse(t, ts.do(t, http.MethodGet, tc.p, testReadKey, nil, tc.header))
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		if !strings.Contains(body, tc.empty) || strings.Contains(body, "Top.Pkg") {
+			t.Errorf("%s: got %s", tc.p, body)
+		}
+	}
+
+	for _, p := range []string{"Packages()?$top=-1", "Packages()?$top=ten", "FindPackagesById()?id='Top.Pkg'&$top=1.5"} {
+		status, body := ts.get(t, p)
+		wantStatus(t, p, status, body, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// markdownRenderer turns the common subset of CommonMark (plus GitHub tables) used
+// in package readmes into HTML. Nothing from the source is passed through raw: text
+// is always escaped, raw HTML shows as text, links are limited to safe schemes and
+// images only resolve through Image, which may refuse them.
+type markdownRenderer struct {
+	// Image returns the URL to use for an image reference, or false to show its alt text
+	Image func(src string) (string, bool)
+	// Link may rewrite the destination of a link that has passed the safe scheme check
+	Link func(dest string) string
+}
+
+var (
+	mdHeading     = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRule        = regexp.MustCompile(`^ {0,3}((\*[ \t]*){3,}|(-[ \t]*){3,}|(_[ \t]*){3,})$`)
+	mdFence       = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})[ \t]*([^`]*)$")
+	mdListItem    = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])([ \t]+|$)`)
+	mdSetext1     = regexp.MustCompile(`^ {0,3}=+[ \t]*$`)
+	mdSetext2     = regexp.MustCompile(`^ {0,3}-+[ \t]*$`)
+	mdTableDelim  = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	mdFenceLang   = regexp.MustCompile(`[^A-Za-z0-9_+#.-]`)
+	mdAutolink    = regexp.MustCompile(`^<((?:https?|mailto):[^<>\s]+)>`)
+	mdLinkDest    = regexp.MustCompile(`^\(\s*(<[^<>\n]*>|[^\s()]*(?:\([^\s()]*\)[^\s()]*)*)(?:\s+("[^"]*"|'[^']*'))?\s*\)`)
+	mdPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+)
+
+// Render converts markdown source to HTML
+func (mr *markdownRenderer) Render(src string) string {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	src = strings.Replace(src, "\r", "\n", -1)
+	src = strings.Replace(src, "\t", "    ", -1)
+	var b strings.Builder
+	mr.renderBlocks(&b, strings.Split(src, "\n"), false)
+	return b.String()
+}
+
+// renderBlocks renders block structure. Tight list items leave their paragraphs unwrapped.
+func (mr *markdownRenderer) renderBlocks(b *strings.Builder, lines []string, tight bool) {
+	var para []string
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		text := mr.inline(strings.Join(para, "\n"))
+		if tight {
+			b.WriteString(text + "\n")
+		} else {
+			b.WriteString("<p>" + text + "</p>\n")
+		}
+		para = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			flush()
+
+		case len(para) > 0 && mdSetext1.MatchString(line):
+			b.WriteString("<h1>" + mr.inline(strings.Join(para, "\n")) + "</h1>\n")
+			para = nil
+
+		case len(para) > 0 && mdSetext2.MatchString(line):
+			b.WriteString("<h2>" + mr.inline(strings.Join(para, "\n")) + "</h2>\n")
+			para = nil
+
+		case mdRule.MatchString(line):
+			flush()
+			b.WriteString("<hr>\n")
+
+		case mdHeading.MatchString(line):
+			flush()
+			m := mdHeading.FindStringSubmatch(line)
+			n := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + n + ">" + mr.inline(m[2]) + "</h" + n + ">\n")
+
+		case mdFence.MatchString(line):
+			flush()
+			m := mdFence.FindStringSubmatch(line)
+			fence := m[1]
+			var code []string
+			for i++; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				if strings.HasPrefix(t, fence[:3]) && strings.Trim(t, fence[:1]) == "" && len(t) >= len(fence) {
+					break
+				}
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code")
+			if info := strings.Fields(m[2]); len(info) > 0 {
+				if lang := mdFenceLang.ReplaceAllString(info[0], ""); lang != "" {
+					b.WriteString(` class="language-` + lang + `"`)
+				}
+			}
+			b.WriteString(">" + html.EscapeString(strings.Join(code, "\n")))
+			if len(code) > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case len(para) == 0 && strings.HasPrefix(line, "    "):
+			var code []string
+			for ; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) != "" && !strings.HasPrefix(lines[i], "    ") {
+					break
+				}
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			i--
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				if !strings.HasPrefix(t, ">") {
+					break
+				}
+				t = strings.TrimPrefix(t, ">")
+				quote = append(quote, strings.TrimPrefix(t, " "))
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			mr.renderBlocks(b, quote, false)
+			b.WriteString("</blockquote>\n")
+
+		case mdListItem.MatchString(line) && (len(para) == 0 || strings.TrimSpace(line[len(mdListItem.FindString(line)):]) != ""):
+			flush()
+			i = mr.renderList(b, lines, i) - 1
+
+		case len(para) == 0 && i+1 < len(lines) && strings.Contains(line, "|") && mdTableDelim.MatchString(lines[i+1]) &&
+			len(splitTableRow(line)) == len(splitTableRow(lines[i+1])):
+			i = mr.renderTable(b, lines, i) - 1
+
+		default:
+			para = append(para, strings.TrimLeft(line, " "))
+		}
+	}
+	flush()
+}
+
+// renderList renders the list starting at lines[start], returning the index after it
+func (mr *markdownRenderer) renderList(b *strings.Builder, lines []string, start int) int {
+	first := mdListItem.FindStringSubmatch(lines[start])
+	ordered := first[2][0] >= '0' && first[2][0] <= '9'
+	marker := first[2][len(first[2])-1:]
+
+	if ordered {
+		if n := strings.TrimLeft(first[2][:len(first[2])-1], "0"); n != "" && n != "1" {
+			b.WriteString(`<ol start="` + n + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+
+	// sameList reports whether a line starts another item of this list
+	sameList := func(l string) bool {
+		m := mdListItem.FindStringSubmatch(l)
+		return m != nil && m[2][len(m[2])-1:] == marker && (m[2][0] >= '0' && m[2][0] <= '9') == ordered
+	}
+
+	var items [][]string
+	loose := false
+	i := start
+	for i < len(lines) && sameList(lines[i]) {
+		m := mdListItem.FindStringSubmatch(lines[i])
+		indent := len(m[0])
+		if m[3] == "" {
+			indent = len(m[1]) + len(m[2]) + 1
+		}
+		item := []string{lines[i][len(m[0]):]}
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			if strings.TrimSpace(l) == "" {
+				// A blank line continues the item only if indented content follows
+				j := i + 1
+				for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+					j++
+				}
+				if j < len(lines) && leadingSpaces(lines[j]) >= indent {
+					loose = true
+					item = append(item, "")
+					continue
+				}
+				if j < len(lines) && sameList(lines[j]) && leadingSpaces(lines[j]) < indent {
+					loose = true
+				}
+				i = j
+				break
+			}
+			if leadingSpaces(l) >= indent {
+				item = append(item, l[indent:])
+				continue
+			}
+			if mdListItem.MatchString(l) || mdRule.MatchString(l) || mdHeading.MatchString(l) || mdFence.MatchString(l) ||
+				strings.HasPrefix(strings.TrimSpace(l), ">") {
+				break
+			}
+			// Lazy continuation of the item's paragraph
+			item = append(item, strings.TrimSpace(l))
+		}
+		items = append(items, item)
+		if i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			break
+		}
+	}
+
+	for _, item := range items {
+		b.WriteString("<li>")
+		mr.renderBlocks(b, item, !loose)
+		b.WriteString("</li>\n")
+	}
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// renderTable renders a GitHub style table starting at lines[start], returning the index after it
+func (mr *markdownRenderer) renderTable(b *strings.Builder, lines []string, start int) int {
+	header := splitTableRow(lines[start])
+	var align []string
+	for _, d := range splitTableRow(lines[start+1]) {
+		switch {
+		case strings.HasPrefix(d, ":") && strings.HasSuffix(d, ":"):
+			align = append(align, ` style="text-align:center"`)
+		case strings.HasSuffix(d, ":"):
+			align = append(align, ` style="text-align:right"`)
+		case strings.HasPrefix(d, ":"):
+			align = append(align, ` style="text-align:left"`)
+		default:
+			align = append(align, "")
+		}
+	}
+
+	b.WriteString("<table>\n<thead>\n<tr>")
+	for i, h := range header {
+		b.WriteString("<th" + align[i] + ">" + mr.inline(h) + "</th>")
+	}
+	b.WriteString("</tr>\n</thead>\n<tbody>\n")
+	i := start + 2
+	for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && strings.Contains(lines[i], "|"); i++ {
+		cells := splitTableRow(lines[i])
+		b.WriteString("<tr>")
+		for j := range header {
+			c := ""
+			if j < len(cells) {
+				c = cells[j]
+			}
+			b.WriteString("<td" + align[j] + ">" + mr.inline(c) + "</td>")
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// splitTableRow splits a table row into trimmed cells, honouring \| escapes
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	var cells []string
+	var cur strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cur.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		default:
+			cur.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cur.String()))
+}
+
+// leadingSpaces counts the spaces a line starts with
+func leadingSpaces(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " "))
+}
+
+// inline renders code spans, links, images, emphasis and line breaks, escaping everything else
+func (mr *markdownRenderer) inline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(mdPunctuation, s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+			continue
+
+		case c == '`':
+			n := 1
+			for i+n < len(s) && s[i+n] == '`' {
+				n++
+			}
+			ticks := s[i : i+n]
+			if end := strings.Index(s[i+n:], ticks); end >= 0 {
+				code := strings.Replace(s[i+n:i+n+end], "\n", " ", -1)
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += n + end + n
+				continue
+			}
+			b.WriteString(ticks)
+			i += n
+			continue
+
+		case c == '<':
+			if m := mdAutolink.FindStringSubmatch(s[i:]); m != nil {
+				if u, ok := safeLinkURL(m[1]); ok {
+					b.WriteString(`<a href="` + html.EscapeString(u) + `" rel="nofollow">` + html.EscapeString(m[1]) + "</a>")
+					i += len(m[0])
+					continue
+				}
+			}
+
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if text, dest, title, n, ok := parseMarkdownLink(s[i+1:]); ok {
+				if u, ok := mr.image(dest); ok {
+					b.WriteString(`<img src="` + html.EscapeString(u) + `" alt="` + html.EscapeString(text) + `"`)
+					if title != "" {
+						b.WriteString(` title="` + html.EscapeString(title) + `"`)
+					}
+					b.WriteString(">")
+				} else {
+					b.WriteString(html.EscapeString(text))
+				}
+				i += 1 + n
+				continue
+			}
+
+		case c == '[':
+			if text, dest, title, n, ok := parseMarkdownLink(s[i:]); ok {
+				if u, ok := safeLinkURL(dest); ok {
+					if mr.Link != nil {
+						u = mr.Link(u)
+					}
+					b.WriteString(`<a href="` + html.EscapeString(u) + `"`)
+					if title != "" {
+						b.WriteString(` title="` + html.EscapeString(title) + `"`)
+					}
+					b.WriteString(` rel="nofollow">` + mr.inline(text) + "</a>")
+				} else {
+					b.WriteString(mr.inline(text))
+				}
+				i += n
+				continue
+			}
+
+		case c == '*' || c == '_':
+			if out, n, ok := mr.emphasis(s, i); ok {
+				b.WriteString(out)
+				i += n
+				continue
+			}
+
+		case c == '\n':
+			// Two trailing spaces make a hard break
+			out := b.String()
+			if strings.HasSuffix(out, "  ") {
+				trimmed := strings.TrimRight(out, " ")
+				b.Reset()
+				b.WriteString(trimmed + "<br>\n")
+			} else {
+				b.WriteByte('\n')
+			}
+			i++
+			continue
+		}
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// emphasis renders *em*, _em_, **strong** or __strong__ starting at s[i], if it closes
+func (mr *markdownRenderer) emphasis(s string, i int) (string, int, bool) {
+	c := s[i : i+1]
+	delim := c
+	if strings.HasPrefix(s[i:], c+c) {
+		delim = c + c
+	}
+	start := i + len(delim)
+	// An opening delimiter must be followed by non-space, and _ must not be inside a word
+	if start >= len(s) || s[start] == ' ' || s[start] == '\n' || (c == "_" && i > 0 && isWordByte(s[i-1])) {
+		return "", 0, false
+	}
+	for j := start + 1; j+len(delim) <= len(s); j++ {
+		if s[j] == '\\' {
+			j++
+			continue
+		}
+		if s[j] == '`' {
+			// Skip over code spans so their contents are left alone
+			if end := strings.IndexByte(s[j+1:], '`'); end >= 0 {
+				j += end + 1
+			}
+			continue
+		}
+		if !strings.HasPrefix(s[j:], delim) || s[j-1] == ' ' || s[j-1] == '\n' {
+			continue
+		}
+		if len(delim) == 1 && j+1 < len(s) && s[j+1] == s[j] {
+			// Part of a strong delimiter, skip it
+			j++
+			continue
+		}
+		if c == "_" && j+len(delim) < len(s) && isWordByte(s[j+len(delim)]) {
+			continue
+		}
+		inner := mr.inline(s[start:j])
+		if len(delim) == 2 {
+			return "<strong>" + inner + "</strong>", j + 2 - i, true
+		}
+		return "<em>" + inner + "</em>", j + 1 - i, true
+	}
+	return "", 0, false
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// parseMarkdownLink parses [text](dest "title") at the start of s, returning its length
+func parseMarkdownLink(s string) (text string, dest string, title string, n int, ok bool) {
+	depth := 0
+	end := -1
+	for i := 0; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return "", "", "", 0, false
+	}
+	m := mdLinkDest.FindStringSubmatch(s[end+1:])
+	if m == nil {
+		return "", "", "", 0, false
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(m[1], "<"), ">")
+	if len(m[2]) >= 2 {
+		title = m[2][1 : len(m[2])-1]
+	}
+	return s[1:end], dest, title, end + 1 + len(m[0]), true
+}
+
+// safeLinkURL allows relative links and http, https and mailto ones only
+func safeLinkURL(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+	default:
+		return "", false
+	}
+	// Browsers ignore some characters in schemes, so be strict about anything before a colon
+	if u.Scheme == "" && strings.Contains(strings.SplitN(raw, "/", 2)[0], ":") {
+		return "", false
+	}
+	return u.String(), true
+}
+
+// image resolves an image reference through Image, refusing everything if unset
+func (mr *markdownRenderer) image(src string) (string, bool) {
+	if mr.Image == nil {
+		return "", false
+	}
+	return mr.Image(strings.TrimSpace(src))
+}
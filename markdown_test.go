@@ -0,0 +1,164 @@
+package main
+
+import (
+	"html"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownRender(t *testing.T) {
+	mr := &markdownRenderer{}
+	for src, want := range map[string]string{
+		"# Title":                      "<h1>Title</h1>\n",
+		"Title\n===":                   "<h1>Title</h1>\n",
+		"### Sub ###":                  "<h3>Sub</h3>\n",
+		"Some *em*, **strong**, `a<b`": "<p>Some <em>em</em>, <strong>strong</strong>, <code>a&lt;b</code></p>\n",
+		"- one\n- two":                 "<ul>\n<li>one\n</li>\n<li>two\n</li>\n</ul>\n",
+		"1. a\n2. b":                   "<ol>\n<li>a\n</li>\n<li>b\n</li>\n</ol>\n",
+		"> quoted":                     "<blockquote>\n<p>quoted</p>\n</blockquote>\n",
+		"---":                          "<hr>\n",
+		"```go\nx := 1 < 2\n```":       "<pre><code class=\"language-go\">x := 1 &lt; 2\n</code></pre>\n",
+		"| a | b |\n|---|:-:|\n| 1 | 2 |": "<table>\n<thead>\n<tr><th>a</th><th style=\"text-align:center\">b</th></tr>\n</thead>\n<tbody>\n" +
+			"<tr><td>1</td><td style=\"text-align:center\">2</td></tr>\n</tbody>\n</table>\n",
+		"[site](https://example.com/?a=1&b=2)": "<p><a href=\"https://example.com/?a=1&amp;b=2\" rel=\"nofollow\">site</a></p>\n",
+		"<https://example.com/>":               "<p><a href=\"https://example.com/\" rel=\"nofollow\">https://example.com/</a></p>\n",
+		"<b>raw</b>":                           "<p>&lt;b&gt;raw&lt;/b&gt;</p>\n",
+		"![alt](pic.png)":                      "<p>alt</p>\n",
+	} {
+		if got := mr.Render(src); got != want {
+			t.Errorf("%q:\ngot  %q\nwant %q", src, got, want)
+		}
+	}
+}
+
+var (
+	mdTag     = regexp.MustCompile(`<(/?)([a-zA-Z0-9]+)((?:\s+[^>]*)?)>`)
+	mdAttr    = regexp.MustCompile(`([a-zA-Z-]+)="([^"]*)"`)
+	mdTagSafe = map[string]bool{
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "p": true, "em": true, "strong": true,
+		"code": true, "pre": true, "ul": true, "ol": true, "li": true, "blockquote": true, "hr": true, "br": true,
+		"table": true, "thead": true, "tbody": true, "tr": true, "th": true, "td": true, "a": true, "img": true, "del": true,
+	}
+	mdAttrSafe = map[string]bool{"href": true, "src": true, "alt": true, "title": true, "rel": true, "class": true, "style": true, "start": true}
+)
+
+// checkSanitized fails the test if rendered HTML has any tag, attribute or URL the
+// renderer should never produce, and returns the img sources it has
+func checkSanitized(t *testing.T, out string) []string {
+	t.Helper()
+	var images []string
+	for _, m := range mdTag.FindAllStringSubmatch(out, -1) {
+		if !mdTagSafe[strings.ToLower(m[2])] {
+			t.Errorf("unsafe tag %s", m[0])
+		}
+		rest := mdAttr.ReplaceAllString(m[3], "")
+		if strings.TrimSpace(rest) != "" {
+			t.Errorf("unquoted attribute in %s", m[0])
+		}
+		for _, a := range mdAttr.FindAllStringSubmatch(m[3], -1) {
+			name, val := strings.ToLower(a[1]), html.UnescapeString(a[2])
+			if !mdAttrSafe[name] {
+				t.Errorf("unsafe attribute %s in %s", a[1], m[0])
+			}
+			if name == "href" || name == "src" {
+				scheme := strings.ToLower(strings.SplitN(strings.Map(func(r rune) rune {
+					if r <= ' ' {
+						return -1
+					}
+					return r
+				}, val), ":", 2)[0])
+				if strings.Contains(val, ":") && scheme != "http" && scheme != "https" && scheme != "mailto" {
+					t.Errorf("unsafe URL %q in %s", val, m[0])
+				}
+			}
+			if name == "src" {
+				images = append(images, val)
+			}
+		}
+	}
+	return images
+}
+
+func TestMarkdownSanitized(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "markdown", "xss.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := &markdownRenderer{Image: func(src string) (string, bool) {
+		if src == "images/logo.png" {
+			return "/feed/ui/Pkg/1.0.0/asset?path=images%2Flogo.png", true
+		}
+		return "", false
+	}}
+	out := mr.Render(string(b))
+
+	images := checkSanitized(t, out)
+	if len(images) != 1 || images[0] != "/feed/ui/Pkg/1.0.0/asset?path=images%2Flogo.png" {
+		t.Errorf("images %q, want only the package's own logo", images)
+	}
+	// The attempts are shown as text
+	for _, want := range []string{"&lt;script&gt;alert(1)&lt;/script&gt;", "&lt;img src=x onerror=", `<a href="https://example.com/docs?a=1&amp;b=2" rel="nofollow">site</a>`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %s", want)
+		}
+	}
+}
+
+// The UI page renders the readme, with images from the package only, and cuts
+// long readmes short with a link to the whole file
+func TestUIReadme(t *testing.T) {
+	xss, err := ioutil.ReadFile(filepath.Join("testdata", "markdown", "xss.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, func(c *Config) { c.UIReadmeMaxBytes = 2048 })
+	// Rendered for an earlier run's server, with its URL
+	readmeCache.Lock()
+	readmeCache.m = make(map[string]*packageReadme)
+	readmeCache.Unlock()
+	ts.mustPush(t, testPackage(t, "Readme.Pkg", "1.0.0", "<readme>docs\\readme.md</readme>", map[string]string{
+		"docs/readme.md":       string(xss),
+		"docs/images/logo.png": "\x89PNG\r\n\x1a\n",
+		"docs/lib/tool.dll":    "MZ",
+		"README.md":            "# Not this one",
+	}))
+	long := "# Long\n\n" + strings.Repeat("A line of the readme.\n", 200)
+	ts.mustPush(t, testPackage(t, "Readme.Long", "1.0.0", "", map[string]string{"README.md": long}))
+
+	status, body := ts.get(t, "ui/Readme.Pkg/1.0.0")
+	wantStatus(t, "ui page", status, body, http.StatusOK)
+	readme := between(body, `<div class="readme">`, "</div>")
+	if !strings.Contains(readme, "<h1>Readme &lt;script&gt;") {
+		t.Fatalf("readme not rendered: %.300s", readme)
+	}
+	images := checkSanitized(t, readme)
+	want := ts.Feed + "ui/Readme.Pkg/1.0.0/asset?path=docs%2Fimages%2Flogo.png"
+	if len(images) != 1 || images[0] != want {
+		t.Errorf("images %q, want %q", images, want)
+	}
+	readmeCache.Lock()
+	cached := readmeCache.m[versionKey("readme.pkg", "1.0.0")]
+	readmeCache.Unlock()
+	if cached == nil || cached.Path != "docs/readme.md" {
+		t.Errorf("rendered readme not cached: %+v", cached)
+	}
+
+	status, body = ts.get(t, strings.TrimPrefix(want, ts.Feed))
+	wantStatus(t, "asset", status, body, http.StatusOK)
+	status, body = ts.get(t, "ui/Readme.Pkg/1.0.0/asset?path=docs%2Flib%2Ftool.dll")
+	wantStatus(t, "non-image asset", status, body, http.StatusBadRequest)
+
+	status, body = ts.get(t, "ui/Readme.Long/1.0.0")
+	wantStatus(t, "long ui page", status, body, http.StatusOK)
+	readme = between(body, `<div class="readme">`, "</div>")
+	if !strings.Contains(readme, "too long to show in full") || !strings.Contains(readme, "?path=README.md") {
+		t.Errorf("long readme not cut short: %.300s", readme)
+	}
+	if n := strings.Count(readme, "A line of the readme."); n == 0 || n >= 200 {
+		t.Errorf("long readme shows %d of 200 lines", n)
+	}
+}
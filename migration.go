@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name a migration's checkpoint is kept under in the filestore's settings
+const migrationSetting = "migration"
+
+// Versions copied between checkpoints
+const migrationCheckpointEvery = 25
+
+// Migration states
+const (
+	migrationCopying = "copying"
+	migrationCopied  = "copied"
+	migrationCutOver = "cut-over"
+)
+
+// migrationTarget names the store a migration copies to. Config is a filestore
+// config applied over the current one, so only what differs need be given.
+type migrationTarget struct {
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// migrationFailure is a version that couldn't be copied or didn't verify
+type migrationFailure struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	Error   string `json:"error"`
+}
+
+// migrationState is a migration's progress. It is checkpointed in the source
+// store's settings so the copy resumes where it was after a restart.
+type migrationState struct {
+	Target   migrationTarget    `json:"target"`
+	Status   string             `json:"status"`
+	Started  time.Time          `json:"started"`
+	Updated  time.Time          `json:"updated"`
+	Total    int                `json:"total"`
+	Copied   []string           `json:"copied"`
+	Failures []migrationFailure `json:"failures"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// migratingFileStore routes the server's store while a migration runs. Until cut
+// over, pushes and changes go to both stores, feeds are served from the source,
+// and packages are read from the target first, falling back to the source. Once
+// cut over everything goes to the target.
+type migratingFileStore struct {
+	source fileStore
+
+	// Held for reading by every write, so cutover can stop them briefly
+	writes sync.RWMutex
+
+	lock    sync.Mutex
+	target  fileStore
+	cutOver bool
+	state   *migrationState
+	running bool
+	cancel  context.CancelFunc
+}
+
+func newMigratingFileStore(source fileStore) *migratingFileStore {
+	return &migratingFileStore{source: source}
+}
+
+// stores returns the source and target and whether the target has taken over
+func (m *migratingFileStore) stores() (fileStore, fileStore, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.source, m.target, m.cutOver
+}
+
+// active is the store that holds the feed
+func (m *migratingFileStore) active() fileStore {
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt
+	}
+	return src
+}
+
+// openMigrationTarget opens the store a migration copies to, refusing the store
+// the server already uses
+func openMigrationTarget(t migrationTarget) (fileStore, error) {
+	cur := server.Config()
+	c := *cur
+	if len(t.Config) > 0 {
+		if err := json.Unmarshal(t.Config, &c.FileStore); err != nil {
+			return nil, errors.New("target config is not a filestore config: " + err.Error())
+		}
+	}
+	if t.Type != "" {
+		c.FileStore.Type = t.Type
+	}
+	if c.FileStore.Type != "local" && c.FileStore.Type != "gcp" {
+		return nil, errors.New("target type must be local or gcp")
+	}
+	if c.FileStore.Type == cur.FileStore.Type && c.FileStore.RepoDIR == cur.FileStore.RepoDIR &&
+		c.FileStore.BucketName == cur.FileStore.BucketName && c.FileStore.ProjectID == cur.FileStore.ProjectID {
+		return nil, errors.New("target is the store already in use")
+	}
+	return newFileStore(&Server{config: &c, URL: server.URL, operations: server.operations})
+}
+
+// resumeMigration picks up a migration checkpointed before a restart
+func (m *migratingFileStore) resumeMigration() error {
+	b, err := m.source.GetSetting(context.Background(), migrationSetting)
+	if err == ErrFileNotFound || err == ErrNotSupported {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	st := &migrationState{}
+	if err := json.Unmarshal(b, st); err != nil {
+		return err
+	}
+	// Abandoned migrations leave an empty checkpoint
+	if st.Status == "" {
+		return nil
+	}
+	tgt, err := openMigrationTarget(st.Target)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	m.target = tgt
+	m.state = st
+	m.cutOver = st.Status == migrationCutOver
+	m.lock.Unlock()
+
+	switch st.Status {
+	case migrationCutOver:
+		log.Println("WARNING: The package store was migrated, point the filestore config at the new store")
+	case migrationCopying:
+		log.Println("Resuming package store migration,", len(st.Copied), "of", st.Total, "versions copied")
+		m.start()
+	}
+	return nil
+}
+
+// start runs the copy in the background
+func (m *migratingFileStore) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.lock.Lock()
+	m.cancel = cancel
+	m.running = true
+	m.lock.Unlock()
+
+	go func() {
+		err := m.copyAll(ctx)
+		m.lock.Lock()
+		m.running = false
+		if err != nil && ctx.Err() == nil {
+			m.state.Error = err.Error()
+			log.Println("Package store migration stopped:", err)
+		} else if err == nil {
+			m.state.Status = migrationCopied
+			m.state.Error = ""
+			log.Println("Package store migration copied", len(m.state.Copied), "versions,", len(m.state.Failures), "failed")
+		}
+		m.lock.Unlock()
+		if ctx.Err() == nil {
+			if err := m.checkpoint(context.Background()); err != nil {
+				log.Println("Error: Cannot checkpoint migration", err)
+			}
+		}
+	}()
+}
+
+// checkpoint saves the migration's progress in the source store, and once cut
+// over in the target too
+func (m *migratingFileStore) checkpoint(ctx context.Context) error {
+	m.lock.Lock()
+	m.state.Updated = time.Now().UTC()
+	b, err := json.Marshal(m.state)
+	cut := m.cutOver
+	tgt := m.target
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := m.source.PutSetting(ctx, migrationSetting, b); err != nil {
+		return err
+	}
+	if cut {
+		return tgt.PutSetting(ctx, migrationSetting, b)
+	}
+	return nil
+}
+
+// Settings copied to the target once the versions are: the allowed ID list,
+// package visibility, retired IDs and the keys share and next links are signed
+// with, so links handed out before the cutover still work after it
+var migratedSettings = []string{allowedIDsSetting, visibilitySetting, retiredIDsSetting, shareKeySetting, skipTokenKeySetting}
+
+// copyAll copies every version not yet copied, then the pins and settings
+func (m *migratingFileStore) copyAll(ctx context.Context) error {
+	src, tgt, _ := m.stores()
+	entries, err := allPackageEntries(ctx, src, "")
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	copied := make(map[string]bool)
+	for _, k := range m.state.Copied {
+		copied[k] = true
+	}
+	m.state.Total = len(entries)
+	m.state.Failures = nil
+	m.lock.Unlock()
+
+	var todo []*NugetPackageEntry
+	for _, e := range entries {
+		if !copied[cacheKey(e.Properties.ID, e.Properties.Version)] {
+			todo = append(todo, e)
+		}
+	}
+	op := server.operations.Start("migrate", len(todo))
+	defer op.Finish()
+
+	for i, e := range todo {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := copyVersion(ctx, src, tgt, e.Properties.ID, e.Properties.Version)
+		m.lock.Lock()
+		if err != nil {
+			m.state.Failures = append(m.state.Failures, migrationFailure{ID: e.Properties.ID, Version: e.Properties.Version, Error: err.Error()})
+		} else {
+			m.state.Copied = append(m.state.Copied, cacheKey(e.Properties.ID, e.Properties.Version))
+		}
+		m.lock.Unlock()
+		op.Step()
+		if i%migrationCheckpointEvery == migrationCheckpointEvery-1 {
+			if err := m.checkpoint(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Pins and settings
+	pins, err := src.GetPinnedVersions(ctx)
+	if err != nil && err != ErrNotSupported {
+		return err
+	}
+	for id, ver := range pins {
+		if err := tgt.SetPinnedVersion(ctx, id, ver); err != nil && err != ErrNotSupported {
+			return err
+		}
+	}
+	for _, name := range migratedSettings {
+		if b, err := src.GetSetting(ctx, name); err == nil {
+			if err := tgt.PutSetting(ctx, name, b); err != nil {
+				return err
+			}
+		} else if err != ErrFileNotFound && err != ErrNotSupported {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyVersion copies a version's nupkg, symbols, listing and download count to the
+// target and checks the target's copy has the hash the source records
+func copyVersion(ctx context.Context, src fileStore, tgt fileStore, id string, ver string) error {
+	e, err := src.GetPackageEntry(ctx, id, ver)
+	if err != nil {
+		return err
+	}
+
+	te, err := tgt.GetPackageEntry(ctx, id, ver)
+	if err == ErrFileNotFound {
+		pkg, err := src.ReadPackageFile(ctx, id, ver)
+		if err != nil {
+			return err
+		}
+		h := sha512.Sum512(pkg)
+		if !strings.EqualFold(hex.EncodeToString(h[:]), e.Properties.PackageHash) {
+			return errors.New("source package does not match its recorded hash")
+		}
+		// A push during the migration may have stored it since
+		if _, err := tgt.StorePackage(ctx, pkg); err != nil && !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+		if te, err = tgt.GetPackageEntry(ctx, id, ver); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if !strings.EqualFold(te.Properties.PackageHash, e.Properties.PackageHash) {
+		return errors.New("target already has a different package for this version")
+	}
+
+	if e.Properties.Listed.Value != te.Properties.Listed.Value {
+		if err := tgt.SetListed(ctx, id, ver, e.Properties.Listed.Value); err == ErrNotSupported {
+			return errors.New("target can't unlist versions")
+		} else if err != nil {
+			return err
+		}
+	}
+	if n := e.Properties.VersionDownloadCount.Value - te.Properties.VersionDownloadCount.Value; n > 0 {
+		if err := tgt.AddDownloads(ctx, map[string]int{id + "/" + ver: n}); err != nil {
+			return err
+		}
+	}
+
+	// Verify what the target serves, not just what it recorded
+	b, err := tgt.ReadPackageFile(ctx, id, ver)
+	if err != nil {
+		return err
+	}
+	h := sha512.Sum512(b)
+	if !strings.EqualFold(hex.EncodeToString(h[:]), e.Properties.PackageHash) {
+		return errors.New("target copy does not match the source hash")
+	}
+	return copySymbolPackage(ctx, src, tgt, id, ver)
+}
+
+// copySymbolPackage copies a version's .snupkg, if it has one, to the target
+func copySymbolPackage(ctx context.Context, src fileStore, tgt fileStore, id string, ver string) error {
+	sym, err := src.GetSymbolPackage(ctx, id, ver)
+	if err == ErrFileNotFound || err == ErrNotSupported {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if b, err := tgt.GetSymbolPackage(ctx, id, ver); err == nil && bytes.Equal(b, sym) {
+		return nil
+	}
+	if err := tgt.StoreSymbolPackage(ctx, id, ver, sym); err == ErrNotSupported {
+		return errors.New("target can't store symbol packages")
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// cutOverTo makes the target the active store. Writes wait while the last changes
+// are copied; reads carry on from whichever store has the package.
+func (m *migratingFileStore) cutOverTo(ctx context.Context) error {
+	m.writes.Lock()
+	defer m.writes.Unlock()
+
+	m.lock.Lock()
+	if m.state == nil || m.cutOver {
+		m.lock.Unlock()
+		return errors.New("no migration to cut over")
+	}
+	if m.running || m.state.Status != migrationCopied {
+		m.lock.Unlock()
+		return errors.New("the copy has not finished")
+	}
+	m.lock.Unlock()
+
+	// Quarantine isn't migrated
+	if q, err := m.source.GetQuarantinedEntries(ctx); err == nil && len(q) > 0 {
+		return fmt.Errorf("%d packages are in quarantine, approve or reject them first", len(q))
+	}
+
+	// Anything pushed since the copy finished
+	if err := m.copyAll(ctx); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	if n := len(m.state.Failures); n > 0 {
+		m.lock.Unlock()
+		m.checkpoint(ctx)
+		return fmt.Errorf("%d versions failed to copy, see the status", n)
+	}
+	m.cutOver = true
+	m.state.Status = migrationCutOver
+	m.lock.Unlock()
+	log.Println("Package store migration cut over to the new store")
+	return m.checkpoint(ctx)
+}
+
+// abandon stops a migration that hasn't been cut over and forgets it. The target's
+// copies are left for the operator to remove.
+func (m *migratingFileStore) abandon(ctx context.Context) error {
+	m.writes.Lock()
+	defer m.writes.Unlock()
+
+	m.lock.Lock()
+	if m.state == nil {
+		m.lock.Unlock()
+		return ErrFileNotFound
+	}
+	if m.cutOver {
+		m.lock.Unlock()
+		return errors.New("the migration has been cut over")
+	}
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.target = nil
+	m.state = nil
+	m.running = false
+	m.lock.Unlock()
+	return m.source.PutSetting(ctx, migrationSetting, []byte(`{}`))
+}
+
+// Reads during a migration try the target first
+
+func (m *migratingFileStore) GetPackageEntry(ctx context.Context, id string, ver string) (*NugetPackageEntry, error) {
+	src, tgt, cut := m.stores()
+	if tgt != nil {
+		npe, err := tgt.GetPackageEntry(ctx, id, ver)
+		if cut || err != ErrFileNotFound {
+			return npe, err
+		}
+	}
+	return src.GetPackageEntry(ctx, id, ver)
+}
+
+func (m *migratingFileStore) GetPackageFile(ctx context.Context, id string, ver string) (*packageFile, error) {
+	src, tgt, cut := m.stores()
+	if tgt != nil {
+		f, err := tgt.GetPackageFile(ctx, id, ver)
+		if cut || err != ErrFileNotFound {
+			return f, err
+		}
+	}
+	return src.GetPackageFile(ctx, id, ver)
+}
+
+func (m *migratingFileStore) ReadPackageFile(ctx context.Context, id string, ver string) ([]byte, error) {
+	src, tgt, cut := m.stores()
+	if tgt != nil {
+		b, err := tgt.ReadPackageFile(ctx, id, ver)
+		if cut || err != ErrFileNotFound {
+			return b, err
+		}
+	}
+	return src.ReadPackageFile(ctx, id, ver)
+}
+
+func (m *migratingFileStore) GetFile(ctx context.Context, f string) ([]byte, string, error) {
+	src, tgt, cut := m.stores()
+	if tgt != nil {
+		b, t, err := tgt.GetFile(ctx, f)
+		if cut || err != ErrFileNotFound {
+			return b, t, err
+		}
+	}
+	return src.GetFile(ctx, f)
+}
+
+func (m *migratingFileStore) GetCompressedFile(ctx context.Context, f string) ([]byte, error) {
+	src, tgt, cut := m.stores()
+	if tgt != nil {
+		b, err := tgt.GetCompressedFile(ctx, f)
+		if cut || err != ErrFileNotFound {
+			return b, err
+		}
+	}
+	return src.GetCompressedFile(ctx, f)
+}
+
+// Writes during a migration go to both stores. The source's result is the one
+// returned; the copy catches up with any the target missed.
+
+func (m *migratingFileStore) StorePackage(ctx context.Context, pkg []byte) (bool, error) {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt.StorePackage(ctx, pkg)
+	}
+	exists, err := src.StorePackage(ctx, pkg)
+	if err == nil && tgt != nil {
+		if _, err := tgt.StorePackage(ctx, pkg); err != nil && !strings.Contains(err.Error(), "already exists") {
+			log.Println("Migration: could not store pushed package in the new store:", err)
+		}
+	}
+	return exists, err
+}
+
+func (m *migratingFileStore) ApprovePackage(ctx context.Context, id string, ver string) error {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt.ApprovePackage(ctx, id, ver)
+	}
+	if err := src.ApprovePackage(ctx, id, ver); err != nil {
+		return err
+	}
+	if tgt != nil {
+		if err := copyVersion(ctx, src, tgt, id, ver); err != nil {
+			log.Println("Migration: could not copy approved package to the new store:", err)
+		}
+	}
+	return nil
+}
+
+func (m *migratingFileStore) SetListed(ctx context.Context, id string, ver string, listed bool) error {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt.SetListed(ctx, id, ver, listed)
+	}
+	if err := src.SetListed(ctx, id, ver, listed); err != nil {
+		return err
+	}
+	if tgt != nil {
+		if err := tgt.SetListed(ctx, id, ver, listed); err != nil && err != ErrFileNotFound {
+			log.Println("Migration: could not change listing in the new store:", err)
+		}
+	}
+	return nil
+}
+
+func (m *migratingFileStore) DeletePackage(ctx context.Context, id string, ver string) error {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt.DeletePackage(ctx, id, ver)
+	}
+	if err := src.DeletePackage(ctx, id, ver); err != nil {
+		return err
+	}
+	if tgt != nil {
+		if err := tgt.DeletePackage(ctx, id, ver); err != nil && err != ErrFileNotFound {
+			log.Println("Migration: could not delete the version from the new store:", err)
+		}
+	}
+	return nil
+}
+
+func (m *migratingFileStore) AddDownloads(ctx context.Context, counts map[string]int) error {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt.AddDownloads(ctx, counts)
+	}
+	if err := src.AddDownloads(ctx, counts); err != nil {
+		return err
+	}
+	// Versions not copied yet are ignored by the target and copied with their count
+	if tgt != nil {
+		if err := tgt.AddDownloads(ctx, counts); err != nil {
+			log.Println("Migration: could not count downloads in the new store:", err)
+		}
+	}
+	return nil
+}
+
+func (m *migratingFileStore) SetPinnedVersion(ctx context.Context, id string, ver string) error {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt.SetPinnedVersion(ctx, id, ver)
+	}
+	if err := src.SetPinnedVersion(ctx, id, ver); err != nil {
+		return err
+	}
+	if tgt != nil {
+		if err := tgt.SetPinnedVersion(ctx, id, ver); err != nil && err != ErrNotSupported {
+			log.Println("Migration: could not pin the version in the new store:", err)
+		}
+	}
+	return nil
+}
+
+func (m *migratingFileStore) StoreSymbolPackage(ctx context.Context, id string, ver string, pkg []byte) error {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt.StoreSymbolPackage(ctx, id, ver, pkg)
+	}
+	if err := src.StoreSymbolPackage(ctx, id, ver, pkg); err != nil {
+		return err
+	}
+	// Symbols of versions not copied yet are copied with them
+	if tgt != nil {
+		if err := tgt.StoreSymbolPackage(ctx, id, ver, pkg); err != nil && err != ErrFileNotFound {
+			log.Println("Migration: could not store pushed symbols in the new store:", err)
+		}
+	}
+	return nil
+}
+
+func (m *migratingFileStore) PutSetting(ctx context.Context, name string, b []byte) error {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	src, tgt, cut := m.stores()
+	if cut {
+		return tgt.PutSetting(ctx, name, b)
+	}
+	if err := src.PutSetting(ctx, name, b); err != nil {
+		return err
+	}
+	if tgt != nil {
+		if err := tgt.PutSetting(ctx, name, b); err != nil {
+			log.Println("Migration: could not save setting in the new store:", err)
+		}
+	}
+	return nil
+}
+
+// Everything else is served by the active store
+
+func (m *migratingFileStore) Init(c *Server) error {
+	return m.active().Init(c)
+}
+
+func (m *migratingFileStore) GetPackageFeedEntries(ctx context.Context, id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+	return m.active().GetPackageFeedEntries(ctx, id, startAfter, max)
+}
+
+func (m *migratingFileStore) GetAccessLevel(ctx context.Context, key string) (access, error) {
+	return m.active().GetAccessLevel(ctx, key)
+}
+
+func (m *migratingFileStore) UpdateCountsInMemory() {
+	m.active().UpdateCountsInMemory()
+}
+
+func (m *migratingFileStore) QuarantinePackage(ctx context.Context, pkg []byte) (*NugetPackageEntry, error) {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	return m.active().QuarantinePackage(ctx, pkg)
+}
+
+func (m *migratingFileStore) GetQuarantinedEntries(ctx context.Context) ([]*NugetPackageEntry, error) {
+	return m.active().GetQuarantinedEntries(ctx)
+}
+
+func (m *migratingFileStore) RejectPackage(ctx context.Context, id string, ver string, reason string) error {
+	m.writes.RLock()
+	defer m.writes.RUnlock()
+	return m.active().RejectPackage(ctx, id, ver, reason)
+}
+
+func (m *migratingFileStore) GetChanges(ctx context.Context, since int64) ([]changeRecord, int64, bool, error) {
+	return m.active().GetChanges(ctx, since)
+}
+
+func (m *migratingFileStore) LastChanged(ctx context.Context) time.Time {
+	return m.active().LastChanged(ctx)
+}
+
+func (m *migratingFileStore) GetExtractionStatus(ctx context.Context, id string, ver string) (*extractionStatus, error) {
+	return m.active().GetExtractionStatus(ctx, id, ver)
+}
+
+func (m *migratingFileStore) GetExtractionStatuses(ctx context.Context) ([]*extractionStatus, error) {
+	return m.active().GetExtractionStatuses(ctx)
+}
+
+func (m *migratingFileStore) ReextractPackage(ctx context.Context, id string, ver string) (*extractionStatus, error) {
+	return m.active().ReextractPackage(ctx, id, ver)
+}
+
+func (m *migratingFileStore) Reindex(ctx context.Context) (int, error) {
+	return m.active().Reindex(ctx)
+}
+
+func (m *migratingFileStore) GetPackageStorage(ctx context.Context, id string, ver string) (*packageStorage, error) {
+	return m.active().GetPackageStorage(ctx, id, ver)
+}
+
+func (m *migratingFileStore) GetSetting(ctx context.Context, name string) ([]byte, error) {
+	return m.active().GetSetting(ctx, name)
+}
+
+func (m *migratingFileStore) GetPinnedVersions(ctx context.Context) (map[string]string, error) {
+	return m.active().GetPinnedVersions(ctx)
+}
+
+func (m *migratingFileStore) GetPackageVersions(ctx context.Context, id string) ([]string, error) {
+	return m.active().GetPackageVersions(ctx, id)
+}
+
+func (m *migratingFileStore) GetNuspec(ctx context.Context, id string, ver string) ([]byte, error) {
+	return m.active().GetNuspec(ctx, id, ver)
+}
+
+func (m *migratingFileStore) GetSymbolPackage(ctx context.Context, id string, ver string) ([]byte, error) {
+	return m.active().GetSymbolPackage(ctx, id, ver)
+}
+
+func (m *migratingFileStore) GetSymbolFile(ctx context.Context, pdbName string, signature string) ([]byte, string, error) {
+	return m.active().GetSymbolFile(ctx, pdbName, signature)
+}
+
+// migrationStatus is a migration as served by admin/migrate/status. The target's
+// config is left out as it may hold API keys.
+type migrationStatus struct {
+	Target   string             `json:"target"`
+	Status   string             `json:"status"`
+	Running  bool               `json:"running"`
+	Started  time.Time          `json:"started"`
+	Updated  time.Time          `json:"updated"`
+	Total    int                `json:"total"`
+	Copied   int                `json:"copied"`
+	Failures []migrationFailure `json:"failures"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// serveMigration handles admin/migrate: POST starts or resumes a migration, GET
+// .../status reports it, POST .../cutover switches to the target and DELETE
+// abandons it
+func serveMigration(w http.ResponseWriter, r *http.Request) {
+	m := server.migration
+	action := strings.Trim(r.URL.Path[len(server.URL.Path+`admin/migrate`):], `/`)
+
+	switch {
+	case r.Method == http.MethodGet && action == "status":
+		// Reported below
+	case r.Method == http.MethodPost && action == "":
+		var req struct {
+			Target migrationTarget `json:"target"`
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(b, &req); err != nil || req.Target.Type == "" {
+			writeMigrationError(w, http.StatusBadRequest, "body must be {\"target\": {\"type\": \"...\", \"config\": {...}}}")
+			return
+		}
+		m.lock.Lock()
+		busy := m.running || m.cutOver
+		existing := m.state != nil
+		m.lock.Unlock()
+		if busy {
+			writeMigrationError(w, http.StatusConflict, "a migration is already running or cut over")
+			return
+		}
+		if !existing {
+			tgt, err := openMigrationTarget(req.Target)
+			if err != nil {
+				writeMigrationError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			m.lock.Lock()
+			m.target = tgt
+			m.state = &migrationState{Target: req.Target, Started: time.Now().UTC(), Copied: []string{}}
+			m.lock.Unlock()
+		}
+		// Copying again resumes, retrying failed versions
+		m.lock.Lock()
+		m.state.Status = migrationCopying
+		m.lock.Unlock()
+		if err := m.checkpoint(r.Context()); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		m.start()
+	case r.Method == http.MethodPost && action == "cutover":
+		if err := m.cutOverTo(r.Context()); isCancelled(err) {
+			writeCancelled(w, r)
+			return
+		} else if err != nil {
+			writeMigrationError(w, http.StatusConflict, err.Error())
+			return
+		}
+	case r.Method == http.MethodDelete && action == "":
+		if err := m.abandon(r.Context()); err == ErrFileNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeMigrationError(w, http.StatusConflict, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	m.lock.Lock()
+	if m.state == nil {
+		m.lock.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	st := migrationStatus{
+		Target:   m.state.Target.Type,
+		Status:   m.state.Status,
+		Running:  m.running,
+		Started:  m.state.Started,
+		Updated:  m.state.Updated,
+		Total:    m.state.Total,
+		Copied:   len(m.state.Copied),
+		Failures: append([]migrationFailure{}, m.state.Failures...),
+		Error:    m.state.Error,
+	}
+	m.lock.Unlock()
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if r.Method == http.MethodPost && action == "" {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	w.Write(b)
+}
+
+// writeMigrationError explains why a migration request was refused
+func writeMigrationError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(msg))
+}
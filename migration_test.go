@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// symbolPackage builds a .snupkg for a version
+func symbolPackage(t *testing.T, id string, ver string) []byte {
+	t.Helper()
+	return testPackage(t, id, ver, `<packageTypes><packageType name="SymbolsPackage" /></packageTypes>`,
+		map[string]string{"lib/net6.0/" + id + ".pdb": "not really a pdb"})
+}
+
+// migrate starts a migration to a local directory and waits for it to copy
+func migrate(t *testing.T, ts *testServer, dir string) migrationStatus {
+	t.Helper()
+	body := `{"target": {"type": "local", "config": {"local-directory": ` + jsonString(dir) + `}}}`
+	status, b := readResponse(t, ts.do(t, http.MethodPost, "admin/migrate", testWriteKey, strings.NewReader(body), nil))
+	wantStatus(t, "migrate", status, b, http.StatusAccepted)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, b := readResponse(t, ts.do(t, http.MethodGet, "admin/migrate/status", testWriteKey, nil, nil))
+		wantStatus(t, "status", status, b, http.StatusOK)
+		var st migrationStatus
+		if err := json.Unmarshal([]byte(b), &st); err != nil {
+			t.Fatal(err)
+		}
+		if !st.Running {
+			if st.Status != migrationCopied {
+				t.Fatalf("migration stopped: %s", b)
+			}
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("migration still running: %s", b)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMigrationCopiesSettingsAndSymbols(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Mig.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Mig.Old", "1.0.0", "", nil))
+	sym := symbolPackage(t, "Mig.Pkg", "1.0.0")
+	status, body := readResponse(t, ts.pushTo(t, "api/v2/symbolpackage/", testWriteKey, sym))
+	wantStatus(t, "symbols", status, body, http.StatusCreated)
+	status, body = readResponse(t, ts.do(t, http.MethodPut, "admin/packages/Mig.Old/retire", testWriteKey, strings.NewReader(`{"message": "gone"}`), nil))
+	wantStatus(t, "retire", status, body, http.StatusOK)
+
+	st := migrate(t, ts, filepath.Join(ts.Dir, "target"))
+	if st.Total != 2 || st.Copied != 2 || len(st.Failures) != 0 {
+		t.Errorf("got %+v", st)
+	}
+
+	ctx := context.Background()
+	src, tgt, _ := server.migration.stores()
+	b, err := tgt.GetSymbolPackage(ctx, "Mig.Pkg", "1.0.0")
+	if err != nil || !bytes.Equal(b, sym) {
+		t.Errorf("symbols not copied: %v", err)
+	}
+	for _, name := range []string{retiredIDsSetting, shareKeySetting, skipTokenKeySetting} {
+		want, err := src.GetSetting(ctx, name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := tgt.GetSetting(ctx, name); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestMigrationSymbolPushesGoToBothStores(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Mig.Sym", "1.0.0", "", nil))
+	migrate(t, ts, filepath.Join(ts.Dir, "target"))
+
+	// Pushed after the copy, before the cutover
+	ts.mustPush(t, testPackage(t, "Mig.Sym", "2.0.0", "", nil))
+	for _, ver := range []string{"1.0.0", "2.0.0"} {
+		sym := symbolPackage(t, "Mig.Sym", ver)
+		status, body := readResponse(t, ts.pushTo(t, "api/v2/symbolpackage/", testWriteKey, sym))
+		wantStatus(t, "symbols "+ver, status, body, http.StatusCreated)
+
+		src, tgt, _ := server.migration.stores()
+		for name, fs := range map[string]fileStore{"old": src, "new": tgt} {
+			if b, err := fs.GetSymbolPackage(context.Background(), "Mig.Sym", ver); err != nil || !bytes.Equal(b, sym) {
+				t.Errorf("%s: symbols not in the %s store: %v", ver, name, err)
+			}
+		}
+	}
+
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/migrate/cutover", testWriteKey, nil, nil))
+	wantStatus(t, "cutover", status, body, http.StatusOK)
+	status, body = ts.get(t, "snupkg/Mig.Sym/1.0.0")
+	wantStatus(t, "symbols after the cutover", status, body, http.StatusOK)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path"
+	"strings"
+)
+
+// mirroredChanges drops the changes to packages that require license acceptance
+// when mirroring.skip-license-acceptance is set, so replicas following api/changes
+// never copy them, unless their ID is in license-acceptance-allowed. Removals are
+// always passed on.
+func mirroredChanges(ctx context.Context, changes []changeRecord) []changeRecord {
+	c := server.Config()
+	if !c.Mirroring.SkipLicenseAcceptance {
+		return changes
+	}
+
+	list := []changeRecord{}
+	for _, ch := range changes {
+		if ch.Type == changeCheckpoint || ch.Type == changeRemoved || licenseAcceptanceAllowed(c, ch.ID) {
+			list = append(list, ch)
+			continue
+		}
+		npe, err := server.fs.GetPackageEntry(ctx, ch.ID, ch.Version)
+		if err == nil && npe.Properties.RequireLicenseAcceptance.Value {
+			log.Printf("Mirroring: skipping %s %s, it requires license acceptance", ch.ID, ch.Version)
+			continue
+		}
+		list = append(list, ch)
+	}
+	return list
+}
+
+// licenseAcceptanceAllowed reports whether an ID may be mirrored even though its
+// packages require license acceptance
+func licenseAcceptanceAllowed(c *Config, id string) bool {
+	for _, g := range c.Mirroring.LicenseAcceptanceAllowed {
+		if ok, _ := path.Match(strings.ToLower(g), strings.ToLower(id)); ok {
+			return true
+		}
+	}
+	return false
+}
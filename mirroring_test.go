@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Packages with requireLicenseAcceptance true, false and absent from the nuspec
+func licensePackages(t *testing.T) map[string][]byte {
+	return map[string][]byte{
+		"Lic.Required": testPackage(t, "Lic.Required", "1.0.0", `<requireLicenseAcceptance>true</requireLicenseAcceptance>
+    <licenseUrl>https://example.com/eula</licenseUrl>`, nil),
+		"Lic.Optional": testPackage(t, "Lic.Optional", "1.0.0", `<requireLicenseAcceptance>false</requireLicenseAcceptance>
+    <license type="expression">MIT</license>`, nil),
+		"Lic.Absent": testPackage(t, "Lic.Absent", "1.0.0", "", nil),
+	}
+}
+
+func TestRequireLicenseAcceptance(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, pkg := range licensePackages(t) {
+		ts.mustPush(t, pkg)
+	}
+
+	status, body := ts.get(t, "$metadata")
+	wantStatus(t, "$metadata", status, body, http.StatusOK)
+	if !strings.Contains(body, `<Property Name="RequireLicenseAcceptance" Type="Edm.Boolean" Nullable="false" />`) {
+		t.Error("$metadata does not declare RequireLicenseAcceptance as Edm.Boolean")
+	}
+
+	for _, tc := range []struct {
+		id      string
+		require bool
+		license string
+	}{
+		{"Lic.Required", true, "https://example.com/eula"},
+		{"Lic.Optional", false, "https://licenses.nuget.org/MIT"},
+		{"Lic.Absent", false, ""},
+	} {
+		status, body := ts.get(t, "Packages(Id='"+tc.id+"',Version='1.0.0')")
+		wantStatus(t, tc.id, status, body, http.StatusOK)
+		if want := fmt.Sprintf(`<d:RequireLicenseAcceptance m:type="Edm.Boolean">%v</d:RequireLicenseAcceptance>`, tc.require); !strings.Contains(body, want) {
+			t.Errorf("%s: no %s", tc.id, want)
+		}
+
+		status, body = ts.get(t, "Packages()?$filter=Id%20eq%20'"+tc.id+"'&$format=json")
+		wantStatus(t, tc.id+" json", status, body, http.StatusOK)
+		if want := fmt.Sprintf(`"RequireLicenseAcceptance":%v`, tc.require); !strings.Contains(body, want) {
+			t.Errorf("%s json: no %s", tc.id, want)
+		}
+
+		status, body = ts.get(t, "ui/"+tc.id+"/1.0.0")
+		wantStatus(t, tc.id+" ui", status, body, http.StatusOK)
+		if got := strings.Contains(body, `class="license-notice"`); got != tc.require {
+			t.Errorf("%s ui: license notice shown %v, want %v", tc.id, got, tc.require)
+		}
+		if tc.license != "" && !strings.Contains(body, `<a href="`+tc.license+`"`) {
+			t.Errorf("%s ui: no link to %s", tc.id, tc.license)
+		}
+	}
+}
+
+// mirroredIDs returns the IDs of the changes a replica is sent
+func mirroredIDs(t *testing.T, ts *testServer) []string {
+	t.Helper()
+	status, body := ts.get(t, "api/changes?since=0")
+	wantStatus(t, "changes", status, body, http.StatusOK)
+	var res struct {
+		Changes []changeRecord `json:"changes"`
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, c := range res.Changes {
+		if c.Type != changeCheckpoint {
+			ids = append(ids, c.Type+" "+c.ID)
+		}
+	}
+	return ids
+}
+
+func TestMirroringSkipsLicenseAcceptance(t *testing.T) {
+	ts := newTestServer(t, nil)
+	pkgs := licensePackages(t)
+	for _, id := range []string{"Lic.Required", "Lic.Optional", "Lic.Absent"} {
+		ts.mustPush(t, pkgs[id])
+	}
+	all := "added Lic.Required,added Lic.Optional,added Lic.Absent"
+	if got := strings.Join(mirroredIDs(t, ts), ","); got != all {
+		t.Errorf("skip off: %s", got)
+	}
+
+	reload := func(change func(c *Config)) {
+		t.Helper()
+		rewriteConfig(t, ts, change)
+		status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/reload-config", testWriteKey, nil, nil))
+		wantStatus(t, "reload", status, body, http.StatusNoContent)
+	}
+	reload(func(c *Config) { c.Mirroring.SkipLicenseAcceptance = true })
+	if got := strings.Join(mirroredIDs(t, ts), ","); got != "added Lic.Optional,added Lic.Absent" {
+		t.Errorf("skip on: %s", got)
+	}
+
+	// Removals are always passed on. The version is gone, so nothing can be
+	// copied from its earlier add.
+	status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Lic.Required/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete", status, body, http.StatusNoContent)
+	if got := strings.Join(mirroredIDs(t, ts), ","); got != all+",removed Lic.Required" {
+		t.Errorf("skip on, after a removal: %s", got)
+	}
+
+	ts.mustPush(t, pkgs["Lic.Required"])
+	if got := strings.Join(mirroredIDs(t, ts), ","); got != "added Lic.Optional,added Lic.Absent,removed Lic.Required" {
+		t.Errorf("skip on, pushed again: %s", got)
+	}
+
+	// Unless allowed
+	reload(func(c *Config) { c.Mirroring.LicenseAcceptanceAllowed = []string{"lic.req*"} })
+	if got := strings.Join(mirroredIDs(t, ts), ","); got != all+",removed Lic.Required,added Lic.Required" {
+		t.Errorf("allowed: %s", got)
+	}
+
+	// A bad glob is refused
+	rewriteConfig(t, ts, func(c *Config) { c.Mirroring.LicenseAcceptanceAllowed = []string{"Lic.[Req"} })
+	status, body = readResponse(t, ts.do(t, http.MethodPost, "admin/reload-config", testWriteKey, nil, nil))
+	wantStatus(t, "reload of a bad glob", status, body, http.StatusBadRequest)
+	if !strings.Contains(body, "license-acceptance-allowed") {
+		t.Errorf("reload of a bad glob: %q", body)
+	}
+}
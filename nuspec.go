@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	nuspec "github.com/soloworks/go-nuspec"
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Namespace family used by nuspec schemas, e.g. http://schemas.microsoft.com/packaging/2013/05/nuspec.xsd
+const nuspecNamespacePrefix = "http://schemas.microsoft.com/packaging/"
+
+// ErrNuspecMissingIdentity is returned when a nuspec has no id or version
+var ErrNuspecMissingIdentity = errors.New("nuspec is missing id or version")
+
+// ErrInvalidPackageIdentity is returned when a nuspec's id or version isn't one
+// NuGet accepts
+var ErrInvalidPackageIdentity = errors.New("invalid package id or version")
+
+// validPackageID matches the IDs NuGet accepts, words joined by dots or dashes
+var validPackageID = regexp.MustCompile(`^\w+([.-]\w+)*$`)
+
+// Longest package ID NuGet accepts
+const maxPackageIDLength = 100
+
+// checkPackageIdentity fails unless id and ver are a package ID and version NuGet
+// accepts. They name the package's files in the store, so are checked before any
+// path is built from them.
+func checkPackageIdentity(id string, ver string) error {
+	if len(id) > maxPackageIDLength || !validPackageID.MatchString(id) {
+		return fmt.Errorf("%w: %q is not a package id", ErrInvalidPackageIdentity, id)
+	}
+	if _, err := versions.Parse(ver); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPackageIdentity, err)
+	}
+	return nil
+}
+
+// parseNuspec reads a .nuspec, tolerating byte order marks, unusual namespaces and
+// encoding declarations that nuget.exe accepts. Strict parsing is tried first, with a
+// namespace-agnostic decode of the metadata we use as a fallback.
+func parseNuspec(b []byte) (*nuspec.NuSpec, error) {
+
+	// Strip/convert byte order marks
+	b = stripBOM(b)
+
+	// Strict parse
+	nsf, err := nuspec.FromBytes(b)
+	if err == nil && nsf.Meta.ID != "" && nsf.Meta.Version != "" {
+		if nsf.Xmlns != "" && !strings.HasPrefix(nsf.Xmlns, nuspecNamespacePrefix) {
+			log.Printf("Nuspec for %s %s uses unknown namespace %q", nsf.Meta.ID, nsf.Meta.Version, nsf.Xmlns)
+		}
+		return nsf, nil
+	}
+
+	// Fallback parse
+	nsf, ferr := decodeNuspecLenient(b)
+	if ferr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, ferr
+	}
+	log.Printf("Nuspec for %s %s read with lenient decoder (strict parse: %v)", nsf.Meta.ID, nsf.Meta.Version, err)
+	return nsf, nil
+}
+
+// stripBOM removes a UTF-8 byte order mark, converting UTF-16 content to UTF-8
+func stripBOM(b []byte) []byte {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xEF, 0xBB, 0xBF}):
+		log.Println("Nuspec: stripped UTF-8 byte order mark")
+		return b[3:]
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}), bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		log.Println("Nuspec: converted UTF-16 content to UTF-8")
+		le := b[0] == 0xFF
+		u := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			if le {
+				u = append(u, uint16(b[i])|uint16(b[i+1])<<8)
+			} else {
+				u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+			}
+		}
+		s := string(utf16.Decode(u))
+		// The declaration no longer matches the content
+		return []byte(strings.Replace(s, `encoding="utf-16"`, `encoding="utf-8"`, 1))
+	}
+	return b
+}
+
+// decodeNuspecLenient walks the XML ignoring namespaces, picking out metadata elements by local name
+func decodeNuspecLenient(b []byte) (*nuspec.NuSpec, error) {
+	nsf := nuspec.New()
+	nsf.Xmlns = ""
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	// Treat any declared encoding as UTF-8 compatible
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var stack []string
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if len(stack) == 1 && t.Name.Space != "" {
+				nsf.Xmlns = t.Name.Space
+			}
+			// Dependencies are attributes on metadata/dependencies/(group/)dependency
+			if t.Name.Local == "dependency" && len(stack) > 2 && stack[1] == "metadata" {
+				dep := nuspec.Dependency{}
+				for _, a := range t.Attr {
+					switch a.Name.Local {
+					case "id":
+						dep.ID = a.Value
+					case "version":
+						dep.Version = a.Value
+					}
+				}
+				nsf.Meta.Dependencies.Dependency = append(nsf.Meta.Dependencies.Dependency, dep)
+			}
+			if t.Name.Local == "license" && len(stack) == 3 && stack[1] == "metadata" {
+				for _, a := range t.Attr {
+					if a.Name.Local == "type" {
+						nsf.Meta.License.Type = a.Value
+					}
+				}
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			// Only direct children of package/metadata are of interest
+			if len(stack) != 3 || stack[1] != "metadata" {
+				continue
+			}
+			v := strings.TrimSpace(string(t))
+			m := &nsf.Meta
+			switch stack[2] {
+			case "id":
+				m.ID = v
+			case "version":
+				m.Version = v
+			case "title":
+				m.Title = v
+			case "authors":
+				m.Authors = v
+			case "owners":
+				m.Owners = v
+			case "licenseUrl":
+				m.LicenseURL = v
+			case "license":
+				m.License.Text = v
+			case "projectUrl":
+				m.ProjectURL = v
+			case "iconUrl":
+				m.IconURL = v
+			case "requireLicenseAcceptance":
+				m.ReqLicenseAccept, _ = strconv.ParseBool(v)
+			case "description":
+				m.Description = v
+			case "releaseNotes":
+				m.ReleaseNotes = v
+			case "copyright":
+				m.Copyright = v
+			case "summary":
+				m.Summary = v
+			case "language":
+				m.Language = v
+			case "tags":
+				m.Tags = v
+			}
+		}
+	}
+
+	if nsf.Meta.ID == "" || nsf.Meta.Version == "" {
+		return nil, ErrNuspecMissingIdentity
+	}
+	return nsf, nil
+}
+
+// nuspecClient is what a nuspec asks of clients installing it, which go-nuspec
+// doesn't read
+type nuspecClient struct {
+	Meta struct {
+		MinClientVersion      string `xml:"minClientVersion,attr"`
+		DevelopmentDependency string `xml:"developmentDependency"`
+	} `xml:"metadata"`
+}
+
+// nuspecClientDetails returns a nuspec's minClientVersion and whether it is a
+// development dependency
+func nuspecClientDetails(b []byte) (string, bool, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var c nuspecClient
+	if err := d.Decode(&c); err != nil {
+		return "", false, err
+	}
+	dev, _ := strconv.ParseBool(strings.TrimSpace(c.Meta.DevelopmentDependency))
+	return strings.TrimSpace(c.Meta.MinClientVersion), dev, nil
+}
+
+// nuspecDependencies returns the dependencies of a nuspec in the V2
+// id:range:framework|... format, keeping the target framework of each group. A
+// group with no dependencies is listed as ::framework, as nuget.org does.
+func nuspecDependencies(b []byte) (string, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var deps []string
+	var stack []string
+	framework, empty := "", false
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if len(stack) < 3 || stack[1] != "metadata" || stack[2] != "dependencies" {
+				continue
+			}
+			switch {
+			case t.Name.Local == "group" && len(stack) == 4:
+				framework, empty = "", true
+				for _, a := range t.Attr {
+					if a.Name.Local == "targetFramework" {
+						framework = a.Value
+					}
+				}
+			case t.Name.Local == "dependency":
+				id, ver := "", ""
+				for _, a := range t.Attr {
+					switch a.Name.Local {
+					case "id":
+						id = a.Value
+					case "version":
+						ver = a.Value
+					}
+				}
+				deps = append(deps, id+":"+ver+":"+framework)
+				empty = false
+			}
+		case xml.EndElement:
+			if t.Name.Local == "group" && len(stack) == 4 && stack[2] == "dependencies" {
+				if empty && framework != "" {
+					deps = append(deps, "::"+framework)
+				}
+				framework, empty = "", false
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return strings.Join(deps, "|"), nil
+}
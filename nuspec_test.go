@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Nuspecs as vendors' tools write them, see testdata/nuspec
+func readNuspecFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "nuspec", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// nuspecPackage builds a nupkg holding a nuspec as it is
+func nuspecPackage(t *testing.T, name string, nuspec []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(nuspec)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseNuspec(t *testing.T) {
+	for _, tc := range []struct {
+		file    string
+		id      string
+		version string
+		authors string
+	}{
+		{"utf8-bom.nuspec", "Vendor.Bom", "1.2.0", "Vendor A"},
+		{"namespace-2013.nuspec", "Vendor.Schema2013", "3.0.1", "Vendor B"},
+		{"utf16.nuspec", "Vendor.Utf16", "1.0.0", "Vendor C"},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			nsf, err := parseNuspec(readNuspecFixture(t, tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nsf.Meta.ID != tc.id || nsf.Meta.Version != tc.version || nsf.Meta.Authors != tc.authors {
+				t.Errorf("got %q %q by %q, want %q %q by %q", nsf.Meta.ID, nsf.Meta.Version, nsf.Meta.Authors, tc.id, tc.version, tc.authors)
+			}
+		})
+	}
+
+	if _, err := parseNuspec(readNuspecFixture(t, "no-version.nuspec")); err == nil {
+		t.Error("nuspec without a version was accepted")
+	}
+}
+
+// Packages from the vendors' tools are stored and served like any other
+func TestPushUnusualNuspecs(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for file, entry := range map[string]string{
+		"utf8-bom.nuspec":       "Packages(Id='Vendor.Bom',Version='1.2.0')",
+		"namespace-2013.nuspec": "Packages(Id='Vendor.Schema2013',Version='3.0.1')",
+	} {
+		ts.mustPush(t, nuspecPackage(t, "package.nuspec", readNuspecFixture(t, file)))
+		status, body := ts.get(t, entry)
+		wantStatus(t, file, status, body, http.StatusOK)
+	}
+
+	status, body := ts.get(t, "Packages(Id='Vendor.Schema2013',Version='3.0.1')")
+	wantStatus(t, "entry", status, body, http.StatusOK)
+	if got := between(body, "<d:Dependencies>", "</d:Dependencies>"); got != "Newtonsoft.Json:6.0.8:net45" {
+		t.Errorf("dependencies %q, want those of the 2013 schema nuspec", got)
+	}
+
+	status, body = ts.push(t, nuspecPackage(t, "package.nuspec", readNuspecFixture(t, "no-version.nuspec")))
+	wantStatus(t, "push without a version", status, body, http.StatusBadRequest)
+}
+
+// A push whose id or version isn't one NuGet accepts is refused before anything is
+// written, as they name the package's files
+func TestPushInvalidIdentity(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, tc := range []struct{ id, ver string }{
+		{"../../escape", "1.0.0"},
+		{"..", "1.0.0"},
+		{"Sub/Dir", "1.0.0"},
+		{`Back\Slash`, "1.0.0"},
+		{"Has Space", "1.0.0"},
+		{".Leading.Dot", "1.0.0"},
+		{strings.Repeat("A", 101), "1.0.0"},
+		{"Valid.Id", "../../1.0.0"},
+		{"Valid.Id", "1.0.0/x"},
+		{"Valid.Id", "one"},
+	} {
+		// Named package.nuspec, as the id can't name it
+		pkg := nuspecPackage(t, "package.nuspec", []byte(`<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://schemas.microsoft.com/packaging/2010/07/nuspec.xsd">
+  <metadata>
+    <id>`+tc.id+`</id>
+    <version>`+tc.ver+`</version>
+    <authors>Tester</authors>
+    <description>Invalid identity</description>
+  </metadata>
+</package>`))
+		status, body := ts.push(t, pkg)
+		wantStatus(t, tc.id+" "+tc.ver, status, body, http.StatusBadRequest)
+		if !strings.Contains(body, ErrInvalidPackageIdentity.Error()) {
+			t.Errorf("%s %s: got %q", tc.id, tc.ver, body)
+		}
+		// The store refuses it too, whoever calls it
+		if _, err := server.fs.StorePackage(context.Background(), pkg); !errors.Is(err, ErrInvalidPackageIdentity) {
+			t.Errorf("%s %s: stored with %v", tc.id, tc.ver, err)
+		}
+	}
+	for _, p := range []string{filepath.Join(ts.Root, "..", "escape"), filepath.Join(ts.Root, "..", "..", "escape")} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was written: %v", p, err)
+		}
+	}
+	status, body := ts.get(t, "Packages()")
+	wantStatus(t, "feed", status, body, http.StatusOK)
+	if ids := feedIDs(t, body); len(ids) != 0 {
+		t.Errorf("feed has %v, want nothing stored", ids)
+	}
+
+	// Dashes, underscores and a longest id are fine
+	ts.mustPush(t, testPackage(t, "Vendor_Name.Some-Pkg", "1.0.0-beta.1+build", "", nil))
+	ts.mustPush(t, testPackage(t, strings.Repeat("A", 100), "1.0", "", nil))
+}
+
+// The text of unicode.nuspec, Japanese with emoji: joined by zero width joiners,
+// with skin tones and variation selectors, and outside the BMP
+const (
+	unicodeTitle        = "会議室コントロール 🎛️"
+	unicodeAuthors      = "山田 太郎"
+	unicodeSummary      = "会議室の照明と音響を制御します 💡🔊"
+	unicodeDescription  = "日本語の説明です。絵文字 👩‍💻 と 👍🏽、半角ｶﾅ、そして 𠮷野家 も含みます。"
+	unicodeReleaseNotes = "初版リリース 🎉 — 不具合を修正しました"
+	unicodeTags         = "会議室 照明 🎛️"
+)
+
+// Japanese and emoji metadata is served byte for byte as pushed, by the feed in
+// XML and JSON and by the UI, and the nuspec is kept as it was
+func TestUnicodeMetadata(t *testing.T) {
+	ts := newTestServer(t, nil)
+	nuspec := readNuspecFixture(t, "unicode.nuspec")
+	ts.mustPush(t, nuspecPackage(t, "Vendor.Nihongo.nuspec", nuspec))
+
+	v4 := http.Header{"Accept": {"application/json;odata.metadata=minimal"}}
+	for _, tc := range []struct {
+		p           string
+		header      http.Header
+		contentType string
+		prefix      string
+		want        []string
+	}{
+		{p: "Packages(Id='Vendor.Nihongo',Version='1.0.0')", contentType: "application/atom+xml;type=feed;charset=utf-8", prefix: `<?xml version="1.0" encoding="utf-8"?>` + "\n", want: []string{
+			`<title type="Text">` + unicodeTitle + `</title>`,
+			`<summary type="Text">` + unicodeSummary + `</summary>`,
+			`<name>` + unicodeAuthors + `</name>`,
+			`<d:Description>` + unicodeDescription + `</d:Description>`,
+			`<d:ReleaseNotes m:null="false">` + unicodeReleaseNotes + `</d:ReleaseNotes>`,
+			`<d:Tags>` + unicodeTags + `</d:Tags>`,
+		}},
+		{p: "FindPackagesById()?id='Vendor.Nihongo'", contentType: "application/atom+xml;type=feed;charset=utf-8", prefix: `<?xml version="1.0" encoding="utf-8"?>` + "\n", want: []string{
+			`<d:Description>` + unicodeDescription + `</d:Description>`,
+		}},
+		{p: "Packages()?$format=json", contentType: "application/json", prefix: "{", want: []string{
+			`"Authors":"` + unicodeAuthors + `"`,
+			`"Description":"` + unicodeDescription + `"`,
+			`"ReleaseNotes":"` + unicodeReleaseNotes + `"`,
+			`"Summary":"` + unicodeSummary + `"`,
+			`"Tags":"` + unicodeTags + `"`,
+			`"Title":"` + unicodeTitle + `"`,
+		}},
+		{p: "Packages()", header: v4, contentType: "application/json;odata.metadata=minimal", prefix: "{", want: []string{
+			`"Description":"` + unicodeDescription + `"`,
+			`"Summary":"` + unicodeSummary + `"`,
+			`"Title":"` + unicodeTitle + `"`,
+		}},
+		{p: "v3/registration/vendor.nihongo/index.json", contentType: "application/json", prefix: "{", want: []string{
+			`"description":"` + unicodeDescription + `"`,
+			`"tags":["会議室","照明","🎛️"]`,
+		}},
+		{p: "ui/Vendor.Nihongo/1.0.0", contentType: "text/html; charset=utf-8", prefix: "<!DOCTYPE html>", want: []string{
+			`<meta charset="utf-8">`,
+			`<h1>` + unicodeTitle + ` <small>1.0.0</small></h1>`,
+			`<p>` + unicodeDescription + `</p>`,
+			`<td>` + unicodeAuthors + `</td>`,
+		}},
+	} {
+		res := ts.do(t, http.MethodGet, tc.p, testReadKey, nil, tc.header)
+		contentType := res.Header.Get("Content-Type")
+		status, body := readResponse(t, res)
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		if contentType != tc.contentType {
+			t.Errorf("%s: Content-Type %q, want %q", tc.p, contentType, tc.contentType)
+		}
+		if !strings.HasPrefix(body, tc.prefix) {
+			t.Errorf("%s: starts %.60q, want %q", tc.p, body, tc.prefix)
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(body, w) {
+				t.Errorf("%s: no %s in\n%s", tc.p, w, body)
+			}
+		}
+	}
+
+	// The nuspec and package are served as pushed
+	status, body := ts.get(t, "v3-flatcontainer/vendor.nihongo/1.0.0/vendor.nihongo.1.0.0.nuspec")
+	wantStatus(t, "nuspec", status, body, http.StatusOK)
+	if body != string(nuspec) {
+		t.Errorf("nuspec served as\n%s\nwant\n%s", body, nuspec)
+	}
+	status, body = ts.get(t, "nupkg/Vendor.Nihongo/1.0.0")
+	wantStatus(t, "nupkg", status, body, http.StatusOK)
+	if body != string(nuspecPackage(t, "Vendor.Nihongo.nuspec", nuspec)) {
+		t.Error("nupkg isn't served as pushed")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// loadOpenAPI reads the OpenAPI description of the routes outside the OData feed
+// and points it at the host URL, ready to serve
+func loadOpenAPI(fn string, base string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	// Paths start with '/', so the server URL mustn't end with one
+	doc["servers"] = []map[string]string{{"url": strings.TrimSuffix(base, "/")}}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(server.OpenAPIResponse)))
+	w.Write(server.OpenAPIResponse)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A route handleRequest serves, by method and the path after the base URL
+type routedPath struct {
+	method string
+	path   string // Exact path, or prefix if prefix is set
+	prefix bool
+	suffix string // Required path suffix, if any
+}
+
+func (rp routedPath) String() string {
+	s := strings.ToUpper(rp.method) + " /" + rp.path
+	if rp.prefix {
+		s += "*"
+	}
+	return s + rp.suffix
+}
+
+// matches reports whether an OpenAPI path template is served by the route
+func (rp routedPath) matches(p string) bool {
+	p = strings.TrimPrefix(p, "/")
+	if !rp.prefix {
+		return p == rp.path
+	}
+	return strings.HasPrefix(p, rp.path) && strings.HasSuffix(p, rp.suffix)
+}
+
+// The OData feed is described by $metadata rather than the OpenAPI document
+var odataRoutes = map[string]bool{
+	"":                        true,
+	"$metadata":               true,
+	"Packages":                true,
+	"api/v2/Packages":         true,
+	"FindPackagesById":        true,
+	"api/v2/FindPackagesById": true,
+	"Search":                  true,
+	"api/v2/Search":           true,
+	"GetUpdates":              true,
+	"api/v2/GetUpdates":       true,
+}
+
+// handlerRoutes reads the routes out of handleRequest in main.go: each case of a
+// switch on the path, under the method switch or checking r.Method itself
+func handlerRoutes(t *testing.T) []routedPath {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fn *ast.FuncDecl
+	for _, d := range f.Decls {
+		if fd, ok := d.(*ast.FuncDecl); ok && fd.Name.Name == "handleRequest" {
+			fn = fd
+		}
+	}
+	if fn == nil {
+		t.Fatal("no handleRequest in main.go")
+	}
+
+	var routes []routedPath
+	var walk func(n ast.Node, methods []string)
+	walk = func(n ast.Node, methods []string) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch s := n.(type) {
+			case *ast.SwitchStmt:
+				if s.Tag != nil && exprString(s.Tag) == "r.Method" {
+					for _, c := range s.Body.List {
+						cc := c.(*ast.CaseClause)
+						var ms []string
+						for _, e := range cc.List {
+							ms = append(ms, httpMethod(e))
+						}
+						for _, st := range cc.Body {
+							walk(st, ms)
+						}
+					}
+					return false
+				}
+			case *ast.CaseClause:
+				for _, e := range s.List {
+					ms := requestMethods(e)
+					if ms == nil {
+						ms = methods
+					}
+					if rp, ok := caseRoute(e); ok {
+						for _, m := range ms {
+							rp.method = m
+							routes = append(routes, rp)
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+	walk(fn.Body, nil)
+	if len(routes) == 0 {
+		t.Fatal("no routes found in handleRequest")
+	}
+	return routes
+}
+
+// caseRoute reads the route a switch case matches, comparing the request path
+// with server.URL.Path+`...`
+func caseRoute(e ast.Expr) (routedPath, bool) {
+	var rp routedPath
+	found := false
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.BinaryExpr:
+			if x.Op == token.EQL {
+				if p, ok := basePath(x.Y); ok && isRequestPath(x.X) {
+					rp.path, found = p, true
+					return false
+				}
+			}
+		case *ast.CallExpr:
+			switch exprString(x.Fun) {
+			case "strings.HasPrefix":
+				if p, ok := basePath(x.Args[1]); ok && isRequestPath(x.Args[0]) {
+					rp.path, rp.prefix, found = p, true, true
+				}
+			case "strings.HasSuffix":
+				if s, ok := x.Args[1].(*ast.BasicLit); ok {
+					rp.suffix, _ = strconv.Unquote(s.Value)
+				}
+			}
+		}
+		return true
+	})
+	return rp, found
+}
+
+// basePath reads server.URL.Path or server.URL.Path+`literal`
+func basePath(e ast.Expr) (string, bool) {
+	if exprString(e) == "server.URL.Path" {
+		return "", true
+	}
+	b, ok := e.(*ast.BinaryExpr)
+	if !ok || b.Op != token.ADD || exprString(b.X) != "server.URL.Path" {
+		return "", false
+	}
+	lit, ok := b.Y.(*ast.BasicLit)
+	if !ok {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+// isRequestPath reports whether an expression is r.URL.Path or r.URL.String()
+func isRequestPath(e ast.Expr) bool {
+	s := exprString(e)
+	return s == "r.URL.Path" || s == "r.URL.String()"
+}
+
+// requestMethods reads the methods a case checks with r.Method == http.MethodX,
+// nil if it doesn't
+func requestMethods(e ast.Expr) []string {
+	var ms []string
+	ast.Inspect(e, func(n ast.Node) bool {
+		if b, ok := n.(*ast.BinaryExpr); ok && b.Op == token.EQL && exprString(b.X) == "r.Method" {
+			ms = append(ms, httpMethod(b.Y))
+		}
+		return true
+	})
+	return ms
+}
+
+// httpMethod names an http.MethodX constant as the OpenAPI document does, HEAD
+// being served with GET
+func httpMethod(e ast.Expr) string {
+	m := strings.ToLower(strings.TrimPrefix(exprString(e), "http.Method"))
+	if m == "head" {
+		return "get"
+	}
+	return m
+}
+
+// exprString renders the selectors and calls routes are written with
+func exprString(e ast.Expr) string {
+	switch x := e.(type) {
+	case *ast.Ident:
+		return x.Name
+	case *ast.SelectorExpr:
+		return exprString(x.X) + "." + x.Sel.Name
+	case *ast.CallExpr:
+		return exprString(x.Fun) + "()"
+	}
+	return ""
+}
+
+// Every route outside the OData feed is in the OpenAPI document, and everything
+// the document describes is routed
+func TestOpenAPICoversRoutes(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("templates", "openapi.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	routes := handlerRoutes(t)
+
+	var missing []string
+	for _, rp := range routes {
+		if rp.method == "get" && odataRoutes[rp.path] {
+			continue
+		}
+		found := false
+		for p, ops := range doc.Paths {
+			if _, ok := ops[rp.method]; ok && rp.matches(p) {
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, rp.String())
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Errorf("routes missing from templates/openapi.json:\n%s", strings.Join(missing, "\n"))
+	}
+
+	var unrouted []string
+	for p, ops := range doc.Paths {
+		for m := range ops {
+			found := false
+			for _, rp := range routes {
+				if rp.method == m && rp.matches(p) {
+					found = true
+				}
+			}
+			if !found {
+				unrouted = append(unrouted, strings.ToUpper(m)+" "+p)
+			}
+		}
+	}
+	sort.Strings(unrouted)
+	if len(unrouted) > 0 {
+		t.Errorf("paths in templates/openapi.json handleRequest doesn't route:\n%s", strings.Join(unrouted, "\n"))
+	}
+}
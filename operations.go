@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long read paths wait on the store lock before answering 503, unless configured
+const defaultReadLockTimeout = 2 * time.Second
+
+// Retry-After sent when no running operation can estimate when it'll finish
+const defaultRetryAfter = 5 * time.Second
+
+// operation is a long running admin task such as a reindex. Progress is counted in
+// whatever steps the task has (packages, IDs) against Total, if known.
+type operation struct {
+	done     int64     // accessed atomically, kept first for alignment
+	ID       int64     `json:"id"`
+	Name     string    `json:"name"`
+	Started  time.Time `json:"started"`
+	Total    int64     `json:"total"`
+	Done     int64     `json:"done"`
+	Estimate string    `json:"estimatedRemaining,omitempty"`
+	registry *operationRegistry
+}
+
+// Step records progress through the operation
+func (op *operation) Step() {
+	if op == nil {
+		return
+	}
+	atomic.AddInt64(&op.done, 1)
+}
+
+// Finish removes the operation from the registry
+func (op *operation) Finish() {
+	if op == nil {
+		return
+	}
+	op.registry.lock.Lock()
+	defer op.registry.lock.Unlock()
+	delete(op.registry.running, op.ID)
+}
+
+// remaining estimates how long the operation has left from its rate so far
+func (op *operation) remaining(now time.Time) (time.Duration, bool) {
+	done := atomic.LoadInt64(&op.done)
+	if op.Total <= 0 || done <= 0 {
+		return 0, false
+	}
+	if done >= op.Total {
+		return 0, true
+	}
+	elapsed := now.Sub(op.Started)
+	return time.Duration(float64(elapsed) * float64(op.Total-done) / float64(done)), true
+}
+
+// operationRegistry holds the operations currently running
+type operationRegistry struct {
+	lock    sync.Mutex
+	nextID  int64
+	running map[int64]*operation
+}
+
+func newOperationRegistry() *operationRegistry {
+	return &operationRegistry{running: make(map[int64]*operation)}
+}
+
+// Start registers a new operation, total is 0 if the number of steps isn't known.
+// Callers must Finish it.
+func (or *operationRegistry) Start(name string, total int) *operation {
+	if or == nil {
+		return nil
+	}
+	or.lock.Lock()
+	defer or.lock.Unlock()
+	or.nextID++
+	op := &operation{
+		ID:       or.nextID,
+		Name:     name,
+		Started:  time.Now().UTC(),
+		Total:    int64(total),
+		registry: or,
+	}
+	or.running[op.ID] = op
+	return op
+}
+
+// List returns a copy of the running operations, oldest first
+func (or *operationRegistry) List() []operation {
+	or.lock.Lock()
+	defer or.lock.Unlock()
+	now := time.Now()
+	list := []operation{}
+	for _, op := range or.running {
+		c := *op
+		c.Done = atomic.LoadInt64(&op.done)
+		if d, ok := op.remaining(now); ok {
+			c.Estimate = d.Round(time.Second).String()
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// RetryAfter estimates when the store will be free again from the slowest running
+// operation, falling back to defaultRetryAfter
+func (or *operationRegistry) RetryAfter() time.Duration {
+	or.lock.Lock()
+	defer or.lock.Unlock()
+	now := time.Now()
+	var longest time.Duration
+	known := false
+	for _, op := range or.running {
+		if d, ok := op.remaining(now); ok {
+			known = true
+			if d > longest {
+				longest = d
+			}
+		}
+	}
+	if !known {
+		return defaultRetryAfter
+	}
+	return longest
+}
+
+// readLockTimeout returns how long read paths wait on the store, 0 meaning forever
+func readLockTimeout(c *Config) time.Duration {
+	if c == nil || c.ReadLockTimeout == "" {
+		return defaultReadLockTimeout
+	}
+	d, err := time.ParseDuration(c.ReadLockTimeout)
+	if err != nil {
+		return defaultReadLockTimeout
+	}
+	return d
+}
+
+// validateReadLockTimeout checks the read-lock-timeout config
+func validateReadLockTimeout(c *Config) error {
+	if c.ReadLockTimeout == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(c.ReadLockTimeout); err != nil || d < 0 {
+		return errors.New("read-lock-timeout is not a valid duration: " + c.ReadLockTimeout)
+	}
+	return nil
+}
+
+// acquireWithin calls lock, giving up with ErrBusy after d (0 waits as long as the
+// context allows) or with the context's error if it ends first. If the lock is only
+// acquired after giving up it is released again straight away.
+func acquireWithin(ctx context.Context, lock func(), unlock func(), d time.Duration) error {
+	acquired := make(chan struct{})
+	abandoned := make(chan struct{})
+	go func() {
+		lock()
+		select {
+		case acquired <- struct{}{}:
+		case <-abandoned:
+			unlock()
+		}
+	}()
+
+	var timeout <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-acquired:
+		return nil
+	case <-timeout:
+		close(abandoned)
+		return ErrBusy
+	case <-ctx.Done():
+		close(abandoned)
+		return ctx.Err()
+	}
+}
+
+// writeBusy answers 503 with a Retry-After estimated from the running operations
+func writeBusy(w http.ResponseWriter) {
+	d := defaultRetryAfter
+	if server != nil {
+		d = server.operations.RetryAfter()
+	}
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func serveOperations(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(server.operations.List())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Feed reads stuck behind a held write lock give up with a 503 and a Retry-After
+// estimated from the running operation
+func TestBusyRetryAfter(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.ReadLockTimeout = "100ms" })
+	ts.mustPush(t, testPackage(t, "Busy.Pkg", "1.0.0", "", nil))
+	src, _, _ := server.migration.stores()
+	local := src.(*fileStoreLocal)
+
+	// Half way through after ten seconds, so about ten to go
+	op := server.operations.Start("reindex", 10)
+	op.Started = time.Now().Add(-10 * time.Second)
+	for i := 0; i < 5; i++ {
+		op.Step()
+	}
+
+	local.lock.Lock()
+	var unlock sync.Once
+	defer unlock.Do(local.lock.Unlock)
+	for _, p := range []string{"Packages()", "FindPackagesById()?id='Busy.Pkg'"} {
+		start := time.Now()
+		res := ts.do(t, http.MethodGet, p, testReadKey, nil, nil)
+		status, body := readResponse(t, res)
+		wantStatus(t, p+" while busy", status, body, http.StatusServiceUnavailable)
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: answered after %v, want about the 100ms timeout", p, d)
+		}
+		if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err != nil || secs < 9 || secs > 11 {
+			t.Errorf("%s: Retry-After %q, want about 10", p, res.Header.Get("Retry-After"))
+		}
+	}
+
+	// The admin endpoint doesn't wait on the store
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "admin/operations", testWriteKey, nil, nil))
+	wantStatus(t, "admin/operations", status, body, http.StatusOK)
+	var ops []operation
+	if err := json.Unmarshal([]byte(body), &ops); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Name != "reindex" || ops[0].Done != 5 || ops[0].Total != 10 || ops[0].Estimate == "" {
+		t.Errorf("operations %s", body)
+	}
+
+	unlock.Do(local.lock.Unlock)
+	status, body = ts.get(t, "Packages()")
+	wantStatus(t, "Packages() after", status, body, http.StatusOK)
+	op.Finish()
+	if _, body := readResponse(t, ts.do(t, http.MethodGet, "admin/operations", testWriteKey, nil, nil)); body != "[]" {
+		t.Errorf("operations after finishing: %s", body)
+	}
+}
+
+func TestRetryAfterEstimate(t *testing.T) {
+	or := newOperationRegistry()
+	if d := or.RetryAfter(); d != defaultRetryAfter {
+		t.Errorf("nothing running: %v, want %v", d, defaultRetryAfter)
+	}
+	unknown := or.Start("import", 0)
+	unknown.Step()
+	if d := or.RetryAfter(); d != defaultRetryAfter {
+		t.Errorf("no total: %v, want %v", d, defaultRetryAfter)
+	}
+
+	// The slowest operation decides
+	fast := or.Start("reindex", 4)
+	fast.Started = time.Now().Add(-3 * time.Second)
+	fast.Step()
+	fast.Step()
+	fast.Step()
+	slow := or.Start("migrate", 4)
+	slow.Started = time.Now().Add(-30 * time.Second)
+	slow.Step()
+	if d := or.RetryAfter(); d < 89*time.Second || d > 91*time.Second {
+		t.Errorf("RetryAfter %v, want about 90s", d)
+	}
+	slow.Finish()
+	if d := or.RetryAfter(); d < 900*time.Millisecond || d > 1100*time.Millisecond {
+		t.Errorf("RetryAfter %v after the slow one finished, want about 1s", d)
+	}
+}
+
+func TestAcquireWithin(t *testing.T) {
+	var mu sync.Mutex
+	if err := acquireWithin(context.Background(), mu.Lock, mu.Unlock, time.Second); err != nil {
+		t.Fatalf("free lock: %v", err)
+	}
+	if err := acquireWithin(context.Background(), mu.Lock, mu.Unlock, 50*time.Millisecond); err != ErrBusy {
+		t.Errorf("held lock: got %v, want ErrBusy", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := acquireWithin(ctx, mu.Lock, mu.Unlock, 0); err != context.Canceled {
+		t.Errorf("cancelled: got %v", err)
+	}
+
+	// Once released, a waiter that gave up hands the lock straight back
+	mu.Unlock()
+	if err := acquireWithin(context.Background(), mu.Lock, mu.Unlock, time.Second); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// feedOrderKey is one property of a $orderby, e.g. "DownloadCount desc"
+type feedOrderKey struct {
+	Property string
+	Desc     bool
+}
+
+// feedOrder is a parsed $orderby, its keys in the order they break ties. Empty is
+// the default order, newest published first.
+type feedOrder []feedOrderKey
+
+// Properties a feed can be ordered by, by their lower case names
+var feedOrderProperties = map[string]string{
+	"id":            "Id",
+	"version":       "Version",
+	"published":     "Published",
+	"downloadcount": "DownloadCount",
+}
+
+// parseFeedOrder reads a $orderby such as "DownloadCount desc,Id". Anything it
+// doesn't understand, a property or a direction, gives the default order.
+func parseFeedOrder(orderBy string) feedOrder {
+	var o feedOrder
+	for _, c := range strings.Split(orderBy, ",") {
+		x := strings.Fields(c)
+		if len(x) == 0 || len(x) > 2 {
+			return nil
+		}
+		p, ok := feedOrderProperties[strings.ToLower(x[0])]
+		if !ok {
+			return nil
+		}
+		k := feedOrderKey{Property: p}
+		if len(x) == 2 {
+			switch strings.ToLower(x[1]) {
+			case "asc":
+			case "desc":
+				k.Desc = true
+			default:
+				return nil
+			}
+		}
+		o = append(o, k)
+	}
+	return o
+}
+
+// compare orders two entries by one key, ascending
+func (k feedOrderKey) compare(a *NugetPackageEntry, b *NugetPackageEntry) int {
+	switch k.Property {
+	case "Id":
+		return strings.Compare(strings.ToLower(a.Properties.ID), strings.ToLower(b.Properties.ID))
+	case "Version":
+		return versions.Compare(a.Properties.Version, b.Properties.Version)
+	case "Published":
+		pa, pb := a.Properties.Published.Value, b.Properties.Published.Value
+		switch {
+		case pa.Before(pb):
+			return -1
+		case pb.Before(pa):
+			return 1
+		}
+	case "DownloadCount":
+		return a.Properties.DownloadCount.Value - b.Properties.DownloadCount.Value
+	}
+	return 0
+}
+
+// sortFeedEntries sorts entries in the order asked for. Ties are broken by ID and
+// then version, so every entry has one place and a page continuing after it
+// starts in the same place each time.
+func sortFeedEntries(entries []*NugetPackageEntry, o feedOrder) {
+	if len(o) == 0 {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[j].Properties.Published.Value.Before(entries[i].Properties.Published.Value)
+		})
+		return
+	}
+	keys := append(append(feedOrder{}, o...), feedOrderKey{Property: "Id"}, feedOrderKey{Property: "Version"})
+	sort.SliceStable(entries, func(i, j int) bool {
+		for _, k := range keys {
+			c := k.compare(entries[i], entries[j])
+			if k.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// isFeedPosition reports whether a skip token's "{id}.{version}" names the entry,
+// however either wrote the version
+func isFeedPosition(p *NugetPackageEntry, token string) bool {
+	id := p.Properties.ID
+	if len(token) <= len(id) || !strings.EqualFold(token[:len(id)], id) || token[len(id)] != '.' {
+		return false
+	}
+	return versions.Equal(token[len(id)+1:], p.Properties.Version)
+}
+
+// pageFeedEntries returns up to max of sorted entries, after the one startAfter
+// names if set, and whether more follow
+func pageFeedEntries(entries []*NugetPackageEntry, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+	start := 0
+	if startAfter != "" {
+		start = -1
+		for i, e := range entries {
+			if isFeedPosition(e, startAfter) {
+				start = i + 1
+				break
+			}
+		}
+		// Starting again at the top would repeat what the client already has
+		if start < 0 {
+			return nil, false, ErrStartAfterGone
+		}
+	}
+	end := start + max
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[start:end], end < len(entries), nil
+}
+
+type feedOrderContextKey struct{}
+
+// withFeedOrder returns a context whose feed reads are in the order given
+func withFeedOrder(ctx context.Context, o feedOrder) context.Context {
+	return context.WithValue(ctx, feedOrderContextKey{}, o)
+}
+
+// contextFeedOrder returns the order feed reads in a context are in, empty for
+// the default
+func contextFeedOrder(ctx context.Context) feedOrder {
+	o, _ := ctx.Value(feedOrderContextKey{}).(feedOrder)
+	return o
+}
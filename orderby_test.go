@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFeedOrder(t *testing.T) {
+	for _, tc := range []struct {
+		orderBy string
+		want    feedOrder
+	}{
+		{"", nil},
+		{"Id", feedOrder{{Property: "Id"}}},
+		{"id asc", feedOrder{{Property: "Id"}}},
+		{"DownloadCount desc,Id", feedOrder{{Property: "DownloadCount", Desc: true}, {Property: "Id"}}},
+		{"Version DESC, published", feedOrder{{Property: "Version", Desc: true}, {Property: "Published"}}},
+		// Anything not understood is the default order
+		{"Title", nil},
+		{"Id,Title", nil},
+		{"Id sideways", nil},
+		{"Id desc extra", nil},
+		{"Id,", nil},
+	} {
+		if got := parseFeedOrder(tc.orderBy); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %+v, want %+v", tc.orderBy, got, tc.want)
+		}
+	}
+}
+
+// Feeds are sorted by $orderby, ties broken by ID and version, and paging through
+// them gives every entry once in that order
+func TestFeedOrderRoutes(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxPageSize = 2 })
+	for _, v := range []string{"Order.A 1.0.0", "Order.A 1.10.0", "Order.A 1.2.0", "Order.A 2.0.0-beta", "Order.B 1.0.0", "Order.C 0.5.0"} {
+		x := strings.Fields(v)
+		ts.mustPush(t, testPackage(t, x[0], x[1], "", nil))
+	}
+	// Order.A is downloaded twice and Order.B once
+	for _, p := range []string{"nupkg/Order.A/1.0.0", "nupkg/Order.A/1.2.0", "nupkg/Order.B/1.0.0"} {
+		status, body := ts.get(t, p)
+		wantStatus(t, p, status, body, http.StatusOK)
+	}
+	server.downloads.Close()
+
+	all := func(p string) []string {
+		t.Helper()
+		pages, _ := feedPages(t, ts, p)
+		var ids []string
+		for _, page := range pages {
+			ids = append(ids, page...)
+		}
+		return ids
+	}
+	byID := []string{"Order.A 1.0.0", "Order.A 1.2.0", "Order.A 1.10.0", "Order.A 2.0.0-beta", "Order.B 1.0.0", "Order.C 0.5.0"}
+	for _, tc := range []struct {
+		p    string
+		want []string
+	}{
+		{"Packages()?$orderby=Id", byID},
+		{"Packages()?$orderby=id asc", byID},
+		{"Packages()?$orderby=Id desc", []string{"Order.C 0.5.0", "Order.B 1.0.0", "Order.A 1.0.0", "Order.A 1.2.0", "Order.A 1.10.0", "Order.A 2.0.0-beta"}},
+		{"Packages()?$orderby=Version", []string{"Order.C 0.5.0", "Order.A 1.0.0", "Order.B 1.0.0", "Order.A 1.2.0", "Order.A 1.10.0", "Order.A 2.0.0-beta"}},
+		{"Packages()?$orderby=Version desc,Id desc", []string{"Order.A 2.0.0-beta", "Order.A 1.10.0", "Order.A 1.2.0", "Order.B 1.0.0", "Order.A 1.0.0", "Order.C 0.5.0"}},
+		{"Packages()?$orderby=DownloadCount desc", byID},
+		{"Packages()?$orderby=DownloadCount", []string{"Order.C 0.5.0", "Order.B 1.0.0", "Order.A 1.0.0", "Order.A 1.2.0", "Order.A 1.10.0", "Order.A 2.0.0-beta"}},
+		{"Packages()?$orderby=DownloadCount desc,Version desc", []string{"Order.A 2.0.0-beta", "Order.A 1.10.0", "Order.A 1.2.0", "Order.A 1.0.0", "Order.B 1.0.0", "Order.C 0.5.0"}},
+		{"Packages()?$orderby=Id&$skip=0", byID},
+		{"FindPackagesById()?id='Order.A'&$orderby=Version desc", []string{"Order.A 2.0.0-beta", "Order.A 1.10.0", "Order.A 1.2.0", "Order.A 1.0.0"}},
+	} {
+		if got := all(tc.p); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.p, got, tc.want)
+		}
+	}
+
+	// An order that isn't understood is the default one
+	def := all("Packages()")
+	if len(def) != len(byID) {
+		t.Fatalf("Packages(): got %q", def)
+	}
+	for _, p := range []string{"Packages()?$orderby=Title", "Packages()?$orderby=Id sideways", "Packages()?$orderby=Id,Title"} {
+		if got := all(p); !reflect.DeepEqual(got, def) {
+			t.Errorf("%s: got %q, want the default %q", p, got, def)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Default size the package cache is kept under
+const defaultCacheMaxBytes = 1024 * 1024 * 1024
+
+// cachedPackage is a nupkg held in the cache directory
+type cachedPackage struct {
+	key  string
+	path string
+	size int64
+	hash string
+}
+
+// cacheStats are the package cache's counters, as served by admin/cache
+type cacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+	MaxBytes      int64  `json:"maxBytes"`
+}
+
+// cachedFileStore is a read-through cache of nupkgs on local disk in front of a
+// remote FileStore. Downloads are served from the cache when its copy still has the
+// hash the store records for the version, fetched and kept otherwise. Pushes are
+// written through. The least recently used packages are evicted to stay under the
+// size bound. Everything else goes straight to the remote store.
+type cachedFileStore struct {
+	fileStore
+	dir string
+	max int64
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	size    int64
+
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	invalidations uint64
+}
+
+// newCachedFileStore puts a cache in dir in front of fs, picking up the packages
+// already in dir from before a restart
+func newCachedFileStore(fs fileStore, dir string, max int64) (*cachedFileStore, error) {
+	if max <= 0 {
+		max = defaultCacheMaxBytes
+	}
+	c := &cachedFileStore{
+		fileStore: fs,
+		dir:       dir,
+		max:       max,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := c.scan(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// scan loads the cache index from the cache directory, most recently used last by
+// modification time, which hits update
+func (c *cachedFileStore) scan() error {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.nupkg"))
+	if err != nil {
+		return err
+	}
+	type found struct {
+		path string
+		mod  time.Time
+	}
+	var list []found
+	for _, p := range files {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		list = append(list, found{p, fi.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].mod.Before(list[j].mod) })
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, f := range list {
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			continue
+		}
+		h := sha512.Sum512(b)
+		key := strings.TrimSuffix(filepath.Base(f.path), ".nupkg")
+		c.entries[key] = c.lru.PushFront(&cachedPackage{key: key, path: f.path, size: int64(len(b)), hash: hex.EncodeToString(h[:])})
+		c.size += int64(len(b))
+	}
+	c.evict()
+	log.Printf("Package cache loaded with %d packages, %d bytes", len(c.entries), c.size)
+	return nil
+}
+
+// cacheKey names a version in the cache, ignoring case and normalization
+func cacheKey(id string, ver string) string {
+	return strings.ToLower(id) + "." + versions.Key(ver)
+}
+
+// lookup opens the cached copy of a version if its hash is the one wanted. A copy
+// with any other hash is out of date and dropped.
+func (c *cachedFileStore) lookup(key string, hash string) *packageFile {
+	c.lock.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil
+	}
+	cp := el.Value.(*cachedPackage)
+	if hash != "" && !strings.EqualFold(cp.hash, hash) {
+		c.remove(el)
+		c.lock.Unlock()
+		atomic.AddUint64(&c.invalidations, 1)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	c.lock.Unlock()
+
+	f, err := openPackageFile(cp.path, "application/octet-stream")
+	if err != nil {
+		c.lock.Lock()
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+		c.lock.Unlock()
+		return nil
+	}
+	// Keep recency across restarts
+	now := time.Now()
+	os.Chtimes(cp.path, now, now)
+	return f
+}
+
+// add keeps a package in the cache, evicting others to make room. Packages bigger
+// than the whole cache aren't kept.
+func (c *cachedFileStore) add(key string, b []byte) {
+	if int64(len(b)) > c.max {
+		return
+	}
+	h := sha512.Sum512(b)
+	p := filepath.Join(c.dir, key+".nupkg")
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.Println("Package cache: could not write", key, err)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		log.Println("Package cache: could not write", key, err)
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*cachedPackage).size
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cachedPackage{key: key, path: p, size: int64(len(b)), hash: hex.EncodeToString(h[:])})
+	c.size += int64(len(b))
+	c.evict()
+}
+
+// evict drops least recently used packages until the cache is under its bound.
+// The lock must be held.
+func (c *cachedFileStore) evict() {
+	for c.size > c.max {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		c.remove(el)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// remove drops a package from the cache. The lock must be held.
+func (c *cachedFileStore) remove(el *list.Element) {
+	cp := el.Value.(*cachedPackage)
+	c.lru.Remove(el)
+	delete(c.entries, cp.key)
+	c.size -= cp.size
+	if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+		log.Println("Package cache: could not remove", cp.key, err)
+	}
+}
+
+// Stats returns the cache's counters and current size
+func (c *cachedFileStore) Stats() cacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return cacheStats{
+		Hits:          atomic.LoadUint64(&c.hits),
+		Misses:        atomic.LoadUint64(&c.misses),
+		Evictions:     atomic.LoadUint64(&c.evictions),
+		Invalidations: atomic.LoadUint64(&c.invalidations),
+		Entries:       len(c.entries),
+		Bytes:         c.size,
+		MaxBytes:      c.max,
+	}
+}
+
+// open opens a version's nupkg in the cache, or reads it from the remote store and
+// keeps it. The copy is checked against the hash the store records, so the cache
+// follows the store if a version is replaced and never keeps a corrupt download.
+func (c *cachedFileStore) open(ctx context.Context, id string, ver string) (*packageFile, error) {
+	hash := ""
+	if npe, err := c.fileStore.GetPackageEntry(ctx, id, ver); err == nil {
+		hash = npe.Properties.PackageHash
+	} else if err != ErrFileNotFound {
+		return nil, err
+	}
+
+	key := cacheKey(id, ver)
+	if f := c.lookup(key, hash); f != nil {
+		atomic.AddUint64(&c.hits, 1)
+		return f, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	b, err := c.fileStore.ReadPackageFile(ctx, id, ver)
+	if err != nil {
+		return nil, err
+	}
+	h := sha512.Sum512(b)
+	if hash == "" || !strings.EqualFold(hex.EncodeToString(h[:]), hash) {
+		log.Println("Package cache: not keeping", id, ver, "as it doesn't match the recorded hash")
+	} else {
+		c.add(key, b)
+	}
+	return bytesPackageFile(b, time.Time{}, "application/octet-stream"), nil
+}
+
+// GetPackageFile streams a cached copy from disk
+func (c *cachedFileStore) GetPackageFile(ctx context.Context, id string, ver string) (*packageFile, error) {
+	return c.open(ctx, id, ver)
+}
+
+func (c *cachedFileStore) ReadPackageFile(ctx context.Context, id string, ver string) ([]byte, error) {
+	f, err := c.open(ctx, id, ver)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (c *cachedFileStore) StorePackage(ctx context.Context, pkg []byte) (bool, error) {
+	exists, err := c.fileStore.StorePackage(ctx, pkg)
+	if err != nil {
+		return exists, err
+	}
+	if nsf, err := readNuspec(pkg); err == nil {
+		c.add(cacheKey(nsf.Meta.ID, nsf.Meta.Version), pkg)
+	}
+	return exists, nil
+}
+
+func serveCacheStats(w http.ResponseWriter, r *http.Request) {
+	if server.cache == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(server.cache.Stats())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowFileStore stands in for a remote store far away, counting the nupkgs read
+// from it
+type slowFileStore struct {
+	fileStore
+	delay time.Duration
+	reads int64
+}
+
+func (s *slowFileStore) ReadPackageFile(ctx context.Context, id string, ver string) ([]byte, error) {
+	atomic.AddInt64(&s.reads, 1)
+	time.Sleep(s.delay)
+	return s.fileStore.ReadPackageFile(ctx, id, ver)
+}
+
+// newCacheTest pushes the packages to a test server and puts a cache of max bytes
+// in front of a slow copy of its store
+func newCacheTest(t *testing.T, max int64, pkgs ...[]byte) (*testServer, *slowFileStore, *cachedFileStore) {
+	t.Helper()
+	ts := newTestServer(t, nil)
+	for _, pkg := range pkgs {
+		ts.mustPush(t, pkg)
+	}
+	slow := &slowFileStore{fileStore: server.fs, delay: 50 * time.Millisecond}
+	c, err := newCachedFileStore(slow, filepath.Join(ts.Dir, "cache"), max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts, slow, c
+}
+
+// timedRead reads a version through the cache, returning how long it took
+func timedRead(t *testing.T, c *cachedFileStore, id string, ver string, want []byte) time.Duration {
+	t.Helper()
+	start := time.Now()
+	b, err := c.ReadPackageFile(context.Background(), id, ver)
+	if err != nil {
+		t.Fatalf("read %s %s: %v", id, ver, err)
+	}
+	if string(b) != string(want) {
+		t.Fatalf("read %s %s: wrong content", id, ver)
+	}
+	return time.Since(start)
+}
+
+func TestPackageCacheHit(t *testing.T) {
+	pkg := testPackage(t, "Cache.Pkg", "1.0.0", "", nil)
+	_, slow, c := newCacheTest(t, 0, pkg)
+
+	if d := timedRead(t, c, "Cache.Pkg", "1.0.0", pkg); d < slow.delay {
+		t.Errorf("first read took %v, quicker than the store", d)
+	}
+	// Any case or normalization of the version is the same entry
+	for _, ver := range []string{"1.0.0", "1.0", "1.0.0.0"} {
+		if d := timedRead(t, c, "cache.pkg", ver, pkg); d >= slow.delay {
+			t.Errorf("read %s took %v, no quicker than the store", ver, d)
+		}
+	}
+	if n := atomic.LoadInt64(&slow.reads); n != 1 {
+		t.Errorf("store read %d times, want 1", n)
+	}
+	s := c.Stats()
+	if s.Hits != 3 || s.Misses != 1 || s.Entries != 1 || s.Bytes != int64(len(pkg)) {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestPackageCacheEviction(t *testing.T) {
+	a := testPackage(t, "Cache.A", "1.0.0", "", nil)
+	b := testPackage(t, "Cache.B", "1.0.0", "", nil)
+	d := testPackage(t, "Cache.D", "1.0.0", "", nil)
+	// Room for two of the three
+	max := int64(len(a) + len(b) + len(d)/2)
+	_, slow, c := newCacheTest(t, max, a, b, d)
+
+	timedRead(t, c, "Cache.A", "1.0.0", a)
+	timedRead(t, c, "Cache.B", "1.0.0", b)
+	// A is now more recently used than B, which goes to make room for D
+	timedRead(t, c, "Cache.A", "1.0.0", a)
+	timedRead(t, c, "Cache.D", "1.0.0", d)
+
+	s := c.Stats()
+	if s.Evictions != 1 || s.Entries != 2 || s.Bytes > max {
+		t.Errorf("stats %+v, max %d", s, max)
+	}
+	reads := atomic.LoadInt64(&slow.reads)
+	timedRead(t, c, "Cache.A", "1.0.0", a)
+	timedRead(t, c, "Cache.D", "1.0.0", d)
+	if n := atomic.LoadInt64(&slow.reads); n != reads {
+		t.Errorf("kept packages read from the store %d times", n-reads)
+	}
+	timedRead(t, c, "Cache.B", "1.0.0", b)
+	if n := atomic.LoadInt64(&slow.reads); n != reads+1 {
+		t.Errorf("evicted package read from the store %d times, want 1", n-reads)
+	}
+	files, _ := filepath.Glob(filepath.Join(c.dir, "*.nupkg"))
+	if len(files) != 2 {
+		t.Errorf("cache directory holds %v", files)
+	}
+
+	// Bigger than the whole cache is served but never kept
+	c, err := newCachedFileStore(slow, filepath.Join(filepath.Dir(c.dir), "small"), int64(len(a))-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timedRead(t, c, "Cache.A", "1.0.0", a)
+	if s := c.Stats(); s.Entries != 0 || s.Evictions != 0 {
+		t.Errorf("oversized package kept: %+v", s)
+	}
+}
+
+func TestPackageCacheRestart(t *testing.T) {
+	a := testPackage(t, "Cache.A", "1.0.0", "", nil)
+	b := testPackage(t, "Cache.B", "1.0.0", "", nil)
+	_, slow, c := newCacheTest(t, 0, a, b)
+	timedRead(t, c, "Cache.A", "1.0.0", a)
+	timedRead(t, c, "Cache.B", "1.0.0", b)
+
+	// A new cache on the same directory picks up both
+	c, err := newCachedFileStore(slow, c.dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Entries != 2 || s.Bytes != int64(len(a)+len(b)) {
+		t.Errorf("after restart, stats %+v", s)
+	}
+	reads := atomic.LoadInt64(&slow.reads)
+	timedRead(t, c, "Cache.A", "1.0.0", a)
+	timedRead(t, c, "Cache.B", "1.0.0", b)
+	if n := atomic.LoadInt64(&slow.reads); n != reads {
+		t.Errorf("store read %d times after restart, want 0", n-reads)
+	}
+}
+
+func TestPackageCacheInvalidation(t *testing.T) {
+	pkg := testPackage(t, "Cache.Pkg", "1.0.0", "", nil)
+	_, slow, c := newCacheTest(t, 0, pkg)
+
+	// A copy that isn't what the store records, as if the version were replaced
+	// upstream while the server was down
+	stale := testPackage(t, "Cache.Pkg", "1.0.0", "<title>Old</title>", nil)
+	if err := ioutil.WriteFile(filepath.Join(c.dir, cacheKey("Cache.Pkg", "1.0.0")+".nupkg"), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newCachedFileStore(slow, c.dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timedRead(t, c, "Cache.Pkg", "1.0.0", pkg)
+	if s := c.Stats(); s.Invalidations != 1 || s.Misses != 1 || s.Entries != 1 || s.Bytes != int64(len(pkg)) {
+		t.Errorf("stats %+v", s)
+	}
+	timedRead(t, c, "Cache.Pkg", "1.0.0", pkg)
+	if n := atomic.LoadInt64(&slow.reads); n != 1 {
+		t.Errorf("store read %d times, want 1", n)
+	}
+}
+
+func TestPackageCacheWriteThrough(t *testing.T) {
+	ts, slow, c := newCacheTest(t, 0)
+	server.fs = c
+	server.cache = c
+
+	pkg := testPackage(t, "Cache.Pkg", "1.0.0", "", nil)
+	ts.mustPush(t, pkg)
+	if s := c.Stats(); s.Entries != 1 {
+		t.Errorf("pushed package not cached: %+v", s)
+	}
+	status, body := ts.get(t, "nupkg/Cache.Pkg/1.0.0")
+	wantStatus(t, "download", status, body, http.StatusOK)
+	if body != string(pkg) {
+		t.Error("download has the wrong content")
+	}
+	if n := atomic.LoadInt64(&slow.reads); n != 0 {
+		t.Errorf("store read %d times, want 0", n)
+	}
+
+	// The counters are served to admins
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "admin/cache", testReadKey, nil, nil))
+	wantStatus(t, "read key", status, body, http.StatusForbidden)
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "admin/cache", testWriteKey, nil, nil))
+	wantStatus(t, "write key", status, body, http.StatusOK)
+	var s cacheStats
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Hits != 1 || s.Misses != 0 || s.Entries != 1 || s.MaxBytes != defaultCacheMaxBytes {
+		t.Errorf("admin/cache %+v", s)
+	}
+}
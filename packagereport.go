@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Most change log records included in a package report
+const maxReportChanges = 20
+
+// packageStorage describes where a stored version's nupkg and extracted content are
+type packageStorage struct {
+	Package      string `json:"package"`
+	PackageSize  int64  `json:"packageSize"`
+	ContentDir   string `json:"contentDir,omitempty"`
+	ContentFiles int    `json:"contentFiles"`
+	ContentSize  int64  `json:"contentSize"`
+}
+
+// packageReport is everything known about one package version, for support tooling.
+// Sections a store doesn't keep are left out.
+type packageReport struct {
+	ID         string                 `json:"id"`
+	Version    string                 `json:"version"`
+	Listed     bool                   `json:"listed"`
+	Owners     string                 `json:"owners,omitempty"`
+	Entry      *v4Package             `json:"entry"`
+	Storage    *packageStorage        `json:"storage,omitempty"`
+	Hash       *packageHashReport     `json:"hash"`
+	Downloads  *packageDownloadReport `json:"downloads"`
+	Extraction *extractionStatus      `json:"extraction,omitempty"`
+	Changes    []changeRecord         `json:"changes,omitempty"`
+}
+
+// packageHashReport compares the hash in the feed with the one recorded when the
+// version was stored and, when asked to verify, the hash of the file as it is now
+type packageHashReport struct {
+	Algorithm string `json:"algorithm"`
+	Feed      string `json:"feed"`
+	Recorded  string `json:"recorded,omitempty"`
+	Computed  string `json:"computed,omitempty"`
+	Matches   *bool  `json:"matches,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// packageDownloadReport is a version's download counts and statistics
+type packageDownloadReport struct {
+	Version int           `json:"version"`
+	Total   int           `json:"total"`
+	Stats   *versionStats `json:"stats,omitempty"`
+}
+
+func servePackageReport(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting admin/packages/{id}/{version}[?verify=true]
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`admin/packages`):], `/`), `/`)
+	if len(x) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	server.fs.UpdateCountsInMemory()
+	npe, err := server.fs.GetPackageEntry(r.Context(), x[0], x[1])
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	id, ver := npe.Properties.ID, npe.Properties.Version
+
+	rep := &packageReport{
+		ID:      id,
+		Version: ver,
+		Listed:  npe.Properties.Listed.Value,
+		Entry:   newV4Package(npe),
+		Hash: &packageHashReport{
+			Algorithm: npe.Properties.PackageHashAlgorithm,
+			Feed:      npe.Properties.PackageHash,
+		},
+		Downloads: &packageDownloadReport{
+			Version: npe.Properties.VersionDownloadCount.Value,
+			Total:   npe.Properties.DownloadCount.Value,
+		},
+	}
+
+	// Each remaining section is optional, a store that doesn't keep it leaves it out
+	if ps, err := server.fs.GetPackageStorage(r.Context(), id, ver); err == nil {
+		rep.Storage = ps
+	}
+	if st, err := server.fs.GetExtractionStatus(r.Context(), id, ver); err == nil {
+		rep.Extraction = st
+	}
+	for _, vs := range server.stats.forPackage(id) {
+		if versions.Equal(vs.Version, ver) {
+			vs := vs
+			rep.Downloads.Stats = &vs
+		}
+	}
+	if changes, _, _, err := server.fs.GetChanges(r.Context(), 0); err == nil {
+		for _, c := range changes {
+			if strings.EqualFold(c.ID, id) && versions.Equal(c.Version, ver) {
+				rep.Changes = append(rep.Changes, c)
+				if c.Hash != "" {
+					rep.Hash.Recorded = c.Hash
+				}
+			}
+		}
+		if len(rep.Changes) > maxReportChanges {
+			rep.Changes = rep.Changes[len(rep.Changes)-maxReportChanges:]
+		}
+	}
+
+	// Owners are only in the nuspec, and verifying means reading the package anyway
+	verify := strings.EqualFold(r.URL.Query().Get("verify"), "true")
+	pkg, err := server.fs.ReadPackageFile(r.Context(), id, ver)
+	if err == nil {
+		if nsf, err := readNuspec(pkg); err == nil {
+			rep.Owners = nsf.Meta.Owners
+		}
+		if verify {
+			h := sha512.Sum512(pkg)
+			rep.Hash.Computed = hex.EncodeToString(h[:])
+			matches := strings.EqualFold(rep.Hash.Computed, rep.Hash.Feed) &&
+				(rep.Hash.Recorded == "" || strings.EqualFold(rep.Hash.Computed, rep.Hash.Recorded))
+			rep.Hash.Matches = &matches
+		}
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if verify {
+		rep.Hash.Error = err.Error()
+	}
+
+	b, err := json.Marshal(rep)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Header of a Windows PDB, an MSF 7.0 multi-stream file
+var msfMagic = []byte("Microsoft C/C++ MSF 7.00\r\n\x1aDS\x00\x00\x00")
+
+// Header of a portable PDB, an ECMA-335 metadata root
+var portablePDBMagic = []byte("BSJB")
+
+var errNotPDB = errors.New("not a Windows or portable PDB")
+
+// pdbSignature returns the key a symbol server finds a PDB by, its GUID and age
+// as upper case hex. Portable PDBs have no age and are keyed with FFFFFFFF.
+func pdbSignature(b []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(b, msfMagic):
+		return msfSignature(b)
+	case bytes.HasPrefix(b, portablePDBMagic):
+		return portablePDBSignature(b)
+	}
+	return "", errNotPDB
+}
+
+// formatPDBGuid writes a GUID as a symbol server does, its first three fields
+// little endian, with no dashes
+func formatPDBGuid(g []byte) string {
+	le := binary.LittleEndian
+	return fmt.Sprintf("%08X%04X%04X%X", le.Uint32(g), le.Uint16(g[4:]), le.Uint16(g[6:]), g[8:16])
+}
+
+// msfSignature reads the GUID from a Windows PDB's info stream and the age from
+// its DBI stream, the age the executable records
+func msfSignature(b []byte) (string, error) {
+	le := binary.LittleEndian
+	if len(b) < 56 {
+		return "", errNotPDB
+	}
+	blockSize := int(le.Uint32(b[32:]))
+	dirBytes := int(le.Uint32(b[44:]))
+	mapAddr := int(le.Uint32(b[52:]))
+	if blockSize <= 0 || blockSize > 1<<16 || dirBytes <= 0 || dirBytes > len(b) {
+		return "", errNotPDB
+	}
+
+	// Join the blocks of a stream, given the indexes of its blocks
+	blocks := func(idx []byte, size int) ([]byte, bool) {
+		var s []byte
+		for i := 0; len(s) < size; i++ {
+			if (i+1)*4 > len(idx) {
+				return nil, false
+			}
+			off := int(le.Uint32(idx[i*4:])) * blockSize
+			if off < 0 || off+blockSize > len(b) {
+				return nil, false
+			}
+			s = append(s, b[off:off+blockSize]...)
+		}
+		return s[:size], true
+	}
+
+	// The directory lists each stream's size and then its blocks
+	n := (dirBytes + blockSize - 1) / blockSize
+	if mapAddr*blockSize+n*4 > len(b) {
+		return "", errNotPDB
+	}
+	dir, ok := blocks(b[mapAddr*blockSize:mapAddr*blockSize+n*4], dirBytes)
+	if !ok || len(dir) < 4 {
+		return "", errNotPDB
+	}
+	count := int(le.Uint32(dir))
+	if count < 4 || 4+count*4 > len(dir) {
+		return "", errNotPDB
+	}
+	stream := func(i int) ([]byte, bool) {
+		next := 4 + count*4
+		for j := 0; j < i; j++ {
+			if sz := le.Uint32(dir[4+j*4:]); sz != 0xFFFFFFFF {
+				next += (int(sz) + blockSize - 1) / blockSize * 4
+			}
+		}
+		size := int(le.Uint32(dir[4+i*4:]))
+		if size < 0 || size > len(b) || next > len(dir) {
+			return nil, false
+		}
+		return blocks(dir[next:], size)
+	}
+
+	info, ok := stream(1)
+	if !ok || len(info) < 28 {
+		return "", errNotPDB
+	}
+	age := le.Uint32(info[8:])
+	if dbi, ok := stream(3); ok && len(dbi) >= 12 {
+		age = le.Uint32(dbi[8:])
+	}
+	return formatPDBGuid(info[12:28]) + fmt.Sprintf("%X", age), nil
+}
+
+// portablePDBSignature reads the GUID from the ID in a portable PDB's #Pdb stream
+func portablePDBSignature(b []byte) (string, error) {
+	le := binary.LittleEndian
+	if len(b) < 16 {
+		return "", errNotPDB
+	}
+	p := 16 + int(le.Uint32(b[12:]))
+	if p < 16 || p+4 > len(b) {
+		return "", errNotPDB
+	}
+	count := int(le.Uint16(b[p+2:]))
+	p += 4
+	for i := 0; i < count; i++ {
+		if p+8 > len(b) {
+			break
+		}
+		off, size := int(le.Uint32(b[p:])), int(le.Uint32(b[p+4:]))
+		end := bytes.IndexByte(b[p+8:], 0)
+		if end < 0 {
+			break
+		}
+		name := string(b[p+8 : p+8+end])
+		p += 8 + (end+4)/4*4
+		if name == "#Pdb" {
+			if size < 20 || off < 0 || off+20 > len(b) {
+				break
+			}
+			return formatPDBGuid(b[off:off+16]) + "FFFFFFFF", nil
+		}
+	}
+	return "", errNotPDB
+}
+
+// symbolKey is where a PDB is indexed, by its file name and signature in any case
+func symbolKey(pdbName string, signature string) string {
+	return strings.ToLower(pdbName) + "/" + strings.ToUpper(signature)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Name the pinned versions are kept under in the filestore's settings
+const pinsSetting = "pins"
+
+// pinRequest is the body of PUT admin/packages/{id}/pin
+type pinRequest struct {
+	Version string `json:"version"`
+}
+
+// servePin pins the version of a package that carries IsLatestVersion, or with
+// DELETE goes back to the highest listed stable version
+func servePin(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting admin/packages/{id}/pin
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`admin/packages`):], `/`), `/`)
+	if len(x) != 2 || x[1] != "pin" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := x[0]
+
+	ver := ""
+	if r.Method == http.MethodPut {
+		b, err := ioutil.ReadAll(r.Body)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var req pinRequest
+		if err := json.Unmarshal(b, &req); err != nil || req.Version == "" {
+			writePinError(w, "body must be {\"version\": \"...\"}")
+			return
+		}
+
+		// Only a listed version can be pinned
+		npe, err := server.fs.GetPackageEntry(r.Context(), id, req.Version)
+		if err == ErrFileNotFound {
+			writePinError(w, "version "+req.Version+" of "+id+" does not exist")
+			return
+		} else if err == ErrBusy {
+			writeBusy(w)
+			return
+		} else if isCancelled(err) {
+			writeCancelled(w, r)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !npe.Properties.Listed.Value {
+			writePinError(w, "version "+req.Version+" of "+id+" is unlisted")
+			return
+		}
+		id, ver = npe.Properties.ID, npe.Properties.Version
+	} else if entries, err := allPackageEntries(r.Context(), server.fs, id); err == nil && len(entries) > 0 {
+		// Stores may key the pin by the ID as pushed
+		id = entries[0].Properties.ID
+	}
+
+	err := server.fs.SetPinnedVersion(r.Context(), id, ver)
+	if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writePinError explains why a pin was refused
+func writePinError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(msg))
+}
+
+// latestVersion returns the version of a package flagged IsLatestVersion, which is
+// the pinned version if there is one, or for a package with only prereleases the
+// absolute latest version
+func latestVersion(ctx context.Context, id string) (string, error) {
+	entries, err := allPackageEntries(ctx, server.fs, id)
+	if err != nil {
+		return "", err
+	}
+	abs := ""
+	for _, e := range entries {
+		if !strings.EqualFold(e.Properties.ID, id) {
+			continue
+		}
+		if e.Properties.IsLatestVersion.Value {
+			return e.Properties.Version, nil
+		}
+		if e.Properties.IsAbsoluteLatestVersion.Value {
+			abs = e.Properties.Version
+		}
+	}
+	if abs == "" {
+		return "", ErrFileNotFound
+	}
+	return abs, nil
+}
+
+// pinnedVersion returns the version a package is pinned to, if any
+func pinnedVersion(ctx context.Context, id string) string {
+	pins, err := server.fs.GetPinnedVersions(ctx)
+	if err != nil {
+		return ""
+	}
+	return pins[strings.ToLower(id)]
+}
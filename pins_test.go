@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// pin pins Flag.Pkg to a version, or unpins it if ver is empty
+func (ts *testServer) pin(t *testing.T, key string, ver string) (int, string) {
+	t.Helper()
+	if ver == "" {
+		return readResponse(t, ts.do(t, http.MethodDelete, "admin/packages/Flag.Pkg/pin", key, nil, nil))
+	}
+	return readResponse(t, ts.do(t, http.MethodPut, "admin/packages/Flag.Pkg/pin", key, strings.NewReader(`{"version": "`+ver+`"}`), nil))
+}
+
+// wantLatestDownload fails the test unless nupkg/Flag.Pkg/latest is a version
+func wantLatestDownload(t *testing.T, ts *testServer, what string, ver string) {
+	t.Helper()
+	status, body := ts.get(t, "nupkg/Flag.Pkg/latest")
+	wantStatus(t, what+" latest download", status, body, http.StatusOK)
+	nsf, err := readNuspec([]byte(body))
+	if err != nil {
+		t.Fatalf("%s: latest download: %v", what, err)
+	}
+	if nsf.Meta.Version != ver {
+		t.Errorf("%s: latest download is %s, want %s", what, nsf.Meta.Version, ver)
+	}
+}
+
+func TestPinLatestVersion(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, ver := range []string{"1.0.0", "2.0.0", "3.0.0-beta"} {
+		ts.mustPush(t, testPackage(t, "Flag.Pkg", ver, "", nil))
+	}
+	wantLatest(t, ts, "unpinned", "2.0.0", "3.0.0-beta")
+	wantLatestDownload(t, ts, "unpinned", "2.0.0")
+
+	// Pin an older version
+	status, body := ts.pin(t, testReadKey, "1.0.0")
+	wantStatus(t, "pin with a read key", status, body, http.StatusForbidden)
+	status, body = ts.pin(t, testWriteKey, "1.0")
+	wantStatus(t, "pin", status, body, http.StatusNoContent)
+	wantLatest(t, ts, "pinned", "1.0.0", "3.0.0-beta")
+	wantLatestDownload(t, ts, "pinned", "1.0.0")
+	status, body = ts.get(t, "ui/Flag.Pkg/2.0.0")
+	wantStatus(t, "ui", status, body, http.StatusOK)
+	if !strings.Contains(body, "pinned to 1.0.0") {
+		t.Error("ui does not show the pin")
+	}
+
+	// Kept across a restart, and newer pushes don't take over
+	ts.restart(t)
+	ts.mustPush(t, testPackage(t, "Flag.Pkg", "4.0.0", "", nil))
+	wantLatest(t, ts, "pinned after a restart and a push", "1.0.0", "4.0.0")
+
+	// Only versions that exist and are listed can be pinned
+	for _, tc := range []struct{ what, ver, msg string }{
+		{"missing", "9.0.0", "does not exist"},
+		{"unlisted", "2.0.0", "is unlisted"},
+	} {
+		if tc.what == "unlisted" {
+			ts.setListed(t, "2.0.0", false)
+		}
+		status, body := ts.pin(t, testWriteKey, tc.ver)
+		wantStatus(t, "pin "+tc.what, status, body, http.StatusBadRequest)
+		if !strings.Contains(body, tc.msg) {
+			t.Errorf("pin %s: %q", tc.what, body)
+		}
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodPut, "admin/packages/Flag.Pkg/pin", testWriteKey, strings.NewReader(`{}`), nil))
+	wantStatus(t, "pin without a version", status, body, http.StatusBadRequest)
+	wantLatest(t, ts, "refused pins", "1.0.0", "4.0.0")
+
+	// Unpin
+	status, body = ts.pin(t, testWriteKey, "")
+	wantStatus(t, "unpin", status, body, http.StatusNoContent)
+	wantLatest(t, ts, "unpinned again", "4.0.0", "4.0.0")
+	wantLatestDownload(t, ts, "unpinned again", "4.0.0")
+	status, body = ts.get(t, "ui/Flag.Pkg/4.0.0")
+	wantStatus(t, "ui", status, body, http.StatusOK)
+	if strings.Contains(body, "pinned to") {
+		t.Error("ui still shows the pin")
+	}
+}
+
+// A pinned version that goes away leaves the normal rules in charge
+func TestPinnedVersionRemoved(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, ver := range []string{"1.0.0", "2.0.0", "3.0.0-beta"} {
+		ts.mustPush(t, testPackage(t, "Flag.Pkg", ver, "", nil))
+	}
+
+	// A prerelease can be pinned
+	status, body := ts.pin(t, testWriteKey, "3.0.0-beta")
+	wantStatus(t, "pin prerelease", status, body, http.StatusNoContent)
+	wantLatest(t, ts, "pinned prerelease", "3.0.0-beta", "3.0.0-beta")
+
+	// Unlisted, then listed again
+	ts.setListed(t, "3.0.0-beta", false)
+	wantLatest(t, ts, "pinned version unlisted", "2.0.0", "2.0.0")
+	ts.setListed(t, "3.0.0-beta", true)
+	wantLatest(t, ts, "pinned version relisted", "3.0.0-beta", "3.0.0-beta")
+
+	// Deleted
+	status, body = ts.pin(t, testWriteKey, "1.0.0")
+	wantStatus(t, "pin", status, body, http.StatusNoContent)
+	status, body = readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Flag.Pkg/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete pinned", status, body, http.StatusNoContent)
+	wantLatest(t, ts, "pinned version deleted", "2.0.0", "3.0.0-beta")
+	wantLatestDownload(t, ts, "pinned version deleted", "2.0.0")
+	ts.restart(t)
+	wantLatest(t, ts, "pinned version deleted, after a restart", "2.0.0", "3.0.0-beta")
+}
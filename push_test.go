@@ -0,0 +1,366 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentDuplicatePushes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Race.Pkg", "0.9.0", "", nil))
+
+	// Pushes of the version race each other and downloads and feed reads of the
+	// same ID. Each push has other content, so only one can be stored.
+	const n = 8
+	pkgs := make([][]byte, n)
+	for i := range pkgs {
+		pkgs[i] = testPackage(t, "Race.Pkg", "1.0.0", "", map[string]string{"content/a.txt": fmt.Sprint(i)})
+	}
+	statuses := make([]int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i], _ = ts.push(t, pkgs[i])
+		}(i)
+		go func() {
+			defer wg.Done()
+			readResponse(t, ts.do(t, http.MethodGet, "nupkg/Race.Pkg/0.9.0", testReadKey, nil, nil))
+			readResponse(t, ts.do(t, http.MethodGet, "Packages(Id='Race.Pkg',Version='0.9.0')", testReadKey, nil, nil))
+			readResponse(t, ts.do(t, http.MethodGet, "FindPackagesById()?id='Race.Pkg'", testReadKey, nil, nil))
+		}()
+	}
+	wg.Wait()
+
+	winner := -1
+	conflicts := 0
+	for i, s := range statuses {
+		switch s {
+		case http.StatusCreated:
+			winner = i
+		case http.StatusConflict:
+			conflicts++
+		}
+	}
+	if winner < 0 || conflicts != n-1 {
+		t.Fatalf("got statuses %v, want one 201 and %d 409s", statuses, n-1)
+	}
+
+	status, body := ts.get(t, "FindPackagesById()?id='Race.Pkg'")
+	wantStatus(t, "feed", status, body, http.StatusOK)
+	if ids := feedIDs(t, body); len(ids) != 2 || ids[0] == ids[1] {
+		t.Errorf("feed has %v, want each version once", ids)
+	}
+
+	b, err := ioutil.ReadFile(ts.nupkgPath(t, "race.pkg", "1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, pkgs[winner]) {
+		t.Fatal("nupkg on disk isn't the package that won")
+	}
+	if _, err := zip.NewReader(bytes.NewReader(b), int64(len(b))); err != nil {
+		t.Fatalf("nupkg on disk is invalid: %v", err)
+	}
+	status, body = ts.get(t, "files/race.pkg/1.0.0/content/a.txt")
+	wantStatus(t, "content", status, body, http.StatusOK)
+	if body != fmt.Sprint(winner) {
+		t.Errorf("content is of push %s, want %d", body, winner)
+	}
+}
+
+// countingReader counts the bytes read from it, which a transport only does when
+// it sends a request's body
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// A push sent with Expect: 100-continue, as nuget.exe sends large ones, is refused
+// before the client sends any of the package
+func TestPushRefusedBeforeBody(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxUploadBytes = 1 << 20 })
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.ExpectContinueTimeout = 10 * time.Second
+	client := &http.Client{Transport: transport}
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		size int64
+		want int
+	}{
+		{name: "no key", size: 1 << 10, want: http.StatusForbidden},
+		{name: "read key", key: testReadKey, size: 1 << 10, want: http.StatusForbidden},
+		{name: "too large", key: testWriteKey, size: 8 << 20, want: http.StatusRequestEntityTooLarge},
+	} {
+		body := &countingReader{r: io.LimitReader(zeroReader{}, tc.size)}
+		r, err := http.NewRequest(http.MethodPut, ts.Feed+"api/v2/package/", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ContentLength = tc.size
+		r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		r.Header.Set("Expect", "100-continue")
+		if tc.key != "" {
+			r.Header.Set("X-NuGet-ApiKey", tc.key)
+		}
+		res, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		status, text := readResponse(t, res)
+		wantStatus(t, tc.name, status, text, tc.want)
+		if n := atomic.LoadInt64(&body.n); n != 0 {
+			t.Errorf("%s: client sent %d bytes of the body", tc.name, n)
+		}
+	}
+
+	// A chunked upload has no length to check, so it is cut off at the limit
+	part := "--x\r\nContent-Disposition: form-data; name=\"package\"; filename=\"package.nupkg\"\r\n\r\nPK\x03\x04"
+	body := io.MultiReader(strings.NewReader(part), io.LimitReader(zeroReader{}, 8<<20))
+	r, err := http.NewRequest(http.MethodPut, ts.Feed+"api/v2/package/", ioutil.NopCloser(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	r.Header.Set("X-NuGet-ApiKey", testWriteKey)
+	res, err := ts.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, text := readResponse(t, res)
+	wantStatus(t, "chunked", status, text, http.StatusRequestEntityTooLarge)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// A push to api/v2/package/{id}/{version} must be that package
+func TestVersionedPush(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, tc := range []struct {
+		name    string
+		path    string
+		id, ver string
+		want    int
+	}{
+		{name: "match", path: "api/v2/package/Target.Pkg/1.0.0", id: "Target.Pkg", ver: "1.0.0", want: http.StatusCreated},
+		{name: "case only", path: "api/v2/package/target.pkg/2.0.0", id: "Target.Pkg", ver: "2.0.0", want: http.StatusCreated},
+		{name: "normalized", path: "api/v2/package/Target.Pkg/3.0", id: "Target.Pkg", ver: "3.0.0", want: http.StatusCreated},
+		{name: "other id", path: "api/v2/package/Target.Pkg/4.0.0", id: "Other.Pkg", ver: "4.0.0", want: http.StatusBadRequest},
+		{name: "other version", path: "api/v2/package/Target.Pkg/5.0.0", id: "Target.Pkg", ver: "5.0.1", want: http.StatusBadRequest},
+		{name: "feed root", path: "", id: "Other.Pkg", ver: "6.0.0", want: http.StatusCreated},
+		{name: "unversioned", path: "api/v2/package/", id: "Other.Pkg", ver: "7.0.0", want: http.StatusCreated},
+	} {
+		status, body := readResponse(t, ts.pushTo(t, tc.path, testWriteKey, testPackage(t, tc.id, tc.ver, "", nil)))
+		wantStatus(t, tc.name, status, body, tc.want)
+		if tc.want != http.StatusBadRequest {
+			continue
+		}
+		// The error names both, and nothing is stored
+		for _, s := range []string{tc.id + " " + tc.ver, "Target.Pkg"} {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: %s does not name %s", tc.name, body, s)
+			}
+		}
+		status, body = ts.get(t, "Packages(Id='"+tc.id+"',Version='"+tc.ver+"')")
+		wantStatus(t, tc.name+" stored", status, body, http.StatusNotFound)
+	}
+
+	// An unreadable package is never stored under a versioned URL
+	status, body := readResponse(t, ts.pushTo(t, "api/v2/package/Target.Pkg/8.0.0", testWriteKey, nuspecPackage(t, "readme.txt", nil)))
+	wantStatus(t, "no nuspec", status, body, http.StatusBadRequest)
+}
+
+// Approving a quarantined package checks the file is the version it's filed under
+func TestApproveChecksTarget(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Moderation.Enabled = true
+		c.Moderation.PackageIDs = []string{"Mod.*"}
+	})
+	status, body := ts.push(t, testPackage(t, "Mod.Pkg", "1.0.0", "", nil))
+	wantStatus(t, "push", status, body, http.StatusAccepted)
+
+	// Replaced by hand with another package
+	fp := ts.local(t).quarantinePath("Mod.Pkg", "1.0.0")
+	if err := ioutil.WriteFile(fp, testPackage(t, "Mod.Other", "1.0.0", "", nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodPost, "admin/quarantine/Mod.Pkg/1.0.0/approve", testWriteKey, nil, nil))
+	wantStatus(t, "approve", status, body, http.StatusBadRequest)
+	if !strings.Contains(body, "Mod.Other 1.0.0") || !strings.Contains(body, "Mod.Pkg 1.0.0") {
+		t.Errorf("approve: %s does not name both", body)
+	}
+	status, body = ts.get(t, "Packages(Id='Mod.Other',Version='1.0.0')")
+	wantStatus(t, "approved other", status, body, http.StatusNotFound)
+}
+
+// A retried push of the stored bytes succeeds, other bytes for the version conflict
+func TestIdempotentPush(t *testing.T) {
+	ts := newTestServer(t, nil)
+	pkg := testPackage(t, "Retry.Pkg", "1.0.0", "", nil)
+	other := testPackage(t, "Retry.Pkg", "1.0.0", "<title>Other</title>", nil)
+	sum := sha512.Sum512(pkg)
+	pushWithHash := func(pkg []byte, hash string) (int, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, err := mw.CreateFormFile("package", "package.nupkg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(pkg)
+		mw.Close()
+		return readResponse(t, ts.do(t, http.MethodPut, "api/v2/package/", testWriteKey, &buf, http.Header{
+			"Content-Type":         {mw.FormDataContentType()},
+			"X-Nuget-Package-Hash": {hash},
+		}))
+	}
+
+	status, body := pushWithHash(pkg, hex.EncodeToString(sum[:]))
+	wantStatus(t, "first push", status, body, http.StatusCreated)
+
+	// With no hash, or the hash as hex or base64
+	for name, hash := range map[string]string{
+		"missing hash header": "",
+		"hex hash":            strings.ToUpper(hex.EncodeToString(sum[:])),
+		"base64 hash":         base64.StdEncoding.EncodeToString(sum[:]),
+	} {
+		status, body := pushWithHash(pkg, hash)
+		wantStatus(t, "identical retry with "+name, status, body, http.StatusOK)
+	}
+
+	// Different bytes, or bytes not matching the hash sent
+	status, body = ts.push(t, other)
+	wantStatus(t, "conflicting retry", status, body, http.StatusConflict)
+	status, body = pushWithHash(other, hex.EncodeToString(sum[:]))
+	wantStatus(t, "hash of another package", status, body, http.StatusBadRequest)
+	status, body = pushWithHash(pkg, "not a hash!")
+	wantStatus(t, "malformed hash", status, body, http.StatusBadRequest)
+
+	// The stored hash is compared, not the file
+	if err := ioutil.WriteFile(ts.nupkgPath(t, "retry.pkg", "1.0.0"), other, 0644); err != nil {
+		t.Fatal(err)
+	}
+	status, body = ts.push(t, pkg)
+	wantStatus(t, "retry against the recorded hash", status, body, http.StatusOK)
+
+	_, feed := ts.get(t, "FindPackagesById()?id='Retry.Pkg'")
+	if got := feedIDs(t, feed); len(got) != 1 {
+		t.Errorf("feed has %q, want a single entry", got)
+	}
+}
+
+// A push is the package itself with any Content-Type but multipart, and anything
+// that isn't a zip file or is cut short is refused without storing it
+func TestUploadParsing(t *testing.T) {
+	ts := newTestServer(t, nil)
+	pkg := string(testPackage(t, "Upload.Pkg", "1.0.0", "", nil))
+	part := func(boundary string, data string) string {
+		return "--" + boundary + "\r\nContent-Disposition: form-data; name=\"package\"; filename=\"package.nupkg\"\r\n\r\n" + data
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string // None if empty
+		body        string
+		want        int
+		error       string // Part of the error expected, if any
+	}{
+		{name: "no content type", body: pkg, want: http.StatusCreated},
+		{name: "octet stream", contentType: "application/octet-stream", body: pkg, want: http.StatusCreated},
+		{name: "unparseable content type", contentType: "multipart/", body: pkg, want: http.StatusCreated},
+		{name: "no content type, not a zip", body: "<?xml version=\"1.0\"?><package/>", want: http.StatusBadRequest, error: "not a nupkg (zip) file"},
+		{name: "empty body", body: "", want: http.StatusBadRequest, error: "not a nupkg (zip) file"},
+		{name: "zip signature only", body: "PK", want: http.StatusBadRequest, error: "not a nupkg (zip) file"},
+		{name: "text part", contentType: "multipart/form-data; boundary=x", body: part("x", "hello\r\n--x--\r\n"), want: http.StatusBadRequest, error: "not a nupkg (zip) file"},
+		{name: "cut short", contentType: "multipart/form-data; boundary=x", body: part("x", pkg[:100]), want: http.StatusBadRequest, error: "part way through"},
+		{name: "no boundary", contentType: "multipart/form-data", body: part("x", pkg+"\r\n--x--\r\n"), want: http.StatusBadRequest, error: "invalid multipart boundary"},
+		{name: "long boundary", contentType: "multipart/form-data; boundary=" + strings.Repeat("b", 71), body: part(strings.Repeat("b", 71), pkg+"\r\n--"+strings.Repeat("b", 71)+"--\r\n"), want: http.StatusBadRequest, error: "invalid multipart boundary"},
+		{name: "no parts", contentType: "multipart/form-data; boundary=x", body: "--x--\r\n", want: http.StatusBadRequest, error: "no package in multipart body"},
+		{name: "no boundary in body", contentType: "multipart/form-data; boundary=x", body: pkg, want: http.StatusBadRequest, error: "invalid multipart body"},
+		{name: "bad part header", contentType: "multipart/form-data; boundary=x", body: "--x\r\nContent-Disposition\r\n\r\n" + pkg + "\r\n--x--\r\n", want: http.StatusBadRequest, error: "invalid multipart body"},
+	} {
+		header := http.Header{}
+		if tc.contentType != "" {
+			header.Set("Content-Type", tc.contentType)
+		}
+		status, body := readResponse(t, ts.do(t, http.MethodPut, "api/v2/package/", testWriteKey, strings.NewReader(tc.body), header))
+		wantStatus(t, tc.name, status, body, tc.want)
+		if !strings.Contains(body, tc.error) {
+			t.Errorf("%s: got %q, want %q", tc.name, body, tc.error)
+		}
+		// Refused pushes store nothing
+		if tc.want == http.StatusBadRequest {
+			if _, n := ts.get(t, "Packages()/$count"); n != "0" {
+				t.Errorf("%s: %s packages stored", tc.name, n)
+			}
+		} else {
+			status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Upload.Pkg/1.0.0", testWriteKey, nil, nil))
+			wantStatus(t, tc.name+" delete", status, body, http.StatusNoContent)
+		}
+	}
+}
+
+// Only the first max-upload-parts parts of a multipart push are taken
+func TestUploadPartCap(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxUploadParts = 2 })
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for i := 1; i <= 3; i++ {
+		fw, err := mw.CreateFormFile("package", "package.nupkg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(testPackage(t, "Parts.Pkg", fmt.Sprintf("%d.0.0", i), "", nil))
+	}
+	mw.Close()
+	status, body := readResponse(t, ts.do(t, http.MethodPut, "api/v2/package/", testWriteKey, &buf, http.Header{"Content-Type": {mw.FormDataContentType()}}))
+	// The answer is the first part's, the rest are stored or refused silently
+	wantStatus(t, "push", status, body, http.StatusCreated)
+	for ver, want := range map[string]int{"1.0.0": http.StatusOK, "2.0.0": http.StatusOK, "3.0.0": http.StatusNotFound} {
+		status, body := ts.get(t, "Packages(Id='Parts.Pkg',Version='"+ver+"')")
+		wantStatus(t, ver, status, body, want)
+	}
+
+	// Refused at the limit, not once every part has been buffered
+	buf.Reset()
+	mw = multipart.NewWriter(&buf)
+	for i := 0; i < 1000; i++ {
+		fw, err := mw.CreateFormFile("package", "package.nupkg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("not a package"))
+	}
+	mw.Close()
+	status, body = readResponse(t, ts.do(t, http.MethodPut, "api/v2/package/", testWriteKey, &buf, http.Header{"Content-Type": {mw.FormDataContentType()}}))
+	wantStatus(t, "many parts", status, body, http.StatusBadRequest)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// quarantineItem is a pending package as listed by the admin API
+type quarantineItem struct {
+	ID          string `json:"id"`
+	Version     string `json:"version"`
+	Title       string `json:"title"`
+	Authors     string `json:"authors"`
+	Description string `json:"description"`
+	Size        int    `json:"size"`
+	Hash        string `json:"hash"`
+	Submitted   string `json:"submitted"`
+}
+
+func serveQuarantineList(w http.ResponseWriter, r *http.Request) {
+
+	// Get all packages awaiting approval
+	entries, err := server.fs.GetQuarantinedEntries(r.Context())
+	if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	items := []quarantineItem{}
+	for _, e := range entries {
+		items = append(items, quarantineItem{
+			ID:          e.Properties.ID,
+			Version:     e.Properties.Version,
+			Title:       e.Properties.Title,
+			Authors:     e.Author.Name,
+			Description: e.Properties.Description,
+			Size:        e.Properties.PackageSize.Value,
+			Hash:        e.Properties.PackageHash,
+			Submitted:   formatISO8601Time(e.Properties.Published.Value),
+		})
+	}
+
+	b, err := json.Marshal(items)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+func serveQuarantineAction(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting admin/quarantine/{id}/{version}/{approve|reject}
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`admin/quarantine`):], `/`), `/`)
+	if len(x) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var err error
+	switch x[2] {
+	case "approve":
+		err = server.fs.ApprovePackage(r.Context(), x[0], x[1])
+	case "reject":
+		// Reason can be supplied as {"reason":"..."} or ?reason=
+		reason := r.URL.Query().Get("reason")
+		if b, _ := ioutil.ReadAll(r.Body); len(b) > 0 {
+			var body struct {
+				Reason string `json:"reason"`
+			}
+			if err := json.Unmarshal(b, &body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reason = body.Reason
+		}
+		err = server.fs.RejectPackage(r.Context(), x[0], x[1], reason)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var targetErr *pushTargetError
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if errors.As(err, &targetErr) {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
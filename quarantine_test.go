@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// quarantined lists the packages awaiting approval as "id version"
+func quarantined(t *testing.T, ts *testServer) []string {
+	t.Helper()
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "admin/quarantine", testWriteKey, nil, nil))
+	wantStatus(t, "quarantine list", status, body, http.StatusOK)
+	var items []quarantineItem
+	if err := json.Unmarshal([]byte(body), &items); err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	for _, it := range items {
+		list = append(list, it.ID+" "+it.Version)
+	}
+	return list
+}
+
+func TestQuarantine(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.Moderation.Enabled = true
+		c.Moderation.PackageIDs = []string{"Mod.*"}
+	})
+	action := func(id string, ver string, act string, body string) (int, string) {
+		t.Helper()
+		return readResponse(t, ts.do(t, http.MethodPost, "admin/quarantine/"+id+"/"+ver+"/"+act, testWriteKey, strings.NewReader(body), nil))
+	}
+	inFeed := func(id string, ver string) bool {
+		t.Helper()
+		status, _ := ts.get(t, "Packages(Id='"+id+"',Version='"+ver+"')")
+		return status == http.StatusOK
+	}
+
+	// IDs outside the moderated ones are stored straight away
+	ts.mustPush(t, testPackage(t, "Free.Pkg", "1.0.0", "", nil))
+
+	pkg := testPackage(t, "Mod.Pkg", "1.0.0", "", nil)
+	status, body := ts.push(t, pkg)
+	wantStatus(t, "moderated push", status, body, http.StatusAccepted)
+	if inFeed("Mod.Pkg", "1.0.0") {
+		t.Error("quarantined package is in the feed")
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "nupkg/Mod.Pkg/1.0.0", testReadKey, nil, nil))
+	wantStatus(t, "quarantined download", status, body, http.StatusNotFound)
+	if got := quarantined(t, ts); !reflect.DeepEqual(got, []string{"Mod.Pkg 1.0.0"}) {
+		t.Errorf("quarantine: got %q", got)
+	}
+
+	// The version is taken while it waits, whatever is pushed
+	status, body = ts.push(t, pkg)
+	wantStatus(t, "push of the quarantined version", status, body, http.StatusConflict)
+	status, body = ts.push(t, testPackage(t, "Mod.Pkg", "1.0.0", "<tags>other</tags>", nil))
+	wantStatus(t, "other push of the quarantined version", status, body, http.StatusConflict)
+	if got := quarantined(t, ts); len(got) != 1 {
+		t.Errorf("quarantine after duplicate pushes: got %q", got)
+	}
+
+	// Approving serves it, after which a retry of the same push is a success
+	status, body = action("Mod.Pkg", "1.0.0", "approve", "")
+	wantStatus(t, "approve", status, body, http.StatusNoContent)
+	if !inFeed("Mod.Pkg", "1.0.0") {
+		t.Error("approved package is not in the feed")
+	}
+	if got := quarantined(t, ts); len(got) != 0 {
+		t.Errorf("quarantine after approval: got %q", got)
+	}
+	status, body = ts.push(t, pkg)
+	wantStatus(t, "retry after approval", status, body, http.StatusOK)
+	status, body = ts.push(t, testPackage(t, "Mod.Pkg", "1.0.0", "<tags>other</tags>", nil))
+	wantStatus(t, "other push after approval", status, body, http.StatusConflict)
+	if got := quarantined(t, ts); len(got) != 0 {
+		t.Errorf("quarantine after pushes of an approved version: got %q", got)
+	}
+
+	// Rejecting drops it for good
+	status, body = ts.push(t, testPackage(t, "Mod.Pkg", "2.0.0", "", nil))
+	wantStatus(t, "second moderated push", status, body, http.StatusAccepted)
+	status, body = action("Mod.Pkg", "2.0.0", "reject", `{"reason": "not ready"}`)
+	wantStatus(t, "reject", status, body, http.StatusNoContent)
+	if inFeed("Mod.Pkg", "2.0.0") {
+		t.Error("rejected package is in the feed")
+	}
+	if got := quarantined(t, ts); len(got) != 0 {
+		t.Errorf("quarantine after rejection: got %q", got)
+	}
+	status, body = action("Mod.Pkg", "2.0.0", "approve", "")
+	wantStatus(t, "approve after rejection", status, body, http.StatusNotFound)
+	status, body = action("Mod.Pkg", "2.0.0", "reject", "")
+	wantStatus(t, "reject again", status, body, http.StatusNotFound)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Default largest readme rendered in full, beyond it the start is shown
+const defaultUIReadmeMaxBytes = 64 * 1024
+
+// Largest readme served by the readme route
+const maxReadmeFileBytes = 1024 * 1024
+
+// Image types the UI will serve out of a package for a readme
+var uiImageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".webp": true,
+}
+
+// packageReadme is a package's readme rendered for the UI
+type packageReadme struct {
+	Path      string
+	HTML      template.HTML
+	Truncated bool
+}
+
+// readmeCache keeps rendered readmes, which never change once a package is stored.
+// Packages without a readme are cached too, with an empty Path.
+var readmeCache = struct {
+	sync.Mutex
+	m map[string]*packageReadme
+}{m: make(map[string]*packageReadme)}
+
+// Most rendered readmes cached at once
+const maxReadmeCache = 256
+
+// renderedReadme returns the package's readme as sanitized HTML, from the cache if possible
+func renderedReadme(ctx context.Context, id string, ver string, files []zipFileInfo) (*packageReadme, error) {
+	key := versionKey(id, ver)
+
+	readmeCache.Lock()
+	rm, ok := readmeCache.m[key]
+	readmeCache.Unlock()
+	if ok {
+		return rm, nil
+	}
+
+	rm = &packageReadme{}
+	p, err := findReadme(ctx, id, ver, files)
+	if err != nil {
+		return nil, err
+	}
+	if p != "" {
+		max := server.Config().UIReadmeMaxBytes
+		if max <= 0 {
+			max = defaultUIReadmeMaxBytes
+		}
+		b, err := readPackageEntry(ctx, id, ver, p, int64(max)+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > max {
+			b = truncateReadme(b[:max])
+			rm.Truncated = true
+		}
+		if utf8.Valid(b) {
+			rm.Path = p
+			mr := &markdownRenderer{
+				Image: readmeImageResolver(id, ver, p, files),
+				Link:  readmeLinkResolver(id, ver, p, files),
+			}
+			// Sanitized by construction: the renderer escapes all source text
+			rm.HTML = template.HTML(mr.Render(string(b)))
+		}
+	}
+
+	readmeCache.Lock()
+	if len(readmeCache.m) >= maxReadmeCache {
+		// Drop an arbitrary entry to stay bounded
+		for k := range readmeCache.m {
+			delete(readmeCache.m, k)
+			break
+		}
+	}
+	readmeCache.m[key] = rm
+	readmeCache.Unlock()
+
+	return rm, nil
+}
+
+// findReadme returns the path of the readme the nuspec names, falling back to a
+// README.md at the root of the package, or "" if there is none
+func findReadme(ctx context.Context, id string, ver string, files []zipFileInfo) (string, error) {
+	var nuspecName string
+	for _, f := range files {
+		if !strings.Contains(f.Name, "/") && strings.HasSuffix(strings.ToLower(f.Name), ".nuspec") {
+			nuspecName = f.Name
+		}
+	}
+	if nuspecName != "" {
+		b, err := readPackageEntry(ctx, id, ver, nuspecName, 1024*1024)
+		if err != nil {
+			return "", err
+		}
+		if r := nuspecReadme(b); r != "" {
+			r = packageFilePath(r)
+			for _, f := range files {
+				if strings.EqualFold(f.Name, r) {
+					return f.Name, nil
+				}
+			}
+		}
+	}
+	for _, f := range files {
+		if strings.EqualFold(f.Name, "readme.md") {
+			return f.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// packageFilePath returns a file named in a nuspec, with either slash, as a clean
+// path within the package, so no "../" can lead outside it
+func packageFilePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.Replace(p, `\`, "/", -1)), "/")
+}
+
+// nuspecReadme returns the package/metadata/readme element of a nuspec, if any
+func nuspecReadme(b []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(stripBOM(b)))
+	d.Strict = false
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var stack []string
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) == 3 && stack[1] == "metadata" && stack[2] == "readme" {
+				return strings.TrimSpace(string(t))
+			}
+		}
+	}
+}
+
+// truncateReadme cuts a readme back to its last complete line
+func truncateReadme(b []byte) []byte {
+	if i := bytes.LastIndexByte(b, '\n'); i > 0 {
+		return b[:i]
+	}
+	// Don't split a UTF-8 sequence
+	for len(b) > 0 && !utf8.Valid(b) {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// readmeImageResolver only lets readme images refer to image files in the package
+// itself, resolved relative to the readme and served through the UI asset route
+func readmeImageResolver(id string, ver string, readme string, files []zipFileInfo) func(string) (string, bool) {
+	return func(src string) (string, bool) {
+		u, err := url.Parse(src)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+			return "", false
+		}
+		p := u.Path
+		if !strings.HasPrefix(p, "/") {
+			p = path.Join(path.Dir("/"+readme), p)
+		}
+		p = strings.TrimPrefix(path.Clean(p), "/")
+		if !uiImageExtensions[strings.ToLower(path.Ext(p))] {
+			return "", false
+		}
+		for _, f := range files {
+			if f.Name == p {
+				return server.URL.String() + "ui/" + url.PathEscape(id) + "/" + url.PathEscape(ver) + "/asset?path=" + url.QueryEscape(p), true
+			}
+		}
+		return "", false
+	}
+}
+
+// readmeLinkResolver points relative links at files in the package to the UI's view
+// of them, leaving other links as they are
+func readmeLinkResolver(id string, ver string, readme string, files []zipFileInfo) func(string) string {
+	return func(dest string) string {
+		u, err := url.Parse(dest)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+			return dest
+		}
+		p := u.Path
+		if !strings.HasPrefix(p, "/") {
+			p = path.Join(path.Dir("/"+readme), p)
+		}
+		p = strings.TrimPrefix(path.Clean(p), "/")
+		for _, f := range files {
+			if f.Name == p {
+				return server.URL.String() + "ui/" + url.PathEscape(id) + "/" + url.PathEscape(ver) + "/view?path=" + url.QueryEscape(p)
+			}
+		}
+		return dest
+	}
+}
+
+// readmeURL returns where a package's embedded readme is served, "" if it has none
+func readmeURL(e *NugetPackageEntry) string {
+	if e.Properties.ReadmeFile == "" {
+		return ""
+	}
+	return server.URL.String() + "readme/" + url.PathEscape(e.Properties.ID) + "/" + url.PathEscape(e.Properties.Version)
+}
+
+// serveReadme serves readme/{id}/{version}, the readme the nuspec embeds as it is
+// in the package
+func serveReadme(w http.ResponseWriter, r *http.Request) {
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`readme`):], `/`), `/`)
+	if len(x) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	npe, err := server.fs.GetPackageEntry(r.Context(), x[0], x[1])
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if snap := requestSnapshot(r); snap != nil && !snap.Contains(npe.Properties.ID, npe.Properties.Version) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if npe.Properties.ReadmeFile == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Zip entry names vary in case from the nuspec's
+	files, err := packageListing(r.Context(), npe.Properties.ID, npe.Properties.Version)
+	if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	name := ""
+	for _, f := range files {
+		if strings.EqualFold(f.Name, npe.Properties.ReadmeFile) {
+			name = f.Name
+		}
+	}
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b, err := readPackageEntry(r.Context(), npe.Properties.ID, npe.Properties.Version, name, maxReadmeFileBytes)
+	if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write(b)
+}
+
+func serveUIAsset(w http.ResponseWriter, r *http.Request, id string, ver string) {
+
+	// Only exact, clean image entry names are looked up
+	p := r.URL.Query().Get("path")
+	if p == "" || path.Clean(p) != p || strings.HasPrefix(p, "/") || strings.Contains(p, "..") ||
+		!uiImageExtensions[strings.ToLower(path.Ext(p))] {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	files, err := packageListing(r.Context(), id, ver)
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var info *zipFileInfo
+	for i := range files {
+		if files[i].Name == p {
+			info = &files[i]
+		}
+	}
+	max := server.Config().UIPreviewMaxBytes
+	if max <= 0 {
+		max = defaultUIPreviewMaxBytes
+	}
+	if info == nil || info.Size > uint64(max) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := readPackageEntry(r.Context(), id, ver, p, int64(max))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// SVGs can carry script, so nothing in an asset may run if opened directly
+	w.Header().Set("Content-Type", contentTypeFor(p, b))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(b)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// readOnlyState is the body of admin/read-only
+type readOnlyState struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// isReadOnly reports whether changes to the feed are being refused
+func isReadOnly() bool {
+	return atomic.LoadInt32(&server.readOnly) == 1
+}
+
+// setReadOnly starts or stops refusing changes to the feed, until the next restart
+func setReadOnly(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&server.readOnly, v) != v {
+		log.Println("Read-only mode:", on)
+	}
+}
+
+// readOnlyAllows reports whether a request is served while the feed is read-only:
+// reads, snapshots and reindexes don't change what's stored, and the mode must
+// be able to be turned off
+func readOnlyAllows(r *http.Request) bool {
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return true
+	case r.URL.Path == server.URL.Path+`admin/read-only`,
+		r.URL.Path == server.URL.Path+`admin/reindex`,
+		r.URL.Path == server.URL.Path+`api/snapshots`,
+		strings.HasPrefix(r.URL.Path, server.URL.Path+`api/snapshots/`):
+		return true
+	}
+	return false
+}
+
+// writeReadOnly refuses a change while the feed is read-only
+func writeReadOnly(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("the feed is read-only, changes are refused until an administrator allows them again"))
+}
+
+// serveReadOnly handles admin/read-only: GET returns whether the feed is
+// read-only and PUT with {"readOnly": true} or false sets it
+func serveReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		b, err := ioutil.ReadAll(r.Body)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var req readOnlyState
+		if err := json.Unmarshal(b, &req); err != nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`body must be {"readOnly": true} or {"readOnly": false}`))
+			return
+		}
+		setReadOnly(req.ReadOnly)
+	}
+
+	b, err := json.Marshal(readOnlyState{ReadOnly: isReadOnly()})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// serveReindex handles POST admin/reindex, reading the store's packages again and
+// returning how many were found
+func serveReindex(w http.ResponseWriter, r *http.Request) {
+	n, err := server.fs.Reindex(r.Context())
+	if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(struct {
+		Packages int `json:"packages"`
+	}{n})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Versions in each registration page. A package with more is served in the paged
+// form, its index linking to pages rather than including them.
+const registrationPageSize = 64
+
+// registrationURL returns the URL of a registration document
+func registrationURL(doc string) string {
+	return server.URL.String() + `v3/registration/` + doc
+}
+
+func serveRegistration(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting v3/registration/{id}/index.json, v3/registration/{id}/{version}.json
+	// or v3/registration/{id}/page/{lower}/{upper}.json
+	x := strings.Split(r.URL.Path[len(server.URL.Path+`v3/registration/`):], `/`)
+	if len(x) < 2 || x[0] == "" || !strings.HasSuffix(x[len(x)-1], `.json`) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	lastChanged := server.fs.LastChanged(r.Context())
+	if notModified(w, r, lastChanged) {
+		return
+	}
+
+	entries, err := registrationEntries(r, x[0])
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Documents are rendered once for each generation of the ID
+	serveV3Document(w, r, v3CacheKey(r, x[0]), registrationGeneration(entries), strings.Join(x[1:], "/"), func() ([]byte, error) {
+		var res interface{}
+		switch {
+		case len(x) == 2 && x[1] == `index.json`:
+			res = registrationIndex(entries)
+		case len(x) == 2:
+			ver := strings.TrimSuffix(x[1], `.json`)
+			for _, e := range entries {
+				if versions.Equal(e.Properties.Version, ver) {
+					res = registrationLeaf(e)
+				}
+			}
+		case len(x) == 4 && x[1] == `page` && len(entries) > registrationPageSize:
+			lower, upper := x[2], strings.TrimSuffix(x[3], `.json`)
+			for _, page := range registrationPages(entries) {
+				if versions.Equal(page[0].Properties.Version, lower) && versions.Equal(page[len(page)-1].Properties.Version, upper) {
+					res = registrationPage(page, true)
+				}
+			}
+		}
+		if res == nil {
+			return nil, ErrFileNotFound
+		}
+		return marshalJSON(res)
+	})
+}
+
+// registrationEntries returns every version of an id the request can see, listed or
+// not, oldest first, or ErrFileNotFound if there are none
+func registrationEntries(r *http.Request, id string) ([]*NugetPackageEntry, error) {
+	all, err := allPackageEntries(r.Context(), server.fs, id)
+	if err != nil {
+		return nil, err
+	}
+	if snap := requestSnapshot(r); snap != nil {
+		all = snap.Filter(all)
+	}
+	var entries []*NugetPackageEntry
+	for _, e := range all {
+		if strings.EqualFold(e.Properties.ID, id) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, ErrFileNotFound
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return versions.Compare(entries[i].Properties.Version, entries[j].Properties.Version) < 0
+	})
+	return entries, nil
+}
+
+// registrationPages splits versions, oldest first, into pages
+func registrationPages(entries []*NugetPackageEntry) [][]*NugetPackageEntry {
+	var pages [][]*NugetPackageEntry
+	for i := 0; i < len(entries); i += registrationPageSize {
+		end := i + registrationPageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		pages = append(pages, entries[i:end])
+	}
+	return pages
+}
+
+// registrationIndex lists the pages of an id's versions, including their versions
+// unless there are too many to serve in one document
+func registrationIndex(entries []*NugetPackageEntry) map[string]interface{} {
+	id := strings.ToLower(entries[0].Properties.ID)
+	paged := len(entries) > registrationPageSize
+	var items []interface{}
+	for _, page := range registrationPages(entries) {
+		p := registrationPage(page, paged)
+		if paged {
+			delete(p, "items")
+		}
+		items = append(items, p)
+	}
+	return map[string]interface{}{
+		"@id":   registrationURL(id + `/index.json`),
+		"@type": []string{"catalog:CatalogRoot", "PackageRegistration", "catalog:Permalink"},
+		"count": len(items),
+		"items": items,
+	}
+}
+
+// registrationPage is one page of versions, at its own URL in the paged form or
+// within the index otherwise
+func registrationPage(page []*NugetPackageEntry, paged bool) map[string]interface{} {
+	id := strings.ToLower(page[0].Properties.ID)
+	lower := versions.Key(page[0].Properties.Version)
+	upper := versions.Key(page[len(page)-1].Properties.Version)
+	u := registrationURL(id + `/index.json#page/` + lower + `/` + upper)
+	if paged {
+		u = registrationURL(id + `/page/` + lower + `/` + upper + `.json`)
+	}
+	var items []interface{}
+	for _, e := range page {
+		items = append(items, registrationItem(e))
+	}
+	return map[string]interface{}{
+		"@id":    u,
+		"@type":  "catalog:CatalogPage",
+		"count":  len(page),
+		"lower":  lower,
+		"upper":  upper,
+		"parent": registrationURL(id + `/index.json`),
+		"items":  items,
+	}
+}
+
+// registrationItem is a version as listed in a page
+func registrationItem(e *NugetPackageEntry) map[string]interface{} {
+	id := strings.ToLower(e.Properties.ID)
+	return map[string]interface{}{
+		"@id":            registrationURL(id + `/` + versions.Key(e.Properties.Version) + `.json`),
+		"@type":          "Package",
+		"catalogEntry":   registrationCatalogEntry(e),
+		"packageContent": registrationPackageContent(e),
+		"registration":   registrationURL(id + `/index.json`),
+	}
+}
+
+// registrationLeaf is the document of one version
+func registrationLeaf(e *NugetPackageEntry) map[string]interface{} {
+	id := strings.ToLower(e.Properties.ID)
+	return map[string]interface{}{
+		"@id":            registrationURL(id + `/` + versions.Key(e.Properties.Version) + `.json`),
+		"@type":          []string{"Package", "http://schema.nuget.org/catalog#Permalink"},
+		"catalogEntry":   registrationCatalogEntry(e),
+		"listed":         e.Properties.Listed.Value,
+		"packageContent": registrationPackageContent(e),
+		"published":      formatISO8601Time(e.Properties.Published.Value),
+		"registration":   registrationURL(id + `/index.json`),
+	}
+}
+
+// registrationCatalogEntry is the metadata of a version, the fields of a catalog
+// PackageDetails leaf as of now
+func registrationCatalogEntry(e *NugetPackageEntry) map[string]interface{} {
+	p := e.Properties
+	b, _ := json.Marshal(newCatalogMetadata(e))
+	var entry map[string]interface{}
+	json.Unmarshal(b, &entry)
+	entry["@id"] = registrationURL(strings.ToLower(p.ID) + `/` + versions.Key(p.Version) + `.json#catalogEntry`)
+	entry["@type"] = "PackageDetails"
+	entry["id"] = p.ID
+	entry["version"] = versions.Normalize(p.Version)
+	entry["published"] = formatISO8601Time(p.Published.Value)
+	entry["packageContent"] = registrationPackageContent(e)
+	if u := readmeURL(e); u != "" {
+		entry["readmeUrl"] = u
+	}
+
+	// Retired IDs are deprecated in favour of their replacement
+	if p.DeprecationMessage != "" {
+		d := map[string]interface{}{
+			"reasons": []string{"Legacy"},
+			"message": p.DeprecationMessage,
+		}
+		if p.AlternatePackageID != "" {
+			d["alternatePackage"] = map[string]interface{}{"id": p.AlternatePackageID, "range": "*"}
+		}
+		entry["deprecation"] = d
+	}
+	return entry
+}
+
+// registrationPackageContent is the flat container URL of a version's nupkg
+func registrationPackageContent(e *NugetPackageEntry) string {
+	id := strings.ToLower(e.Properties.ID)
+	ver := versions.Key(e.Properties.Version)
+	return flatContainerURL(id + `/` + ver + `/` + id + `.` + ver + `.nupkg`)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Shown for versions pushed without release notes
+const noReleaseNotes = "No release notes."
+
+// packageChangelog is every version of a package with its release notes, newest first
+type packageChangelog struct {
+	ID       string             `json:"id"`
+	Versions []changelogVersion `json:"versions"`
+}
+
+type changelogVersion struct {
+	Version      string             `json:"version"`
+	Published    time.Time          `json:"published"`
+	Listed       bool               `json:"listed"`
+	ReleaseNotes string             `json:"releaseNotes"`
+	Added        []changelogPackage `json:"dependenciesAdded"`
+	Removed      []changelogPackage `json:"dependenciesRemoved"`
+}
+
+// changelogPackage is a dependency as listed in a changelog
+type changelogPackage struct {
+	ID        string `json:"id"`
+	Range     string `json:"range,omitempty"`
+	Framework string `json:"framework,omitempty"`
+}
+
+// changelogCache keeps assembled changelogs until the feed next changes, for each
+// set of packages keys can see
+var changelogCache struct {
+	lock       sync.Mutex
+	changed    time.Time
+	changelogs map[string]*packageChangelog
+}
+
+// currentChangelog returns the cached changelog of a package, assembling it if
+// packages have changed. It returns nil if the package doesn't exist.
+func currentChangelog(ctx context.Context, id string) (*packageChangelog, error) {
+	changelogCache.lock.Lock()
+	defer changelogCache.lock.Unlock()
+
+	changed := server.fs.LastChanged(ctx)
+	if changelogCache.changelogs == nil || !changed.Equal(changelogCache.changed) {
+		changelogCache.changelogs = make(map[string]*packageChangelog)
+		changelogCache.changed = changed
+	}
+	key := contextViewer(ctx).scope() + "/" + strings.ToLower(id)
+	if cl, ok := changelogCache.changelogs[key]; ok {
+		return cl, nil
+	}
+
+	entries, err := allPackageEntries(ctx, server.fs, id)
+	if err != nil {
+		return nil, err
+	}
+	cl := assembleChangelog(entries)
+	changelogCache.changelogs[key] = cl
+	return cl, nil
+}
+
+// assembleChangelog orders a package's versions newest first, noting how each
+// one's dependencies differ from the version before it
+func assembleChangelog(entries []*NugetPackageEntry) *packageChangelog {
+	if len(entries) == 0 {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return versions.Compare(entries[i].Properties.Version, entries[j].Properties.Version) < 0
+	})
+
+	cl := &packageChangelog{ID: entries[0].Properties.ID}
+	var prev []changelogPackage
+	for _, e := range entries {
+		deps := parseDependencies(e.Properties.Dependencies)
+		v := changelogVersion{
+			Version:      e.Properties.Version,
+			Published:    e.Properties.Published.Value,
+			Listed:       e.Properties.Listed.Value,
+			ReleaseNotes: e.Properties.ReleaseNotes.Value,
+			Added:        diffDependencies(deps, prev),
+			Removed:      diffDependencies(prev, deps),
+		}
+		if v.ReleaseNotes == "" {
+			v.ReleaseNotes = noReleaseNotes
+		}
+		cl.Versions = append(cl.Versions, v)
+		prev = deps
+	}
+
+	// Newest first
+	for i, j := 0, len(cl.Versions)-1; i < j; i, j = i+1, j-1 {
+		cl.Versions[i], cl.Versions[j] = cl.Versions[j], cl.Versions[i]
+	}
+	return cl
+}
+
+// parseDependencies splits the V2 id:range:framework|... dependency format
+func parseDependencies(s string) []changelogPackage {
+	var deps []changelogPackage
+	for _, d := range strings.Split(s, "|") {
+		x := strings.SplitN(d, ":", 3)
+		if x[0] == "" {
+			continue
+		}
+		dep := changelogPackage{ID: x[0]}
+		if len(x) > 1 {
+			dep.Range = x[1]
+		}
+		if len(x) > 2 {
+			dep.Framework = x[2]
+		}
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// diffDependencies returns the dependencies in a not in b. A dependency whose
+// range changed is in both lists, as removed at the old range and added at the new.
+func diffDependencies(a []changelogPackage, b []changelogPackage) []changelogPackage {
+	out := []changelogPackage{}
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if strings.EqualFold(x.ID, y.ID) && x.Range == y.Range && strings.EqualFold(x.Framework, y.Framework) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// changelogMarkdown renders a changelog for embedding in a wiki
+func changelogMarkdown(cl *packageChangelog) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s changelog\n", cl.ID)
+	for _, v := range cl.Versions {
+		fmt.Fprintf(&b, "\n## %s", v.Version)
+		if !v.Published.IsZero() {
+			fmt.Fprintf(&b, " (%s)", v.Published.UTC().Format("2006-01-02"))
+		}
+		if !v.Listed {
+			b.WriteString(" - unlisted")
+		}
+		b.WriteString("\n\n")
+		if v.ReleaseNotes == noReleaseNotes {
+			b.WriteString("_" + noReleaseNotes + "_\n")
+		} else {
+			b.WriteString(strings.TrimSpace(v.ReleaseNotes) + "\n")
+		}
+		writeMarkdownDependencies(&b, "Dependencies added", v.Added)
+		writeMarkdownDependencies(&b, "Dependencies removed", v.Removed)
+	}
+	return b.Bytes()
+}
+
+func writeMarkdownDependencies(b *bytes.Buffer, title string, deps []changelogPackage) {
+	if len(deps) == 0 {
+		return
+	}
+	b.WriteString("\n**" + title + ":**\n\n")
+	for _, d := range deps {
+		b.WriteString("- `" + d.ID)
+		if d.Range != "" {
+			b.WriteString(" " + d.Range)
+		}
+		b.WriteString("`")
+		if d.Framework != "" {
+			b.WriteString(" (" + d.Framework + ")")
+		}
+		b.WriteString("\n")
+	}
+}
+
+func serveChangelog(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting api/packages/{id}/changelog[?format=md]
+	id := strings.TrimSuffix(r.URL.Path[len(server.URL.Path+`api/packages/`):], `/changelog`)
+	if id == "" || strings.Contains(id, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	cl, err := currentChangelog(r.Context(), id)
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if cl == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var b []byte
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "md", "markdown":
+		b = changelogMarkdown(cl)
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	case "", "json":
+		if b, err = json.Marshal(cl); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("format must be json or md"))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
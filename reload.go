@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/thatgitsam/go-nuget-server/hooks"
+)
+
+// Config returns the current configuration. It may be swapped for a new one by
+// a reload at any time, so callers should fetch it once per use rather than keep it.
+func (s *Server) Config() *Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.config
+}
+
+// PushChain returns the interceptors pushes currently run through
+func (s *Server) PushChain() hooks.Chain {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.pushChain
+}
+
+// validateConfig checks settings that can't be fixed up at runtime
+func validateConfig(c *Config) error {
+	for _, k := range append(append([]string{}, c.FileStore.APIKeys.ReadOnly...), c.FileStore.APIKeys.ReadWrite...) {
+		if strings.TrimSpace(k) == "" {
+			return errors.New("api-keys must not contain empty or blank keys")
+		}
+	}
+	for _, g := range c.Moderation.PackageIDs {
+		if _, err := path.Match(g, ""); err != nil {
+			return errors.New("moderation package-ids contains an invalid glob: " + g)
+		}
+	}
+	for _, g := range c.Mirroring.LicenseAcceptanceAllowed {
+		if _, err := path.Match(g, ""); err != nil {
+			return errors.New("mirroring license-acceptance-allowed contains an invalid glob: " + g)
+		}
+	}
+	if c.SnapshotTTL != "" {
+		if _, err := time.ParseDuration(c.SnapshotTTL); err != nil {
+			return errors.New("snapshot-ttl is not a valid duration: " + c.SnapshotTTL)
+		}
+	}
+	if c.ShareMaxTTL != "" {
+		if d, err := time.ParseDuration(c.ShareMaxTTL); err != nil || d <= 0 {
+			return errors.New("share-max-ttl is not a valid duration: " + c.ShareMaxTTL)
+		}
+	}
+	if c.DownloadDedupWindow != "" {
+		if _, err := time.ParseDuration(c.DownloadDedupWindow); err != nil {
+			return errors.New("download-dedup-window is not a valid duration: " + c.DownloadDedupWindow)
+		}
+	}
+	if c.DownloadResumeWindow != "" {
+		if _, err := time.ParseDuration(c.DownloadResumeWindow); err != nil {
+			return errors.New("download-resume-window is not a valid duration: " + c.DownloadResumeWindow)
+		}
+	}
+	if err := validateReadLockTimeout(c); err != nil {
+		return err
+	}
+	if err := validateRuleNames(c); err != nil {
+		return err
+	}
+	if err := validateIDPolicies(c); err != nil {
+		return err
+	}
+	if err := validateVisibility(c); err != nil {
+		return err
+	}
+	if err := validateCrawlers(c); err != nil {
+		return err
+	}
+	if err := validateTelemetry(c); err != nil {
+		return err
+	}
+	if err := validateVersionLimits(c); err != nil {
+		return err
+	}
+	if err := validateIdempotency(c); err != nil {
+		return err
+	}
+	if err := validateAdminGRPC(c); err != nil {
+		return err
+	}
+	if err := validateDeleteMode(c); err != nil {
+		return err
+	}
+	if _, err := newPushChain(c); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReloadConfig re-reads the config file and applies the settings that are safe to
+// change at runtime (API keys, log level, moderation, UI options, content types).
+// The host URL and filestore settings are kept as they were at startup. The new
+// config is validated and swapped in whole, so requests never see a partially
+// applied config. On error the current config is left in place.
+func (s *Server) ReloadConfig() error {
+	c, _, err := readConfig(s.configFile)
+	if err != nil {
+		return err
+	}
+	if err := validateConfig(c); err != nil {
+		return err
+	}
+	chain, err := newPushChain(c)
+	if err != nil {
+		return err
+	}
+
+	// Keep the settings that need a restart
+	old := s.Config()
+	if c.HostURL != old.HostURL {
+		log.Println("WARNING: host-url changes need a restart to apply")
+	}
+	if c.FileStore.Type != old.FileStore.Type || c.FileStore.RepoDIR != old.FileStore.RepoDIR ||
+		c.FileStore.BucketName != old.FileStore.BucketName || c.FileStore.ProjectID != old.FileStore.ProjectID {
+		log.Println("WARNING: filestore location changes need a restart to apply")
+	}
+	if c.AdminGRPCAddress != old.AdminGRPCAddress {
+		log.Println("WARNING: admin-grpc-address changes need a restart to apply")
+	}
+	c.HostURL = old.HostURL
+	c.FileStore.Type = old.FileStore.Type
+	c.FileStore.RepoDIR = old.FileStore.RepoDIR
+	c.FileStore.BucketName = old.FileStore.BucketName
+	c.FileStore.ProjectID = old.FileStore.ProjectID
+	c.FileStore.ChangeLogMaxRecords = old.FileStore.ChangeLogMaxRecords
+	c.SkipTokenKey = old.SkipTokenKey
+	c.SnapshotTTL = old.SnapshotTTL
+	c.AdminGRPCAddress = old.AdminGRPCAddress
+
+	s.configLock.Lock()
+	s.config = c
+	s.pushChain = chain
+	s.configLock.Unlock()
+
+	log.Printf("Configuration reloaded from %q", s.configFile)
+	return nil
+}
+
+// watchConfig reloads the config on SIGHUP, and when the file changes if an interval is set
+func (s *Server) watchConfig(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var modTime time.Time
+	if interval > 0 {
+		if f, err := os.Stat(s.configFile); err == nil {
+			modTime = f.ModTime()
+		}
+		tick = time.NewTicker(interval).C
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading configuration")
+		case <-tick:
+			f, err := os.Stat(s.configFile)
+			if err != nil || !f.ModTime().After(modTime) {
+				continue
+			}
+			modTime = f.ModTime()
+		}
+		if err := s.ReloadConfig(); err != nil {
+			log.Println("Error reloading configuration, keeping current:", err)
+		}
+	}
+}
+
+func serveReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if err := server.ReloadConfig(); err != nil {
+		b := []byte(err.Error())
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(b)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rewriteConfig changes a test server's config file, without applying it
+func rewriteConfig(t *testing.T, ts *testServer, change func(c *Config)) {
+	t.Helper()
+	cf := filepath.Join(ts.Dir, "config.json")
+	b, err := ioutil.ReadFile(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := defaultConfig()
+	if err := json.Unmarshal(b, c); err != nil {
+		t.Fatal(err)
+	}
+	change(c)
+	if b, err = json.Marshal(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cf, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadRotatesKeys(t *testing.T) {
+	ts := newTestServer(t, nil)
+	reload := func(key string) (int, string) {
+		t.Helper()
+		return readResponse(t, ts.do(t, http.MethodPost, "admin/reload-config", key, nil, nil))
+	}
+	read := func(key string) int {
+		t.Helper()
+		status, _ := readResponse(t, ts.do(t, http.MethodGet, "Packages()", key, nil, nil))
+		return status
+	}
+	push := func(key string, ver string) int {
+		t.Helper()
+		status, _ := readResponse(t, ts.pushTo(t, "api/v2/package/", key, testPackage(t, "Reload.Pkg", ver, "", nil)))
+		return status
+	}
+	if read(testReadKey) != http.StatusOK || push(testWriteKey, "1.0.0") != http.StatusCreated {
+		t.Fatal("the keys in the config don't work before the reload")
+	}
+
+	rewriteConfig(t, ts, func(c *Config) {
+		c.FileStore.APIKeys.ReadOnly = []string{"new-read"}
+		c.FileStore.APIKeys.ReadWrite = []string{"new-write"}
+		c.Loglevel = 2
+	})
+	status, body := reload(testWriteKey)
+	wantStatus(t, "reload", status, body, http.StatusNoContent)
+
+	// The old keys stop working at once, the new ones start
+	if got := read(testReadKey); got != http.StatusForbidden {
+		t.Errorf("old read key: got %d, want 403", got)
+	}
+	if got := push(testWriteKey, "2.0.0"); got != http.StatusForbidden {
+		t.Errorf("old write key: got %d, want 403", got)
+	}
+	if got := read("new-read"); got != http.StatusOK {
+		t.Errorf("new read key: got %d, want 200", got)
+	}
+	if got := push("new-read", "2.0.0"); got != http.StatusForbidden {
+		t.Errorf("new read key pushing: got %d, want 403", got)
+	}
+	if got := push("new-write", "2.0.0"); got != http.StatusCreated {
+		t.Errorf("new write key: got %d, want 201", got)
+	}
+	if server.Config().Loglevel != 2 {
+		t.Errorf("log-level %d after the reload, want 2", server.Config().Loglevel)
+	}
+
+	// A config that doesn't validate is refused and the current one kept
+	rewriteConfig(t, ts, func(c *Config) {
+		c.FileStore.APIKeys.ReadWrite = []string{"newer-write", " "}
+	})
+	status, body = reload("new-write")
+	wantStatus(t, "reload of a bad config", status, body, http.StatusBadRequest)
+	if !strings.Contains(body, "api-keys") {
+		t.Errorf("reload of a bad config: got %q, want the problem named", body)
+	}
+	if got := push("new-write", "3.0.0"); got != http.StatusCreated {
+		t.Errorf("write key after a refused reload: got %d, want 201", got)
+	}
+	if got := read("newer-write"); got != http.StatusForbidden {
+		t.Errorf("key from the refused config: got %d, want 403", got)
+	}
+
+	// Settings that need a restart keep their startup values
+	rewriteConfig(t, ts, func(c *Config) {
+		c.FileStore.APIKeys.ReadWrite = []string{"new-write"}
+		c.FileStore.RepoDIR = filepath.Join(ts.Dir, "elsewhere")
+		c.HostURL = "http://elsewhere.example/feed/"
+	})
+	status, body = reload("new-write")
+	wantStatus(t, "reload moving the store", status, body, http.StatusNoContent)
+	if c := server.Config(); c.FileStore.RepoDIR != ts.Root || c.HostURL != ts.Feed {
+		t.Errorf("store %q at %q after the reload, want %q at %q", c.FileStore.RepoDIR, c.HostURL, ts.Root, ts.Feed)
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "Packages()", "new-read", nil, nil))
+	wantStatus(t, "feed", status, body, http.StatusOK)
+	if got := feedIDs(t, body); len(got) != 3 {
+		t.Errorf("feed after the reload has %q, want the three versions pushed", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// resolveCandidate is a hosted version and why the resolver did or didn't consider it
+type resolveCandidate struct {
+	Version    string `json:"version"`
+	Listed     bool   `json:"listed"`
+	Prerelease bool   `json:"prerelease"`
+	Included   bool   `json:"included"`
+	Reason     string `json:"reason"`
+}
+
+// resolveResult is what a client restoring the range would get from the feed
+type resolveResult struct {
+	ID         string             `json:"id"`
+	Range      string             `json:"range"`
+	Prerelease bool               `json:"prerelease"`
+	Selected   *string            `json:"selected"`
+	Candidates []resolveCandidate `json:"candidates"`
+	Error      string             `json:"error,omitempty"`
+}
+
+func serveResolve(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting api/resolve?id=Foo&range=[1.2.0,2.0.0)&prerelease=false
+	q := r.URL.Query()
+	res := resolveResult{ID: q.Get("id"), Range: q.Get("range"), Candidates: []resolveCandidate{}}
+	if res.ID == "" || res.Range == "" {
+		res.Error = "id and range are required"
+		writeResolveJSON(w, http.StatusBadRequest, &res)
+		return
+	}
+	if p := q.Get("prerelease"); p != "" {
+		var err error
+		if res.Prerelease, err = strconv.ParseBool(p); err != nil {
+			res.Error = "prerelease must be true or false"
+			writeResolveJSON(w, http.StatusBadRequest, &res)
+			return
+		}
+	}
+	vr, err := parseVersionRange(res.Range)
+	if err != nil {
+		res.Error = err.Error()
+		writeResolveJSON(w, http.StatusBadRequest, &res)
+		return
+	}
+
+	entries, err := allPackageEntries(r.Context(), server.fs, res.ID)
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		res.Error = "package not found"
+		writeResolveJSON(w, http.StatusNotFound, &res)
+		return
+	}
+	res.ID = entries[0].Properties.ID
+	sort.Slice(entries, func(i, j int) bool {
+		return versions.Compare(entries[i].Properties.Version, entries[j].Properties.Version) < 0
+	})
+
+	// Apply the same rules a client sees through the feed
+	snap := requestSnapshot(r)
+	exact := vr.Min != "" && vr.Min == vr.Max
+	for _, e := range entries {
+		v := e.Properties.Version
+		c := resolveCandidate{Version: v, Listed: e.Properties.Listed.Value, Prerelease: versions.IsPrerelease(v)}
+		switch {
+		case snap != nil && !snap.Contains(e.Properties.ID, v):
+			c.Reason = "not in snapshot"
+		case !vr.Satisfies(v):
+			c.Reason = "outside range"
+		case versions.IsSemVer2(v) && !requestSemVer2(r):
+			c.Reason = "SemVer 2.0.0 version and semVerLevel=2.0.0 not requested"
+		case c.Prerelease && !res.Prerelease && !vr.AllowsPrerelease():
+			c.Reason = "prerelease not requested"
+		case !c.Listed && !exact:
+			c.Reason = "unlisted"
+		case !c.Listed:
+			c.Included, c.Reason = true, "unlisted, but the range pins it exactly"
+		default:
+			c.Included, c.Reason = true, "in range"
+		}
+		res.Candidates = append(res.Candidates, c)
+	}
+
+	// Clients take the lowest version in a range, or the highest for a floating one
+	for i := range res.Candidates {
+		c := &res.Candidates[i]
+		if !c.Included {
+			continue
+		}
+		if res.Selected == nil || vr.Floating {
+			v := c.Version
+			res.Selected = &v
+		}
+	}
+
+	writeResolveJSON(w, http.StatusOK, &res)
+}
+
+func writeResolveJSON(w http.ResponseWriter, status int, res *resolveResult) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(status)
+	w.Write(b)
+}
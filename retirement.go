@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name retired package IDs are kept under in the filestore
+const retiredIDsSetting = "retired-ids"
+
+// How long retirements read from the store are trusted before being read again, so
+// changes made by other instances apply
+const retirementRefresh = 10 * time.Second
+
+// Message shown for a retired ID if none is given
+const defaultRetirementMessage = "This package is no longer maintained."
+
+// Retirement changes kept in the history, oldest dropped first
+const maxRetirementHistory = 1000
+
+// packageRetirement retires a package ID, pointing its consumers at a replacement
+type packageRetirement struct {
+	ID            string    `json:"id"`
+	ReplacementID string    `json:"replacementId,omitempty"`
+	Message       string    `json:"message"`
+	Retired       time.Time `json:"retired"`
+}
+
+// pushError is why a push of the retired ID is refused
+func (rt *packageRetirement) pushError() string {
+	msg := "package id " + rt.ID + " is retired"
+	if rt.ReplacementID != "" {
+		msg += ", use " + rt.ReplacementID + " instead"
+	}
+	return msg + ". " + rt.Message
+}
+
+// retirementEvent records an ID being retired or brought back
+type retirementEvent struct {
+	Action        string `json:"action"`
+	ID            string `json:"id"`
+	ReplacementID string `json:"replacementId,omitempty"`
+	Message       string `json:"message,omitempty"`
+	// Hash of the API key that made the change, not the key itself
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+// retiredIDs are the retired package IDs by lower case ID, with the changes made
+type retiredIDs struct {
+	Packages map[string]*packageRetirement `json:"packages"`
+	History  []retirementEvent             `json:"history"`
+}
+
+// retiringFileStore marks every version of a retired package ID as deprecated, with
+// the replacement to use. It wraps the store every route uses, so feeds, searches and
+// the UI all show it.
+type retiringFileStore struct {
+	fileStore
+	lock    sync.Mutex
+	loaded  time.Time
+	ids     *retiredIDs
+	raw     []byte
+	changed time.Time
+}
+
+// retired returns the retired IDs, read from the store at most every retirementRefresh
+func (fs *retiringFileStore) retired(ctx context.Context) (*retiredIDs, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.ids != nil && time.Since(fs.loaded) < retirementRefresh {
+		return fs.ids, nil
+	}
+	ri, b, err := fs.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fs.loaded = time.Now()
+	if fs.ids == nil || !bytes.Equal(b, fs.raw) {
+		fs.changed = ri.lastChanged()
+	}
+	fs.ids = ri
+	fs.raw = b
+	return ri, nil
+}
+
+// lastChanged returns when the newest change in the history was made, so feeds
+// don't look changed just because a server has started
+func (ri *retiredIDs) lastChanged() time.Time {
+	var t time.Time
+	for _, ev := range ri.History {
+		if ev.Time.After(t) {
+			t = ev.Time
+		}
+	}
+	return t
+}
+
+// read reads the retired IDs from the store. The lock must be held.
+func (fs *retiringFileStore) read(ctx context.Context) (*retiredIDs, []byte, error) {
+	ri := &retiredIDs{}
+	b, err := fs.fileStore.GetSetting(ctx, retiredIDsSetting)
+	if err == nil {
+		if err := json.Unmarshal(b, ri); err != nil {
+			return nil, nil, err
+		}
+	} else if err != ErrFileNotFound && err != ErrNotSupported {
+		return nil, nil, err
+	}
+	if ri.Packages == nil {
+		ri.Packages = make(map[string]*packageRetirement)
+	}
+	if ri.History == nil {
+		ri.History = []retirementEvent{}
+	}
+	return ri, b, nil
+}
+
+// retirementOf returns a package ID's retirement, nil if it isn't retired
+func (fs *retiringFileStore) retirementOf(ctx context.Context, id string) (*packageRetirement, error) {
+	ri, err := fs.retired(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ri.Packages[strings.ToLower(id)], nil
+}
+
+// setRetirement retires an ID, or brings it back if rt is nil, recording who did
+// it in the history. It returns ErrFileNotFound to bring back an ID that isn't retired.
+func (fs *retiringFileStore) setRetirement(ctx context.Context, id string, rt *packageRetirement, key string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	// Always start from the stored copy so edits by other instances aren't lost
+	ri, _, err := fs.read(ctx)
+	if err != nil {
+		return err
+	}
+	k := sha256.Sum256([]byte(key))
+	ev := retirementEvent{ID: id, Key: hex.EncodeToString(k[:8]), Time: time.Now().UTC()}
+	if rt == nil {
+		old, ok := ri.Packages[strings.ToLower(id)]
+		if !ok {
+			return ErrFileNotFound
+		}
+		ev.Action, ev.ID = "restore", old.ID
+		delete(ri.Packages, strings.ToLower(id))
+	} else {
+		ev.Action, ev.ReplacementID, ev.Message = "retire", rt.ReplacementID, rt.Message
+		ri.Packages[strings.ToLower(id)] = rt
+	}
+	ri.History = append(ri.History, ev)
+	if len(ri.History) > maxRetirementHistory {
+		ri.History = ri.History[len(ri.History)-maxRetirementHistory:]
+	}
+
+	b, err := json.MarshalIndent(ri, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fs.fileStore.PutSetting(ctx, retiredIDsSetting, b); err != nil {
+		return err
+	}
+	fs.ids = ri
+	fs.raw = b
+	fs.loaded = time.Now()
+	fs.changed = ev.Time
+	log.Printf("Package id %s: %s by key %s", ev.ID, ev.Action, ev.Key)
+	return nil
+}
+
+// deprecate returns copies of the entries of retired IDs marked deprecated, and the
+// others as they are
+func (fs *retiringFileStore) deprecate(ctx context.Context, entries []*NugetPackageEntry) ([]*NugetPackageEntry, error) {
+	ri, err := fs.retired(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(ri.Packages) == 0 {
+		return entries, nil
+	}
+	list := make([]*NugetPackageEntry, 0, len(entries))
+	for _, e := range entries {
+		if rt, ok := ri.Packages[strings.ToLower(e.Properties.ID)]; ok {
+			c := *e
+			c.Properties.DeprecationMessage = rt.Message
+			c.Properties.AlternatePackageID = rt.ReplacementID
+			e = &c
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+func (fs *retiringFileStore) GetPackageEntry(ctx context.Context, id string, ver string) (*NugetPackageEntry, error) {
+	npe, err := fs.fileStore.GetPackageEntry(ctx, id, ver)
+	if err != nil {
+		return nil, err
+	}
+	list, err := fs.deprecate(ctx, []*NugetPackageEntry{npe})
+	if err != nil {
+		return nil, err
+	}
+	return list[0], nil
+}
+
+func (fs *retiringFileStore) GetPackageFeedEntries(ctx context.Context, id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+	page, more, err := fs.fileStore.GetPackageFeedEntries(ctx, id, startAfter, max)
+	if err != nil {
+		return nil, false, err
+	}
+	page, err = fs.deprecate(ctx, page)
+	return page, more, err
+}
+
+// LastChanged includes retirements, as they change what feeds show
+func (fs *retiringFileStore) LastChanged(ctx context.Context) time.Time {
+	t := fs.fileStore.LastChanged(ctx)
+	if _, err := fs.retired(ctx); err != nil {
+		return t
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.changed.After(t) {
+		return fs.changed
+	}
+	return t
+}
+
+// replacementEntry returns the latest version of a retired ID's replacement, for
+// FindPackagesById to list after the retired ID's own versions, or nil if there is
+// none to show
+func replacementEntry(ctx context.Context, id string) (*NugetPackageEntry, error) {
+	if !server.Config().RetiredIDs.IncludeReplacement {
+		return nil, nil
+	}
+	rt, err := server.retirement.retirementOf(ctx, id)
+	if err != nil || rt == nil || rt.ReplacementID == "" {
+		return nil, err
+	}
+	ver, err := latestVersion(ctx, rt.ReplacementID)
+	if err == ErrFileNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	npe, err := server.fs.GetPackageEntry(ctx, rt.ReplacementID, ver)
+	if err == ErrFileNotFound {
+		return nil, nil
+	}
+	return npe, err
+}
+
+// retirementRequest is the body of PUT admin/packages/{id}/retire
+type retirementRequest struct {
+	ReplacementID string `json:"replacementId"`
+	Message       string `json:"message"`
+}
+
+// retirementInfo is an ID's retirement as served by admin/packages/{id}/retire
+type retirementInfo struct {
+	ID string `json:"id"`
+	// Null once the ID is brought back
+	Retirement *packageRetirement `json:"retirement"`
+	History    []retirementEvent  `json:"history"`
+}
+
+func serveRetirement(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting admin/packages/{id}/retire
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`admin/packages`):], `/`), `/`)
+	if len(x) != 2 || x[0] == "" || x[1] != "retire" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := x[0]
+
+	switch r.Method {
+	case http.MethodPut, http.MethodDelete:
+		// Retiring an ID is governed by the same ID policies as publishing it
+		if err := checkIDPolicy(r, id); err != nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var req retirementRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			writeRetirementError(w, "body must be {\"replacementId\": \"...\", \"message\": \"...\"}")
+			return
+		}
+		req.ReplacementID = strings.TrimSpace(req.ReplacementID)
+		if req.Message = strings.TrimSpace(req.Message); req.Message == "" {
+			req.Message = defaultRetirementMessage
+		}
+		if strings.EqualFold(req.ReplacementID, id) {
+			writeRetirementError(w, "a package id can't be replaced by itself")
+			return
+		}
+		if req.ReplacementID != "" {
+			if rt, err := server.retirement.retirementOf(r.Context(), req.ReplacementID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			} else if rt != nil {
+				writeRetirementError(w, "replacement "+req.ReplacementID+" is itself retired")
+				return
+			}
+		}
+
+		// Keep the ID as pushed if there are versions
+		if entries, err := allPackageEntries(r.Context(), server.fs, id); err == nil && len(entries) > 0 {
+			id = entries[0].Properties.ID
+		}
+		rt := &packageRetirement{ID: id, ReplacementID: req.ReplacementID, Message: req.Message, Retired: time.Now().UTC()}
+		if err := server.retirement.setRetirement(r.Context(), id, rt, requestAPIKey(r)); err == ErrBusy {
+			writeBusy(w)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		err := server.retirement.setRetirement(r.Context(), id, nil, requestAPIKey(r))
+		if err == ErrFileNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err == ErrBusy {
+			writeBusy(w)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The retirement, with the changes made to the ID
+	ri, err := server.retirement.retired(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info := retirementInfo{ID: id, Retirement: ri.Packages[strings.ToLower(id)], History: []retirementEvent{}}
+	for _, ev := range ri.History {
+		if strings.EqualFold(ev.ID, id) {
+			info.History = append(info.History, ev)
+		}
+	}
+	if info.Retirement == nil && len(info.History) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if info.Retirement != nil {
+		info.ID = info.Retirement.ID
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// writeRetirementError explains why a retirement was refused
+func writeRetirementError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(msg))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A retired ID takes no more pushes, shows its replacement in every feed and can
+// be brought back
+func TestRetirement(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.RetiredIDs.IncludeReplacement = true })
+	ts.mustPush(t, testPackage(t, "Old.Utils", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "New.Utils", "2.0.0", "", nil))
+	retire := func(method string, id string, body string) (int, string) {
+		return readResponse(t, ts.do(t, method, "admin/packages/"+id+"/retire", testWriteKey, strings.NewReader(body), nil))
+	}
+	info := func(id string) retirementInfo {
+		t.Helper()
+		status, body := readResponse(t, ts.do(t, http.MethodGet, "admin/packages/"+id+"/retire", testWriteKey, nil, nil))
+		wantStatus(t, "retirement of "+id, status, body, http.StatusOK)
+		var ri retirementInfo
+		if err := json.Unmarshal([]byte(body), &ri); err != nil {
+			t.Fatal(err)
+		}
+		return ri
+	}
+
+	// What can't be retired
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "admin/packages/Old.Utils/retire", testWriteKey, nil, nil))
+	wantStatus(t, "never retired", status, body, http.StatusNotFound)
+	for _, tc := range []struct {
+		body   string
+		status int
+		err    string
+	}{
+		{`{"replacementId": "OLD.UTILS"}`, http.StatusBadRequest, "can't be replaced by itself"},
+		{`not json`, http.StatusBadRequest, "body must be"},
+	} {
+		status, body := retire(http.MethodPut, "Old.Utils", tc.body)
+		wantStatus(t, tc.body, status, body, tc.status)
+		if !strings.Contains(body, tc.err) {
+			t.Errorf("%s: got %q, want %q", tc.body, body, tc.err)
+		}
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodPut, "admin/packages/Old.Utils/retire", testReadKey, strings.NewReader(`{}`), nil))
+	if status == http.StatusOK {
+		t.Errorf("retire with a read key: got %d %s", status, body)
+	}
+
+	status, body = retire(http.MethodPut, "old.utils", `{"replacementId": "New.Utils", "message": " Renamed "}`)
+	wantStatus(t, "retire", status, body, http.StatusOK)
+	ri := info("Old.Utils")
+	if ri.ID != "Old.Utils" || ri.Retirement == nil || ri.Retirement.ReplacementID != "New.Utils" || ri.Retirement.Message != "Renamed" ||
+		len(ri.History) != 1 || ri.History[0].Action != "retire" || ri.History[0].Key == "" || strings.Contains(body, testWriteKey) {
+		t.Errorf("retired: got %s", body)
+	}
+	// A retired replacement is refused
+	status, body = retire(http.MethodPut, "Other.Utils", `{"replacementId": "Old.Utils"}`)
+	wantStatus(t, "replaced by a retired id", status, body, http.StatusBadRequest)
+
+	// Pushes of any version are refused with the replacement
+	status, body = ts.push(t, testPackage(t, "OLD.Utils", "1.1.0", "", nil))
+	wantStatus(t, "push of a retired id", status, body, http.StatusGone)
+	var res uploadResult
+	if err := json.Unmarshal([]byte(body), &res); err != nil || res.Error != "package id Old.Utils is retired, use New.Utils instead. Renamed" {
+		t.Errorf("push of a retired id: got %s", body)
+	}
+
+	// Its versions stay downloadable and every feed says what replaces them
+	status, body = ts.get(t, "nupkg/Old.Utils/1.0.0")
+	wantStatus(t, "download", status, body, http.StatusOK)
+	for _, tc := range []struct {
+		p    string
+		want []string
+	}{
+		{"Packages(Id='Old.Utils',Version='1.0.0')", []string{"<d:DeprecationMessage>Renamed</d:DeprecationMessage>", "<d:AlternatePackageId>New.Utils</d:AlternatePackageId>"}},
+		{"Packages()?$format=json&$filter=Id eq 'Old.Utils'", []string{`"DeprecationMessage":"Renamed"`, `"AlternatePackageId":"New.Utils"`}},
+		{"v3/registration/old.utils/index.json", []string{`"deprecation":{`, `"message":"Renamed"`, `"alternatePackage":{"id":"New.Utils","range":"*"}`}},
+		// With include-replacement the replacement follows the old ID's versions
+		{"FindPackagesById()?id='Old.Utils'", []string{"Version='1.0.0'", "Packages(Id='New.Utils',Version='2.0.0')"}},
+	} {
+		status, body := ts.get(t, strings.Replace(tc.p, " ", "%20", -1))
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		for _, w := range tc.want {
+			if !strings.Contains(body, w) {
+				t.Errorf("%s: no %s in %s", tc.p, w, body)
+			}
+		}
+	}
+	status, body = ts.get(t, "FindPackagesById()?id='New.Utils'")
+	wantStatus(t, "replacement", status, body, http.StatusOK)
+	if strings.Contains(body, "DeprecationMessage>") {
+		t.Errorf("the replacement is deprecated: %s", body)
+	}
+
+	// Brought back, it takes pushes again and the history keeps both changes
+	status, body = retire(http.MethodDelete, "OLD.UTILS", "")
+	wantStatus(t, "restore", status, body, http.StatusNoContent)
+	ts.mustPush(t, testPackage(t, "Old.Utils", "1.1.0", "", nil))
+	for _, p := range []string{"Packages(Id='Old.Utils',Version='1.0.0')", "FindPackagesById()?id='Old.Utils'"} {
+		status, body := ts.get(t, p)
+		wantStatus(t, p, status, body, http.StatusOK)
+		if strings.Contains(body, "DeprecationMessage>") || strings.Contains(body, "New.Utils") {
+			t.Errorf("%s after restoring: %s", p, body)
+		}
+	}
+	if ri := info("Old.Utils"); ri.Retirement != nil || len(ri.History) != 2 || ri.History[1].Action != "restore" || ri.History[1].ID != "Old.Utils" {
+		t.Errorf("restored: got %+v", ri)
+	}
+	status, body = retire(http.MethodDelete, "Old.Utils", "")
+	wantStatus(t, "restore again", status, body, http.StatusNotFound)
+
+	// Retirements are kept in the store
+	status, body = retire(http.MethodPut, "Old.Utils", `{}`)
+	wantStatus(t, "retire again", status, body, http.StatusOK)
+	ts.restart(t)
+	if ri := info("Old.Utils"); ri.Retirement == nil || ri.Retirement.Message != defaultRetirementMessage || len(ri.History) != 3 {
+		t.Errorf("after a restart: got %+v", ri)
+	}
+}
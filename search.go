@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results returned by Search() unless $top asks for fewer or more
+const defaultSearchTop = 30
+
+// searchQuery is a parsed search term. Besides free text, terms of the form
+// tags:automation, author:"Platform Team" and id:Foo restrict matches to that field.
+type searchQuery struct {
+	Terms   []string
+	Tags    []string
+	Authors []string
+	IDs     []string
+}
+
+// parseSearchQuery splits a search term on spaces, keeping "quoted phrases" together
+func parseSearchQuery(s string) *searchQuery {
+	q := &searchQuery{}
+	for _, tok := range splitSearchTokens(s) {
+		field, value := "", tok
+		if i := strings.Index(tok, ":"); i > 0 {
+			field, value = strings.ToLower(tok[:i]), strings.Trim(tok[i+1:], `"`)
+		}
+		if value == "" {
+			continue
+		}
+		value = strings.ToLower(value)
+		switch field {
+		case "tag", "tags":
+			q.Tags = append(q.Tags, value)
+		case "author", "authors":
+			q.Authors = append(q.Authors, value)
+		case "id", "packageid":
+			q.IDs = append(q.IDs, value)
+		default:
+			q.Terms = append(q.Terms, strings.ToLower(strings.Trim(tok, `"`)))
+		}
+	}
+	return q
+}
+
+// splitSearchTokens splits on whitespace outside of double quotes
+func splitSearchTokens(s string) []string {
+	var toks []string
+	var cur strings.Builder
+	quoted := false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			cur.WriteRune(c)
+		case (c == ' ' || c == '\t') && !quoted:
+			if cur.Len() > 0 {
+				toks = append(toks, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	if cur.Len() > 0 {
+		toks = append(toks, cur.String())
+	}
+	return toks
+}
+
+// splitTags splits nuspec tags, which may be separated by spaces or commas
+func splitTags(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool { return c == ' ' || c == ',' || c == '\t' })
+}
+
+// splitAuthors splits a nuspec's comma separated authors
+func splitAuthors(s string) []string {
+	var authors []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			authors = append(authors, a)
+		}
+	}
+	return authors
+}
+
+// Matches reports whether a package entry satisfies every part of the query
+func (q *searchQuery) Matches(e *NugetPackageEntry) bool {
+	tags := make(map[string]bool)
+	for _, t := range splitTags(e.Properties.Tags) {
+		tags[strings.ToLower(t)] = true
+	}
+	for _, t := range q.Tags {
+		if !tags[t] {
+			return false
+		}
+	}
+
+	for _, a := range q.Authors {
+		found := false
+		for _, ea := range splitAuthors(e.Author.Name) {
+			if strings.ToLower(ea) == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, id := range q.IDs {
+		if strings.ToLower(e.Properties.ID) != id {
+			return false
+		}
+	}
+
+	text := strings.ToLower(strings.Join([]string{e.Properties.ID, e.Properties.Title, e.Properties.Description, e.Properties.Tags}, " "))
+	for _, t := range q.Terms {
+		if !strings.Contains(text, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func serveSearch(w http.ResponseWriter, r *http.Request) {
+
+	setDataServiceVersion(w, r)
+
+	expand, err := parseExpand(r)
+	if err != nil {
+		writeODataError(w, r, err.(*odataError))
+		return
+	}
+	inlineCount, err := requestInlineCount(r)
+	if err != nil {
+		writeODataError(w, r, err.(*odataError))
+		return
+	}
+
+	// Expecting Search()?searchTerm='tags:automation'&targetFramework='net472'&includePrerelease=false&$skip=0&$top=30
+	v := r.URL.Query()
+	q := parseSearchQuery(strings.Trim(v.Get("searchTerm"), `'`))
+	frameworks := parseFrameworkFilter(strings.Trim(v.Get("targetFramework"), `'`))
+	prerelease := strings.EqualFold(v.Get("includePrerelease"), "true")
+	skip, _, err := requestSkip(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	top, err := requestTop(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if top < 0 {
+		top = defaultSearchTop
+	}
+
+	server.fs.UpdateCountsInMemory()
+	entries, err := allPackageEntries(r.Context(), server.fs, "")
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The index narrows down which packages can match, each is still checked in full.
+	// It covers everything the key can see, so is updated before any filtering.
+	candidates, indexed := searchCandidates(r.Context(), entries, q)
+	if snap := requestSnapshot(r); snap != nil {
+		entries = snap.Filter(entries)
+	}
+	entries = filterSemVer2(r, entries)
+
+	// Only the latest version of each package is a search result
+	var results []*NugetPackageEntry
+	for _, e := range entries {
+		latest := e.Properties.IsLatestVersion.Value
+		if prerelease {
+			latest = e.Properties.IsAbsoluteLatestVersion.Value
+		}
+		if !latest || (indexed && !candidates[searchIndexKey(e)]) {
+			continue
+		}
+		if q.Matches(e) && frameworks.Matches(e) {
+			results = append(results, e)
+		}
+	}
+	// Sorted by ID unless $orderby asks otherwise, as Visual Studio's "DownloadCount desc,Id"
+	order := parseFeedOrder(v.Get("$orderby"))
+	if len(order) == 0 {
+		order = feedOrder{{Property: "Id"}}
+	}
+	sortFeedEntries(results, order)
+
+	// Search()/$count and $inlinecount are of every result, not just this page
+	total := len(results)
+	if isCountPath(r.URL.Path) {
+		serveFeedCount(w, r, total, nil)
+		return
+	}
+	if skip > len(results) {
+		skip = len(results)
+	}
+	results = results[skip:]
+	if top < len(results) {
+		results = results[:top]
+	}
+	results = withGalleryURLs(results)
+	results = deterministicEntries(r, results)
+	results = expandEntries(results, expand)
+
+	if f := requestedFeedFormat(r); f != feedFormatAtom {
+		renderJSONFeed(w, f, results, "", false)
+		return
+	}
+
+	nf := NewNugetFeed("Search", server.URL.String())
+	nf.SetUpdated(server.fs.LastChanged(r.Context()))
+	nf.Packages = results
+	if inlineCount {
+		nf.Count = &total
+	}
+	b := nf.ToBytes()
+
+	w.Header().Set("Content-Type", "application/atom+xml;type=feed;charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// facetCount is a tag or author and how many packages have it
+type facetCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// feedFacets are the distinct tags and authors across the latest version of each package
+type feedFacets struct {
+	Tags    []facetCount `json:"tags"`
+	Authors []facetCount `json:"authors"`
+}
+
+// facetCache keeps the facets until the feed next changes, for each set of
+// packages keys can see
+var facetCache struct {
+	lock    sync.Mutex
+	changed time.Time
+	facets  map[string]*feedFacets
+}
+
+// currentFacets returns the cached facets, recomputing them if packages have changed
+func currentFacets(ctx context.Context) (*feedFacets, error) {
+	facetCache.lock.Lock()
+	defer facetCache.lock.Unlock()
+
+	changed := server.fs.LastChanged(ctx)
+	if facetCache.facets == nil || !changed.Equal(facetCache.changed) {
+		facetCache.facets = make(map[string]*feedFacets)
+		facetCache.changed = changed
+	}
+	scope := contextViewer(ctx).scope()
+	if f, ok := facetCache.facets[scope]; ok {
+		return f, nil
+	}
+
+	entries, err := allPackageEntries(ctx, server.fs, "")
+	if err != nil {
+		return nil, err
+	}
+	f := computeFacets(entries)
+	facetCache.facets[scope] = f
+	return f, nil
+}
+
+// computeFacets counts tags and authors case insensitively over the latest versions,
+// naming each by the first spelling seen
+func computeFacets(entries []*NugetPackageEntry) *feedFacets {
+	tags := newFacetCounter()
+	authors := newFacetCounter()
+	for _, e := range entries {
+		if !e.Properties.IsAbsoluteLatestVersion.Value {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, t := range splitTags(e.Properties.Tags) {
+			if !seen[strings.ToLower(t)] {
+				seen[strings.ToLower(t)] = true
+				tags.add(t)
+			}
+		}
+		for _, a := range splitAuthors(e.Author.Name) {
+			authors.add(a)
+		}
+	}
+	return &feedFacets{Tags: tags.sorted(), Authors: authors.sorted()}
+}
+
+type facetCounter struct {
+	counts map[string]*facetCount
+}
+
+func newFacetCounter() *facetCounter {
+	return &facetCounter{counts: make(map[string]*facetCount)}
+}
+
+func (fc *facetCounter) add(name string) {
+	k := strings.ToLower(name)
+	if c, ok := fc.counts[k]; ok {
+		c.Count++
+		return
+	}
+	fc.counts[k] = &facetCount{Name: name, Count: 1}
+}
+
+// sorted returns the counts, most common first
+func (fc *facetCounter) sorted() []facetCount {
+	list := []facetCount{}
+	for _, c := range fc.counts {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+	return list
+}
+
+func serveFacets(w http.ResponseWriter, r *http.Request) {
+	f, err := currentFacets(r.Context())
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
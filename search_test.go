@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want searchQuery
+	}{
+		{"", searchQuery{}},
+		{"Logging", searchQuery{Terms: []string{"logging"}}},
+		{"tags:Automation", searchQuery{Tags: []string{"automation"}}},
+		{`author:"Platform Team" json`, searchQuery{Terms: []string{"json"}, Authors: []string{"platform team"}}},
+		{`tag:a tags:b id:Foo.Bar`, searchQuery{Tags: []string{"a", "b"}, IDs: []string{"foo.bar"}}},
+		{`"two words"  tags:`, searchQuery{Terms: []string{"two words"}}},
+	} {
+		if got := parseSearchQuery(tc.in); !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tc.in, *got, tc.want)
+		}
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	got := splitTags("automation, qsys,plugin  lua")
+	if want := []string{"automation", "qsys", "plugin", "lua"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSearchFacets(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Facet.One", "1.0.0", "<tags>automation qsys</tags>", nil))
+	ts.mustPush(t, testPackage(t, "Facet.Two", "1.0.0", "<tags>Automation,lua</tags>", nil))
+
+	facets := func() feedFacets {
+		t.Helper()
+		status, body := ts.get(t, "api/facets")
+		wantStatus(t, "facets", status, body, http.StatusOK)
+		var f feedFacets
+		if err := json.Unmarshal([]byte(body), &f); err != nil {
+			t.Fatal(err)
+		}
+		// Tags are named by whichever spelling was seen first
+		for i := range f.Tags {
+			f.Tags[i].Name = strings.ToLower(f.Tags[i].Name)
+		}
+		return f
+	}
+	f := facets()
+	if want := []facetCount{{"automation", 2}, {"lua", 1}, {"qsys", 1}}; !reflect.DeepEqual(f.Tags, want) {
+		t.Errorf("tags = %v, want %v", f.Tags, want)
+	}
+	if want := []facetCount{{"Tester", 2}}; !reflect.DeepEqual(f.Authors, want) {
+		t.Errorf("authors = %v, want %v", f.Authors, want)
+	}
+
+	// Facets follow packages being added and removed
+	ts.mustPush(t, testPackage(t, "Facet.Three", "1.0.0", "<tags>lua</tags>", nil))
+	status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Facet.One/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete", status, body, http.StatusNoContent)
+	f = facets()
+	if want := []facetCount{{"lua", 2}, {"automation", 1}}; !reflect.DeepEqual(f.Tags, want) {
+		t.Errorf("tags = %v, want %v", f.Tags, want)
+	}
+
+	t.Run("search", func(t *testing.T) {
+		status, body := ts.get(t, "Search()?searchTerm='tags:LUA'")
+		wantStatus(t, "search", status, body, http.StatusOK)
+		if ids := feedIDs(t, body); !reflect.DeepEqual(ids, []string{"Facet.Three 1.0.0", "Facet.Two 1.0.0"}) {
+			t.Errorf("got %v", ids)
+		}
+		status, body = ts.get(t, "Search()?searchTerm='tags:lua'&$skip=1&$top=1")
+		wantStatus(t, "search", status, body, http.StatusOK)
+		if ids := feedIDs(t, body); !reflect.DeepEqual(ids, []string{"Facet.Two 1.0.0"}) {
+			t.Errorf("page 2: got %v", ids)
+		}
+	})
+
+	t.Run("bad paging", func(t *testing.T) {
+		for _, q := range []string{"$skip=-1", "$skip=x", "$top=-1", "$top=x"} {
+			status, body := ts.get(t, "Search()?searchTerm=''&"+q)
+			wantStatus(t, q, status, body, http.StatusBadRequest)
+		}
+	})
+}
+
+// Search() finds the latest version of each package whose ID, title, description
+// or tags hold every term, in pages sorted by ID
+func TestSearchRoutes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, p := range []struct{ id, ver, metadata string }{
+		{"Search.Lighting", "1.0.0", "<title>Room Lighting</title><tags>lights dimmer</tags>"},
+		{"Search.Lighting", "2.0.0", "<title>Room Lighting</title><tags>lights dimmer</tags>"},
+		{"Search.Audio", "1.0.0", "<tags>dsp mixer</tags>"},
+		{"Search.Audio", "1.1.0-beta", "<tags>dsp mixer</tags>"},
+		{"Other.Thing", "1.0.0", ""},
+		{"Beta.Only", "0.1.0-alpha", "<title>Lighting prototype</title>"},
+		{"Search.Hidden", "1.0.0", ""},
+	} {
+		ts.mustPush(t, testPackage(t, p.id, p.ver, p.metadata, nil))
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Search.Hidden/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	all := []string{"Other.Thing 1.0.0", "Search.Audio 1.0.0", "Search.Lighting 2.0.0"}
+	for _, tc := range []struct {
+		p    string
+		want []string
+	}{
+		{"Search()", all},
+		{"Search()?searchTerm=''", all},
+		{"api/v2/Search()?searchTerm=''", all},
+		// As nuget.exe list asks
+		{"Search()?searchTerm='search'&targetFramework=''&includePrerelease=false&$skip=0&$top=30", []string{"Search.Audio 1.0.0", "Search.Lighting 2.0.0"}},
+		// Terms match the ID, title, description and tags whatever the case, quoted or not
+		{"Search()?searchTerm='LIGHTING'", []string{"Search.Lighting 2.0.0"}},
+		{"Search()?searchTerm=lighting", []string{"Search.Lighting 2.0.0"}},
+		{"Search()?searchTerm='room'", []string{"Search.Lighting 2.0.0"}},
+		// Each term is matched on its own, a quoted phrase as a whole
+		{"Search()?searchTerm='of other'", []string{"Other.Thing 1.0.0"}},
+		{"Search()?searchTerm='\"other of\"'", nil},
+		{"Search()?searchTerm='Dimmer'", []string{"Search.Lighting 2.0.0"}},
+		{"Search()?searchTerm='search mixer'", []string{"Search.Audio 1.0.0"}},
+		{"Search()?searchTerm='nothing-matches'", nil},
+		// Unlisted versions are never results
+		{"Search()?searchTerm='hidden'", nil},
+		// With prereleases the latest of any kind is the result
+		{"Search()?searchTerm='lighting'&includePrerelease=true", []string{"Beta.Only 0.1.0-alpha", "Search.Lighting 2.0.0"}},
+		{"Search()?searchTerm='dsp'&includePrerelease=True", []string{"Search.Audio 1.1.0-beta"}},
+		{"Search()?searchTerm='dsp'&includePrerelease=yes", []string{"Search.Audio 1.0.0"}},
+		// Paging
+		{"Search()?searchTerm=''&$skip=1&$top=1", []string{"Search.Audio 1.0.0"}},
+		{"Search()?searchTerm=''&$skip=2", []string{"Search.Lighting 2.0.0"}},
+		{"Search()?searchTerm=''&$skip=10", nil},
+		{"Search()?searchTerm=''&$top=0", nil},
+		// Ordering
+		{"Search()?searchTerm=''&$orderby=Id desc", []string{"Search.Lighting 2.0.0", "Search.Audio 1.0.0", "Other.Thing 1.0.0"}},
+		{"Search()?searchTerm=''&includePrerelease=true&$orderby=Version desc,Id&$top=2", []string{"Search.Lighting 2.0.0", "Search.Audio 1.1.0-beta"}},
+	} {
+		status, body := ts.get(t, strings.ReplaceAll(tc.p, " ", "%20"))
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		if ids := feedIDs(t, body); !reflect.DeepEqual(ids, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.p, ids, tc.want)
+		}
+		if strings.Contains(body, `rel="next"`) {
+			t.Errorf("%s: search pages have no next link: %s", tc.p, body)
+		}
+	}
+
+	// The JSON formats list the same results
+	for _, tc := range []struct {
+		header http.Header
+		p      string
+	}{
+		{nil, "Search()?searchTerm='search'&$format=json"},
+		{http.Header{"Accept": {"application/json;odata.metadata=minimal"}}, "Search()?searchTerm='search'"},
+	} {
+		status, body := readResponse(t, ts.do(t, http.MethodGet, tc.p, testReadKey, nil, tc.header))
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		var feed struct {
+			D struct {
+				Results []struct{ Id, Version string } `json:"results"`
+			} `json:"d"`
+			Value []struct{ Id, Version string } `json:"value"`
+		}
+		if err := json.Unmarshal([]byte(body), &feed); err != nil {
+			t.Fatalf("%s: %v", tc.p, err)
+		}
+		var ids []string
+		for _, r := range append(feed.D.Results, feed.Value...) {
+			ids = append(ids, r.Id+" "+r.Version)
+		}
+		if want := []string{"Search.Audio 1.0.0", "Search.Lighting 2.0.0"}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("%s: got %q, want %q", tc.p, ids, want)
+		}
+	}
+
+	// Without a $top a page holds the default number of results
+	t.Run("default top", func(t *testing.T) {
+		ts := newTestServer(t, nil)
+		for i := 0; i <= defaultSearchTop; i++ {
+			ts.mustPush(t, testPackage(t, fmt.Sprintf("Many.Pkg%02d", i), "1.0.0", "", nil))
+		}
+		status, body := ts.get(t, "Search()?searchTerm='many'")
+		wantStatus(t, "search", status, body, http.StatusOK)
+		if ids := feedIDs(t, body); len(ids) != defaultSearchTop || ids[0] != "Many.Pkg00 1.0.0" {
+			t.Errorf("got %d results %q, want the first %d", len(ids), ids, defaultSearchTop)
+		}
+		status, body = ts.get(t, fmt.Sprintf("Search()?searchTerm='many'&$skip=%d", defaultSearchTop))
+		wantStatus(t, "search", status, body, http.StatusOK)
+		if ids := feedIDs(t, body); !reflect.DeepEqual(ids, []string{fmt.Sprintf("Many.Pkg%02d 1.0.0", defaultSearchTop)}) {
+			t.Errorf("second page: got %q", ids)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Query words whose matching versions an index keeps before starting over
+const maxSearchWordsKept = 1024
+
+// searchIndex maps the words in the ID, title, description and tags of the latest
+// versions of packages to the versions they appear in. Search uses it to pick out
+// the versions that can match a term before checking them with searchQuery.Matches,
+// so results are the same as scanning every package. Autocomplete uses the IDs it
+// holds, every ID with a listed version, to find those starting with a prefix.
+type searchIndex struct {
+	// Text each version was indexed with, by searchIndexKey
+	docs map[string]string
+	// Token to the versions it appears in
+	postings map[string]map[string]bool
+	// Lower case ID to the number of its versions indexed
+	idCounts map[string]int
+	// The IDs of idCounts sorted, nil until next needed after a change
+	ids []string
+	// Versions with a token containing a query word, kept until the next update as
+	// typeahead asks for much the same words again and again
+	containing map[string]map[string]bool
+}
+
+// searchIndexes keeps an index for each set of packages keys can see, brought up
+// to date when the feed changes
+var searchIndexes struct {
+	lock    sync.Mutex
+	changed time.Time
+	// Set by a reindex, which may not move LastChanged
+	stale   bool
+	indexes map[string]*searchIndex
+}
+
+// invalidateSearchIndexes drops every index, they're rebuilt by the next search
+func invalidateSearchIndexes() {
+	searchIndexes.lock.Lock()
+	defer searchIndexes.lock.Unlock()
+	searchIndexes.stale = true
+}
+
+func searchIndexKey(e *NugetPackageEntry) string {
+	return versionKey(e.Properties.ID, e.Properties.Version)
+}
+
+// searchText is the text search terms are matched against
+func searchText(e *NugetPackageEntry) string {
+	return strings.Join([]string{e.Properties.ID, e.Properties.Title, e.Properties.Description, e.Properties.Tags}, " ")
+}
+
+// searchTokens splits text into lower case words at anything that isn't a letter
+// or digit, adding the camelCase parts of each word, e.g. "QSys.HttpClient" gives
+// qsys, q, sys, httpclient, http and client
+func searchTokens(s string) []string {
+	var toks []string
+	for _, w := range strings.FieldsFunc(s, func(c rune) bool { return !unicode.IsLetter(c) && !unicode.IsDigit(c) }) {
+		toks = append(toks, strings.ToLower(w))
+		parts := splitCamelCase(w)
+		if len(parts) > 1 {
+			for _, p := range parts {
+				toks = append(toks, strings.ToLower(p))
+			}
+		}
+	}
+	return toks
+}
+
+// splitCamelCase splits a word where lower case or digits meet upper case, and
+// before the last capital of a run followed by lower case (HTTPClient is HTTP Client)
+func splitCamelCase(w string) []string {
+	r := []rune(w)
+	var parts []string
+	start := 0
+	for i := 1; i < len(r); i++ {
+		if !unicode.IsUpper(r[i]) {
+			continue
+		}
+		if !unicode.IsUpper(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1])) {
+			parts = append(parts, string(r[start:i]))
+			start = i
+		}
+	}
+	return append(parts, string(r[start:]))
+}
+
+// searchCandidates returns the versions among entries, everything a context's key
+// can see, that can match a query, as searchIndex.candidates does. The index is
+// updated from entries if the feed has changed.
+func searchCandidates(ctx context.Context, entries []*NugetPackageEntry, q *searchQuery) (map[string]bool, bool) {
+	searchIndexes.lock.Lock()
+	defer searchIndexes.lock.Unlock()
+	return currentSearchIndex(ctx, entries).candidates(q)
+}
+
+// autocompleteCandidates returns the lower case IDs among entries, everything a
+// context's key can see, that start with a lower case prefix and have a listed
+// version. The index is updated from entries if the feed has changed.
+func autocompleteCandidates(ctx context.Context, entries []*NugetPackageEntry, prefix string) map[string]bool {
+	searchIndexes.lock.Lock()
+	defer searchIndexes.lock.Unlock()
+	return currentSearchIndex(ctx, entries).idsWithPrefix(prefix)
+}
+
+// currentSearchIndex returns the index of the packages a context's key can see,
+// entries, with searchIndexes locked
+func currentSearchIndex(ctx context.Context, entries []*NugetPackageEntry) *searchIndex {
+	changed := server.fs.LastChanged(ctx)
+	if searchIndexes.indexes == nil || searchIndexes.stale {
+		searchIndexes.indexes = make(map[string]*searchIndex)
+		searchIndexes.stale = false
+	}
+	scope := contextViewer(ctx).scope()
+	idx, ok := searchIndexes.indexes[scope]
+	if !changed.Equal(searchIndexes.changed) {
+		// Bring this scope's index up to date, the others are rebuilt when next used
+		for s := range searchIndexes.indexes {
+			if s != scope {
+				delete(searchIndexes.indexes, s)
+			}
+		}
+		if ok {
+			idx.update(entries)
+		}
+	}
+	if !ok {
+		idx = newSearchIndex()
+		idx.update(entries)
+		searchIndexes.indexes[scope] = idx
+	}
+	searchIndexes.changed = changed
+	return idx
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{docs: make(map[string]string), postings: make(map[string]map[string]bool), idCounts: make(map[string]int)}
+}
+
+// update indexes the latest versions among entries, only retokenizing versions
+// that are new or whose text changed and dropping ones no longer latest
+func (idx *searchIndex) update(entries []*NugetPackageEntry) {
+	idx.containing = make(map[string]map[string]bool)
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if !e.Properties.IsLatestVersion.Value && !e.Properties.IsAbsoluteLatestVersion.Value {
+			continue
+		}
+		key := searchIndexKey(e)
+		seen[key] = true
+		text := searchText(e)
+		if old, ok := idx.docs[key]; ok {
+			if old == text {
+				continue
+			}
+			idx.remove(key)
+		}
+		idx.docs[key] = text
+		if id := strings.ToLower(e.Properties.ID); idx.idCounts[id] == 0 {
+			idx.ids = nil
+			idx.idCounts[id] = 1
+		} else {
+			idx.idCounts[id]++
+		}
+		for _, t := range searchTokens(text) {
+			if idx.postings[t] == nil {
+				idx.postings[t] = make(map[string]bool)
+			}
+			idx.postings[t][key] = true
+		}
+	}
+	for key := range idx.docs {
+		if !seen[key] {
+			idx.remove(key)
+		}
+	}
+}
+
+// remove drops a version from the index
+func (idx *searchIndex) remove(key string) {
+	for _, t := range searchTokens(idx.docs[key]) {
+		delete(idx.postings[t], key)
+		if len(idx.postings[t]) == 0 {
+			delete(idx.postings, t)
+		}
+	}
+	delete(idx.docs, key)
+	id := key[:strings.LastIndex(key, "/")]
+	if idx.idCounts[id]--; idx.idCounts[id] <= 0 {
+		delete(idx.idCounts, id)
+		idx.ids = nil
+	}
+}
+
+// idsWithPrefix returns the lower case IDs indexed that start with a lower case
+// prefix
+func (idx *searchIndex) idsWithPrefix(prefix string) map[string]bool {
+	if idx.ids == nil {
+		idx.ids = make([]string, 0, len(idx.idCounts))
+		for id := range idx.idCounts {
+			idx.ids = append(idx.ids, id)
+		}
+		sort.Strings(idx.ids)
+	}
+	found := make(map[string]bool)
+	for i := sort.SearchStrings(idx.ids, prefix); i < len(idx.ids) && strings.HasPrefix(idx.ids[i], prefix); i++ {
+		found[idx.ids[i]] = true
+	}
+	return found
+}
+
+// candidates returns the versions that can match a query's free text terms. It
+// returns false if the index can't narrow them down, for a query without terms
+// or with a quoted phrase, and every version has to be checked.
+func (idx *searchIndex) candidates(q *searchQuery) (map[string]bool, bool) {
+	if len(q.Terms) == 0 {
+		return nil, false
+	}
+	var sets []map[string]bool
+	for _, term := range q.Terms {
+		if strings.IndexFunc(term, unicode.IsSpace) >= 0 {
+			return nil, false
+		}
+		// A term's words each lie within one word of any text containing it
+		words := strings.FieldsFunc(term, func(c rune) bool { return !unicode.IsLetter(c) && !unicode.IsDigit(c) })
+		if len(words) == 0 {
+			return nil, false
+		}
+		for _, w := range words {
+			sets = append(sets, idx.versionsContaining(w))
+		}
+	}
+	// Intersected smallest first, so each step only looks at what's left
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	set := make(map[string]bool, len(sets[0]))
+	for k := range sets[0] {
+		set[k] = true
+	}
+	for _, s := range sets[1:] {
+		for k := range set {
+			if !s[k] {
+				delete(set, k)
+			}
+		}
+	}
+	return set, true
+}
+
+// versionsContaining returns the versions with a token containing a word
+func (idx *searchIndex) versionsContaining(w string) map[string]bool {
+	if keys, ok := idx.containing[w]; ok {
+		return keys
+	}
+	keys := make(map[string]bool)
+	for t, tk := range idx.postings {
+		if strings.Contains(t, w) {
+			for k := range tk {
+				keys[k] = true
+			}
+		}
+	}
+	if len(idx.containing) >= maxSearchWordsKept {
+		idx.containing = make(map[string]map[string]bool)
+	}
+	idx.containing[w] = keys
+	return keys
+}
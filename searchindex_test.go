@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Words the generated packages are described with
+var searchTestWords = []string{"http", "client", "json", "parser", "lua", "control", "audio", "video", "camera", "mixer",
+	"plugin", "driver", "logging", "crypto", "sha512", "utf-8", "日本語", "café", "naïve", "x64"}
+
+// searchTestEntries returns n packages of up to three versions each, made up the
+// same way for a seed, with their latest versions flagged as the store flags them
+func searchTestEntries(n int, seed int64) []*NugetPackageEntry {
+	rnd := rand.New(rand.NewSource(seed))
+	word := func() string { return searchTestWords[rnd.Intn(len(searchTestWords))] }
+	var entries []*NugetPackageEntry
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("Vendor%d.%s%sKit.Pkg%d", i%37, strings.Title(word()), strings.ToUpper(word()[:1]), i)
+		for v := 1; v <= 1+rnd.Intn(3); v++ {
+			e := &NugetPackageEntry{}
+			e.Properties.ID = id
+			e.Properties.Version = fmt.Sprintf("%d.0.0", v)
+			if rnd.Intn(4) == 0 {
+				e.Properties.Version += "-beta." + fmt.Sprint(v)
+				e.Properties.IsPrerelease.Value = true
+			}
+			e.Properties.Listed.Value = rnd.Intn(8) != 0
+			e.Properties.Title = strings.Title(word()) + " " + word()
+			// A paragraph, as descriptions usually are
+			for s := 0; s < 5; s++ {
+				e.Properties.Description += fmt.Sprintf("A %s for %s, with %s-%s support and the %s of a %s. ", word(), word(), word(), word(), word(), word())
+			}
+			e.Properties.Description += fmt.Sprintf("Model%d.", rnd.Intn(1000))
+			e.Properties.Tags = word() + " " + word()
+			entries = append(entries, e)
+		}
+	}
+	fs := &fileStoreLocal{packages: entries}
+	fs.RecalculateLatestVersions()
+	return entries
+}
+
+// scanSearch returns the versions Search() returns for a query by checking every
+// package, as it did before the index
+func scanSearch(entries []*NugetPackageEntry, q *searchQuery, prerelease bool) []string {
+	var keys []string
+	for _, e := range entries {
+		latest := e.Properties.IsLatestVersion.Value
+		if prerelease {
+			latest = e.Properties.IsAbsoluteLatestVersion.Value
+		}
+		if latest && q.Matches(e) {
+			keys = append(keys, searchIndexKey(e))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// indexSearch returns the versions Search() returns for a query using the index
+func indexSearch(idx *searchIndex, entries []*NugetPackageEntry, q *searchQuery, prerelease bool) []string {
+	candidates, indexed := idx.candidates(q)
+	var keys []string
+	for _, e := range entries {
+		latest := e.Properties.IsLatestVersion.Value
+		if prerelease {
+			latest = e.Properties.IsAbsoluteLatestVersion.Value
+		}
+		if !latest || (indexed && !candidates[searchIndexKey(e)]) {
+			continue
+		}
+		if q.Matches(e) {
+			keys = append(keys, searchIndexKey(e))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scanAutocomplete returns the lower case IDs with a listed version starting with
+// a prefix, by checking every package
+func scanAutocomplete(entries []*NugetPackageEntry, prefix string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, e := range entries {
+		if id := strings.ToLower(e.Properties.ID); e.Properties.Listed.Value && strings.HasPrefix(id, prefix) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// The index finds the same packages as a scan, as packages change too
+func TestSearchIndexMatchesScan(t *testing.T) {
+	entries := searchTestEntries(2000, 1)
+	idx := newSearchIndex()
+	idx.update(entries)
+
+	queries := []string{"http", "HTTP", "client", "httpclient", "kit", "pkg12", "vendor3", "vendor3.", "vendor3.http",
+		"json parser", "sha", "sha512", "utf", "utf-8", "日本", "café", "cafe", "x6", "tags:lua", "tag:mixer camera",
+		"id:vendor1.httpjkit.pkg1", "\"for audio\"", "\"audio, with\"", "nothing-matches", "", ".", "-beta", "model42", "model4 lua"}
+	prefixes := []string{"", "v", "vendor1", "vendor1.", "vendor12.audio", "VENDOR2", "vendor36.", "vendor37", "z"}
+	check := func(stage string) {
+		t.Helper()
+		for _, s := range queries {
+			q := parseSearchQuery(s)
+			for _, prerelease := range []bool{false, true} {
+				want, got := scanSearch(entries, q, prerelease), indexSearch(idx, entries, q, prerelease)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: search %q prerelease %v: index found %d, scan %d", stage, s, prerelease, len(got), len(want))
+				}
+			}
+		}
+		for _, p := range prefixes {
+			p = strings.ToLower(p)
+			if want, got := scanAutocomplete(entries, p), idx.idsWithPrefix(p); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: autocomplete %q: index found %d, scan %d", stage, p, len(got), len(want))
+			}
+		}
+	}
+	check("built")
+
+	// Change some text, unlist and relist some versions and remove some packages
+	rnd := rand.New(rand.NewSource(2))
+	var kept []*NugetPackageEntry
+	for _, e := range entries {
+		switch rnd.Intn(10) {
+		case 0:
+			e.Properties.Description = "now about a " + searchTestWords[rnd.Intn(len(searchTestWords))]
+		case 1:
+			e.Properties.Listed.Value = !e.Properties.Listed.Value
+		case 2:
+			continue
+		}
+		kept = append(kept, e)
+	}
+	entries = kept
+	fs := &fileStoreLocal{packages: entries}
+	fs.RecalculateLatestVersions()
+	idx.update(entries)
+	check("updated")
+
+	// Everything removed
+	entries = nil
+	idx.update(entries)
+	check("emptied")
+	if len(idx.docs) != 0 || len(idx.postings) != 0 || len(idx.idCounts) != 0 {
+		t.Errorf("emptied index holds %d docs, %d tokens and %d IDs", len(idx.docs), len(idx.postings), len(idx.idCounts))
+	}
+}
+
+// Searching 20,000 packages, by scanning them or through the index as it is
+// between changes to the feed
+func BenchmarkSearch(b *testing.B) {
+	entries := searchTestEntries(20000, 1)
+	q := parseSearchQuery("model42 parser")
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanSearch(entries, q, false)
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		idx := newSearchIndex()
+		idx.update(entries)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			indexSearch(idx, entries, q, false)
+		}
+	})
+	b.Run("build", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			newSearchIndex().update(entries)
+		}
+	})
+}
+
+// Autocompleting among 20,000 packages as an ID is typed
+func BenchmarkAutocomplete(b *testing.B) {
+	entries := searchTestEntries(20000, 1)
+	prefixes := []string{"v", "ve", "vendor1", "vendor12", "vendor12.", "vendor12.j"}
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanAutocomplete(entries, prefixes[i%len(prefixes)])
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		idx := newSearchIndex()
+		idx.update(entries)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			idx.idsWithPrefix(prefixes[i%len(prefixes)])
+		}
+	})
+}
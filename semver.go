@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// versionKey identifies a version of a package in maps and caches, the same for
+// every way of writing the id and version
+func versionKey(id string, ver string) string {
+	return strings.ToLower(id) + "/" + versions.Key(ver)
+}
+
+// requestSemVer2 reports whether the client sent semVerLevel=2.0.0 (or higher),
+// meaning SemVer 2.0.0 versions may be included in the feed
+func requestSemVer2(r *http.Request) bool {
+	l := strings.Trim(r.URL.Query().Get("semVerLevel"), `'`)
+	if i := strings.Index(l, "."); i >= 0 {
+		l = l[:i]
+	}
+	n, err := strconv.Atoi(l)
+	return err == nil && n >= 2
+}
+
+// filterSemVer2 drops SemVer 2.0.0 versions from entries unless the client asked for them
+func filterSemVer2(r *http.Request, entries []*NugetPackageEntry) []*NugetPackageEntry {
+	if requestSemVer2(r) {
+		return entries
+	}
+	var filtered []*NugetPackageEntry
+	for _, e := range entries {
+		if !versions.IsSemVer2(e.Properties.Version) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
@@ -1,52 +1,232 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"net/url"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/thatgitsam/go-nuget-server/hooks"
 )
 
 // Config represents the config file
 type Config struct {
-	Loglevel  int    `json:"log-level"`
-	HostURL   string `json:"host-url"`
-	FileStore struct {
+	Loglevel int    `json:"log-level"`
+	HostURL  string `json:"host-url"`
+	// Key used to sign continuation tokens (random per start if empty)
+	SkipTokenKey string `json:"skiptoken-key"`
+	// Key used to sign share links (generated and kept in the filestore if empty)
+	ShareKey string `json:"share-key"`
+	// Longest lifetime of a share link, e.g. "168h" (default 7 days)
+	ShareMaxTTL string `json:"share-max-ttl"`
+	// Accept unsigned 'id','version' continuation tokens (deprecated)
+	LegacySkipTokens bool `json:"legacy-skiptokens"`
+	// Lifetime of feed snapshots, e.g. "24h"
+	SnapshotTTL string `json:"snapshot-ttl"`
+	// Require a read level API key for the _www pages as well as the feed
+	WWWRequireKey bool `json:"www-require-key"`
+	// Require a read level API key for the service document and $metadata,
+	// which are open by default so remote repository health checks can probe them
+	ServiceRootRequireKey bool `json:"service-root-require-key"`
+	// Ignore repeat downloads of a version by the same client within this, e.g. "1m" (off if empty)
+	DownloadDedupWindow string `json:"download-dedup-window"`
+	// Responses for a version a client was just served taken as the same download resumed or retried, e.g. "30s" (default 30s, "0" counts each)
+	DownloadResumeWindow string `json:"download-resume-window"`
+	// Downloads queued for counting before further ones are dropped (default 1024)
+	DownloadQueueSize int `json:"download-queue-size"`
+	// Most entries in a Packages() or FindPackagesById() page, whatever $top asks for (default 100)
+	MaxPageSize int `json:"max-page-size"`
+	// Entries above which JSON feeds and change lists are streamed without a Content-Length (default 1000)
+	StreamJSONEntries int `json:"stream-json-entries"`
+	// How long feed reads wait on a busy store before answering 503, e.g. "2s" (default 2s, "0" waits forever)
+	ReadLockTimeout string `json:"read-lock-timeout"`
+	// Largest push request body accepted, in bytes (no limit if 0)
+	MaxUploadBytes int64 `json:"max-upload-bytes"`
+	// Parts of a multipart push taken before it is refused (default 5)
+	MaxUploadParts int `json:"max-upload-parts"`
+	// Largest file the UI will preview inline
+	UIPreviewMaxBytes int `json:"ui-preview-max-bytes"`
+	// Largest readme the UI renders in full, longer ones are cut short
+	UIReadmeMaxBytes int `json:"ui-readme-max-bytes"`
+	// Report abuse link for each package, {id} and {version} are replaced. Relative
+	// URLs are resolved against host-url
+	ReportAbuseURL string `json:"report-abuse-url"`
+	// Content types by file extension (e.g. ".qsys"), overriding the built in ones
+	ContentTypes map[string]string `json:"content-types"`
+	// How often to check the config file for changes, e.g. "10s" (off if empty)
+	ConfigWatchInterval string `json:"config-watch-interval"`
+	// How long admin responses are kept for retries with the same Idempotency-Key, e.g. "1h" (default 24h)
+	IdempotencyWindow string `json:"idempotency-window"`
+	// Address the gRPC admin API listens on, e.g. "127.0.0.1:9090" (off if empty)
+	AdminGRPCAddress string `json:"admin-grpc-address"`
+	// What DELETE api/v2/package/{id}/{version} does: "hard" removes the version (default), "unlist" unlists it
+	DeleteMode string `json:"delete-mode"`
+	// Versions DELETE refuses with a 409 and a summary of their impact, unless ?force=true
+	DeleteProtection struct {
+		// The latest version of a package
+		Latest bool `json:"latest"`
+		// The only version satisfying a hosted package's dependency range
+		SoleSatisfier bool `json:"sole-satisfier"`
+	} `json:"delete-protection"`
+	// Package IDs whose V3 registration and flat container documents are kept rendered (default 1000)
+	V3CacheIDs int `json:"v3-cache-ids"`
+	FileStore  struct {
 		// Type can be 'gcp'|'local'
 		Type string `json:"type"`
 		// Options for 'local'
 		RepoDIR string `json:"local-directory"`
+		// How packages are laid out in local-directory, 'hierarchical' (default) or 'flat'
+		Layout string `json:"layout"`
+		// Records kept in the replica change log before compaction
+		ChangeLogMaxRecords int `json:"changelog-max-records"`
+		// Set when several instances share the local directory (e.g. over NFS)
+		SharedStorage bool `json:"shared-storage"`
+		// Seconds between checks for changes made by other instances
+		SharedSyncInterval int `json:"shared-sync-interval"`
+		// Write .gz copies of compressible content files when extracting
+		PrecompressContent bool `json:"precompress-content"`
+		// Smallest content file precompressed, in bytes (default 1024)
+		PrecompressMinBytes int `json:"precompress-min-bytes"`
 		// Options for 'gcp'
 		BucketName string `json:"storage-bucket"`
 		ProjectID  string `json:"project-id"`
+		// Local directory caching packages downloaded from a remote filestore
+		CacheDirectory string `json:"cache-directory"`
+		// Size the package cache is kept under, in bytes (default 1GB)
+		CacheMaxBytes int64 `json:"cache-max-bytes"`
 		// Hard coded API keys
 		APIKeys struct {
 			ReadOnly  []string `json:"read-only"`
 			ReadWrite []string `json:"read-write"`
 		} `json:"api-keys"`
 	} `json:"filestore"`
+	// Mirroring through api/changes
+	Mirroring struct {
+		// Leave packages that require license acceptance out of api/changes
+		SkipLicenseAcceptance bool `json:"skip-license-acceptance"`
+		// Package ID globs mirrored even if they require license acceptance
+		LicenseAcceptanceAllowed []string `json:"license-acceptance-allowed"`
+	} `json:"mirroring"`
+	// Moderation holds pushed packages in quarantine until approved
+	Moderation struct {
+		Enabled bool `json:"enabled"`
+		// Package ID globs to moderate (all packages if empty)
+		PackageIDs []string `json:"package-ids"`
+	} `json:"moderation"`
+	// Limits on decompressing package contents
+	ExtractionLimits extractionLimits `json:"extraction-limits"`
+	// Package ID prefixes or globs reserved for certain API keys
+	IDPolicies []idPolicy `json:"id-policies"`
+	// Interceptors run on every push after the id-policy check, by registered name
+	PushInterceptors []pushInterceptorConfig `json:"push-interceptors"`
+	// Most versions a package may have, and what happens to pushes beyond them
+	VersionLimits versionLimitsConfig `json:"version-limits"`
+	// Daily summary of the instance sent to a collector, off unless enabled
+	Telemetry telemetryConfig `json:"telemetry"`
+	// robots.txt, noindex headers and what crawlers get on download routes
+	Crawlers crawlerConfig `json:"crawlers"`
+	// Groups of API keys packages can be restricted to
+	Visibility visibilityConfig `json:"visibility"`
+	// Package IDs retired at admin/packages/{id}/retire
+	RetiredIDs struct {
+		// FindPackagesById for a retired ID also lists the replacement's latest version
+		IncludeReplacement bool `json:"include-replacement"`
+	} `json:"retired-ids"`
+	// Only IDs on the list managed at admin/allowed-ids may be pushed when enabled
+	AllowedIDs struct {
+		Enabled bool `json:"enabled"`
+		// Told to publishers of IDs not on the list, e.g. how to register one
+		Registration string `json:"registration"`
+	} `json:"allowed-ids"`
+	// Validation of pushed packages, rule names are listed in validation.go
+	Validation struct {
+		// Rules not run at all
+		DisabledRules []string `json:"disabled-rules"`
+		// Rules whose warnings reject the push with a 400
+		FailRules []string `json:"fail-rules"`
+		// Content folder size above which large-content warns (default 50MB)
+		MaxContentBytes int64 `json:"max-content-bytes"`
+	} `json:"validation"`
 }
 
 // Server represents the global server object
 type Server struct {
+	configFile       string
+	configWatch      time.Duration
+	configLock       sync.RWMutex
 	config           *Config
+	pushChain        hooks.Chain
 	URL              *url.URL
 	MetaDataResponse []byte
+	OpenAPIResponse  []byte
 	fs               fileStore
+	skipTokenKey     []byte
+	shareKey         []byte
+	snapshots        *snapshotRegistry
+	uiTemplates      *template.Template
+	stats            *downloadStats
+	downloads        *downloadPipeline
+	operations       *operationRegistry
+	tracer           *tracer
+	cache            *cachedFileStore
+	migration        *migratingFileStore
+	visibility       *visibleFileStore
+	health           *healthRegistry
+	catalog          *packageCatalog
+	idempotency      *idempotencyStore
+	adminGRPC        *grpc.Server
+	retirement       *retiringFileStore
+	v3cache          *v3Cache
+	readOnly         int32 // accessed atomically, set while changes are refused
 }
 
-// InitServer returns a structure with all core config data
+// InitServer returns a structure with all core config data, ready to serve
 func InitServer(cf string) *Server {
-	// Create a new server structure
-	s := &Server{}
+	s := loadServer(cf)
 
-	// read configuration file
-	log.Println(`Loading configuration from "` + cf + `"`)
+	// Route the store through a migration, so one can be started or resumed
+	s.migration = newMigratingFileStore(s.fs)
+	s.fs = s.migration
 
-	data, err := ioutil.ReadFile(cf)
-	if err != nil {
-		log.Fatal(err)
+	// Hide packages from keys outside the groups they're restricted to
+	s.visibility = &visibleFileStore{fileStore: s.fs}
+	s.fs = s.visibility
+
+	// Mark the versions of retired IDs deprecated wherever they're shown
+	s.retirement = &retiringFileStore{fileStore: s.fs}
+	s.fs = s.retirement
+
+	// Tracing is configured by the environment, as for any OpenTelemetry service
+	var err error
+	if s.tracer, err = newTracerFromEnv(); err != nil {
+		log.Fatal("Error with tracing: ", err)
+	}
+	if s.tracer != nil {
+		log.Println("Tracing enabled")
+		s.fs = &tracedFileStore{fileStore: s.fs}
+	}
+
+	// V3 documents are rendered once for each change of their package
+	s.v3cache = newV3Cache()
+
+	// Share links are signed with a key that outlives restarts
+	if s.shareKey, err = loadShareKey(context.Background(), s); err != nil {
+		log.Fatal("Error loading share key: ", err)
+	}
+
+	// As are next links, so every instance accepts those of the others
+	if s.skipTokenKey, err = loadSkipTokenKey(context.Background(), s); err != nil {
+		log.Fatal("Error loading skiptoken key: ", err)
 	}
 
 	// read metadata XML file
@@ -55,29 +235,64 @@ func InitServer(cf string) *Server {
 		log.Fatal(err)
 	}
 
-	// Load in the config file from the file system
-	err = json.Unmarshal(data, &s.config)
+	// read the OpenAPI description of everything outside the feed
+	s.OpenAPIResponse, err = loadOpenAPI(filepath.Join("templates", "openapi.json"), s.URL.String())
 	if err != nil {
-		log.Fatal("Error with json:", err)
+		log.Fatal("Error with templates/openapi.json: ", err)
 	}
 
-	// Set URL
-	u, err := url.Parse(s.config.HostURL)
-	s.URL = u
+	// read UI templates
+	s.uiTemplates, err = template.ParseGlob(filepath.Join("templates", "ui-*.html"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Init the fileStore
-	switch s.config.FileStore.Type {
-	case "gcp":
-		s.fs = &fileStoreGCP{}
-	case "local":
-		s.fs = &fileStoreLocal{}
+	// Download statistics are kept beside a local repo, in memory otherwise
+	statsPath := ""
+	if s.config.FileStore.Type == "local" {
+		statsPath = filepath.Join(s.config.FileStore.RepoDIR, "download-stats.json")
 	}
-	if err := s.fs.Init(s); err != nil {
-		log.Fatal("Error starting FileStore:", err)
+	if s.stats, err = loadDownloadStats(statsPath); err != nil {
+		log.Println("Warning: could not load download stats:", err)
+	}
+
+	// The V3 catalog is kept beside a local repo, other stores don't serve one
+	if s.config.FileStore.Type == "local" {
+		if s.catalog, err = openCatalog(filepath.Join(s.config.FileStore.RepoDIR, "catalog.jsonl")); err != nil {
+			log.Fatal("Error loading catalog: ", err)
+		}
+	}
+
+	// Idempotency-Keys are remembered beside a local repo, in memory otherwise
+	idempotencyPath := ""
+	if s.config.FileStore.Type == "local" {
+		idempotencyPath = filepath.Join(s.config.FileStore.RepoDIR, "idempotency-keys.json")
+	}
+	if s.idempotency, err = loadIdempotencyStore(idempotencyPath); err != nil {
+		log.Println("Warning: could not load idempotency keys:", err)
+	}
+	go s.idempotency.runSaver()
+
+	// Count downloads off the request path
+	var dedup time.Duration
+	if s.config.DownloadDedupWindow != "" {
+		dedup, _ = time.ParseDuration(s.config.DownloadDedupWindow)
+	}
+	resume := defaultDownloadResumeWindow
+	if s.config.DownloadResumeWindow != "" {
+		resume, _ = time.ParseDuration(s.config.DownloadResumeWindow)
+	}
+	s.downloads = newDownloadPipeline(s.fs, s.stats, s.config.DownloadQueueSize, dedup, resume, downloadFlushDelay)
+
+	// How often serving checks the config file for changes
+	if s.config.ConfigWatchInterval != "" {
+		if s.configWatch, err = time.ParseDuration(s.config.ConfigWatchInterval); err != nil {
+			log.Fatal("Error with config-watch-interval:", err)
+		}
 	}
 
 	// Todo Warn if API Keys not present
-	a, err := s.fs.GetAccessLevel("")
+	a, err := s.fs.GetAccessLevel(context.Background(), "")
 	if err != nil {
 		log.Fatal("Error getting AccessLevel", err)
 	}
@@ -91,3 +306,113 @@ func InitServer(cf string) *Server {
 
 	return s
 }
+
+// loadServer reads the config and opens the fileStore, leaving out everything only
+// needed to serve HTTP so the CLI commands can use it standalone
+func loadServer(cf string) *Server {
+	// Create a new server structure
+	s := &Server{configFile: cf}
+
+	// read configuration file, over the defaults and under the environment
+	c, found, err := readConfig(cf)
+	if err != nil {
+		log.Fatal("Error loading configuration: ", err)
+	}
+	if found {
+		log.Println(`Loading configuration from "` + cf + `"`)
+	} else {
+		log.Println(`No configuration file "` + cf + `", using defaults`)
+	}
+	s.config = c
+	if b, err := json.Marshal(redactConfig(c)); err == nil {
+		log.Println("Effective configuration:", string(b))
+	}
+	warnings, err := checkConfig(s.config)
+	if err != nil {
+		log.Fatal("Error with config: ", err)
+	}
+	for _, w := range warnings {
+		log.Println("WARNING:", w)
+	}
+	if s.pushChain, err = newPushChain(s.config); err != nil {
+		log.Fatal("Error with config: ", err)
+	}
+
+	// Set URL
+	u, err := url.Parse(s.config.HostURL)
+	s.URL = u
+
+	// Set the continuation token signing key
+	if s.config.SkipTokenKey != "" {
+		s.skipTokenKey = []byte(s.config.SkipTokenKey)
+	} else if s.skipTokenKey, err = newSkipTokenKey(); err != nil {
+		log.Fatal("Error generating skiptoken key:", err)
+	}
+	if s.config.LegacySkipTokens {
+		log.Println("WARNING: Unsigned legacy skiptokens are accepted, this will be removed in a future version")
+	}
+
+	// Create the snapshot registry
+	ttl := defaultSnapshotTTL
+	if s.config.SnapshotTTL != "" {
+		if ttl, err = time.ParseDuration(s.config.SnapshotTTL); err != nil {
+			log.Fatal("Error with snapshot-ttl:", err)
+		}
+	}
+	s.snapshots = newSnapshotRegistry(ttl)
+
+	// Long running tasks register here so busy responses can estimate a retry time
+	s.operations = newOperationRegistry()
+
+	// Problems the server carries on despite are reported by statusz
+	s.health = newHealthRegistry()
+
+	// Init the fileStore
+	if s.fs, err = newFileStore(s); err != nil {
+		log.Fatal("Error starting FileStore:", err)
+	}
+
+	// Serve a remote store's packages from local disk where possible
+	if s.config.FileStore.CacheDirectory != "" && s.config.FileStore.Type != "local" {
+		if s.cache, err = newCachedFileStore(s.fs, s.config.FileStore.CacheDirectory, s.config.FileStore.CacheMaxBytes); err != nil {
+			log.Fatal("Error starting package cache:", err)
+		}
+		s.fs = s.cache
+	}
+
+	return s
+}
+
+// newFileStore opens the fileStore a server's config names
+func newFileStore(s *Server) (fileStore, error) {
+	var fs fileStore
+	switch s.config.FileStore.Type {
+	case "gcp":
+		fs = &fileStoreGCP{}
+	case "local":
+		fs = &fileStoreLocal{}
+	default:
+		return nil, errors.New("unknown filestore type " + s.config.FileStore.Type)
+	}
+	if err := fs.Init(s); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// requiresModeration reports whether pushes of the package ID must be approved before being served
+func (s *Server) requiresModeration(id string) bool {
+	c := s.Config()
+	if !c.Moderation.Enabled {
+		return false
+	}
+	if len(c.Moderation.PackageIDs) == 0 {
+		return true
+	}
+	for _, g := range c.Moderation.PackageIDs {
+		if ok, _ := path.Match(strings.ToLower(g), strings.ToLower(id)); ok {
+			return true
+		}
+	}
+	return false
+}
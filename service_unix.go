@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+// prepareService is only needed for Windows services
+func prepareService() {}
+
+// runService serves in the console, which also covers systemd units
+func runService(addr string) {
+	runConsole(addr)
+}
+
+// inheritedListener returns the socket passed by systemd socket activation, or nil
+// when the process wasn't socket activated
+func inheritedListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		return nil, errors.New("socket activation passed more than one socket")
+	}
+
+	// Passed sockets start at fd 3, and aren't for any children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	f := os.NewFile(3, "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// notifySystemd sends a state such as "READY=1" to systemd for Type=notify units.
+// Nothing is sent when not run by systemd.
+func notifySystemd(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	// Abstract sockets are given with a leading @
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
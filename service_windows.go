@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// Name the service is registered under
+const windowsServiceName = "go-nuget-server"
+
+// isWindowsService reports whether the process was started by the service control manager
+func isWindowsService() bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	return err == nil && !interactive
+}
+
+// prepareService moves to the executable's folder when run as a service, which
+// starts in System32, so the config and templates are found beside the executable
+func prepareService() {
+	if !isWindowsService() {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	if err := os.Chdir(filepath.Dir(exe)); err != nil {
+		log.Println("Error: Cannot change to the executable's folder", err)
+	}
+}
+
+// runService serves under the service control manager, or in the console when run interactively
+func runService(addr string) {
+	if !isWindowsService() {
+		runConsole(addr)
+		return
+	}
+	if err := svc.Run(windowsServiceName, &windowsService{addr: addr}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// windowsService handles service control requests
+type windowsService struct {
+	addr string
+}
+
+func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.StartPending}
+	srv, errc, err := startServer(ws.addr)
+	if err != nil {
+		log.Println("Error: Cannot start", err)
+		return false, 1
+	}
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-errc:
+			log.Println("Error:", err)
+			s <- svc.Status{State: svc.StopPending}
+			stopServer(srv)
+			return false, 1
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				stopServer(srv)
+				return false, 0
+			}
+		}
+	}
+}
+
+// Service managers only hand over listeners on Linux
+func inheritedListener() (net.Listener, error) {
+	return nil, nil
+}
+
+func notifySystemd(state string) {}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name the generated share link signing key is kept under in the filestore
+const shareKeySetting = "share-key"
+
+// Lifetime of a share link if none is asked for
+const defaultShareTTL = 24 * time.Hour
+
+// Longest lifetime a share link can be given if share-max-ttl isn't set
+const defaultShareMaxTTL = 7 * 24 * time.Hour
+
+// Characters of the package hash a share link is bound to
+const shareHashChars = 16
+
+// ErrInvalidShareToken is returned when a share link is malformed or has been tampered with
+var ErrInvalidShareToken = errors.New("invalid share token")
+
+// shareGrant is what a share link allows: downloading one version, with the hash
+// it had when shared, until it expires
+type shareGrant struct {
+	ID      string
+	Version string
+	Hash    string
+	Expires time.Time
+}
+
+// loadShareKey returns the key share links are signed with: share-key from the
+// config, or one generated at first start and kept in the filestore so links
+// survive restarts and work on every instance
+func loadShareKey(ctx context.Context, s *Server) ([]byte, error) {
+	if s.config.ShareKey != "" {
+		return []byte(s.config.ShareKey), nil
+	}
+	return loadGeneratedKey(ctx, s.fs, shareKeySetting)
+}
+
+// signShareToken returns the HMAC of a share token payload
+func signShareToken(key []byte, payload string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("share|" + payload))
+	return m.Sum(nil)
+}
+
+// newShareToken returns a signed token granting the download
+func newShareToken(key []byte, g *shareGrant) string {
+	payload := g.ID + "|" + g.Version + "|" + g.Hash + "|" + strconv.FormatInt(g.Expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload + "|" + hex.EncodeToString(signShareToken(key, payload))))
+}
+
+// parseShareToken validates a share token's signature and returns its grant,
+// which may have expired
+func parseShareToken(key []byte, token string) (*shareGrant, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidShareToken
+	}
+	i := strings.LastIndex(string(b), "|")
+	if i < 0 {
+		return nil, ErrInvalidShareToken
+	}
+	payload := string(b[:i])
+	sig, err := hex.DecodeString(string(b[i+1:]))
+	if err != nil || !hmac.Equal(sig, signShareToken(key, payload)) {
+		return nil, ErrInvalidShareToken
+	}
+	x := strings.Split(payload, "|")
+	if len(x) != 4 || x[0] == "" || x[1] == "" {
+		return nil, ErrInvalidShareToken
+	}
+	exp, err := strconv.ParseInt(x[3], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidShareToken
+	}
+	return &shareGrant{ID: x[0], Version: x[1], Hash: x[2], Expires: time.Unix(exp, 0).UTC()}, nil
+}
+
+// shareMaxTTL returns the longest lifetime a share link can be given
+func shareMaxTTL(c *Config) time.Duration {
+	if c.ShareMaxTTL != "" {
+		if d, err := time.ParseDuration(c.ShareMaxTTL); err == nil {
+			return d
+		}
+	}
+	return defaultShareMaxTTL
+}
+
+// serveShare handles POST admin/share, returning a link anyone can download a
+// version from until it expires
+func serveShare(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID      string `json:"id"`
+		Version string `json:"version"`
+		TTL     string `json:"ttl"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if isBodyTooLarge(err) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(b, &req); err != nil || req.ID == "" || req.Version == "" {
+		writeShareError(w, `body must be {"id": "...", "version": "...", "ttl": "24h"}`)
+		return
+	}
+	ttl := defaultShareTTL
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			writeShareError(w, "ttl must be a positive duration, e.g. 24h")
+			return
+		}
+	}
+	if max := shareMaxTTL(server.Config()); ttl > max {
+		writeShareError(w, "ttl must not be over "+max.String())
+		return
+	}
+
+	// Only a version the key can see can be shared
+	npe, err := server.fs.GetPackageEntry(r.Context(), req.ID, req.Version)
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	g := &shareGrant{
+		ID:      npe.Properties.ID,
+		Version: npe.Properties.Version,
+		Hash:    shareHash(npe),
+		Expires: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+	out := struct {
+		URL     string `json:"url"`
+		ID      string `json:"id"`
+		Version string `json:"version"`
+		Expires string `json:"expires"`
+	}{server.URL.String() + "dl/" + newShareToken(server.shareKey, g), g.ID, g.Version, formatISO8601Time(g.Expires)}
+	b, err = json.Marshal(out)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// shareHash returns the part of a version's hash a share link is bound to, so a
+// version deleted and pushed again with other content isn't served
+func shareHash(npe *NugetPackageEntry) string {
+	h := strings.ToLower(npe.Properties.PackageHash)
+	if len(h) > shareHashChars {
+		h = h[:shareHashChars]
+	}
+	return h
+}
+
+// serveShareDownload serves dl/{token} without an API key. Expired links, and
+// links to versions no longer stored as they were, get a 410.
+func serveShareDownload(w http.ResponseWriter, r *http.Request) {
+	token := strings.Trim(r.URL.Path[len(server.URL.Path+`dl`):], `/`)
+	g, err := parseShareToken(server.shareKey, token)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if time.Now().After(g.Expires) {
+		writeShareGone(w, "this link expired "+formatISO8601Time(g.Expires))
+		return
+	}
+
+	npe, err := server.fs.GetPackageEntry(r.Context(), g.ID, g.Version)
+	if err == ErrFileNotFound {
+		writeShareGone(w, "the shared package is no longer available")
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if shareHash(npe) != g.Hash {
+		writeShareGone(w, "the shared package is no longer available")
+		return
+	}
+
+	// The link is only good until it expires, so caches mustn't keep it
+	w.Header().Set("Cache-Control", "private, no-store")
+	serveVersionFile(w, r, npe.Properties.ID, npe.Properties.Version)
+}
+
+// writeShareGone answers a share link that can no longer be used
+func writeShareGone(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	w.Write([]byte(msg))
+}
+
+// writeShareError explains why a share link wasn't created
+func writeShareError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(msg))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreFilesAreNotServed(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Share.Pkg", "1.0.0", "", map[string]string{"content/readme.txt": "hello"}))
+
+	status, body := ts.get(t, "files/share.pkg/1.0.0/content/readme.txt")
+	wantStatus(t, "content file", status, body, http.StatusOK)
+	if body != "hello" {
+		t.Fatalf("content file: got %q", body)
+	}
+	key := hex.EncodeToString(server.shareKey)
+
+	for _, p := range []string{
+		"files/.settings/share-key.json",
+		"files/%2Esettings/share-key.json",
+		"files/share.pkg/../.settings/share-key.json",
+		"files/idempotency-keys.json",
+		"files/downloads.json",
+		"files/changes.jsonl",
+		"files/share.pkg/1.0.0/.extracted",
+	} {
+		status, body := ts.get(t, p)
+		if status != http.StatusNotFound {
+			t.Errorf("%s: got %d %q, want 404", p, status, body)
+		}
+		if strings.Contains(body, key) {
+			t.Errorf("%s: served %q", p, body)
+		}
+	}
+}
+
+// shareLink asks for a share link to a version, returning the path of it under the feed
+func shareLink(t *testing.T, ts *testServer, id string, ver string, ttl string) string {
+	t.Helper()
+	req := `{"id":"` + id + `","version":"` + ver + `","ttl":"` + ttl + `"}`
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/share", testWriteKey, strings.NewReader(req), nil))
+	wantStatus(t, "share", status, body, http.StatusCreated)
+	var out struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(body), &out); err != nil || !strings.HasPrefix(out.URL, ts.Feed+"dl/") {
+		t.Fatalf("share: got %s (%v)", body, err)
+	}
+	return strings.TrimPrefix(out.URL, ts.Feed)
+}
+
+func TestShareLinks(t *testing.T) {
+	ts := newTestServer(t, nil)
+	pkg := testPackage(t, "Share.Pkg", "1.0.0", "", nil)
+	ts.mustPush(t, pkg)
+
+	t.Run("valid", func(t *testing.T) {
+		link := shareLink(t, ts, "Share.Pkg", "1.0.0", "1h")
+		status, body := readResponse(t, ts.do(t, http.MethodGet, link, "", nil, nil))
+		wantStatus(t, "download", status, body, http.StatusOK)
+		if body != string(pkg) {
+			t.Error("download isn't the package pushed")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		g := &shareGrant{ID: "Share.Pkg", Version: "1.0.0", Expires: time.Now().Add(-time.Minute).UTC().Truncate(time.Second)}
+		npe, err := server.fs.GetPackageEntry(context.Background(), "Share.Pkg", "1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Hash = shareHash(npe)
+		status, body := readResponse(t, ts.do(t, http.MethodGet, "dl/"+newShareToken(server.shareKey, g), "", nil, nil))
+		wantStatus(t, "download", status, body, http.StatusGone)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		link := shareLink(t, ts, "Share.Pkg", "1.0.0", "1h")
+		c := "A"
+		if strings.HasSuffix(link, c) {
+			c = "B"
+		}
+		status, body := readResponse(t, ts.do(t, http.MethodGet, link[:len(link)-1]+c, "", nil, nil))
+		wantStatus(t, "download", status, body, http.StatusNotFound)
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		req := strings.NewReader(`{"id":"Share.Pkg","version":"1.0.0","ttl":"` + strings.Repeat("1", maxPostBodyBytes) + `s"}`)
+		status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/share", testWriteKey, req, nil))
+		wantStatus(t, "share", status, body, http.StatusRequestEntityTooLarge)
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		link := shareLink(t, ts, "Share.Pkg", "1.0.0", "1h")
+		status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Share.Pkg/1.0.0", testWriteKey, nil, nil))
+		wantStatus(t, "delete", status, body, http.StatusNoContent)
+		status, body = readResponse(t, ts.do(t, http.MethodGet, link, "", nil, nil))
+		wantStatus(t, "download", status, body, http.StatusGone)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files used to coordinate instances sharing a local directory
+const (
+	sharedLockName   = ".lock"
+	sharedMarkerName = ".changed"
+)
+
+// Default seconds between checks for changes made by other instances
+const defaultSharedSyncInterval = 5
+
+// A lock older than this is assumed to be left behind by a crashed instance
+const sharedLockStale = 30 * time.Second
+
+// How long to wait for another instance to release the lock
+const sharedLockTimeout = 10 * time.Second
+
+// ErrLockTimeout is returned when the shared lock can't be acquired in time
+var ErrLockTimeout = errors.New("timed out waiting for shared storage lock")
+
+// lockShared takes the repository wide lock file, which is created exclusively so
+// only one instance can hold it. Returns a function that releases the lock.
+func (fs *fileStoreLocal) lockShared() (func(), error) {
+	lp := filepath.Join(fs.rootDir, sharedLockName)
+	deadline := time.Now().Add(sharedLockTimeout)
+	for {
+		f, err := os.OpenFile(lp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			host, _ := os.Hostname()
+			fmt.Fprintf(f, "%s %d\n", host, os.Getpid())
+			f.Close()
+			return func() { os.Remove(lp) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// Break locks left behind by crashed instances
+		if fi, err := os.Stat(lp); err == nil && time.Since(fi.ModTime()) > sharedLockStale {
+			log.Println("Warning: Removing stale shared storage lock")
+			os.Remove(lp)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// touchSharedMarker tells other instances the package set has changed
+func (fs *fileStoreLocal) touchSharedMarker() {
+	now := time.Now().UTC()
+	mp := filepath.Join(fs.rootDir, sharedMarkerName)
+	if err := ioutil.WriteFile(mp, []byte(now.Format(time.RFC3339Nano)), 0644); err != nil {
+		log.Println("Error: Cannot update shared change marker", err)
+		return
+	}
+	os.Chtimes(mp, now, now)
+}
+
+// sharedMarkerTime returns when another instance last changed the package set
+func (fs *fileStoreLocal) sharedMarkerTime() time.Time {
+	fi, err := os.Stat(filepath.Join(fs.rootDir, sharedMarkerName))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime().UTC()
+}
+
+// watchShared polls the change marker and reloads when another instance has
+// stored or removed a package
+func (fs *fileStoreLocal) watchShared(interval int) {
+	if interval <= 0 {
+		interval = defaultSharedSyncInterval
+	}
+	seen := fs.sharedMarkerTime()
+	for range time.Tick(time.Duration(interval) * time.Second) {
+		t := fs.sharedMarkerTime()
+		if t.Equal(seen) {
+			continue
+		}
+		seen = t
+		if err := fs.reloadShared(); err != nil {
+			log.Println("Error: Cannot reload shared storage", err)
+		}
+	}
+}
+
+// reloadShared rebuilds the in-memory package list, download counts and change log from disk
+func (fs *fileStoreLocal) reloadShared() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.packages = nil
+	fs.resetPaths()
+	if err := fs.LoadDownloadCounts(); err != nil {
+		log.Printf("Error: could not load download counts: %v", err)
+	}
+	if err := fs.RefeshPackages(); err != nil {
+		return err
+	}
+	fs.markChanged(fs.sharedMarkerTime())
+	return fs.changes.Reload()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newSharedInstance opens another local store over the test server's directory,
+// as a replica sharing it would
+func newSharedInstance(t *testing.T) *fileStoreLocal {
+	t.Helper()
+	fs := &fileStoreLocal{}
+	if err := fs.Init(server); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestSharedStorage(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.FileStore.SharedStorage = true
+		c.FileStore.SharedSyncInterval = 3600
+	})
+	ctx := context.Background()
+	a, b := newSharedInstance(t), newSharedInstance(t)
+
+	// A version pushed on one instance can't be pushed again on the other
+	if _, err := a.StorePackage(ctx, testPackage(t, "Shared.X", "1.0.0", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.StorePackage(ctx, testPackage(t, "Shared.X", "1.0.0", "<title>Other</title>", nil)); err == nil {
+		t.Error("duplicate push on the other instance was stored")
+	}
+	if _, err := b.StorePackage(ctx, testPackage(t, "Shared.Y", "1.0.0", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range []*fileStoreLocal{a, b} {
+		if err := fs.reloadShared(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.GetPackageEntry(ctx, "Shared.Y", "1.0.0"); err != nil {
+		t.Errorf("push on the other instance not seen after a reload: %v", err)
+	}
+
+	// Counts from both instances are kept, by removals too
+	if err := a.AddDownloads(ctx, map[string]int{"Shared.X/1.0.0": 3, "Shared.Y/1.0.0": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddDownloads(ctx, map[string]int{"shared.x/1.0": 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeletePackage(ctx, "Shared.Y", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := readDownloadCounts(filepath.Join(ts.Root, "downloads.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"Shared.X/1.0.0": 7}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("downloads.json = %v, want %v", counts, want)
+	}
+
+	// Changes from both instances are appended in one sequence
+	if err := b.SetListed(ctx, "Shared.X", "1.0.0", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.StorePackage(ctx, testPackage(t, "Shared.Z", "1.0.0", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetListed(ctx, "Shared.Z", "1.0.0", false); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := openChangeLog(filepath.Join(ts.Root, "changes.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _, _ := cl.Since(0)
+	var got []string
+	for i, r := range records {
+		if i > 0 && r.Seq != records[i-1].Seq+1 {
+			t.Errorf("record %d has seq %d after %d", i, r.Seq, records[i-1].Seq)
+		}
+		if r.Type != changeCheckpoint {
+			got = append(got, r.Type+" "+r.ID)
+		}
+	}
+	want := []string{"added Shared.X", "added Shared.Y", "removed Shared.Y", "unlisted Shared.X", "added Shared.Z", "unlisted Shared.Z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(ts.Root, sharedLockName)); !os.IsNotExist(err) {
+		t.Errorf("shared lock left behind: %v", err)
+	}
+}
+
+func TestSkipTokenKeyShared(t *testing.T) {
+	newTestServer(t, nil)
+	other := &Server{config: server.config, fs: newSharedInstance(t)}
+	key, err := loadSkipTokenKey(context.Background(), other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, server.skipTokenKey) {
+		t.Fatal("instances over one directory sign next links with different keys")
+	}
+	id, ver, err := parseSkipToken(key, newSkipToken(server.skipTokenKey, "Foo", "1.0.0"), false)
+	if err != nil || id != "Foo" || ver != "1.0.0" {
+		t.Errorf("token from one instance read by the other as %q %q, %v", id, ver, err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/base64"
+	"html"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSkipToken(t *testing.T) {
+	key := []byte("key")
+	token := newSkipToken(key, "Some.Pkg", "1.0.0")
+	if strings.Contains(token, "Some.Pkg") {
+		t.Errorf("token %q isn't opaque", token)
+	}
+	if id, ver, err := parseSkipToken(key, token, false); err != nil || id != "Some.Pkg" || ver != "1.0.0" {
+		t.Errorf("round trip: got %q %q %v", id, ver, err)
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(token)
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(raw), "Some.Pkg", "Other.Pkg", 1)))
+	for name, tc := range map[string]struct {
+		token  string
+		legacy bool
+	}{
+		"tampered":         {token: tampered},
+		"other key":        {token: newSkipToken([]byte("other"), "Some.Pkg", "1.0.0")},
+		"not base64":       {token: "!!!"},
+		"unsigned":         {token: base64.RawURLEncoding.EncodeToString([]byte("Some.Pkg|1.0.0"))},
+		"bad signature":    {token: base64.RawURLEncoding.EncodeToString([]byte("Some.Pkg|1.0.0|zz"))},
+		"empty id":         {token: newSkipToken(key, "", "1.0.0")},
+		"legacy":           {token: "'Some.Pkg','1.0.0'"},
+		"legacy malformed": {token: "'Some.Pkg'", legacy: true},
+	} {
+		if id, ver, err := parseSkipToken(key, tc.token, tc.legacy); err != ErrInvalidSkipToken {
+			t.Errorf("%s: got %q %q %v, want it rejected", name, id, ver, err)
+		}
+	}
+
+	if id, ver, err := parseSkipToken(key, "'Some.Pkg','1.0.0'", true); err != nil || id != "Some.Pkg" || ver != "1.0.0" {
+		t.Errorf("legacy allowed: got %q %q %v", id, ver, err)
+	}
+}
+
+// nextHref returns the next link of an Atom feed, or empty on the last page
+func nextHref(t *testing.T, feed string) string {
+	t.Helper()
+	for _, l := range strings.Split(feed, "<link ")[1:] {
+		if strings.Contains(l, `rel="next"`) {
+			return html.UnescapeString(between(l, `href="`, `"`))
+		}
+	}
+	return ""
+}
+
+func TestSkipTokenPaging(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxPageSize = 1 })
+	for _, v := range []string{"1.0.0", "2.0.0", "3.0.0"} {
+		ts.mustPush(t, testPackage(t, "Page.Pkg", v, "", nil))
+	}
+
+	// Following the next links pages through every version, with or without a
+	// $top, and the whole feed is cut to max-page-size the same way
+	var tokens []string
+	for _, start := range []string{"FindPackagesById()?id='Page.Pkg'", "FindPackagesById()?id='Page.Pkg'&$top=3", "Packages()"} {
+		var got []string
+		for p := start; p != ""; {
+			status, body := ts.get(t, p)
+			wantStatus(t, p, status, body, http.StatusOK)
+			if ids := feedIDs(t, body); len(ids) > 1 {
+				t.Fatalf("%s: page of %q", p, ids)
+			} else {
+				got = append(got, ids...)
+			}
+			next := nextHref(t, body)
+			if next == "" {
+				break
+			}
+			u, err := url.Parse(next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, u.Query().Get("$skiptoken"))
+			p = strings.TrimPrefix(next, ts.Feed)
+		}
+		want := []string{"Page.Pkg 3.0.0", "Page.Pkg 2.0.0", "Page.Pkg 1.0.0"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: paged through %q, want %q", start, got, want)
+		}
+	}
+
+	// Anything but a token the server made is refused
+	raw, _ := base64.RawURLEncoding.DecodeString(tokens[0])
+	forged := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(raw), "3.0.0", "2.0.0", 1)))
+	for _, token := range []string{forged, "garbage", "'Page.Pkg','3.0.0'"} {
+		status, body := ts.get(t, "FindPackagesById()?id='Page.Pkg'&$skiptoken="+url.QueryEscape(token))
+		wantStatus(t, "skiptoken "+token, status, body, http.StatusBadRequest)
+	}
+}
+
+// A link after a version deleted since is refused, rather than starting again from
+// the top and repeating what the client has
+func TestSkipTokenAfterDelete(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxPageSize = 1 })
+	for _, v := range []string{"1.0.0", "2.0.0", "3.0.0"} {
+		ts.mustPush(t, testPackage(t, "Page.Pkg", v, "", nil))
+	}
+
+	for _, start := range []string{"FindPackagesById()?id='Page.Pkg'", "Packages()?$orderby=Version", "Packages()?$orderby=DownloadCount desc"} {
+		status, body := ts.get(t, strings.ReplaceAll(start, " ", "%20"))
+		wantStatus(t, start, status, body, http.StatusOK)
+		next := strings.TrimPrefix(nextHref(t, body), ts.Feed)
+		if next == "" {
+			t.Fatalf("%s: no next link", start)
+		}
+		ids := feedIDs(t, body)
+		ver := strings.TrimPrefix(ids[0], "Page.Pkg ")
+
+		status, body = readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Page.Pkg/"+ver, testWriteKey, nil, nil))
+		wantStatus(t, "delete "+ver, status, body, http.StatusNoContent)
+		status, body = ts.get(t, strings.ReplaceAll(next, " ", "%20"))
+		wantStatus(t, start+" after deleting "+ver, status, body, http.StatusBadRequest)
+		ts.mustPush(t, testPackage(t, "Page.Pkg", ver, "", nil))
+	}
+
+	// Reading the whole feed isn't affected
+	status, body := ts.get(t, "Packages()/$count")
+	wantStatus(t, "count", status, body, http.StatusOK)
+	if body != "3" {
+		t.Errorf("count: got %s, want 3", body)
+	}
+}
+
+// Unsigned tokens from older next links work only while legacy-skiptokens is set
+func TestLegacySkipTokens(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.LegacySkipTokens = true })
+	ts.mustPush(t, testPackage(t, "Page.Pkg", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Page.Pkg", "2.0.0", "", nil))
+	status, body := ts.get(t, "FindPackagesById()?id='Page.Pkg'&$skiptoken="+url.QueryEscape("'Page.Pkg','2.0.0'"))
+	wantStatus(t, "legacy skiptoken", status, body, http.StatusOK)
+	if got := feedIDs(t, body); !reflect.DeepEqual(got, []string{"Page.Pkg 1.0.0"}) {
+		t.Errorf("got %q, want the versions after 2.0.0", got)
+	}
+}
+
+// Both stores page through sorted entries the same way, however the token wrote
+// the version
+func TestPageFeedEntries(t *testing.T) {
+	var entries []*NugetPackageEntry
+	for _, v := range []string{"1.0.0", "1.10.0", "1.2.0", "2.0.0-beta"} {
+		e := &NugetPackageEntry{}
+		e.Properties.ID = "Page.Pkg"
+		e.Properties.Version = v
+		entries = append(entries, e)
+	}
+	sortFeedEntries(entries, parseFeedOrder("Version desc"))
+
+	var got []string
+	for startAfter := ""; ; {
+		page, more, err := pageFeedEntries(entries, startAfter, 3)
+		if err != nil {
+			t.Fatalf("after %q: %v", startAfter, err)
+		}
+		for _, e := range page {
+			got = append(got, e.Properties.Version)
+		}
+		if !more {
+			break
+		}
+		// Written as a client might
+		last := page[len(page)-1]
+		startAfter = strings.ToLower(last.Properties.ID) + "." + last.Properties.Version + ".0"
+	}
+	if want := []string{"2.0.0-beta", "1.10.0", "1.2.0", "1.0.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paged through %q, want %q", got, want)
+	}
+
+	if page, more, err := pageFeedEntries(entries, "Page.Pkg.1.0.0", 3); err != nil || len(page) != 0 || more {
+		t.Errorf("after the last: got %d entries, more %v, %v", len(page), more, err)
+	}
+	for _, startAfter := range []string{"Page.Pkg.1.5.0", "Other.Pkg.1.0.0", "Page.Pkg"} {
+		if _, _, err := pageFeedEntries(entries, startAfter, 3); err != ErrStartAfterGone {
+			t.Errorf("after %q: got %v, want ErrStartAfterGone", startAfter, err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default lifetime of a feed snapshot
+const defaultSnapshotTTL = 24 * time.Hour
+
+// feedSnapshot is an immutable set of package versions captured at a point in time
+type feedSnapshot struct {
+	ID       string
+	Created  time.Time
+	Expires  time.Time
+	versions map[string]bool
+}
+
+// snapshotKey returns the lookup key for a package version within a snapshot
+func snapshotKey(id string, ver string) string {
+	return versionKey(id, ver)
+}
+
+// Contains reports whether the package version was visible when the snapshot was taken
+func (fs *feedSnapshot) Contains(id string, ver string) bool {
+	return fs.versions[snapshotKey(id, ver)]
+}
+
+// Filter returns only the entries that are part of the snapshot
+func (fs *feedSnapshot) Filter(entries []*NugetPackageEntry) []*NugetPackageEntry {
+	var f []*NugetPackageEntry
+	for _, e := range entries {
+		if fs.Contains(e.Properties.ID, e.Properties.Version) {
+			f = append(f, e)
+		}
+	}
+	return f
+}
+
+// snapshotRegistry holds all live snapshots
+type snapshotRegistry struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	snapshots map[string]*feedSnapshot
+}
+
+func newSnapshotRegistry(ttl time.Duration) *snapshotRegistry {
+	return &snapshotRegistry{ttl: ttl, snapshots: make(map[string]*feedSnapshot)}
+}
+
+// Create captures the given entries as a new snapshot
+func (sr *snapshotRegistry) Create(entries []*NugetPackageEntry) (*feedSnapshot, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	s := &feedSnapshot{
+		ID:       hex.EncodeToString(b),
+		Created:  now,
+		Expires:  now.Add(sr.ttl),
+		versions: make(map[string]bool),
+	}
+	for _, e := range entries {
+		s.versions[snapshotKey(e.Properties.ID, e.Properties.Version)] = true
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.purge(now)
+	sr.snapshots[s.ID] = s
+	return s, nil
+}
+
+// Get returns a live snapshot, or nil if unknown or expired
+func (sr *snapshotRegistry) Get(id string) *feedSnapshot {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.purge(time.Now())
+	return sr.snapshots[id]
+}
+
+// Delete removes a snapshot, returning false if it did not exist
+func (sr *snapshotRegistry) Delete(id string) bool {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	_, ok := sr.snapshots[id]
+	delete(sr.snapshots, id)
+	return ok
+}
+
+// Containing returns the IDs of the live snapshots a version is part of
+func (sr *snapshotRegistry) Containing(id string, ver string) []string {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.purge(time.Now())
+	ids := []string{}
+	for _, s := range sr.snapshots {
+		if s.Contains(id, ver) {
+			ids = append(ids, s.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// purge drops expired snapshots, lock must be held
+func (sr *snapshotRegistry) purge(now time.Time) {
+	for id, s := range sr.snapshots {
+		if now.After(s.Expires) {
+			delete(sr.snapshots, id)
+		}
+	}
+}
+
+type snapshotContextKey struct{}
+
+// requestSnapshot returns the snapshot a request is restricted to, if any
+func requestSnapshot(r *http.Request) *feedSnapshot {
+	s, _ := r.Context().Value(snapshotContextKey{}).(*feedSnapshot)
+	return s
+}
+
+// withSnapshot returns a copy of the request restricted to the snapshot and routed
+// as if the snapshot/{id}/ prefix was not present
+func withSnapshot(r *http.Request, s *feedSnapshot, path string) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), snapshotContextKey{}, s))
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	r.URL = &u
+	return r
+}
+
+func createSnapshot(w http.ResponseWriter, r *http.Request) {
+
+	// Page through every visible package version
+	var entries []*NugetPackageEntry
+	startAfter := ""
+	for {
+		page, isMore, err := server.fs.GetPackageFeedEntries(r.Context(), "", startAfter, 1000)
+		if err == ErrStartAfterGone {
+			// The last version read was removed meanwhile, so capture them all again
+			entries, startAfter = nil, ""
+			continue
+		} else if err == ErrBusy {
+			writeBusy(w)
+			return
+		} else if isCancelled(err) {
+			writeCancelled(w, r)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, page...)
+		if !isMore || len(page) == 0 {
+			break
+		}
+		startAfter = page[len(page)-1].Properties.ID + "." + page[len(page)-1].Properties.Version
+	}
+
+	s, err := server.snapshots.Create(entries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(struct {
+		ID       string `json:"id"`
+		URL      string `json:"url"`
+		Created  string `json:"created"`
+		Expires  string `json:"expires"`
+		Packages int    `json:"packages"`
+	}{s.ID, server.URL.String() + "snapshot/" + s.ID + "/", formatISO8601Time(s.Created), formatISO8601Time(s.Expires), len(s.versions)})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(r.URL.Path[len(server.URL.Path+`api/snapshots`):], `/`)
+	if id == "" || !server.snapshots.Delete(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveSnapshotGone explains that a version in the snapshot has since been deleted
+func serveSnapshotGone(w http.ResponseWriter, s *feedSnapshot, id string, ver string) {
+	b := []byte(fmt.Sprintf("%s %s was part of snapshot %s but has since been deleted from the feed\n", id, ver, s.ID))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(http.StatusGone)
+	w.Write(b)
+}
+
+// rebaseWriter rewrites the server URL in XML/JSON responses so links
+// emitted within a snapshot stay within that snapshot
+type rebaseWriter struct {
+	http.ResponseWriter
+	from    []byte
+	to      []byte
+	status  int
+	rewrite bool
+	decided bool
+	buf     bytes.Buffer
+}
+
+func newRebaseWriter(w http.ResponseWriter, from string, to string) *rebaseWriter {
+	return &rebaseWriter{ResponseWriter: w, from: []byte(from), to: []byte(to)}
+}
+
+// decide chooses whether the body should be rewritten, from its content type
+func (rw *rebaseWriter) decide() {
+	if !rw.decided {
+		ct := rw.Header().Get("Content-Type")
+		rw.rewrite = strings.Contains(ct, "xml") || strings.Contains(ct, "json")
+		rw.decided = true
+	}
+}
+
+func (rw *rebaseWriter) WriteHeader(status int) {
+	rw.decide()
+	if rw.rewrite {
+		rw.status = status
+		return
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *rebaseWriter) Write(b []byte) (int, error) {
+	rw.decide()
+	if rw.rewrite {
+		return rw.buf.Write(b)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered, rewritten body
+func (rw *rebaseWriter) Flush() {
+	if !rw.rewrite {
+		return
+	}
+	b := bytes.ReplaceAll(rw.buf.Bytes(), rw.from, rw.to)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if rw.status != 0 {
+		rw.ResponseWriter.WriteHeader(rw.status)
+	}
+	rw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Entries above which JSON feeds and change lists are streamed rather than built
+// in memory with a Content-Length
+const defaultStreamJSONEntries = 1000
+
+// Size of the buffer between a streamed response's encoder and the connection
+const streamJSONBufferSize = 32 * 1024
+
+// streamJSONEntries returns the entry count above which JSON responses are streamed
+func streamJSONEntries() int {
+	if n := server.Config().StreamJSONEntries; n > 0 {
+		return n
+	}
+	return defaultStreamJSONEntries
+}
+
+// streamJSONArray sends a JSON response whose only large part is one array,
+// encoding each element as it is written so the whole response is never held in
+// memory. prefix is everything before the array's elements and suffix everything
+// after, as marshalJSON would encode them, so the bytes are the same as a buffered
+// response's. It is sent chunked, without a Content-Length.
+func streamJSONArray(w http.ResponseWriter, contentType string, prefix string, n int, elem func(i int) interface{}, suffix string) {
+	w.Header().Set("Content-Type", contentType)
+	bw := bufio.NewWriterSize(w, streamJSONBufferSize)
+	bw.WriteString(prefix)
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	for i := 0; i < n; i++ {
+		b.Reset()
+		if err := enc.Encode(elem(i)); err != nil {
+			// Too late for a status, a client sees the truncated body as an error
+			log.Println("Error streaming JSON response:", err)
+			return
+		}
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		if _, err := bw.Write(bytes.TrimSuffix(b.Bytes(), []byte("\n"))); err != nil {
+			// Client gone
+			return
+		}
+	}
+
+	bw.WriteString(suffix)
+	bw.Flush()
+}
+
+// jsonString encodes a string as marshalJSON does, for streamed prefixes and suffixes
+func jsonString(s string) string {
+	b, _ := marshalJSON(s)
+	return string(b)
+}
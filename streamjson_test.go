@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Streaming writes the same bytes marshalJSON does for the whole value, whatever
+// the elements hold
+func TestStreamJSONArrayMatchesMarshal(t *testing.T) {
+	type elem struct {
+		Name  string            `json:"name"`
+		N     int               `json:"n,omitempty"`
+		Tags  []string          `json:"tags"`
+		Extra map[string]string `json:"extra,omitempty"`
+	}
+	type doc struct {
+		Context string `json:"@odata.context"`
+		Value   []elem `json:"value"`
+		Next    string `json:"@odata.nextLink,omitempty"`
+	}
+	for _, tc := range []struct {
+		name string
+		doc  doc
+	}{
+		{"one", doc{Context: "ctx", Value: []elem{{Name: "a"}}}},
+		{"several", doc{Context: "ctx", Value: []elem{{Name: "a", N: 1}, {Name: "b", Tags: []string{"x", "y"}}, {Name: "c", Extra: map[string]string{"z": "1", "a": "2"}}}}},
+		{"html and quotes", doc{Context: `<a href="x">&</a>`, Value: []elem{{Name: `<script>"\'&</script>`}}, Next: "https://host/feed/Packages?$skip=1&$top=2"}},
+		{"unicode", doc{Context: "日本語", Value: []elem{{Name: "パッケージ 😀", Tags: []string{"é", "  ", "\x00\x1f"}}}}},
+		{"invalid utf-8", doc{Context: "\xff", Value: []elem{{Name: "a\xc3"}}}},
+	} {
+		want, err := marshalJSON(tc.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		suffix := `]`
+		if tc.doc.Next != "" {
+			suffix += `,"@odata.nextLink":` + jsonString(tc.doc.Next)
+		}
+		rec := httptest.NewRecorder()
+		streamJSONArray(rec, "application/json", `{"@odata.context":`+jsonString(tc.doc.Context)+`,"value":[`, len(tc.doc.Value), func(i int) interface{} {
+			return tc.doc.Value[i]
+		}, suffix+`}`)
+		if got := rec.Body.String(); got != string(want) {
+			t.Errorf("%s: streamed\n%s\nbuffered\n%s", tc.name, got, want)
+		}
+	}
+}
+
+// Feeds and change lists over stream-json-entries are streamed, without a
+// Content-Length, as the bytes they'd have been buffered
+func TestStreamedFeedsMatchBuffered(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for i, md := range []string{
+		`<title>Plain</title>`,
+		`<title>&lt;b&gt;Bold &amp; "quoted"&lt;/b&gt;</title><tags>html &lt;tags&gt;</tags>`,
+		`<title>日本語のパッケージ</title><summary>絵文字 😀 and café</summary>`,
+		`<title>Line&#x2028;separator</title><releaseNotes>tab	and
+newline</releaseNotes>`,
+		`<title>Dependencies</title><dependencies><group targetFramework="net48"><dependency id="Stream.Pkg0" version="[1.0.0,2.0.0)" /></group></dependencies>`,
+	} {
+		for _, ver := range []string{"1.0.0", "2.0.0-beta"} {
+			ts.mustPush(t, testPackage(t, "Stream.Pkg"+strconv.Itoa(i), ver, md, nil))
+		}
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Stream.Pkg1/1.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	v4 := http.Header{"Accept": {"application/json;odata.metadata=minimal"}}
+	for _, tc := range []struct {
+		p      string
+		header http.Header
+	}{
+		{"Packages()?$format=json", nil},
+		{"Packages()?$format=json&$orderby=Id%20desc&$top=3", nil},
+		{"api/v2/Packages()?$format=json&$filter=IsPrerelease", nil},
+		{"Packages()", v4},
+		{"Packages()?$top=4&$skip=2", v4},
+		{"FindPackagesById()?id='Stream.Pkg2'&includePrerelease=true&$format=json", nil},
+		{"FindPackagesById()?id='Stream.Pkg2'&includePrerelease=true", v4},
+		{"Search()?searchTerm=''&includePrerelease=true&$format=json", nil},
+		{"Search()?searchTerm='stream'", v4},
+		{"api/changes", nil},
+		{"api/changes?since=4", nil},
+	} {
+		// Called directly, as net/http adds a Content-Length to short streamed responses
+		get := func(stream int) (string, http.Header) {
+			server.Config().StreamJSONEntries = stream
+			r := httptest.NewRequest(http.MethodGet, server.URL.Path+tc.p, nil)
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			r.Header.Set("X-NuGet-ApiKey", testReadKey)
+			w := httptest.NewRecorder()
+			handleRequest(w, r)
+			wantStatus(t, tc.p, w.Code, w.Body.String(), http.StatusOK)
+			return w.Body.String(), w.Header()
+		}
+		buffered, bh := get(1000)
+		streamed, sh := get(1)
+		if streamed != buffered {
+			t.Errorf("%s: streamed\n%s\nbuffered\n%s", tc.p, streamed, buffered)
+		}
+		if bh.Get("Content-Length") != strconv.Itoa(len(buffered)) || sh.Get("Content-Length") != "" {
+			t.Errorf("%s: buffered Content-Length %q, streamed %q", tc.p, bh.Get("Content-Length"), sh.Get("Content-Length"))
+		}
+		if bh.Get("Content-Type") != sh.Get("Content-Type") {
+			t.Errorf("%s: buffered Content-Type %q, streamed %q", tc.p, bh.Get("Content-Type"), sh.Get("Content-Type"))
+		}
+	}
+}
+
+// largestWriteWriter discards a response, noting the most it was given at once
+type largestWriteWriter struct {
+	header  http.Header
+	largest int
+}
+
+func (w *largestWriteWriter) Header() http.Header { return w.header }
+func (w *largestWriteWriter) WriteHeader(int)     {}
+func (w *largestWriteWriter) Write(b []byte) (int, error) {
+	if len(b) > w.largest {
+		w.largest = len(b)
+	}
+	return len(b), nil
+}
+
+// A response of 20,000 packages built in memory or streamed. write-B is the most
+// handed to the connection at once, the whole body when it's buffered.
+func BenchmarkStreamJSON(b *testing.B) {
+	entries := searchTestEntries(20000, 1)
+	elem := func(i int) interface{} { return newCatalogMetadata(entries[i]) }
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		w := &largestWriteWriter{header: make(http.Header)}
+		for i := 0; i < b.N; i++ {
+			resp := struct {
+				Value []interface{} `json:"value"`
+			}{}
+			for j := range entries {
+				resp.Value = append(resp.Value, elem(j))
+			}
+			out, err := marshalJSON(resp)
+			if err != nil {
+				b.Fatal(err)
+			}
+			w.Write(out)
+		}
+		b.ReportMetric(float64(w.largest), "write-B")
+	})
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		w := &largestWriteWriter{header: make(http.Header)}
+		for i := 0; i < b.N; i++ {
+			streamJSONArray(w, "application/json", `{"value":[`, len(entries), elem, `]}`)
+		}
+		b.ReportMetric(float64(w.largest), "write-B")
+	})
+}
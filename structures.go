@@ -2,12 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	nuspec "github.com/soloworks/go-nuspec"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
 )
 
 // NugetServiceCollection used by NugetService
@@ -43,6 +50,23 @@ func NewNugetService(baseURL string) *NugetService {
 	return &ns
 }
 
+// Prolog of every XML response. encoding/xml's Header names the encoding in upper
+// case, NuGet.org and the $metadata template use lower case.
+const xmlProlog = `<?xml version="1.0" encoding="utf-8"?>` + "\n"
+
+// marshalJSON encodes a JSON response. Descriptions and release notes keep <, >
+// and & as written rather than escaped for HTML, and like every other character
+// outside ASCII are sent as UTF-8.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
 // ToBytes exports structure as byte array
 func (ns *NugetService) ToBytes() []byte {
 	var b bytes.Buffer
@@ -50,7 +74,7 @@ func (ns *NugetService) ToBytes() []byte {
 	output, err := xml.MarshalIndent(ns, "  ", "    ")
 	if err != nil {
 	}
-	b.WriteString(xml.Header)
+	b.WriteString(xmlProlog)
 	b.Write(output)
 	return b.Bytes()
 
@@ -58,10 +82,11 @@ func (ns *NugetService) ToBytes() []byte {
 
 // NugetLink is used in NugetPackage
 type NugetLink struct {
-	Rel   string `xml:"rel,attr"`
-	Title string `xml:"title,attr,omitempty"`
-	Type  string `xml:"type,attr,omitempty"`
-	Href  string `xml:"href,attr"`
+	Rel    string       `xml:"rel,attr"`
+	Title  string       `xml:"title,attr,omitempty"`
+	Type   string       `xml:"type,attr,omitempty"`
+	Href   string       `xml:"href,attr"`
+	Inline *NugetInline `xml:"m:inline,omitempty"`
 }
 
 // NugetFeed represents the XML of a NugetFeed response
@@ -71,12 +96,14 @@ type NugetFeed struct {
 	XMLNs   string   `xml:"xmlns,attr"`
 	XMLNsD  string   `xml:"xmlns:d,attr"`
 	XMLNsM  string   `xml:"xmlns:m,attr"`
-	ID      string   `xml:"id"`
-	Title   struct {
+	// Every entry the feed would page through, for $inlinecount=allpages
+	Count *int   `xml:"m:count,omitempty"`
+	ID    string `xml:"id"`
+	Title struct {
 		Text string `xml:",chardata"`
 		Type string `xml:"type,attr"`
 	} `xml:"title"`
-	Updated  string       `xml:"updated"`
+	Updated  EdmDateTime  `xml:"updated"`
 	Link     []*NugetLink `xml:"link"`
 	Packages []*NugetPackageEntry
 }
@@ -93,7 +120,6 @@ func NewNugetFeed(title string, baseURL string) *NugetFeed {
 	nf.ID = baseURL + title
 	nf.Title.Text = title
 	nf.Title.Type = "text"
-	nf.Updated = time.Now().Format(zuluTimeLayout)
 	nf.Link = append(nf.Link, &NugetLink{
 		Rel:   "self",
 		Title: title,
@@ -103,9 +129,25 @@ func NewNugetFeed(title string, baseURL string) *NugetFeed {
 	return &nf
 }
 
+// SetUpdated stamps the feed with the time the package set last changed. If the
+// store doesn't know, the newest entry's time is used when the feed is rendered,
+// so the same packages always give the same feed.
+func (nf *NugetFeed) SetUpdated(t time.Time) {
+	if !t.IsZero() {
+		nf.Updated.Value = t
+	}
+}
+
 // ToBytes exports structure as byte array
 func (nf *NugetFeed) ToBytes() []byte {
 	var b bytes.Buffer
+	if nf.Updated.Value.IsZero() {
+		for _, p := range nf.Packages {
+			if p.Updated.Value.After(nf.Updated.Value) {
+				nf.Updated.Value = p.Updated.Value
+			}
+		}
+	}
 	// Unmarshal into XML
 	output, err := xml.MarshalIndent(nf, "  ", "    ")
 	// Break XML Encoding to match Nuget server output
@@ -125,7 +167,7 @@ func (nf *NugetFeed) ToBytes() []byte {
 	output = bytes.ReplaceAll(output, []byte("http://hosturl/"), []byte(server.URL.String()))
 
 	// Write the XML Header
-	b.WriteString(xml.Header)
+	b.WriteString(xmlProlog)
 	b.Write(output)
 	return b.Bytes()
 
@@ -152,7 +194,7 @@ type NugetPackageEntry struct {
 		Text string `xml:",chardata"`
 		Type string `xml:"type,attr"`
 	} `xml:"summary"`
-	Updated string `xml:"updated"`
+	Updated EdmDateTime `xml:"updated"`
 	Author  struct {
 		Name string `xml:"name"`
 	} `xml:"author"`
@@ -169,10 +211,7 @@ type NugetPackageEntry struct {
 			Value string `xml:",chardata"`
 			Null  bool   `xml:"m:null,attr"`
 		} `xml:"d:Copyright"`
-		Created struct {
-			Value string `xml:",chardata"`
-			Type  string `xml:"m:type,attr"`
-		} `xml:"d:Created"`
+		Created EdmDateTime `xml:"d:Created"`
 		Dependencies  string `xml:"d:Dependencies"`
 		Description   string `xml:"d:Description"`
 		DownloadCount struct {
@@ -183,14 +222,8 @@ type NugetPackageEntry struct {
 		IconURL           string `xml:"d:IconUrl"`
 		IsLatestVersion   BoolProp `xml:"d:IsLatestVersion"`
 		IsAbsoluteLatestVersion BoolProp `xml:"d:IsAbsoluteLatestVersion"`
-		LastEdited struct {
-			Value string `xml:",chardata"`
-			Type  string `xml:"m:type,attr"`
-		} `xml:"d:LastEdited"`
-		Published struct {
-			Value string `xml:",chardata"`
-			Type  string `xml:"m:type,attr"`
-		} `xml:"d:Published"`
+		LastEdited EdmDateTime `xml:"d:LastEdited"`
+		Published EdmDateTime `xml:"d:Published"`
 		LicenseURL struct {
 			Value string `xml:",chardata"`
 			Null  bool   `xml:"m:null,attr"`
@@ -199,6 +232,11 @@ type NugetPackageEntry struct {
 			Value string `xml:",chardata"`
 			Null  bool   `xml:"m:null,attr"`
 		} `xml:"d:LicenseNames"`
+		// The nuspec's license element, as an SPDX expression or a file in the package
+		LicenseExpression string `xml:"-"`
+		LicenseFile       string `xml:"-"`
+		// The nuspec's readme element, a markdown file in the package
+		ReadmeFile       string `xml:"-"`
 		LicenseReportURL struct {
 			Value string `xml:",chardata"`
 			Null  bool   `xml:"m:null,attr"`
@@ -229,14 +267,82 @@ type NugetPackageEntry struct {
 			Value bool   `xml:",chardata"`
 			Type  string `xml:"m:type,attr"`
 		} `xml:"d:IsPrerelease"`
+		Listed           BoolProp `xml:"d:Listed"`
 		MinClientVersion struct {
 			Value string `xml:",chardata"`
 			Null  bool   `xml:"m:null,attr"`
 		} `xml:"d:MinClientVersion"`
-		Language string `xml:"d:Language"`
+		DevelopmentDependency BoolProp `xml:"d:DevelopmentDependency"`
+		Language              string   `xml:"d:Language"`
+		// Frameworks the package has assemblies or build files for, | separated
+		SupportedFrameworks string `xml:"d:SupportedFrameworks"`
+		// Set on every version of a retired package ID, see retirement.go
+		DeprecationMessage string `xml:"d:DeprecationMessage,omitempty"`
+		AlternatePackageID string `xml:"d:AlternatePackageId,omitempty"`
 	} `xml:"m:properties"`
 }
 
+// EdmDateTime holds a timestamp as a time.Time, it is only formatted when rendered
+type EdmDateTime struct {
+	Value time.Time
+	Type  string
+}
+
+// MarshalXML renders the timestamp as RFC3339 UTC with a Z suffix
+func (dt EdmDateTime) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if dt.Type != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "m:type"}, Value: dt.Type})
+	}
+	return e.EncodeElement(formatAtomTime(dt.Value), start)
+}
+
+// UnmarshalXML reads back a timestamp written by MarshalXML (or by older versions)
+func (dt *EdmDateTime) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var s string
+	if err := d.DecodeElement(&s, &start); err != nil {
+		return err
+	}
+	for _, a := range start.Attr {
+		if a.Name.Local == "type" {
+			dt.Type = a.Value
+		}
+	}
+	dt.Value = parseTimestamp(s)
+	return nil
+}
+
+// formatAtomTime formats a timestamp for Atom/XML output (RFC3339, UTC, Z suffix)
+func formatAtomTime(t time.Time) string {
+	return t.UTC().Format(zuluTimeLayout)
+}
+
+// formatODataJSONTime formats a timestamp for OData verbose JSON output (/Date(ms)/)
+func formatODataJSONTime(t time.Time) string {
+	return fmt.Sprintf("/Date(%d)/", t.UnixNano()/int64(time.Millisecond))
+}
+
+// formatISO8601Time formats a timestamp for V3 JSON output (ISO8601, UTC)
+func formatISO8601Time(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseTimestamp reads a stored timestamp string, trying the layouts older
+// metadata may have been written with. Unparseable values are logged rather
+// than silently becoming the zero time.
+func parseTimestamp(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{zuluTimeLayout, time.RFC3339Nano, "2006-01-02T15:04:05", time.RFC1123Z, time.RFC1123} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC()
+		}
+	}
+	log.Printf("WARNING: Could not parse stored timestamp %q, leaving it unset", s)
+	return time.Time{}
+}
+
 type BoolProp struct {
 	Value bool   `xml:",chardata"`
 	Type  string `xml:"m:type,attr"`
@@ -280,12 +386,18 @@ func NewNugetPackageEntry(nsf *nuspec.NuSpec) *NugetPackageEntry {
 	e.Properties.ID = nsf.Meta.ID
 	e.Properties.IDLowerCase = strings.ToLower(e.Properties.ID)
 	e.Properties.Version = nsf.Meta.Version
-	e.Properties.VersionNorm = nsf.Meta.Version
+	e.Properties.VersionNorm = versions.Normalize(nsf.Meta.Version)
 	e.Properties.Copyright.Value = nsf.Meta.Copyright
 	if e.Properties.Copyright.Value == "" {
 		e.Properties.Copyright.Null = true
 	}
 	e.Properties.Description = nsf.Meta.Description
+	// V2 dependency format is id:range:framework separated by |
+	var deps []string
+	for _, d := range nsf.Meta.Dependencies.Dependency {
+		deps = append(deps, d.ID+":"+d.Version+":")
+	}
+	e.Properties.Dependencies = strings.Join(deps, "|")
 	e.Properties.GalleryDetailsURL = nsf.Meta.ProjectURL
 	e.Properties.IconURL = nsf.Meta.IconURL
 	e.Properties.IsLatestVersion.Type = "Edm.Boolean"
@@ -295,9 +407,23 @@ func NewNugetPackageEntry(nsf *nuspec.NuSpec) *NugetPackageEntry {
 	if e.Properties.ReleaseNotes.Value == "" {
 		e.Properties.ReleaseNotes.Null = true
 	}
+	// A license expression or file gets the LicenseUrl NuGet expects in its place
+	e.Properties.LicenseURL.Value = nsf.Meta.LicenseURL
+	switch lic := strings.TrimSpace(nsf.Meta.License.Text); {
+	case lic == "":
+	case strings.EqualFold(nsf.Meta.License.Type, "expression"):
+		e.Properties.LicenseExpression = lic
+		e.Properties.LicenseNames.Value = lic
+	case strings.EqualFold(nsf.Meta.License.Type, "file"):
+		e.Properties.LicenseFile = packageFilePath(lic)
+	}
+	if e.Properties.LicenseURL.Value == "" && (e.Properties.LicenseExpression != "" || e.Properties.LicenseFile != "") {
+		e.Properties.LicenseURL.Value = deprecatedLicenseURL
+	}
 	if e.Properties.LicenseURL.Value == "" {
 		e.Properties.LicenseURL.Null = true
 	}
+	e.Properties.RequireLicenseAcceptance.Value = nsf.Meta.ReqLicenseAccept
 	if e.Properties.LicenseNames.Value == "" {
 		e.Properties.LicenseNames.Null = true
 	}
@@ -315,10 +441,13 @@ func NewNugetPackageEntry(nsf *nuspec.NuSpec) *NugetPackageEntry {
 	// Set other values
 	e.Properties.Created.Type = "Edm.DateTime"
 	e.Properties.DownloadCount.Type = "Edm.Int32"
+	e.Properties.IsPrerelease.Value = versions.IsPrerelease(nsf.Meta.Version)
 	e.Properties.IsPrerelease.Type = "Edm.Boolean"
+	e.Properties.Listed = BoolProp{Value: true, Type: "Edm.Boolean"}
 	e.Properties.LastEdited.Type = "Edm.DateTime"
 	e.Properties.Published.Type = "Edm.DateTime"
 	e.Properties.RequireLicenseAcceptance.Type = "Edm.Boolean"
+	e.Properties.DevelopmentDependency.Type = "Edm.Boolean"
 	e.Properties.VersionDownloadCount.Type = "Edm.Int32"
 
 	// Replace http://content/ with internal full URLs
@@ -330,6 +459,28 @@ func NewNugetPackageEntry(nsf *nuspec.NuSpec) *NugetPackageEntry {
 	return &e
 }
 
+// setNuspecDetails sets what the parsed nuspec leaves out from the nuspec in the
+// package itself: dependencies keeping the target framework of each group, the
+// minClientVersion, developmentDependency and readme
+func (e *NugetPackageEntry) setNuspecDetails(pkg []byte) {
+	b, err := readNuspecFile(pkg)
+	if err != nil {
+		return
+	}
+	b = stripBOM(b)
+	if deps, err := nuspecDependencies(b); err == nil {
+		e.Properties.Dependencies = deps
+	}
+	if min, dev, err := nuspecClientDetails(b); err == nil {
+		e.Properties.MinClientVersion.Value = min
+		e.Properties.MinClientVersion.Null = min == ""
+		e.Properties.DevelopmentDependency.Value = dev
+	}
+	if rm := nuspecReadme(b); rm != "" {
+		e.Properties.ReadmeFile = packageFilePath(rm)
+	}
+}
+
 // Filename returns the logical filename for this package
 func (npe *NugetPackageEntry) Filename() string {
 	return npe.Properties.ID + "." + npe.Properties.Version + ".nupkg"
@@ -365,7 +516,7 @@ func (npe *NugetPackageEntry) ToBytes() []byte {
 	output = bytes.ReplaceAll(output, []byte("http://hosturl/"), []byte(server.URL.String()))
 
 	// Write the XML Header
-	b.WriteString(xml.Header)
+	b.WriteString(xmlProlog)
 	b.Write(output)
 	return b.Bytes()
 }
@@ -375,62 +526,130 @@ type packageParams struct {
 	Version string
 }
 
-func newPackageParams(p string) *packageParams {
+// parsePackageKey reads the key of a Packages(Id='..',Version='..') path, starting
+// after the opening bracket, and returns whatever follows the closing one, such as
+// /$value. Keys may come in any order and case with spaces around them, and a quote
+// inside a value is doubled as OData escapes it.
+func parsePackageKey(p string) (*packageParams, string, error) {
 	pp := packageParams{}
+	seen := make(map[string]bool)
+	i := 0
+	skipSpace := func() {
+		for i < len(p) && (p[i] == ' ' || p[i] == '\t') {
+			i++
+		}
+	}
 
-	for strings.Contains(p, `=`) {
-		i := strings.Index(p, `=`)
-		if i == -1 || i == 0 {
-			break // malformed string, stop parsing
+	for {
+		skipSpace()
+		if i < len(p) && p[i] == ')' && len(seen) == 0 {
+			// Packages() is the list feed
+			return &pp, p[i+1:], nil
+		}
+
+		// Key
+		start := i
+		for i < len(p) && p[i] != '=' && p[i] != ' ' && p[i] != '\t' && p[i] != ',' && p[i] != ')' && p[i] != '\'' {
+			i++
+		}
+		k := strings.ToLower(p[start:i])
+		if k == "" {
+			return nil, "", errors.New("expected a key at position " + strconv.Itoa(start))
+		}
+		if seen[k] {
+			return nil, "", errors.New("key " + p[start:i] + " is given twice")
 		}
-		k := strings.TrimSpace(p[:i])
-		p = p[i+1:] // skip the '=' character
+		seen[k] = true
+		skipSpace()
+		if i >= len(p) || p[i] != '=' {
+			return nil, "", errors.New("expected = after " + p[start:i])
+		}
+		i++
+		skipSpace()
 
-		i = strings.Index(p, `'`)
-		if i == -1 {
-			break // malformed string
+		// Quoted value, with '' standing for a quote
+		if i >= len(p) || p[i] != '\'' {
+			return nil, "", errors.New("value of " + p[start:i-1] + " must be quoted")
 		}
-		j := strings.Index(p[i+1:], `'`)
-		if j == -1 {
-			break // malformed string
+		i++
+		var v strings.Builder
+		closed := false
+		for i < len(p) {
+			if p[i] == '\'' {
+				if i+1 < len(p) && p[i+1] == '\'' {
+					v.WriteByte('\'')
+					i += 2
+					continue
+				}
+				i++
+				closed = true
+				break
+			}
+			v.WriteByte(p[i])
+			i++
 		}
-		v := strings.TrimSpace(p[i+1 : i+1+j])
-		p = strings.TrimSpace(p[i+1+j+1:])
-		if strings.HasPrefix(p, ",") {
-			p = p[1:]
+		if !closed {
+			return nil, "", errors.New("unterminated quote in value of " + k)
 		}
 		switch k {
-		case `Id`:
-			pp.ID = v
-		case `Version`:
-			pp.Version = v
+		case "id":
+			pp.ID = strings.TrimSpace(v.String())
+		case "version":
+			pp.Version = strings.TrimSpace(v.String())
 		}
-	}
 
-	return &pp
+		// Separator or the end of the key
+		skipSpace()
+		if i >= len(p) {
+			return nil, "", errors.New("missing closing bracket")
+		}
+		switch p[i] {
+		case ',':
+			i++
+		case ')':
+			return &pp, p[i+1:], nil
+		default:
+			return nil, "", errors.New("unexpected " + string(p[i]) + " at position " + strconv.Itoa(i))
+		}
+	}
 }
 
+// statusWriter records the status and length of a response for the request log.
+// Like net/http, the first status sent is the one that counts, and a response
+// whose handler never called WriteHeader went out as 200.
 type statusWriter struct {
 	http.ResponseWriter
 	status int
 	length int
 }
 
+// Status returns the status sent, 200 if the handler never set one
 func (w *statusWriter) Status() int {
 	if w.status == 0 {
-		return 200
+		return http.StatusOK
 	}
 	return w.status
 }
 
+// WroteHeader reports whether the status has been sent, by WriteHeader or the
+// first Write
+func (w *statusWriter) WroteHeader() bool {
+	return w.status != 0
+}
+
 func (w *statusWriter) WriteHeader(status int) {
+	// Later calls are ignored by net/http, so don't record them
+	if w.status != 0 {
+		log.Println("Warning: superfluous WriteHeader", status, "after", w.status)
+		return
+	}
 	w.status = status
 	w.ResponseWriter.WriteHeader(status)
 }
 
 func (w *statusWriter) Write(b []byte) (int, error) {
 	if w.status == 0 {
-		w.status = 200
+		w.status = http.StatusOK
 	}
 	n, err := w.ResponseWriter.Write(b)
 	w.length += n
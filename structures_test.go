@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A package published at a known instant has that time in every feed format
+func TestTimestampsMatchAcrossFormats(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Time.Pkg", "1.0.0", "", nil))
+
+	// The local store takes the publish time from the file
+	published := time.Date(2021, 3, 4, 5, 6, 7, 0, time.FixedZone("AEST", 10*60*60))
+	if err := os.Chtimes(ts.nupkgPath(t, "time.pkg", "1.0.0"), published, published); err != nil {
+		t.Fatal(err)
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/reindex", testWriteKey, nil, nil))
+	wantStatus(t, "reindex", status, body, http.StatusOK)
+
+	// Atom: RFC3339 in UTC
+	_, atom := ts.get(t, "Packages(Id='Time.Pkg',Version='1.0.0')")
+	if got := between(atom, `<d:Published m:type="Edm.DateTime">`, "<"); got != "2021-03-03T19:06:07Z" {
+		t.Errorf("Atom Published = %q", got)
+	}
+
+	// OData verbose JSON: /Date(ms)/
+	_, verbose := ts.get(t, "Packages(Id='Time.Pkg',Version='1.0.0')?$format=json")
+	var v struct {
+		D struct {
+			Results []struct{ Published string }
+		}
+	}
+	if err := json.Unmarshal([]byte(verbose), &v); err != nil || len(v.D.Results) != 1 {
+		t.Fatalf("%v: %s", err, verbose)
+	}
+	ms, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(v.D.Results[0].Published, "/Date("), ")/"), 10, 64)
+	if err != nil || !time.Unix(0, ms*int64(time.Millisecond)).Equal(published) {
+		t.Errorf("JSON Published = %q", v.D.Results[0].Published)
+	}
+
+	// V3: ISO8601 in UTC
+	_, leaf := ts.get(t, "v3/registration/time.pkg/1.0.0.json")
+	var r struct {
+		Published    string `json:"published"`
+		CatalogEntry struct {
+			Published string `json:"published"`
+		} `json:"catalogEntry"`
+	}
+	if err := json.Unmarshal([]byte(leaf), &r); err != nil {
+		t.Fatalf("%v: %s", err, leaf)
+	}
+	if r.Published != "2021-03-03T19:06:07Z" || r.CatalogEntry.Published != r.Published {
+		t.Errorf("V3 published = %q, catalog entry %q", r.Published, r.CatalogEntry.Published)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+	for _, s := range []string{
+		"2019-05-06T07:08:09Z",
+		"2019-05-06T17:08:09+10:00",
+		" 2019-05-06T07:08:09 ",
+		"Mon, 06 May 2019 07:08:09 +0000",
+	} {
+		if got := parseTimestamp(s); !got.Equal(want) {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "06/05/2019 07:08:09"} {
+		if got := parseTimestamp(s); !got.IsZero() {
+			t.Errorf("parseTimestamp(%q) = %v, want unset", s, got)
+		}
+	}
+}
+
+// Variations of the package key seen from clients
+func TestParsePackageKey(t *testing.T) {
+	for _, c := range []struct {
+		key, id, version, rest string
+	}{
+		{"Id='A.Pkg',Version='1.0.0')", "A.Pkg", "1.0.0", ""},
+		{"Version='1.0.0',Id='A.Pkg')", "A.Pkg", "1.0.0", ""},
+		{"id='A.Pkg',version='1.0.0')", "A.Pkg", "1.0.0", ""},
+		{"ID='A.Pkg',VERSION='1.0.0')", "A.Pkg", "1.0.0", ""},
+		{" Id = 'A.Pkg' ,\tVersion= '1.0.0' )", "A.Pkg", "1.0.0", ""},
+		{"Id=' A.Pkg ',Version='1.0.0')", "A.Pkg", "1.0.0", ""},
+		{"Id='O''Brien.Pkg',Version='1.0.0')", "O'Brien.Pkg", "1.0.0", ""},
+		{"Id='A,Pkg)',Version='1.0.0')", "A,Pkg)", "1.0.0", ""},
+		{"Id='A.Pkg',Version='1.0.0')/$value", "A.Pkg", "1.0.0", "/$value"},
+		{"Id='A.Pkg')", "A.Pkg", "", ""},
+		{"Id='',Version='')", "", "", ""},
+		{"Other='x',Id='A.Pkg')", "A.Pkg", "", ""},
+		{")", "", "", ""},
+		{" )/$count", "", "", "/$count"},
+	} {
+		pp, rest, err := parsePackageKey(c.key)
+		if err != nil {
+			t.Errorf("%s: %v", c.key, err)
+			continue
+		}
+		if pp.ID != c.id || pp.Version != c.version || rest != c.rest {
+			t.Errorf("%s: got %q %q rest %q, want %q %q rest %q", c.key, pp.ID, pp.Version, rest, c.id, c.version, c.rest)
+		}
+	}
+
+	for _, key := range []string{
+		"",
+		"Id='A.Pkg'",
+		"Id='A.Pkg',Version='1.0.0'",
+		"Id='A.Pkg,Version='1.0.0')",
+		"Id=A.Pkg,Version='1.0.0')",
+		"Id='A.Pkg' Version='1.0.0')",
+		"Id='A.Pkg',,Version='1.0.0')",
+		"Id='A.Pkg',)",
+		"Id='A.Pkg',id='B.Pkg')",
+		"'A.Pkg','1.0.0')",
+		"='A.Pkg')",
+		"Id'A.Pkg')",
+		"Id='A.Pkg'x)",
+	} {
+		if pp, rest, err := parsePackageKey(key); err == nil {
+			t.Errorf("%q parsed as %+v rest %q, want an error", key, pp, rest)
+		}
+	}
+}
+
+// Any key quoted the OData way reads back as written, and nothing makes the
+// parser panic or return more than it was given
+func FuzzParsePackageKey(f *testing.F) {
+	f.Add("A.Pkg", "1.0.0", "/$value")
+	f.Add("O'Brien", "1.0.0-beta", "")
+	f.Add("A,B)", "1.0.0", ")")
+	f.Add("", "", "''")
+	f.Fuzz(func(t *testing.T, id string, version string, tail string) {
+		quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+		for _, key := range []string{
+			"Id=" + quote(id) + ",Version=" + quote(version) + ")" + tail,
+			" version = " + quote(version) + " , ID=" + quote(id) + ")" + tail,
+		} {
+			pp, rest, err := parsePackageKey(key)
+			if err != nil {
+				t.Fatalf("%q: %v", key, err)
+			}
+			if pp.ID != strings.TrimSpace(id) || pp.Version != strings.TrimSpace(version) || rest != tail {
+				t.Fatalf("%q: got %q %q rest %q", key, pp.ID, pp.Version, rest)
+			}
+		}
+
+		raw := id + version + tail
+		if pp, rest, err := parsePackageKey(raw); err == nil && (pp == nil || !strings.HasSuffix(raw, rest)) {
+			t.Fatalf("%q: got %+v rest %q", raw, pp, rest)
+		}
+	})
+}
+
+// The key variations find the same entry and download, and a malformed key is
+// refused rather than answered with the list feed
+func TestPackageKeyRoutes(t *testing.T) {
+	ts := newTestServer(t, nil)
+	pkg := testPackage(t, "Key.Pkg", "1.0.0", "", nil)
+	ts.mustPush(t, pkg)
+	ts.mustPush(t, testPackage(t, "Key.Other", "1.0.0", "", nil))
+
+	for _, key := range []string{
+		"Packages(Id='Key.Pkg',Version='1.0.0')",
+		"Packages(Version='1.0.0',Id='Key.Pkg')",
+		"Packages(id='key.pkg',version='1.0')",
+		"Packages(%20Id%20=%20'Key.Pkg'%20,%20Version%20=%20'1.0.0'%20)",
+	} {
+		status, body := ts.get(t, key)
+		wantStatus(t, key, status, body, http.StatusOK)
+		if id, ver := between(body, "<d:Id>", "</d:Id>"), between(body, "<d:Version>", "</d:Version>"); id != "Key.Pkg" || ver != "1.0.0" {
+			t.Errorf("%s: got %s %s", key, id, ver)
+		}
+
+		status, body = ts.get(t, key+"/$value")
+		wantStatus(t, key+"/$value", status, body, http.StatusOK)
+		if nuspec, err := readNuspec([]byte(body)); err != nil || nuspec.Meta.ID != "Key.Pkg" {
+			t.Errorf("%s/$value: %v", key, err)
+		}
+	}
+
+	for _, key := range []string{
+		"Packages(Id='Key.Pkg,Version='1.0.0')",
+		"Packages(Id=Key.Pkg,Version='1.0.0')",
+		"Packages(Id='Key.Pkg',Id='Key.Other')",
+		"Packages(Id='Key.Pkg'",
+	} {
+		status, body := ts.get(t, key)
+		wantStatus(t, key, status, body, http.StatusBadRequest)
+		if !strings.Contains(body, "malformed package key") {
+			t.Errorf("%s: %q", key, body)
+		}
+	}
+
+	// $value needs both keys
+	status, body := ts.get(t, "Packages(Id='Key.Pkg')/$value")
+	wantStatus(t, "$value without a version", status, body, http.StatusNotFound)
+	status, body = ts.get(t, "Packages(Id='Key.Pkg',Version='2.0.0')/$value")
+	wantStatus(t, "$value of a missing version", status, body, http.StatusNotFound)
+}
+
+// The status recorded is the first one sent, 200 for a handler that only wrote
+// a body or wrote nothing at all
+func TestStatusWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		write  func(w *statusWriter)
+		status int
+		sent   bool
+		length int
+	}{
+		{"nothing", func(w *statusWriter) {}, http.StatusOK, false, 0},
+		{"body only", func(w *statusWriter) { w.Write([]byte("hello")) }, http.StatusOK, true, 5},
+		{"header", func(w *statusWriter) { w.WriteHeader(http.StatusNotFound) }, http.StatusNotFound, true, 0},
+		{"header then body", func(w *statusWriter) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("ab"))
+			w.Write([]byte("c"))
+		}, http.StatusCreated, true, 3},
+		{"second header", func(w *statusWriter) {
+			w.WriteHeader(http.StatusAccepted)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusAccepted, true, 0},
+		{"header after body", func(w *statusWriter) {
+			w.Write([]byte("x"))
+			w.WriteHeader(http.StatusBadRequest)
+		}, http.StatusOK, true, 1},
+	} {
+		rec := httptest.NewRecorder()
+		w := &statusWriter{ResponseWriter: rec}
+		tc.write(w)
+		if w.Status() != tc.status || w.WroteHeader() != tc.sent || w.length != tc.length {
+			t.Errorf("%s: got status %d, sent %v, length %d, want %d, %v, %d", tc.name, w.Status(), w.WroteHeader(), w.length, tc.status, tc.sent, tc.length)
+		}
+		if tc.sent && rec.Code != tc.status {
+			t.Errorf("%s: sent %d, recorded %d", tc.name, rec.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Package type a .snupkg's nuspec declares
+const symbolsPackageType = "SymbolsPackage"
+
+// Name the PDB index is kept under in the filestore's settings
+const symbolsSetting = "symbols"
+
+// symbolEntry is where an indexed PDB is, the version whose .snupkg holds it and
+// its path in there
+type symbolEntry struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	Path    string `json:"path"`
+}
+
+// nuspecPackageTypes is the part of a nuspec naming its package types
+type nuspecPackageTypes struct {
+	Meta struct {
+		PackageTypes struct {
+			PackageType []struct {
+				Name string `xml:"name,attr"`
+			} `xml:"packageType"`
+		} `xml:"packageTypes"`
+	} `xml:"metadata"`
+}
+
+// isSymbolsNuspec reports whether a nuspec declares the SymbolsPackage type
+func isSymbolsNuspec(b []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(stripBOM(b)))
+	d.Strict = false
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var t nuspecPackageTypes
+	if err := d.Decode(&t); err != nil {
+		return false
+	}
+	for _, p := range t.Meta.PackageTypes.PackageType {
+		if strings.EqualFold(p.Name, symbolsPackageType) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPDBFiles reports whether a package holds any .pdb files
+func hasPDBFiles(pkg []byte) bool {
+	zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	if err != nil {
+		return false
+	}
+	for _, f := range zr.File {
+		if strings.EqualFold(path.Ext(f.Name), ".pdb") {
+			return true
+		}
+	}
+	return false
+}
+
+// pushSymbolPackage checks and stores one pushed .snupkg beside the version it is
+// for, writing the response. It returns false if the push failed.
+func pushSymbolPackage(w http.ResponseWriter, r *http.Request, pkg []byte) bool {
+	b, err := readNuspecFile(pkg)
+	if err != nil {
+		writeUploadError(w, http.StatusBadRequest, "not a symbols package: "+err.Error())
+		return false
+	}
+	nsf, err := parseNuspec(b)
+	if err != nil {
+		writeUploadError(w, http.StatusBadRequest, "invalid nuspec: "+err.Error())
+		return false
+	}
+	if !isSymbolsNuspec(b) {
+		writeUploadError(w, http.StatusBadRequest, "not a symbols package: the nuspec has no "+symbolsPackageType+" package type")
+		return false
+	}
+	if !hasPDBFiles(pkg) {
+		writeUploadError(w, http.StatusBadRequest, "not a symbols package: it has no .pdb files")
+		return false
+	}
+
+	// Symbols are governed by the same ID policies as the package
+	if err := checkIDPolicy(r, nsf.Meta.ID); err != nil {
+		writeUploadError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+
+	// Symbols only go beside a version already pushed, stored under its ID and version
+	npe, err := server.fs.GetPackageEntry(r.Context(), nsf.Meta.ID, nsf.Meta.Version)
+	if err == nil {
+		err = server.fs.StoreSymbolPackage(r.Context(), npe.Properties.ID, npe.Properties.Version, pkg)
+	}
+	if err == ErrFileNotFound {
+		writeUploadError(w, http.StatusNotFound, nsf.Meta.ID+" "+nsf.Meta.Version+" isn't in the feed, push the package before its symbols")
+		return false
+	} else if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return false
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return false
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return false
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return true
+}
+
+// serveSymbolPackage serves snupkg/{id}/{version}, the symbols pushed for a version
+func serveSymbolPackage(w http.ResponseWriter, r *http.Request) {
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`snupkg`):], `/`), `/`)
+	if len(x) != 2 || x[0] == "" || x[1] == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Versions outside of a snapshot don't exist within it
+	if snap := requestSnapshot(r); snap != nil && !snap.Contains(x[0], x[1]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	npe, err := server.fs.GetPackageEntry(r.Context(), x[0], x[1])
+	var b []byte
+	if err == nil {
+		b, err = server.fs.GetSymbolPackage(r.Context(), npe.Properties.ID, npe.Properties.Version)
+	}
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Header().Set("Content-Disposition", `filename=`+npe.Properties.ID+"."+npe.Properties.Version+".snupkg")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := writeBody(r.Context(), w, b); isCancelled(err) {
+		logDebug("Stopped sending symbols of", npe.Properties.ID, npe.Properties.Version, "to cancelled request")
+	}
+}
+
+// serveSymbolFile answers the symbol server protocol debuggers use,
+// symbols/{pdbName}/{signature}/{pdbName}, with a PDB from the indexed .snupkgs
+func serveSymbolFile(w http.ResponseWriter, r *http.Request) {
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`symbols`):], `/`), `/`)
+	if len(x) != 3 || x[0] == "" || x[1] == "" || !strings.EqualFold(x[0], x[2]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, _, err := server.fs.GetSymbolFile(r.Context(), x[0], x[1])
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// A signature names one build of a PDB, so it never changes
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := writeBody(r.Context(), w, b); isCancelled(err) {
+		logDebug("Stopped sending", x[0], x[1], "to cancelled request")
+	}
+}
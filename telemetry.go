@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverVersion is reported in telemetry, set when building releases with
+// -ldflags "-X main.serverVersion=1.2.3"
+var serverVersion = "dev"
+
+// How often the telemetry summary is sent
+const telemetryInterval = 24 * time.Hour
+
+// Attempts at sending a summary, and the wait before the first retry, doubled for each after
+const (
+	telemetryAttempts = 5
+	telemetryBackoff  = time.Minute
+)
+
+// How long the collector gets to answer
+const telemetryTimeout = 30 * time.Second
+
+// telemetryConfig sends a daily summary of the instance to a collector. Nothing is
+// sent unless it is enabled.
+type telemetryConfig struct {
+	Enabled bool `json:"enabled"`
+	// URL summaries are POSTed to
+	CollectorURL string `json:"collector-url"`
+	// Names this instance in summaries, e.g. the customer site
+	Instance string `json:"instance"`
+}
+
+// validateTelemetry checks the telemetry config
+func validateTelemetry(c *Config) error {
+	if !c.Telemetry.Enabled {
+		return nil
+	}
+	u, err := url.Parse(c.Telemetry.CollectorURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("telemetry collector-url must be an http or https URL")
+	}
+	if strings.TrimSpace(c.Telemetry.Instance) == "" {
+		return errors.New("telemetry instance must be set")
+	}
+	return nil
+}
+
+// telemetrySummary is everything a collector is sent. It only holds counts and
+// facts about the server, nothing read from a package may be added to it.
+type telemetrySummary struct {
+	Instance    string          `json:"instance"`
+	Version     string          `json:"version"`
+	GoVersion   string          `json:"goVersion"`
+	OS          string          `json:"os"`
+	StoreType   string          `json:"storeType"`
+	Generated   time.Time       `json:"generated"`
+	PeriodStart time.Time       `json:"periodStart"`
+	Packages    int             `json:"packages"`
+	Versions    int             `json:"versions"`
+	Downloads   int             `json:"downloads"`
+	Errors      telemetryErrors `json:"errors"`
+	// Kinds of component statusz reports problems with, without what follows a "/"
+	// in their names, which may be a package ID
+	Degraded []string `json:"degraded"`
+}
+
+// telemetryErrors counts error responses since the last summary was sent
+type telemetryErrors struct {
+	Client int `json:"client"`
+	Server int `json:"server"`
+}
+
+// responseCounts counts error responses for telemetry
+var responseCounts struct {
+	lock  sync.Mutex
+	since time.Time
+	telemetryErrors
+}
+
+// countResponse notes a response's status for telemetry
+func countResponse(status int) {
+	if status < 400 {
+		return
+	}
+	responseCounts.lock.Lock()
+	defer responseCounts.lock.Unlock()
+	if status >= 500 {
+		responseCounts.Server++
+	} else {
+		responseCounts.Client++
+	}
+}
+
+// resetResponseCounts starts a new period, once a summary of the last was sent.
+// Responses counted after the summary was built carry over.
+func resetResponseCounts(sent telemetrySummary) {
+	responseCounts.lock.Lock()
+	defer responseCounts.lock.Unlock()
+	responseCounts.since = sent.Generated
+	responseCounts.Client -= sent.Errors.Client
+	responseCounts.Server -= sent.Errors.Server
+}
+
+// buildTelemetry returns the summary that would be sent now
+func buildTelemetry(ctx context.Context) (*telemetrySummary, error) {
+	server.fs.UpdateCountsInMemory()
+	entries, err := allPackageEntries(ctx, server.fs, "")
+	if err != nil {
+		return nil, err
+	}
+
+	c := server.Config()
+	t := &telemetrySummary{
+		Instance:  c.Telemetry.Instance,
+		Version:   serverVersion,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS + "/" + runtime.GOARCH,
+		StoreType: c.FileStore.Type,
+		Generated: time.Now().UTC(),
+		Versions:  len(entries),
+		Degraded:  []string{},
+	}
+	ids := make(map[string]bool)
+	for _, e := range entries {
+		ids[strings.ToLower(e.Properties.ID)] = true
+		t.Downloads += e.Properties.VersionDownloadCount.Value
+	}
+	t.Packages = len(ids)
+	kinds := make(map[string]bool)
+	for _, p := range server.health.List() {
+		k := strings.SplitN(p.Component, "/", 2)[0]
+		if !kinds[k] {
+			kinds[k] = true
+			t.Degraded = append(t.Degraded, k)
+		}
+	}
+
+	responseCounts.lock.Lock()
+	t.PeriodStart = responseCounts.since
+	t.Errors = responseCounts.telemetryErrors
+	responseCounts.lock.Unlock()
+	return t, nil
+}
+
+// sendTelemetry POSTs a summary to the collector
+func sendTelemetry(ctx context.Context, collector string, t *telemetrySummary) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, telemetryTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, collector, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("collector answered " + res.Status)
+	}
+	return nil
+}
+
+// reportTelemetry builds and sends a summary, starting a new period if it's sent
+func reportTelemetry(ctx context.Context) error {
+	c := server.Config()
+	if !c.Telemetry.Enabled {
+		return errors.New("telemetry is not enabled")
+	}
+	t, err := buildTelemetry(ctx)
+	if err != nil {
+		return err
+	}
+	if err := sendTelemetry(ctx, c.Telemetry.CollectorURL, t); err != nil {
+		return err
+	}
+	resetResponseCounts(*t)
+	return nil
+}
+
+// runTelemetry sends a summary every day while telemetry is enabled, retrying with
+// backoff if the collector can't be reached. It is started whether or not telemetry
+// is enabled so a config reload can turn it on.
+func runTelemetry() {
+	responseCounts.lock.Lock()
+	responseCounts.since = time.Now().UTC()
+	responseCounts.lock.Unlock()
+
+	for range time.NewTicker(telemetryInterval).C {
+		if !server.Config().Telemetry.Enabled {
+			continue
+		}
+		wait := telemetryBackoff
+		for i := 1; ; i++ {
+			err := reportTelemetry(context.Background())
+			if err == nil {
+				break
+			}
+			if i == telemetryAttempts {
+				log.Println("Error sending telemetry, giving up until tomorrow:", err)
+				break
+			}
+			log.Println("Error sending telemetry, retrying in", wait, err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+func serveTelemetry(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path[len(server.URL.Path+`admin/telemetry/`):] {
+	case `preview`:
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// Built as the server itself sees the store, as a sent summary is
+		t, err := buildTelemetry(context.Background())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(t)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+	case `send`:
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !server.Config().Telemetry.Enabled {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("telemetry is not enabled"))
+			return
+		}
+		// Sent once, the daily summary is the one retried
+		if err := reportTelemetry(context.Background()); err != nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
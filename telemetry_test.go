@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A summary carries counts only: a package's ID, version and metadata, the API
+// keys and the components statusz names appear nowhere in what's sent
+func TestTelemetrySentinels(t *testing.T) {
+	// Every name the server knows a package or key by is marked with the sentinel
+	const sentinel = "zq7sentinel"
+	const (
+		id       = "Zq7Sentinel.Package"
+		key      = "zq7sentinel-write-key"
+		readKey  = "zq7sentinel-read-key"
+		metadata = `<title>Zq7Sentinel Title</title><tags>zq7sentinel-tag</tags><owners>zq7sentinel-owner</owners>
+<projectUrl>https://zq7sentinel.example/</projectUrl><releaseNotes>zq7sentinel notes</releaseNotes>`
+	)
+
+	var received struct {
+		sync.Mutex
+		header http.Header
+		url    string
+		body   []string
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received.Lock()
+		defer received.Unlock()
+		received.header, received.url = r.Header, r.URL.String()
+		received.body = append(received.body, string(b))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer collector.Close()
+
+	ts := newTestServer(t, func(c *Config) {
+		c.Telemetry = telemetryConfig{Enabled: true, CollectorURL: collector.URL + "/collect", Instance: "site-a"}
+		c.FileStore.APIKeys.ReadWrite = append(c.FileStore.APIKeys.ReadWrite, key)
+		c.FileStore.APIKeys.ReadOnly = append(c.FileStore.APIKeys.ReadOnly, readKey)
+	})
+	status, body := readResponse(t, ts.pushTo(t, "api/v2/package/", key, testPackage(t, id, "7.7.7-zq7sentinel", metadata, map[string]string{"lib/net48/Zq7Sentinel.dll": sentinel})))
+	wantStatus(t, "push", status, body, http.StatusCreated)
+	for _, p := range []string{"nupkg/" + id + "/7.7.7-zq7sentinel", "nupkg/" + id + "/9.9.9-zq7sentinel"} {
+		readResponse(t, ts.do(t, http.MethodGet, p, readKey, nil, nil))
+	}
+	server.health.Degrade("nupkg/"+id, "zq7sentinel could not be read")
+	defer server.health.Recover("nupkg/" + id)
+
+	status, preview := readResponse(t, ts.do(t, http.MethodGet, "admin/telemetry/preview", key, nil, nil))
+	wantStatus(t, "preview", status, preview, http.StatusOK)
+	status, body = readResponse(t, ts.do(t, http.MethodPost, "admin/telemetry/send", key, nil, nil))
+	wantStatus(t, "send", status, body, http.StatusNoContent)
+
+	received.Lock()
+	defer received.Unlock()
+	if len(received.body) != 1 {
+		t.Fatalf("collector got %d summaries", len(received.body))
+	}
+	sent := received.body[0]
+	var headers []string
+	for k, vs := range received.header {
+		headers = append(headers, k+": "+strings.Join(vs, ", "))
+	}
+	for name, s := range map[string]string{
+		"summary sent":    sent,
+		"preview":         preview,
+		"request URL":     received.url,
+		"request headers": strings.Join(headers, "\n"),
+	} {
+		if strings.Contains(strings.ToLower(s), sentinel) {
+			t.Errorf("%s holds a package's or key's name:\n%s", name, s)
+		}
+	}
+
+	// What is sent is still a useful summary
+	var summary telemetrySummary
+	if err := json.Unmarshal([]byte(sent), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Instance != "site-a" || summary.Packages != 1 || summary.Versions != 1 ||
+		summary.Errors.Client < 1 || strings.Join(summary.Degraded, ",") != "nupkg" {
+		t.Errorf("summary %s", sent)
+	}
+}
@@ -0,0 +1,182 @@
+// Command record is a logging reverse proxy for capturing what NuGet clients send
+// to a feed and what they get back.
+//
+// Point a client at the proxy instead of the feed and every exchange is appended
+// to the output file as one JSON line, with API keys and credentials redacted and
+// the feed's URL replaced by {base}, so recordings from any server compare equal.
+// Links to the feed in responses are rewritten to the proxy so clients following
+// them stay on it, and responses aren't compressed so they can be:
+//
+//	go run ./tools/record -target http://localhost:5000/feed/ -listen :5001 -out dotnet-restore.jsonl
+//	dotnet restore --source http://localhost:5001/feed/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Headers whose values are replaced before being written
+var secretHeaders = []string{"X-Nuget-Apikey", "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// exchange is one recorded request and response
+type exchange struct {
+	Time     time.Time     `json:"time"`
+	Request  recordedHTTP  `json:"request"`
+	Response recordedHTTP  `json:"response"`
+	Duration time.Duration `json:"duration"`
+
+	public string // The feed's URL as the client sees it, through the proxy
+}
+
+// recordedHTTP is a request or response. Bodies that aren't UTF-8 text are kept
+// as base64, bodies over the limit only by their size.
+type recordedHTTP struct {
+	Method     string              `json:"method,omitempty"`
+	Path       string              `json:"path,omitempty"`
+	Status     int                 `json:"status,omitempty"`
+	Header     map[string][]string `json:"header"`
+	Body       string              `json:"body,omitempty"`
+	BodyBase64 string              `json:"bodyBase64,omitempty"`
+	BodySize   int                 `json:"bodySize"`
+}
+
+func main() {
+	target := flag.String("target", "http://localhost:5000/", "feed to forward to")
+	listen := flag.String("listen", ":5001", "address to listen on")
+	out := flag.String("out", "recording.jsonl", "file exchanges are appended to")
+	maxBody := flag.Int("max-body", 1<<20, "largest body recorded in full, in bytes")
+	flag.Parse()
+
+	u, err := url.Parse(*target)
+	if err != nil {
+		log.Fatal("Error with -target: ", err)
+	}
+	f, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	rec := &recorder{out: json.NewEncoder(f), base: strings.TrimSuffix(u.String(), "/"), basePath: strings.TrimSuffix(u.Path, "/"), maxBody: *maxBody}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: u.Scheme, Host: u.Host})
+	proxy.ModifyResponse = rec.response
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = u.Host
+		r.Header.Del("Accept-Encoding")
+	}
+
+	log.Printf("Recording %s on %s to %s", u, *listen, *out)
+	log.Fatal(http.ListenAndServe(*listen, rec.wrap(proxy)))
+}
+
+// recorder writes exchanges as they complete
+type recorder struct {
+	lock     sync.Mutex
+	out      *json.Encoder
+	base     string // The feed's URL, without a trailing slash
+	basePath string // The feed's path, without a trailing slash
+	maxBody  int
+}
+
+type contextKey int
+
+const exchangeKey contextKey = 0
+
+// wrap records the request before handing it on, so the body is still there to send
+func (rc *recorder) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		e := &exchange{Time: time.Now().UTC(), public: "http://" + r.Host + rc.basePath}
+		e.Request = rc.record(e, r.Header, body)
+		e.Request.Method = r.Method
+		e.Request.Path = r.URL.RequestURI()
+		if strings.HasPrefix(e.Request.Path, rc.basePath+"/") {
+			e.Request.Path = "{base}" + strings.TrimPrefix(e.Request.Path, rc.basePath)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), exchangeKey, e)))
+	})
+}
+
+// response records the response and writes out the exchange
+func (rc *recorder) response(res *http.Response) error {
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	e, _ := res.Request.Context().Value(exchangeKey).(*exchange)
+	if e == nil {
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+	e.Response = rc.record(e, res.Header, body)
+	e.Response.Status = res.StatusCode
+	e.Duration = time.Since(e.Time)
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if err := rc.out.Encode(e); err != nil {
+		log.Println("Error writing recording:", err)
+	}
+	log.Println(e.Request.Method, e.Request.Path, e.Response.Status)
+
+	// Keep the client on the proxy
+	if utf8.Valid(body) {
+		body = bytes.Replace(body, []byte(rc.base), []byte(e.public), -1)
+		res.ContentLength = int64(len(body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if l := res.Header.Get("Location"); l != "" {
+		res.Header.Set("Location", strings.Replace(l, rc.base, e.public, 1))
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// record sanitizes headers and a body for writing
+func (rc *recorder) record(e *exchange, h http.Header, body []byte) recordedHTTP {
+	rh := recordedHTTP{Header: make(map[string][]string), BodySize: len(body)}
+	for k, v := range h {
+		for _, s := range v {
+			rh.Header[k] = append(rh.Header[k], rc.sanitize(e, s))
+		}
+	}
+	for _, k := range secretHeaders {
+		if _, ok := rh.Header[k]; ok {
+			rh.Header[k] = []string{"REDACTED"}
+		}
+	}
+	if len(body) > rc.maxBody {
+		return rh
+	}
+	if utf8.Valid(body) {
+		rh.Body = rc.sanitize(e, string(body))
+	} else {
+		rh.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+	}
+	return rh
+}
+
+// sanitize replaces the feed's URL, as either the feed or the client sees it
+func (rc *recorder) sanitize(e *exchange, s string) string {
+	s = strings.Replace(s, rc.base, "{base}", -1)
+	return strings.Replace(s, e.public, "{base}", -1)
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing follows the OpenTelemetry conventions without depending on its SDK: it is
+// configured by the standard OTEL_* environment variables, continues W3C traceparent
+// headers and exports over OTLP/HTTP as JSON. With no exporter configured there is no
+// tracer and every span is nil, which costs a nil check.
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// OTLP status codes
+const (
+	spanStatusUnset = 0
+	spanStatusError = 2
+)
+
+// Defaults for the batch span processor and exporter, as in the OpenTelemetry spec
+const (
+	defaultOTLPEndpoint       = "http://localhost:4318"
+	defaultTraceQueueSize     = 2048
+	defaultTraceBatchSize     = 512
+	defaultTraceExportDelay   = 5 * time.Second
+	defaultTraceExportTimeout = 10 * time.Second
+)
+
+// traceAttr is a span attribute, a string, int or bool
+type traceAttr struct {
+	Key   string
+	Value interface{}
+}
+
+// traceSpan is one timed operation within a trace. A nil span records nothing.
+type traceSpan struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []traceAttr
+	status   int
+	message  string
+}
+
+// SetAttr adds an attribute to the span
+func (s *traceSpan) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, traceAttr{Key: key, Value: value})
+}
+
+// SetError marks the span as failed, if err is set
+func (s *traceSpan) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.status = spanStatusError
+	s.message = err.Error()
+}
+
+// End finishes the span and queues it for export
+func (s *traceSpan) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.tracer.queue(s)
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span a context is within, or nil
+func spanFromContext(ctx context.Context) *traceSpan {
+	s, _ := ctx.Value(spanContextKey{}).(*traceSpan)
+	return s
+}
+
+// startSpan starts a child of the context's span. Work outside a traced request,
+// such as CLI commands and background flushes, isn't traced.
+func startSpan(ctx context.Context, name string) (context.Context, *traceSpan) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, spanKindInternal)
+	s.traceID = parent.traceID
+	s.parentID = parent.spanID
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// traced times f as a child span of the context's span
+func traced(ctx context.Context, name string, f func()) {
+	_, s := startSpan(ctx, name)
+	f()
+	s.End()
+}
+
+// startRequestSpan starts the server span for a request, continuing the caller's
+// trace if it sent a traceparent. Requests the caller chose not to sample aren't traced.
+func startRequestSpan(r *http.Request) (*http.Request, *traceSpan) {
+	t := server.tracer
+	if t == nil {
+		return r, nil
+	}
+	s := t.newSpan(r.Method, spanKindServer)
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return r, nil
+		}
+		s.traceID = traceID
+		s.parentID = parentID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	s.SetAttr("http.request.method", r.Method)
+	s.SetAttr("url.path", r.URL.Path)
+	if ua := r.UserAgent(); ua != "" {
+		s.SetAttr("user_agent.original", ua)
+	}
+	return r.WithContext(context.WithValue(r.Context(), spanContextKey{}, s)), s
+}
+
+// endRequestSpan records the response status and finishes a request's span
+func endRequestSpan(s *traceSpan, status int) {
+	if s == nil {
+		return
+	}
+	s.SetAttr("http.response.status_code", status)
+	if status >= 500 {
+		s.status = spanStatusError
+	}
+	s.End()
+}
+
+// parseTraceparent reads a W3C traceparent header, version 00 or a later one
+func parseTraceparent(h string) ([16]byte, [8]byte, bool, bool) {
+	var traceID [16]byte
+	var parentID [8]byte
+	x := strings.Split(strings.TrimSpace(h), "-")
+	if len(x) < 4 || len(x[0]) != 2 || x[0] == "ff" || (x[0] == "00" && len(x) != 4) ||
+		len(x[1]) != 32 || len(x[2]) != 16 || len(x[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	t, err1 := hex.DecodeString(x[1])
+	p, err2 := hex.DecodeString(x[2])
+	f, err3 := hex.DecodeString(x[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return traceID, parentID, false, false
+	}
+	copy(traceID[:], t)
+	copy(parentID[:], p)
+	if traceID == ([16]byte{}) || parentID == ([8]byte{}) {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, f[0]&1 == 1, true
+}
+
+// tracer batches finished spans and exports them in the background
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	console  bool
+	resource []traceAttr
+	client   *http.Client
+	delay    time.Duration
+	batch    int
+
+	spans   chan *traceSpan
+	done    chan struct{}
+	closing sync.Once
+
+	dropLock sync.Mutex
+	dropped  int
+}
+
+// newTracerFromEnv returns a tracer configured by the OTEL_* environment variables,
+// or nil if no exporter is configured
+func newTracerFromEnv() (*tracer, error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil, nil
+	}
+
+	t := &tracer{
+		headers: make(map[string]string),
+		delay:   defaultTraceExportDelay,
+		batch:   defaultTraceBatchSize,
+	}
+
+	// An exporter is only configured by naming one or giving an endpoint
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	switch e := strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")); e {
+	case "none":
+		return nil, nil
+	case "console":
+		t.console = true
+	case "", "otlp":
+		if e == "" && endpoint == "" && base == "" {
+			return nil, nil
+		}
+		if endpoint == "" {
+			if base == "" {
+				base = defaultOTLPEndpoint
+			}
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+		if _, err := url.Parse(endpoint); err != nil {
+			return nil, errors.New("OTLP traces endpoint is not a valid URL: " + endpoint)
+		}
+		t.endpoint = endpoint
+	default:
+		return nil, errors.New("OTEL_TRACES_EXPORTER must be otlp, console or none: " + e)
+	}
+
+	// Only JSON is spoken, which collectors accept on the same path as protobuf
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if t.endpoint != "" && protocol != "" && protocol != "http/json" && protocol != "http/protobuf" {
+		return nil, errors.New("OTLP over gRPC is not supported, use http/json: " + protocol)
+	}
+
+	for _, h := range []string{os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")} {
+		for k, v := range parseOTelList(h) {
+			t.headers[k] = v
+		}
+	}
+
+	timeout := defaultTraceExportTimeout
+	for _, v := range []string{os.Getenv("OTEL_EXPORTER_OTLP_TIMEOUT"), os.Getenv("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT")} {
+		if ms, err := strconv.Atoi(v); err == nil && ms > 0 {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+	t.client = &http.Client{Timeout: timeout}
+
+	if ms, err := strconv.Atoi(os.Getenv("OTEL_BSP_SCHEDULE_DELAY")); err == nil && ms > 0 {
+		t.delay = time.Duration(ms) * time.Millisecond
+	}
+	if n, err := strconv.Atoi(os.Getenv("OTEL_BSP_MAX_EXPORT_BATCH_SIZE")); err == nil && n > 0 {
+		t.batch = n
+	}
+	queueSize := defaultTraceQueueSize
+	if n, err := strconv.Atoi(os.Getenv("OTEL_BSP_MAX_QUEUE_SIZE")); err == nil && n > 0 {
+		queueSize = n
+	}
+
+	// The service name wins over one given as a resource attribute
+	attrs := parseOTelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		attrs["service.name"] = name
+	} else if attrs["service.name"] == "" {
+		attrs["service.name"] = "go-nuget-server"
+	}
+	for k, v := range attrs {
+		t.resource = append(t.resource, traceAttr{Key: k, Value: v})
+	}
+
+	t.spans = make(chan *traceSpan, queueSize)
+	t.done = make(chan struct{})
+	go t.run()
+	return t, nil
+}
+
+// parseOTelList reads a comma separated list of key=value pairs with URL encoded values
+func parseOTelList(s string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			continue
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			continue
+		}
+		m[strings.TrimSpace(kv[:i])] = v
+	}
+	return m
+}
+
+func (t *tracer) newSpan(name string, kind int) *traceSpan {
+	s := &traceSpan{tracer: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// queue hands a finished span to the exporter, dropping it if the queue is full
+// rather than holding up the request
+func (t *tracer) queue(s *traceSpan) {
+	select {
+	case t.spans <- s:
+	default:
+		t.dropLock.Lock()
+		t.dropped++
+		t.dropLock.Unlock()
+	}
+}
+
+// run exports spans whenever a batch fills or the delay passes, until closed
+func (t *tracer) run() {
+	defer close(t.done)
+	tick := time.NewTicker(t.delay)
+	defer tick.Stop()
+
+	var batch []*traceSpan
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < t.batch {
+				continue
+			}
+		case <-tick.C:
+		}
+		t.export(batch)
+		batch = nil
+
+		t.dropLock.Lock()
+		if t.dropped > 0 {
+			log.Println("Tracing: dropped", t.dropped, "spans with the export queue full")
+			t.dropped = 0
+		}
+		t.dropLock.Unlock()
+	}
+}
+
+// Close exports the spans still queued
+func (t *tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.closing.Do(func() {
+		close(t.spans)
+		<-t.done
+	})
+}
+
+// export sends a batch of spans to the collector, or writes it to the log for the
+// console exporter. Failures are logged and the batch dropped.
+func (t *tracer) export(batch []*traceSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	b, err := json.Marshal(otlpRequest(t.resource, batch))
+	if err != nil {
+		log.Println("Tracing: could not encode spans:", err)
+		return
+	}
+	if t.console {
+		log.Println("Tracing:", string(b))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(b))
+	if err != nil {
+		log.Println("Tracing: export failed:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		log.Println("Tracing: export failed:", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Println("Tracing: export failed:", res.Status)
+	}
+}
+
+// otlpRequest builds the OTLP/JSON export request body for a batch of spans
+func otlpRequest(resource []traceAttr, batch []*traceSpan) interface{} {
+	type status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	type span struct {
+		TraceID      string        `json:"traceId"`
+		SpanID       string        `json:"spanId"`
+		ParentSpanID string        `json:"parentSpanId,omitempty"`
+		Name         string        `json:"name"`
+		Kind         int           `json:"kind"`
+		Start        string        `json:"startTimeUnixNano"`
+		End          string        `json:"endTimeUnixNano"`
+		Attributes   []interface{} `json:"attributes,omitempty"`
+		Status       status        `json:"status"`
+	}
+
+	spans := make([]span, 0, len(batch))
+	for _, s := range batch {
+		o := span{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: otlpAttributes(s.attrs),
+			Status:     status{Code: s.status, Message: s.message},
+		}
+		if s.parentID != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		spans = append(spans, o)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "go-nuget-server"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes encodes attributes as OTLP key/value pairs
+func otlpAttributes(attrs []traceAttr) []interface{} {
+	list := make([]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch x := a.Value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": x}
+		case int:
+			// 64 bit integers are strings in OTLP/JSON
+			v = map[string]interface{}{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+		}
+		list = append(list, map[string]interface{}{"key": a.Key, "value": v})
+	}
+	return list
+}
+
+// tracedFileStore wraps a FileStore with spans around the calls that dominate feed,
+// download and push latency. It's only used when tracing is configured.
+type tracedFileStore struct {
+	fileStore
+}
+
+// storeResult names the outcome of a FileStore call for a span
+func storeResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case err == ErrFileNotFound:
+		return "not_found"
+	case err == ErrBusy:
+		return "busy"
+	case isCancelled(err):
+		return "cancelled"
+	}
+	return "error"
+}
+
+// endStoreSpan records the result of a FileStore call and finishes its span. Only
+// unexpected errors mark the span as failed.
+func endStoreSpan(s *traceSpan, err error) {
+	result := storeResult(err)
+	s.SetAttr("nuget.result", result)
+	if result == "error" {
+		s.SetError(err)
+	}
+	s.End()
+}
+
+func (fs *tracedFileStore) GetPackageFeedEntries(ctx context.Context, id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+	ctx, s := startSpan(ctx, "filestore GetPackageFeedEntries")
+	if id != "" {
+		s.SetAttr("nuget.package.id", id)
+	}
+	entries, more, err := fs.fileStore.GetPackageFeedEntries(ctx, id, startAfter, max)
+	s.SetAttr("nuget.entries", len(entries))
+	endStoreSpan(s, err)
+	return entries, more, err
+}
+
+func (fs *tracedFileStore) GetPackageVersions(ctx context.Context, id string) ([]string, error) {
+	ctx, s := startSpan(ctx, "filestore GetPackageVersions")
+	s.SetAttr("nuget.package.id", id)
+	list, err := fs.fileStore.GetPackageVersions(ctx, id)
+	s.SetAttr("nuget.entries", len(list))
+	endStoreSpan(s, err)
+	return list, err
+}
+
+func (fs *tracedFileStore) GetNuspec(ctx context.Context, id string, ver string) ([]byte, error) {
+	ctx, s := startSpan(ctx, "filestore GetNuspec")
+	s.SetAttr("nuget.package.id", id)
+	s.SetAttr("nuget.package.version", ver)
+	b, err := fs.fileStore.GetNuspec(ctx, id, ver)
+	endStoreSpan(s, err)
+	return b, err
+}
+
+func (fs *tracedFileStore) StoreSymbolPackage(ctx context.Context, id string, ver string, pkg []byte) error {
+	ctx, s := startSpan(ctx, "filestore StoreSymbolPackage")
+	s.SetAttr("nuget.package.id", id)
+	s.SetAttr("nuget.package.version", ver)
+	s.SetAttr("nuget.bytes", len(pkg))
+	err := fs.fileStore.StoreSymbolPackage(ctx, id, ver, pkg)
+	endStoreSpan(s, err)
+	return err
+}
+
+func (fs *tracedFileStore) GetSymbolPackage(ctx context.Context, id string, ver string) ([]byte, error) {
+	ctx, s := startSpan(ctx, "filestore GetSymbolPackage")
+	s.SetAttr("nuget.package.id", id)
+	s.SetAttr("nuget.package.version", ver)
+	b, err := fs.fileStore.GetSymbolPackage(ctx, id, ver)
+	endStoreSpan(s, err)
+	return b, err
+}
+
+func (fs *tracedFileStore) GetSymbolFile(ctx context.Context, pdbName string, signature string) ([]byte, string, error) {
+	ctx, s := startSpan(ctx, "filestore GetSymbolFile")
+	s.SetAttr("nuget.pdb.name", pdbName)
+	s.SetAttr("nuget.pdb.signature", signature)
+	b, id, err := fs.fileStore.GetSymbolFile(ctx, pdbName, signature)
+	s.SetAttr("nuget.bytes", len(b))
+	endStoreSpan(s, err)
+	return b, id, err
+}
+
+func (fs *tracedFileStore) GetPackageFile(ctx context.Context, id string, ver string) (*packageFile, error) {
+	ctx, s := startSpan(ctx, "filestore GetPackageFile")
+	s.SetAttr("nuget.package.id", id)
+	s.SetAttr("nuget.package.version", ver)
+	f, err := fs.fileStore.GetPackageFile(ctx, id, ver)
+	if f != nil {
+		s.SetAttr("nuget.bytes", f.Size)
+	}
+	endStoreSpan(s, err)
+	return f, err
+}
+
+func (fs *tracedFileStore) StorePackage(ctx context.Context, pkg []byte) (bool, error) {
+	ctx, s := startSpan(ctx, "filestore StorePackage")
+	if s != nil {
+		if nsf, err := readNuspec(pkg); err == nil {
+			s.SetAttr("nuget.package.id", nsf.Meta.ID)
+			s.SetAttr("nuget.package.version", nsf.Meta.Version)
+		}
+		s.SetAttr("nuget.bytes", len(pkg))
+	}
+	exists, err := fs.fileStore.StorePackage(ctx, pkg)
+	endStoreSpan(s, err)
+	return exists, err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// recordedSpan is a span as an OTLP/JSON collector receives it
+type recordedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string            `json:"key"`
+		Value map[string]string `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// attr returns an attribute's value, as OTLP/JSON writes it, or empty
+func (s recordedSpan) attr(key string) string {
+	for _, v := range s.attrValue(key) {
+		return v
+	}
+	return ""
+}
+
+// attrValue returns an attribute's typed OTLP value, e.g. {"intValue": "200"}
+func (s recordedSpan) attrValue(key string) map[string]string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// spanRecorder is an OTLP/HTTP collector keeping every span exported to it
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []recordedSpan
+}
+
+// newTracedTestServer starts a feed that exports its spans to a recorder
+func newTracedTestServer(t *testing.T) (*testServer, *spanRecorder) {
+	t.Helper()
+	rec := &spanRecorder{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []recordedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/v1/traces" || json.Unmarshal(b, &req) != nil {
+			t.Errorf("collector got %s %s", r.URL.Path, b)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rec.lock.Lock()
+		defer rec.lock.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				rec.spans = append(rec.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_BSP_SCHEDULE_DELAY", "10")
+
+	ts := newTestServer(t, nil)
+	if server.tracer == nil {
+		t.Fatal("tracing not enabled")
+	}
+	return ts, rec
+}
+
+// trace flushes the tracer and returns the spans of one trace by name
+func (rec *spanRecorder) trace(t *testing.T, traceID string) map[string]recordedSpan {
+	t.Helper()
+	server.tracer.Close()
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	spans := make(map[string]recordedSpan)
+	for _, s := range rec.spans {
+		if s.TraceID != traceID {
+			continue
+		}
+		if _, ok := spans[s.Name]; ok && s.Name != "serialize" {
+			t.Errorf("trace has two %s spans", s.Name)
+		}
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+// wantTrace checks a request's trace is one server span continuing the caller's,
+// with the children named and nothing else
+func wantTrace(t *testing.T, spans map[string]recordedSpan, parentID string, children ...string) recordedSpan {
+	t.Helper()
+	root, ok := spans["GET"]
+	if !ok || root.Kind != spanKindServer || root.ParentSpanID != parentID {
+		t.Fatalf("server span: got %+v, want a child of %s", root, parentID)
+	}
+	for _, name := range children {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span in %v", name, spans)
+			continue
+		}
+		if s.Kind != spanKindInternal || s.ParentSpanID != root.SpanID {
+			t.Errorf("%s: kind %d, parent %s, want a child of the server span %s", name, s.Kind, s.ParentSpanID, root.SpanID)
+		}
+	}
+	if len(spans) != len(children)+1 {
+		t.Errorf("got spans %v, want GET and %q", spans, children)
+	}
+	return root
+}
+
+func TestTracingFeedRequest(t *testing.T) {
+	ts, rec := newTracedTestServer(t)
+	ts.mustPush(t, testPackage(t, "Trace.Pkg", "1.0.0", "", nil))
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "FindPackagesById()?id='Trace.Pkg'", testReadKey, nil,
+		http.Header{"Traceparent": {"00-" + traceID + "-" + parentID + "-01"}, "User-Agent": {"NuGet Test"}}))
+	wantStatus(t, "feed", status, body, http.StatusOK)
+
+	spans := rec.trace(t, traceID)
+	root := wantTrace(t, spans, parentID, "auth", "filestore GetPackageFeedEntries", "serialize", "write")
+	for k, want := range map[string]string{
+		"http.request.method":       "GET",
+		"url.path":                  "/feed/FindPackagesById()",
+		"user_agent.original":       "NuGet Test",
+		"http.response.status_code": "200",
+	} {
+		if got := root.attr(k); got != want {
+			t.Errorf("server span %s: got %q, want %q", k, got, want)
+		}
+	}
+	store := spans["filestore GetPackageFeedEntries"]
+	if store.attr("nuget.package.id") != "Trace.Pkg" || store.attr("nuget.entries") != "1" || store.attr("nuget.result") != "ok" || store.Status.Code != spanStatusUnset {
+		t.Errorf("store span: got %+v", store)
+	}
+}
+
+func TestTracingDownload(t *testing.T) {
+	ts, rec := newTracedTestServer(t)
+	pkg := testPackage(t, "Trace.Pkg", "1.0.0", "", nil)
+	ts.mustPush(t, pkg)
+
+	const traceID, parentID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	header := http.Header{"Traceparent": {"00-" + traceID + "-" + parentID + "-01"}}
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "nupkg/Trace.Pkg/1.0.0", testReadKey, nil, header))
+	wantStatus(t, "download", status, body, http.StatusOK)
+
+	// A caller that doesn't sample isn't traced
+	const unsampled = "11111111111111111111111111111111"
+	header = http.Header{"Traceparent": {"00-" + unsampled + "-" + parentID + "-00"}}
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "nupkg/Trace.Pkg/1.0.0", testReadKey, nil, header))
+	wantStatus(t, "unsampled download", status, body, http.StatusOK)
+
+	spans := rec.trace(t, traceID)
+	root := wantTrace(t, spans, parentID, "auth", "filestore GetPackageFile")
+	if got := root.attr("url.path"); got != "/feed/nupkg/Trace.Pkg/1.0.0" {
+		t.Errorf("server span url.path: got %q", got)
+	}
+	file := spans["filestore GetPackageFile"]
+	for k, want := range map[string]string{
+		"nuget.package.id":      "Trace.Pkg",
+		"nuget.package.version": "1.0.0",
+		"nuget.bytes":           strconv.Itoa(len(pkg)),
+		"nuget.result":          "ok",
+	} {
+		if got := file.attr(k); got != want {
+			t.Errorf("store span %s: got %q, want %q", k, got, want)
+		}
+	}
+	if file.attrValue("nuget.bytes")["intValue"] == "" || root.attrValue("http.response.status_code")["intValue"] == "" {
+		t.Errorf("sizes and statuses aren't OTLP integers: %+v %+v", file.Attributes, root.Attributes)
+	}
+
+	if spans := rec.trace(t, unsampled); len(spans) != 0 {
+		t.Errorf("unsampled request exported %v", spans)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Default largest file the UI will display inline
+const defaultUIPreviewMaxBytes = 256 * 1024
+
+// File extensions the UI will display as text
+var uiTextExtensions = map[string]bool{
+	".nuspec": true, ".xml": true, ".md": true, ".txt": true, ".json": true,
+	".ps1": true, ".psm1": true, ".psd1": true, ".lua": true, ".config": true,
+	".props": true, ".targets": true, ".cs": true, ".yml": true, ".yaml": true,
+}
+
+// zipFileInfo is an entry in a package's zip central directory
+type zipFileInfo struct {
+	Name string
+	Size uint64
+}
+
+// zipListings caches the file list of packages, which never change once stored
+var zipListings = struct {
+	sync.Mutex
+	m map[string][]zipFileInfo
+}{m: make(map[string][]zipFileInfo)}
+
+// Most package listings cached at once
+const maxZipListings = 512
+
+// packageListing returns the files in a package, from the cache if possible
+func packageListing(ctx context.Context, id string, ver string) ([]zipFileInfo, error) {
+	key := versionKey(id, ver)
+
+	zipListings.Lock()
+	l, ok := zipListings.m[key]
+	zipListings.Unlock()
+	if ok {
+		return l, nil
+	}
+
+	b, err := server.fs.ReadPackageFile(ctx, id, ver)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		l = append(l, zipFileInfo{Name: f.Name, Size: f.UncompressedSize64})
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+
+	zipListings.Lock()
+	if len(zipListings.m) >= maxZipListings {
+		// Drop an arbitrary entry to stay bounded
+		for k := range zipListings.m {
+			delete(zipListings.m, k)
+			break
+		}
+	}
+	zipListings.m[key] = l
+	zipListings.Unlock()
+
+	return l, nil
+}
+
+// uiTreeNode is a file or folder in the package content tree
+type uiTreeNode struct {
+	Name     string
+	Path     string
+	Size     uint64
+	IsDir    bool
+	View     string
+	Children []*uiTreeNode
+}
+
+// newUITree builds a folder tree from a flat file listing
+func newUITree(files []zipFileInfo, view string) *uiTreeNode {
+	root := &uiTreeNode{IsDir: true, View: view}
+	for _, f := range files {
+		n := root
+		parts := strings.Split(f.Name, "/")
+		for i, p := range parts {
+			var c *uiTreeNode
+			for _, x := range n.Children {
+				if x.Name == p {
+					c = x
+				}
+			}
+			if c == nil {
+				c = &uiTreeNode{Name: p, Path: strings.Join(parts[:i+1], "/"), IsDir: i < len(parts)-1, View: view}
+				n.Children = append(n.Children, c)
+			}
+			if !c.IsDir {
+				c.Size = f.Size
+			}
+			n = c
+		}
+	}
+	return root
+}
+
+func serveUI(w http.ResponseWriter, r *http.Request) {
+
+	// Expecting ui/{id}/{version}[/view|/asset]
+	x := strings.Split(strings.Trim(r.URL.Path[len(server.URL.Path+`ui`):], `/`), `/`)
+	switch {
+	case len(x) == 2:
+		serveUIPackage(w, r, x[0], x[1])
+	case len(x) == 3 && x[2] == "view":
+		serveUIView(w, r, x[0], x[1])
+	case len(x) == 3 && x[2] == "asset":
+		serveUIAsset(w, r, x[0], x[1])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// renderUI executes a UI template into the response
+func renderUI(w http.ResponseWriter, name string, data interface{}) {
+	var b bytes.Buffer
+	if err := server.uiTemplates.ExecuteTemplate(&b, name, data); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// The homepage in the FileStore, served at / and /index.html
+var homePage = path.Join("_www", "index.html")
+
+// Placeholder in the homepage replaced by the time the feed last changed
+const feedUpdatedPlaceholder = "{{feed-updated}}"
+
+// serveHome serves the homepage with the time a package was last published or
+// removed in place of {{feed-updated}}. Stores without one get a built in page
+// linking the feed.
+func serveHome(w http.ResponseWriter, r *http.Request) {
+	updated := ""
+	if lc := server.fs.LastChanged(r.Context()); !lc.IsZero() {
+		updated = formatAtomTime(lc)
+	}
+
+	b, _, err := server.fs.GetFile(r.Context(), homePage)
+	if err == ErrFileNotFound {
+		renderUI(w, "home", struct {
+			Feed    string
+			Updated string
+		}{
+			Feed:    server.URL.String(),
+			Updated: updated,
+		})
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b = bytes.Replace(b, []byte(feedUpdatedPlaceholder), []byte(updated), -1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+func serveUIPackage(w http.ResponseWriter, r *http.Request, id string, ver string) {
+	npe, err := server.fs.GetPackageEntry(r.Context(), id, ver)
+	if err == ErrBusy {
+		writeBusy(w)
+		return
+	} else if isCancelled(err) {
+		writeCancelled(w, r)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	files, err := packageListing(r.Context(), npe.Properties.ID, npe.Properties.Version)
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	readme, err := renderedReadme(r.Context(), npe.Properties.ID, npe.Properties.Version, files)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	extraction, _ := server.fs.GetExtractionStatus(r.Context(), npe.Properties.ID, npe.Properties.Version)
+
+	base := server.URL.String()
+	view := base + "ui/" + npe.Properties.ID + "/" + npe.Properties.Version + "/view"
+
+	// A retired ID's banner links to its replacement's latest version
+	replacement := ""
+	if alt := npe.Properties.AlternatePackageID; alt != "" {
+		if ver, err := latestVersion(r.Context(), alt); err == nil {
+			replacement = base + "ui/" + alt + "/" + ver
+		}
+	}
+	renderUI(w, "package", struct {
+		Base       string
+		Entry      *NugetPackageEntry
+		Published  string
+		Extraction *extractionStatus
+		Readme     *packageReadme
+		Frameworks []string
+		Pinned     string
+		License    string
+		View       string
+		Tree       *uiTreeNode
+		// Link to the replacement of a retired ID
+		Replacement string
+	}{
+		Base:        base,
+		Entry:       npe,
+		Published:   formatAtomTime(npe.Properties.Published.Value),
+		Extraction:  extraction,
+		Readme:      readme,
+		Frameworks:  splitFrameworks(npe.Properties.SupportedFrameworks),
+		Pinned:      pinnedVersion(r.Context(), npe.Properties.ID),
+		License:     licenseLink(npe),
+		View:        view,
+		Tree:        newUITree(files, view),
+		Replacement: replacement,
+	})
+}
+
+func serveUIView(w http.ResponseWriter, r *http.Request, id string, ver string) {
+
+	// Only exact, clean entry names are looked up, so nothing outside the zip can be reached
+	p := r.URL.Query().Get("path")
+	if p == "" || path.Clean(p) != p || strings.HasPrefix(p, "/") || strings.Contains(p, "..") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	files, err := packageListing(r.Context(), id, ver)
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var info *zipFileInfo
+	for i := range files {
+		if files[i].Name == p {
+			info = &files[i]
+		}
+	}
+	if info == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Base    string
+		ID      string
+		Version string
+		Path    string
+		Text    string
+		Refused string
+	}{Base: server.URL.String(), ID: id, Version: ver, Path: p}
+
+	max := server.Config().UIPreviewMaxBytes
+	if max <= 0 {
+		max = defaultUIPreviewMaxBytes
+	}
+
+	switch {
+	case !uiTextExtensions[strings.ToLower(path.Ext(p))]:
+		data.Refused = "This file type can't be previewed."
+	case info.Size > uint64(max):
+		data.Refused = "This file is too large to preview."
+	default:
+		b, err := readPackageEntry(r.Context(), id, ver, p, int64(max))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !utf8.Valid(b) || bytes.IndexByte(b, 0) >= 0 {
+			data.Refused = "This file is not text and can't be previewed."
+		} else {
+			data.Text = string(b)
+		}
+	}
+
+	renderUI(w, "view", data)
+}
+
+// readPackageEntry reads a single named file out of a package, up to max bytes
+func readPackageEntry(ctx context.Context, id string, ver string, name string, max int64) ([]byte, error) {
+	b, err := server.fs.ReadPackageFile(ctx, id, ver)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.Name == name {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			// Never trust the size the zip header declares
+			return ioutil.ReadAll(io.LimitReader(rc, max))
+		}
+	}
+	return nil, ErrFileNotFound
+}
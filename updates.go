@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// splitUpdatesList splits a GetUpdates() parameter such as 'A|B', nil if empty
+func splitUpdatesList(s string) []string {
+	s = strings.Trim(s, `'`)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "|")
+}
+
+// serveGetUpdates answers Visual Studio's Updates tab with the versions newer than
+// those installed
+func serveGetUpdates(w http.ResponseWriter, r *http.Request) {
+
+	setDataServiceVersion(w, r)
+
+	expand, err := parseExpand(r)
+	if err != nil {
+		writeODataError(w, r, err.(*odataError))
+		return
+	}
+
+	lastChanged := server.fs.LastChanged(r.Context())
+	if notModified(w, r, lastChanged) {
+		return
+	}
+
+	// Expecting GetUpdates()?packageIds='A|B'&versions='1.0|2.0'&includePrerelease=false
+	// &includeAllVersions=false&targetFrameworks='net45'&versionConstraints='|[2.0,3.0)'
+	v := r.URL.Query()
+	ids := splitUpdatesList(v.Get("packageIds"))
+	installed := splitUpdatesList(v.Get("versions"))
+	constraints := splitUpdatesList(v.Get("versionConstraints"))
+	if len(ids) != len(installed) || (constraints != nil && len(constraints) != len(ids)) {
+		writeODataError(w, r, &odataError{Status: http.StatusBadRequest, Message: "packageIds, versions and versionConstraints must list the same number of packages"})
+		return
+	}
+	prerelease := strings.EqualFold(strings.Trim(v.Get("includePrerelease"), `'`), "true")
+	allVersions := strings.EqualFold(strings.Trim(v.Get("includeAllVersions"), `'`), "true")
+	frameworks := parseFrameworkFilter(strings.Trim(v.Get("targetFrameworks"), `'`))
+
+	server.fs.UpdateCountsInMemory()
+	var updates []*NugetPackageEntry
+	for i, id := range ids {
+		if _, err := versions.Parse(installed[i]); id == "" || err != nil {
+			writeODataError(w, r, &odataError{Status: http.StatusBadRequest, Message: "'" + id + "' '" + installed[i] + "' is not a package ID and version"})
+			return
+		}
+		var vr *versionRange
+		if constraints != nil && constraints[i] != "" {
+			if vr, err = parseVersionRange(constraints[i]); err != nil {
+				writeODataError(w, r, &odataError{Status: http.StatusBadRequest, Message: "version constraint '" + constraints[i] + "' of '" + id + "': " + err.Error()})
+				return
+			}
+		}
+
+		entries, err := allPackageEntries(r.Context(), server.fs, id)
+		if err == ErrBusy {
+			writeBusy(w)
+			return
+		} else if isCancelled(err) {
+			writeCancelled(w, r)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if snap := requestSnapshot(r); snap != nil {
+			entries = snap.Filter(entries)
+		}
+		entries = filterSemVer2(r, entries)
+
+		// Listed versions newer than the one installed, oldest first
+		var newer []*NugetPackageEntry
+		for _, e := range entries {
+			ver := e.Properties.Version
+			if !strings.EqualFold(e.Properties.ID, id) || !e.Properties.Listed.Value ||
+				(!prerelease && versions.IsPrerelease(ver)) || versions.Compare(ver, installed[i]) <= 0 {
+				continue
+			}
+			if (vr == nil || vr.Satisfies(ver)) && frameworks.Matches(e) {
+				newer = append(newer, e)
+			}
+		}
+		sort.Slice(newer, func(i, j int) bool {
+			return versions.Compare(newer[i].Properties.Version, newer[j].Properties.Version) < 0
+		})
+		if !allVersions && len(newer) > 0 {
+			newer = newer[len(newer)-1:]
+		}
+		updates = append(updates, newer...)
+	}
+
+	if isCountPath(r.URL.Path) {
+		serveFeedCount(w, r, len(updates), nil)
+		return
+	}
+
+	updates = withGalleryURLs(updates)
+	updates = deterministicEntries(r, updates)
+	updates = expandEntries(updates, expand)
+
+	if f := requestedFeedFormat(r); f != feedFormatAtom {
+		renderJSONFeed(w, f, updates, "", false)
+		return
+	}
+
+	nf := NewNugetFeed("GetUpdates", server.URL.String())
+	nf.SetUpdated(lastChanged)
+	nf.Packages = updates
+	b := nf.ToBytes()
+
+	w.Header().Set("Content-Type", "application/atom+xml;type=feed;charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// GetUpdates() offers the listed versions newer than each one installed, only the
+// newest unless all are asked for
+func TestGetUpdates(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, v := range []string{
+		"Upd.A 1.0.0", "Upd.A 1.5.0", "Upd.A 2.0.0", "Upd.A 2.1.0-beta", "Upd.A 3.0.0",
+		"Upd.B 1.0.0", "Upd.B 1.0.1",
+		"Upd.C 1.0.0",
+	} {
+		x := strings.Fields(v)
+		ts.mustPush(t, testPackage(t, x[0], x[1], "", nil))
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Upd.A/3.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	for _, tc := range []struct {
+		p    string
+		want []string
+	}{
+		{"GetUpdates()?packageIds='Upd.A|Upd.B'&versions='1.0.0|1.0.0'&includePrerelease=false&includeAllVersions=false",
+			[]string{"Upd.A 2.0.0", "Upd.B 1.0.1"}},
+		{"api/v2/GetUpdates()?packageIds='Upd.A|Upd.B'&versions='1.0.0|1.0.0'", []string{"Upd.A 2.0.0", "Upd.B 1.0.1"}},
+		{"GetUpdates()?packageIds='Upd.A|Upd.B'&versions='1.0.0|1.0.0'&includeAllVersions=true",
+			[]string{"Upd.A 1.5.0", "Upd.A 2.0.0", "Upd.B 1.0.1"}},
+		{"GetUpdates()?packageIds='Upd.A|Upd.B'&versions='1.0.0|1.0.0'&includePrerelease=true",
+			[]string{"Upd.A 2.1.0-beta", "Upd.B 1.0.1"}},
+		{"GetUpdates()?packageIds='Upd.A'&versions='1.0.0'&includePrerelease=true&includeAllVersions=true",
+			[]string{"Upd.A 1.5.0", "Upd.A 2.0.0", "Upd.A 2.1.0-beta"}},
+		// IDs match whatever the case, versions are compared as SemVer
+		{"GetUpdates()?packageIds='upd.a'&versions='1.5'&includeAllVersions=true", []string{"Upd.A 2.0.0"}},
+		{"GetUpdates()?packageIds='Upd.A'&versions='2.0.0-alpha'&includeAllVersions=true", []string{"Upd.A 2.0.0"}},
+		{"GetUpdates()?packageIds='Upd.A'&versions='1.10.0'", []string{"Upd.A 2.0.0"}},
+		// Nothing newer, nothing offered, and never an unlisted version
+		{"GetUpdates()?packageIds='Upd.A|Upd.C'&versions='2.0.0|1.0.0'", nil},
+		{"GetUpdates()?packageIds='Upd.B'&versions='9.0.0'", nil},
+		{"GetUpdates()?packageIds='No.Such.Pkg'&versions='1.0.0'", nil},
+		{"GetUpdates()?packageIds=''&versions=''", nil},
+		// Constraints keep updates within a range, an empty one is no constraint
+		{"GetUpdates()?packageIds='Upd.A|Upd.B'&versions='1.0.0|1.0.0'&includeAllVersions=true&versionConstraints='[1.0,2.0)|'",
+			[]string{"Upd.A 1.5.0", "Upd.B 1.0.1"}},
+	} {
+		status, body := ts.get(t, tc.p)
+		wantStatus(t, tc.p, status, body, http.StatusOK)
+		if ids := feedIDs(t, body); !reflect.DeepEqual(ids, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.p, ids, tc.want)
+		}
+	}
+
+	res := ts.do(t, http.MethodGet, "GetUpdates()/$count?packageIds='Upd.A|Upd.B'&versions='1.0.0|1.0.0'&includeAllVersions=true", testReadKey, nil, nil)
+	contentType := res.Header.Get("Content-Type")
+	status, body = readResponse(t, res)
+	wantStatus(t, "count", status, body, http.StatusOK)
+	if body != "3" || contentType != "text/plain; charset=utf-8" {
+		t.Errorf("count: got %q as %s, want 3", body, contentType)
+	}
+
+	for _, p := range []string{
+		"GetUpdates()?packageIds='Upd.A|Upd.B'&versions='1.0.0'",
+		"GetUpdates()?packageIds='Upd.A'&versions='1.0.0|1.0.0'",
+		"GetUpdates()?packageIds='Upd.A'",
+		"GetUpdates()?packageIds='Upd.A'&versions='latest'",
+		"GetUpdates()?packageIds='|Upd.B'&versions='1.0.0|1.0.0'",
+		"GetUpdates()?packageIds='Upd.A|Upd.B'&versions='1.0.0|1.0.0'&versionConstraints='[1.0,2.0)'",
+		"GetUpdates()?packageIds='Upd.A'&versions='1.0.0'&versionConstraints='[2.0,1.0'",
+	} {
+		status, body := ts.get(t, p)
+		wantStatus(t, p, status, body, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Package IDs whose V3 documents are kept rendered unless configured
+const defaultV3CacheIDs = 1000
+
+// v3CacheStats are the V3 document cache's counters, as served by admin/v3-cache
+type v3CacheStats struct {
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Evictions uint64  `json:"evictions"`
+	HitRate   float64 `json:"hitRate"`
+	IDs       int     `json:"ids"`
+	MaxIDs    int     `json:"maxIds"`
+}
+
+// v3Cache keeps the rendered registration and flat container documents of package
+// IDs. Each document is kept for one generation of its ID, a digest of everything
+// it's rendered from, which a push, delete, relist or deprecation of the ID moves.
+// Only that ID's documents are then rendered again, and ETags of the others stay
+// the same. The least recently used IDs are dropped to stay under the bound.
+type v3Cache struct {
+	lock sync.Mutex
+	ids  map[string]*list.Element
+	lru  *list.List // front is most recently used
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// v3CachedID is the documents kept for one ID as seen by one set of keys
+type v3CachedID struct {
+	key  string
+	docs map[string]v3CachedDoc
+}
+
+// v3CachedDoc is a rendered document and the generation it was rendered for
+type v3CachedDoc struct {
+	gen string
+	b   []byte
+}
+
+func newV3Cache() *v3Cache {
+	return &v3Cache{ids: make(map[string]*list.Element), lru: list.New()}
+}
+
+// v3CacheKey is what an ID's documents are kept under. Keys that see different
+// versions, and snapshots, get documents of their own.
+func v3CacheKey(r *http.Request, id string) string {
+	k := strings.ToLower(id) + "|" + contextViewer(r.Context()).scope()
+	if snap := requestSnapshot(r); snap != nil {
+		k += "|" + snap.ID
+	}
+	return k
+}
+
+// registrationGeneration digests what an ID's registration documents are rendered
+// from: the server URL and each version's hash, listing, publishing and deprecation
+func registrationGeneration(entries []*NugetPackageEntry) string {
+	h := sha256.New()
+	io.WriteString(h, server.URL.String())
+	for _, e := range entries {
+		p := e.Properties
+		fmt.Fprintf(h, "\n%s|%s|%s|%t|%d|%s|%s", p.ID, p.Version, p.PackageHash, p.Listed.Value,
+			p.Published.Value.UnixNano(), p.DeprecationMessage, p.AlternatePackageID)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// versionsGeneration digests the versions a flat container index lists
+func versionsGeneration(list []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(list, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// v3ETag is the entity tag of a document of an ID's generation
+func v3ETag(gen string, doc string) string {
+	sum := sha256.Sum256([]byte(gen + "/" + doc))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// get returns a document of the ID kept under key, rendering and keeping it if
+// there's none of generation gen
+func (c *v3Cache) get(key string, gen string, doc string, render func() ([]byte, error)) ([]byte, error) {
+	c.lock.Lock()
+	if el, ok := c.ids[key]; ok {
+		if d, ok := el.Value.(*v3CachedID).docs[doc]; ok && d.gen == gen {
+			c.lru.MoveToFront(el)
+			c.lock.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			return d.b, nil
+		}
+	}
+	c.lock.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	b, err := render()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.ids[key]
+	if !ok {
+		el = c.lru.PushFront(&v3CachedID{key: key, docs: make(map[string]v3CachedDoc)})
+		c.ids[key] = el
+	}
+	el.Value.(*v3CachedID).docs[doc] = v3CachedDoc{gen: gen, b: b}
+	c.lru.MoveToFront(el)
+	for c.lru.Len() > c.maxIDs() {
+		back := c.lru.Back()
+		c.lru.Remove(back)
+		delete(c.ids, back.Value.(*v3CachedID).key)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	return b, nil
+}
+
+// maxIDs is how many IDs are kept, as configured
+func (c *v3Cache) maxIDs() int {
+	if n := server.Config().V3CacheIDs; n > 0 {
+		return n
+	}
+	return defaultV3CacheIDs
+}
+
+// Stats returns the cache's counters and current size
+func (c *v3Cache) Stats() v3CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	st := v3CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		IDs:       c.lru.Len(),
+		MaxIDs:    c.maxIDs(),
+	}
+	if n := st.Hits + st.Misses; n > 0 {
+		st.HitRate = float64(st.Hits) / float64(n)
+	}
+	return st
+}
+
+// serveV3Document answers with a cached document of an ID, or a 304 if the
+// client has the generation's ETag
+func serveV3Document(w http.ResponseWriter, r *http.Request, key string, gen string, doc string, render func() ([]byte, error)) {
+	etag := v3ETag(gen, doc)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	b, err := server.v3cache.get(key, gen, doc, render)
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+func serveV3CacheStats(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(server.v3cache.Stats())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestV3Cache(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Cache.A", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Cache.B", "1.0.0", "", nil))
+
+	docs := []string{"v3/registration/%s/index.json", "v3-flatcontainer/%s/index.json"}
+	etags := func(id string) map[string]string {
+		t.Helper()
+		tags := make(map[string]string)
+		for _, d := range docs {
+			p := strings.Replace(d, "%s", id, 1)
+			res := ts.do(t, http.MethodGet, p, testReadKey, nil, nil)
+			etag := res.Header.Get("ETag")
+			status, body := readResponse(t, res)
+			wantStatus(t, p, status, body, http.StatusOK)
+			if etag == "" {
+				t.Fatalf("%s: no ETag", p)
+			}
+			tags[p] = etag
+		}
+		return tags
+	}
+
+	a1, b1 := etags("cache.a"), etags("cache.b")
+	for p, etag := range etags("cache.a") {
+		if etag != a1[p] {
+			t.Errorf("%s: ETag %s changed to %s without a change", p, a1[p], etag)
+		}
+	}
+
+	ts.mustPush(t, testPackage(t, "Cache.A", "2.0.0", "", nil))
+	a2, b2 := etags("cache.a"), etags("cache.b")
+	for p := range a1 {
+		if a2[p] == a1[p] {
+			t.Errorf("%s: ETag didn't change after a push", p)
+		}
+		status, body := ts.get(t, p)
+		wantStatus(t, p, status, body, http.StatusOK)
+		if !strings.Contains(body, "2.0.0") {
+			t.Errorf("%s: new version missing: %s", p, body)
+		}
+	}
+	for p := range b1 {
+		if b2[p] != b1[p] {
+			t.Errorf("%s: ETag changed by a push of another ID", p)
+		}
+		res := ts.do(t, http.MethodGet, p, testReadKey, nil, http.Header{"If-None-Match": {b1[p]}})
+		status, body := readResponse(t, res)
+		wantStatus(t, p+" If-None-Match", status, body, http.StatusNotModified)
+	}
+
+	status, body := ts.get(t, "v3-flatcontainer/no.such.pkg/index.json")
+	wantStatus(t, "unknown ID", status, body, http.StatusNotFound)
+
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "admin/v3-cache", testWriteKey, nil, nil))
+	wantStatus(t, "stats", status, body, http.StatusOK)
+	var st v3CacheStats
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Hits == 0 || st.Misses == 0 || st.HitRate <= 0 || st.IDs != 2 || st.MaxIDs != defaultV3CacheIDs {
+		t.Errorf("got %+v", st)
+	}
+	status, _ = ts.get(t, "admin/v3-cache")
+	wantStatus(t, "stats with a read key", status, "", http.StatusForbidden)
+}
+
+func TestV3CacheEviction(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.V3CacheIDs = 1 })
+	ts.mustPush(t, testPackage(t, "Evict.A", "1.0.0", "", nil))
+	ts.mustPush(t, testPackage(t, "Evict.B", "1.0.0", "", nil))
+
+	for _, id := range []string{"evict.a", "evict.b", "evict.a"} {
+		status, body := ts.get(t, "v3/registration/"+id+"/index.json")
+		wantStatus(t, id, status, body, http.StatusOK)
+	}
+	st := server.v3cache.Stats()
+	if st.IDs != 1 || st.MaxIDs != 1 || st.Evictions != 2 || st.Hits != 0 {
+		t.Errorf("got %+v", st)
+	}
+}
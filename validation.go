@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	nuspec "github.com/soloworks/go-nuspec"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Content folder size above which large-content warns, unless configured
+const defaultMaxContentBytes = 50 * 1024 * 1024
+
+// validationWarning is a problem noticed with an uploaded package
+type validationWarning struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// packageValidation is what a rule gets to look at
+type packageValidation struct {
+	nsf    *nuspec.NuSpec
+	files  []*zip.File
+	config *Config
+}
+
+// validationRule checks one thing about a package, returning a message if it fails
+type validationRule struct {
+	Name  string
+	Check func(v *packageValidation) string
+}
+
+// Rules run over every upload. Add new policies here, their names can then be
+// disabled or made fatal in the validation config.
+var validationRules = []validationRule{
+	{"missing-description", checkDescription},
+	{"missing-license", checkLicense},
+	{"large-content", checkContentSize},
+	{"non-normalized-version", checkVersionNormalized},
+}
+
+func checkDescription(v *packageValidation) string {
+	if strings.TrimSpace(v.nsf.Meta.Description) == "" {
+		return "the nuspec has no description"
+	}
+	return ""
+}
+
+func checkLicense(v *packageValidation) string {
+	if v.nsf.Meta.LicenseURL == "" && strings.TrimSpace(v.nsf.Meta.License.Text) == "" {
+		return "the nuspec has no license or licenseUrl"
+	}
+	return ""
+}
+
+func checkContentSize(v *packageValidation) string {
+	max := v.config.Validation.MaxContentBytes
+	if max <= 0 {
+		max = defaultMaxContentBytes
+	}
+	var total uint64
+	for _, f := range v.files {
+		if strings.HasPrefix(f.Name, "content/") {
+			total += f.UncompressedSize64
+		}
+	}
+	if total > uint64(max) {
+		return fmt.Sprintf("the content folder is %d bytes, over the %d byte limit", total, max)
+	}
+	return ""
+}
+
+func checkVersionNormalized(v *packageValidation) string {
+	if ver := versions.Lenient(v.nsf.Meta.Version); !ver.IsNormalized() {
+		return "version " + ver.String() + " is not normalized, clients will see " + ver.Normalize()
+	}
+	return ""
+}
+
+// isValidationRule reports whether a rule name exists
+func isValidationRule(name string) bool {
+	for _, r := range validationRules {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRuleNames checks rule names given in the config
+func validateRuleNames(c *Config) error {
+	for _, n := range append(append([]string{}, c.Validation.DisabledRules...), c.Validation.FailRules...) {
+		if !isValidationRule(n) {
+			return errors.New("validation lists an unknown rule: " + n)
+		}
+	}
+	return nil
+}
+
+// validatePackage runs the enabled rules over a package. The returned bool is
+// true if any warning is for a rule configured to reject the upload.
+func validatePackage(pkg []byte, nsf *nuspec.NuSpec, c *Config) ([]validationWarning, bool) {
+	v := &packageValidation{nsf: nsf, config: c}
+	if zr, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg))); err == nil {
+		v.files = zr.File
+	}
+
+	warnings := []validationWarning{}
+	fatal := false
+	for _, r := range validationRules {
+		if containsString(c.Validation.DisabledRules, r.Name) {
+			continue
+		}
+		if msg := r.Check(v); msg != "" {
+			warnings = append(warnings, validationWarning{Rule: r.Name, Message: msg})
+			if containsString(c.Validation.FailRules, r.Name) {
+				fatal = true
+			}
+		}
+	}
+	return warnings, fatal
+}
+
+// uploadResult is the JSON body returned for a push. nuget.exe ignores it, build
+// pipelines can read the warnings.
+type uploadResult struct {
+	ID                string              `json:"id"`
+	Version           string              `json:"version"`
+	NormalizedVersion string              `json:"normalizedVersion"`
+	Size              int                 `json:"size"`
+	Hash              string              `json:"hash"`
+	Warnings          []validationWarning `json:"warnings"`
+	Error             string              `json:"error,omitempty"`
+}
+
+func newUploadResult(pkg []byte, nsf *nuspec.NuSpec, warnings []validationWarning) *uploadResult {
+	h := sha512.Sum512(pkg)
+	return &uploadResult{
+		ID:                nsf.Meta.ID,
+		Version:           nsf.Meta.Version,
+		NormalizedVersion: versions.Normalize(nsf.Meta.Version),
+		Size:              len(pkg),
+		Hash:              hex.EncodeToString(h[:]),
+		Warnings:          warnings,
+	}
+}
+
+// pushTargetError is returned when a package is pushed or promoted to a URL naming a
+// different id or version than its nuspec
+type pushTargetError struct {
+	URLID, URLVersion string
+	ID, Version       string
+}
+
+func (e *pushTargetError) Error() string {
+	return fmt.Sprintf("package is %s %s but the URL is for %s %s", e.ID, e.Version, e.URLID, e.URLVersion)
+}
+
+// pushTarget returns the id and version named by a push to api/v2/package/{id}/{version}.
+// Pushes to the feed root or api/v2/package/ name neither and can be any package.
+func pushTarget(r *http.Request) (string, string, bool) {
+	prefix := server.URL.Path + `api/v2/package/`
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return "", "", false
+	}
+	x := strings.Split(strings.Trim(r.URL.Path[len(prefix):], `/`), `/`)
+	if len(x) != 2 || x[0] == "" || x[1] == "" {
+		return "", "", false
+	}
+	id, err1 := url.PathUnescape(x[0])
+	ver, err2 := url.PathUnescape(x[1])
+	if err1 != nil || err2 != nil {
+		return "", "", false
+	}
+	return id, ver, true
+}
+
+// checkPushTarget checks a package is the id and version a URL names. Ids differing
+// only in case and versions that normalize the same match.
+func checkPushTarget(id string, ver string, nsf *nuspec.NuSpec) error {
+	if !strings.EqualFold(id, nsf.Meta.ID) ||
+		!versions.Equal(ver, nsf.Meta.Version) {
+		return &pushTargetError{URLID: id, URLVersion: ver, ID: nsf.Meta.ID, Version: nsf.Meta.Version}
+	}
+	return nil
+}
+
+// pushHash returns the SHA512 of a pushed package as hex. A client may send the hash
+// it expects in X-NuGet-Package-Hash, as hex or base64, which must match.
+func pushHash(r *http.Request, pkg []byte) (string, error) {
+	h := sha512.Sum512(pkg)
+	hash := hex.EncodeToString(h[:])
+	sent := strings.TrimSpace(r.Header.Get("X-NuGet-Package-Hash"))
+	if sent == "" {
+		return hash, nil
+	}
+	b, err := hex.DecodeString(sent)
+	if err != nil {
+		if b, err = base64.StdEncoding.DecodeString(sent); err != nil {
+			return "", errors.New("X-NuGet-Package-Hash is neither hex nor base64")
+		}
+	}
+	if !bytes.Equal(b, h[:]) {
+		return "", errors.New("X-NuGet-Package-Hash does not match the package")
+	}
+	return hash, nil
+}
+
+// identicalVersion reports whether the stored copy of a version has the hash given,
+// so a retried push of a package that was already stored can succeed. The hash the
+// store recorded is compared, the file isn't read.
+func identicalVersion(ctx context.Context, id string, ver string, hash string) bool {
+	npe, err := server.fs.GetPackageEntry(ctx, id, ver)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(npe.Properties.PackageHash, hash)
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	nuspec "github.com/soloworks/go-nuspec"
+)
+
+// warnedRules returns the names of the rules a package is warned about
+func warnedRules(t *testing.T, pkg []byte, c *Config) ([]string, bool) {
+	t.Helper()
+	nsf, err := readNuspec(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings, fatal := validatePackage(pkg, nsf, c)
+	var rules []string
+	for _, w := range warnings {
+		rules = append(rules, w.Rule)
+	}
+	return rules, fatal
+}
+
+func TestValidationRules(t *testing.T) {
+	newTestServer(t, nil) // Reading the nuspec uses the server's extraction limits
+	const license = "<license type=\"expression\">MIT</license>"
+	bare := nuspecPackage(t, "Bare.Pkg.nuspec", []byte(`<?xml version="1.0"?>
+<package><metadata><id>Bare.Pkg</id><version>1.0.0</version><authors>a</authors></metadata></package>`))
+	big := strings.Repeat("x", 2048)
+
+	for _, tc := range []struct {
+		name      string
+		pkg       []byte
+		configure func(c *Config)
+		want      []string
+		fatal     bool
+	}{
+		{name: "clean", pkg: testPackage(t, "Good.Pkg", "1.0.0", license, nil)},
+		{name: "licenseUrl", pkg: testPackage(t, "Good.Pkg", "1.0.0", "<licenseUrl>https://example.com/l</licenseUrl>", nil)},
+		{name: "no description or license", pkg: bare, want: []string{"missing-description", "missing-license"}},
+		{name: "no license", pkg: testPackage(t, "Some.Pkg", "1.0.0", "", nil), want: []string{"missing-license"}},
+		{name: "not normalized", pkg: testPackage(t, "Some.Pkg", "01.0", license, nil), want: []string{"non-normalized-version"}},
+		{
+			name:      "large content",
+			pkg:       testPackage(t, "Some.Pkg", "1.0.0", license, map[string]string{"content/big.txt": big, "lib/big.dll": big}),
+			configure: func(c *Config) { c.Validation.MaxContentBytes = 1024 },
+			want:      []string{"large-content"},
+		},
+		{
+			name:      "content under the limit",
+			pkg:       testPackage(t, "Some.Pkg", "1.0.0", license, map[string]string{"content/big.txt": big, "lib/big.dll": big}),
+			configure: func(c *Config) { c.Validation.MaxContentBytes = 4096 },
+		},
+		{
+			name:      "disabled",
+			pkg:       bare,
+			configure: func(c *Config) { c.Validation.DisabledRules = []string{"missing-license"} },
+			want:      []string{"missing-description"},
+		},
+		{
+			name:      "fatal",
+			pkg:       bare,
+			configure: func(c *Config) { c.Validation.FailRules = []string{"missing-license"} },
+			want:      []string{"missing-description", "missing-license"},
+			fatal:     true,
+		},
+		{
+			name:      "fatal rule not broken",
+			pkg:       testPackage(t, "Some.Pkg", "1.0.0", "", nil),
+			configure: func(c *Config) { c.Validation.FailRules = []string{"missing-description"} },
+			want:      []string{"missing-license"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := defaultConfig()
+			if tc.configure != nil {
+				tc.configure(c)
+			}
+			got, fatal := warnedRules(t, tc.pkg, c)
+			if !reflect.DeepEqual(got, tc.want) || fatal != tc.fatal {
+				t.Errorf("warned %q, fatal %v, want %q, %v", got, fatal, tc.want, tc.fatal)
+			}
+		})
+	}
+}
+
+func TestValidateRuleNames(t *testing.T) {
+	c := defaultConfig()
+	c.Validation.FailRules = []string{"missing-license"}
+	if err := validateRuleNames(c); err != nil {
+		t.Errorf("known rule: %v", err)
+	}
+	c.Validation.DisabledRules = []string{"no-such-rule"}
+	if err := validateRuleNames(c); err == nil || !strings.Contains(err.Error(), "no-such-rule") {
+		t.Errorf("unknown rule: got %v", err)
+	}
+}
+
+// nuget.exe sends a push as a multipart PUT and only looks at the status, so the
+// JSON body must come whole with the 201 and nothing else about the response change
+func TestPushResult(t *testing.T) {
+	ts := newTestServer(t, nil)
+	pkg := testPackage(t, "Result.Pkg", "1.0", "", nil)
+
+	res := ts.pushTo(t, "api/v2/package/", testWriteKey, pkg)
+	status, body := readResponse(t, res)
+	wantStatus(t, "push", status, body, http.StatusCreated)
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	if res.ContentLength != int64(len(body)) {
+		t.Errorf("Content-Length %d, body is %d bytes", res.ContentLength, len(body))
+	}
+
+	var result uploadResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	h := sha512.Sum512(pkg)
+	want := uploadResult{
+		ID:                "Result.Pkg",
+		Version:           "1.0",
+		NormalizedVersion: "1.0.0",
+		Size:              len(pkg),
+		Hash:              hex.EncodeToString(h[:]),
+		Warnings: []validationWarning{
+			{Rule: "missing-license", Message: "the nuspec has no license or licenseUrl"},
+			{Rule: "non-normalized-version", Message: "version 1.0 is not normalized, clients will see 1.0.0"},
+		},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("result %+v\nwant %+v", result, want)
+	}
+	status, body = ts.get(t, "Packages(Id='Result.Pkg',Version='1.0.0')")
+	wantStatus(t, "pushed package", status, body, http.StatusOK)
+}
+
+// A rule in fail-rules rejects the push with the same body, and nothing is stored
+func TestPushFailsValidation(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.Validation.FailRules = []string{"missing-license"} })
+	status, body := ts.push(t, testPackage(t, "Rejected.Pkg", "1.0.0", "", nil))
+	wantStatus(t, "push", status, body, http.StatusBadRequest)
+
+	var result uploadResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	if result.Error == "" || len(result.Warnings) != 1 || result.Warnings[0].Rule != "missing-license" {
+		t.Errorf("result %+v, want an error and the missing-license warning", result)
+	}
+	status, body = ts.get(t, "Packages(Id='Rejected.Pkg',Version='1.0.0')")
+	wantStatus(t, "rejected package", status, body, http.StatusNotFound)
+}
+
+func TestCheckPushTarget(t *testing.T) {
+	nsf := &nuspec.NuSpec{}
+	nsf.Meta.ID = "Target.Pkg"
+	nsf.Meta.Version = "1.0.0"
+	for _, tc := range []struct {
+		id, ver string
+		ok      bool
+	}{
+		{"Target.Pkg", "1.0.0", true},
+		{"TARGET.PKG", "1.0.0", true},
+		{"Target.Pkg", "1.0", true},
+		{"Target.Pkg", "1.0.0.0", true},
+		{"Target.Pkg", "1.0.1", false},
+		{"Target.Pkg", "1.0.0-beta", false},
+		{"Target", "1.0.0", false},
+	} {
+		err := checkPushTarget(tc.id, tc.ver, nsf)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s %s: got %v, want ok %v", tc.id, tc.ver, err, tc.ok)
+		}
+		if err != nil && err.Error() != "package is Target.Pkg 1.0.0 but the URL is for "+tc.id+" "+tc.ver {
+			t.Errorf("%s %s: error %q", tc.id, tc.ver, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// Version limit policies, what a push over the hard limit gets
+const (
+	versionLimitReject = "reject"
+	versionLimitEvict  = "evict"
+)
+
+// versionLimits caps how many versions a package may have
+type versionLimits struct {
+	// Versions above which each push logs a warning and statusz reports the package (off if 0)
+	Soft int `json:"soft"`
+	// Versions a package may have (off if 0)
+	Hard int `json:"hard"`
+	// 'reject' (default) refuses pushes over the hard limit with a 409, 'evict'
+	// deletes the oldest prereleases to make room
+	Policy string `json:"policy"`
+}
+
+// versionLimitsConfig is the limits for every package, with overrides for some
+type versionLimitsConfig struct {
+	// Versions above which each push logs a warning and statusz reports the package (off if 0)
+	Soft int `json:"soft"`
+	// Versions a package may have (off if 0)
+	Hard int `json:"hard"`
+	// What a push over the hard limit gets, 'reject' (default) or 'evict'
+	Policy string `json:"policy"`
+	// Limits for package ID globs, the first matching is used instead
+	Overrides []versionLimitOverride `json:"overrides"`
+}
+
+type versionLimitOverride struct {
+	// Package ID glob, e.g. "Team.CI.*"
+	ID string `json:"id"`
+	versionLimits
+}
+
+// validateVersionLimits checks the version-limits config
+func validateVersionLimits(c *Config) error {
+	check := func(l versionLimits, where string) error {
+		if l.Soft < 0 || l.Hard < 0 {
+			return errors.New("version-limits " + where + "limits must not be negative")
+		}
+		switch l.Policy {
+		case "", versionLimitReject, versionLimitEvict:
+		default:
+			return errors.New("version-limits " + where + "policy must be reject or evict: " + l.Policy)
+		}
+		return nil
+	}
+	vl := c.VersionLimits
+	if err := check(versionLimits{Soft: vl.Soft, Hard: vl.Hard, Policy: vl.Policy}, ""); err != nil {
+		return err
+	}
+	for _, o := range c.VersionLimits.Overrides {
+		if _, err := path.Match(o.ID, ""); err != nil || o.ID == "" {
+			return errors.New("version-limits overrides contains an invalid glob: " + o.ID)
+		}
+		if err := check(o.versionLimits, "override "+o.ID+" "); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitsFor returns the version limits that apply to a package ID
+func limitsFor(c *Config, id string) versionLimits {
+	for _, o := range c.VersionLimits.Overrides {
+		if ok, _ := path.Match(strings.ToLower(o.ID), strings.ToLower(id)); ok {
+			return o.versionLimits
+		}
+	}
+	vl := c.VersionLimits
+	return versionLimits{Soft: vl.Soft, Hard: vl.Hard, Policy: vl.Policy}
+}
+
+// versionLimitError is a push refused for taking a package over its hard limit
+type versionLimitError struct {
+	ID       string
+	Versions int
+	Limit    int
+	Reason   string
+}
+
+func (e *versionLimitError) Error() string {
+	return fmt.Sprintf("%s has %d versions, the limit is %d%s", e.ID, e.Versions, e.Limit, e.Reason)
+}
+
+// versionLimitLocks serialises pushes of each package under a hard limit, so two
+// can't both count the same room or evict the same versions
+var versionLimitLocks struct {
+	lock sync.Mutex
+	ids  map[string]*sync.Mutex
+}
+
+// lockVersionLimit holds a package's version limit until the returned func is called
+func lockVersionLimit(id string) func() {
+	versionLimitLocks.lock.Lock()
+	if versionLimitLocks.ids == nil {
+		versionLimitLocks.ids = make(map[string]*sync.Mutex)
+	}
+	key := strings.ToLower(id)
+	l := versionLimitLocks.ids[key]
+	if l == nil {
+		l = &sync.Mutex{}
+		versionLimitLocks.ids[key] = l
+	}
+	versionLimitLocks.lock.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// planVersionEvictions applies the hard limit to a push of a new version, returning
+// the oldest prereleases to delete under the evict policy once the new version is
+// stored. Stable versions, the latest prerelease and a pinned version are never
+// evicted. It returns a *versionLimitError if the push must be refused.
+func planVersionEvictions(id string, ver string) ([]*NugetPackageEntry, error) {
+	l := limitsFor(server.Config(), id)
+	if l.Hard == 0 {
+		return nil, nil
+	}
+
+	// Every version counts, whoever pushed it
+	ctx := context.Background()
+	entries, err := allPackageEntries(ctx, server.fs, id)
+	if err != nil {
+		return nil, err
+	}
+	var existing []*NugetPackageEntry
+	for _, e := range entries {
+		if !strings.EqualFold(e.Properties.ID, id) {
+			continue
+		}
+		// A version already stored is refused or accepted as a duplicate, not limited
+		if versions.Equal(e.Properties.Version, ver) {
+			return nil, nil
+		}
+		existing = append(existing, e)
+	}
+	over := len(existing) + 1 - l.Hard
+	if over <= 0 {
+		return nil, nil
+	}
+	if l.Policy != versionLimitEvict {
+		return nil, &versionLimitError{ID: id, Versions: len(existing), Limit: l.Hard}
+	}
+
+	// The oldest prereleases go first, keeping the latest one and any pinned version
+	pinned := pinnedVersion(ctx, id)
+	var prereleases []*NugetPackageEntry
+	for _, e := range existing {
+		if versions.IsPrerelease(e.Properties.Version) && !versions.Equal(e.Properties.Version, pinned) {
+			prereleases = append(prereleases, e)
+		}
+	}
+	sort.Slice(prereleases, func(i, j int) bool {
+		return versions.Compare(prereleases[i].Properties.Version, prereleases[j].Properties.Version) < 0
+	})
+	if len(prereleases) > 0 {
+		prereleases = prereleases[:len(prereleases)-1]
+	}
+	sort.SliceStable(prereleases, func(i, j int) bool {
+		return prereleases[i].Properties.Published.Value.Before(prereleases[j].Properties.Published.Value)
+	})
+	if len(prereleases) < over {
+		return nil, &versionLimitError{ID: id, Versions: len(existing), Limit: l.Hard, Reason: " and too few prereleases can be evicted"}
+	}
+	return prereleases[:over], nil
+}
+
+// evictVersions deletes the versions planVersionEvictions chose, once the version
+// they make room for is stored. Evictions aren't abandoned part way.
+func evictVersions(evict []*NugetPackageEntry, ver string) error {
+	for _, e := range evict {
+		if err := server.fs.DeletePackage(context.Background(), e.Properties.ID, e.Properties.Version); err != nil {
+			return err
+		}
+		log.Printf("Version limit: evicted %s %s to make room for %s", e.Properties.ID, e.Properties.Version, ver)
+	}
+	return nil
+}
+
+// noteVersionCount warns once a package has more versions than its soft limit,
+// and reports it in statusz until it's back under
+func noteVersionCount(id string) {
+	l := limitsFor(server.Config(), id)
+	component := "version-limit/" + strings.ToLower(id)
+	if l.Soft == 0 {
+		server.health.Recover(component)
+		return
+	}
+	entries, err := allPackageEntries(context.Background(), server.fs, id)
+	if err != nil {
+		return
+	}
+	n := 0
+	for _, e := range entries {
+		if strings.EqualFold(e.Properties.ID, id) {
+			n++
+		}
+	}
+	if n <= l.Soft {
+		server.health.Recover(component)
+		return
+	}
+	msg := fmt.Sprintf("%s has %d versions, over the soft limit of %d", id, n, l.Soft)
+	log.Println("WARNING: Version limit:", msg)
+	server.health.Degrade(component, msg)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// storedVersions returns the versions of a package the flat container lists
+func storedVersions(t *testing.T, ts *testServer, id string) []string {
+	t.Helper()
+	status, body := ts.get(t, "v3-flatcontainer/"+strings.ToLower(id)+"/index.json")
+	if status == http.StatusNotFound {
+		return nil
+	}
+	wantStatus(t, id+" versions", status, body, http.StatusOK)
+	var index struct {
+		Versions []string `json:"versions"`
+	}
+	if err := json.Unmarshal([]byte(body), &index); err != nil {
+		t.Fatal(err)
+	}
+	return index.Versions
+}
+
+// A push over the hard limit is refused under reject, or makes room by evicting
+// the prereleases published first under evict
+func TestVersionLimitPolicies(t *testing.T) {
+	type push struct {
+		ver    string
+		status int
+		err    string // In the push's result
+	}
+	for _, tc := range []struct {
+		name   string
+		limits versionLimitsConfig
+		pin    string
+		pushes []push
+		want   []string
+	}{
+		{name: "reject by default", limits: versionLimitsConfig{Hard: 3},
+			pushes: []push{
+				{"1.0.0", http.StatusCreated, ""},
+				{"1.1.0-beta", http.StatusCreated, ""},
+				{"1.1.0", http.StatusCreated, ""},
+				{"2.0.0", http.StatusConflict, "Limit.Pkg has 3 versions, the limit is 3"},
+				// A version already stored isn't limited
+				{"1.1.0", http.StatusOK, ""},
+			},
+			want: []string{"1.0.0", "1.1.0-beta", "1.1.0"}},
+		{name: "reject", limits: versionLimitsConfig{Hard: 2, Policy: versionLimitReject},
+			pushes: []push{
+				{"1.0.0-alpha", http.StatusCreated, ""},
+				{"1.0.0-beta", http.StatusCreated, ""},
+				{"1.0.0", http.StatusConflict, "Limit.Pkg has 2 versions, the limit is 2"},
+			},
+			want: []string{"1.0.0-alpha", "1.0.0-beta"}},
+		{name: "evict", limits: versionLimitsConfig{Hard: 4, Policy: versionLimitEvict},
+			pushes: []push{
+				{"1.0.0", http.StatusCreated, ""},
+				{"2.0.0-beta.2", http.StatusCreated, ""},
+				{"2.0.0-beta.1", http.StatusCreated, ""},
+				{"2.0.0-rc", http.StatusCreated, ""},
+				// beta.2 was published before beta.1, so goes first
+				{"2.0.0", http.StatusCreated, ""},
+				{"2.1.0", http.StatusCreated, ""},
+				// Only the latest prerelease is left, it and stable versions stay
+				{"3.0.0", http.StatusConflict, "Limit.Pkg has 4 versions, the limit is 4 and too few prereleases can be evicted"},
+			},
+			want: []string{"1.0.0", "2.0.0-rc", "2.0.0", "2.1.0"}},
+		{name: "evict keeps the pinned version", limits: versionLimitsConfig{Hard: 3, Policy: versionLimitEvict}, pin: "1.0.0-alpha",
+			pushes: []push{
+				{"1.0.0-alpha", http.StatusCreated, ""},
+				{"1.0.0-beta", http.StatusCreated, ""},
+				{"1.0.0-rc", http.StatusCreated, ""},
+				{"1.0.0", http.StatusCreated, ""},
+				{"1.0.1", http.StatusConflict, "too few prereleases can be evicted"},
+			},
+			want: []string{"1.0.0-alpha", "1.0.0-rc", "1.0.0"}},
+		{name: "override",
+			limits: versionLimitsConfig{Hard: 1, Overrides: []versionLimitOverride{
+				{ID: "Other.*", versionLimits: versionLimits{Hard: 1}},
+				{ID: "limit.*", versionLimits: versionLimits{Hard: 2, Policy: versionLimitEvict}},
+			}},
+			pushes: []push{
+				{"1.0.0-beta", http.StatusCreated, ""},
+				{"1.0.0-rc", http.StatusCreated, ""},
+				{"1.0.0", http.StatusCreated, ""},
+				{"1.0.1", http.StatusConflict, "Limit.Pkg has 2 versions, the limit is 2 and too few prereleases can be evicted"},
+			},
+			want: []string{"1.0.0-rc", "1.0.0"}},
+	} {
+		ts := newTestServer(t, func(c *Config) { c.VersionLimits = tc.limits })
+		for i, p := range tc.pushes {
+			if i == 1 && tc.pin != "" {
+				status, body := readResponse(t, ts.do(t, http.MethodPut, "admin/packages/Limit.Pkg/pin", testWriteKey, strings.NewReader(`{"version": "`+tc.pin+`"}`), nil))
+				wantStatus(t, tc.name+" pin", status, body, http.StatusNoContent)
+			}
+			status, body := ts.push(t, testPackage(t, "Limit.Pkg", p.ver, "", nil))
+			wantStatus(t, tc.name+" push "+p.ver, status, body, p.status)
+			if p.err != "" {
+				var res uploadResult
+				if err := json.Unmarshal([]byte(body), &res); err != nil || !strings.Contains(res.Error, p.err) {
+					t.Errorf("%s push %s: got %s, want the error %q", tc.name, p.ver, body, p.err)
+				}
+			}
+		}
+		if got := storedVersions(t, ts, "Limit.Pkg"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: stored %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Nothing is evicted for a push that isn't stored, nor by pushes racing for the
+// same room
+func TestVersionLimitEvictsOnlyOnceStored(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.VersionLimits = versionLimitsConfig{Hard: 2, Policy: versionLimitEvict}
+		c.ExtractionLimits = extractionLimits{MaxFiles: 3}
+	})
+	ts.mustPush(t, testPackage(t, "Limit.Pkg", "1.0.0-a", "", nil))
+	ts.mustPush(t, testPackage(t, "Limit.Pkg", "1.0.0-b", "", nil))
+
+	// Over the extraction limit, so refused after room would have been made
+	status, body := ts.push(t, testPackage(t, "Limit.Pkg", "1.0.0-c", "", map[string]string{"content/a": "a", "content/b": "b", "content/c": "c"}))
+	wantStatus(t, "push over the extraction limit", status, body, http.StatusBadRequest)
+	// Failing validation
+	status, body = ts.push(t, testPackage(t, "Limit.Pkg", "1.0.0-d", "", map[string]string{"content/../x": "x"}))
+	wantStatus(t, "push of an unsafe entry", status, body, http.StatusBadRequest)
+	if got, want := storedVersions(t, ts, "Limit.Pkg"), []string{"1.0.0-a", "1.0.0-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after refused pushes: stored %q, want %q", got, want)
+	}
+
+	// Each push evicts the oldest prerelease left, however they overlap
+	var wg sync.WaitGroup
+	for _, ver := range []string{"1.0.0-c", "1.0.0-d", "1.0.0-e"} {
+		wg.Add(1)
+		go func(ver string) {
+			defer wg.Done()
+			status, body := ts.push(t, testPackage(t, "Limit.Pkg", ver, "", nil))
+			if status != http.StatusCreated && status != http.StatusConflict {
+				t.Errorf("push %s: got %d %s", ver, status, body)
+			}
+		}(ver)
+	}
+	wg.Wait()
+	if got := storedVersions(t, ts, "Limit.Pkg"); len(got) != 2 {
+		t.Errorf("after concurrent pushes: stored %q, want 2 versions", got)
+	}
+}
+
+// Over the soft limit a package is reported in statusz until it's back under
+func TestVersionLimitSoft(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.VersionLimits = versionLimitsConfig{Soft: 2} })
+	statusz := func() string {
+		_, body := readResponse(t, ts.do(t, http.MethodGet, "statusz", testWriteKey, nil, nil))
+		return body
+	}
+	for _, ver := range []string{"1.0.0", "2.0.0"} {
+		ts.mustPush(t, testPackage(t, "Soft.Pkg", ver, "", nil))
+	}
+	if body := statusz(); strings.Contains(body, "version-limit/") {
+		t.Errorf("at the soft limit: %s", body)
+	}
+	ts.mustPush(t, testPackage(t, "Soft.Pkg", "3.0.0", "", nil))
+	if body := statusz(); !strings.Contains(body, "version-limit/soft.pkg") || !strings.Contains(body, "Soft.Pkg has 3 versions, over the soft limit of 2") {
+		t.Errorf("over the soft limit: %s", body)
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodDelete, "api/v2/package/Soft.Pkg/3.0.0", testWriteKey, nil, nil))
+	wantStatus(t, "delete", status, body, http.StatusNoContent)
+	if body := statusz(); strings.Contains(body, "version-limit/") {
+		t.Errorf("back under the soft limit: %s", body)
+	}
+}
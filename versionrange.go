@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/thatgitsam/go-nuget-server/versions"
+)
+
+// versionRange is a parsed NuGet version range, e.g. "1.0" (1.0 or higher),
+// "[1.0]" (exactly 1.0), "[1.0,2.0)" or "(,1.0]". Floating ranges such as "1.2.*"
+// or "1.0.0-beta*" match a prefix and resolve to the highest matching version.
+type versionRange struct {
+	Original     string
+	Min          string
+	MinInclusive bool
+	Max          string
+	MaxInclusive bool
+	// Floating ranges only
+	Floating bool
+	// Release parts that must match, e.g. ["1","2"] for "1.2.*"
+	floatRelease []int
+	// Prerelease label prefix for "1.0.0-beta*", floatPre is set for any "-*" form
+	floatPre    bool
+	floatPrefix string
+}
+
+// parseVersionRange parses the NuGet version range syntax
+func parseVersionRange(s string) (*versionRange, error) {
+	vr := &versionRange{Original: s}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("empty version range")
+	}
+
+	// Floating, e.g. "*", "1.*", "1.2.*", "1.0.0-*", "1.0.0-beta*"
+	if strings.HasSuffix(s, "*") {
+		return parseFloatingRange(vr, s)
+	}
+
+	// A bare version is a minimum
+	if s[0] != '[' && s[0] != '(' {
+		if err := checkRangeVersion(s); err != nil {
+			return nil, err
+		}
+		vr.Min, vr.MinInclusive = s, true
+		return vr, nil
+	}
+
+	last := s[len(s)-1]
+	if len(s) < 3 || (last != ']' && last != ')') {
+		return nil, errors.New("version range " + s + " is missing its closing bracket")
+	}
+	vr.MinInclusive = s[0] == '['
+	vr.MaxInclusive = last == ']'
+	parts := strings.Split(s[1:len(s)-1], ",")
+	switch len(parts) {
+	case 1:
+		// Exact version, only valid as [x]
+		v := strings.TrimSpace(parts[0])
+		if !vr.MinInclusive || !vr.MaxInclusive || v == "" {
+			return nil, errors.New("version range " + s + " must be of the form [version] for an exact version")
+		}
+		if err := checkRangeVersion(v); err != nil {
+			return nil, err
+		}
+		vr.Min, vr.Max = v, v
+	case 2:
+		vr.Min, vr.Max = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if vr.Min == "" && vr.Max == "" {
+			return nil, errors.New("version range " + s + " has no bounds")
+		}
+		for _, v := range []string{vr.Min, vr.Max} {
+			if v == "" {
+				continue
+			}
+			if err := checkRangeVersion(v); err != nil {
+				return nil, err
+			}
+		}
+		if vr.Min != "" && vr.Max != "" {
+			c := versions.Compare(vr.Min, vr.Max)
+			if c > 0 || (c == 0 && !(vr.MinInclusive && vr.MaxInclusive)) {
+				return nil, errors.New("version range " + s + " can never be satisfied")
+			}
+		}
+	default:
+		return nil, errors.New("version range " + s + " has too many bounds")
+	}
+	return vr, nil
+}
+
+func parseFloatingRange(vr *versionRange, s string) (*versionRange, error) {
+	vr.Floating = true
+	vr.MinInclusive = true
+	if s == "*" {
+		vr.Min = "0.0.0"
+		return vr, nil
+	}
+
+	// Prerelease floats, e.g. "1.0.0-*" or "1.0.0-beta*"
+	if i := strings.Index(s, "-"); i >= 0 {
+		rel, pre := s[:i], strings.TrimSuffix(s[i+1:], "*")
+		if strings.Contains(pre, "*") {
+			return nil, errors.New("version range " + s + " can only float its last part")
+		}
+		if err := checkRangeVersion(rel); err != nil {
+			return nil, err
+		}
+		v := versions.Lenient(rel)
+		vr.floatRelease = v.Release()
+		vr.floatPre, vr.floatPrefix = true, strings.ToLower(pre)
+		vr.Min = v.Normalize() + "-" + pre
+		if pre == "" {
+			vr.Min = v.Normalize() + "-0"
+		}
+		return vr, nil
+	}
+
+	// Release floats, e.g. "1.*" or "1.2.*"
+	if !strings.HasSuffix(s, ".*") || strings.Count(s, "*") != 1 {
+		return nil, errors.New("version range " + s + " can only float a whole version part")
+	}
+	rel := strings.TrimSuffix(s, ".*")
+	parts := strings.Split(rel, ".")
+	if len(parts) > 3 {
+		return nil, errors.New("version range " + s + " has too many parts")
+	}
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, errors.New("version range " + s + " has a part that is not a number: " + p)
+		}
+		vr.floatRelease = append(vr.floatRelease, n)
+	}
+	vr.Min = versions.Normalize(rel)
+	return vr, nil
+}
+
+// checkRangeVersion checks a version used as a range bound
+func checkRangeVersion(v string) error {
+	_, err := versions.Parse(v)
+	return err
+}
+
+// Satisfies reports whether a version is in the range
+func (vr *versionRange) Satisfies(v string) bool {
+	if vr.Floating {
+		return vr.floatMatches(v)
+	}
+	if vr.Min != "" {
+		c := versions.Compare(v, vr.Min)
+		if c < 0 || (c == 0 && !vr.MinInclusive) {
+			return false
+		}
+	}
+	if vr.Max != "" {
+		c := versions.Compare(v, vr.Max)
+		if c > 0 || (c == 0 && !vr.MaxInclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// floatMatches reports whether a version matches a floating range's fixed parts
+func (vr *versionRange) floatMatches(s string) bool {
+	v := versions.Lenient(s)
+	rel := v.Release()
+
+	if vr.floatPre {
+		// Same release, as any prerelease with the prefix or the release itself
+		if len(rel) != len(vr.floatRelease) {
+			return false
+		}
+		for i, n := range vr.floatRelease {
+			if rel[i] != n {
+				return false
+			}
+		}
+		return !v.IsPrerelease() || strings.HasPrefix(strings.ToLower(v.PrereleaseTag()), vr.floatPrefix)
+	}
+
+	if len(rel) < len(vr.floatRelease) {
+		return false
+	}
+	for i, n := range vr.floatRelease {
+		if rel[i] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsPrerelease reports whether the range itself asks for prerelease versions,
+// by floating a prerelease label or having a prerelease bound
+func (vr *versionRange) AllowsPrerelease() bool {
+	return vr.floatPre || versions.IsPrerelease(vr.Min) || versions.IsPrerelease(vr.Max)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVersionRange(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		min, max string
+		minIncl  bool
+		maxIncl  bool
+		floating bool
+	}{
+		{in: "1.0", min: "1.0", minIncl: true},
+		{in: " 1.0.0-beta ", min: "1.0.0-beta", minIncl: true},
+		{in: "[1.0]", min: "1.0", max: "1.0", minIncl: true, maxIncl: true},
+		{in: "[1.0,2.0)", min: "1.0", max: "2.0", minIncl: true},
+		{in: "(1.0,2.0]", min: "1.0", max: "2.0", maxIncl: true},
+		{in: "(1.0, 2.0)", min: "1.0", max: "2.0"},
+		{in: "(,1.0]", max: "1.0", maxIncl: true},
+		{in: "[1.0,)", min: "1.0", minIncl: true},
+		{in: "[1.0,1.0]", min: "1.0", max: "1.0", minIncl: true, maxIncl: true},
+		{in: "*", min: "0.0.0", minIncl: true, floating: true},
+		{in: "1.*", min: "1.0.0", minIncl: true, floating: true},
+		{in: "1.2.*", min: "1.2.0", minIncl: true, floating: true},
+		{in: "1.0.0-*", min: "1.0.0-0", minIncl: true, floating: true},
+		{in: "1.0.0-beta*", min: "1.0.0-beta", minIncl: true, floating: true},
+	} {
+		vr, err := parseVersionRange(tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if vr.Min != tc.min || vr.Max != tc.max || vr.MinInclusive != tc.minIncl || vr.MaxInclusive != tc.maxIncl || vr.Floating != tc.floating {
+			t.Errorf("%q: got %+v", tc.in, vr)
+		}
+	}
+}
+
+func TestParseVersionRangeErrors(t *testing.T) {
+	for in, want := range map[string]string{
+		"":            "empty version range",
+		"abc":         "abc",
+		"[1.0":        "missing its closing bracket",
+		"(1.0)":       "must be of the form [version]",
+		"[]":          "[]",
+		"[,]":         "has no bounds",
+		"[1.0,2.0,3]": "too many bounds",
+		"[2.0,1.0]":   "can never be satisfied",
+		"(1.0,1.0]":   "can never be satisfied",
+		"[1.0,x]":     "x",
+		"1.*.0":       "not a number",
+		"1.0*":        "can only float a whole version part",
+		"1.0.0-b*t*":  "can only float its last part",
+		"1.2.3.4.*":   "too many parts",
+		"a.*":         "not a number: a",
+	} {
+		_, err := parseVersionRange(in)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want one containing %q", in, err, want)
+		}
+	}
+}
+
+func TestVersionRangeSatisfies(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		yes []string
+		no  []string
+		pre bool // AllowsPrerelease
+	}{
+		{in: "1.0", yes: []string{"1.0.0", "1.0", "1.0.0.0", "2.0.0", "1.0.1-beta"}, no: []string{"0.9.9", "1.0.0-beta"}},
+		{in: "[1.0]", yes: []string{"1.0.0", "1.0"}, no: []string{"1.0.1", "0.9.0"}},
+		{in: "[1.0,2.0)", yes: []string{"1.0.0", "1.9.9"}, no: []string{"2.0.0", "0.9.0"}},
+		{in: "(1.0,2.0]", yes: []string{"1.0.1", "2.0.0"}, no: []string{"1.0.0", "2.0.1"}},
+		{in: "(,1.0]", yes: []string{"0.0.1", "1.0.0"}, no: []string{"1.0.1"}},
+		{in: "[1.0.0-beta,2.0)", yes: []string{"1.0.0-beta", "1.0.0-rc", "1.0.0"}, no: []string{"1.0.0-alpha"}, pre: true},
+		{in: "*", yes: []string{"0.0.1", "9.0.0"}},
+		{in: "1.*", yes: []string{"1.0.0", "1.9.3"}, no: []string{"2.0.0", "0.9.0"}},
+		{in: "1.2.*", yes: []string{"1.2.0", "1.2.7", "1.2.7.1"}, no: []string{"1.3.0", "1.1.9"}},
+		{in: "1.0.0-*", yes: []string{"1.0.0-alpha", "1.0.0-beta.2", "1.0.0"}, no: []string{"1.0.1-alpha", "1.1.0"}, pre: true},
+		{in: "1.0.0-beta*", yes: []string{"1.0.0-beta", "1.0.0-BETA2", "1.0.0"}, no: []string{"1.0.0-alpha", "1.0.1-beta"}, pre: true},
+	} {
+		vr, err := parseVersionRange(tc.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.in, err)
+		}
+		for _, v := range tc.yes {
+			if !vr.Satisfies(v) {
+				t.Errorf("%q should be satisfied by %s", tc.in, v)
+			}
+		}
+		for _, v := range tc.no {
+			if vr.Satisfies(v) {
+				t.Errorf("%q should not be satisfied by %s", tc.in, v)
+			}
+		}
+		if vr.AllowsPrerelease() != tc.pre {
+			t.Errorf("%q: AllowsPrerelease %v, want %v", tc.in, !tc.pre, tc.pre)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, v := range []string{"1.0.0", "1.2.0", "1.3.0-beta", "1.4.0", "1.5.0+build", "2.0.0"} {
+		ts.mustPush(t, testPackage(t, "Resolve.Pkg", v, "", nil))
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodPost, "admin/unlist/Resolve.Pkg/1.2.0", testWriteKey, nil, nil))
+	wantStatus(t, "unlist", status, body, http.StatusNoContent)
+
+	resolve := func(query string, want int) resolveResult {
+		t.Helper()
+		status, body := ts.get(t, "api/resolve?"+query)
+		wantStatus(t, query, status, body, want)
+		var res resolveResult
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatalf("%s: %v: %s", query, err, body)
+		}
+		return res
+	}
+
+	for _, tc := range []struct {
+		query    string
+		selected string
+	}{
+		{query: "id=resolve.pkg&range=" + url.QueryEscape("[1.1.0,2.0.0)"), selected: "1.4.0"},
+		{query: "id=Resolve.Pkg&range=" + url.QueryEscape("[1.2.0]"), selected: "1.2.0"},
+		{query: "id=Resolve.Pkg&range=1.1", selected: "1.4.0"},
+		{query: "id=Resolve.Pkg&range=1.1&prerelease=true", selected: "1.3.0-beta"},
+		{query: "id=Resolve.Pkg&range=1.*", selected: "1.4.0"},
+		{query: "id=Resolve.Pkg&range=1.*&semVerLevel=2.0.0", selected: "1.5.0+build"},
+		{query: "id=Resolve.Pkg&range=" + url.QueryEscape("(2.0.0,)")},
+	} {
+		res := resolve(tc.query, http.StatusOK)
+		got := ""
+		if res.Selected != nil {
+			got = *res.Selected
+		}
+		if got != tc.selected {
+			t.Errorf("%s: selected %q, want %q", tc.query, got, tc.selected)
+		}
+	}
+
+	// Each hosted version is listed with why it was left out
+	res := resolve("id=Resolve.Pkg&range="+url.QueryEscape("[1.1.0,2.0.0)"), http.StatusOK)
+	var reasons []string
+	for _, c := range res.Candidates {
+		reasons = append(reasons, c.Version+": "+c.Reason)
+	}
+	want := []string{
+		"1.0.0: outside range",
+		"1.2.0: unlisted",
+		"1.3.0-beta: prerelease not requested",
+		"1.4.0: in range",
+		"1.5.0+build: SemVer 2.0.0 version and semVerLevel=2.0.0 not requested",
+		"2.0.0: outside range",
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("candidates:\n%q\nwant\n%q", reasons, want)
+	}
+
+	if res := resolve("id=Resolve.Pkg&range="+url.QueryEscape("[2.0,1.0]"), http.StatusBadRequest); !strings.Contains(res.Error, "can never be satisfied") {
+		t.Errorf("invalid range: error %q", res.Error)
+	}
+	resolve("id=Resolve.Pkg", http.StatusBadRequest)
+	resolve("id=Resolve.Pkg&range=1.0&prerelease=maybe", http.StatusBadRequest)
+	resolve("id=No.Such.Pkg&range=1.0", http.StatusNotFound)
+}
@@ -0,0 +1,336 @@
+// Package versions parses, normalizes and orders NuGet package versions, so every
+// part of the server agrees on which strings name the same version and which of
+// two versions is newer.
+//
+// A version is up to four dot separated numbers, optionally followed by a
+// prerelease label ("-beta.2") and build metadata ("+abc"). Versions are ordered
+// as SemVer 2.0.0 orders them, ignoring case in prerelease labels as NuGet does,
+// and build metadata plays no part in ordering or equality.
+package versions
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed package version
+type Version struct {
+	original string
+	// Release parts as written, with numbers canonicalized, at least three
+	release []string
+	// Numeric value of each release part, 0 for a part that isn't a number
+	nums []int
+	// Prerelease identifiers as written, none for a release
+	pre []string
+	// Build metadata as written, without the "+"
+	meta string
+}
+
+// Parse parses a version, returning an error if it isn't a valid NuGet version
+func Parse(s string) (Version, error) {
+	v := parse(s)
+	if strings.TrimSpace(s) == "" {
+		return v, errors.New("empty version")
+	}
+	rel, _, _ := split(strings.TrimSpace(s))
+	parts := strings.Split(rel, ".")
+	if len(parts) > 4 {
+		return v, errors.New("version " + s + " has too many parts")
+	}
+	for _, p := range parts {
+		if !isNumber(p) {
+			return v, errors.New("version " + s + " has a part that is not a number: " + p)
+		}
+	}
+	if strings.Contains(strings.SplitN(s, "+", 2)[0], "-") && len(v.pre) == 0 {
+		return v, errors.New("version " + s + " has an empty prerelease label")
+	}
+	for _, id := range v.pre {
+		if !isIdentifier(id) {
+			return v, errors.New("version " + s + " has an invalid prerelease label")
+		}
+	}
+	if strings.Contains(s, "+") {
+		for _, id := range strings.Split(v.meta, ".") {
+			if !isIdentifier(id) {
+				return v, errors.New("version " + s + " has invalid build metadata")
+			}
+		}
+	}
+	return v, nil
+}
+
+// parse splits a version into its parts without checking them, so versions
+// already stored can be ordered and normalized whatever they look like
+func parse(s string) Version {
+	v := Version{original: s}
+	rel, pre, meta := split(strings.TrimSpace(s))
+	v.meta = meta
+	if pre != "" {
+		v.pre = strings.Split(pre, ".")
+	}
+	for _, p := range strings.Split(rel, ".") {
+		n, err := strconv.Atoi(p)
+		if err == nil {
+			p = strconv.Itoa(n)
+		} else {
+			// Leading digits count, as in "1.2b"
+			n = leadingNumber(p)
+		}
+		v.release = append(v.release, p)
+		v.nums = append(v.nums, n)
+	}
+	for len(v.release) < 3 {
+		v.release = append(v.release, "0")
+		v.nums = append(v.nums, 0)
+	}
+	return v
+}
+
+// split returns the release, prerelease label and build metadata of a version
+func split(s string) (string, string, string) {
+	meta := ""
+	if i := strings.Index(s, "+"); i >= 0 {
+		s, meta = s[:i], s[i+1:]
+	}
+	pre := ""
+	if i := strings.Index(s, "-"); i >= 0 {
+		s, pre = s[:i], s[i+1:]
+	}
+	return s, pre, meta
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isIdentifier reports whether s is a SemVer identifier: ASCII letters, digits and hyphens
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func leadingNumber(s string) int {
+	n := 0
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			break
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n
+}
+
+// String returns the version as it was written
+func (v Version) String() string {
+	return v.original
+}
+
+// Normalize returns the NuGet normalized form: leading zeros dropped, at least
+// three parts, a zero fourth part removed and no build metadata (e.g. "01.0" is
+// "1.0.0", "1.0.0.0+abc" is "1.0.0"). The prerelease label keeps its case.
+func (v Version) Normalize() string {
+	rel := v.release
+	if len(rel) == 4 && rel[3] == "0" {
+		rel = rel[:3]
+	}
+	s := strings.Join(rel, ".")
+	if len(v.pre) > 0 {
+		s += "-" + strings.Join(v.pre, ".")
+	}
+	return s
+}
+
+// IsNormalized reports whether the version, less any build metadata, is written
+// in its normalized form
+func (v Version) IsNormalized() bool {
+	s := strings.TrimSpace(v.original)
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	return s == v.Normalize()
+}
+
+// Key returns a form of the version for map keys and file names, the same for
+// every way of writing the version
+func (v Version) Key() string {
+	return strings.ToLower(v.Normalize())
+}
+
+// Equal reports whether two versions are the same version
+func (v Version) Equal(o Version) bool {
+	return v.Key() == o.Key()
+}
+
+// Compare returns -1, 0 or 1 as v is older than, the same as or newer than o.
+// Release parts are compared as numbers, a release is newer than its
+// prereleases, and prerelease labels are compared identifier by identifier,
+// numeric ones by value and older than alphanumeric ones (so "dev.9" < "dev.10"
+// < "dev.a").
+func (v Version) Compare(o Version) int {
+	for i := 0; i < len(v.nums) || i < len(o.nums); i++ {
+		var x, y int
+		if i < len(v.nums) {
+			x = v.nums[i]
+		}
+		if i < len(o.nums) {
+			y = o.nums[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := compareIdentifiers(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.pre) < len(o.pre):
+		return -1
+	case len(v.pre) > len(o.pre):
+		return 1
+	}
+	return 0
+}
+
+// compareIdentifiers compares two prerelease identifiers, ignoring case
+func compareIdentifiers(a, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	an, bn := isNumber(a), isNumber(b)
+	switch {
+	case an && bn:
+		// By value, then as written so "01" and "1" aren't taken as the same
+		x := strings.TrimLeft(a, "0")
+		y := strings.TrimLeft(b, "0")
+		if len(x) != len(y) {
+			if len(x) < len(y) {
+				return -1
+			}
+			return 1
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	case an:
+		return -1
+	case bn:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// IsPrerelease reports whether the version has a prerelease label
+func (v Version) IsPrerelease() bool {
+	return len(v.pre) > 0
+}
+
+// PrereleaseTag returns the prerelease label as written without its "-", e.g.
+// "beta.2", or "" for a release
+func (v Version) PrereleaseTag() string {
+	return strings.Join(v.pre, ".")
+}
+
+// HasPrereleaseTag reports whether the prerelease label starts with the
+// identifiers of tag, each matched in full and ignoring case, so "dev" matches
+// 1.2.3-dev.45 and 1.2.3-dev but not 1.2.3-develop.1
+func (v Version) HasPrereleaseTag(tag string) bool {
+	want := strings.Split(tag, ".")
+	if len(v.pre) < len(want) {
+		return false
+	}
+	for i, w := range want {
+		if !strings.EqualFold(v.pre[i], w) {
+			return false
+		}
+	}
+	return true
+}
+
+// PrereleaseName returns the first prerelease identifier in lower case, e.g. the
+// branch of 1.2.3-Dev.45 is "dev", or "" for a release
+func (v Version) PrereleaseName() string {
+	if len(v.pre) == 0 {
+		return ""
+	}
+	return strings.ToLower(v.pre[0])
+}
+
+// IsSemVer2 reports whether only SemVer 2.0.0 aware clients can understand the
+// version, i.e. it has build metadata or a dotted prerelease label
+func (v Version) IsSemVer2() bool {
+	return strings.Contains(v.original, "+") || len(v.pre) > 1
+}
+
+// Release returns the numbers of the normalized release parts, e.g. [1 2 0] for "1.2"
+func (v Version) Release() []int {
+	n := v.nums
+	if len(n) == 4 && n[3] == 0 && v.release[3] == "0" {
+		n = n[:3]
+	}
+	return append([]int{}, n...)
+}
+
+// Normalize returns the normalized form of a version string, see Version.Normalize
+func Normalize(s string) string {
+	return parse(s).Normalize()
+}
+
+// Key returns the map key of a version string, see Version.Key
+func Key(s string) string {
+	return parse(s).Key()
+}
+
+// Equal reports whether two version strings name the same version
+func Equal(a, b string) bool {
+	return parse(a).Equal(parse(b))
+}
+
+// Compare orders two version strings, see Version.Compare
+func Compare(a, b string) int {
+	return parse(a).Compare(parse(b))
+}
+
+// IsPrerelease reports whether a version string has a prerelease label
+func IsPrerelease(s string) bool {
+	return parse(s).IsPrerelease()
+}
+
+// IsSemVer2 reports whether a version string is SemVer 2.0.0 only, see Version.IsSemVer2
+func IsSemVer2(s string) bool {
+	return parse(s).IsSemVer2()
+}
+
+// Lenient returns a version without checking it, for versions already stored
+// that must be handled whatever they look like
+func Lenient(s string) Version {
+	return parse(s)
+}
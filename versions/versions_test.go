@@ -0,0 +1,161 @@
+package versions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		in string
+		ok bool
+	}{
+		{"1", true},
+		{"1.0", true},
+		{"1.0.0", true},
+		{"1.0.0.0", true},
+		{"1.0.0-beta", true},
+		{"1.0.0-beta.2+sha.abc", true},
+		{"1.0.0+abc", true},
+		{"", false},
+		{"1.0.0.0.0", false},
+		{"1.x", false},
+		{"1.0.0-", false},
+		{"1.0.0-beta_2", false},
+		{"1.0.0+a..b", false},
+	} {
+		if _, err := Parse(tc.in); (err == nil) != tc.ok {
+			t.Errorf("Parse(%q) = %v, want ok %v", tc.in, err, tc.ok)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"1", "1.0.0"},
+		{"1.0", "1.0.0"},
+		{"01.02.03", "1.2.3"},
+		{"1.0.0.0", "1.0.0"},
+		{"1.0.0.1", "1.0.0.1"},
+		{"1.0.0-Beta.2", "1.0.0-Beta.2"},
+		{"1.0.0+abc", "1.0.0"},
+		{"1.0.0.0-rc+abc", "1.0.0-rc"},
+		{" 1.2 ", "1.2.0"},
+	} {
+		if got := Normalize(tc.in); got != tc.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"1.0", "1.0.0", true},
+		{"1.0.0.0", "1.0.0", true},
+		{"1.0.0-BETA", "1.0.0-beta", true},
+		{"1.0.0+a", "1.0.0+b", true},
+		{"1.0.0", "1.0.1", false},
+		{"1.0.0-beta", "1.0.0", false},
+	} {
+		if got := Equal(tc.a, tc.b); got != tc.want {
+			t.Errorf("Equal(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+		if Key(tc.a) == Key(tc.b) != tc.want {
+			t.Errorf("Key(%q) = %q, Key(%q) = %q", tc.a, Key(tc.a), tc.b, Key(tc.b))
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// In SemVer 2.0.0 precedence order
+	ordered := []string{
+		"0.9.0",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.10",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.0.1",
+		"1.0.1",
+		"1.2.0",
+		"1.10.0",
+		"2.0.0",
+	}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := Compare(a, b); got != want {
+				t.Errorf("Compare(%q, %q) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+	for _, tc := range []struct {
+		a, b string
+	}{
+		{"1.0", "1.0.0"},
+		{"1.0.0+abc", "1.0.0"},
+		{"1.0.0-RC.1", "1.0.0-rc.1"},
+	} {
+		if got := Compare(tc.a, tc.b); got != 0 {
+			t.Errorf("Compare(%q, %q) = %d, want 0", tc.a, tc.b, got)
+		}
+	}
+}
+
+func TestPrerelease(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		pre      bool
+		tag      string
+		name     string
+		semver2  bool
+		release  []int
+		hasTag   string
+		matchTag bool
+	}{
+		{"1.0.0", false, "", "", false, []int{1, 0, 0}, "dev", false},
+		{"1.2", false, "", "", false, []int{1, 2, 0}, "", false},
+		{"1.2.3-Dev.45", true, "Dev.45", "dev", true, []int{1, 2, 3}, "dev", true},
+		{"1.2.3-develop.1", true, "develop.1", "develop", true, []int{1, 2, 3}, "dev", false},
+		{"1.2.3-beta", true, "beta", "beta", false, []int{1, 2, 3}, "beta.1", false},
+		{"1.2.3.4+abc", false, "", "", true, []int{1, 2, 3, 4}, "", false},
+	} {
+		v := Lenient(tc.in)
+		if v.IsPrerelease() != tc.pre || IsPrerelease(tc.in) != tc.pre {
+			t.Errorf("IsPrerelease(%q) = %v, want %v", tc.in, v.IsPrerelease(), tc.pre)
+		}
+		if got := v.PrereleaseTag(); got != tc.tag {
+			t.Errorf("PrereleaseTag(%q) = %q, want %q", tc.in, got, tc.tag)
+		}
+		if got := v.PrereleaseName(); got != tc.name {
+			t.Errorf("PrereleaseName(%q) = %q, want %q", tc.in, got, tc.name)
+		}
+		if got := IsSemVer2(tc.in); got != tc.semver2 {
+			t.Errorf("IsSemVer2(%q) = %v, want %v", tc.in, got, tc.semver2)
+		}
+		if got := v.Release(); !reflect.DeepEqual(got, tc.release) {
+			t.Errorf("Release(%q) = %v, want %v", tc.in, got, tc.release)
+		}
+		if tc.hasTag != "" {
+			if got := v.HasPrereleaseTag(tc.hasTag); got != tc.matchTag {
+				t.Errorf("HasPrereleaseTag(%q, %q) = %v, want %v", tc.in, tc.hasTag, got, tc.matchTag)
+			}
+		}
+		if got := v.String(); got != tc.in {
+			t.Errorf("String() = %q, want %q", got, tc.in)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestVersionsWrittenDifferently(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ts.mustPush(t, testPackage(t, "Norm.Pkg", "1.0", "", nil))
+
+	// Stored under the normalized version
+	if _, err := os.Stat(ts.nupkgPath(t, "norm.pkg", "1.0.0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another way of writing the version is the same package
+	for _, ver := range []string{"1.0.0", "1.0.0.0"} {
+		status, body := ts.push(t, testPackage(t, "Norm.Pkg", ver, "<title>Other</title>", nil))
+		wantStatus(t, "push "+ver, status, body, http.StatusConflict)
+	}
+	for _, ver := range []string{"1.0", "1.0.0", "1.0.0.0"} {
+		status, body := readResponse(t, ts.do(t, http.MethodGet, "nupkg/Norm.Pkg/"+ver, testReadKey, nil, nil))
+		wantStatus(t, "download "+ver, status, body, http.StatusOK)
+	}
+
+	// Versions are ordered by precedence, not as strings
+	for _, ver := range []string{"1.0.0-rc.1", "1.0.0-rc.10", "1.1.0-beta", "1.0.0-rc.2"} {
+		ts.mustPush(t, testPackage(t, "Norm.Pkg", ver, "", nil))
+	}
+	status, body := ts.get(t, "Packages(Id='Norm.Pkg',Version='1.0')")
+	wantStatus(t, "entry", status, body, http.StatusOK)
+	if between(body, "<d:IsLatestVersion m:type=\"Edm.Boolean\">", "<") != "true" {
+		t.Errorf("1.0 isn't IsLatestVersion: %s", body)
+	}
+	status, body = ts.get(t, "Packages(Id='Norm.Pkg',Version='1.1.0-beta')")
+	wantStatus(t, "entry", status, body, http.StatusOK)
+	if between(body, "<d:IsAbsoluteLatestVersion m:type=\"Edm.Boolean\">", "<") != "true" {
+		t.Errorf("1.1.0-beta isn't IsAbsoluteLatestVersion: %s", body)
+	}
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name package visibility is kept under in the filestore
+const visibilitySetting = "visibility"
+
+// How long visibility read from the store is trusted before being read again, so
+// changes made by other instances apply
+const visibilityRefresh = 10 * time.Second
+
+// Header a push names the groups that may see the package with
+const visibilityHeader = "X-NuGet-Visibility"
+
+// Visibility value for a package everyone can see
+const visibilityPublic = "public"
+
+// visibilityConfig names groups of API keys that packages can be restricted to
+type visibilityConfig struct {
+	// Group name to the keys in it
+	Groups map[string][]string `json:"groups"`
+	// Keys that see every package
+	AdminKeys []string `json:"admin-keys"`
+}
+
+// validateVisibility checks the visibility config
+func validateVisibility(c *Config) error {
+	for g, keys := range c.Visibility.Groups {
+		if g == "" || strings.EqualFold(g, visibilityPublic) || strings.Contains(g, ",") {
+			return errors.New(`visibility group names must not be empty, contain "," or be "public"`)
+		}
+		for _, k := range keys {
+			if k == "" {
+				return errors.New("visibility group " + g + " must not contain empty keys")
+			}
+		}
+	}
+	return nil
+}
+
+// viewer is who a request reads packages as
+type viewer struct {
+	all    bool
+	groups map[string]bool
+}
+
+type viewerContextKey struct{}
+
+// viewerFor returns what an API key may see. Without any groups configured the
+// feature is off and everything is seen.
+func viewerFor(c *Config, key string) *viewer {
+	v := &viewer{groups: make(map[string]bool)}
+	if len(c.Visibility.Groups) == 0 {
+		v.all = true
+		return v
+	}
+	for _, k := range c.Visibility.AdminKeys {
+		if key != "" && k == key {
+			v.all = true
+			return v
+		}
+	}
+	for g, keys := range c.Visibility.Groups {
+		for _, k := range keys {
+			if key != "" && k == key {
+				v.groups[strings.ToLower(g)] = true
+			}
+		}
+	}
+	return v
+}
+
+// sees reports whether the viewer may see a package restricted to groups, where
+// no groups means public
+func (v *viewer) sees(groups []string) bool {
+	if v.all || len(groups) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		if v.groups[strings.ToLower(g)] {
+			return true
+		}
+	}
+	return false
+}
+
+// scope identifies the packages the viewer sees, for caching results per viewer
+func (v *viewer) scope() string {
+	if v == nil || v.all {
+		return "*"
+	}
+	var gs []string
+	for g := range v.groups {
+		gs = append(gs, g)
+	}
+	sort.Strings(gs)
+	return strings.Join(gs, ",")
+}
+
+// withViewer returns a copy of the request that reads the store as the API key
+// it was sent with. Work the server does for itself, with no viewer, sees everything.
+func withViewer(r *http.Request) *http.Request {
+	v := viewerFor(server.Config(), requestAPIKey(r))
+	return r.WithContext(context.WithValue(r.Context(), viewerContextKey{}, v))
+}
+
+// contextViewer returns who a context reads packages as, nil for the server itself
+func contextViewer(ctx context.Context) *viewer {
+	v, _ := ctx.Value(viewerContextKey{}).(*viewer)
+	return v
+}
+
+// packageVisibility maps lower case package IDs to the groups that may see them.
+// IDs that aren't listed are public.
+type packageVisibility struct {
+	Packages map[string][]string `json:"packages"`
+	// When it was last changed, so feeds don't look changed when a server starts
+	Changed time.Time `json:"changed,omitempty"`
+}
+
+// visibleFileStore hides packages from requests whose key may not see them, as if
+// they didn't exist. It wraps the store every route uses, so the rule is applied
+// to feeds, searches, downloads and everything else alike.
+type visibleFileStore struct {
+	fileStore
+
+	lock    sync.Mutex
+	loaded  time.Time
+	vis     *packageVisibility
+	raw     []byte
+	changed time.Time
+}
+
+// visibility returns the package visibility, read from the store at most every
+// visibilityRefresh
+func (fs *visibleFileStore) visibility(ctx context.Context) (*packageVisibility, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.vis != nil && time.Since(fs.loaded) < visibilityRefresh {
+		return fs.vis, nil
+	}
+	pv := &packageVisibility{Packages: make(map[string][]string)}
+	b, err := fs.fileStore.GetSetting(ctx, visibilitySetting)
+	if err == nil {
+		if err := json.Unmarshal(b, pv); err != nil {
+			return nil, err
+		}
+		if pv.Packages == nil {
+			pv.Packages = make(map[string][]string)
+		}
+	} else if err != ErrFileNotFound && err != ErrNotSupported {
+		return nil, err
+	}
+	fs.loaded = time.Now()
+	if fs.vis == nil || !bytes.Equal(b, fs.raw) {
+		fs.changed = pv.Changed
+		// Changed by another instance that doesn't stamp it
+		if fs.changed.IsZero() && fs.vis != nil {
+			fs.changed = fs.loaded
+		}
+	}
+	fs.vis = pv
+	fs.raw = b
+	return pv, nil
+}
+
+// LastChanged includes changes to visibility, as they change what feeds show
+func (fs *visibleFileStore) LastChanged(ctx context.Context) time.Time {
+	t := fs.fileStore.LastChanged(ctx)
+	if _, err := fs.visibility(ctx); err != nil {
+		return t
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.changed.After(t) {
+		return fs.changed
+	}
+	return t
+}
+
+// setVisibility restricts a package ID to groups, or makes it public if there are none
+func (fs *visibleFileStore) setVisibility(ctx context.Context, id string, groups []string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	// Always start from the stored copy so edits by other instances aren't lost
+	pv := &packageVisibility{}
+	b, err := fs.fileStore.GetSetting(ctx, visibilitySetting)
+	if err == nil {
+		if err := json.Unmarshal(b, pv); err != nil {
+			return err
+		}
+	} else if err != ErrFileNotFound {
+		return err
+	}
+	if pv.Packages == nil {
+		pv.Packages = make(map[string][]string)
+	}
+	if len(groups) == 0 {
+		delete(pv.Packages, strings.ToLower(id))
+	} else {
+		pv.Packages[strings.ToLower(id)] = groups
+	}
+	pv.Changed = time.Now().UTC()
+	if b, err = json.Marshal(pv); err != nil {
+		return err
+	}
+	if err := fs.fileStore.PutSetting(ctx, visibilitySetting, b); err != nil {
+		return err
+	}
+	fs.vis = pv
+	fs.raw = b
+	fs.loaded = time.Now()
+	fs.changed = pv.Changed
+	return nil
+}
+
+// groupsFor returns the groups a package ID is restricted to, none if public
+func (fs *visibleFileStore) groupsFor(ctx context.Context, id string) ([]string, error) {
+	pv, err := fs.visibility(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pv.Packages[strings.ToLower(id)], nil
+}
+
+// hidden reports whether the context's viewer may not see a package ID
+func (fs *visibleFileStore) hidden(ctx context.Context, id string) (bool, error) {
+	v := contextViewer(ctx)
+	if v == nil || v.all {
+		return false, nil
+	}
+	groups, err := fs.groupsFor(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	return !v.sees(groups), nil
+}
+
+// filter drops the entries the context's viewer may not see
+func (fs *visibleFileStore) filter(ctx context.Context, entries []*NugetPackageEntry) ([]*NugetPackageEntry, error) {
+	v := contextViewer(ctx)
+	if v == nil || v.all {
+		return entries, nil
+	}
+	pv, err := fs.visibility(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list []*NugetPackageEntry
+	for _, e := range entries {
+		if v.sees(pv.Packages[strings.ToLower(e.Properties.ID)]) {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+func (fs *visibleFileStore) GetPackageEntry(ctx context.Context, id string, ver string) (*NugetPackageEntry, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.GetPackageEntry(ctx, id, ver)
+}
+
+// GetPackageFeedEntries reads on past hidden entries so pages stay full
+func (fs *visibleFileStore) GetPackageFeedEntries(ctx context.Context, id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+	v := contextViewer(ctx)
+	if v == nil || v.all {
+		return fs.fileStore.GetPackageFeedEntries(ctx, id, startAfter, max)
+	}
+	var list []*NugetPackageEntry
+	from := startAfter
+	for {
+		page, more, err := fs.fileStore.GetPackageFeedEntries(ctx, id, startAfter, max)
+		if err == ErrStartAfterGone && startAfter != from {
+			// A hidden version read past was removed meanwhile, so fill the page again
+			list, startAfter = nil, from
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		seen, err := fs.filter(ctx, page)
+		if err != nil {
+			return nil, false, err
+		}
+		list = append(list, seen...)
+		if max > 0 && len(list) >= max {
+			return list[:max], more || len(list) > max, nil
+		}
+		if !more || len(page) == 0 {
+			return list, false, nil
+		}
+		last := page[len(page)-1]
+		startAfter = last.Properties.ID + "." + last.Properties.Version
+	}
+}
+
+func (fs *visibleFileStore) GetPackageVersions(ctx context.Context, id string) ([]string, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.GetPackageVersions(ctx, id)
+}
+
+func (fs *visibleFileStore) GetNuspec(ctx context.Context, id string, ver string) ([]byte, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.GetNuspec(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) StoreSymbolPackage(ctx context.Context, id string, ver string, pkg []byte) error {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return err
+	} else if h {
+		return ErrFileNotFound
+	}
+	return fs.fileStore.StoreSymbolPackage(ctx, id, ver, pkg)
+}
+
+func (fs *visibleFileStore) GetSymbolPackage(ctx context.Context, id string, ver string) ([]byte, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.GetSymbolPackage(ctx, id, ver)
+}
+
+// GetSymbolFile only finds which package a PDB is for once it has it
+func (fs *visibleFileStore) GetSymbolFile(ctx context.Context, pdbName string, signature string) ([]byte, string, error) {
+	b, id, err := fs.fileStore.GetSymbolFile(ctx, pdbName, signature)
+	if err != nil {
+		return nil, "", err
+	}
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, "", err
+	} else if h {
+		return nil, "", ErrFileNotFound
+	}
+	return b, id, nil
+}
+
+func (fs *visibleFileStore) GetFile(ctx context.Context, f string) ([]byte, string, error) {
+	if h, err := fs.hidden(ctx, fileID(f)); err != nil {
+		return nil, "", err
+	} else if h {
+		return nil, "", ErrFileNotFound
+	}
+	return fs.fileStore.GetFile(ctx, f)
+}
+
+func (fs *visibleFileStore) GetCompressedFile(ctx context.Context, f string) ([]byte, error) {
+	if h, err := fs.hidden(ctx, fileID(f)); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.GetCompressedFile(ctx, f)
+}
+
+// fileID returns the package ID a content path is under
+func fileID(f string) string {
+	return strings.SplitN(strings.TrimLeft(path.Clean("/"+f), "/"), "/", 2)[0]
+}
+
+func (fs *visibleFileStore) GetPackageFile(ctx context.Context, id string, ver string) (*packageFile, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.GetPackageFile(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) ReadPackageFile(ctx context.Context, id string, ver string) ([]byte, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.ReadPackageFile(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) GetQuarantinedEntries(ctx context.Context) ([]*NugetPackageEntry, error) {
+	entries, err := fs.fileStore.GetQuarantinedEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return fs.filter(ctx, entries)
+}
+
+func (fs *visibleFileStore) ApprovePackage(ctx context.Context, id string, ver string) error {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return err
+	} else if h {
+		return ErrFileNotFound
+	}
+	return fs.fileStore.ApprovePackage(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) RejectPackage(ctx context.Context, id string, ver string, reason string) error {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return err
+	} else if h {
+		return ErrFileNotFound
+	}
+	return fs.fileStore.RejectPackage(ctx, id, ver, reason)
+}
+
+// GetChanges leaves out the changes to hidden packages, keeping the sequence
+// numbers so a mirror's position is still valid
+func (fs *visibleFileStore) GetChanges(ctx context.Context, since int64) ([]changeRecord, int64, bool, error) {
+	changes, max, reset, err := fs.fileStore.GetChanges(ctx, since)
+	v := contextViewer(ctx)
+	if err != nil || v == nil || v.all {
+		return changes, max, reset, err
+	}
+	pv, err := fs.visibility(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	var list []changeRecord
+	for _, c := range changes {
+		if c.ID == "" || v.sees(pv.Packages[strings.ToLower(c.ID)]) {
+			list = append(list, c)
+		}
+	}
+	return list, max, reset, nil
+}
+
+func (fs *visibleFileStore) GetExtractionStatus(ctx context.Context, id string, ver string) (*extractionStatus, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.GetExtractionStatus(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) GetExtractionStatuses(ctx context.Context) ([]*extractionStatus, error) {
+	list, err := fs.fileStore.GetExtractionStatuses(ctx)
+	v := contextViewer(ctx)
+	if err != nil || v == nil || v.all {
+		return list, err
+	}
+	pv, err := fs.visibility(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var seen []*extractionStatus
+	for _, st := range list {
+		if v.sees(pv.Packages[strings.ToLower(st.ID)]) {
+			seen = append(seen, st)
+		}
+	}
+	return seen, nil
+}
+
+func (fs *visibleFileStore) ReextractPackage(ctx context.Context, id string, ver string) (*extractionStatus, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.ReextractPackage(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) SetListed(ctx context.Context, id string, ver string, listed bool) error {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return err
+	} else if h {
+		return ErrFileNotFound
+	}
+	return fs.fileStore.SetListed(ctx, id, ver, listed)
+}
+
+func (fs *visibleFileStore) DeletePackage(ctx context.Context, id string, ver string) error {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return err
+	} else if h {
+		return ErrFileNotFound
+	}
+	return fs.fileStore.DeletePackage(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) GetPackageStorage(ctx context.Context, id string, ver string) (*packageStorage, error) {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return nil, err
+	} else if h {
+		return nil, ErrFileNotFound
+	}
+	return fs.fileStore.GetPackageStorage(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) SetPinnedVersion(ctx context.Context, id string, ver string) error {
+	if h, err := fs.hidden(ctx, id); err != nil {
+		return err
+	} else if h {
+		return ErrFileNotFound
+	}
+	return fs.fileStore.SetPinnedVersion(ctx, id, ver)
+}
+
+func (fs *visibleFileStore) GetPinnedVersions(ctx context.Context) (map[string]string, error) {
+	pins, err := fs.fileStore.GetPinnedVersions(ctx)
+	v := contextViewer(ctx)
+	if err != nil || v == nil || v.all {
+		return pins, err
+	}
+	pv, err := fs.visibility(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]string)
+	for id, ver := range pins {
+		if v.sees(pv.Packages[strings.ToLower(id)]) {
+			seen[id] = ver
+		}
+	}
+	return seen, nil
+}
+
+// parseVisibility reads a visibility value: "public", or a comma separated list of
+// configured group names
+func parseVisibility(c *Config, s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, visibilityPublic) {
+		return nil, nil
+	}
+	var groups []string
+	for _, g := range strings.Split(s, ",") {
+		g = strings.TrimSpace(g)
+		found := ""
+		for name := range c.Visibility.Groups {
+			if strings.EqualFold(name, g) {
+				found = name
+			}
+		}
+		if found == "" {
+			return nil, errors.New("visibility names an unknown group: " + g)
+		}
+		groups = append(groups, found)
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// checkPushVisibility returns an error if the request's key may not push the ID,
+// because the ID is restricted to groups the key isn't in, or may not restrict it
+// to the groups in the visibility header. The groups to apply are returned, nil
+// with no header.
+func checkPushVisibility(r *http.Request, id string) ([]string, int, error) {
+	vfs := server.visibility
+	if h, err := vfs.hidden(r.Context(), id); err != nil {
+		return nil, http.StatusInternalServerError, err
+	} else if h {
+		return nil, http.StatusForbidden, errors.New("package id " + id + " is reserved by another group")
+	}
+	hv := r.Header.Get(visibilityHeader)
+	if hv == "" {
+		return nil, 0, nil
+	}
+	c := server.Config()
+	if len(c.Visibility.Groups) == 0 {
+		return nil, http.StatusBadRequest, errors.New("no visibility groups are configured")
+	}
+	groups, err := parseVisibility(c, hv)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	// A key can't hide a package from itself
+	if groups != nil && !contextViewer(r.Context()).sees(groups) {
+		return nil, http.StatusBadRequest, errors.New("visibility must include a group the API key is in")
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	return groups, 0, nil
+}
+
+// visibilityEntry is a package ID's visibility as served by admin/visibility
+type visibilityEntry struct {
+	ID         string   `json:"id"`
+	Visibility []string `json:"visibility"`
+}
+
+// serveVisibility handles admin/visibility: GET lists the restricted IDs the key
+// can see, GET and PUT admin/visibility/{id} read and change one ID's visibility
+func serveVisibility(w http.ResponseWriter, r *http.Request) {
+	vfs := server.visibility
+	id := strings.Trim(r.URL.Path[len(server.URL.Path+`admin/visibility`):], `/`)
+
+	var out interface{}
+	switch {
+	case id == "" && r.Method != http.MethodPut:
+		pv, err := vfs.visibility(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		v := contextViewer(r.Context())
+		list := []visibilityEntry{}
+		for id, groups := range pv.Packages {
+			if v == nil || v.sees(groups) {
+				list = append(list, visibilityEntry{ID: id, Visibility: groups})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		out = list
+	case id != "" && !strings.Contains(id, "/"):
+		if h, err := vfs.hidden(r.Context(), id); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if h {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPut {
+			var req struct {
+				Visibility string `json:"visibility"`
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			if isBodyTooLarge(err) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if err := json.Unmarshal(b, &req); err != nil || req.Visibility == "" {
+				writeVisibilityError(w, `body must be {"visibility": "public"} or {"visibility": "group,group"}`)
+				return
+			}
+			r.Header.Set(visibilityHeader, req.Visibility)
+			groups, status, err := checkPushVisibility(r, id)
+			if err != nil && status == http.StatusBadRequest {
+				writeVisibilityError(w, err.Error())
+				return
+			} else if err != nil {
+				w.WriteHeader(status)
+				return
+			}
+			if err := vfs.setVisibility(r.Context(), id, groups); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		groups, err := vfs.groupsFor(r.Context(), id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if groups == nil {
+			groups = []string{}
+		}
+		out = visibilityEntry{ID: id, Visibility: groups}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// writeVisibilityError explains why a visibility change was refused
+func writeVisibilityError(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(msg))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Keys of the visibility test server. Reads are open, so anonymous requests are
+// let through as well.
+const (
+	teamAKey = "team-a-key"
+	teamBKey = "team-b-key"
+	opsKey   = "ops-key"
+)
+
+// newVisibilityTestServer starts a feed shared by two teams, each with a package
+// of their own, and a public package
+func newVisibilityTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ts := newTestServer(t, func(c *Config) {
+		c.FileStore.APIKeys.ReadOnly = nil
+		c.FileStore.APIKeys.ReadWrite = []string{teamAKey, teamBKey, opsKey}
+		c.Visibility.Groups = map[string][]string{"team-a": {teamAKey}, "team-b": {teamBKey}}
+		c.Visibility.AdminKeys = []string{opsKey}
+	})
+	for _, p := range []struct{ id, key, visibility string }{
+		{"A.Internal", teamAKey, "team-a"},
+		{"B.Internal", teamBKey, "team-b"},
+		{"Shared.Pkg", opsKey, ""},
+	} {
+		status, body := ts.pushVisible(t, testPackage(t, p.id, "1.0.0", "", nil), p.key, p.visibility)
+		wantStatus(t, "push "+p.id, status, body, http.StatusCreated)
+	}
+	return ts
+}
+
+// pushVisible pushes a package restricted to the groups named, if any
+func (ts *testServer) pushVisible(t *testing.T, pkg []byte, key string, visibility string) (int, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("package", "package.nupkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(pkg)
+	mw.Close()
+	header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+	if visibility != "" {
+		header.Set(visibilityHeader, visibility)
+	}
+	return readResponse(t, ts.do(t, http.MethodPut, "api/v2/package/", key, &buf, header))
+}
+
+// autocompleteIDs reads the package IDs of an autocomplete response, sorted
+func autocompleteIDs(t *testing.T, body string) []string {
+	t.Helper()
+	var res autocompleteResult
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	if res.TotalHits != len(res.Data) {
+		t.Errorf("totalHits %d for %q", res.TotalHits, res.Data)
+	}
+	sort.Strings(res.Data)
+	return res.Data
+}
+
+func TestVisibility(t *testing.T) {
+	ts := newVisibilityTestServer(t)
+
+	for _, tc := range []struct {
+		name string
+		key  string
+		sees []string
+	}{
+		{"team a", teamAKey, []string{"A.Internal", "Shared.Pkg"}},
+		{"team b", teamBKey, []string{"B.Internal", "Shared.Pkg"}},
+		{"anonymous", "", []string{"Shared.Pkg"}},
+		{"admin", opsKey, []string{"A.Internal", "B.Internal", "Shared.Pkg"}},
+		// The V3 documents are cached, so a team reading after the admin must
+		// still only get its own
+		{"team b after admin", teamBKey, []string{"B.Internal", "Shared.Pkg"}},
+	} {
+		get := func(p string) (int, string) {
+			return readResponse(t, ts.do(t, http.MethodGet, p, tc.key, nil, nil))
+		}
+		sees := make(map[string]bool)
+		for _, id := range tc.sees {
+			sees[id] = true
+		}
+		var want []string
+		for _, id := range tc.sees {
+			want = append(want, id+" 1.0.0")
+		}
+
+		// Lists and their counts
+		for _, p := range []string{"Packages()", "Search()?searchTerm=''&includePrerelease=true"} {
+			status, body := get(p)
+			wantStatus(t, tc.name+" "+p, status, body, http.StatusOK)
+			got := feedIDs(t, body)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s: got %q, want %q", tc.name, p, got, want)
+			}
+			cp := strings.Replace(p, "()", "()/$count", 1)
+			status, body = get(cp)
+			wantStatus(t, tc.name+" "+cp, status, body, http.StatusOK)
+			if body != strconv.Itoa(len(want)) {
+				t.Errorf("%s %s: got %s, want %d", tc.name, cp, body, len(want))
+			}
+		}
+		status, body := get("autocomplete?q=&prerelease=true")
+		wantStatus(t, tc.name+" autocomplete", status, body, http.StatusOK)
+		if got := autocompleteIDs(t, body); !reflect.DeepEqual(got, tc.sees) {
+			t.Errorf("%s autocomplete: got %q, want %q", tc.name, got, tc.sees)
+		}
+
+		// A hidden package answers as one that doesn't exist
+		for _, id := range []string{"A.Internal", "B.Internal", "Shared.Pkg"} {
+			lower := strings.ToLower(id)
+			status, body := get("FindPackagesById()?id='" + id + "'")
+			wantStatus(t, tc.name+" FindPackagesById "+id, status, body, http.StatusOK)
+			if got := len(feedIDs(t, body)); got != map[bool]int{true: 1, false: 0}[sees[id]] {
+				t.Errorf("%s FindPackagesById %s: got %d entries", tc.name, id, got)
+			}
+			for _, p := range []string{
+				"Packages(Id='" + id + "',Version='1.0.0')",
+				"v3-flatcontainer/" + lower + "/index.json",
+				"v3-flatcontainer/" + lower + "/1.0.0/" + lower + ".1.0.0.nupkg",
+				"v3/registration/" + lower + "/index.json",
+				"nupkg/" + id + "/1.0.0",
+			} {
+				status, body := get(p)
+				missing, missingBody := get(strings.Replace(strings.Replace(p, id, "No.Such", -1), lower, "no.such", -1))
+				switch {
+				case sees[id] && status != http.StatusOK:
+					t.Errorf("%s %s: got %d %.100s, want 200", tc.name, p, status, body)
+				case !sees[id] && (status != http.StatusNotFound || status != missing || body != missingBody):
+					t.Errorf("%s %s: got %d %.100s, want what a missing package gets, %d %.100s", tc.name, p, status, body, missing, missingBody)
+				}
+			}
+		}
+	}
+}
+
+// A team can't push over, or change, an ID restricted to another
+func TestVisibilityOtherTeam(t *testing.T) {
+	ts := newVisibilityTestServer(t)
+
+	status, body := ts.pushVisible(t, testPackage(t, "A.Internal", "2.0.0", "", nil), teamBKey, "")
+	wantStatus(t, "push over team a", status, body, http.StatusForbidden)
+	status, body = ts.pushVisible(t, testPackage(t, "B.Other", "1.0.0", "", nil), teamBKey, "team-a")
+	wantStatus(t, "push for team a", status, body, http.StatusBadRequest)
+	if !strings.Contains(body, "a group the API key is in") {
+		t.Errorf("push for team a: got %s", body)
+	}
+
+	// Making a package public shows it to everyone
+	status, body = readResponse(t, ts.do(t, http.MethodPut, "admin/visibility/A.Internal", teamAKey, strings.NewReader(`{"visibility": "public"}`), nil))
+	if status >= 300 {
+		t.Fatalf("make public: got %d %s", status, body)
+	}
+	status, body = readResponse(t, ts.do(t, http.MethodGet, "nupkg/A.Internal/1.0.0", "", nil, nil))
+	wantStatus(t, "anonymous download once public", status, body, http.StatusOK)
+}
+
+// A push that's refused leaves its ID's visibility as it was
+func TestVisibilityRejectedPush(t *testing.T) {
+	ts := newVisibilityTestServer(t)
+	visibility := func(id string) []string {
+		t.Helper()
+		status, body := readResponse(t, ts.do(t, http.MethodGet, "admin/visibility/"+id, opsKey, nil, nil))
+		wantStatus(t, "visibility of "+id, status, body, http.StatusOK)
+		var e visibilityEntry
+		if err := json.Unmarshal([]byte(body), &e); err != nil {
+			t.Fatal(err)
+		}
+		return e.Visibility
+	}
+
+	for _, tc := range []struct {
+		name   string
+		pkg    []byte
+		key    string
+		status int
+		id     string
+		want   []string
+	}{
+		{"new id over an extraction limit", testPackage(t, "A.New", "1.0.0", "", map[string]string{"content/../x": "x"}), teamAKey, http.StatusBadRequest, "A.New", []string{}},
+		{"different bytes of a public version", testPackage(t, "Shared.Pkg", "1.0.0", "<title>Changed</title>", nil), opsKey, http.StatusConflict, "Shared.Pkg", []string{}},
+		{"restricted id over an extraction limit", testPackage(t, "A.Internal", "2.0.0", "", map[string]string{"content/../x": "x"}), opsKey, http.StatusBadRequest, "A.Internal", []string{"team-a"}},
+	} {
+		status, body := ts.pushVisible(t, tc.pkg, tc.key, "team-a,team-b")
+		wantStatus(t, tc.name, status, body, tc.status)
+		if got := visibility(tc.id); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: visibility %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	status, body := readResponse(t, ts.do(t, http.MethodGet, "nupkg/Shared.Pkg/1.0.0", "", nil, nil))
+	wantStatus(t, "anonymous download", status, body, http.StatusOK)
+
+	// Stored, the push's visibility stays
+	status, body = ts.pushVisible(t, testPackage(t, "A.New", "1.0.0", "", nil), teamAKey, "team-a,team-b")
+	wantStatus(t, "push", status, body, http.StatusCreated)
+	if got, want := visibility("A.New"), []string{"team-a", "team-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored: visibility %q, want %q", got, want)
+	}
+}